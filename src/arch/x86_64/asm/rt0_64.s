@@ -8,7 +8,7 @@ align 8
 
 ; Allocate space for the interrupt descriptor table (IDT).
 ; This arch supports up to 256 interrupt handlers
-%define IDT_ENTRIES 0xff
+%define IDT_ENTRIES 0x100
 _rt0_idt_start:
 	resq 2 * IDT_ENTRIES ; each 64-bit IDT entry is 16 bytes
 _rt0_idt_end:
@@ -159,11 +159,19 @@ ret
 ; code must be popped off the stack before calling iretq. The generated handlers 
 ; are aware whether they need to deal with the code or not and jump to the 
 ; appropriate get dispatcher.
+;
+; Vectors above the ones reserved for CPU exceptions (0x20 and up) are used by
+; external interrupts and IPIs which never push an error code. Their gate
+; handlers push the vector number in place of the code so that a single
+; handler can service all of them.
 ;------------------------------------------------------------------------------
 %assign gate_num 0 
 %rep    IDT_ENTRIES
 extern _rt0_interrupt_handlers
 _rt0_64_gate_entry_%+ gate_num:
+	%if gate_num >= 0x20
+		push qword gate_num
+	%endif
 	push rax
 	mov rax, _rt0_interrupt_handlers
 	add rax, 8*gate_num
@@ -172,7 +180,7 @@ _rt0_64_gate_entry_%+ gate_num:
 
 	; For a list of gate numbers that push an error code see:
 	; http://wiki.osdev.org/Exceptions
-	%if (gate_num == 8) || (gate_num >= 10 && gate_num <= 14) || (gate_num == 17) || (gate_num == 30)
+	%if (gate_num == 8) || (gate_num >= 10 && gate_num <= 14) || (gate_num == 17) || (gate_num == 30) || (gate_num >= 0x20)
 		jmp _rt0_64_gate_dispatcher_with_code
 	%else
 		jmp _rt0_64_gate_dispatcher_without_code
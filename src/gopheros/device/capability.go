@@ -0,0 +1,83 @@
+package device
+
+// Capability describes a set of optional features supported by a driver
+// and the hardware it manages.
+type Capability uint32
+
+const (
+	// CapDMA is set if the device can perform DMA transfers.
+	CapDMA Capability = 1 << iota
+
+	// CapMSI is set if the device can signal interrupts using message
+	// signaled interrupts.
+	CapMSI
+
+	// CapMSIX is set if the device supports MSI-X.
+	CapMSIX
+
+	// Cap64BitAddressing is set if the device can access physical
+	// addresses above 4G when performing DMA transfers.
+	Cap64BitAddressing
+
+	// CapHotplug is set if the device can be removed while the system is
+	// running.
+	CapHotplug
+
+	// capLast is the last defined capability.
+	capLast = CapHotplug
+)
+
+// capabilityNames contains the names of the capabilities in bit order.
+var capabilityNames = [...]string{"dma", "msi", "msix", "64bit", "hotplug"}
+
+// String implements fmt.Stringer for Capability. It returns a
+// comma-separated list with the names of the capabilities in the set.
+func (c Capability) String() string {
+	var (
+		names string
+		index int
+	)
+
+	for bit := Capability(1); bit <= capLast; bit, index = bit<<1, index+1 {
+		if c&bit == 0 {
+			continue
+		}
+
+		if names != "" {
+			names += ","
+		}
+		names += capabilityNames[index]
+	}
+
+	if names == "" {
+		return "none"
+	}
+
+	return names
+}
+
+// CapabilityProvider is an optional interface implemented by drivers that
+// can report the features supported by the device they manage. It allows
+// other kernel code to query a bound driver's features without having to
+// type-assert to the concrete driver type.
+type CapabilityProvider interface {
+	// DriverCapabilities returns the set of capabilities supported by
+	// the driver.
+	DriverCapabilities() Capability
+}
+
+// Capabilities returns the capabilities of the supplied driver or 0 if the
+// driver does not implement CapabilityProvider.
+func Capabilities(drv Driver) Capability {
+	if provider, ok := drv.(CapabilityProvider); ok {
+		return provider.DriverCapabilities()
+	}
+
+	return 0
+}
+
+// HasCapability returns true if the supplied driver supports all of the
+// requested capabilities.
+func HasCapability(drv Driver, caps Capability) bool {
+	return Capabilities(drv)&caps == caps
+}
@@ -0,0 +1,59 @@
+package device
+
+import "testing"
+
+func TestCapabilityString(t *testing.T) {
+	specs := []struct {
+		input Capability
+		exp   string
+	}{
+		{0, "none"},
+		{CapDMA, "dma"},
+		{CapDMA | CapMSI | Cap64BitAddressing, "dma,msi,64bit"},
+		{CapMSIX | CapHotplug | Capability(1<<31), "msix,hotplug"},
+	}
+
+	for specIndex, spec := range specs {
+		if got := spec.input.String(); got != spec.exp {
+			t.Errorf("[spec %d] expected %q; got %q", specIndex, spec.exp, got)
+		}
+	}
+}
+
+func TestHasCapability(t *testing.T) {
+	var (
+		nic   = &capabilityMockDriver{caps: CapDMA | CapMSI | Cap64BitAddressing}
+		plain = &mockDriver{}
+	)
+
+	specs := []struct {
+		drv  Driver
+		caps Capability
+		exp  bool
+	}{
+		{nic, CapDMA, true},
+		{nic, CapDMA | Cap64BitAddressing, true},
+		{nic, CapDMA | CapMSIX, false},
+		{nic, 0, true},
+		{plain, CapDMA, false},
+		{plain, 0, true},
+	}
+
+	for specIndex, spec := range specs {
+		if got := HasCapability(spec.drv, spec.caps); got != spec.exp {
+			t.Errorf("[spec %d] expected HasCapability(%s) to return %t; got %t", specIndex, spec.caps, spec.exp, got)
+		}
+	}
+
+	if got := Capabilities(plain); got != 0 {
+		t.Errorf("expected driver without capability support to report no capabilities; got %s", got)
+	}
+}
+
+type capabilityMockDriver struct {
+	mockDriver
+
+	caps Capability
+}
+
+func (d *capabilityMockDriver) DriverCapabilities() Capability { return d.caps }
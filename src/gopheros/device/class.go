@@ -0,0 +1,218 @@
+package device
+
+import (
+	"gopheros/kernel"
+	"io"
+	"strconv"
+)
+
+// Class describes a category of devices that expose a common interface to
+// the upper kernel layers.
+type Class uint8
+
+const (
+	// ClassBlock describes devices that implement BlockDevice.
+	ClassBlock Class = iota
+
+	// ClassChar describes devices that implement CharDevice.
+	ClassChar
+
+	// ClassNet describes devices that implement NetDevice.
+	ClassNet
+
+	// classCount is the number of supported device classes.
+	classCount
+)
+
+// String implements fmt.Stringer for Class.
+func (c Class) String() string {
+	switch c {
+	case ClassBlock:
+		return "block"
+	case ClassChar:
+		return "char"
+	case ClassNet:
+		return "net"
+	default:
+		return "unknown"
+	}
+}
+
+// namePrefix returns the prefix used for the names of the devices of this
+// class.
+func (c Class) namePrefix() string {
+	switch c {
+	case ClassBlock:
+		return "blk"
+	case ClassChar:
+		return "chr"
+	default:
+		return "net"
+	}
+}
+
+// implementedBy returns true if drv implements the interface of this class.
+func (c Class) implementedBy(drv Driver) bool {
+	var ok bool
+	switch c {
+	case ClassBlock:
+		_, ok = drv.(BlockDevice)
+	case ClassChar:
+		_, ok = drv.(CharDevice)
+	case ClassNet:
+		_, ok = drv.(NetDevice)
+	}
+
+	return ok
+}
+
+// BlockDevice is implemented by drivers for devices that store data in
+// fixed-size blocks (e.g. disks).
+type BlockDevice interface {
+	Driver
+
+	// BlockSize returns the size of each block in bytes.
+	BlockSize() uint32
+
+	// BlockCount returns the number of blocks provided by the device.
+	BlockCount() uint64
+
+	// ReadBlocks reads len(buf)/BlockSize() consecutive blocks starting at
+	// the specified block into buf. The length of buf must be a multiple
+	// of the block size.
+	ReadBlocks(block uint64, buf []byte) *kernel.Error
+
+	// WriteBlocks writes the contents of buf to len(buf)/BlockSize()
+	// consecutive blocks starting at the specified block. The length of
+	// buf must be a multiple of the block size.
+	WriteBlocks(block uint64, buf []byte) *kernel.Error
+}
+
+// CharDevice is implemented by drivers for devices that transfer data as a
+// stream of bytes (e.g. serial ports).
+type CharDevice interface {
+	Driver
+	io.Reader
+	io.Writer
+}
+
+// RxFn is a function invoked by network devices for each received frame.
+// The frame contents are only valid for the duration of the call.
+type RxFn func(frame []byte)
+
+// NetDevice is implemented by drivers for devices that send and receive
+// network frames.
+type NetDevice interface {
+	Driver
+
+	// HardwareAddr returns the MAC address of the device.
+	HardwareAddr() [6]byte
+
+	// MTU returns the max size of a frame payload in bytes.
+	MTU() uint32
+
+	// Transmit queues a frame for transmission.
+	Transmit(frame []byte) *kernel.Error
+
+	// SetReceiver registers the function that is invoked for each
+	// received frame. Passing nil drops all received frames.
+	SetReceiver(fn RxFn)
+}
+
+// ClassDevice describes a device registered with a device class.
+type ClassDevice struct {
+	// Name is assigned when the device is registered and consists of a
+	// class-specific prefix and a sequence number (e.g. "blk0").
+	Name string
+
+	Class Class
+
+	// Driver implements the interface of the device class.
+	Driver Driver
+}
+
+var (
+	// classDevices tracks the devices registered with each class.
+	classDevices [classCount][]*ClassDevice
+
+	// classNextIndex tracks the sequence number that is assigned to the
+	// next device registered with each class. Sequence numbers are not
+	// reused when devices are unregistered.
+	classNextIndex [classCount]int
+
+	errUnknownDeviceClass       = &kernel.Error{Module: "device", Message: "unknown device class"}
+	errDeviceClassMismatch      = &kernel.Error{Module: "device", Message: "driver does not implement the device class interface"}
+	errClassDeviceExists        = &kernel.Error{Module: "device", Message: "driver is already registered with the device class"}
+	errClassDeviceNotRegistered = &kernel.Error{Module: "device", Message: "device is not registered with its device class"}
+)
+
+// RegisterClassDevice registers a driver that implements the interface of
+// the supplied device class so that upper layers (e.g. the VFS or the
+// network stack) can discover it via ClassDevices. The returned ClassDevice
+// contains the name assigned to the device.
+func RegisterClassDevice(class Class, drv Driver) (*ClassDevice, *kernel.Error) {
+	if class >= classCount {
+		return nil, errUnknownDeviceClass
+	}
+
+	if !class.implementedBy(drv) {
+		return nil, errDeviceClassMismatch
+	}
+
+	for _, dev := range classDevices[class] {
+		if dev.Driver == drv {
+			return nil, errClassDeviceExists
+		}
+	}
+
+	dev := &ClassDevice{
+		Name:   class.namePrefix() + strconv.Itoa(classNextIndex[class]),
+		Class:  class,
+		Driver: drv,
+	}
+	classNextIndex[class]++
+	classDevices[class] = append(classDevices[class], dev)
+	return dev, nil
+}
+
+// UnregisterClassDevice removes a device registered via RegisterClassDevice.
+func UnregisterClassDevice(dev *ClassDevice) *kernel.Error {
+	if dev.Class >= classCount {
+		return errUnknownDeviceClass
+	}
+
+	devs := classDevices[dev.Class]
+	for index, registered := range devs {
+		if registered == dev {
+			classDevices[dev.Class] = append(devs[:index], devs[index+1:]...)
+			return nil
+		}
+	}
+
+	return errClassDeviceNotRegistered
+}
+
+// ClassDevices returns the devices registered with the supplied class in
+// the order they were registered. Callers must not modify the contents of
+// the returned slice.
+func ClassDevices(class Class) []*ClassDevice {
+	if class >= classCount {
+		return nil
+	}
+
+	return classDevices[class]
+}
+
+// FindClassDevice returns the registered device with the supplied name or
+// nil if no such device exists.
+func FindClassDevice(name string) *ClassDevice {
+	for _, devs := range classDevices {
+		for _, dev := range devs {
+			if dev.Name == name {
+				return dev
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,140 @@
+package device
+
+import (
+	"gopheros/kernel"
+	"reflect"
+	"testing"
+)
+
+func TestClassString(t *testing.T) {
+	specs := []struct {
+		input Class
+		exp   string
+	}{
+		{ClassBlock, "block"},
+		{ClassChar, "char"},
+		{ClassNet, "net"},
+		{Class(42), "unknown"},
+	}
+
+	for specIndex, spec := range specs {
+		if got := spec.input.String(); got != spec.exp {
+			t.Errorf("[spec %d] expected %q; got %q", specIndex, spec.exp, got)
+		}
+	}
+}
+
+func TestClassDevices(t *testing.T) {
+	defer func() {
+		classDevices = [classCount][]*ClassDevice{}
+		classNextIndex = [classCount]int{}
+	}()
+
+	var (
+		disk0  = &mockBlockDevice{mockDriver: mockDriver{name: "ahci"}}
+		disk1  = &mockBlockDevice{mockDriver: mockDriver{name: "ahci"}}
+		serial = &mockCharDevice{mockDriver: mockDriver{name: "serial"}}
+		nic    = &mockNetDevice{mockDriver: mockDriver{name: "e1000"}}
+	)
+
+	regSpecs := []struct {
+		class   Class
+		drv     Driver
+		expName string
+		expErr  *kernel.Error
+	}{
+		{ClassBlock, disk0, "blk0", nil},
+		{ClassBlock, disk1, "blk1", nil},
+		{ClassChar, serial, "chr0", nil},
+		{ClassNet, nic, "net0", nil},
+		{ClassBlock, disk0, "", errClassDeviceExists},
+		{ClassChar, disk0, "", errDeviceClassMismatch},
+		{ClassNet, serial, "", errDeviceClassMismatch},
+		{ClassBlock, &mockDriver{}, "", errDeviceClassMismatch},
+		{Class(42), nic, "", errUnknownDeviceClass},
+	}
+
+	var registered []*ClassDevice
+	for specIndex, spec := range regSpecs {
+		dev, err := RegisterClassDevice(spec.class, spec.drv)
+		if err != spec.expErr {
+			t.Errorf("[spec %d] expected error %v; got %v", specIndex, spec.expErr, err)
+			continue
+		}
+
+		if err != nil {
+			continue
+		}
+
+		if dev.Name != spec.expName || dev.Class != spec.class || dev.Driver != spec.drv {
+			t.Errorf("[spec %d] unexpected class device %+v", specIndex, dev)
+		}
+		registered = append(registered, dev)
+	}
+
+	if exp, got := registered[:2], ClassDevices(ClassBlock); !reflect.DeepEqual(got, exp) {
+		t.Fatalf("expected block devices to be %v; got %v", exp, got)
+	}
+
+	if got := ClassDevices(Class(42)); got != nil {
+		t.Fatalf("expected no devices for unknown class; got %v", got)
+	}
+
+	if got := FindClassDevice("net0"); got != registered[3] {
+		t.Fatalf("expected to find net0; got %v", got)
+	}
+
+	if got := FindClassDevice("blk2"); got != nil {
+		t.Fatalf("expected not to find blk2; got %v", got)
+	}
+
+	unregSpecs := []struct {
+		dev    *ClassDevice
+		expErr *kernel.Error
+	}{
+		{registered[0], nil},
+		{registered[0], errClassDeviceNotRegistered},
+		{&ClassDevice{Class: Class(42)}, errUnknownDeviceClass},
+	}
+
+	for specIndex, spec := range unregSpecs {
+		if err := UnregisterClassDevice(spec.dev); err != spec.expErr {
+			t.Errorf("[spec %d] expected error %v; got %v", specIndex, spec.expErr, err)
+		}
+	}
+
+	// Names are not reused after a device is unregistered
+	dev, err := RegisterClassDevice(ClassBlock, disk0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if dev.Name != "blk2" {
+		t.Fatalf("expected re-registered device to be named blk2; got %q", dev.Name)
+	}
+}
+
+type mockBlockDevice struct {
+	mockDriver
+}
+
+func (d *mockBlockDevice) BlockSize() uint32                            { return 512 }
+func (d *mockBlockDevice) BlockCount() uint64                           { return 0 }
+func (d *mockBlockDevice) ReadBlocks(_ uint64, _ []byte) *kernel.Error  { return nil }
+func (d *mockBlockDevice) WriteBlocks(_ uint64, _ []byte) *kernel.Error { return nil }
+
+type mockCharDevice struct {
+	mockDriver
+}
+
+func (d *mockCharDevice) Read(_ []byte) (int, error)  { return 0, nil }
+func (d *mockCharDevice) Write(_ []byte) (int, error) { return 0, nil }
+
+type mockNetDevice struct {
+	mockDriver
+}
+
+func (d *mockNetDevice) HardwareAddr() [6]byte           { return [6]byte{} }
+func (d *mockNetDevice) MTU() uint32                     { return 1500 }
+func (d *mockNetDevice) Transmit(_ []byte) *kernel.Error { return nil }
+func (d *mockNetDevice) SetReceiver(_ RxFn)              {}
@@ -14,9 +14,41 @@ type Driver interface {
 	DriverVersion() (major uint16, minor uint16, patch uint16)
 
 	// DriverInit initializes the device driver. If the driver init code
-	// needs to log some output, it can use the supplied io.Writer in
-	// conjunction with a call to kfmt.Fprint.
-	DriverInit(io.Writer) *kernel.Error
+	// needs to log some output, it can use the supplied Logger which
+	// attributes the output to the driver and filters it according to
+	// the driver's log level. The Logger can also be used as an io.Writer
+	// in conjunction with a call to kfmt.Fprint.
+	DriverInit(*Logger) *kernel.Error
+}
+
+// Shutdowner is an optional interface implemented by drivers that need to
+// quiesce their hardware before the system is powered off or rebooted.
+type Shutdowner interface {
+	// DriverShutdown stops the device. No other driver methods are
+	// invoked after a call to DriverShutdown.
+	DriverShutdown() *kernel.Error
+}
+
+// Suspender is an optional interface implemented by drivers that need to
+// save and restore the state of their hardware when the system enters and
+// leaves a sleep state.
+type Suspender interface {
+	// DriverSuspend saves the device state and stops the device.
+	DriverSuspend() *kernel.Error
+
+	// DriverResume restores the device state saved by DriverSuspend.
+	DriverResume() *kernel.Error
+}
+
+// SelfTester is an optional interface implemented by drivers that can run
+// sanity checks against the hardware they manage. Self-tests are invoked by
+// the hal package after all drivers have been initialized if the kernel
+// was booted with the "selftest=on" command line parameter.
+type SelfTester interface {
+	// DriverSelfTest runs the driver self-tests and returns an error if
+	// any of them fails. Diagnostic output can be written to the supplied
+	// io.Writer.
+	DriverSelfTest(w io.Writer) *kernel.Error
 }
 
 // ProbeFn is a function that scans for the presence of a particular
@@ -50,6 +82,27 @@ const (
 
 // DriverInfo is a driver-defined struct that is passed to calls to RegisterDriver.
 type DriverInfo struct {
+	// Name identifies the driver when other drivers declare a dependency
+	// on it. It should match the value returned by the driver's
+	// DriverName method.
+	Name string
+
+	// DependsOn lists the names of the drivers (or the functions listed in
+	// the Provides field of other drivers) that must be successfully
+	// initialized before the probe function of this driver is invoked.
+	DependsOn []string
+
+	// Provides optionally names the function implemented by the driver
+	// (e.g. "clocksource"). Drivers that provide the same function are
+	// treated as alternatives: the hal package probes them in order of
+	// decreasing Priority and only initializes the first one that
+	// probes successfully.
+	Provides string
+
+	// Priority ranks drivers that provide the same function. Drivers with
+	// a higher priority are probed first.
+	Priority int
+
 	// Order specifies at which stage of the HW detection step should
 	// the probe function be invoked.
 	Order DetectOrder
@@ -71,10 +124,92 @@ func (l DriverInfoList) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
 // Less compares 2 elements of the driver info list.
 func (l DriverInfoList) Less(i, j int) bool { return l[i].Order < l[j].Order }
 
+// Resolve returns a copy of the driver info list sorted so that each driver
+// appears after all of its dependencies. Drivers that do not depend on each
+// other are sorted by their detection order and then by decreasing priority;
+// drivers with the same detection order and priority retain their relative
+// order in the list. A dependency on a function listed in the Provides
+// field is satisfied once all drivers providing that function are placed.
+//
+// Drivers that depend on drivers that are not part of the list or that are
+// part of a dependency cycle cannot be ordered; they are excluded from the
+// sorted list and returned via the second return value instead.
+func (l DriverInfoList) Resolve() (sorted, unresolved DriverInfoList) {
+	var (
+		placed  = make([]bool, len(l))
+		pending = len(l)
+	)
+
+	sorted = make(DriverInfoList, 0, len(l))
+	for pending != 0 {
+		// Select the ready driver with the lowest detection order and
+		// the highest priority; ties are broken by the position in the
+		// list.
+		next := -1
+		for index, info := range l {
+			if placed[index] || !l.dependenciesPlaced(info, placed) {
+				continue
+			}
+
+			if next == -1 || info.Order < l[next].Order ||
+				(info.Order == l[next].Order && info.Priority > l[next].Priority) {
+				next = index
+			}
+		}
+
+		if next == -1 {
+			break
+		}
+
+		placed[next] = true
+		sorted = append(sorted, l[next])
+		pending--
+	}
+
+	for index, info := range l {
+		if !placed[index] {
+			unresolved = append(unresolved, info)
+		}
+	}
+
+	return sorted, unresolved
+}
+
+// dependenciesPlaced returns true if all dependencies of the supplied driver
+// refer to drivers in the list that have been marked as placed.
+func (l DriverInfoList) dependenciesPlaced(info *DriverInfo, placed []bool) bool {
+	for _, dep := range info.DependsOn {
+		found := false
+		for index, other := range l {
+			if other.Name != dep && other.Provides != dep {
+				continue
+			}
+
+			if !placed[index] {
+				return false
+			}
+			found = true
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
 var (
 	// registeredDrivers tracks the drivers registered via a call to
 	// RegisterDriver.
 	registeredDrivers DriverInfoList
+
+	// ErrProbeDeferred can be returned by DriverInit to indicate that the
+	// driver cannot be initialized until some other driver (e.g. the
+	// driver for the bus the device is attached to) has been initialized.
+	// The hal package retries the initialization of deferred drivers after
+	// the remaining drivers have been probed.
+	ErrProbeDeferred = &kernel.Error{Module: "device", Message: "probe deferred"}
 )
 
 // RegisterDriver adds the supplied driver info to the list of registered
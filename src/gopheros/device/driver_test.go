@@ -1,6 +1,7 @@
 package device
 
 import (
+	"reflect"
 	"sort"
 	"testing"
 )
@@ -34,3 +35,71 @@ func TestDriverInfoListSorting(t *testing.T) {
 		}
 	}
 }
+
+func TestDriverInfoListResolve(t *testing.T) {
+	var (
+		acpi   = &DriverInfo{Name: "acpi", Order: DetectOrderBeforeACPI}
+		ioapic = &DriverInfo{Name: "ioapic", DependsOn: []string{"acpi"}, Order: DetectOrderEarly}
+		pci    = &DriverInfo{Name: "pci", DependsOn: []string{"acpi", "ioapic"}}
+		vt     = &DriverInfo{Name: "vt", Order: DetectOrderEarly}
+		cons   = &DriverInfo{Name: "console", Order: DetectOrderEarly}
+		last   = &DriverInfo{Name: "last", Order: DetectOrderLast}
+		cycleA = &DriverInfo{Name: "a", DependsOn: []string{"b"}}
+		cycleB = &DriverInfo{Name: "b", DependsOn: []string{"a"}}
+		orphan = &DriverInfo{Name: "orphan", DependsOn: []string{"missing"}}
+		child  = &DriverInfo{Name: "child", DependsOn: []string{"orphan"}, Order: DetectOrderEarly}
+	)
+
+	list := DriverInfoList{last, pci, cycleA, ioapic, vt, orphan, acpi, cycleB, child, cons}
+	sorted, unresolved := list.Resolve()
+
+	expSorted := DriverInfoList{vt, cons, acpi, ioapic, pci, last}
+	if !reflect.DeepEqual(sorted, expSorted) {
+		t.Errorf("expected sorted list to be:\n%v\ngot:\n%v", driverNames(expSorted), driverNames(sorted))
+	}
+
+	expUnresolved := DriverInfoList{cycleA, orphan, cycleB, child}
+	if !reflect.DeepEqual(unresolved, expUnresolved) {
+		t.Errorf("expected unresolved list to be:\n%v\ngot:\n%v", driverNames(expUnresolved), driverNames(unresolved))
+	}
+
+	// The original list should not be modified
+	if list[0] != last || list[9] != cons {
+		t.Error("expected Resolve not to modify the original list")
+	}
+}
+
+func TestDriverInfoListResolveAlternatives(t *testing.T) {
+	var (
+		pit     = &DriverInfo{Name: "pit", Provides: "clocksource"}
+		hpet    = &DriverInfo{Name: "hpet", Provides: "clocksource", Priority: 100, DependsOn: []string{"acpi"}}
+		pmtimer = &DriverInfo{Name: "acpi_pm", Provides: "clocksource", Priority: 50, DependsOn: []string{"acpi"}}
+		acpi    = &DriverInfo{Name: "acpi", Order: DetectOrderBeforeACPI}
+		sched   = &DriverInfo{Name: "sched", DependsOn: []string{"clocksource"}, Order: DetectOrderEarly}
+		rtc     = &DriverInfo{Name: "rtc", DependsOn: []string{"wallclock"}}
+	)
+
+	list := DriverInfoList{sched, pit, pmtimer, rtc, hpet, acpi}
+	sorted, unresolved := list.Resolve()
+
+	// Alternatives are sorted by decreasing priority and drivers that
+	// depend on a provided function are placed after all its providers.
+	expSorted := DriverInfoList{acpi, hpet, pmtimer, pit, sched}
+	if !reflect.DeepEqual(sorted, expSorted) {
+		t.Errorf("expected sorted list to be:\n%v\ngot:\n%v", driverNames(expSorted), driverNames(sorted))
+	}
+
+	expUnresolved := DriverInfoList{rtc}
+	if !reflect.DeepEqual(unresolved, expUnresolved) {
+		t.Errorf("expected unresolved list to be:\n%v\ngot:\n%v", driverNames(expUnresolved), driverNames(unresolved))
+	}
+}
+
+func driverNames(list DriverInfoList) []string {
+	names := make([]string, 0, len(list))
+	for _, info := range list {
+		names = append(names, info.Name)
+	}
+
+	return names
+}
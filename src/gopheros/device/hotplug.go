@@ -0,0 +1,80 @@
+package device
+
+// EventType describes the type of a device event.
+type EventType uint8
+
+const (
+	// DeviceAdded is published after a device has been attached to the
+	// registry and a driver has been bound to it (if a matching binding
+	// was found).
+	DeviceAdded EventType = iota
+
+	// DeviceRemoved is published after a device has been detached from
+	// the registry and its driver has been shut down.
+	DeviceRemoved
+)
+
+// String implements fmt.Stringer for EventType.
+func (t EventType) String() string {
+	switch t {
+	case DeviceAdded:
+		return "added"
+	case DeviceRemoved:
+		return "removed"
+	default:
+		return "unknown"
+	}
+}
+
+// Event describes a change to the set of devices attached to the registry.
+type Event struct {
+	Type   EventType
+	Device *Node
+}
+
+// EventFn is a function that is invoked for each published device event.
+type EventFn func(Event)
+
+// Subscription is returned by EventBus.Subscribe and identifies a subscriber.
+type Subscription struct {
+	fn EventFn
+}
+
+// EventBus delivers device events to a list of subscribers. Bus drivers
+// (e.g. the ACPI hotplug notification handler or a USB hub driver) do not
+// publish events directly; they attach and detach devices using the
+// registry which publishes the appropriate events to its event bus.
+type EventBus struct {
+	subscribers []*Subscription
+}
+
+// Subscribe registers fn to be invoked for each event published to the bus.
+// Events are delivered synchronously in the order the subscribers were
+// registered.
+func (b *EventBus) Subscribe(fn EventFn) *Subscription {
+	sub := &Subscription{fn: fn}
+	b.subscribers = append(b.subscribers, sub)
+	return sub
+}
+
+// Unsubscribe removes a subscriber from the bus. It is safe to invoke
+// Unsubscribe from within an event handler.
+func (b *EventBus) Unsubscribe(sub *Subscription) {
+	// Build a new slice so that any in-progress Publish calls can
+	// continue iterating the previous list of subscribers.
+	subscribers := make([]*Subscription, 0, len(b.subscribers))
+	for _, registered := range b.subscribers {
+		if registered != sub {
+			subscribers = append(subscribers, registered)
+		}
+	}
+
+	b.subscribers = subscribers
+}
+
+// Publish delivers ev to all subscribers.
+func (b *EventBus) Publish(ev Event) {
+	for _, sub := range b.subscribers {
+		sub.fn(ev)
+	}
+}
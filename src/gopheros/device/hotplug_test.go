@@ -0,0 +1,135 @@
+package device
+
+import (
+	"bytes"
+	"gopheros/kernel"
+	"reflect"
+	"testing"
+)
+
+func TestEventTypeString(t *testing.T) {
+	specs := []struct {
+		input EventType
+		exp   string
+	}{
+		{DeviceAdded, "added"},
+		{DeviceRemoved, "removed"},
+		{EventType(42), "unknown"},
+	}
+
+	for specIndex, spec := range specs {
+		if got := spec.input.String(); got != spec.exp {
+			t.Errorf("[spec %d] expected %q; got %q", specIndex, spec.exp, got)
+		}
+	}
+}
+
+func TestEventBus(t *testing.T) {
+	var (
+		bus      EventBus
+		received []string
+		dev      = &Node{Name: "usb0"}
+		sub1     *Subscription
+	)
+
+	sub1 = bus.Subscribe(func(ev Event) {
+		received = append(received, "sub1 "+ev.Type.String())
+		bus.Unsubscribe(sub1)
+	})
+	bus.Subscribe(func(ev Event) {
+		received = append(received, "sub2 "+ev.Type.String())
+	})
+
+	bus.Publish(Event{Type: DeviceAdded, Device: dev})
+	bus.Publish(Event{Type: DeviceRemoved, Device: dev})
+
+	exp := []string{"sub1 added", "sub2 added", "sub2 removed"}
+	if !reflect.DeepEqual(received, exp) {
+		t.Fatalf("expected received events to be %v; got %v", exp, received)
+	}
+}
+
+func TestRegistryHotplugEvents(t *testing.T) {
+	var (
+		buf      bytes.Buffer
+		r        = Registry{out: &buf}
+		received []hotplugRecord
+
+		hub   = &Node{Name: "hub0", Bus: "usb", IDs: []string{"hub"}}
+		port1 = &Node{Name: "port1", Bus: "usb", IDs: []string{"storage"}}
+		port2 = &Node{Name: "port2", Bus: "usb"}
+	)
+
+	r.RegisterBinding(&Binding{
+		Matches: []Match{{Bus: "usb", ID: "hub"}},
+		Bind: func(_ *Node) Driver {
+			return &shutdownMockDriver{mockDriver: mockDriver{name: "usbhub"}}
+		},
+	})
+	r.RegisterBinding(&Binding{
+		Matches: []Match{{Bus: "usb", ID: "storage"}},
+		Bind: func(_ *Node) Driver {
+			return &shutdownMockDriver{
+				mockDriver:  mockDriver{name: "usbstorage"},
+				shutdownErr: &kernel.Error{Module: "test", Message: "device busy"},
+			}
+		},
+	})
+
+	r.Events().Subscribe(func(ev Event) {
+		received = append(received, hotplugRecord{ev.Device.Name, ev.Type, ev.Device.Driver != nil})
+	})
+
+	for _, spec := range []struct{ parent, dev *Node }{{nil, hub}, {hub, port1}, {hub, port2}} {
+		if err := r.AddDevice(spec.parent, spec.dev); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	hubDrv := hub.Driver.(*shutdownMockDriver)
+	storageDrv := port1.Driver.(*shutdownMockDriver)
+
+	buf.Reset()
+	if err := r.RemoveDevice(hub); err != nil {
+		t.Fatal(err)
+	}
+
+	exp := []hotplugRecord{
+		{"hub0", DeviceAdded, true},
+		{"port1", DeviceAdded, true},
+		{"port2", DeviceAdded, false},
+		{"port1", DeviceRemoved, false},
+		{"port2", DeviceRemoved, false},
+		{"hub0", DeviceRemoved, false},
+	}
+	if !reflect.DeepEqual(received, exp) {
+		t.Fatalf("expected received events to be:\n%v\ngot:\n%v", exp, received)
+	}
+
+	if hubDrv.shutdownCount != 1 || storageDrv.shutdownCount != 1 {
+		t.Fatalf("expected removed drivers to be shut down once; got %d, %d", hubDrv.shutdownCount, storageDrv.shutdownCount)
+	}
+
+	if exp, got := "[device] /hub0/port1: usbstorage: shutdown failed: device busy\n", buf.String(); got != exp {
+		t.Fatalf("expected output to be:\n%q\ngot:\n%q", exp, got)
+	}
+}
+
+// hotplugRecord captures the state of a device when an event is received.
+type hotplugRecord struct {
+	name  string
+	typ   EventType
+	bound bool
+}
+
+type shutdownMockDriver struct {
+	mockDriver
+
+	shutdownErr   *kernel.Error
+	shutdownCount int
+}
+
+func (d *shutdownMockDriver) DriverShutdown() *kernel.Error {
+	d.shutdownCount++
+	return d.shutdownErr
+}
@@ -0,0 +1,314 @@
+// Package ioapic provides a driver for the I/O APIC interrupt controllers
+// that route external interrupts to the local APICs of the system CPUs.
+package ioapic
+
+import (
+	"gopheros/device"
+	"gopheros/kernel"
+	"gopheros/kernel/mem"
+	"gopheros/kernel/mem/vmm"
+	"unsafe"
+)
+
+const (
+	// maxControllers defines the max number of I/O APICs that can be
+	// registered via AddController.
+	maxControllers = 8
+
+	// isaIRQCount is the number of legacy ISA IRQs.
+	isaIRQCount = 16
+
+	// The I/O APIC registers are accessed indirectly by writing the
+	// register index to the select register and then accessing the
+	// window register.
+	regSelect = 0x00
+	regWindow = 0x10
+	mmioSize  = mem.Size(0x20)
+
+	regVersion    = 0x01
+	regRedirTable = 0x10
+
+	// Redirection table entry bits.
+	redirPolarityLow  = 1 << 13
+	redirTriggerLevel = 1 << 15
+	redirMasked       = 1 << 16
+	redirDestShift    = 24
+)
+
+// Polarity describes the signal polarity of an interrupt line.
+type Polarity uint8
+
+const (
+	// PolarityActiveHigh is the polarity of ISA interrupts.
+	PolarityActiveHigh Polarity = iota
+
+	// PolarityActiveLow is the polarity of PCI interrupts.
+	PolarityActiveLow
+)
+
+// TriggerMode describes whether an interrupt is edge or level triggered.
+type TriggerMode uint8
+
+const (
+	// TriggerEdge is the trigger mode of ISA interrupts.
+	TriggerEdge TriggerMode = iota
+
+	// TriggerLevel is the trigger mode of PCI interrupts.
+	TriggerLevel
+)
+
+// Route describes how a global system interrupt (GSI) is delivered to the
+// CPUs.
+type Route struct {
+	// Vector is the IDT vector raised when the interrupt fires.
+	Vector uint8
+
+	// Dest is the APIC ID of the CPU that receives the interrupt.
+	Dest uint8
+
+	Polarity Polarity
+	Trigger  TriggerMode
+}
+
+// controller describes an I/O APIC.
+type controller struct {
+	id       uint8
+	physAddr uintptr
+	gsiBase  uint32
+
+	// The following fields are populated when the driver is initialized.
+	regs    uintptr
+	entries uint32
+}
+
+// resource returns the register window of the controller.
+func (ctrl *controller) resource() device.Resource {
+	return device.Resource{Type: device.ResourceMemory, Base: uint64(ctrl.physAddr), Length: uint64(mmioSize)}
+}
+
+// sourceOverride describes how a legacy ISA IRQ is connected to the I/O
+// APICs.
+type sourceOverride struct {
+	gsi      uint32
+	polarity Polarity
+	trigger  TriggerMode
+}
+
+var (
+	// The following functions are used by tests to mock calls to the vmm
+	// package and to the controller registers and are automatically
+	// inlined by the compiler.
+	mapMMIOFn       = vmm.MapMMIO
+	unmapMMIOFn     = vmm.UnmapMMIO
+	readRegisterFn  = readRegister
+	writeRegisterFn = writeRegister
+
+	controllers     [maxControllers]controller
+	controllerCount int
+
+	// overrides describes the connection of each ISA IRQ. By default,
+	// ISA IRQs are identity-mapped to GSIs.
+	overrides [isaIRQCount]*sourceOverride
+
+	// initialized is set once the driver has mapped the controllers.
+	initialized bool
+
+	errTooManyControllers = &kernel.Error{Module: "ioapic", Message: "max number of I/O APICs reached"}
+	errInvalidISAIRQ      = &kernel.Error{Module: "ioapic", Message: "invalid ISA IRQ"}
+	errNotInitialized     = &kernel.Error{Module: "ioapic", Message: "I/O APIC driver not initialized"}
+	errNoControllerForGSI = &kernel.Error{Module: "ioapic", Message: "GSI is not handled by any I/O APIC"}
+)
+
+// AddController registers an I/O APIC with the supplied ID, physical
+// register address and first GSI. It is invoked with the contents of the
+// MADT I/O APIC entries before the driver is probed.
+func AddController(id uint8, physAddr uintptr, gsiBase uint32) *kernel.Error {
+	if controllerCount == maxControllers {
+		return errTooManyControllers
+	}
+
+	controllers[controllerCount] = controller{id: id, physAddr: physAddr, gsiBase: gsiBase}
+	controllerCount++
+	return nil
+}
+
+// AddSourceOverride records that the supplied ISA IRQ is connected to gsi
+// using the specified polarity and trigger mode. It is invoked with the
+// contents of the MADT interrupt source override entries.
+func AddSourceOverride(isaIRQ uint8, gsi uint32, polarity Polarity, trigger TriggerMode) *kernel.Error {
+	if isaIRQ >= isaIRQCount {
+		return errInvalidISAIRQ
+	}
+
+	overrides[isaIRQ] = &sourceOverride{gsi: gsi, polarity: polarity, trigger: trigger}
+	return nil
+}
+
+// LegacyGSI returns the GSI, polarity and trigger mode for the supplied ISA
+// IRQ taking into account any registered source overrides.
+func LegacyGSI(isaIRQ uint8) (uint32, Polarity, TriggerMode) {
+	if isaIRQ < isaIRQCount && overrides[isaIRQ] != nil {
+		ov := overrides[isaIRQ]
+		return ov.gsi, ov.polarity, ov.trigger
+	}
+
+	return uint32(isaIRQ), PolarityActiveHigh, TriggerEdge
+}
+
+// RouteGSI programs the redirection entry for gsi so that it is delivered
+// to the CPU with APIC ID route.Dest using route.Vector. The entry remains
+// masked until EnableIRQ is invoked.
+func RouteGSI(gsi uint32, route Route) *kernel.Error {
+	ctrl, index, err := lookup(gsi)
+	if err != nil {
+		return err
+	}
+
+	low := uint32(route.Vector) | redirMasked
+	if route.Polarity == PolarityActiveLow {
+		low |= redirPolarityLow
+	}
+	if route.Trigger == TriggerLevel {
+		low |= redirTriggerLevel
+	}
+
+	// Write the high dword first so the entry never points to a stale
+	// destination while unmasked.
+	writeRegisterFn(ctrl.regs, regRedirTable+2*index+1, uint32(route.Dest)<<redirDestShift)
+	writeRegisterFn(ctrl.regs, regRedirTable+2*index, low)
+	return nil
+}
+
+// EnableIRQ unmasks the redirection entry for gsi.
+func EnableIRQ(gsi uint32) *kernel.Error {
+	return setMasked(gsi, false)
+}
+
+// DisableIRQ masks the redirection entry for gsi.
+func DisableIRQ(gsi uint32) *kernel.Error {
+	return setMasked(gsi, true)
+}
+
+// setMasked updates the mask bit of the redirection entry for gsi.
+func setMasked(gsi uint32, masked bool) *kernel.Error {
+	ctrl, index, err := lookup(gsi)
+	if err != nil {
+		return err
+	}
+
+	reg := uint32(regRedirTable + 2*index)
+	low := readRegisterFn(ctrl.regs, reg)
+	if masked {
+		low |= redirMasked
+	} else {
+		low &^= redirMasked
+	}
+	writeRegisterFn(ctrl.regs, reg, low)
+	return nil
+}
+
+// lookup returns the controller that handles gsi and the index of the
+// redirection entry for gsi.
+func lookup(gsi uint32) (*controller, uint32, *kernel.Error) {
+	if !initialized {
+		return nil, 0, errNotInitialized
+	}
+
+	for index := 0; index < controllerCount; index++ {
+		ctrl := &controllers[index]
+		if gsi >= ctrl.gsiBase && gsi < ctrl.gsiBase+ctrl.entries {
+			return ctrl, gsi - ctrl.gsiBase, nil
+		}
+	}
+
+	return nil, 0, errNoControllerForGSI
+}
+
+// readRegister reads an I/O APIC register.
+func readRegister(regs uintptr, reg uint32) uint32 {
+	*(*uint32)(unsafe.Pointer(regs + regSelect)) = reg
+	return *(*uint32)(unsafe.Pointer(regs + regWindow))
+}
+
+// writeRegister writes an I/O APIC register.
+func writeRegister(regs uintptr, reg, value uint32) {
+	*(*uint32)(unsafe.Pointer(regs + regSelect)) = reg
+	*(*uint32)(unsafe.Pointer(regs + regWindow)) = value
+}
+
+// ioapicDriver initializes the registered I/O APICs.
+type ioapicDriver struct{}
+
+// DriverName returns the name of this driver.
+func (*ioapicDriver) DriverName() string {
+	return "ioapic"
+}
+
+// DriverVersion returns the version of this driver.
+func (*ioapicDriver) DriverVersion() (uint16, uint16, uint16) {
+	return 0, 0, 1
+}
+
+// DriverInit claims and maps the registers of each registered I/O APIC and
+// masks all redirection entries. If any controller cannot be set up, the
+// registers of the controllers set up so far are unmapped and released.
+func (*ioapicDriver) DriverInit(w *device.Logger) *kernel.Error {
+	for index := 0; index < controllerCount; index++ {
+		ctrl := &controllers[index]
+
+		res := ctrl.resource()
+		if err := device.ClaimResource("ioapic", res); err != nil {
+			releaseControllers(index)
+			return err
+		}
+
+		regs, err := mapMMIOFn(ctrl.physAddr, mmioSize, vmm.CacheUncached)
+		if err != nil {
+			_ = device.ReleaseResource("ioapic", res)
+			releaseControllers(index)
+			return err
+		}
+
+		ctrl.regs = regs
+		ctrl.entries = (readRegisterFn(regs, regVersion)>>16)&0xff + 1
+		for entry := uint32(0); entry < ctrl.entries; entry++ {
+			writeRegisterFn(regs, regRedirTable+2*entry, redirMasked)
+		}
+
+		w.Infof("I/O APIC %d at 0x%x handles GSIs %d-%d\n", ctrl.id, ctrl.physAddr, ctrl.gsiBase, ctrl.gsiBase+ctrl.entries-1)
+	}
+
+	initialized = true
+	return nil
+}
+
+// releaseControllers unmaps and releases the registers of the first count
+// controllers.
+func releaseControllers(count int) {
+	for index := 0; index < count; index++ {
+		ctrl := &controllers[index]
+		_ = unmapMMIOFn(ctrl.regs, mmioSize)
+		_ = device.ReleaseResource("ioapic", ctrl.resource())
+		ctrl.regs, ctrl.entries = 0, 0
+	}
+}
+
+// probeForIOAPIC returns a driver if any I/O APICs have been registered.
+func probeForIOAPIC() device.Driver {
+	if controllerCount == 0 {
+		return nil
+	}
+
+	return &ioapicDriver{}
+}
+
+func init() {
+	device.RegisterDriver(&device.DriverInfo{
+		Name:      "ioapic",
+		DependsOn: []string{"lapic"},
+		Provides:  "intc",
+		Priority:  100,
+		Order:     device.DetectOrderACPI,
+		Probe:     probeForIOAPIC,
+	})
+}
@@ -0,0 +1,316 @@
+package ioapic
+
+import (
+	"gopheros/device"
+	"gopheros/kernel"
+	"gopheros/kernel/mem"
+	"gopheros/kernel/mem/vmm"
+	"reflect"
+	"testing"
+	"unsafe"
+)
+
+func TestRegisterAccess(t *testing.T) {
+	var regs [mmioSize / 4]uint32
+	base := uintptr(unsafe.Pointer(&regs[0]))
+
+	regs[regWindow/4] = 0xdeadbeef
+	if got := readRegister(base, regVersion); got != 0xdeadbeef {
+		t.Fatalf("expected to read 0xdeadbeef; got 0x%x", got)
+	}
+
+	if got := regs[regSelect/4]; got != regVersion {
+		t.Fatalf("expected select register to be %d; got %d", regVersion, got)
+	}
+
+	writeRegister(base, regRedirTable+3, 0x42)
+	if regs[regSelect/4] != regRedirTable+3 || regs[regWindow/4] != 0x42 {
+		t.Fatalf("unexpected register contents after write: select=0x%x window=0x%x", regs[regSelect/4], regs[regWindow/4])
+	}
+}
+
+func TestSourceOverrides(t *testing.T) {
+	defer resetState()
+
+	if err := AddSourceOverride(0, 2, PolarityActiveHigh, TriggerEdge); err != nil {
+		t.Fatal(err)
+	}
+	if err := AddSourceOverride(9, 9, PolarityActiveLow, TriggerLevel); err != nil {
+		t.Fatal(err)
+	}
+	if err := AddSourceOverride(isaIRQCount, 16, PolarityActiveLow, TriggerLevel); err != errInvalidISAIRQ {
+		t.Fatalf("expected error %v; got %v", errInvalidISAIRQ, err)
+	}
+
+	specs := []struct {
+		irq         uint8
+		expGSI      uint32
+		expPolarity Polarity
+		expTrigger  TriggerMode
+	}{
+		{0, 2, PolarityActiveHigh, TriggerEdge},
+		{1, 1, PolarityActiveHigh, TriggerEdge},
+		{9, 9, PolarityActiveLow, TriggerLevel},
+		{42, 42, PolarityActiveHigh, TriggerEdge},
+	}
+
+	for specIndex, spec := range specs {
+		gsi, polarity, trigger := LegacyGSI(spec.irq)
+		if gsi != spec.expGSI || polarity != spec.expPolarity || trigger != spec.expTrigger {
+			t.Errorf("[spec %d] expected LegacyGSI to return %d, %d, %d; got %d, %d, %d", specIndex, spec.expGSI, spec.expPolarity, spec.expTrigger, gsi, polarity, trigger)
+		}
+	}
+}
+
+func TestDriver(t *testing.T) {
+	defer resetState()
+
+	fake := mockRegisters(map[uintptr]uint32{
+		0xf000: 23 << 16, // 24 entries
+		0xf100: 7 << 16,  // 8 entries
+	})
+
+	mapMMIOFn = func(physAddr uintptr, size mem.Size, attrs vmm.CacheAttr) (uintptr, *kernel.Error) {
+		if size != mmioSize || attrs != vmm.CacheUncached {
+			t.Errorf("unexpected MMIO mapping request: size=%d attrs=%d", size, attrs)
+		}
+		return physAddr - 0xfec00000 + 0xf000, nil
+	}
+
+	if drv := probeForIOAPIC(); drv != nil {
+		t.Fatal("expected probe to return nil when no I/O APICs are registered")
+	}
+
+	if err := RouteGSI(1, Route{}); err != errNotInitialized {
+		t.Fatalf("expected error %v; got %v", errNotInitialized, err)
+	}
+
+	if err := AddController(0, 0xfec00000, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := AddController(1, 0xfec00100, 24); err != nil {
+		t.Fatal(err)
+	}
+
+	drv := probeForIOAPIC()
+	if drv == nil {
+		t.Fatal("expected probe to return a driver")
+	}
+
+	if drv.DriverName() != "ioapic" {
+		t.Fatalf("unexpected driver name %q", drv.DriverName())
+	}
+
+	if major, minor, patch := drv.DriverVersion(); major != 0 || minor != 0 || patch != 1 {
+		t.Fatalf("unexpected driver version %d.%d.%d", major, minor, patch)
+	}
+
+	if err := drv.DriverInit(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := fake[0xf000][regRedirTable+2*23]; got != redirMasked {
+		t.Fatalf("expected all redirection entries to be masked; got 0x%x", got)
+	}
+
+	if err := RouteGSI(25, Route{Vector: 0x40, Dest: 3, Polarity: PolarityActiveLow, Trigger: TriggerLevel}); err != nil {
+		t.Fatal(err)
+	}
+	if err := RouteGSI(2, Route{Vector: 0x20}); err != nil {
+		t.Fatal(err)
+	}
+
+	specs := []struct {
+		regs    uintptr
+		reg     uint32
+		expLow  uint32
+		expHigh uint32
+	}{
+		{0xf100, regRedirTable + 2, 0x40 | redirMasked | redirPolarityLow | redirTriggerLevel, 3 << 24},
+		{0xf000, regRedirTable + 4, 0x20 | redirMasked, 0},
+	}
+
+	for specIndex, spec := range specs {
+		if got := fake[spec.regs][spec.reg]; got != spec.expLow {
+			t.Errorf("[spec %d] expected low dword to be 0x%x; got 0x%x", specIndex, spec.expLow, got)
+		}
+		if got := fake[spec.regs][spec.reg+1]; got != spec.expHigh {
+			t.Errorf("[spec %d] expected high dword to be 0x%x; got 0x%x", specIndex, spec.expHigh, got)
+		}
+	}
+
+	if err := EnableIRQ(25); err != nil {
+		t.Fatal(err)
+	}
+	if got := fake[0xf100][regRedirTable+2]; got&redirMasked != 0 {
+		t.Fatalf("expected GSI 25 to be unmasked; got 0x%x", got)
+	}
+
+	if err := DisableIRQ(25); err != nil {
+		t.Fatal(err)
+	}
+	if got := fake[0xf100][regRedirTable+2]; got&redirMasked == 0 {
+		t.Fatalf("expected GSI 25 to be masked; got 0x%x", got)
+	}
+
+	if err := EnableIRQ(32); err != errNoControllerForGSI {
+		t.Fatalf("expected error %v; got %v", errNoControllerForGSI, err)
+	}
+
+	if err := DisableIRQ(32); err != errNoControllerForGSI {
+		t.Fatalf("expected error %v; got %v", errNoControllerForGSI, err)
+	}
+}
+
+func TestDriverInitErrors(t *testing.T) {
+	defer resetState()
+
+	expErr := &kernel.Error{Module: "test", Message: "out of address space"}
+	mapMMIOFn = func(_ uintptr, _ mem.Size, _ vmm.CacheAttr) (uintptr, *kernel.Error) {
+		return 0, expErr
+	}
+
+	for index := 0; index < maxControllers; index++ {
+		if err := AddController(uint8(index), 0xfec00000, uint32(index*24)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := AddController(maxControllers, 0xfec00000, 0); err != errTooManyControllers {
+		t.Fatalf("expected error %v; got %v", errTooManyControllers, err)
+	}
+
+	if err := (&ioapicDriver{}).DriverInit(nil); err != expErr {
+		t.Fatalf("expected error %v; got %v", expErr, err)
+	}
+
+	if _, ok := device.ResourceOwner(device.Resource{Type: device.ResourceMemory, Base: 0xfec00000, Length: 1}); ok {
+		t.Fatal("expected the register window to be released when mapping it fails")
+	}
+
+	// The register window of another I/O APIC overlaps a claimed resource
+	if err := device.ClaimResource("other", device.Resource{Type: device.ResourceMemory, Base: 0xfec00010, Length: 4}); err != nil {
+		t.Fatal(err)
+	}
+	defer device.ReleaseResources("other")
+
+	if err := (&ioapicDriver{}).DriverInit(nil); err == nil {
+		t.Fatal("expected DriverInit to fail when the register window is claimed by another driver")
+	}
+
+	if err := EnableIRQ(0); err != errNotInitialized {
+		t.Fatalf("expected error %v; got %v", errNotInitialized, err)
+	}
+}
+
+func TestDriverInitUnwind(t *testing.T) {
+	defer resetState()
+
+	mockRegisters(map[uintptr]uint32{
+		0xf000: 23 << 16,
+		0xf100: 23 << 16,
+		0xf200: 23 << 16,
+	})
+
+	var (
+		expErr        = &kernel.Error{Module: "test", Message: "out of address space"}
+		failAddr      uintptr
+		unmappedAddrs []uintptr
+	)
+
+	mapMMIOFn = func(physAddr uintptr, _ mem.Size, _ vmm.CacheAttr) (uintptr, *kernel.Error) {
+		if physAddr == failAddr {
+			return 0, expErr
+		}
+		return physAddr - 0xfec00000 + 0xf000, nil
+	}
+	unmapMMIOFn = func(virtAddr uintptr, size mem.Size) *kernel.Error {
+		if size != mmioSize {
+			t.Errorf("unexpected MMIO unmap request: size=%d", size)
+		}
+		unmappedAddrs = append(unmappedAddrs, virtAddr)
+		return nil
+	}
+
+	for index := 0; index < 3; index++ {
+		if err := AddController(uint8(index), 0xfec00000+uintptr(index)*0x100, uint32(index*24)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	assertUnwound := func(expAddrs []uintptr) {
+		if !reflect.DeepEqual(unmappedAddrs, expAddrs) {
+			t.Errorf("expected registers at %v to be unmapped; got %v", expAddrs, unmappedAddrs)
+		}
+
+		for index := 0; index < controllerCount; index++ {
+			if controllers[index].regs != 0 {
+				t.Errorf("[controller %d] expected registers to be cleared", index)
+			}
+
+			if owner, ok := device.ResourceOwner(controllers[index].resource()); ok && owner == "ioapic" {
+				t.Errorf("[controller %d] expected register window to be released", index)
+			}
+		}
+	}
+
+	// Mapping the last controller fails
+	failAddr = 0xfec00200
+	if err := (&ioapicDriver{}).DriverInit(nil); err != expErr {
+		t.Fatalf("expected error %v; got %v", expErr, err)
+	}
+	assertUnwound([]uintptr{0xf000, 0xf100})
+
+	// The register window of the second controller is claimed by another
+	// driver
+	failAddr, unmappedAddrs = 0, nil
+	if err := device.ClaimResource("other", device.Resource{Type: device.ResourceMemory, Base: 0xfec00110, Length: 4}); err != nil {
+		t.Fatal(err)
+	}
+	defer device.ReleaseResources("other")
+
+	if err := (&ioapicDriver{}).DriverInit(nil); err == nil {
+		t.Fatal("expected DriverInit to fail when the register window is claimed by another driver")
+	}
+	assertUnwound([]uintptr{0xf000})
+}
+
+func TestDriverRegistration(t *testing.T) {
+	for _, info := range device.DriverList() {
+		if info.Name == "ioapic" {
+			return
+		}
+	}
+
+	t.Fatal("expected the ioapic driver to be registered")
+}
+
+// mockRegisters replaces the register accessors with a fake implementation
+// that stores register values per controller. The version register of each
+// controller is initialized using the supplied values.
+func mockRegisters(versions map[uintptr]uint32) map[uintptr]map[uint32]uint32 {
+	fake := make(map[uintptr]map[uint32]uint32)
+	for regs, version := range versions {
+		fake[regs] = map[uint32]uint32{regVersion: version}
+	}
+
+	readRegisterFn = func(regs uintptr, reg uint32) uint32 {
+		return fake[regs][reg]
+	}
+	writeRegisterFn = func(regs uintptr, reg, value uint32) {
+		fake[regs][reg] = value
+	}
+
+	return fake
+}
+
+func resetState() {
+	device.ReleaseResources("ioapic")
+	mapMMIOFn = vmm.MapMMIO
+	unmapMMIOFn = vmm.UnmapMMIO
+	readRegisterFn = readRegister
+	writeRegisterFn = writeRegister
+	controllerCount = 0
+	overrides = [isaIRQCount]*sourceOverride{}
+	initialized = false
+}
@@ -0,0 +1,386 @@
+// Package lapic provides a driver for the local APIC of the boot CPU.
+package lapic
+
+import (
+	"gopheros/device"
+	"gopheros/device/pit"
+	"gopheros/kernel"
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/mem"
+	"gopheros/kernel/mem/vmm"
+	"gopheros/kernel/time"
+	"unsafe"
+)
+
+const (
+	// SpuriousVector is the IDT vector raised by the local APIC for
+	// spurious interrupts.
+	SpuriousVector = 0xff
+
+	apicBaseMSR      = 0x1b
+	apicBaseEnable   = 1 << 11
+	apicBaseX2APIC   = 1 << 10
+	apicBaseAddrMask = 0x000ffffffffff000
+
+	// In x2APIC mode, each register is accessed via the MSR at address
+	// x2APICMSRBase + (register offset >> 4).
+	x2APICMSRBase = 0x800
+
+	regID             = 0x20
+	regVersion        = 0x30
+	regEOI            = 0xb0
+	regSpurious       = 0xf0
+	regLVTTimer       = 0x320
+	regLVTPerfCounter = 0x340
+	regTimerInitCount = 0x380
+	regTimerCurCount  = 0x390
+	regTimerDivide    = 0x3e0
+	regICRLow         = 0x300
+	regICRHigh        = 0x310
+
+	// In x2APIC mode, the ICR is accessed as a single 64-bit MSR.
+	x2APICICRMSR = x2APICMSRBase + regICRLow>>4
+
+	spuriousEnable  = 1 << 8
+	lvtDeliveryNMI  = 4 << 8
+	lvtMasked       = 1 << 16
+	timerPeriodic   = 1 << 17
+	timerDivideBy16 = 0x3
+
+	icrDeliveryPending  = 1 << 12
+	icrDestShift        = 24
+	icrAllExcludingSelf = 3 << 18
+
+	// maxDeliveryPoll bounds the number of ICR polls while waiting for a
+	// previous IPI to be delivered in xAPIC mode.
+	maxDeliveryPoll = 1 << 20
+
+	// The timer is calibrated by counting the number of timer ticks
+	// that elapse while PIT channel 2 counts down for calibrationMs.
+	calibrationMs = 10
+)
+
+// TimerMode describes the operating mode of the local APIC timer.
+type TimerMode uint8
+
+const (
+	// TimerOneShot raises a single interrupt once the timer expires.
+	TimerOneShot TimerMode = iota
+
+	// TimerPeriodic raises interrupts at a fixed interval.
+	TimerPeriodic
+)
+
+var (
+	// The following functions are used by tests to mock calls to the cpu,
+	// pit and vmm packages and are automatically inlined by the compiler.
+	hasAPICFn    = cpu.HasAPIC
+	hasX2APICFn  = cpu.HasX2APIC
+	readMSRFn    = cpu.ReadMSR
+	writeMSRFn   = cpu.WriteMSR
+	pitOneShotFn = pit.OneShot
+	mapMMIOFn    = vmm.MapMMIO
+	unmapMMIOFn  = vmm.UnmapMMIO
+	paramBoolFn  = device.ParamBool
+
+	// The local APIC state populated when the driver is initialized.
+	x2apic      bool
+	regs        uintptr
+	ticksPerMs  uint32
+	initialized bool
+
+	errNotInitialized     = &kernel.Error{Module: "lapic", Message: "local APIC driver not initialized"}
+	errInvalidTimerPeriod = &kernel.Error{Module: "lapic", Message: "timer period out of range"}
+	errCalibrationFailed  = &kernel.Error{Module: "lapic", Message: "timed out while calibrating the timer against the PIT"}
+	errInvalidDestination = &kernel.Error{Module: "lapic", Message: "APIC ID cannot be addressed in xAPIC mode"}
+	errIPITimeout         = &kernel.Error{Module: "lapic", Message: "timed out while waiting for IPI delivery"}
+)
+
+// ID returns the APIC ID of the boot CPU.
+func ID() uint32 {
+	if x2apic {
+		return read(regID)
+	}
+
+	return read(regID) >> 24
+}
+
+// EOI signals the end of the interrupt that is currently being serviced.
+// It must be invoked by the handlers of interrupts delivered through the
+// local APIC.
+func EOI() {
+	if initialized {
+		write(regEOI, 0)
+	}
+}
+
+// StartTimer arms the local APIC timer so that it raises the supplied
+// vector after periodMicros microseconds. In periodic mode, the interrupt
+// is raised repeatedly until StopTimer is invoked.
+func StartTimer(mode TimerMode, vector uint8, periodMicros uint32) *kernel.Error {
+	if !initialized {
+		return errNotInitialized
+	}
+
+	count := uint64(ticksPerMs) * uint64(periodMicros) / 1000
+	if count == 0 || count > 0xffffffff {
+		return errInvalidTimerPeriod
+	}
+
+	lvt := uint32(vector)
+	if mode == TimerPeriodic {
+		lvt |= timerPeriodic
+	}
+
+	write(regLVTTimer, lvt)
+	write(regTimerInitCount, uint32(count))
+	return nil
+}
+
+// EventSource adapts the local APIC timer in one-shot mode to the
+// timer.EventSource interface. Timer interrupts are raised using Vector.
+type EventSource struct {
+	Vector uint8
+}
+
+// Arm programs the local APIC timer to raise an interrupt after the supplied
+// delay. Delays are rounded down to the timer resolution and clamped to the
+// max delay supported by the timer; if the timer fires before the earliest
+// software timer expires, the timer package re-arms it.
+func (s EventSource) Arm(delay time.Duration) {
+	if !initialized {
+		return
+	}
+
+	if delay < 0 {
+		delay = 0
+	}
+
+	count := uint64(0xffffffff)
+	if maxDelay := time.Duration(count) * time.Millisecond / time.Duration(ticksPerMs); delay < maxDelay {
+		count = uint64(delay) * uint64(ticksPerMs) / uint64(time.Millisecond)
+	}
+	if count == 0 {
+		count = 1
+	}
+
+	write(regLVTTimer, uint32(s.Vector))
+	write(regTimerInitCount, uint32(count))
+}
+
+// StopTimer disarms the local APIC timer.
+func StopTimer() {
+	if !initialized {
+		return
+	}
+
+	write(regLVTTimer, lvtMasked)
+	write(regTimerInitCount, 0)
+}
+
+// X2APIC returns true if the local APIC operates in x2APIC mode.
+func X2APIC() bool {
+	return x2apic
+}
+
+// SendIPI sends a fixed inter-processor interrupt with the supplied vector
+// to the CPU with APIC ID dest. In x2APIC mode, the IPI is sent with a
+// single MSR write; in xAPIC mode, SendIPI waits for any previously sent
+// IPI to be delivered before sending a new one.
+func SendIPI(dest uint32, vector uint8) *kernel.Error {
+	if !initialized {
+		return errNotInitialized
+	}
+
+	if x2apic {
+		writeMSRFn(x2APICICRMSR, uint64(dest)<<32|uint64(vector))
+		return nil
+	}
+
+	if dest > 0xff {
+		return errInvalidDestination
+	}
+
+	if err := waitForIPIDelivery(); err != nil {
+		return err
+	}
+
+	// Writing the low dword triggers the IPI so the destination must be
+	// written first.
+	write(regICRHigh, dest<<icrDestShift)
+	write(regICRLow, uint32(vector))
+	return nil
+}
+
+// BroadcastIPI sends a fixed inter-processor interrupt with the supplied
+// vector to all CPUs except the calling one using the "all excluding self"
+// destination shorthand.
+func BroadcastIPI(vector uint8) *kernel.Error {
+	if !initialized {
+		return errNotInitialized
+	}
+
+	if x2apic {
+		writeMSRFn(x2APICICRMSR, icrAllExcludingSelf|uint64(vector))
+		return nil
+	}
+
+	if err := waitForIPIDelivery(); err != nil {
+		return err
+	}
+
+	write(regICRHigh, 0)
+	write(regICRLow, icrAllExcludingSelf|uint32(vector))
+	return nil
+}
+
+// waitForIPIDelivery waits for any previously sent IPI to be delivered in
+// xAPIC mode.
+func waitForIPIDelivery() *kernel.Error {
+	for poll := 0; read(regICRLow)&icrDeliveryPending != 0; poll++ {
+		if poll == maxDeliveryPoll {
+			return errIPITimeout
+		}
+	}
+
+	return nil
+}
+
+// EnablePerfCounterNMI configures the local APIC to deliver performance
+// counter overflow interrupts as NMIs. The local APIC masks the entry when
+// such an interrupt is delivered so it must be invoked again to unmask it.
+func EnablePerfCounterNMI() *kernel.Error {
+	if !initialized {
+		return errNotInitialized
+	}
+
+	write(regLVTPerfCounter, lvtDeliveryNMI)
+	return nil
+}
+
+// read returns the value of a local APIC register.
+func read(reg uint32) uint32 {
+	if x2apic {
+		return uint32(readMSRFn(x2APICMSRBase + reg>>4))
+	}
+
+	return *(*uint32)(unsafe.Pointer(regs + uintptr(reg)))
+}
+
+// write updates the value of a local APIC register.
+func write(reg, value uint32) {
+	if x2apic {
+		writeMSRFn(x2APICMSRBase+reg>>4, uint64(value))
+		return
+	}
+
+	*(*uint32)(unsafe.Pointer(regs + uintptr(reg))) = value
+}
+
+// calibrateTimer returns the number of timer ticks per millisecond using
+// PIT channel 2 as the reference clock.
+func calibrateTimer() (uint32, *kernel.Error) {
+	err := pitOneShotFn(calibrationMs, func() { write(regTimerInitCount, 0xffffffff) })
+	if err != nil {
+		write(regTimerInitCount, 0)
+		return 0, errCalibrationFailed
+	}
+
+	elapsed := 0xffffffff - read(regTimerCurCount)
+	write(regTimerInitCount, 0)
+	return elapsed / calibrationMs, nil
+}
+
+// lapicDriver initializes the local APIC of the boot CPU.
+type lapicDriver struct{}
+
+// DriverName returns the name of this driver.
+func (*lapicDriver) DriverName() string {
+	return "lapic"
+}
+
+// DriverVersion returns the version of this driver.
+func (*lapicDriver) DriverVersion() (uint16, uint16, uint16) {
+	return 0, 0, 1
+}
+
+// DriverInit enables the local APIC, configures the spurious interrupt
+// vector, calibrates the timer and installs the TLB shootdown IPI handler.
+//
+// If the CPU supports it, the local APIC is switched to x2APIC mode where
+// its registers are accessed via MSRs instead of MMIO. x2APIC mode can be
+// disabled with the "x2apic=off" kernel command line parameter unless the
+// firmware has already enabled it; switching from x2APIC back to xAPIC
+// mode requires the local APIC to be disabled first.
+func (*lapicDriver) DriverInit(w *device.Logger) *kernel.Error {
+	base := readMSRFn(apicBaseMSR)
+
+	if base&apicBaseX2APIC != 0 || (hasX2APICFn() && paramBoolFn("x2apic", true)) {
+		// Setting EXTD while the local APIC is disabled is an invalid
+		// transition; the local APIC must be enabled in xAPIC mode first.
+		base |= apicBaseEnable
+		writeMSRFn(apicBaseMSR, base)
+		writeMSRFn(apicBaseMSR, base|apicBaseX2APIC)
+		x2apic = true
+	} else {
+		physAddr := uintptr(base & apicBaseAddrMask)
+		res := device.Resource{Type: device.ResourceMemory, Base: uint64(physAddr), Length: uint64(mem.PageSize)}
+		if err := device.ClaimResource("lapic", res); err != nil {
+			return err
+		}
+
+		virtAddr, err := mapMMIOFn(physAddr, mem.PageSize, vmm.CacheUncached)
+		if err != nil {
+			_ = device.ReleaseResource("lapic", res)
+			return err
+		}
+
+		writeMSRFn(apicBaseMSR, base|apicBaseEnable)
+		regs = virtAddr
+	}
+
+	write(regSpurious, SpuriousVector|spuriousEnable)
+	write(regLVTTimer, lvtMasked)
+	write(regTimerDivide, timerDivideBy16)
+
+	var err *kernel.Error
+	if ticksPerMs, err = calibrateTimer(); err == nil {
+		err = setupShootdown()
+	}
+
+	if err != nil {
+		if !x2apic {
+			_ = unmapMMIOFn(regs, mem.PageSize)
+			device.ReleaseResources("lapic")
+			regs = 0
+		}
+		return err
+	}
+
+	mode := "xAPIC"
+	if x2apic {
+		mode = "x2APIC"
+	}
+	w.Infof("%s mode, APIC ID %d, version 0x%x\n", mode, ID(), read(regVersion)&0xff)
+	w.Infof("timer frequency: %d ticks/ms\n", ticksPerMs)
+
+	initialized = true
+	return nil
+}
+
+// probeForLAPIC returns a driver if the CPU contains a local APIC.
+func probeForLAPIC() device.Driver {
+	if !hasAPICFn() {
+		return nil
+	}
+
+	return &lapicDriver{}
+}
+
+func init() {
+	device.RegisterDriver(&device.DriverInfo{
+		Name:  "lapic",
+		Order: device.DetectOrderBeforeACPI,
+		Probe: probeForLAPIC,
+	})
+}
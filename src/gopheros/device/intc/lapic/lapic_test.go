@@ -0,0 +1,540 @@
+package lapic
+
+import (
+	"bytes"
+	"gopheros/device"
+	"gopheros/device/pit"
+	"gopheros/kernel"
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/irq"
+	"gopheros/kernel/mem"
+	"gopheros/kernel/mem/percpu"
+	"gopheros/kernel/mem/vmm"
+	"gopheros/kernel/time"
+	"reflect"
+	"testing"
+	"unsafe"
+)
+
+func TestProbe(t *testing.T) {
+	defer resetState()
+
+	hasAPICFn = func() bool { return false }
+	if drv := probeForLAPIC(); drv != nil {
+		t.Fatal("expected probe to return nil when the CPU has no local APIC")
+	}
+
+	hasAPICFn = func() bool { return true }
+	drv := probeForLAPIC()
+	if drv == nil {
+		t.Fatal("expected probe to return a driver")
+	}
+
+	if drv.DriverName() != "lapic" {
+		t.Fatalf("unexpected driver name %q", drv.DriverName())
+	}
+
+	if major, minor, patch := drv.DriverVersion(); major != 0 || minor != 0 || patch != 1 {
+		t.Fatalf("unexpected driver version %d.%d.%d", major, minor, patch)
+	}
+
+	for _, info := range device.DriverList() {
+		if info.Name == "lapic" {
+			return
+		}
+	}
+
+	t.Fatal("expected the lapic driver to be registered")
+}
+
+func TestDriverInitXAPIC(t *testing.T) {
+	defer resetState()
+
+	var (
+		apicRegs [mem.PageSize / 4]uint32
+		msrs     = map[uint32]uint64{apicBaseMSR: 0xfee00000 | 1<<8}
+		buf      bytes.Buffer
+	)
+
+	apicRegs[regID/4] = 3 << 24
+	apicRegs[regVersion/4] = 0x50014
+
+	hasX2APICFn = func() bool { return false }
+	mockMSRs(msrs)
+	pitDurations := mockPIT(func() { apicRegs[regTimerCurCount/4] = 0xffffffff - 62500 })
+	mapMMIOFn = func(physAddr uintptr, size mem.Size, attrs vmm.CacheAttr) (uintptr, *kernel.Error) {
+		if physAddr != 0xfee00000 || size != mem.PageSize || attrs != vmm.CacheUncached {
+			t.Errorf("unexpected MMIO mapping request: addr=0x%x size=%d attrs=%d", physAddr, size, attrs)
+		}
+		return uintptr(unsafe.Pointer(&apicRegs[0])), nil
+	}
+
+	// Arming the event source is a no-op before the driver is initialized
+	EventSource{Vector: 0x30}.Arm(time.Millisecond)
+
+	if err := StartTimer(TimerOneShot, 0x30, 1000); err != errNotInitialized {
+		t.Fatalf("expected error %v; got %v", errNotInitialized, err)
+	}
+
+	if err := (&lapicDriver{}).DriverInit(device.NewLogger(&buf, nil, device.LogLevelInfo)); err != nil {
+		t.Fatal(err)
+	}
+
+	if exp := []uint32{calibrationMs}; !reflect.DeepEqual(*pitDurations, exp) {
+		t.Fatalf("expected PIT one-shot counts %v; got %v", exp, *pitDurations)
+	}
+
+	if exp, got := uint64(0xfee00000|1<<8|apicBaseEnable), msrs[apicBaseMSR]; got != exp {
+		t.Fatalf("expected APIC base MSR to be 0x%x; got 0x%x", exp, got)
+	}
+
+	if exp, got := uint32(SpuriousVector|spuriousEnable), apicRegs[regSpurious/4]; got != exp {
+		t.Fatalf("expected spurious vector register to be 0x%x; got 0x%x", exp, got)
+	}
+
+	if exp, got := uint32(timerDivideBy16), apicRegs[regTimerDivide/4]; got != exp {
+		t.Fatalf("expected timer divide register to be 0x%x; got 0x%x", exp, got)
+	}
+
+	if apicRegs[regTimerInitCount/4] != 0 {
+		t.Fatal("expected the timer to be stopped after calibration")
+	}
+
+	exp := "xAPIC mode, APIC ID 3, version 0x14\ntimer frequency: 6250 ticks/ms\n"
+	if got := buf.String(); got != exp {
+		t.Fatalf("expected output to be:\n%q\ngot:\n%q", exp, got)
+	}
+
+	if owner, ok := device.ResourceOwner(device.Resource{Type: device.ResourceMemory, Base: 0xfee00000, Length: 1}); !ok || owner != "lapic" {
+		t.Fatalf("expected the local APIC registers to be claimed by the driver; got %q, %t", owner, ok)
+	}
+
+	timerSpecs := []struct {
+		mode     TimerMode
+		vector   uint8
+		micros   uint32
+		expLVT   uint32
+		expCount uint32
+		expErr   *kernel.Error
+	}{
+		{TimerOneShot, 0x30, 1000, 0x30, 6250, nil},
+		{TimerPeriodic, 0x31, 10000, 0x31 | timerPeriodic, 62500, nil},
+		{TimerOneShot, 0x30, 0, 0, 0, errInvalidTimerPeriod},
+		{TimerOneShot, 0x30, 0xffffffff, 0, 0, errInvalidTimerPeriod},
+	}
+
+	for specIndex, spec := range timerSpecs {
+		if err := StartTimer(spec.mode, spec.vector, spec.micros); err != spec.expErr {
+			t.Errorf("[spec %d] expected error %v; got %v", specIndex, spec.expErr, err)
+			continue
+		}
+
+		if spec.expErr != nil {
+			continue
+		}
+
+		if got := apicRegs[regLVTTimer/4]; got != spec.expLVT {
+			t.Errorf("[spec %d] expected timer LVT to be 0x%x; got 0x%x", specIndex, spec.expLVT, got)
+		}
+
+		if got := apicRegs[regTimerInitCount/4]; got != spec.expCount {
+			t.Errorf("[spec %d] expected timer initial count to be %d; got %d", specIndex, spec.expCount, got)
+		}
+	}
+
+	StopTimer()
+	if apicRegs[regLVTTimer/4] != lvtMasked || apicRegs[regTimerInitCount/4] != 0 {
+		t.Fatal("expected StopTimer to mask and stop the timer")
+	}
+
+	apicRegs[regEOI/4] = 0xff
+	EOI()
+	if apicRegs[regEOI/4] != 0 {
+		t.Fatal("expected EOI to write the EOI register")
+	}
+}
+
+func TestDriverInitX2APIC(t *testing.T) {
+	defer resetState()
+
+	msrs := map[uint32]uint64{
+		apicBaseMSR:                   0xfee00000,
+		x2APICMSRBase + regID>>4:      5,
+		x2APICMSRBase + regVersion>>4: 0x14,
+	}
+
+	hasX2APICFn = func() bool { return true }
+	paramBoolFn = func(name string, def bool) bool {
+		if name != "x2apic" || !def {
+			t.Errorf("unexpected parameter lookup: %q (default %t)", name, def)
+		}
+		return def
+	}
+	mockMSRs(msrs)
+	mockPIT(func() { msrs[x2APICMSRBase+regTimerCurCount>>4] = 0xffffffff - 1000 })
+	mapMMIOFn = func(_ uintptr, _ mem.Size, _ vmm.CacheAttr) (uintptr, *kernel.Error) {
+		t.Fatal("unexpected call to MapMMIO in x2APIC mode")
+		return 0, nil
+	}
+
+	var baseWrites []uint64
+	writeMSRFn = func(reg uint32, value uint64) {
+		if reg == apicBaseMSR {
+			baseWrites = append(baseWrites, value)
+		}
+		msrs[reg] = value
+	}
+
+	if err := (&lapicDriver{}).DriverInit(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// The local APIC is disabled by the firmware so it must be enabled
+	// before switching to x2APIC mode
+	expWrites := []uint64{0xfee00000 | apicBaseEnable, 0xfee00000 | apicBaseEnable | apicBaseX2APIC}
+	if len(baseWrites) != len(expWrites) || baseWrites[0] != expWrites[0] || baseWrites[1] != expWrites[1] {
+		t.Fatalf("expected APIC base MSR writes to be %x; got %x", expWrites, baseWrites)
+	}
+
+	if exp, got := uint64(0xfee00000|apicBaseEnable|apicBaseX2APIC), msrs[apicBaseMSR]; got != exp {
+		t.Fatalf("expected APIC base MSR to be 0x%x; got 0x%x", exp, got)
+	}
+
+	if got := ID(); got != 5 {
+		t.Fatalf("expected APIC ID to be 5; got %d", got)
+	}
+
+	if exp, got := uint64(SpuriousVector|spuriousEnable), msrs[x2APICMSRBase+regSpurious>>4]; got != exp {
+		t.Fatalf("expected spurious vector MSR to be 0x%x; got 0x%x", exp, got)
+	}
+
+	if ticksPerMs != 100 {
+		t.Fatalf("expected timer frequency to be 100 ticks/ms; got %d", ticksPerMs)
+	}
+
+	if !X2APIC() {
+		t.Fatal("expected X2APIC to return true")
+	}
+
+	armSpecs := []struct {
+		delay    time.Duration
+		expCount uint64
+	}{
+		{time.Millisecond, 100},
+		{25 * time.Microsecond, 2},
+		{0, 1},
+		{-time.Second, 1},
+		{time.Duration(1) << 62, 0xffffffff},
+	}
+
+	for specIndex, spec := range armSpecs {
+		EventSource{Vector: 0x32}.Arm(spec.delay)
+
+		if got := msrs[x2APICMSRBase+regTimerInitCount>>4]; got != spec.expCount {
+			t.Errorf("[spec %d] expected timer initial count to be %d; got %d", specIndex, spec.expCount, got)
+		}
+
+		if got := msrs[x2APICMSRBase+regLVTTimer>>4]; got != 0x32 {
+			t.Errorf("[spec %d] expected timer LVT to be 0x32; got 0x%x", specIndex, got)
+		}
+	}
+
+	if err := SendIPI(0x1234, 0x40); err != nil {
+		t.Fatal(err)
+	}
+
+	if exp, got := uint64(0x1234<<32|0x40), msrs[x2APICICRMSR]; got != exp {
+		t.Fatalf("expected ICR MSR to be 0x%x; got 0x%x", exp, got)
+	}
+}
+
+func TestX2APICModeSelection(t *testing.T) {
+	defer resetState()
+
+	specs := []struct {
+		base      uint64
+		hasX2APIC bool
+		param     bool
+		expX2APIC bool
+	}{
+		// Disabled via the command line
+		{0xfee00000, true, false, false},
+		// Already enabled by the firmware; cannot switch back to xAPIC
+		{0xfee00000 | apicBaseEnable | apicBaseX2APIC, true, false, true},
+	}
+
+	for specIndex, spec := range specs {
+		var apicRegs [mem.PageSize / 4]uint32
+
+		resetState()
+		msrs := map[uint32]uint64{apicBaseMSR: spec.base}
+		mockMSRs(msrs)
+		hasX2APICFn = func() bool { return spec.hasX2APIC }
+		paramBoolFn = func(_ string, _ bool) bool { return spec.param }
+		mockPIT(func() {
+			apicRegs[regTimerCurCount/4] = 0xffffffff - 1000
+			msrs[x2APICMSRBase+regTimerCurCount>>4] = 0xffffffff - 1000
+		})
+		mapMMIOFn = func(_ uintptr, _ mem.Size, _ vmm.CacheAttr) (uintptr, *kernel.Error) {
+			return uintptr(unsafe.Pointer(&apicRegs[0])), nil
+		}
+
+		if err := (&lapicDriver{}).DriverInit(nil); err != nil {
+			t.Errorf("[spec %d] %v", specIndex, err)
+			continue
+		}
+
+		if got := X2APIC(); got != spec.expX2APIC {
+			t.Errorf("[spec %d] expected X2APIC to return %t; got %t", specIndex, spec.expX2APIC, got)
+		}
+	}
+}
+
+func TestSendIPIXAPIC(t *testing.T) {
+	defer resetState()
+
+	var apicRegs [mem.PageSize / 4]uint32
+
+	if err := SendIPI(1, 0x40); err != errNotInitialized {
+		t.Fatalf("expected error %v; got %v", errNotInitialized, err)
+	}
+
+	regs = uintptr(unsafe.Pointer(&apicRegs[0]))
+	initialized = true
+
+	if err := SendIPI(0x100, 0x40); err != errInvalidDestination {
+		t.Fatalf("expected error %v; got %v", errInvalidDestination, err)
+	}
+
+	apicRegs[regICRLow/4] = icrDeliveryPending
+	if err := SendIPI(1, 0x40); err != errIPITimeout {
+		t.Fatalf("expected error %v; got %v", errIPITimeout, err)
+	}
+
+	apicRegs[regICRLow/4] = 0
+	if err := SendIPI(2, 0x41); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := apicRegs[regICRHigh/4]; got != 2<<icrDestShift {
+		t.Fatalf("expected ICR high dword to be 0x%x; got 0x%x", 2<<icrDestShift, got)
+	}
+
+	if got := apicRegs[regICRLow/4]; got != 0x41 {
+		t.Fatalf("expected ICR low dword to be 0x41; got 0x%x", got)
+	}
+}
+
+func TestBroadcastIPI(t *testing.T) {
+	defer resetState()
+
+	var apicRegs [mem.PageSize / 4]uint32
+
+	if err := BroadcastIPI(0x40); err != errNotInitialized {
+		t.Fatalf("expected error %v; got %v", errNotInitialized, err)
+	}
+
+	regs = uintptr(unsafe.Pointer(&apicRegs[0]))
+	initialized = true
+
+	apicRegs[regICRLow/4] = icrDeliveryPending
+	if err := BroadcastIPI(0x40); err != errIPITimeout {
+		t.Fatalf("expected error %v; got %v", errIPITimeout, err)
+	}
+
+	apicRegs[regICRLow/4] = 0
+	apicRegs[regICRHigh/4] = 0xff << icrDestShift
+	if err := BroadcastIPI(0x41); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := apicRegs[regICRHigh/4]; got != 0 {
+		t.Fatalf("expected ICR high dword to be cleared; got 0x%x", got)
+	}
+
+	if exp, got := uint32(icrAllExcludingSelf|0x41), apicRegs[regICRLow/4]; got != exp {
+		t.Fatalf("expected ICR low dword to be 0x%x; got 0x%x", exp, got)
+	}
+
+	msrs := map[uint32]uint64{}
+	mockMSRs(msrs)
+	x2apic = true
+	if err := BroadcastIPI(0x42); err != nil {
+		t.Fatal(err)
+	}
+
+	if exp, got := uint64(icrAllExcludingSelf|0x42), msrs[x2APICICRMSR]; got != exp {
+		t.Fatalf("expected ICR MSR to be 0x%x; got 0x%x", exp, got)
+	}
+}
+
+func TestEnablePerfCounterNMI(t *testing.T) {
+	defer resetState()
+
+	var apicRegs [mem.PageSize / 4]uint32
+
+	if err := EnablePerfCounterNMI(); err != errNotInitialized {
+		t.Fatalf("expected error %v; got %v", errNotInitialized, err)
+	}
+
+	regs = uintptr(unsafe.Pointer(&apicRegs[0]))
+	initialized = true
+	apicRegs[regLVTPerfCounter/4] = lvtMasked | lvtDeliveryNMI
+
+	if err := EnablePerfCounterNMI(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := apicRegs[regLVTPerfCounter/4]; got != lvtDeliveryNMI {
+		t.Fatalf("expected performance counter LVT to be 0x%x; got 0x%x", lvtDeliveryNMI, got)
+	}
+}
+
+func TestDriverInitErrors(t *testing.T) {
+	defer resetState()
+
+	msrs := map[uint32]uint64{apicBaseMSR: 0xfee00000}
+	mockMSRs(msrs)
+	hasX2APICFn = func() bool { return false }
+
+	t.Run("resource conflict", func(t *testing.T) {
+		res := device.Resource{Type: device.ResourceMemory, Base: 0xfee00100, Length: 4}
+		if err := device.ClaimResource("other", res); err != nil {
+			t.Fatal(err)
+		}
+		defer device.ReleaseResources("other")
+
+		if err := (&lapicDriver{}).DriverInit(nil); err == nil {
+			t.Fatal("expected DriverInit to fail when the registers are claimed by another driver")
+		}
+	})
+
+	t.Run("map error", func(t *testing.T) {
+		expErr := &kernel.Error{Module: "test", Message: "out of address space"}
+		mapMMIOFn = func(_ uintptr, _ mem.Size, _ vmm.CacheAttr) (uintptr, *kernel.Error) {
+			return 0, expErr
+		}
+
+		if err := (&lapicDriver{}).DriverInit(nil); err != expErr {
+			t.Fatalf("expected error %v; got %v", expErr, err)
+		}
+
+		if _, ok := device.ResourceOwner(device.Resource{Type: device.ResourceMemory, Base: 0xfee00000, Length: 1}); ok {
+			t.Fatal("expected the register window to be released when mapping it fails")
+		}
+	})
+
+	t.Run("calibration timeout", func(t *testing.T) {
+		var apicRegs [mem.PageSize / 4]uint32
+		mapMMIOFn = func(_ uintptr, _ mem.Size, _ vmm.CacheAttr) (uintptr, *kernel.Error) {
+			return uintptr(unsafe.Pointer(&apicRegs[0])), nil
+		}
+		var unmappedAddr uintptr
+		unmapMMIOFn = func(virtAddr uintptr, _ mem.Size) *kernel.Error {
+			unmappedAddr = virtAddr
+			return nil
+		}
+		pitOneShotFn = func(_ uint32, start func()) *kernel.Error {
+			start()
+			return &kernel.Error{Module: "test", Message: "PIT timeout"}
+		}
+
+		if err := (&lapicDriver{}).DriverInit(nil); err != errCalibrationFailed {
+			t.Fatalf("expected error %v; got %v", errCalibrationFailed, err)
+		}
+
+		if exp := uintptr(unsafe.Pointer(&apicRegs[0])); unmappedAddr != exp {
+			t.Fatalf("expected the register window at 0x%x to be unmapped; got 0x%x", exp, unmappedAddr)
+		}
+
+		if _, ok := device.ResourceOwner(device.Resource{Type: device.ResourceMemory, Base: 0xfee00000, Length: 1}); ok {
+			t.Fatal("expected the register window to be released after a failed calibration")
+		}
+
+		if apicRegs[regTimerInitCount/4] != 0 {
+			t.Fatal("expected the timer to be stopped after a failed calibration")
+		}
+
+		// The driver should remain unusable
+		EOI()
+		StopTimer()
+		if apicRegs[regEOI/4] != 0 || apicRegs[regLVTTimer/4] != lvtMasked {
+			t.Fatal("expected EOI and StopTimer to be no-ops when the driver is not initialized")
+		}
+	})
+
+	t.Run("shootdown handler error", func(t *testing.T) {
+		var apicRegs [mem.PageSize / 4]uint32
+		mapMMIOFn = func(_ uintptr, _ mem.Size, _ vmm.CacheAttr) (uintptr, *kernel.Error) {
+			return uintptr(unsafe.Pointer(&apicRegs[0])), nil
+		}
+		unmapMMIOFn = func(_ uintptr, _ mem.Size) *kernel.Error { return nil }
+		mockPIT(func() {})
+		expErr := &kernel.Error{Module: "test", Message: "vector in use"}
+		requestIRQFn = func(_ uint8, _ string, _ irq.Handler) *kernel.Error { return expErr }
+
+		if err := (&lapicDriver{}).DriverInit(nil); err != expErr {
+			t.Fatalf("expected error %v; got %v", expErr, err)
+		}
+
+		if _, ok := device.ResourceOwner(device.Resource{Type: device.ResourceMemory, Base: 0xfee00000, Length: 1}); ok {
+			t.Fatal("expected the register window to be released when the shootdown handler cannot be installed")
+		}
+	})
+}
+
+// mockMSRs replaces the MSR accessors with a fake implementation backed by
+// the supplied map.
+func mockMSRs(msrs map[uint32]uint64) {
+	readMSRFn = func(reg uint32) uint64 { return msrs[reg] }
+	writeMSRFn = func(reg uint32, value uint64) { msrs[reg] = value }
+}
+
+// mockPIT replaces the PIT one-shot helper with a fake implementation that
+// invokes the supplied function just before the count expires so it can
+// advance the timer count. mockPIT returns a pointer to the list of
+// requested durations.
+func mockPIT(onExpire func()) *[]uint32 {
+	var durations []uint32
+
+	pitOneShotFn = func(ms uint32, start func()) *kernel.Error {
+		durations = append(durations, ms)
+		start()
+		onExpire()
+		return nil
+	}
+
+	return &durations
+}
+
+func resetState() {
+	device.ReleaseResources("lapic")
+	hasAPICFn = cpu.HasAPIC
+	hasX2APICFn = cpu.HasX2APIC
+	readMSRFn = cpu.ReadMSR
+	writeMSRFn = cpu.WriteMSR
+	pitOneShotFn = pit.OneShot
+	mapMMIOFn = vmm.MapMMIO
+	unmapMMIOFn = vmm.UnmapMMIO
+	paramBoolFn = device.ParamBool
+	cpuCountFn = percpu.CPUCount
+	currentCPUFn = percpu.CurrentCPU
+	flushTLBEntryFn = cpu.FlushTLBEntry
+	switchPDTFn = cpu.SwitchPDT
+	activePDTFn = cpu.ActivePDT
+	broadcastIPIFn = BroadcastIPI
+	requestIRQFn = irq.RequestIRQ
+	setShootdownHandlerFn = vmm.SetShootdownHandler
+	_ = irq.FreeIRQ(ShootdownVector, "tlb-shootdown")
+	vmm.SetShootdownHandler(nil)
+	shootdownLock = 0
+	shootdownReq.gen = 0
+	shootdownReq.pending = 0
+	shootdownReq.flushAll = false
+	shootdownReq.addrs = nil
+	servicedGen = [percpu.MaxCPUs]uint32{}
+	x2apic = false
+	regs = 0
+	ticksPerMs = 0
+	initialized = false
+}
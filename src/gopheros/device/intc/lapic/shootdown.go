@@ -0,0 +1,131 @@
+package lapic
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/irq"
+	"gopheros/kernel/mem/percpu"
+	"gopheros/kernel/mem/vmm"
+	"sync/atomic"
+)
+
+const (
+	// ShootdownVector is the IDT vector of the IPI that asks the other
+	// CPUs to invalidate their TLB entries.
+	ShootdownVector = 0xf0
+
+	// maxShootdownPoll bounds the number of polls while waiting for the
+	// other CPUs to acknowledge a shootdown request.
+	maxShootdownPoll = 1 << 24
+)
+
+var (
+	// The following functions are used by tests to mock calls to the cpu,
+	// irq, percpu and vmm packages.
+	cpuCountFn            = percpu.CPUCount
+	currentCPUFn          = percpu.CurrentCPU
+	flushTLBEntryFn       = cpu.FlushTLBEntry
+	switchPDTFn           = cpu.SwitchPDT
+	activePDTFn           = cpu.ActivePDT
+	broadcastIPIFn        = BroadcastIPI
+	requestIRQFn          = irq.RequestIRQ
+	setShootdownHandlerFn = vmm.SetShootdownHandler
+
+	// shootdownLock serializes shootdown requests from different CPUs.
+	shootdownLock uint32
+
+	// shootdownReq describes the request that is currently being serviced
+	// by the other CPUs. A request is published by incrementing gen;
+	// pending counts the CPUs that have not yet serviced it.
+	shootdownReq struct {
+		gen      uint32
+		pending  uint32
+		flushAll bool
+		addrs    []uintptr
+	}
+
+	// servicedGen tracks the last request generation serviced by each CPU.
+	servicedGen [percpu.MaxCPUs]uint32
+
+	errShootdownTimeout = &kernel.Error{Module: "lapic", Message: "timed out while waiting for TLB shootdown acknowledgements"}
+)
+
+// setupShootdown attaches the shootdown handler to ShootdownVector and
+// registers sendShootdown as the vmm shootdown handler.
+func setupShootdown() *kernel.Error {
+	if err := requestIRQFn(ShootdownVector, "tlb-shootdown", handleShootdown); err != nil {
+		return err
+	}
+
+	setShootdownHandlerFn(sendShootdown)
+	return nil
+}
+
+// sendShootdown broadcasts a shootdown IPI asking all other CPUs to
+// invalidate their TLB entries for the supplied addresses (or flush their
+// entire TLB if flushAll is set) and waits for all of them to acknowledge
+// the request. As stale TLB entries may expose freed frames, failing to
+// deliver the request is unrecoverable.
+func sendShootdown(addrs []uintptr, flushAll bool) {
+	others := cpuCountFn() - 1
+	if others == 0 {
+		return
+	}
+
+	// While spinning, keep servicing requests from other CPUs as they may
+	// be waiting for us with interrupts disabled.
+	for !atomic.CompareAndSwapUint32(&shootdownLock, 0, 1) {
+		serviceShootdown()
+	}
+
+	shootdownReq.addrs = addrs
+	shootdownReq.flushAll = flushAll
+	atomic.StoreUint32(&shootdownReq.pending, others)
+
+	gen := shootdownReq.gen + 1
+	servicedGen[currentCPUFn()] = gen
+	atomic.StoreUint32(&shootdownReq.gen, gen)
+
+	err := broadcastIPIFn(ShootdownVector)
+	for poll := 0; err == nil && atomic.LoadUint32(&shootdownReq.pending) != 0; poll++ {
+		if poll == maxShootdownPoll {
+			err = errShootdownTimeout
+		}
+	}
+
+	shootdownReq.addrs = nil
+	atomic.StoreUint32(&shootdownLock, 0)
+
+	if err != nil {
+		panic(err)
+	}
+}
+
+// handleShootdown services the shootdown IPI raised by sendShootdown.
+func handleShootdown(_ uint8, _ *irq.Frame, _ *irq.Regs) bool {
+	serviceShootdown()
+	EOI()
+	return true
+}
+
+// serviceShootdown applies the TLB invalidations of the current shootdown
+// request to the local TLB and acknowledges the request unless the calling
+// CPU has already serviced it.
+func serviceShootdown() {
+	gen := atomic.LoadUint32(&shootdownReq.gen)
+	cpuIndex := currentCPUFn()
+	if servicedGen[cpuIndex] == gen {
+		return
+	}
+
+	if shootdownReq.flushAll {
+		switchPDTFn(activePDTFn())
+	} else {
+		for _, addr := range shootdownReq.addrs {
+			flushTLBEntryFn(addr)
+		}
+	}
+
+	servicedGen[cpuIndex] = gen
+	atomic.AddUint32(&shootdownReq.pending, ^uint32(0))
+}
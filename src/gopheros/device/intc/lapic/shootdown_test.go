@@ -0,0 +1,154 @@
+package lapic
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/mem"
+	"gopheros/kernel/mem/vmm"
+	"reflect"
+	"testing"
+	"unsafe"
+)
+
+func TestSetupShootdown(t *testing.T) {
+	defer resetState()
+
+	var handlerSet bool
+	setShootdownHandlerFn = func(fn vmm.ShootdownFn) { handlerSet = fn != nil }
+
+	if err := setupShootdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !handlerSet {
+		t.Fatal("expected a vmm shootdown handler to be registered")
+	}
+
+	// The vector should now be in use
+	if err := setupShootdown(); err == nil {
+		t.Fatal("expected setupShootdown to fail when the handler is already attached")
+	}
+}
+
+func TestSendShootdown(t *testing.T) {
+	defer resetState()
+
+	var (
+		apicRegs   [mem.PageSize / 4]uint32
+		cpuIndex   uint32
+		flushed    []uintptr
+		switchedTo uintptr
+	)
+
+	regs = uintptr(unsafe.Pointer(&apicRegs[0]))
+	initialized = true
+	currentCPUFn = func() uint32 { return cpuIndex }
+	flushTLBEntryFn = func(addr uintptr) { flushed = append(flushed, addr) }
+	activePDTFn = func() uintptr { return 0xbadf00d }
+	switchPDTFn = func(pdt uintptr) { switchedTo = pdt }
+
+	// The remote CPU services the request from inside the IPI handler.
+	broadcastIPIFn = func(vector uint8) *kernel.Error {
+		if vector != ShootdownVector {
+			t.Errorf("expected IPI vector 0x%x; got 0x%x", ShootdownVector, vector)
+		}
+
+		cpuIndex = 1
+		defer func() { cpuIndex = 0 }()
+		apicRegs[regEOI/4] = 0xff
+		if !handleShootdown(vector, nil, nil) {
+			t.Error("expected handleShootdown to claim the interrupt")
+		}
+
+		if apicRegs[regEOI/4] != 0 {
+			t.Error("expected handleShootdown to signal EOI")
+		}
+
+		// Redelivering the IPI should not acknowledge the request twice
+		handleShootdown(vector, nil, nil)
+		return nil
+	}
+
+	t.Run("single CPU", func(t *testing.T) {
+		cpuCountFn = func() uint32 { return 1 }
+		sendShootdown([]uintptr{0x1000}, false)
+
+		if flushed != nil || shootdownReq.gen != 0 {
+			t.Fatal("expected no shootdown request to be sent when only one CPU is online")
+		}
+	})
+
+	cpuCountFn = func() uint32 { return 2 }
+
+	t.Run("flush addresses", func(t *testing.T) {
+		flushed = nil
+		sendShootdown([]uintptr{0x1000, 0x2000}, false)
+
+		if exp := []uintptr{0x1000, 0x2000}; !reflect.DeepEqual(flushed, exp) {
+			t.Fatalf("expected remote CPU to flush %v; got %v", exp, flushed)
+		}
+
+		if shootdownReq.pending != 0 || shootdownLock != 0 || shootdownReq.addrs != nil {
+			t.Fatal("expected the shootdown request to be completed")
+		}
+	})
+
+	t.Run("flush all", func(t *testing.T) {
+		flushed = nil
+		sendShootdown(nil, true)
+
+		if flushed != nil || switchedTo != 0xbadf00d {
+			t.Fatal("expected remote CPU to reload CR3")
+		}
+	})
+
+	t.Run("service requests while waiting for the lock", func(t *testing.T) {
+		// CPU 1 holds the lock and waits for CPU 0 to flush 0x3000
+		shootdownLock = 1
+		shootdownReq.addrs = []uintptr{0x3000}
+		shootdownReq.flushAll = false
+		shootdownReq.pending = 1
+		shootdownReq.gen++
+		flushed = nil
+		flushTLBEntryFn = func(addr uintptr) {
+			flushed = append(flushed, addr)
+			if addr == 0x3000 {
+				shootdownLock = 0
+			}
+		}
+
+		sendShootdown([]uintptr{0x4000}, false)
+
+		if exp := []uintptr{0x3000, 0x4000}; !reflect.DeepEqual(flushed, exp) {
+			t.Fatalf("expected flushed addresses to be %v; got %v", exp, flushed)
+		}
+	})
+
+	t.Run("IPI error", func(t *testing.T) {
+		expErr := &kernel.Error{Module: "test", Message: "IPI timeout"}
+		broadcastIPIFn = func(_ uint8) *kernel.Error { return expErr }
+
+		defer func() {
+			if err := recover(); err != expErr {
+				t.Fatalf("expected to panic with %v; got %v", expErr, err)
+			}
+
+			if shootdownLock != 0 {
+				t.Fatal("expected the shootdown lock to be released")
+			}
+		}()
+
+		sendShootdown([]uintptr{0x1000}, false)
+	})
+
+	t.Run("ack timeout", func(t *testing.T) {
+		broadcastIPIFn = func(_ uint8) *kernel.Error { return nil }
+
+		defer func() {
+			if err := recover(); err != errShootdownTimeout {
+				t.Fatalf("expected to panic with %v; got %v", errShootdownTimeout, err)
+			}
+		}()
+
+		sendShootdown([]uintptr{0x1000}, false)
+	})
+}
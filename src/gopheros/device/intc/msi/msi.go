@@ -0,0 +1,245 @@
+// Package msi provides helpers for composing message signaled interrupts
+// (MSI) and programming the MSI and MSI-X capabilities of PCI devices.
+//
+// Devices that use message signaled interrupts deliver them by writing a
+// message to a special address range that is decoded by the local APICs,
+// bypassing the I/O APICs. As a result, each device can be assigned its own
+// vectors instead of sharing a legacy IRQ line with other devices.
+package msi
+
+import (
+	"gopheros/kernel"
+	"unsafe"
+)
+
+const (
+	// The message address selects the local APIC that receives the
+	// interrupt; the message data selects the vector.
+	msgAddressBase = 0xfee00000
+	msgDestShift   = 12
+
+	// Offsets into the PCI configuration space header.
+	cfgStatusCommand = 0x04
+	cfgCapPointer    = 0x34
+
+	statusCapList = 1 << 20
+
+	// maxCapabilities bounds the capability list walk so a malformed list
+	// cannot cause an infinite loop. The capability structures must be
+	// located after the 64-byte header of the 256-byte config space.
+	maxCapabilities = (256 - 64) / 4
+
+	// Capability IDs.
+	capIDMSI  = 0x05
+	capIDMSIX = 0x11
+
+	// MSI message control bits (upper half of the capability dword) and
+	// register offsets relative to the capability.
+	msiEnable           = 1 << 16
+	msiMultiCapShift    = 17
+	msiMultiEnShift     = 20
+	msiMultiEnMask      = 0x7 << msiMultiEnShift
+	msi64BitCapable     = 1 << 23
+	msiAddrLowOffset    = 0x04
+	msiAddrHighOffset   = 0x08
+	msiData32Offset     = 0x08
+	msiData64Offset     = 0x0c
+	msiDataPreserveMask = 0xffff0000
+
+	// MSI-X message control bits (upper half of the capability dword) and
+	// register offsets relative to the capability.
+	msixTableSizeMask = 0x7ff << 16
+	msixFunctionMask  = 1 << 30
+	msixEnable        = 1 << 31
+	msixTableOffset   = 0x04
+	msixPBAOffset     = 0x08
+	msixBIRMask       = 0x7
+
+	// MSI-X table entry layout.
+	msixEntrySize      = 16
+	msixEntryAddrLow   = 0x0
+	msixEntryAddrHigh  = 0x4
+	msixEntryData      = 0x8
+	msixEntryControl   = 0xc
+	msixEntryMaskedBit = 1 << 0
+)
+
+var (
+	errInvalidDestination = &kernel.Error{Module: "msi", Message: "APIC ID cannot be addressed without interrupt remapping"}
+	errNoMSICapability    = &kernel.Error{Module: "msi", Message: "device does not support MSI"}
+	errNoMSIXCapability   = &kernel.Error{Module: "msi", Message: "device does not support MSI-X"}
+	errInvalidVectorCount = &kernel.Error{Module: "msi", Message: "vector count not supported by device"}
+)
+
+// ConfigSpace is implemented by types that provide access to the PCI
+// configuration space of a device function. All offsets are dword-aligned.
+type ConfigSpace interface {
+	// ReadConfig32 returns the dword at the supplied offset.
+	ReadConfig32(offset uint8) uint32
+
+	// WriteConfig32 writes a dword to the supplied offset.
+	WriteConfig32(offset uint8, value uint32)
+}
+
+// Message describes the address/data pair that a device writes to signal
+// an interrupt.
+type Message struct {
+	Address uint64
+	Data    uint32
+}
+
+// Compose returns an edge-triggered, fixed-delivery message that raises
+// vector on the CPU with APIC ID dest. APIC IDs above 255 can only be
+// targeted via interrupt remapping, which is not supported.
+func Compose(dest uint32, vector uint8) (Message, *kernel.Error) {
+	if dest > 0xff {
+		return Message{}, errInvalidDestination
+	}
+
+	return Message{
+		Address: msgAddressBase | uint64(dest)<<msgDestShift,
+		Data:    uint32(vector),
+	}, nil
+}
+
+// FindCapability walks the capability list of a PCI device function and
+// returns the config space offset of the capability with the supplied ID.
+func FindCapability(cfg ConfigSpace, id uint8) (uint8, bool) {
+	if cfg.ReadConfig32(cfgStatusCommand)&statusCapList == 0 {
+		return 0, false
+	}
+
+	offset := uint8(cfg.ReadConfig32(cfgCapPointer)) &^ 3
+	for i := 0; offset != 0 && i < maxCapabilities; i++ {
+		header := cfg.ReadConfig32(offset)
+		if uint8(header) == id {
+			return offset, true
+		}
+
+		offset = uint8(header>>8) &^ 3
+	}
+
+	return 0, false
+}
+
+// EnableMSI programs the MSI capability of a device function with msg and
+// enables count vectors. When more than one vector is enabled, the device
+// signals each one by modifying the low bits of the message data; the
+// vector in msg must therefore be aligned to count (see irq.AllocVectors).
+func EnableMSI(cfg ConfigSpace, msg Message, count uint8) *kernel.Error {
+	capOffset, ok := FindCapability(cfg, capIDMSI)
+	if !ok {
+		return errNoMSICapability
+	}
+
+	ctrl := cfg.ReadConfig32(capOffset)
+	maxCount := uint32(1) << ((ctrl >> msiMultiCapShift) & 0x7)
+	if count == 0 || uint32(count) > maxCount || count&(count-1) != 0 {
+		return errInvalidVectorCount
+	}
+
+	dataOffset := capOffset + msiData32Offset
+	cfg.WriteConfig32(capOffset+msiAddrLowOffset, uint32(msg.Address))
+	if ctrl&msi64BitCapable != 0 {
+		cfg.WriteConfig32(capOffset+msiAddrHighOffset, uint32(msg.Address>>32))
+		dataOffset = capOffset + msiData64Offset
+	}
+
+	// The message data register is 16 bits wide; preserve the contents
+	// of the upper half of the dword.
+	data := cfg.ReadConfig32(dataOffset)&msiDataPreserveMask | msg.Data&0xffff
+	cfg.WriteConfig32(dataOffset, data)
+
+	var log2Count uint32
+	for ; 1<<log2Count < uint32(count); log2Count++ {
+	}
+
+	ctrl = ctrl&^msiMultiEnMask | log2Count<<msiMultiEnShift | msiEnable
+	cfg.WriteConfig32(capOffset, ctrl)
+	return nil
+}
+
+// DisableMSI disables message signaled interrupts for a device function.
+func DisableMSI(cfg ConfigSpace) *kernel.Error {
+	capOffset, ok := FindCapability(cfg, capIDMSI)
+	if !ok {
+		return errNoMSICapability
+	}
+
+	cfg.WriteConfig32(capOffset, cfg.ReadConfig32(capOffset)&^msiEnable)
+	return nil
+}
+
+// MSIXInfo describes the location and size of the MSI-X table and pending
+// bit array (PBA) of a device function. The table and PBA reside in memory
+// space at an offset from the address of the specified BAR.
+type MSIXInfo struct {
+	TableSize   uint16
+	TableBAR    uint8
+	TableOffset uint32
+	PBABAR      uint8
+	PBAOffset   uint32
+}
+
+// MSIXCapability returns information about the MSI-X capability of a
+// device function. The caller is responsible for mapping the BAR that
+// contains the table before programming it via SetMSIXEntry.
+func MSIXCapability(cfg ConfigSpace) (MSIXInfo, *kernel.Error) {
+	capOffset, ok := FindCapability(cfg, capIDMSIX)
+	if !ok {
+		return MSIXInfo{}, errNoMSIXCapability
+	}
+
+	ctrl := cfg.ReadConfig32(capOffset)
+	table := cfg.ReadConfig32(capOffset + msixTableOffset)
+	pba := cfg.ReadConfig32(capOffset + msixPBAOffset)
+
+	return MSIXInfo{
+		TableSize:   uint16((ctrl&msixTableSizeMask)>>16) + 1,
+		TableBAR:    uint8(table & msixBIRMask),
+		TableOffset: table &^ msixBIRMask,
+		PBABAR:      uint8(pba & msixBIRMask),
+		PBAOffset:   pba &^ msixBIRMask,
+	}, nil
+}
+
+// SetMSIXEntry programs the entry at the supplied index of an MSI-X table
+// mapped at the virtual address table. The entry is masked while it is
+// being updated and remains masked if masked is true.
+func SetMSIXEntry(table uintptr, index uint16, msg Message, masked bool) {
+	entry := table + uintptr(index)*msixEntrySize
+
+	ctrl := (*uint32)(unsafe.Pointer(entry + msixEntryControl))
+	*ctrl |= msixEntryMaskedBit
+
+	*(*uint32)(unsafe.Pointer(entry + msixEntryAddrLow)) = uint32(msg.Address)
+	*(*uint32)(unsafe.Pointer(entry + msixEntryAddrHigh)) = uint32(msg.Address >> 32)
+	*(*uint32)(unsafe.Pointer(entry + msixEntryData)) = msg.Data
+
+	if !masked {
+		*ctrl &^= msixEntryMaskedBit
+	}
+}
+
+// EnableMSIX enables MSI-X for a device function. Table entries should be
+// programmed via SetMSIXEntry before calling EnableMSIX.
+func EnableMSIX(cfg ConfigSpace) *kernel.Error {
+	capOffset, ok := FindCapability(cfg, capIDMSIX)
+	if !ok {
+		return errNoMSIXCapability
+	}
+
+	cfg.WriteConfig32(capOffset, cfg.ReadConfig32(capOffset)&^msixFunctionMask|msixEnable)
+	return nil
+}
+
+// DisableMSIX disables MSI-X for a device function.
+func DisableMSIX(cfg ConfigSpace) *kernel.Error {
+	capOffset, ok := FindCapability(cfg, capIDMSIX)
+	if !ok {
+		return errNoMSIXCapability
+	}
+
+	cfg.WriteConfig32(capOffset, cfg.ReadConfig32(capOffset)&^msixEnable)
+	return nil
+}
@@ -0,0 +1,213 @@
+package msi
+
+import (
+	"testing"
+	"unsafe"
+)
+
+func TestCompose(t *testing.T) {
+	msg, err := Compose(3, 0x41)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if exp := (Message{Address: 0xfee03000, Data: 0x41}); msg != exp {
+		t.Fatalf("expected message %+v; got %+v", exp, msg)
+	}
+
+	if _, err = Compose(0x100, 0x41); err != errInvalidDestination {
+		t.Fatalf("expected error %v; got %v", errInvalidDestination, err)
+	}
+}
+
+func TestFindCapability(t *testing.T) {
+	specs := []struct {
+		cfg       mockConfigSpace
+		id        uint8
+		expOffset uint8
+		expFound  bool
+	}{
+		// No capability list
+		{mockConfigSpace{cfgCapPointer: 0x40}, capIDMSI, 0, false},
+		// Capability found at the end of the list
+		{
+			mockConfigSpace{
+				cfgStatusCommand: statusCapList,
+				cfgCapPointer:    0x40,
+				0x40:             0x5001,
+				0x50:             0x6009,
+				0x60:             capIDMSI,
+			},
+			capIDMSI, 0x60, true,
+		},
+		// Capability not present
+		{
+			mockConfigSpace{cfgStatusCommand: statusCapList, cfgCapPointer: 0x40, 0x40: 0x0001},
+			capIDMSIX, 0, false,
+		},
+		// Malformed list that loops back on itself
+		{
+			mockConfigSpace{cfgStatusCommand: statusCapList, cfgCapPointer: 0x40, 0x40: 0x4001},
+			capIDMSIX, 0, false,
+		},
+	}
+
+	for specIndex, spec := range specs {
+		offset, found := FindCapability(spec.cfg, spec.id)
+		if offset != spec.expOffset || found != spec.expFound {
+			t.Errorf("[spec %d] expected (0x%x, %t); got (0x%x, %t)", specIndex, spec.expOffset, spec.expFound, offset, found)
+		}
+	}
+}
+
+func TestMSI(t *testing.T) {
+	msg := Message{Address: 0xfee01000, Data: 0x48}
+
+	t.Run("64-bit capability", func(t *testing.T) {
+		cfg := mockConfigSpace{
+			cfgStatusCommand: statusCapList,
+			cfgCapPointer:    0x50,
+			// 8 messages capable, 64-bit address
+			0x50: capIDMSI | msi64BitCapable | 3<<msiMultiCapShift,
+			0x58: 0xdead,
+			0x5c: 0xbeef0000,
+		}
+
+		if err := EnableMSI(cfg, msg, 8); err != nil {
+			t.Fatal(err)
+		}
+
+		if exp := uint32(capIDMSI | msi64BitCapable | 3<<msiMultiCapShift | 3<<msiMultiEnShift | msiEnable); cfg[0x50] != exp {
+			t.Fatalf("expected message control to be 0x%x; got 0x%x", exp, cfg[0x50])
+		}
+
+		if cfg[0x54] != 0xfee01000 || cfg[0x58] != 0 {
+			t.Fatalf("expected message address to be 0xfee01000; got 0x%x%08x", cfg[0x58], cfg[0x54])
+		}
+
+		if cfg[0x5c] != 0xbeef0048 {
+			t.Fatalf("expected message data register to be 0xbeef0048; got 0x%x", cfg[0x5c])
+		}
+
+		if err := DisableMSI(cfg); err != nil {
+			t.Fatal(err)
+		}
+
+		if cfg[0x50]&msiEnable != 0 {
+			t.Fatal("expected MSI to be disabled")
+		}
+	})
+
+	t.Run("32-bit capability", func(t *testing.T) {
+		cfg := mockConfigSpace{
+			cfgStatusCommand: statusCapList,
+			cfgCapPointer:    0x50,
+			0x50:             capIDMSI | 6<<msiMultiEnShift,
+		}
+
+		if err := EnableMSI(cfg, msg, 1); err != nil {
+			t.Fatal(err)
+		}
+
+		if exp := uint32(capIDMSI | msiEnable); cfg[0x50] != exp {
+			t.Fatalf("expected message control to be 0x%x; got 0x%x", exp, cfg[0x50])
+		}
+
+		if cfg[0x54] != 0xfee01000 || cfg[0x58] != 0x48 {
+			t.Fatalf("expected address/data to be 0xfee01000/0x48; got 0x%x/0x%x", cfg[0x54], cfg[0x58])
+		}
+
+		for _, count := range []uint8{0, 2} {
+			if err := EnableMSI(cfg, msg, count); err != errInvalidVectorCount {
+				t.Errorf("[count %d] expected error %v; got %v", count, errInvalidVectorCount, err)
+			}
+		}
+	})
+
+	t.Run("missing capability", func(t *testing.T) {
+		cfg := mockConfigSpace{}
+
+		if err := EnableMSI(cfg, msg, 1); err != errNoMSICapability {
+			t.Fatalf("expected error %v; got %v", errNoMSICapability, err)
+		}
+
+		if err := DisableMSI(cfg); err != errNoMSICapability {
+			t.Fatalf("expected error %v; got %v", errNoMSICapability, err)
+		}
+	})
+}
+
+func TestMSIX(t *testing.T) {
+	cfg := mockConfigSpace{
+		cfgStatusCommand: statusCapList,
+		cfgCapPointer:    0x40,
+		0x40:             0x7000 | capIDMSIX | msixFunctionMask | 15<<16,
+		0x44:             0x2000 | 2,
+		0x48:             0x3000 | 4,
+		0x70:             capIDMSI,
+	}
+
+	info, err := MSIXCapability(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := MSIXInfo{TableSize: 16, TableBAR: 2, TableOffset: 0x2000, PBABAR: 4, PBAOffset: 0x3000}
+	if info != exp {
+		t.Fatalf("expected MSI-X info %+v; got %+v", exp, info)
+	}
+
+	var table [4 * msixEntrySize / 4]uint32
+	table[1*4+3] = msixEntryMaskedBit
+	tableAddr := uintptr(unsafe.Pointer(&table[0]))
+
+	SetMSIXEntry(tableAddr, 1, Message{Address: 0xfee02000, Data: 0x50}, false)
+	SetMSIXEntry(tableAddr, 2, Message{Address: 0xfee03000, Data: 0x51}, true)
+
+	expTable := [16]uint32{
+		0, 0, 0, 0,
+		0xfee02000, 0, 0x50, 0,
+		0xfee03000, 0, 0x51, msixEntryMaskedBit,
+		0, 0, 0, 0,
+	}
+	if table != expTable {
+		t.Fatalf("expected MSI-X table to be %x; got %x", expTable, table)
+	}
+
+	if err = EnableMSIX(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg[0x40]&(msixEnable|msixFunctionMask) != msixEnable {
+		t.Fatalf("expected MSI-X to be enabled and the function to be unmasked; got control 0x%x", cfg[0x40])
+	}
+
+	if err = DisableMSIX(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg[0x40]&msixEnable != 0 {
+		t.Fatal("expected MSI-X to be disabled")
+	}
+
+	// MSI-X is not supported by this device
+	cfg = mockConfigSpace{}
+	if _, err = MSIXCapability(cfg); err != errNoMSIXCapability {
+		t.Fatalf("expected error %v; got %v", errNoMSIXCapability, err)
+	}
+
+	if err = EnableMSIX(cfg); err != errNoMSIXCapability {
+		t.Fatalf("expected error %v; got %v", errNoMSIXCapability, err)
+	}
+
+	if err = DisableMSIX(cfg); err != errNoMSIXCapability {
+		t.Fatalf("expected error %v; got %v", errNoMSIXCapability, err)
+	}
+}
+
+// mockConfigSpace implements ConfigSpace using a map of dword offsets to
+// values.
+type mockConfigSpace map[uint8]uint32
+
+func (m mockConfigSpace) ReadConfig32(offset uint8) uint32         { return m[offset] }
+func (m mockConfigSpace) WriteConfig32(offset uint8, value uint32) { m[offset] = value }
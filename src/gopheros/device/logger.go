@@ -0,0 +1,157 @@
+package device
+
+import (
+	"gopheros/kernel/kfmt"
+	"io"
+	"strings"
+)
+
+// LogLevel describes the severity of a log message.
+type LogLevel uint8
+
+const (
+	// LogLevelDebug is used for verbose messages that are only useful
+	// when troubleshooting a driver.
+	LogLevelDebug LogLevel = iota
+
+	// LogLevelInfo is used for informational messages. It is the default
+	// log level.
+	LogLevelInfo
+
+	// LogLevelWarn is used for recoverable errors.
+	LogLevelWarn
+
+	// LogLevelError is used for errors that prevent a driver from
+	// operating correctly.
+	LogLevelError
+)
+
+// String implements fmt.Stringer for LogLevel.
+func (l LogLevel) String() string {
+	switch l {
+	case LogLevelDebug:
+		return "debug"
+	case LogLevelInfo:
+		return "info"
+	case LogLevelWarn:
+		return "warn"
+	case LogLevelError:
+		return "error"
+	default:
+		return "unknown"
+	}
+}
+
+// parseLogLevel returns the log level that corresponds to the supplied
+// string. The second return value is false if s is not a valid log level.
+func parseLogLevel(s string) (LogLevel, bool) {
+	for level := LogLevelDebug; level <= LogLevelError; level++ {
+		if level.String() == s {
+			return level, true
+		}
+	}
+
+	return LogLevelInfo, false
+}
+
+var (
+	// defaultLogLevel is the log level used by drivers that do not have
+	// a log level override.
+	defaultLogLevel = LogLevelInfo
+
+	// driverLogLevels contains the per-driver log level overrides.
+	driverLogLevels map[string]LogLevel
+)
+
+// ConfigureLogLevels sets up the driver log levels using the kernel command
+// line. The "loglevel" parameter (e.g. "loglevel=debug") sets the default
+// log level for all drivers while "<driver>.loglevel" parameters (e.g.
+// "smbios.loglevel=warn") override the log level for a particular driver.
+// Parameters with invalid values are ignored.
+func ConfigureLogLevels() {
+	defaultLogLevel = LogLevelInfo
+	driverLogLevels = make(map[string]LogLevel)
+
+	for name, value := range cmdLineFn() {
+		level, ok := parseLogLevel(value)
+		if !ok {
+			continue
+		}
+
+		switch {
+		case name == "loglevel":
+			defaultLogLevel = level
+		case strings.HasSuffix(name, ".loglevel"):
+			driverLogLevels[strings.TrimSuffix(name, ".loglevel")] = level
+		}
+	}
+}
+
+// DriverLogLevel returns the log level for the driver with the supplied
+// name.
+func DriverLogLevel(driverName string) LogLevel {
+	if level, ok := driverLogLevels[driverName]; ok {
+		return level
+	}
+
+	return defaultLogLevel
+}
+
+// Logger is passed to drivers when they are initialized. It injects a
+// prefix that identifies the driver at the beginning of each line and
+// discards messages below the configured log level. Logger implements
+// io.Writer; data written via Write is logged with LogLevelInfo.
+//
+// All Logger methods can be safely invoked on a nil Logger in which case
+// the output is discarded.
+type Logger struct {
+	w     kfmt.PrefixWriter
+	level LogLevel
+}
+
+// NewLogger returns a Logger that writes messages with a level greater than
+// or equal to level to sink. Each line of output is prefixed by prefix.
+func NewLogger(sink io.Writer, prefix []byte, level LogLevel) *Logger {
+	return &Logger{
+		w:     kfmt.PrefixWriter{Sink: sink, Prefix: prefix},
+		level: level,
+	}
+}
+
+// Write implements io.Writer. It writes p to the logger sink using
+// LogLevelInfo.
+func (l *Logger) Write(p []byte) (int, error) {
+	if l == nil || l.level > LogLevelInfo {
+		return len(p), nil
+	}
+
+	return l.w.Write(p)
+}
+
+// Debugf logs a message with LogLevelDebug.
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.logf(LogLevelDebug, format, args...)
+}
+
+// Infof logs a message with LogLevelInfo.
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.logf(LogLevelInfo, format, args...)
+}
+
+// Warnf logs a message with LogLevelWarn.
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	l.logf(LogLevelWarn, format, args...)
+}
+
+// Errorf logs a message with LogLevelError.
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.logf(LogLevelError, format, args...)
+}
+
+func (l *Logger) logf(level LogLevel, format string, args ...interface{}) {
+	if l == nil || level < l.level {
+		return
+	}
+
+	kfmt.Fprintf(&l.w, format, args...)
+}
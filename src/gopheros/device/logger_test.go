@@ -0,0 +1,123 @@
+package device
+
+import (
+	"bytes"
+	"gopheros/kernel/kfmt"
+	"reflect"
+	"testing"
+)
+
+func TestLogLevelString(t *testing.T) {
+	specs := []struct {
+		input LogLevel
+		exp   string
+	}{
+		{LogLevelDebug, "debug"},
+		{LogLevelInfo, "info"},
+		{LogLevelWarn, "warn"},
+		{LogLevelError, "error"},
+		{LogLevel(42), "unknown"},
+	}
+
+	for specIndex, spec := range specs {
+		if got := spec.input.String(); got != spec.exp {
+			t.Errorf("[spec %d] expected %q; got %q", specIndex, spec.exp, got)
+		}
+	}
+}
+
+func TestConfigureLogLevels(t *testing.T) {
+	defer func(origCmdLineFn func() map[string]string) {
+		cmdLineFn = origCmdLineFn
+		defaultLogLevel = LogLevelInfo
+		driverLogLevels = nil
+	}(cmdLineFn)
+
+	if got := DriverLogLevel("smbios"); got != LogLevelInfo {
+		t.Fatalf("expected default log level to be %v; got %v", LogLevelInfo, got)
+	}
+
+	cmdLineFn = func() map[string]string {
+		return map[string]string{
+			"loglevel":         "warn",
+			"smbios.loglevel":  "debug",
+			"vt.loglevel":      "error",
+			"vesa.loglevel":    "verbose",
+			"console.loglevel": "console.loglevel",
+			"acpi":             "off",
+		}
+	}
+	ConfigureLogLevels()
+
+	expLevels := map[string]LogLevel{"smbios": LogLevelDebug, "vt": LogLevelError}
+	if !reflect.DeepEqual(driverLogLevels, expLevels) {
+		t.Fatalf("expected driver log levels to be %v; got %v", expLevels, driverLogLevels)
+	}
+
+	specs := []struct {
+		driver string
+		exp    LogLevel
+	}{
+		{"smbios", LogLevelDebug},
+		{"vt", LogLevelError},
+		{"vesa", LogLevelWarn},
+		{"e1000", LogLevelWarn},
+	}
+
+	for specIndex, spec := range specs {
+		if got := DriverLogLevel(spec.driver); got != spec.exp {
+			t.Errorf("[spec %d] expected log level for %q to be %v; got %v", specIndex, spec.driver, spec.exp, got)
+		}
+	}
+}
+
+func TestLogger(t *testing.T) {
+	specs := []struct {
+		level LogLevel
+		exp   string
+	}{
+		{
+			LogLevelDebug,
+			"[drv] debug 1\n[drv] info 2\n[drv] warn 3\n[drv] error 4\n[drv] write\n[drv] multi\n[drv] line\n",
+		},
+		{
+			LogLevelInfo,
+			"[drv] info 2\n[drv] warn 3\n[drv] error 4\n[drv] write\n[drv] multi\n[drv] line\n",
+		},
+		{
+			LogLevelWarn,
+			"[drv] warn 3\n[drv] error 4\n",
+		},
+		{
+			LogLevelError,
+			"[drv] error 4\n",
+		},
+	}
+
+	for specIndex, spec := range specs {
+		var buf bytes.Buffer
+		log := NewLogger(&buf, []byte("[drv] "), spec.level)
+
+		log.Debugf("debug %d\n", 1)
+		log.Infof("info %d\n", 2)
+		log.Warnf("warn %d\n", 3)
+		log.Errorf("error %d\n", 4)
+		kfmt.Fprintf(log, "write\n")
+		if n, err := log.Write([]byte("multi\nline\n")); n != 11 || err != nil {
+			t.Errorf("[spec %d] expected Write to return 11, nil; got %d, %v", specIndex, n, err)
+		}
+
+		if got := buf.String(); got != spec.exp {
+			t.Errorf("[spec %d] expected output to be:\n%q\ngot:\n%q", specIndex, spec.exp, got)
+		}
+	}
+
+	t.Run("nil logger", func(t *testing.T) {
+		var log *Logger
+
+		log.Errorf("discarded\n")
+		if n, err := log.Write([]byte("discarded")); n != 9 || err != nil {
+			t.Fatalf("expected Write to return 9, nil; got %d, %v", n, err)
+		}
+	})
+}
@@ -0,0 +1,96 @@
+package device
+
+import (
+	"gopheros/kernel/hal/multiboot"
+	"strconv"
+	"strings"
+)
+
+var (
+	// cmdLineFn is overridden by tests.
+	cmdLineFn = multiboot.GetBootCmdLine
+)
+
+// Param returns the value of the named kernel command line parameter. The
+// second return value is false if the parameter was not specified.
+//
+// Parameters are specified as space-separated "name=value" pairs (e.g.
+// "console=serial loglevel=debug"); parameters specified without a value
+// (e.g. "noapic") have their own name as their value. By convention,
+// parameters that only apply to a particular driver are prefixed by the
+// driver name followed by a dot (e.g. "vesa_fb_console.mode=1024x768").
+// Param should be invoked by drivers from their probe or init functions.
+func Param(name string) (string, bool) {
+	value, ok := cmdLineFn()[name]
+	return value, ok
+}
+
+// ParamString returns the value of the named kernel command line parameter
+// or defValue if the parameter was not specified.
+func ParamString(name, defValue string) string {
+	if value, ok := Param(name); ok {
+		return value
+	}
+
+	return defValue
+}
+
+// ParamBool returns the value of the named kernel command line parameter
+// interpreted as a boolean. The values "1", "on", "yes" and "true" are
+// interpreted as true while "0", "off", "no" and "false" are interpreted as
+// false. A parameter specified without a value is interpreted as true.
+// ParamBool returns defValue if the parameter was not specified or if its
+// value cannot be interpreted as a boolean.
+func ParamBool(name string, defValue bool) bool {
+	value, ok := Param(name)
+	if !ok {
+		return defValue
+	}
+
+	switch value {
+	case name, "1", "on", "yes", "true":
+		return true
+	case "0", "off", "no", "false":
+		return false
+	default:
+		return defValue
+	}
+}
+
+// ParamInt returns the value of the named kernel command line parameter
+// interpreted as an integer. Hex ("0x") and octal ("0") prefixes are
+// supported. ParamInt returns defValue if the parameter was not specified or
+// if its value is not a valid integer.
+func ParamInt(name string, defValue int) int {
+	value, ok := Param(name)
+	if !ok {
+		return defValue
+	}
+
+	res, err := strconv.ParseInt(value, 0, 0)
+	if err != nil {
+		return defValue
+	}
+
+	return int(res)
+}
+
+// ParamList returns the value of the named kernel command line parameter
+// split into a list of comma-separated items (e.g. "console=serial,vga").
+// Empty items are omitted. ParamList returns nil if the parameter was not
+// specified.
+func ParamList(name string) []string {
+	value, ok := Param(name)
+	if !ok {
+		return nil
+	}
+
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item != "" {
+			list = append(list, item)
+		}
+	}
+
+	return list
+}
@@ -0,0 +1,91 @@
+package device
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParams(t *testing.T) {
+	defer func(origCmdLineFn func() map[string]string) {
+		cmdLineFn = origCmdLineFn
+	}(cmdLineFn)
+
+	cmdLineFn = func() map[string]string {
+		return map[string]string{
+			"acpi":                    "off",
+			"noapic":                  "noapic",
+			"console":                 "serial,,vga",
+			"loglevel":                "debug",
+			"vesa_fb_console.width":   "1024",
+			"vesa_fb_console.address": "0xfd000000",
+			"vesa_fb_console.height":  "tall",
+			"debug":                   "maybe",
+			"smbios":                  "1",
+		}
+	}
+
+	if value, ok := Param("loglevel"); !ok || value != "debug" {
+		t.Errorf("expected Param to return \"debug\", true; got %q, %t", value, ok)
+	}
+
+	if value, ok := Param("root"); ok || value != "" {
+		t.Errorf("expected Param to return \"\", false for missing param; got %q, %t", value, ok)
+	}
+
+	stringSpecs := []struct {
+		name, defValue, exp string
+	}{
+		{"loglevel", "info", "debug"},
+		{"root", "/dev/sda", "/dev/sda"},
+	}
+
+	for specIndex, spec := range stringSpecs {
+		if got := ParamString(spec.name, spec.defValue); got != spec.exp {
+			t.Errorf("[spec %d] expected ParamString to return %q; got %q", specIndex, spec.exp, got)
+		}
+	}
+
+	boolSpecs := []struct {
+		name     string
+		defValue bool
+		exp      bool
+	}{
+		{"acpi", true, false},
+		{"noapic", false, true},
+		{"smbios", false, true},
+		{"debug", true, true},
+		{"debug", false, false},
+		{"missing", true, true},
+	}
+
+	for specIndex, spec := range boolSpecs {
+		if got := ParamBool(spec.name, spec.defValue); got != spec.exp {
+			t.Errorf("[spec %d] expected ParamBool to return %t; got %t", specIndex, spec.exp, got)
+		}
+	}
+
+	intSpecs := []struct {
+		name     string
+		defValue int
+		exp      int
+	}{
+		{"vesa_fb_console.width", 0, 1024},
+		{"vesa_fb_console.address", 0, 0xfd000000},
+		{"vesa_fb_console.height", 768, 768},
+		{"missing", 42, 42},
+	}
+
+	for specIndex, spec := range intSpecs {
+		if got := ParamInt(spec.name, spec.defValue); got != spec.exp {
+			t.Errorf("[spec %d] expected ParamInt to return %d; got %d", specIndex, spec.exp, got)
+		}
+	}
+
+	if exp, got := []string{"serial", "vga"}, ParamList("console"); !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected ParamList to return %v; got %v", exp, got)
+	}
+
+	if got := ParamList("missing"); got != nil {
+		t.Errorf("expected ParamList to return nil for missing param; got %v", got)
+	}
+}
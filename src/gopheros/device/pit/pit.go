@@ -0,0 +1,76 @@
+// Package pit provides access to channel 2 of the 8254 programmable interval
+// timer (PIT). The channel is used as a reference clock when calibrating
+// timers whose frequency is not reported by the hardware.
+package pit
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/cpu"
+)
+
+const (
+	// Frequency is the input clock frequency of the PIT in Hz.
+	Frequency = 1193182
+
+	// MaxOneShotMs is the longest one-shot count that fits in the 16-bit
+	// channel 2 counter.
+	MaxOneShotMs = 0xffff * 1000 / Frequency
+
+	channel2Port  = 0x42
+	commandPort   = 0x43
+	gatePort      = 0x61
+	gateEnable    = 1 << 0
+	speakerEnable = 1 << 1
+	outputHigh    = 1 << 5
+
+	// Select channel 2, lobyte/hibyte access and mode 0 (interrupt on
+	// terminal count).
+	channel2Mode0 = 0xb0
+
+	// maxPoll bounds the number of polls while waiting for the count to
+	// expire.
+	maxPoll = 1 << 24
+)
+
+var (
+	// The following functions are used by tests to mock calls to the cpu
+	// package and are automatically inlined by the compiler.
+	portReadByteFn  = cpu.PortReadByte
+	portWriteByteFn = cpu.PortWriteByte
+
+	errInvalidDuration = &kernel.Error{Module: "pit", Message: "one-shot duration out of range"}
+	errTimeout         = &kernel.Error{Module: "pit", Message: "timed out while waiting for the channel 2 count to expire"}
+)
+
+// OneShot programs PIT channel 2 to count down for the requested number of
+// milliseconds and busy-waits until the count expires. The start callback is
+// invoked right after the count begins so that callers can sample the clock
+// they are calibrating. The PC speaker is disconnected from channel 2 while
+// the count is in progress.
+func OneShot(ms uint32, start func()) *kernel.Error {
+	if ms == 0 || ms > MaxOneShotMs {
+		return errInvalidDuration
+	}
+
+	// Connect the channel 2 gate and disconnect the PC speaker
+	gate := portReadByteFn(gatePort)&^speakerEnable | gateEnable
+	portWriteByteFn(gatePort, gate)
+
+	count := uint16(Frequency * ms / 1000)
+	portWriteByteFn(commandPort, channel2Mode0)
+	portWriteByteFn(channel2Port, uint8(count))
+	portWriteByteFn(channel2Port, uint8(count>>8))
+
+	// Restart the count by toggling the gate
+	portWriteByteFn(gatePort, gate&^gateEnable)
+	portWriteByteFn(gatePort, gate)
+	start()
+
+	for poll := 0; portReadByteFn(gatePort)&outputHigh == 0; poll++ {
+		if poll == maxPoll {
+			return errTimeout
+		}
+	}
+
+	return nil
+}
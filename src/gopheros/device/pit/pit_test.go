@@ -0,0 +1,89 @@
+package pit
+
+import (
+	"bytes"
+	"gopheros/kernel/cpu"
+	"testing"
+)
+
+func TestOneShot(t *testing.T) {
+	defer resetState()
+
+	var (
+		polls     int
+		started   bool
+		expired   bool
+		gateState uint8
+		written   []uint8
+	)
+
+	portWriteByteFn = func(port uint16, value uint8) {
+		switch port {
+		case channel2Port:
+			written = append(written, value)
+		case gatePort:
+			gateState = value
+		}
+	}
+	portReadByteFn = func(port uint16) uint8 {
+		if port != gatePort {
+			t.Errorf("unexpected read from port 0x%x", port)
+			return 0
+		}
+
+		// The first read configures the gate
+		if polls++; polls == 1 {
+			return speakerEnable
+		}
+
+		if !started {
+			t.Error("expected the start callback to be invoked before polling the output")
+		}
+
+		if polls < 4 {
+			return 0
+		}
+
+		expired = true
+		return outputHigh
+	}
+
+	if err := OneShot(10, func() { started = true }); err != nil {
+		t.Fatal(err)
+	}
+
+	if !expired {
+		t.Fatal("expected OneShot to wait for the count to expire")
+	}
+
+	// 10ms at 1193182Hz = 11931 (0x2e9b) PIT ticks
+	if exp := []uint8{0x9b, 0x2e}; !bytes.Equal(written, exp) {
+		t.Fatalf("expected channel 2 count to be programmed with %v; got %v", exp, written)
+	}
+
+	if gateState&speakerEnable != 0 || gateState&gateEnable == 0 {
+		t.Fatalf("expected the gate to be enabled and the speaker disconnected; got 0x%x", gateState)
+	}
+}
+
+func TestOneShotErrors(t *testing.T) {
+	defer resetState()
+
+	portReadByteFn = func(_ uint16) uint8 { return 0 }
+	portWriteByteFn = func(_ uint16, _ uint8) {}
+
+	for _, ms := range []uint32{0, MaxOneShotMs + 1} {
+		if err := OneShot(ms, func() {}); err != errInvalidDuration {
+			t.Errorf("[%dms] expected error %v; got %v", ms, errInvalidDuration, err)
+		}
+	}
+
+	if err := OneShot(MaxOneShotMs, func() {}); err != errTimeout {
+		t.Fatalf("expected error %v; got %v", errTimeout, err)
+	}
+}
+
+func resetState() {
+	portReadByteFn = cpu.PortReadByte
+	portWriteByteFn = cpu.PortWriteByte
+}
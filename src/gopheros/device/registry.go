@@ -0,0 +1,382 @@
+package device
+
+import (
+	"bytes"
+	"gopheros/kernel"
+	"gopheros/kernel/kfmt"
+	"io"
+)
+
+// ResourceType describes the type of a hardware resource used by a device.
+type ResourceType uint8
+
+const (
+	// ResourceIOPort describes a range of I/O ports.
+	ResourceIOPort ResourceType = iota
+
+	// ResourceMemory describes a memory-mapped I/O region.
+	ResourceMemory
+
+	// ResourceIRQ describes an interrupt line. Only the Base field is
+	// used for IRQ resources.
+	ResourceIRQ
+)
+
+// String implements fmt.Stringer for ResourceType.
+func (t ResourceType) String() string {
+	switch t {
+	case ResourceIOPort:
+		return "io"
+	case ResourceMemory:
+		return "mem"
+	case ResourceIRQ:
+		return "irq"
+	default:
+		return "unknown"
+	}
+}
+
+// Resource describes a hardware resource assigned to a device by the bus
+// that enumerated it.
+type Resource struct {
+	Type   ResourceType
+	Base   uint64
+	Length uint64
+}
+
+// Node describes a device in the registry. Devices are discovered by bus
+// enumerators which add them as children of the bus device they belong to.
+type Node struct {
+	// Name identifies the device among the children of its parent.
+	Name string
+
+	// Bus is the type of bus that enumerated the device (e.g. "acpi" or
+	// "pci").
+	Bus string
+
+	// IDs contains the hardware IDs reported by the bus for the device
+	// (e.g. ACPI _HID/_CID values or PCI vendor:device pairs) in order
+	// of preference.
+	IDs []string
+
+	// Resources contains the resources assigned to the device.
+	Resources []Resource
+
+	// Driver is the driver bound to the device or nil if no matching
+	// driver has been registered.
+	Driver Driver
+
+	parent   *Node
+	children []*Node
+}
+
+// Parent returns the parent of the device or nil for the registry root.
+func (n *Node) Parent() *Node {
+	return n.parent
+}
+
+// Children returns the devices attached to this device.
+func (n *Node) Children() []*Node {
+	return n.children
+}
+
+// Path returns the location of the device in the registry as a
+// slash-separated list of device names.
+func (n *Node) Path() string {
+	if n.parent == nil {
+		return "/"
+	}
+
+	if n.parent.parent == nil {
+		return "/" + n.Name
+	}
+
+	return n.parent.Path() + "/" + n.Name
+}
+
+// Match describes a bus and hardware ID combination that is supported by a
+// driver.
+type Match struct {
+	Bus string
+	ID  string
+}
+
+// BindFn is a function that returns a driver for a device that matches one
+// of the entries in a binding's match table.
+type BindFn func(*Node) Driver
+
+// Binding associates a match table with the function that creates drivers
+// for the matching devices.
+type Binding struct {
+	// Name identifies the binding (e.g. the name of the driver).
+	Name string
+
+	// Matches lists the devices supported by the binding.
+	Matches []Match
+
+	// Bind is invoked for each unbound device that matches an entry in
+	// Matches. If it returns a non-nil driver, the driver is initialized
+	// and bound to the device.
+	Bind BindFn
+}
+
+var (
+	// devices is the registry used by the kernel bus enumerators.
+	devices Registry
+
+	errDeviceNameInUse  = &kernel.Error{Module: "device", Message: "a device with the same name is already attached to the parent"}
+	errInvalidDevice    = &kernel.Error{Module: "device", Message: "device must have a name and must not be attached to the registry"}
+	errDeviceNotInTree  = &kernel.Error{Module: "device", Message: "device is not attached to the registry"}
+	errCannotRemoveRoot = &kernel.Error{Module: "device", Message: "the registry root cannot be removed"}
+)
+
+// Registry maintains a tree of devices discovered by the bus enumerators
+// and binds drivers to them using the match tables of the registered
+// bindings.
+type Registry struct {
+	root     Node
+	bindings []*Binding
+	events   EventBus
+
+	// The writer used for logging driver initialization messages. If nil,
+	// the kfmt output sink is used.
+	out    io.Writer
+	strBuf bytes.Buffer
+}
+
+// Devices returns the registry used by the kernel bus enumerators.
+func Devices() *Registry {
+	return &devices
+}
+
+// Root returns the root of the device tree. Bus enumerators attach the
+// devices they discover below it.
+func (r *Registry) Root() *Node {
+	return &r.root
+}
+
+// Events returns the bus where the registry publishes device events.
+func (r *Registry) Events() *EventBus {
+	return &r.events
+}
+
+// AddDevice attaches dev as a child of parent, tries to bind a driver to it
+// using the registered bindings and publishes a DeviceAdded event. If parent
+// is nil, the device is attached to the registry root.
+func (r *Registry) AddDevice(parent, dev *Node) *kernel.Error {
+	if parent == nil {
+		parent = &r.root
+	}
+
+	if !r.contains(parent) {
+		return errDeviceNotInTree
+	}
+
+	if dev.Name == "" || dev.parent != nil || dev == &r.root {
+		return errInvalidDevice
+	}
+
+	for _, child := range parent.children {
+		if child.Name == dev.Name {
+			return errDeviceNameInUse
+		}
+	}
+
+	dev.parent = parent
+	parent.children = append(parent.children, dev)
+
+	for _, binding := range r.bindings {
+		if r.bind(binding, dev) {
+			break
+		}
+	}
+
+	r.events.Publish(Event{Type: DeviceAdded, Device: dev})
+	return nil
+}
+
+// RemoveDevice detaches dev and all of its children from the registry. The
+// drivers bound to the removed devices are shut down (children before their
+// parents) and a DeviceRemoved event is published for each removed device.
+func (r *Registry) RemoveDevice(dev *Node) *kernel.Error {
+	if dev == &r.root {
+		return errCannotRemoveRoot
+	}
+
+	if !r.contains(dev) {
+		return errDeviceNotInTree
+	}
+
+	shutdownDrivers(dev, r.writer())
+
+	siblings := dev.parent.children
+	for index, child := range siblings {
+		if child == dev {
+			dev.parent.children = append(siblings[:index], siblings[index+1:]...)
+			break
+		}
+	}
+
+	dev.parent = nil
+
+	walkNodePostOrder(dev, func(removed *Node) {
+		r.events.Publish(Event{Type: DeviceRemoved, Device: removed})
+	})
+	return nil
+}
+
+// shutdownDrivers shuts down and unbinds the drivers bound to dev and its
+// children. Children are shut down before their parents.
+func shutdownDrivers(dev *Node, w io.Writer) {
+	walkNodePostOrder(dev, func(node *Node) {
+		if node.Driver == nil {
+			return
+		}
+
+		if s, ok := node.Driver.(Shutdowner); ok {
+			if err := s.DriverShutdown(); err != nil {
+				kfmt.Fprintf(w, "[device] %s: %s: shutdown failed: %s\n", node.Path(), node.Driver.DriverName(), err.Message)
+			}
+		}
+		node.Driver = nil
+	})
+}
+
+// RegisterBinding adds a binding to the registry and binds drivers to any
+// matching devices that are not yet bound.
+func (r *Registry) RegisterBinding(binding *Binding) {
+	r.bindings = append(r.bindings, binding)
+	r.Walk(func(dev *Node, _ int) bool {
+		if dev != &r.root {
+			r.bind(binding, dev)
+		}
+		return true
+	})
+}
+
+// Walk performs a depth-first traversal of the device tree starting at the
+// root and invokes fn for each device together with its depth in the tree.
+// If fn returns false, the children of the device are not visited.
+func (r *Registry) Walk(fn func(dev *Node, depth int) bool) {
+	walkNode(&r.root, 0, fn)
+}
+
+// Print outputs the device tree to w.
+func (r *Registry) Print(w io.Writer) {
+	r.Walk(func(dev *Node, depth int) bool {
+		if dev == &r.root {
+			return true
+		}
+
+		// Top-level devices are attached to the root (depth 0) and are
+		// not indented
+		for i := 1; i < depth; i++ {
+			kfmt.Fprintf(w, "  ")
+		}
+		kfmt.Fprintf(w, "%s (bus: %s", dev.Name, dev.Bus)
+		if len(dev.IDs) != 0 {
+			kfmt.Fprintf(w, ", id: %s", dev.IDs[0])
+		}
+		if dev.Driver != nil {
+			kfmt.Fprintf(w, ", driver: %s", dev.Driver.DriverName())
+		}
+		kfmt.Fprintf(w, ")\n")
+
+		for _, res := range dev.Resources {
+			for i := 0; i < depth; i++ {
+				kfmt.Fprintf(w, "  ")
+			}
+			kfmt.Fprintf(w, "%s 0x%x", res.Type.String(), res.Base)
+			if res.Type != ResourceIRQ {
+				kfmt.Fprintf(w, " - 0x%x", res.Base+res.Length-1)
+			}
+			kfmt.Fprintf(w, "\n")
+		}
+		return true
+	})
+}
+
+// walkNode visits dev and its children.
+func walkNode(dev *Node, depth int, fn func(*Node, int) bool) {
+	if !fn(dev, depth) {
+		return
+	}
+
+	for _, child := range dev.children {
+		walkNode(child, depth+1, fn)
+	}
+}
+
+// walkNodePostOrder visits the children of dev before visiting dev.
+func walkNodePostOrder(dev *Node, fn func(*Node)) {
+	for _, child := range dev.children {
+		walkNodePostOrder(child, fn)
+	}
+
+	fn(dev)
+}
+
+// contains returns true if dev is the registry root or one of its
+// descendants.
+func (r *Registry) contains(dev *Node) bool {
+	for dev.parent != nil {
+		dev = dev.parent
+	}
+
+	return dev == &r.root
+}
+
+// bind attempts to bind a driver from the supplied binding to an unbound
+// device whose bus and IDs match the binding's match table. It returns true
+// if a driver was bound to the device.
+func (r *Registry) bind(binding *Binding, dev *Node) bool {
+	if dev.Driver != nil || !binding.matches(dev) {
+		return false
+	}
+
+	drv := binding.Bind(dev)
+	if drv == nil {
+		return false
+	}
+
+	r.strBuf.Reset()
+	major, minor, patch := drv.DriverVersion()
+	kfmt.Fprintf(&r.strBuf, "[device] %s: %s(%d.%d.%d): ", dev.Path(), drv.DriverName(), major, minor, patch)
+	log := NewLogger(r.writer(), r.strBuf.Bytes(), DriverLogLevel(drv.DriverName()))
+
+	if err := drv.DriverInit(log); err != nil {
+		log.Errorf("init failed: %s\n", err.Message)
+		return false
+	}
+
+	log.Infof("bound\n")
+	dev.Driver = drv
+	return true
+}
+
+// writer returns the writer used for logging driver messages.
+func (r *Registry) writer() io.Writer {
+	if r.out != nil {
+		return r.out
+	}
+
+	return kfmt.GetOutputSink()
+}
+
+// matches returns true if the device matches any entry in the binding's
+// match table.
+func (binding *Binding) matches(dev *Node) bool {
+	for _, match := range binding.Matches {
+		if match.Bus != dev.Bus {
+			continue
+		}
+
+		for _, id := range dev.IDs {
+			if id == match.ID {
+				return true
+			}
+		}
+	}
+
+	return false
+}
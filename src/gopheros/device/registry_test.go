@@ -0,0 +1,233 @@
+package device
+
+import (
+	"bytes"
+	"gopheros/kernel"
+	"reflect"
+	"testing"
+)
+
+func TestResourceTypeString(t *testing.T) {
+	specs := []struct {
+		input ResourceType
+		exp   string
+	}{
+		{ResourceIOPort, "io"},
+		{ResourceMemory, "mem"},
+		{ResourceIRQ, "irq"},
+		{ResourceType(42), "unknown"},
+	}
+
+	for specIndex, spec := range specs {
+		if got := spec.input.String(); got != spec.exp {
+			t.Errorf("[spec %d] expected %q; got %q", specIndex, spec.exp, got)
+		}
+	}
+}
+
+func TestRegistryTopology(t *testing.T) {
+	var (
+		r    Registry
+		pci  = &Node{Name: "pci0", Bus: "acpi", IDs: []string{"PNP0A08", "PNP0A03"}}
+		nic  = &Node{Name: "00:03.0", Bus: "pci", IDs: []string{"8086:100e"}}
+		kbd  = &Node{Name: "ps2kbd", Bus: "acpi", IDs: []string{"PNP0303"}}
+		dupe = &Node{Name: "pci0"}
+	)
+
+	if Devices() != &devices {
+		t.Fatal("expected Devices to return the kernel device registry")
+	}
+
+	if got := r.Root().Path(); got != "/" {
+		t.Fatalf("expected root path to be \"/\"; got %q", got)
+	}
+
+	if err := r.AddDevice(nil, pci); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.AddDevice(pci, nic); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.AddDevice(r.Root(), kbd); err != nil {
+		t.Fatal(err)
+	}
+
+	specs := []struct {
+		parent, dev *Node
+		expErr      *kernel.Error
+	}{
+		{nil, dupe, errDeviceNameInUse},
+		{nil, &Node{}, errInvalidDevice},
+		{nil, nic, errInvalidDevice},
+		{nil, r.Root(), errInvalidDevice},
+		{&Node{Name: "detached"}, &Node{Name: "foo"}, errDeviceNotInTree},
+	}
+
+	for specIndex, spec := range specs {
+		if err := r.AddDevice(spec.parent, spec.dev); err != spec.expErr {
+			t.Errorf("[spec %d] expected error %v; got %v", specIndex, spec.expErr, err)
+		}
+	}
+
+	if got := nic.Path(); got != "/pci0/00:03.0" {
+		t.Fatalf("expected device path to be \"/pci0/00:03.0\"; got %q", got)
+	}
+
+	if nic.Parent() != pci || !reflect.DeepEqual(pci.Children(), []*Node{nic}) {
+		t.Fatal("expected nic to be attached to the pci bus")
+	}
+
+	var visited []string
+	r.Walk(func(dev *Node, depth int) bool {
+		visited = append(visited, dev.Path())
+		return dev != kbd
+	})
+
+	if exp := []string{"/", "/pci0", "/pci0/00:03.0", "/ps2kbd"}; !reflect.DeepEqual(visited, exp) {
+		t.Fatalf("expected visited devices to be %v; got %v", exp, visited)
+	}
+
+	// Removing a device also detaches its children
+	if err := r.RemoveDevice(pci); err != nil {
+		t.Fatal(err)
+	}
+
+	if pci.Parent() != nil || !reflect.DeepEqual(r.Root().Children(), []*Node{kbd}) {
+		t.Fatal("expected pci bus to be detached from the registry")
+	}
+
+	if err := r.RemoveDevice(nic); err != errDeviceNotInTree {
+		t.Fatalf("expected error %v; got %v", errDeviceNotInTree, err)
+	}
+
+	if err := r.RemoveDevice(r.Root()); err != errCannotRemoveRoot {
+		t.Fatalf("expected error %v; got %v", errCannotRemoveRoot, err)
+	}
+}
+
+func TestRegistryBindings(t *testing.T) {
+	var (
+		buf bytes.Buffer
+		r   = Registry{out: &buf}
+		nic = &Node{Name: "00:03.0", Bus: "pci", IDs: []string{"8086:100e"}}
+		kbd = &Node{Name: "ps2kbd", Bus: "acpi", IDs: []string{"PNP0F13", "PNP0303"}}
+		vga = &Node{Name: "00:02.0", Bus: "pci", IDs: []string{"1234:1111"}}
+
+		kbdBinds int
+	)
+
+	if err := r.AddDevice(nil, kbd); err != nil {
+		t.Fatal(err)
+	}
+
+	// Bindings are applied to existing devices when registered
+	r.RegisterBinding(&Binding{
+		Name: "ps2",
+		Matches: []Match{
+			{Bus: "pci", ID: "PNP0303"},
+			{Bus: "acpi", ID: "PNP0303"},
+		},
+		Bind: func(_ *Node) Driver {
+			kbdBinds++
+			return &mockDriver{name: "ps2"}
+		},
+	})
+
+	// Drivers that fail to initialize are not bound
+	r.RegisterBinding(&Binding{
+		Name:    "e1000",
+		Matches: []Match{{Bus: "pci", ID: "8086:100e"}},
+		Bind: func(_ *Node) Driver {
+			return &mockDriver{name: "e1000", initErr: &kernel.Error{Module: "test", Message: "no link"}}
+		},
+	})
+	r.RegisterBinding(&Binding{
+		Name:    "e1000-fallback",
+		Matches: []Match{{Bus: "pci", ID: "8086:100e"}},
+		Bind: func(_ *Node) Driver {
+			return &mockDriver{name: "e1000-fallback"}
+		},
+	})
+
+	// Bindings may decline to drive a matching device
+	r.RegisterBinding(&Binding{
+		Name:    "bochs",
+		Matches: []Match{{Bus: "pci", ID: "1234:1111"}},
+		Bind:    func(_ *Node) Driver { return nil },
+	})
+
+	// Devices are bound when added to the registry
+	if err := r.AddDevice(nil, nic); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.AddDevice(nil, vga); err != nil {
+		t.Fatal(err)
+	}
+
+	if kbd.Driver == nil || kbd.Driver.DriverName() != "ps2" || kbdBinds != 1 {
+		t.Fatalf("expected keyboard to be bound once to the ps2 driver; got %v after %d binds", kbd.Driver, kbdBinds)
+	}
+
+	if nic.Driver == nil || nic.Driver.DriverName() != "e1000-fallback" {
+		t.Fatalf("expected nic to be bound to the fallback driver; got %v", nic.Driver)
+	}
+
+	if vga.Driver != nil {
+		t.Fatalf("expected vga device not to be bound; got %v", vga.Driver)
+	}
+
+	exp := "[device] /ps2kbd: ps2(1.0.0): bound\n" +
+		"[device] /00:03.0: e1000(1.0.0): init failed: no link\n" +
+		"[device] /00:03.0: e1000-fallback(1.0.0): bound\n"
+	if got := buf.String(); got != exp {
+		t.Fatalf("expected output to be:\n%q\ngot:\n%q", exp, got)
+	}
+
+	kbd.Resources = []Resource{
+		{Type: ResourceIOPort, Base: 0x60, Length: 1},
+		{Type: ResourceIRQ, Base: 1},
+	}
+	if err := r.AddDevice(kbd, &Node{Name: "child", Bus: "ps2"}); err != nil {
+		t.Fatal(err)
+	}
+
+	buf.Reset()
+	r.Print(&buf)
+
+	exp = "ps2kbd (bus: acpi, id: PNP0F13, driver: ps2)\n" +
+		"  io 0x60 - 0x60\n" +
+		"  irq 0x1\n" +
+		"  child (bus: ps2)\n" +
+		"00:03.0 (bus: pci, id: 8086:100e, driver: e1000-fallback)\n" +
+		"00:02.0 (bus: pci, id: 1234:1111)\n"
+	if got := buf.String(); got != exp {
+		t.Fatalf("expected output to be:\n%q\ngot:\n%q", exp, got)
+	}
+}
+
+func TestRegistryDefaultOutput(t *testing.T) {
+	var r Registry
+
+	r.RegisterBinding(&Binding{
+		Matches: []Match{{Bus: "pci", ID: "8086:100e"}},
+		Bind:    func(_ *Node) Driver { return &mockDriver{name: "e1000"} },
+	})
+
+	dev := &Node{Name: "nic", Bus: "pci", IDs: []string{"8086:100e"}}
+	if err := r.AddDevice(nil, dev); err != nil {
+		t.Fatal(err)
+	}
+
+	if dev.Driver == nil {
+		t.Fatal("expected driver to be bound")
+	}
+}
+
+type mockDriver struct {
+	name    string
+	initErr *kernel.Error
+}
+
+func (d *mockDriver) DriverName() string                      { return d.name }
+func (d *mockDriver) DriverVersion() (uint16, uint16, uint16) { return 1, 0, 0 }
+func (d *mockDriver) DriverInit(_ *Logger) *kernel.Error      { return d.initErr }
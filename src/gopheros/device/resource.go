@@ -0,0 +1,146 @@
+package device
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/kfmt"
+	"io"
+)
+
+// maxIOPort defines the last addressable I/O port.
+const maxIOPort = 0xffff
+
+var (
+	// claims tracks the resources claimed by drivers in the order they
+	// were claimed.
+	claims []Claim
+
+	errInvalidResource    = &kernel.Error{Module: "device", Message: "invalid resource range"}
+	errResourceInUse      = &kernel.Error{Module: "device", Message: "resource overlaps a resource claimed by another owner"}
+	errResourceNotClaimed = &kernel.Error{Module: "device", Message: "resource has not been claimed by the specified owner"}
+)
+
+// Claim describes a hardware resource that has been claimed by a driver.
+type Claim struct {
+	Resource
+
+	// Owner identifies the driver that claimed the resource.
+	Owner string
+}
+
+// first returns the first port, address or IRQ line covered by the resource.
+func (r *Resource) first() uint64 {
+	return r.Base
+}
+
+// last returns the last port, address or IRQ line covered by the resource.
+// IRQ resources always cover a single line.
+func (r *Resource) last() uint64 {
+	if r.Type == ResourceIRQ {
+		return r.Base
+	}
+
+	return r.Base + r.Length - 1
+}
+
+// valid returns true if the resource describes a non-empty range that does
+// not wrap around the address space of its type.
+func (r *Resource) valid() bool {
+	switch r.Type {
+	case ResourceIRQ:
+		return true
+	case ResourceIOPort, ResourceMemory:
+		if r.Length == 0 || r.last() < r.first() {
+			return false
+		}
+
+		return r.Type != ResourceIOPort || r.last() <= maxIOPort
+	default:
+		return false
+	}
+}
+
+// overlaps returns true if both resources have the same type and cover at
+// least one common port, address or IRQ line.
+func (r *Resource) overlaps(other *Resource) bool {
+	return r.Type == other.Type && r.first() <= other.last() && other.first() <= r.last()
+}
+
+// ClaimResource records that owner uses the supplied resource. Drivers
+// should claim the I/O ports, MMIO windows and IRQ lines they access before
+// touching the hardware so that two drivers cannot silently drive the same
+// device.
+//
+// An error is returned if the resource overlaps a resource claimed by a
+// different owner; ResourceOwner can be used to look up the owner of the
+// conflicting claim. Claiming a resource that overlaps a resource already
+// claimed by the same owner is allowed.
+func ClaimResource(owner string, res Resource) *kernel.Error {
+	if !res.valid() {
+		return errInvalidResource
+	}
+
+	for index := 0; index < len(claims); index++ {
+		if claims[index].Owner != owner && claims[index].overlaps(&res) {
+			return errResourceInUse
+		}
+	}
+
+	claims = append(claims, Claim{Resource: res, Owner: owner})
+	return nil
+}
+
+// ReleaseResource releases a resource previously claimed by owner. The
+// resource must match the claimed resource exactly.
+func ReleaseResource(owner string, res Resource) *kernel.Error {
+	for index := 0; index < len(claims); index++ {
+		if claims[index].Owner == owner && claims[index].Resource == res {
+			claims = append(claims[:index], claims[index+1:]...)
+			return nil
+		}
+	}
+
+	return errResourceNotClaimed
+}
+
+// ReleaseResources releases all resources claimed by owner. Drivers invoke
+// it when they fail to initialize or when they are shut down.
+func ReleaseResources(owner string) {
+	for index := 0; index < len(claims); {
+		if claims[index].Owner == owner {
+			claims = append(claims[:index], claims[index+1:]...)
+			continue
+		}
+		index++
+	}
+}
+
+// ResourceOwner returns the owner of the first claim that overlaps the
+// supplied resource. The second return value is false if no part of the
+// resource has been claimed.
+func ResourceOwner(res Resource) (string, bool) {
+	for index := 0; index < len(claims); index++ {
+		if claims[index].overlaps(&res) {
+			return claims[index].Owner, true
+		}
+	}
+
+	return "", false
+}
+
+// Claims returns the list of claimed resources in the order they were
+// claimed. Callers must not modify the contents of the returned slice.
+func Claims() []Claim {
+	return claims
+}
+
+// PrintClaims outputs the list of claimed resources to w.
+func PrintClaims(w io.Writer) {
+	for index := 0; index < len(claims); index++ {
+		claim := &claims[index]
+		kfmt.Fprintf(w, "%s 0x%x", claim.Type.String(), claim.Base)
+		if claim.Type != ResourceIRQ {
+			kfmt.Fprintf(w, " - 0x%x", claim.last())
+		}
+		kfmt.Fprintf(w, ": %s\n", claim.Owner)
+	}
+}
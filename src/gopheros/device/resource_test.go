@@ -0,0 +1,125 @@
+package device
+
+import (
+	"bytes"
+	"gopheros/kernel"
+	"reflect"
+	"testing"
+)
+
+func TestClaimResource(t *testing.T) {
+	defer func() {
+		claims = nil
+	}()
+
+	specs := []struct {
+		owner  string
+		res    Resource
+		expErr *kernel.Error
+	}{
+		{"ps2", Resource{ResourceIOPort, 0x60, 1}, nil},
+		{"ps2", Resource{ResourceIOPort, 0x64, 1}, nil},
+		{"ps2", Resource{ResourceIRQ, 1, 0}, nil},
+		{"vga", Resource{ResourceMemory, 0xb8000, 0x8000}, nil},
+		{"vga", Resource{ResourceIOPort, 0x3c0, 0x20}, nil},
+		// Overlapping claims by the same owner are allowed
+		{"vga", Resource{ResourceIOPort, 0x3d4, 2}, nil},
+		{"serial", Resource{ResourceIOPort, 0x3f8, 8}, nil},
+		// Same base but different resource types do not conflict
+		{"serial", Resource{ResourceIRQ, 0x60, 0}, nil},
+		{"fb", Resource{ResourceMemory, 0xb0000, 0x8001}, errResourceInUse},
+		{"fb", Resource{ResourceMemory, 0xbffff, 1}, errResourceInUse},
+		{"mouse", Resource{ResourceIRQ, 1, 0}, errResourceInUse},
+		{"kbd", Resource{ResourceIOPort, 0x5f, 2}, errResourceInUse},
+		{"bad", Resource{ResourceIOPort, 0x80, 0}, errInvalidResource},
+		{"bad", Resource{ResourceIOPort, 0xfff0, 0x20}, errInvalidResource},
+		{"bad", Resource{ResourceMemory, ^uint64(0), 2}, errInvalidResource},
+		{"bad", Resource{ResourceType(42), 0, 1}, errInvalidResource},
+	}
+
+	for specIndex, spec := range specs {
+		if err := ClaimResource(spec.owner, spec.res); err != spec.expErr {
+			t.Errorf("[spec %d] expected error %v; got %v", specIndex, spec.expErr, err)
+		}
+	}
+
+	if owner, ok := ResourceOwner(Resource{ResourceMemory, 0xb0000, 0x8001}); !ok || owner != "vga" {
+		t.Fatalf("expected conflicting resource to be owned by \"vga\"; got %q, %t", owner, ok)
+	}
+
+	if owner, ok := ResourceOwner(Resource{ResourceIRQ, 4, 0}); ok || owner != "" {
+		t.Fatalf("expected IRQ 4 not to be claimed; got %q, %t", owner, ok)
+	}
+
+	var buf bytes.Buffer
+	PrintClaims(&buf)
+
+	exp := "io 0x60 - 0x60: ps2\n" +
+		"io 0x64 - 0x64: ps2\n" +
+		"irq 0x1: ps2\n" +
+		"mem 0xb8000 - 0xbffff: vga\n" +
+		"io 0x3c0 - 0x3df: vga\n" +
+		"io 0x3d4 - 0x3d5: vga\n" +
+		"io 0x3f8 - 0x3ff: serial\n" +
+		"irq 0x60: serial\n"
+
+	if got := buf.String(); got != exp {
+		t.Fatalf("expected output to be:\n%q\ngot:\n%q", exp, got)
+	}
+}
+
+func TestReleaseResource(t *testing.T) {
+	defer func() {
+		claims = nil
+	}()
+
+	var (
+		kbdPort = Resource{ResourceIOPort, 0x60, 1}
+		kbdIRQ  = Resource{ResourceIRQ, 1, 0}
+		vgaMem  = Resource{ResourceMemory, 0xb8000, 0x8000}
+	)
+
+	for _, res := range []Resource{kbdPort, kbdIRQ} {
+		if err := ClaimResource("ps2", res); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ClaimResource("vga", vgaMem); err != nil {
+		t.Fatal(err)
+	}
+
+	specs := []struct {
+		owner  string
+		res    Resource
+		expErr *kernel.Error
+	}{
+		{"vga", kbdIRQ, errResourceNotClaimed},
+		{"ps2", Resource{ResourceIOPort, 0x60, 2}, errResourceNotClaimed},
+		{"ps2", kbdIRQ, nil},
+		{"ps2", kbdIRQ, errResourceNotClaimed},
+	}
+
+	for specIndex, spec := range specs {
+		if err := ReleaseResource(spec.owner, spec.res); err != spec.expErr {
+			t.Errorf("[spec %d] expected error %v; got %v", specIndex, spec.expErr, err)
+		}
+	}
+
+	if err := ClaimResource("mouse", kbdIRQ); err != nil {
+		t.Fatalf("expected released IRQ to be claimable; got %v", err)
+	}
+
+	if err := ClaimResource("ps2", Resource{ResourceIOPort, 0x64, 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	ReleaseResources("ps2")
+
+	exp := []Claim{
+		{Resource: vgaMem, Owner: "vga"},
+		{Resource: kbdIRQ, Owner: "mouse"},
+	}
+	if got := Claims(); !reflect.DeepEqual(got, exp) {
+		t.Fatalf("expected claims to be:\n%v\ngot:\n%v", exp, got)
+	}
+}
@@ -0,0 +1,246 @@
+// Package rtc provides a driver for the CMOS real-time clock and access to
+// the battery-backed CMOS NVRAM.
+package rtc
+
+import (
+	"gopheros/device"
+	"gopheros/kernel"
+	"gopheros/kernel/cpu"
+)
+
+const (
+	cmosAddrPort = 0x70
+	cmosDataPort = 0x71
+
+	// Setting bit 7 of the address port disables NMIs; it is left clear
+	// when selecting a register.
+	cmosRegMask = 0x7f
+
+	rtcRegSeconds = 0x00
+	rtcRegMinutes = 0x02
+	rtcRegHours   = 0x04
+	rtcRegDay     = 0x07
+	rtcRegMonth   = 0x08
+	rtcRegYear    = 0x09
+	rtcRegStatusA = 0x0a
+	rtcRegStatusB = 0x0b
+
+	// The NVRAM bytes follow the RTC registers.
+	nvramFirst = 0x0e
+	nvramLast  = 0x7f
+
+	rtcUpdateInProgress = 1 << 7
+	rtcFormat24Hour     = 1 << 1
+	rtcFormatBinary     = 1 << 2
+	rtcHourPM           = 1 << 7
+
+	// maxRTCPoll bounds the number of polls while waiting for an RTC
+	// update to complete and maxRTCReads bounds the number of attempts to
+	// read a consistent date.
+	maxRTCPoll  = 1 << 20
+	maxRTCReads = 8
+)
+
+// rtcDate holds the raw contents of the RTC date registers.
+type rtcDate struct {
+	seconds, minutes, hours, day, month, year, century uint8
+}
+
+var (
+	// centuryReg is the index of the CMOS register that holds the
+	// century or zero if the century register is not available.
+	centuryReg uint8
+
+	// The following functions are used by tests to mock calls to the cpu
+	// package.
+	portReadByteFn             = cpu.PortReadByte
+	portWriteByteFn            = cpu.PortWriteByte
+	saveAndDisableInterruptsFn = cpu.SaveAndDisableInterrupts
+	restoreInterruptsFn        = cpu.RestoreInterrupts
+
+	errRTCTimeout         = &kernel.Error{Module: "rtc", Message: "timed out while waiting for an RTC update to complete"}
+	errRTCInconsistent    = &kernel.Error{Module: "rtc", Message: "could not read a consistent date from the RTC"}
+	errInvalidNVRAMOffset = &kernel.Error{Module: "rtc", Message: "NVRAM offset out of range"}
+)
+
+// SetCenturyRegister specifies the index of the CMOS register that holds the
+// century. It is invoked with the contents of the century field of the ACPI
+// FADT; a zero value indicates that the century register is not available
+// in which case the RTC year is assumed to belong to the 21st century.
+func SetCenturyRegister(reg uint8) {
+	centuryReg = reg
+}
+
+// ReadTime returns the current RTC date as the number of seconds elapsed
+// since the Unix epoch. The RTC is assumed to keep UTC time.
+func ReadTime() (int64, *kernel.Error) {
+	var prev rtcDate
+	for attempt := 0; attempt < maxRTCReads; attempt++ {
+		// The registers may contain a partially updated date while an
+		// update is in progress. Keep reading the date until two
+		// consecutive reads match.
+		date, err := readRTCDate()
+		if err != nil {
+			return 0, err
+		}
+
+		if attempt != 0 && date == prev {
+			return date.unix(readCMOS(rtcRegStatusB)), nil
+		}
+		prev = date
+	}
+
+	return 0, errRTCInconsistent
+}
+
+// ReadNVRAM returns the NVRAM byte at the supplied CMOS offset. Valid
+// offsets are in the range [0x0e, 0x7f].
+func ReadNVRAM(offset uint8) (uint8, *kernel.Error) {
+	if offset < nvramFirst || offset > nvramLast {
+		return 0, errInvalidNVRAMOffset
+	}
+
+	return readCMOS(offset), nil
+}
+
+// WriteNVRAM updates the NVRAM byte at the supplied CMOS offset. Valid
+// offsets are in the range [0x0e, 0x7f].
+func WriteNVRAM(offset, value uint8) *kernel.Error {
+	if offset < nvramFirst || offset > nvramLast {
+		return errInvalidNVRAMOffset
+	}
+
+	flags := saveAndDisableInterruptsFn()
+	portWriteByteFn(cmosAddrPort, offset&cmosRegMask)
+	portWriteByteFn(cmosDataPort, value)
+	restoreInterruptsFn(flags)
+	return nil
+}
+
+// readRTCDate waits for any RTC update to complete and reads the date
+// registers.
+func readRTCDate() (rtcDate, *kernel.Error) {
+	for poll := 0; readCMOS(rtcRegStatusA)&rtcUpdateInProgress != 0; poll++ {
+		if poll == maxRTCPoll {
+			return rtcDate{}, errRTCTimeout
+		}
+	}
+
+	date := rtcDate{
+		seconds: readCMOS(rtcRegSeconds),
+		minutes: readCMOS(rtcRegMinutes),
+		hours:   readCMOS(rtcRegHours),
+		day:     readCMOS(rtcRegDay),
+		month:   readCMOS(rtcRegMonth),
+		year:    readCMOS(rtcRegYear),
+	}
+
+	if centuryReg != 0 {
+		date.century = readCMOS(centuryReg)
+	}
+
+	return date, nil
+}
+
+// unix converts the date to the number of seconds elapsed since the Unix
+// epoch taking into account the register format reported by status
+// register B.
+func (d rtcDate) unix(statusB uint8) int64 {
+	pm := d.hours&rtcHourPM != 0
+	d.hours &^= rtcHourPM
+
+	if statusB&rtcFormatBinary == 0 {
+		d.seconds, d.minutes, d.hours = fromBCD(d.seconds), fromBCD(d.minutes), fromBCD(d.hours)
+		d.day, d.month, d.year = fromBCD(d.day), fromBCD(d.month), fromBCD(d.year)
+		d.century = fromBCD(d.century)
+	}
+
+	// In 12-hour mode, midnight and noon are reported as hour 12
+	if statusB&rtcFormat24Hour == 0 {
+		d.hours %= 12
+		if pm {
+			d.hours += 12
+		}
+	}
+
+	if d.century == 0 {
+		d.century = 20
+	}
+
+	days := daysFromCivil(int64(d.century)*100+int64(d.year), int64(d.month), int64(d.day))
+	return days*86400 + int64(d.hours)*3600 + int64(d.minutes)*60 + int64(d.seconds)
+}
+
+// readCMOS returns the value of a CMOS register.
+func readCMOS(reg uint8) uint8 {
+	flags := saveAndDisableInterruptsFn()
+	portWriteByteFn(cmosAddrPort, reg&cmosRegMask)
+	value := portReadByteFn(cmosDataPort)
+	restoreInterruptsFn(flags)
+	return value
+}
+
+// fromBCD converts a binary-coded decimal value to binary.
+func fromBCD(v uint8) uint8 {
+	return (v>>4)*10 + v&0xf
+}
+
+// daysFromCivil returns the number of days between the Unix epoch and the
+// supplied date of the proleptic Gregorian calendar.
+func daysFromCivil(year, month, day int64) int64 {
+	// Shift the year so that it starts in March; this places the leap
+	// day at the end of the year.
+	if month <= 2 {
+		year--
+	}
+
+	era := year / 400
+	yearOfEra := year - era*400
+	dayOfYear := (153*((month+9)%12)+2)/5 + day - 1
+	dayOfEra := yearOfEra*365 + yearOfEra/4 - yearOfEra/100 + dayOfYear
+	return era*146097 + dayOfEra - 719468
+}
+
+// rtcDriver claims the CMOS I/O ports on behalf of the functions in this
+// package.
+type rtcDriver struct{}
+
+// DriverName returns the name of this driver.
+func (*rtcDriver) DriverName() string {
+	return "rtc"
+}
+
+// DriverVersion returns the version of this driver.
+func (*rtcDriver) DriverVersion() (uint16, uint16, uint16) {
+	return 0, 0, 1
+}
+
+// DriverInit claims the CMOS I/O ports and reports the current RTC time.
+func (*rtcDriver) DriverInit(w *device.Logger) *kernel.Error {
+	res := device.Resource{Type: device.ResourceIOPort, Base: cmosAddrPort, Length: 2}
+	if err := device.ClaimResource("rtc", res); err != nil {
+		return err
+	}
+
+	secs, err := ReadTime()
+	if err != nil {
+		return err
+	}
+
+	w.Infof("time: %d seconds since the epoch\n", secs)
+	return nil
+}
+
+// probeForRTC returns a driver for the CMOS RTC which is present on all PC
+// compatible systems.
+func probeForRTC() device.Driver {
+	return &rtcDriver{}
+}
+
+func init() {
+	device.RegisterDriver(&device.DriverInfo{
+		Name:  "rtc",
+		Order: device.DetectOrderBeforeACPI,
+		Probe: probeForRTC,
+	})
+}
@@ -0,0 +1,258 @@
+package rtc
+
+import (
+	"bytes"
+	"gopheros/device"
+	"gopheros/kernel"
+	"gopheros/kernel/cpu"
+	"testing"
+)
+
+func TestReadTime(t *testing.T) {
+	defer resetState()
+
+	specs := []struct {
+		regs    map[uint8]uint8
+		expSecs int64
+	}{
+		// BCD, 24-hour format
+		{
+			map[uint8]uint8{
+				rtcRegYear: 0x24, rtcRegMonth: 0x02, rtcRegDay: 0x29,
+				rtcRegHours: 0x12, rtcRegMinutes: 0x34, rtcRegSeconds: 0x56,
+				rtcRegStatusB: rtcFormat24Hour,
+			},
+			1709210096,
+		},
+		// Binary, 12-hour format (noon)
+		{
+			map[uint8]uint8{
+				rtcRegYear: 23, rtcRegMonth: 7, rtcRegDay: 4,
+				rtcRegHours: 12 | rtcHourPM, rtcRegMinutes: 30, rtcRegSeconds: 5,
+				rtcRegStatusB: rtcFormatBinary,
+			},
+			1688473805,
+		},
+		// BCD, 12-hour format (midnight)
+		{
+			map[uint8]uint8{
+				rtcRegYear: 0x23, rtcRegMonth: 0x07, rtcRegDay: 0x04,
+				rtcRegHours: 0x12, rtcRegMinutes: 0x30, rtcRegSeconds: 0x05,
+			},
+			1688430605,
+		},
+		// BCD with a century register
+		{
+			map[uint8]uint8{
+				rtcRegYear: 0x99, rtcRegMonth: 0x12, rtcRegDay: 0x31,
+				rtcRegHours: 0x23, rtcRegMinutes: 0x59, rtcRegSeconds: 0x59,
+				rtcRegStatusB: rtcFormat24Hour, testCenturyReg: 0x19,
+			},
+			946684799,
+		},
+	}
+
+	SetCenturyRegister(testCenturyReg)
+	for specIndex, spec := range specs {
+		updatePolls := 3
+		mockCMOS(spec.regs, func(reg uint8) {
+			// Report an update in progress for the first few polls
+			if reg == rtcRegStatusA && updatePolls > 0 {
+				updatePolls--
+				spec.regs[rtcRegStatusA] = rtcUpdateInProgress
+			} else {
+				spec.regs[rtcRegStatusA] = 0
+			}
+		})
+
+		secs, err := ReadTime()
+		if err != nil {
+			t.Errorf("[spec %d] unexpected error: %v", specIndex, err)
+			continue
+		}
+
+		if secs != spec.expSecs {
+			t.Errorf("[spec %d] expected %d seconds since the epoch; got %d", specIndex, spec.expSecs, secs)
+		}
+	}
+}
+
+func TestReadTimeErrors(t *testing.T) {
+	defer resetState()
+
+	specs := []struct {
+		onRead func(map[uint8]uint8, uint8)
+		expErr *kernel.Error
+	}{
+		// The update never completes
+		{
+			func(regs map[uint8]uint8, _ uint8) { regs[rtcRegStatusA] = rtcUpdateInProgress },
+			errRTCTimeout,
+		},
+		// The date changes between each read
+		{
+			func(regs map[uint8]uint8, reg uint8) {
+				if reg == rtcRegSeconds {
+					regs[rtcRegSeconds]++
+				}
+			},
+			errRTCInconsistent,
+		},
+	}
+
+	for specIndex, spec := range specs {
+		regs := map[uint8]uint8{}
+		mockCMOS(regs, func(reg uint8) { spec.onRead(regs, reg) })
+
+		if _, err := ReadTime(); err != spec.expErr {
+			t.Errorf("[spec %d] expected error %v; got %v", specIndex, spec.expErr, err)
+		}
+	}
+}
+
+func TestNVRAM(t *testing.T) {
+	defer resetState()
+
+	regs := map[uint8]uint8{}
+	mockCMOS(regs, func(_ uint8) {})
+
+	for _, offset := range []uint8{nvramFirst, nvramLast} {
+		if err := WriteNVRAM(offset, offset^0xff); err != nil {
+			t.Fatalf("[offset 0x%x] unexpected error: %v", offset, err)
+		}
+
+		if got, err := ReadNVRAM(offset); err != nil || got != offset^0xff {
+			t.Fatalf("[offset 0x%x] expected to read back 0x%x; got 0x%x, %v", offset, offset^0xff, got, err)
+		}
+	}
+
+	for _, offset := range []uint8{rtcRegStatusB, nvramLast + 1} {
+		if _, err := ReadNVRAM(offset); err != errInvalidNVRAMOffset {
+			t.Errorf("[offset 0x%x] expected error %v; got %v", offset, errInvalidNVRAMOffset, err)
+		}
+
+		if err := WriteNVRAM(offset, 0); err != errInvalidNVRAMOffset {
+			t.Errorf("[offset 0x%x] expected error %v; got %v", offset, errInvalidNVRAMOffset, err)
+		}
+	}
+
+	if _, touched := regs[rtcRegStatusB]; touched {
+		t.Fatal("expected RTC registers to be left untouched by invalid NVRAM writes")
+	}
+}
+
+func TestDriver(t *testing.T) {
+	defer resetState()
+
+	drv := probeForRTC()
+	if drv == nil {
+		t.Fatal("expected probe to return a driver")
+	}
+
+	if drvName := drv.DriverName(); drvName != "rtc" {
+		t.Fatalf("expected DriverName() to return \"rtc\"; got %q", drvName)
+	}
+
+	if major, minor, patch := drv.DriverVersion(); major != 0 || minor != 0 || patch != 1 {
+		t.Fatalf("expected DriverVersion() to return 0.0.1; got %d.%d.%d", major, minor, patch)
+	}
+
+	mockCMOS(map[uint8]uint8{rtcRegStatusB: rtcFormatBinary | rtcFormat24Hour, rtcRegDay: 1, rtcRegMonth: 1}, func(_ uint8) {})
+
+	var buf bytes.Buffer
+	if err := drv.DriverInit(device.NewLogger(&buf, nil, device.LogLevelInfo)); err != nil {
+		t.Fatal(err)
+	}
+
+	if exp := "time: 946684800 seconds since the epoch\n"; buf.String() != exp {
+		t.Fatalf("expected output to be %q; got %q", exp, buf.String())
+	}
+}
+
+func TestDriverInitErrors(t *testing.T) {
+	defer resetState()
+
+	// The RTC update never completes
+	mockCMOS(map[uint8]uint8{rtcRegStatusA: rtcUpdateInProgress}, func(_ uint8) {})
+	if err := (&rtcDriver{}).DriverInit(nil); err != errRTCTimeout {
+		t.Fatalf("expected error %v; got %v", errRTCTimeout, err)
+	}
+
+	// The CMOS ports are claimed by another driver
+	device.ReleaseResources("rtc")
+	if err := device.ClaimResource("other", device.Resource{Type: device.ResourceIOPort, Base: cmosDataPort, Length: 1}); err != nil {
+		t.Fatal(err)
+	}
+	defer device.ReleaseResources("other")
+
+	if err := (&rtcDriver{}).DriverInit(nil); err == nil {
+		t.Fatal("expected DriverInit to fail when the CMOS ports are claimed by another driver")
+	}
+}
+
+func TestDriverRegistration(t *testing.T) {
+	for _, info := range device.DriverList() {
+		if info.Name == "rtc" {
+			return
+		}
+	}
+
+	t.Fatal("expected the rtc driver to be registered")
+}
+
+func TestDaysFromCivil(t *testing.T) {
+	specs := []struct {
+		year, month, day int64
+		exp              int64
+	}{
+		{1970, 1, 1, 0},
+		{1969, 12, 31, -1},
+		{2000, 3, 1, 11017},
+		{2099, 12, 31, 47481},
+	}
+
+	for specIndex, spec := range specs {
+		if got := daysFromCivil(spec.year, spec.month, spec.day); got != spec.exp {
+			t.Errorf("[spec %d] expected %d days; got %d", specIndex, spec.exp, got)
+		}
+	}
+}
+
+// testCenturyReg is the century register index reported by the FADT on
+// most PC compatible systems.
+const testCenturyReg = 0x32
+
+// mockCMOS replaces the port accessors with a fake CMOS backed by the
+// supplied register map. The onRead function is invoked before each
+// register read.
+func mockCMOS(regs map[uint8]uint8, onRead func(reg uint8)) {
+	var selected uint8
+
+	saveAndDisableInterruptsFn = func() uint64 { return 0 }
+	restoreInterruptsFn = func(_ uint64) {}
+	portWriteByteFn = func(port uint16, value uint8) {
+		switch port {
+		case cmosAddrPort:
+			selected = value
+		case cmosDataPort:
+			regs[selected] = value
+		}
+	}
+	portReadByteFn = func(port uint16) uint8 {
+		if port != cmosDataPort {
+			return 0
+		}
+
+		onRead(selected)
+		return regs[selected]
+	}
+}
+
+func resetState() {
+	device.ReleaseResources("rtc")
+	centuryReg = 0
+	portReadByteFn = cpu.PortReadByte
+	portWriteByteFn = cpu.PortWriteByte
+	saveAndDisableInterruptsFn = cpu.SaveAndDisableInterrupts
+	restoreInterruptsFn = cpu.RestoreInterrupts
+}
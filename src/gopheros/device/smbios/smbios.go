@@ -0,0 +1,447 @@
+// Package smbios locates and decodes the SMBIOS/DMI tables provided by the
+// system firmware.
+package smbios
+
+import (
+	"gopheros/device"
+	"gopheros/kernel"
+	"gopheros/kernel/hal/multiboot"
+	"gopheros/kernel/kfmt"
+	"gopheros/kernel/mem"
+	"gopheros/kernel/mem/pmm"
+	"gopheros/kernel/mem/vmm"
+	"io"
+	"reflect"
+	"unsafe"
+)
+
+const (
+	// The firmware may place the SMBIOS entry point at any 16-byte
+	// aligned address inside this physical memory region.
+	legacyScanStart = uintptr(0xf0000)
+	legacyScanEnd   = uintptr(0x100000)
+
+	// The max length of the entry point structures. The actual length is
+	// encoded inside each structure.
+	maxEntryPointLen = 0x20
+
+	// The size of the header that precedes each SMBIOS structure.
+	structHeaderLen = 4
+)
+
+// The list of SMBIOS structure types decoded by this package.
+const (
+	typeBIOSInfo     = 0
+	typeSystemInfo   = 1
+	typeBoardInfo    = 2
+	typeProcessor    = 4
+	typeMemoryDevice = 17
+	typeEndOfTable   = 127
+)
+
+var (
+	// The following functions are used by tests to mock calls to the vmm
+	// and multiboot packages and are automatically inlined by the compiler.
+	mapRegionFn     = vmm.MapRegion
+	getEntryPointFn = multiboot.GetSMBIOSEntryPoint
+
+	// sysInfo points to the info decoded by the last initialized driver.
+	sysInfo *Info
+
+	anchor32    = []byte("_SM_")
+	anchor64    = []byte("_SM3_")
+	anchorInter = []byte("_DMI_")
+
+	errInvalidEntryPoint = &kernel.Error{Module: "smbios", Message: "invalid entry point checksum"}
+)
+
+// BIOSInfo contains the information decoded from a type 0 SMBIOS structure.
+type BIOSInfo struct {
+	Vendor      string
+	Version     string
+	ReleaseDate string
+}
+
+// SystemInfo contains the information decoded from a type 1 SMBIOS structure.
+type SystemInfo struct {
+	Manufacturer string
+	ProductName  string
+	Version      string
+	SerialNumber string
+}
+
+// BoardInfo contains the information decoded from a type 2 SMBIOS structure.
+type BoardInfo struct {
+	Manufacturer string
+	Product      string
+	Version      string
+	SerialNumber string
+}
+
+// ProcessorInfo contains the information decoded from a type 4 SMBIOS structure.
+type ProcessorInfo struct {
+	SocketDesignation string
+	Manufacturer      string
+	Version           string
+
+	// Processor speeds in MHz. A zero value indicates an unknown speed.
+	MaxSpeed     uint16
+	CurrentSpeed uint16
+
+	// The number of cores per socket or zero if unknown.
+	CoreCount uint8
+}
+
+// MemoryDevice contains the information decoded from a type 17 SMBIOS
+// structure. Empty memory slots are not reported.
+type MemoryDevice struct {
+	DeviceLocator string
+	BankLocator   string
+	Manufacturer  string
+	Size          mem.Size
+
+	// The memory speed in MT/s. A zero value indicates an unknown speed.
+	Speed uint16
+}
+
+// Info aggregates the system information decoded from the SMBIOS tables.
+type Info struct {
+	MajorVersion uint8
+	MinorVersion uint8
+
+	BIOS          BIOSInfo
+	System        SystemInfo
+	Board         BoardInfo
+	Processors    []ProcessorInfo
+	MemoryDevices []MemoryDevice
+}
+
+// GetInfo returns the system information decoded from the SMBIOS tables or
+// nil if no SMBIOS tables have been detected.
+func GetInfo() *Info {
+	return sysInfo
+}
+
+type smbiosDriver struct {
+	info Info
+
+	// The physical address and length of the structure table.
+	tableAddr uintptr
+	tableLen  uint32
+
+	// The number of structures in the table. SMBIOS 3.x entry points do
+	// not specify a structure count; in that case this field is set to 0
+	// and the table is parsed until an end-of-table structure is found.
+	numStructs uint16
+}
+
+// DriverName returns the name of this driver.
+func (drv *smbiosDriver) DriverName() string {
+	return "smbios"
+}
+
+// DriverVersion returns the version of this driver.
+func (drv *smbiosDriver) DriverVersion() (uint16, uint16, uint16) {
+	return 0, 0, 1
+}
+
+// DriverInit initializes this driver.
+func (drv *smbiosDriver) DriverInit(w *device.Logger) *kernel.Error {
+	tableAddr, err := mapPhysRegion(drv.tableAddr, mem.Size(drv.tableLen))
+	if err != nil {
+		return err
+	}
+
+	drv.parseTable(overlaySlice(tableAddr, int(drv.tableLen)))
+	sysInfo = &drv.info
+
+	drv.printInfo(w)
+	return nil
+}
+
+// parseEntryPoint validates the entry point structure at the supplied virtual
+// address and extracts the location of the SMBIOS structure table.
+func (drv *smbiosDriver) parseEntryPoint(epAddr uintptr) *kernel.Error {
+	ep := overlaySlice(epAddr, maxEntryPointLen)
+
+	switch {
+	case hasPrefix(ep, anchor64):
+		epLen := int(ep[6])
+		if epLen > maxEntryPointLen || !validChecksum(ep[:epLen]) {
+			return errInvalidEntryPoint
+		}
+
+		drv.info.MajorVersion, drv.info.MinorVersion = ep[7], ep[8]
+		drv.tableLen = uint32(readWord(ep, 0x0c)) | uint32(readWord(ep, 0x0e))<<16
+		drv.tableAddr = uintptr(readDword(ep, 0x10)) | uintptr(readDword(ep, 0x14))<<32
+	case hasPrefix(ep, anchor32):
+		epLen := int(ep[5])
+		if epLen > maxEntryPointLen || !validChecksum(ep[:epLen]) ||
+			!hasPrefix(ep[0x10:], anchorInter) || !validChecksum(ep[0x10:0x1f]) {
+			return errInvalidEntryPoint
+		}
+
+		drv.info.MajorVersion, drv.info.MinorVersion = ep[6], ep[7]
+		drv.tableLen = uint32(readWord(ep, 0x16))
+		drv.tableAddr = uintptr(readDword(ep, 0x18))
+		drv.numStructs = readWord(ep, 0x1c)
+	default:
+		return errInvalidEntryPoint
+	}
+
+	return nil
+}
+
+// parseTable scans the SMBIOS structure table and decodes the structure types
+// supported by this package.
+func (drv *smbiosDriver) parseTable(table []byte) {
+	for offset, count := 0, 0; offset+structHeaderLen <= len(table); count++ {
+		if drv.numStructs != 0 && count == int(drv.numStructs) {
+			return
+		}
+
+		structType, structLen := table[offset], int(table[offset+1])
+		if structLen < structHeaderLen || offset+structLen > len(table) {
+			return
+		}
+
+		// The formatted area is followed by a set of NULL-terminated
+		// strings. The end of the set is marked by a double NULL.
+		strStart := offset + structLen
+		strEnd := strStart
+		for ; strEnd+1 < len(table) && (table[strEnd] != 0 || table[strEnd+1] != 0); strEnd++ {
+		}
+
+		fields, strs := table[offset:strStart], table[strStart:strEnd]
+		switch structType {
+		case typeBIOSInfo:
+			drv.info.BIOS = BIOSInfo{
+				Vendor:      lookupString(strs, readByte(fields, 0x04)),
+				Version:     lookupString(strs, readByte(fields, 0x05)),
+				ReleaseDate: lookupString(strs, readByte(fields, 0x08)),
+			}
+		case typeSystemInfo:
+			drv.info.System = SystemInfo{
+				Manufacturer: lookupString(strs, readByte(fields, 0x04)),
+				ProductName:  lookupString(strs, readByte(fields, 0x05)),
+				Version:      lookupString(strs, readByte(fields, 0x06)),
+				SerialNumber: lookupString(strs, readByte(fields, 0x07)),
+			}
+		case typeBoardInfo:
+			drv.info.Board = BoardInfo{
+				Manufacturer: lookupString(strs, readByte(fields, 0x04)),
+				Product:      lookupString(strs, readByte(fields, 0x05)),
+				Version:      lookupString(strs, readByte(fields, 0x06)),
+				SerialNumber: lookupString(strs, readByte(fields, 0x07)),
+			}
+		case typeProcessor:
+			drv.info.Processors = append(drv.info.Processors, ProcessorInfo{
+				SocketDesignation: lookupString(strs, readByte(fields, 0x04)),
+				Manufacturer:      lookupString(strs, readByte(fields, 0x07)),
+				Version:           lookupString(strs, readByte(fields, 0x10)),
+				MaxSpeed:          readWord(fields, 0x14),
+				CurrentSpeed:      readWord(fields, 0x16),
+				CoreCount:         readByte(fields, 0x23),
+			})
+		case typeMemoryDevice:
+			if size := memoryDeviceSize(fields); size != 0 {
+				drv.info.MemoryDevices = append(drv.info.MemoryDevices, MemoryDevice{
+					DeviceLocator: lookupString(strs, readByte(fields, 0x10)),
+					BankLocator:   lookupString(strs, readByte(fields, 0x11)),
+					Manufacturer:  lookupString(strs, readByte(fields, 0x17)),
+					Size:          size,
+					Speed:         readWord(fields, 0x15),
+				})
+			}
+		case typeEndOfTable:
+			return
+		}
+
+		offset = strEnd + 2
+	}
+}
+
+// printInfo outputs a summary of the decoded SMBIOS information to w.
+func (drv *smbiosDriver) printInfo(w io.Writer) {
+	kfmt.Fprintf(w, "SMBIOS version %d.%d\n", drv.info.MajorVersion, drv.info.MinorVersion)
+	kfmt.Fprintf(w, "BIOS: %s %s (%s)\n", drv.info.BIOS.Vendor, drv.info.BIOS.Version, drv.info.BIOS.ReleaseDate)
+	kfmt.Fprintf(w, "system: %s %s\n", drv.info.System.Manufacturer, drv.info.System.ProductName)
+	kfmt.Fprintf(w, "board: %s %s\n", drv.info.Board.Manufacturer, drv.info.Board.Product)
+	for _, cpu := range drv.info.Processors {
+		kfmt.Fprintf(w, "cpu: %s %s (%dMHz)\n", cpu.SocketDesignation, cpu.Version, cpu.CurrentSpeed)
+	}
+	for _, dev := range drv.info.MemoryDevices {
+		kfmt.Fprintf(w, "memory: %s %dMb\n", dev.DeviceLocator, uint64(dev.Size/mem.Mb))
+	}
+}
+
+// memoryDeviceSize decodes the size of a memory device structure. It returns
+// 0 if the slot is empty or the size is unknown.
+func memoryDeviceSize(fields []byte) mem.Size {
+	size := readWord(fields, 0x0c)
+	switch {
+	case size == 0xffff:
+		return 0
+	case size == 0x7fff:
+		// The actual size (in Mb) is stored in the extended size field
+		return mem.Size(readDword(fields, 0x1c)&0x7fffffff) * mem.Mb
+	case size&0x8000 != 0:
+		return mem.Size(size&0x7fff) * mem.Kb
+	default:
+		return mem.Size(size) * mem.Mb
+	}
+}
+
+// lookupString returns the string with the requested 1-based index from the
+// string set that follows the formatted area of a SMBIOS structure. An empty
+// string is returned if index is 0 or it does not match any string.
+func lookupString(strs []byte, index uint8) string {
+	if index == 0 {
+		return ""
+	}
+
+	// The last string in the set is not followed by a NULL in strs
+	for start, end := 0, 0; end <= len(strs); end++ {
+		if end < len(strs) && strs[end] != 0 {
+			continue
+		}
+
+		if index--; index == 0 {
+			return string(strs[start:end])
+		}
+		start = end + 1
+	}
+
+	return ""
+}
+
+// readByte returns the byte at the supplied offset of a structure's formatted
+// area or 0 if the offset is not part of the formatted area. Older SMBIOS
+// versions use shorter structures so fields added by later versions of the
+// spec may not be present.
+func readByte(fields []byte, offset int) uint8 {
+	if offset >= len(fields) {
+		return 0
+	}
+	return fields[offset]
+}
+
+// readWord returns the little-endian uint16 at the supplied offset of a
+// structure's formatted area or 0 if the offset is out of range.
+func readWord(fields []byte, offset int) uint16 {
+	if offset+2 > len(fields) {
+		return 0
+	}
+	return uint16(fields[offset]) | uint16(fields[offset+1])<<8
+}
+
+// readDword returns the little-endian uint32 at the supplied offset of a
+// structure's formatted area or 0 if the offset is out of range.
+func readDword(fields []byte, offset int) uint32 {
+	if offset+4 > len(fields) {
+		return 0
+	}
+	return uint32(readWord(fields, offset)) | uint32(readWord(fields, offset+2))<<16
+}
+
+// validChecksum returns true if the sum of all bytes in data is zero.
+func validChecksum(data []byte) bool {
+	var sum uint8
+	for _, b := range data {
+		sum += b
+	}
+	return sum == 0
+}
+
+// hasPrefix returns true if data begins with prefix.
+func hasPrefix(data, prefix []byte) bool {
+	if len(data) < len(prefix) {
+		return false
+	}
+
+	for i := 0; i < len(prefix); i++ {
+		if data[i] != prefix[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// overlaySlice returns a byte slice of the requested length that is backed by
+// the memory starting at addr.
+func overlaySlice(addr uintptr, length int) []byte {
+	return *(*[]byte)(unsafe.Pointer(&reflect.SliceHeader{
+		Len:  length,
+		Cap:  length,
+		Data: addr,
+	}))
+}
+
+// mapPhysRegion establishes a read-only mapping for the supplied physical
+// memory region and returns back the virtual address that corresponds to
+// physAddr.
+func mapPhysRegion(physAddr uintptr, size mem.Size) (uintptr, *kernel.Error) {
+	pageOffset := physAddr & uintptr(mem.PageSize-1)
+	page, err := mapRegionFn(
+		pmm.Frame(physAddr>>mem.PageShift),
+		size+mem.Size(pageOffset),
+		vmm.FlagPresent|vmm.FlagNoExecute,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	return page.Address() + pageOffset, nil
+}
+
+// locateEntryPoint returns the virtual address of the SMBIOS entry point or
+// 0 if no entry point could be found. The copy of the entry point provided by
+// the bootloader takes precedence over a scan of the legacy BIOS region.
+func locateEntryPoint() uintptr {
+	if epAddr := getEntryPointFn(); epAddr != 0 {
+		return epAddr
+	}
+
+	scanStart, err := mapPhysRegion(legacyScanStart, mem.Size(legacyScanEnd-legacyScanStart))
+	if err != nil {
+		return 0
+	}
+
+	// Prefer a 64-bit entry point if the firmware provides both types
+	var found32 uintptr
+	region := overlaySlice(scanStart, int(legacyScanEnd-legacyScanStart))
+	for offset := 0; offset+maxEntryPointLen <= len(region); offset += 16 {
+		switch {
+		case hasPrefix(region[offset:], anchor64):
+			return scanStart + uintptr(offset)
+		case found32 == 0 && hasPrefix(region[offset:], anchor32):
+			found32 = scanStart + uintptr(offset)
+		}
+	}
+
+	return found32
+}
+
+// probeForSMBIOS checks for the presence of SMBIOS tables.
+func probeForSMBIOS() device.Driver {
+	epAddr := locateEntryPoint()
+	if epAddr == 0 {
+		return nil
+	}
+
+	drv := &smbiosDriver{}
+	if err := drv.parseEntryPoint(epAddr); err != nil {
+		kfmt.Printf("[smbios] %s\n", err.Message)
+		return nil
+	}
+
+	return drv
+}
+
+func init() {
+	device.RegisterDriver(&device.DriverInfo{
+		Name:  "smbios",
+		Order: device.DetectOrderBeforeACPI,
+		Probe: probeForSMBIOS,
+	})
+}
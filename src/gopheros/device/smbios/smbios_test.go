@@ -0,0 +1,475 @@
+package smbios
+
+import (
+	"bytes"
+	"gopheros/device"
+	"gopheros/kernel"
+	"gopheros/kernel/hal/multiboot"
+	"gopheros/kernel/mem"
+	"gopheros/kernel/mem/pmm"
+	"gopheros/kernel/mem/vmm"
+	"reflect"
+	"testing"
+	"unsafe"
+)
+
+func TestParseEntryPoint(t *testing.T) {
+	t.Run("32-bit entry point", func(t *testing.T) {
+		var drv smbiosDriver
+		ep := mockEntryPoint32(0xf1000, uint16(len(mockTable)), 5)
+
+		if err := drv.parseEntryPoint(uintptr(unsafe.Pointer(&ep[0]))); err != nil {
+			t.Fatal(err)
+		}
+
+		if drv.info.MajorVersion != 2 || drv.info.MinorVersion != 8 {
+			t.Errorf("expected version to be 2.8; got %d.%d", drv.info.MajorVersion, drv.info.MinorVersion)
+		}
+
+		if exp := uintptr(0xf1000); drv.tableAddr != exp {
+			t.Errorf("expected table address to be 0x%x; got 0x%x", exp, drv.tableAddr)
+		}
+
+		if exp := uint32(len(mockTable)); drv.tableLen != exp {
+			t.Errorf("expected table length to be %d; got %d", exp, drv.tableLen)
+		}
+
+		if exp := uint16(5); drv.numStructs != exp {
+			t.Errorf("expected structure count to be %d; got %d", exp, drv.numStructs)
+		}
+	})
+
+	t.Run("64-bit entry point", func(t *testing.T) {
+		var drv smbiosDriver
+		ep := mockEntryPoint64(0x1badf000, uint32(len(mockTable)))
+
+		if err := drv.parseEntryPoint(uintptr(unsafe.Pointer(&ep[0]))); err != nil {
+			t.Fatal(err)
+		}
+
+		if drv.info.MajorVersion != 3 || drv.info.MinorVersion != 1 {
+			t.Errorf("expected version to be 3.1; got %d.%d", drv.info.MajorVersion, drv.info.MinorVersion)
+		}
+
+		if exp := uintptr(0x1badf000); drv.tableAddr != exp {
+			t.Errorf("expected table address to be 0x%x; got 0x%x", exp, drv.tableAddr)
+		}
+
+		if exp := uint32(len(mockTable)); drv.tableLen != exp {
+			t.Errorf("expected table length to be %d; got %d", exp, drv.tableLen)
+		}
+
+		if drv.numStructs != 0 {
+			t.Errorf("expected structure count to be 0; got %d", drv.numStructs)
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		badChecksum32 := mockEntryPoint32(0xf1000, 0, 0)
+		badChecksum32[4]++
+
+		badInterChecksum32 := mockEntryPoint32(0xf1000, 0, 0)
+		badInterChecksum32[0x15]++
+
+		badChecksum64 := mockEntryPoint64(0xf1000, 0)
+		badChecksum64[5]++
+
+		badAnchor := make([]byte, maxEntryPointLen)
+		copy(badAnchor, "_SM4_")
+
+		specs := [][]byte{badChecksum32, badInterChecksum32, badChecksum64, badAnchor}
+		for specIndex, spec := range specs {
+			var drv smbiosDriver
+			if err := drv.parseEntryPoint(uintptr(unsafe.Pointer(&spec[0]))); err != errInvalidEntryPoint {
+				t.Errorf("[spec %d] expected to get errInvalidEntryPoint; got %v", specIndex, err)
+			}
+		}
+	})
+}
+
+func TestParseTable(t *testing.T) {
+	expInfo := Info{
+		BIOS: BIOSInfo{
+			Vendor:      "SeaBIOS",
+			Version:     "1.10.2",
+			ReleaseDate: "04/01/2014",
+		},
+		System: SystemInfo{
+			Manufacturer: "QEMU",
+			ProductName:  "Standard PC",
+			Version:      "pc-i440fx",
+		},
+		Board: BoardInfo{
+			Manufacturer: "gopher",
+		},
+		Processors: []ProcessorInfo{
+			{
+				SocketDesignation: "CPU 0",
+				Manufacturer:      "GenuineIntel",
+				Version:           "pc-cpu",
+				MaxSpeed:          2000,
+				CurrentSpeed:      1500,
+				CoreCount:         2,
+			},
+		},
+		MemoryDevices: []MemoryDevice{
+			{
+				DeviceLocator: "DIMM 0",
+				Size:          128 * mem.Mb,
+				Speed:         1600,
+			},
+		},
+	}
+
+	t.Run("parse until end of table", func(t *testing.T) {
+		var drv smbiosDriver
+		drv.parseTable(mockTable)
+
+		if !reflect.DeepEqual(drv.info, expInfo) {
+			t.Fatalf("expected parsed info to be:\n%+v\ngot:\n%+v", expInfo, drv.info)
+		}
+	})
+
+	t.Run("parse up to structure count", func(t *testing.T) {
+		drv := smbiosDriver{numStructs: 2}
+		drv.parseTable(mockTable)
+
+		if !reflect.DeepEqual(drv.info.System, expInfo.System) {
+			t.Errorf("expected system info to be %+v; got %+v", expInfo.System, drv.info.System)
+		}
+
+		if drv.info.Board.Manufacturer != "" || len(drv.info.Processors) != 0 {
+			t.Error("expected parser to stop after processing 2 structures")
+		}
+	})
+
+	t.Run("truncated table", func(t *testing.T) {
+		var drv smbiosDriver
+		drv.parseTable(mockTable[:10])
+
+		if !reflect.DeepEqual(drv.info, Info{}) {
+			t.Errorf("expected truncated table to be ignored; got %+v", drv.info)
+		}
+	})
+}
+
+func TestMemoryDeviceSize(t *testing.T) {
+	specs := []struct {
+		size    uint16
+		extSize uint32
+		exp     mem.Size
+	}{
+		{0, 0, 0},
+		{0xffff, 0, 0},
+		{512, 0, 512 * mem.Mb},
+		{0x8000 | 256, 0, 256 * mem.Kb},
+		{0x7fff, 65536, 64 * mem.Gb},
+	}
+
+	for specIndex, spec := range specs {
+		fields := make([]byte, 0x20)
+		fields[0x0c], fields[0x0d] = byte(spec.size), byte(spec.size>>8)
+		fields[0x1c], fields[0x1d], fields[0x1e], fields[0x1f] = byte(spec.extSize), byte(spec.extSize>>8), byte(spec.extSize>>16), byte(spec.extSize>>24)
+
+		if got := memoryDeviceSize(fields); got != spec.exp {
+			t.Errorf("[spec %d] expected size to be %d; got %d", specIndex, spec.exp, got)
+		}
+	}
+}
+
+func TestLookupString(t *testing.T) {
+	strs := []byte("foo\x00bar\x00baz")
+
+	specs := []struct {
+		index uint8
+		exp   string
+	}{
+		{0, ""},
+		{1, "foo"},
+		{2, "bar"},
+		{3, "baz"},
+		{4, ""},
+	}
+
+	for specIndex, spec := range specs {
+		if got := lookupString(strs, spec.index); got != spec.exp {
+			t.Errorf("[spec %d] expected to get %q; got %q", specIndex, spec.exp, got)
+		}
+	}
+
+	if got := lookupString(nil, 1); got != "" {
+		t.Errorf("expected lookup in empty string set to return an empty string; got %q", got)
+	}
+}
+
+func TestProbe(t *testing.T) {
+	defer func() {
+		mapRegionFn = vmm.MapRegion
+		getEntryPointFn = multiboot.GetSMBIOSEntryPoint
+	}()
+
+	t.Run("entry point provided by bootloader", func(t *testing.T) {
+		ep := mockEntryPoint64(0x1000, uint32(len(mockTable)))
+		getEntryPointFn = func() uintptr { return uintptr(unsafe.Pointer(&ep[0])) }
+		mapRegionFn = func(_ pmm.Frame, _ mem.Size, _ vmm.PageTableEntryFlag) (vmm.Page, *kernel.Error) {
+			t.Fatal("unexpected call to vmm.MapRegion")
+			return 0, nil
+		}
+
+		if drv := probeForSMBIOS(); drv == nil {
+			t.Fatal("expected probeForSMBIOS to return a driver")
+		}
+	})
+
+	t.Run("legacy region scan", func(t *testing.T) {
+		region, regionAddr := alignedBuffer(int(legacyScanEnd - legacyScanStart))
+		copy(region[0x10:], mockEntryPoint32(0x1000, uint16(len(mockTable)), 0))
+		copy(region[0x100:], mockEntryPoint64(0x2000, uint32(len(mockTable))))
+
+		getEntryPointFn = func() uintptr { return 0 }
+		mapRegionFn = func(frame pmm.Frame, size mem.Size, _ vmm.PageTableEntryFlag) (vmm.Page, *kernel.Error) {
+			if exp := pmm.Frame(legacyScanStart >> mem.PageShift); frame != exp {
+				t.Errorf("expected legacy scan to map frame %d; got %d", exp, frame)
+			}
+			return vmm.PageFromAddress(regionAddr), nil
+		}
+
+		drv := probeForSMBIOS()
+		if drv == nil {
+			t.Fatal("expected probeForSMBIOS to return a driver")
+		}
+
+		// The 64-bit entry point should be preferred over the 32-bit one
+		if exp, got := uintptr(0x2000), drv.(*smbiosDriver).tableAddr; got != exp {
+			t.Fatalf("expected driver to use the 64-bit entry point with table address 0x%x; got 0x%x", exp, got)
+		}
+	})
+
+	t.Run("legacy region scan with 32-bit entry point", func(t *testing.T) {
+		region, regionAddr := alignedBuffer(int(legacyScanEnd - legacyScanStart))
+		copy(region[0x10:], mockEntryPoint32(0x1000, uint16(len(mockTable)), 0))
+
+		getEntryPointFn = func() uintptr { return 0 }
+		mapRegionFn = func(_ pmm.Frame, _ mem.Size, _ vmm.PageTableEntryFlag) (vmm.Page, *kernel.Error) {
+			return vmm.PageFromAddress(regionAddr), nil
+		}
+
+		drv := probeForSMBIOS()
+		if drv == nil {
+			t.Fatal("expected probeForSMBIOS to return a driver")
+		}
+
+		if exp, got := uintptr(0x1000), drv.(*smbiosDriver).tableAddr; got != exp {
+			t.Fatalf("expected table address to be 0x%x; got 0x%x", exp, got)
+		}
+	})
+
+	t.Run("no entry point", func(t *testing.T) {
+		_, regionAddr := alignedBuffer(int(legacyScanEnd - legacyScanStart))
+
+		getEntryPointFn = func() uintptr { return 0 }
+		mapRegionFn = func(_ pmm.Frame, _ mem.Size, _ vmm.PageTableEntryFlag) (vmm.Page, *kernel.Error) {
+			return vmm.PageFromAddress(regionAddr), nil
+		}
+
+		if drv := probeForSMBIOS(); drv != nil {
+			t.Fatalf("expected probeForSMBIOS to return nil; got %v", drv)
+		}
+	})
+
+	t.Run("map error", func(t *testing.T) {
+		getEntryPointFn = func() uintptr { return 0 }
+		mapRegionFn = func(_ pmm.Frame, _ mem.Size, _ vmm.PageTableEntryFlag) (vmm.Page, *kernel.Error) {
+			return 0, &kernel.Error{Module: "test", Message: "something went wrong"}
+		}
+
+		if drv := probeForSMBIOS(); drv != nil {
+			t.Fatalf("expected probeForSMBIOS to return nil; got %v", drv)
+		}
+	})
+
+	t.Run("invalid entry point", func(t *testing.T) {
+		ep := mockEntryPoint64(0x1000, uint32(len(mockTable)))
+		ep[5]++
+		getEntryPointFn = func() uintptr { return uintptr(unsafe.Pointer(&ep[0])) }
+
+		if drv := probeForSMBIOS(); drv != nil {
+			t.Fatalf("expected probeForSMBIOS to return nil; got %v", drv)
+		}
+	})
+}
+
+func TestDriverInit(t *testing.T) {
+	defer func() {
+		mapRegionFn = vmm.MapRegion
+		sysInfo = nil
+	}()
+
+	// Place the table at a non page-aligned offset
+	buf, bufAddr := alignedBuffer(int(mem.PageSize))
+	copy(buf[0x10:], mockTable)
+
+	drv := &smbiosDriver{tableAddr: 0x1010, tableLen: uint32(len(mockTable))}
+
+	t.Run("success", func(t *testing.T) {
+		mapRegionFn = func(frame pmm.Frame, size mem.Size, flags vmm.PageTableEntryFlag) (vmm.Page, *kernel.Error) {
+			if exp := pmm.Frame(1); frame != exp {
+				t.Errorf("expected to map frame %d; got %d", exp, frame)
+			}
+
+			if exp := mem.Size(len(mockTable) + 0x10); size != exp {
+				t.Errorf("expected map size to be %d; got %d", exp, size)
+			}
+
+			if flags&vmm.FlagRW != 0 {
+				t.Error("expected SMBIOS table to be mapped read-only")
+			}
+
+			return vmm.PageFromAddress(bufAddr), nil
+		}
+
+		var w bytes.Buffer
+		if err := drv.DriverInit(device.NewLogger(&w, nil, device.LogLevelInfo)); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := GetInfo(); got != &drv.info {
+			t.Fatal("expected GetInfo() to return the info populated by the driver")
+		}
+
+		if exp, got := "GenuineIntel", GetInfo().Processors[0].Manufacturer; got != exp {
+			t.Fatalf("expected processor manufacturer to be %q; got %q", exp, got)
+		}
+
+		exp := "SMBIOS version 0.0\nBIOS: SeaBIOS 1.10.2 (04/01/2014)\nsystem: QEMU Standard PC\nboard: gopher \ncpu: CPU 0 pc-cpu (1500MHz)\nmemory: DIMM 0 128Mb\n"
+		if got := w.String(); got != exp {
+			t.Fatalf("expected driver output to be:\n%q\ngot:\n%q", exp, got)
+		}
+	})
+
+	t.Run("map error", func(t *testing.T) {
+		expErr := &kernel.Error{Module: "test", Message: "something went wrong"}
+		mapRegionFn = func(_ pmm.Frame, _ mem.Size, _ vmm.PageTableEntryFlag) (vmm.Page, *kernel.Error) {
+			return 0, expErr
+		}
+
+		if err := drv.DriverInit(nil); err != expErr {
+			t.Fatalf("expected to get error: %v; got %v", expErr, err)
+		}
+	})
+}
+
+func TestDriverInterface(t *testing.T) {
+	var drv device.Driver = &smbiosDriver{}
+
+	if exp, got := "smbios", drv.DriverName(); got != exp {
+		t.Errorf("expected DriverName() to return %q; got %q", exp, got)
+	}
+
+	if major, minor, patch := drv.DriverVersion(); major != 0 || minor != 0 || patch != 1 {
+		t.Errorf("expected DriverVersion() to return 0.0.1; got %d.%d.%d", major, minor, patch)
+	}
+}
+
+// alignedBuffer returns a zeroed byte slice of the requested size that begins
+// at a page-aligned address.
+func alignedBuffer(size int) ([]byte, uintptr) {
+	buf := make([]byte, size+int(mem.PageSize))
+	offset := int(mem.PageSize) - int(uintptr(unsafe.Pointer(&buf[0]))&uintptr(mem.PageSize-1))
+	if offset == int(mem.PageSize) {
+		offset = 0
+	}
+
+	buf = buf[offset : offset+size]
+	return buf, uintptr(unsafe.Pointer(&buf[0]))
+}
+
+func mockEntryPoint32(tableAddr uint32, tableLen, numStructs uint16) []byte {
+	ep := make([]byte, maxEntryPointLen)
+	copy(ep, anchor32)
+	ep[5] = 0x1f
+	ep[6], ep[7] = 2, 8
+	copy(ep[0x10:], anchorInter)
+	ep[0x16], ep[0x17] = byte(tableLen), byte(tableLen>>8)
+	ep[0x18], ep[0x19], ep[0x1a], ep[0x1b] = byte(tableAddr), byte(tableAddr>>8), byte(tableAddr>>16), byte(tableAddr>>24)
+	ep[0x1c], ep[0x1d] = byte(numStructs), byte(numStructs>>8)
+
+	ep[0x15] = checksumFix(ep[0x10:0x1f])
+	ep[4] = checksumFix(ep[:0x1f])
+	return ep
+}
+
+func mockEntryPoint64(tableAddr uint64, tableLen uint32) []byte {
+	ep := make([]byte, maxEntryPointLen)
+	copy(ep, anchor64)
+	ep[6] = 0x18
+	ep[7], ep[8] = 3, 1
+	ep[0x0c], ep[0x0d], ep[0x0e], ep[0x0f] = byte(tableLen), byte(tableLen>>8), byte(tableLen>>16), byte(tableLen>>24)
+	for i := uint(0); i < 8; i++ {
+		ep[0x10+i] = byte(tableAddr >> (8 * i))
+	}
+
+	ep[5] = checksumFix(ep[:0x18])
+	return ep
+}
+
+// checksumFix returns the value that needs to be added to data so that the
+// sum of its bytes becomes zero.
+func checksumFix(data []byte) byte {
+	var sum byte
+	for _, b := range data {
+		sum += b
+	}
+	return -sum
+}
+
+var mockTable = []byte{
+	// type 0 (BIOS info)
+	0x00, 0x18, 0x00, 0x00,
+	0x01, 0x02, 0x00, 0xe8, 0x03, 0x00, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	'S', 'e', 'a', 'B', 'I', 'O', 'S', 0x00,
+	'1', '.', '1', '0', '.', '2', 0x00,
+	'0', '4', '/', '0', '1', '/', '2', '0', '1', '4', 0x00,
+	0x00,
+	// type 1 (System info); serial number is missing
+	0x01, 0x08, 0x01, 0x00,
+	0x01, 0x02, 0x03, 0x00,
+	'Q', 'E', 'M', 'U', 0x00,
+	'S', 't', 'a', 'n', 'd', 'a', 'r', 'd', ' ', 'P', 'C', 0x00,
+	'p', 'c', '-', 'i', '4', '4', '0', 'f', 'x', 0x00,
+	0x00,
+	// type 2 (Baseboard info); truncated formatted area
+	0x02, 0x05, 0x02, 0x00,
+	0x01,
+	'g', 'o', 'p', 'h', 'e', 'r', 0x00,
+	0x00,
+	// type 4 (Processor info)
+	0x04, 0x28, 0x03, 0x00,
+	0x01, 0x03, 0x01, 0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x03, 0x00, 0x64, 0x00, 0xd0, 0x07, 0xdc, 0x05, 0x41, 0x01, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00, 0x00,
+	'C', 'P', 'U', ' ', '0', 0x00,
+	'G', 'e', 'n', 'u', 'i', 'n', 'e', 'I', 'n', 't', 'e', 'l', 0x00,
+	'p', 'c', '-', 'c', 'p', 'u', 0x00,
+	0x00,
+	// type 17 (Memory device)
+	0x11, 0x20, 0x04, 0x00,
+	0x00, 0x10, 0xfe, 0xff, 0x40, 0x00, 0x40, 0x00, 0x80, 0x00, 0x09, 0x00,
+	0x01, 0x00, 0x07, 0x02, 0x00, 0x40, 0x06, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00,
+	'D', 'I', 'M', 'M', ' ', '0', 0x00,
+	0x00,
+	// type 17 (Memory device) for an empty slot with no strings
+	0x11, 0x20, 0x05, 0x00,
+	0x00, 0x10, 0xfe, 0xff, 0x40, 0x00, 0x40, 0x00, 0x00, 0x00, 0x09, 0x00,
+	0x01, 0x00, 0x07, 0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00,
+	// type 127 (End of table)
+	0x7f, 0x04, 0x06, 0x00,
+	0x00, 0x00,
+	// trailing junk that should be ignored
+	0x01, 0x04, 0x07, 0x00,
+	0x00, 0x00,
+}
@@ -258,7 +258,7 @@ func (t *VT) DriverVersion() (uint16, uint16, uint16) {
 }
 
 // DriverInit initializes this driver.
-func (t *VT) DriverInit(_ io.Writer) *kernel.Error { return nil }
+func (t *VT) DriverInit(_ *device.Logger) *kernel.Error { return nil }
 
 func probeForVT() device.Driver {
 	return NewVT(DefaultTabWidth, DefaultScrollback)
@@ -266,6 +266,7 @@ func probeForVT() device.Driver {
 
 func init() {
 	device.RegisterDriver(&device.DriverInfo{
+		Name:  "vt",
 		Order: device.DetectOrderEarly,
 		Probe: probeForVT,
 	})
@@ -8,10 +8,8 @@ import (
 	"gopheros/kernel/hal/multiboot"
 	"gopheros/kernel/kfmt"
 	"gopheros/kernel/mem"
-	"gopheros/kernel/mem/pmm"
 	"gopheros/kernel/mem/vmm"
 	"image/color"
-	"io"
 	"reflect"
 	"unsafe"
 )
@@ -558,15 +556,11 @@ func (cons *VesaFbConsole) DriverVersion() (uint16, uint16, uint16) {
 }
 
 // DriverInit initializes this driver.
-func (cons *VesaFbConsole) DriverInit(w io.Writer) *kernel.Error {
-	// Map the framebuffer so we can write to it
+func (cons *VesaFbConsole) DriverInit(w *device.Logger) *kernel.Error {
+	// Map the framebuffer so we can write to it. Using write-combining
+	// significantly speeds up framebuffer updates.
 	fbSize := mem.Size(cons.height * cons.pitch)
-	fbPage, err := mapRegionFn(
-		pmm.Frame(cons.fbPhysAddr>>mem.PageShift),
-		fbSize,
-		vmm.FlagPresent|vmm.FlagRW,
-	)
-
+	fbAddr, err := mapMMIOFn(cons.fbPhysAddr, fbSize, vmm.CacheWriteCombining)
 	if err != nil {
 		return err
 	}
@@ -574,10 +568,10 @@ func (cons *VesaFbConsole) DriverInit(w io.Writer) *kernel.Error {
 	cons.fb = *(*[]uint8)(unsafe.Pointer(&reflect.SliceHeader{
 		Len:  int(fbSize),
 		Cap:  int(fbSize),
-		Data: fbPage.Address(),
+		Data: fbAddr,
 	}))
 
-	kfmt.Fprintf(w, "mapped framebuffer to 0x%x\n", fbPage.Address())
+	kfmt.Fprintf(w, "mapped framebuffer to 0x%x\n", fbAddr)
 	kfmt.Fprintf(w, "framebuffer dimensions: %dx%dx%d\n", cons.width, cons.height, cons.bpp)
 
 	cons.loadDefaultPalette()
@@ -604,6 +598,7 @@ func probeForVesaFbConsole() device.Driver {
 
 func init() {
 	device.RegisterDriver(&device.DriverInfo{
+		Name:  "vesa_fb_console",
 		Order: device.DetectOrderEarly,
 		Probe: probeForVesaFbConsole,
 	})
@@ -10,7 +10,6 @@ import (
 	"gopheros/kernel/cpu"
 	"gopheros/kernel/hal/multiboot"
 	"gopheros/kernel/mem"
-	"gopheros/kernel/mem/pmm"
 	"gopheros/kernel/mem/vmm"
 	"image/color"
 	"reflect"
@@ -1439,7 +1438,7 @@ func TestVesaFbReplace24(t *testing.T) {
 
 func TestVesaFbDriverInterface(t *testing.T) {
 	defer func() {
-		mapRegionFn = vmm.MapRegion
+		mapMMIOFn = vmm.MapMMIO
 		portWriteByteFn = cpu.PortWriteByte
 	}()
 	var dev device.Driver = NewVesaFbConsole(320, 200, 8, 320, nil, uintptr(0xa0000))
@@ -1453,7 +1452,10 @@ func TestVesaFbDriverInterface(t *testing.T) {
 	}
 
 	t.Run("init success", func(t *testing.T) {
-		mapRegionFn = func(_ pmm.Frame, _ mem.Size, _ vmm.PageTableEntryFlag) (vmm.Page, *kernel.Error) {
+		mapMMIOFn = func(_ uintptr, _ mem.Size, attrs vmm.CacheAttr) (uintptr, *kernel.Error) {
+			if attrs != vmm.CacheWriteCombining {
+				t.Errorf("expected framebuffer to be mapped as write-combining; got cache attribute %d", attrs)
+			}
 			return 0xa0000, nil
 		}
 
@@ -1466,7 +1468,7 @@ func TestVesaFbDriverInterface(t *testing.T) {
 
 	t.Run("init fail", func(t *testing.T) {
 		expErr := &kernel.Error{Module: "test", Message: "something went wrong"}
-		mapRegionFn = func(_ pmm.Frame, _ mem.Size, _ vmm.PageTableEntryFlag) (vmm.Page, *kernel.Error) {
+		mapMMIOFn = func(_ uintptr, _ mem.Size, _ vmm.CacheAttr) (uintptr, *kernel.Error) {
 			return 0, expErr
 		}
 
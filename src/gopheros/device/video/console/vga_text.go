@@ -9,7 +9,6 @@ import (
 	"gopheros/kernel/mem/pmm"
 	"gopheros/kernel/mem/vmm"
 	"image/color"
-	"io"
 	"reflect"
 	"unsafe"
 )
@@ -200,7 +199,7 @@ func (cons *VgaTextConsole) DriverVersion() (uint16, uint16, uint16) {
 }
 
 // DriverInit initializes this driver.
-func (cons *VgaTextConsole) DriverInit(w io.Writer) *kernel.Error {
+func (cons *VgaTextConsole) DriverInit(w *device.Logger) *kernel.Error {
 	// Map the framebuffer so we can write to it
 	fbSize := mem.Size(cons.width * cons.height * 2)
 	fbPage, err := mapRegionFn(
@@ -237,6 +236,7 @@ func probeForVgaTextConsole() device.Driver {
 
 func init() {
 	device.RegisterDriver(&device.DriverInfo{
+		Name:  "vga_text_console",
 		Order: device.DetectOrderEarly,
 		Probe: probeForVgaTextConsole,
 	})
@@ -10,6 +10,16 @@ func EnableInterrupts()
 // DisableInterrupts disables interrupt handling.
 func DisableInterrupts()
 
+// SaveAndDisableInterrupts disables interrupt handling and returns the
+// previous contents of the flags register so they can be restored with a
+// call to RestoreInterrupts.
+func SaveAndDisableInterrupts() uint64
+
+// RestoreInterrupts restores the flags register contents returned by a
+// call to SaveAndDisableInterrupts. Interrupts are re-enabled only if they
+// were enabled before that call.
+func RestoreInterrupts(flags uint64)
+
 // Halt stops instruction execution.
 func Halt()
 
@@ -26,9 +36,34 @@ func ActivePDT() uintptr
 // ReadCR2 returns the value stored in the CR2 register.
 func ReadCR2() uint64
 
+// ReadCR4 returns the value stored in the CR4 register.
+func ReadCR4() uint64
+
+// WriteCR4 writes a value to the CR4 register.
+func WriteCR4(val uint64)
+
+// ReadMSR returns the value stored in the requested model-specific register.
+func ReadMSR(reg uint32) uint64
+
+// WriteMSR writes a value to the requested model-specific register.
+func WriteMSR(reg uint32, val uint64)
+
+// ReadTSC returns the value of the time-stamp counter.
+func ReadTSC() uint64
+
+// ReadRandom returns a random value generated by the RDRAND instruction. The
+// second return value is false if the hardware random number generator could
+// not provide a value. ReadRandom must only be invoked if HasRDRAND returns
+// true.
+func ReadRandom() (uint64, bool)
+
+// ReadGS returns the pointer-sized value stored at the supplied offset from
+// the base address of the GS segment.
+func ReadGS(offset uintptr) uintptr
+
 // ID returns information about the CPU and its features. It
 // is implemented as a CPUID instruction with EAX=leaf and
-// returns the values in EAX, EBX, ECX and EDX.
+// ECX=0 and returns the values in EAX, EBX, ECX and EDX.
 func ID(leaf uint32) (uint32, uint32, uint32, uint32)
 
 // IsIntel returns true if the code is running on an Intel processor.
@@ -39,6 +74,59 @@ func IsIntel() bool {
 		ecx == 0x6c65746e // "ntel"
 }
 
+// HasRDRAND returns true if the CPU supports the RDRAND instruction.
+func HasRDRAND() bool {
+	_, _, ecx, _ := cpuidFn(1)
+	return ecx&(1<<30) != 0
+}
+
+// HasAPIC returns true if the CPU contains a local APIC.
+func HasAPIC() bool {
+	_, _, _, edx := cpuidFn(1)
+	return edx&(1<<9) != 0
+}
+
+// HasMCA returns true if the CPU supports machine-check exceptions and the
+// machine-check architecture (MCG_CAP and the error-reporting banks).
+func HasMCA() bool {
+	_, _, _, edx := cpuidFn(1)
+	return edx&(1<<7) != 0 && edx&(1<<14) != 0
+}
+
+// HasX2APIC returns true if the local APIC supports x2APIC mode.
+func HasX2APIC() bool {
+	_, _, ecx, _ := cpuidFn(1)
+	return ecx&(1<<21) != 0
+}
+
+// HasInvariantTSC returns true if the time-stamp counter runs at a constant
+// rate regardless of power management state changes.
+func HasInvariantTSC() bool {
+	// Invariant TSC support is reported via extended leaf 0x80000007 EDX bit 8
+	if maxLeaf, _, _, _ := cpuidFn(0x80000000); maxLeaf < 0x80000007 {
+		return false
+	}
+
+	_, _, _, edx := cpuidFn(0x80000007)
+	return edx&(1<<8) != 0
+}
+
+// HasLA57 returns true if the CPU supports 5-level paging which extends the
+// virtual address space to 57 bits.
+//
+// TODO: the kernel always uses 4-level paging. Enabling LA57 requires the
+// rt0 bootstrap to set up a P5 table before enabling paging and the vmm
+// code to support 5 paging levels.
+func HasLA57() bool {
+	// LA57 support is reported via leaf 7 (sub-leaf 0) ECX bit 16
+	if maxLeaf, _, _, _ := cpuidFn(0); maxLeaf < 7 {
+		return false
+	}
+
+	_, _, ecx, _ := cpuidFn(7)
+	return ecx&(1<<16) != 0
+}
+
 // PortWriteByte writes a uint8 value to the requested port.
 func PortWriteByte(port uint16, val uint8)
 
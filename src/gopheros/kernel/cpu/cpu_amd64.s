@@ -8,6 +8,19 @@ TEXT ·DisableInterrupts(SB),NOSPLIT,$0
 	CLI
 	RET
 
+TEXT ·SaveAndDisableInterrupts(SB),NOSPLIT,$0
+	PUSHFQ
+	POPQ AX
+	CLI
+	MOVQ AX, ret+0(FP)
+	RET
+
+TEXT ·RestoreInterrupts(SB),NOSPLIT,$0
+	MOVQ flags+0(FP), AX
+	PUSHQ AX
+	POPFQ
+	RET
+
 TEXT ·Halt(SB),NOSPLIT,$0
 	CLI
 	HLT
@@ -34,8 +47,61 @@ TEXT ·ReadCR2(SB),NOSPLIT,$0
 	MOVQ AX, ret+0(FP)
 	RET
 
+TEXT ·ReadCR4(SB),NOSPLIT,$0
+	MOVQ CR4, AX
+	MOVQ AX, ret+0(FP)
+	RET
+
+TEXT ·WriteCR4(SB),NOSPLIT,$0
+	MOVQ val+0(FP), AX
+	MOVQ AX, CR4
+	RET
+
+TEXT ·ReadMSR(SB),NOSPLIT,$0
+	MOVL reg+0(FP), CX
+	RDMSR
+	// the MSR value is returned in EDX:EAX
+	SHLQ $32, DX
+	ORQ DX, AX
+	MOVQ AX, ret+8(FP)
+	RET
+
+TEXT ·WriteMSR(SB),NOSPLIT,$0
+	MOVL reg+0(FP), CX
+	MOVQ val+8(FP), AX
+	MOVQ AX, DX
+	SHRQ $32, DX
+	WRMSR
+	RET
+
+TEXT ·ReadTSC(SB),NOSPLIT,$0
+	RDTSC
+	// the TSC value is returned in EDX:EAX
+	SHLQ $32, DX
+	ORQ DX, AX
+	MOVQ AX, ret+0(FP)
+	RET
+
+TEXT ·ReadRandom(SB),NOSPLIT,$0
+	BYTE $0x48
+	BYTE $0x0f
+	BYTE $0xc7
+	BYTE $0xf0 // rdrand rax
+	// CF is set if a random value was stored in rax
+	SETCS ret1+8(FP)
+	MOVQ AX, ret+0(FP)
+	RET
+
+TEXT ·ReadGS(SB),NOSPLIT,$0
+	MOVQ offset+0(FP), BX
+	BYTE $0x65 // GS segment override prefix for the following instruction
+	MOVQ (BX), AX
+	MOVQ AX, ret+8(FP)
+	RET
+
 TEXT ·ID(SB),NOSPLIT,$0
 	MOVQ leaf+0(FP), AX
+	XORQ CX, CX
 	CPUID
 	MOVL AX, ret+0(FP)
 	MOVL BX, ret+4(FP)
@@ -80,3 +146,27 @@ TEXT ·PortReadDword(SB),NOSPLIT,$0
 	BYTE $0xed  // in eax, dx
 	MOVL AX, ret+0(FP)
 	RET
+
+// In 64-bit mode SGDT and LGDT use 2+8 bytes for the GDT limit and address
+GLOBL gdtr<>(SB), NOPTR, $10
+
+TEXT ·activeGDT(SB),NOSPLIT,$0
+	MOVQ GDTR, gdtr<>+0(SB)
+	LEAQ gdtr<>(SB), AX
+	MOVQ 2(AX), AX
+	MOVQ AX, ret+0(FP)
+	RET
+
+TEXT ·loadGDT(SB),NOSPLIT,$0
+	LEAQ gdtr<>(SB), AX
+	MOVW limit+8(FP), BX
+	MOVW BX, 0(AX)
+	MOVQ base+0(FP), BX
+	MOVQ BX, 2(AX)
+	MOVQ gdtr<>+0(SB), GDTR
+	RET
+
+TEXT ·loadTR(SB),NOSPLIT,$0
+	MOVW selector+0(FP), AX
+	MOVW AX, TASK // ltr ax
+	RET
@@ -27,3 +27,160 @@ func TestIsIntel(t *testing.T) {
 		}
 	}
 }
+
+func TestHasRDRAND(t *testing.T) {
+	defer func() {
+		cpuidFn = ID
+	}()
+
+	specs := []struct {
+		ecx uint32
+		exp bool
+	}{
+		{1 << 30, true},
+		{^uint32(1 << 30), false},
+	}
+
+	for specIndex, spec := range specs {
+		cpuidFn = func(leaf uint32) (uint32, uint32, uint32, uint32) {
+			if leaf != 1 {
+				t.Fatalf("expected CPUID leaf 1 to be queried; got %d", leaf)
+			}
+			return 0, 0, spec.ecx, 0
+		}
+
+		if got := HasRDRAND(); got != spec.exp {
+			t.Errorf("[spec %d] expected HasRDRAND to return %t; got %t", specIndex, spec.exp, got)
+		}
+	}
+}
+
+func TestHasAPIC(t *testing.T) {
+	defer func() {
+		cpuidFn = ID
+	}()
+
+	specs := []struct {
+		ecx, edx  uint32
+		expAPIC   bool
+		expX2APIC bool
+	}{
+		{0, 1 << 9, true, false},
+		{1 << 21, 1 << 9, true, true},
+		{^uint32(1 << 21), ^uint32(1 << 9), false, false},
+	}
+
+	for specIndex, spec := range specs {
+		cpuidFn = func(leaf uint32) (uint32, uint32, uint32, uint32) {
+			if leaf != 1 {
+				t.Fatalf("expected CPUID leaf 1 to be queried; got %d", leaf)
+			}
+			return 0, 0, spec.ecx, spec.edx
+		}
+
+		if got := HasAPIC(); got != spec.expAPIC {
+			t.Errorf("[spec %d] expected HasAPIC to return %t; got %t", specIndex, spec.expAPIC, got)
+		}
+
+		if got := HasX2APIC(); got != spec.expX2APIC {
+			t.Errorf("[spec %d] expected HasX2APIC to return %t; got %t", specIndex, spec.expX2APIC, got)
+		}
+	}
+}
+
+func TestHasMCA(t *testing.T) {
+	defer func() {
+		cpuidFn = ID
+	}()
+
+	specs := []struct {
+		edx    uint32
+		expMCA bool
+	}{
+		{1<<7 | 1<<14, true},
+		{1 << 7, false},
+		{1 << 14, false},
+		{0, false},
+	}
+
+	for specIndex, spec := range specs {
+		cpuidFn = func(leaf uint32) (uint32, uint32, uint32, uint32) {
+			if leaf != 1 {
+				t.Fatalf("expected CPUID leaf 1 to be queried; got %d", leaf)
+			}
+			return 0, 0, 0, spec.edx
+		}
+
+		if got := HasMCA(); got != spec.expMCA {
+			t.Errorf("[spec %d] expected HasMCA to return %t; got %t", specIndex, spec.expMCA, got)
+		}
+	}
+}
+
+func TestHasInvariantTSC(t *testing.T) {
+	defer func() {
+		cpuidFn = ID
+	}()
+
+	specs := []struct {
+		maxLeaf uint32
+		edx     uint32
+		exp     bool
+	}{
+		{0x80000008, 1 << 8, true},
+		{0x80000007, ^uint32(1 << 8), false},
+		{0x80000006, 1 << 8, false},
+	}
+
+	for specIndex, spec := range specs {
+		cpuidFn = func(leaf uint32) (uint32, uint32, uint32, uint32) {
+			switch leaf {
+			case 0x80000000:
+				return spec.maxLeaf, 0, 0, 0
+			case 0x80000007:
+				return 0, 0, 0, spec.edx
+			}
+
+			t.Fatalf("unexpected CPUID leaf 0x%x", leaf)
+			return 0, 0, 0, 0
+		}
+
+		if got := HasInvariantTSC(); got != spec.exp {
+			t.Errorf("[spec %d] expected HasInvariantTSC to return %t; got %t", specIndex, spec.exp, got)
+		}
+	}
+}
+
+func TestHasLA57(t *testing.T) {
+	defer func() {
+		cpuidFn = ID
+	}()
+
+	specs := []struct {
+		maxLeaf uint32
+		ecx     uint32
+		exp     bool
+	}{
+		{7, 1 << 16, true},
+		{0xd, ^uint32(1 << 16), false},
+		{6, 1 << 16, false},
+	}
+
+	for specIndex, spec := range specs {
+		cpuidFn = func(leaf uint32) (uint32, uint32, uint32, uint32) {
+			switch leaf {
+			case 0:
+				return spec.maxLeaf, 0, 0, 0
+			case 7:
+				return 0, 0, spec.ecx, 0
+			}
+
+			t.Fatalf("unexpected CPUID leaf %d", leaf)
+			return 0, 0, 0, 0
+		}
+
+		if got := HasLA57(); got != spec.exp {
+			t.Errorf("[spec %d] expected HasLA57 to return %t; got %t", specIndex, spec.exp, got)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package pat
+
+import (
+	"gopheros/kernel/kfmt"
+	"gopheros/kernel/mem"
+	"io"
+)
+
+const (
+	// maxVariableMTRRs defines the max number of variable MTRRs that can
+	// be reported by ReadMTRRs. Any additional ranges will be ignored.
+	maxVariableMTRRs = 16
+
+	mtrrCapMSR       = 0xfe
+	mtrrDefTypeMSR   = 0x2ff
+	mtrrPhysBase0MSR = 0x200
+
+	mtrrCapCountMask    = 0xff
+	mtrrDefTypeMask     = 0xff
+	mtrrFixedEnabledBit = 1 << 10
+	mtrrEnabledBit      = 1 << 11
+	mtrrMaskValidBit    = 1 << 11
+
+	// defaultPhysAddrBits is used as the physical address width when the
+	// CPU does not report it.
+	defaultPhysAddrBits = 36
+)
+
+// variableMTRRs is a statically allocated array that backs the VariableRanges
+// slice returned by ReadMTRRs.
+var variableMTRRs [maxVariableMTRRs]MTRRRange
+
+// MTRRRange describes a physical memory range whose memory type is set by a
+// variable MTRR.
+type MTRRRange struct {
+	// The physical address where the range begins.
+	PhysAddress uintptr
+
+	// The range size in bytes.
+	Size mem.Size
+
+	// The memory type for the range.
+	Type MemoryType
+}
+
+// MTRRState describes the MTRR configuration established by the firmware.
+type MTRRState struct {
+	// Supported is set to true if the CPU supports MTRRs.
+	Supported bool
+
+	// Enabled is set to true if the MTRRs are enabled.
+	Enabled bool
+
+	// FixedRangesEnabled is set to true if the fixed-range MTRRs that
+	// cover the first megabyte of physical memory are enabled.
+	FixedRangesEnabled bool
+
+	// DefaultType is the memory type for physical memory that is not
+	// covered by any MTRR.
+	DefaultType MemoryType
+
+	// VariableRanges contains the enabled variable MTRRs.
+	VariableRanges []MTRRRange
+}
+
+// ReadMTRRs returns the current MTRR configuration. The VariableRanges slice
+// is backed by a statically allocated array that gets repopulated by each
+// call to ReadMTRRs so callers must not modify its contents.
+func ReadMTRRs() MTRRState {
+	var state MTRRState
+
+	// CPUID leaf 1 reports support for MTRRs via EDX bit 12
+	if _, _, _, edx := cpuIDFn(1); edx&(1<<12) == 0 {
+		return state
+	}
+	state.Supported = true
+
+	defType := readMSRFn(mtrrDefTypeMSR)
+	state.Enabled = defType&mtrrEnabledBit != 0
+	state.FixedRangesEnabled = state.Enabled && defType&mtrrFixedEnabledBit != 0
+	state.DefaultType = MemoryType(defType & mtrrDefTypeMask)
+
+	var (
+		addrMask = physAddrMask()
+		count    = int(readMSRFn(mtrrCapMSR) & mtrrCapCountMask)
+		found    int
+	)
+
+	if count > maxVariableMTRRs {
+		count = maxVariableMTRRs
+	}
+
+	for index := 0; index < count; index++ {
+		base := readMSRFn(uint32(mtrrPhysBase0MSR + 2*index))
+		mask := readMSRFn(uint32(mtrrPhysBase0MSR + 2*index + 1))
+		if mask&mtrrMaskValidBit == 0 {
+			continue
+		}
+
+		mask &= addrMask &^ uint64(mem.PageSize-1)
+		variableMTRRs[found] = MTRRRange{
+			PhysAddress: uintptr(base & addrMask &^ uint64(mem.PageSize-1)),
+			Size:        mem.Size((^mask & addrMask) + 1),
+			Type:        MemoryType(base & mtrrDefTypeMask),
+		}
+		found++
+	}
+
+	state.VariableRanges = variableMTRRs[:found]
+	return state
+}
+
+// PrintMTRRs outputs the current MTRR configuration to w.
+func PrintMTRRs(w io.Writer) {
+	state := ReadMTRRs()
+	switch {
+	case !state.Supported:
+		kfmt.Fprintf(w, "[pat] MTRRs not supported\n")
+		return
+	case !state.Enabled:
+		kfmt.Fprintf(w, "[pat] MTRRs disabled\n")
+		return
+	}
+
+	kfmt.Fprintf(w, "[pat] MTRR default type: %s, fixed ranges enabled: %t\n", state.DefaultType.String(), state.FixedRangesEnabled)
+	for index, r := range state.VariableRanges {
+		kfmt.Fprintf(w, "[pat] MTRR %d: [0x%x - 0x%x] %s\n", index, r.PhysAddress, r.PhysAddress+uintptr(r.Size)-1, r.Type.String())
+	}
+}
+
+// physAddrMask returns a mask that covers the physical address bits supported
+// by the CPU.
+func physAddrMask() uint64 {
+	physAddrBits := uint32(defaultPhysAddrBits)
+
+	// CPUID leaf 0x80000008 reports the physical address width via EAX
+	// bits 0-7.
+	if maxLeaf, _, _, _ := cpuIDFn(0x80000000); maxLeaf >= 0x80000008 {
+		eax, _, _, _ := cpuIDFn(0x80000008)
+		physAddrBits = eax & 0xff
+	}
+
+	return (uint64(1) << physAddrBits) - 1
+}
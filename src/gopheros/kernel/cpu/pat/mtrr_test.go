@@ -0,0 +1,151 @@
+package pat
+
+import (
+	"bytes"
+	"gopheros/kernel/mem"
+	"testing"
+)
+
+func TestReadMTRRs(t *testing.T) {
+	defer resetMocks()
+
+	msrs := map[uint32]uint64{
+		mtrrCapMSR:     0x502,
+		mtrrDefTypeMSR: mtrrEnabledBit | mtrrFixedEnabledBit | uint64(WriteBack),
+		// 2G uncacheable range at 2G
+		0x200: 0x80000000 | uint64(Uncacheable),
+		0x201: 0xf80000000 | mtrrMaskValidBit,
+		// disabled range
+		0x202: 0x100000000 | uint64(WriteCombining),
+		0x203: 0xfff000000,
+	}
+
+	readMSRFn = func(reg uint32) uint64 {
+		val, ok := msrs[reg]
+		if !ok {
+			t.Fatalf("unexpected MSR read 0x%x", reg)
+		}
+		return val
+	}
+
+	cpuIDFn = func(leaf uint32) (uint32, uint32, uint32, uint32) {
+		switch leaf {
+		case 1:
+			return 0, 0, 0, 1 << 12
+		case 0x80000000:
+			return 0x80000008, 0, 0, 0
+		case 0x80000008:
+			// 36-bit physical addresses
+			return 0x3024, 0, 0, 0
+		}
+
+		t.Fatalf("unexpected CPUID leaf 0x%x", leaf)
+		return 0, 0, 0, 0
+	}
+
+	state := ReadMTRRs()
+	if !state.Supported || !state.Enabled || !state.FixedRangesEnabled {
+		t.Fatalf("expected MTRRs to be supported and enabled; got %+v", state)
+	}
+
+	if state.DefaultType != WriteBack {
+		t.Fatalf("expected default type to be %s; got %s", WriteBack, state.DefaultType)
+	}
+
+	exp := MTRRRange{PhysAddress: 0x80000000, Size: 2 * mem.Gb, Type: Uncacheable}
+	if len(state.VariableRanges) != 1 || state.VariableRanges[0] != exp {
+		t.Fatalf("expected variable ranges to be [%+v]; got %+v", exp, state.VariableRanges)
+	}
+
+	t.Run("too many variable ranges", func(t *testing.T) {
+		msrs[mtrrCapMSR] = 0xff
+		for index := 0; index < maxVariableMTRRs+1; index++ {
+			msrs[uint32(mtrrPhysBase0MSR+2*index)] = uint64(Uncacheable)
+			msrs[uint32(mtrrPhysBase0MSR+2*index+1)] = 0xffffff000 | mtrrMaskValidBit
+		}
+
+		if got := len(ReadMTRRs().VariableRanges); got != maxVariableMTRRs {
+			t.Fatalf("expected %d variable ranges; got %d", maxVariableMTRRs, got)
+		}
+	})
+
+	t.Run("MTRRs not supported", func(t *testing.T) {
+		cpuIDFn = func(_ uint32) (uint32, uint32, uint32, uint32) {
+			return 0, 0, 0, 0
+		}
+
+		if state := ReadMTRRs(); state.Supported {
+			t.Fatal("expected MTRRs not to be supported")
+		}
+	})
+}
+
+func TestPhysAddrMask(t *testing.T) {
+	defer resetMocks()
+
+	specs := []struct {
+		maxLeaf  uint32
+		addrBits uint32
+		exp      uint64
+	}{
+		{0x80000004, 0, 0xfffffffff},
+		{0x80000008, 39, 0x7fffffffff},
+	}
+
+	for specIndex, spec := range specs {
+		cpuIDFn = func(leaf uint32) (uint32, uint32, uint32, uint32) {
+			if leaf == 0x80000000 {
+				return spec.maxLeaf, 0, 0, 0
+			}
+			return spec.addrBits, 0, 0, 0
+		}
+
+		if got := physAddrMask(); got != spec.exp {
+			t.Errorf("[spec %d] expected mask to be 0x%x; got 0x%x", specIndex, spec.exp, got)
+		}
+	}
+}
+
+func TestPrintMTRRs(t *testing.T) {
+	defer resetMocks()
+
+	specs := []struct {
+		cpuIDEdx uint32
+		defType  uint64
+		exp      string
+	}{
+		{0, 0, "[pat] MTRRs not supported\n"},
+		{1 << 12, 0, "[pat] MTRRs disabled\n"},
+		{
+			1 << 12,
+			mtrrEnabledBit | uint64(WriteBack),
+			"[pat] MTRR default type: WB, fixed ranges enabled: false\n[pat] MTRR 0: [0xc0000000 - 0xffffffff] UC\n",
+		},
+	}
+
+	for specIndex, spec := range specs {
+		cpuIDFn = func(leaf uint32) (uint32, uint32, uint32, uint32) {
+			return 0, 0, 0, spec.cpuIDEdx
+		}
+
+		readMSRFn = func(reg uint32) uint64 {
+			switch reg {
+			case mtrrCapMSR:
+				return 1
+			case mtrrDefTypeMSR:
+				return spec.defType
+			case mtrrPhysBase0MSR:
+				return 0xc0000000 | uint64(Uncacheable)
+			default:
+				return 0xfc0000000 | mtrrMaskValidBit
+			}
+		}
+
+		var buf bytes.Buffer
+		PrintMTRRs(&buf)
+
+		if got := buf.String(); got != spec.exp {
+			t.Errorf("[spec %d] expected output:\n%q\ngot:\n%q", specIndex, spec.exp, got)
+		}
+	}
+}
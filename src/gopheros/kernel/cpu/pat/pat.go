@@ -0,0 +1,133 @@
+// Package pat configures the page attribute table (PAT) and reports the
+// memory type range registers (MTRR) set up by the firmware.
+package pat
+
+import "gopheros/kernel/cpu"
+
+// MemoryType describes the caching policy applied to a memory region. The
+// values match the encoding used by the PAT and MTRR registers.
+type MemoryType uint8
+
+const (
+	// Uncacheable disables caching and speculative accesses.
+	Uncacheable MemoryType = 0
+
+	// WriteCombining disables caching but allows writes to be combined in
+	// the CPU's write-combining buffers.
+	WriteCombining MemoryType = 1
+
+	// WriteThrough caches reads while writes are propagated to memory.
+	WriteThrough MemoryType = 4
+
+	// WriteProtected caches reads while writes invalidate cache lines.
+	WriteProtected MemoryType = 5
+
+	// WriteBack caches both reads and writes.
+	WriteBack MemoryType = 6
+
+	// UncachedMinus behaves like Uncacheable but can be overridden by an
+	// MTRR that specifies WriteCombining. It is only valid for PAT entries.
+	UncachedMinus MemoryType = 7
+)
+
+// String implements fmt.Stringer for MemoryType.
+func (t MemoryType) String() string {
+	switch t {
+	case Uncacheable:
+		return "UC"
+	case WriteCombining:
+		return "WC"
+	case WriteThrough:
+		return "WT"
+	case WriteProtected:
+		return "WP"
+	case WriteBack:
+		return "WB"
+	case UncachedMinus:
+		return "UC-"
+	default:
+		return "unknown"
+	}
+}
+
+const (
+	// patMSR is the model-specific register that holds the PAT entries.
+	patMSR = 0x277
+
+	// patEntries defines the number of entries in the PAT.
+	patEntries = 8
+)
+
+var (
+	// the following functions are mocked by tests and are automatically
+	// inlined by the compiler.
+	cpuIDFn    = cpu.ID
+	readMSRFn  = cpu.ReadMSR
+	writeMSRFn = cpu.WriteMSR
+
+	// defaultLayout contains the PAT entries selected by the CPU at
+	// power-up. It also describes the memory types selected by the PWT
+	// and PCD page table entry bits on CPUs without PAT support.
+	defaultLayout = [patEntries]MemoryType{
+		WriteBack, WriteThrough, UncachedMinus, Uncacheable,
+		WriteBack, WriteThrough, UncachedMinus, Uncacheable,
+	}
+
+	// layout contains the PAT entries programmed by Init. It matches the
+	// power-up defaults except for entries 1 and 5 which are set to
+	// write-combining instead of write-through.
+	layout = [patEntries]MemoryType{
+		WriteBack, WriteCombining, UncachedMinus, Uncacheable,
+		WriteBack, WriteCombining, UncachedMinus, Uncacheable,
+	}
+
+	// activeLayout points to the PAT entries that are currently in use.
+	activeLayout = &defaultLayout
+)
+
+// Init programs the PAT with a layout that provides access to the
+// write-combining memory type. Init leaves the PAT untouched if the CPU does
+// not support it.
+func Init() {
+	if !Supported() {
+		return
+	}
+
+	if val := encodeLayout(&layout); readMSRFn(patMSR) != val {
+		writeMSRFn(patMSR, val)
+	}
+
+	activeLayout = &layout
+}
+
+// Supported returns true if the CPU supports the PAT.
+func Supported() bool {
+	// CPUID leaf 1 reports support for PAT via EDX bit 16
+	_, _, _, edx := cpuIDFn(1)
+	return edx&(1<<16) != 0
+}
+
+// Index returns the lowest PAT entry index that selects the requested memory
+// type. Bit 0 of the index maps to the PWT page table entry bit, bit 1 to the
+// PCD bit and bit 2 to the PAT bit. If no entry selects the requested type,
+// Index returns false.
+func Index(memType MemoryType) (uint8, bool) {
+	for index, entryType := range activeLayout {
+		if entryType == memType {
+			return uint8(index), true
+		}
+	}
+
+	return 0, false
+}
+
+// encodeLayout returns the PAT MSR value that corresponds to the supplied
+// list of entries.
+func encodeLayout(entries *[patEntries]MemoryType) uint64 {
+	var val uint64
+	for index, entryType := range entries {
+		val |= uint64(entryType) << (uint(index) * 8)
+	}
+
+	return val
+}
@@ -0,0 +1,117 @@
+package pat
+
+import (
+	"gopheros/kernel/cpu"
+	"testing"
+)
+
+func TestMemoryTypeString(t *testing.T) {
+	specs := []struct {
+		memType MemoryType
+		exp     string
+	}{
+		{Uncacheable, "UC"},
+		{WriteCombining, "WC"},
+		{WriteThrough, "WT"},
+		{WriteProtected, "WP"},
+		{WriteBack, "WB"},
+		{UncachedMinus, "UC-"},
+		{MemoryType(2), "unknown"},
+	}
+
+	for specIndex, spec := range specs {
+		if got := spec.memType.String(); got != spec.exp {
+			t.Errorf("[spec %d] expected %q; got %q", specIndex, spec.exp, got)
+		}
+	}
+}
+
+func TestInit(t *testing.T) {
+	defer resetMocks()
+
+	specs := []struct {
+		supported     bool
+		curPAT        uint64
+		expWriteCount int
+		expLayout     *[patEntries]MemoryType
+	}{
+		{false, 0, 0, &defaultLayout},
+		// Power-up default layout
+		{true, 0x0007040600070406, 1, &layout},
+		{true, 0x0007010600070106, 0, &layout},
+	}
+
+	for specIndex, spec := range specs {
+		activeLayout = &defaultLayout
+		cpuIDFn = func(leaf uint32) (uint32, uint32, uint32, uint32) {
+			if leaf != 1 {
+				t.Fatalf("[spec %d] unexpected CPUID leaf 0x%x", specIndex, leaf)
+			}
+
+			if spec.supported {
+				return 0, 0, 0, 1 << 16
+			}
+			return 0, 0, 0, 0
+		}
+
+		readMSRFn = func(reg uint32) uint64 {
+			if reg != patMSR {
+				t.Fatalf("[spec %d] unexpected MSR read 0x%x", specIndex, reg)
+			}
+			return spec.curPAT
+		}
+
+		writeCount := 0
+		writeMSRFn = func(reg uint32, val uint64) {
+			if exp := uint64(0x0007010600070106); reg != patMSR || val != exp {
+				t.Errorf("[spec %d] unexpected MSR write 0x%x: 0x%x", specIndex, reg, val)
+			}
+			writeCount++
+		}
+
+		Init()
+
+		if activeLayout != spec.expLayout {
+			t.Errorf("[spec %d] unexpected active PAT layout: %v", specIndex, *activeLayout)
+		}
+
+		if writeCount != spec.expWriteCount {
+			t.Errorf("[spec %d] expected PAT MSR to be written %d times; got %d", specIndex, spec.expWriteCount, writeCount)
+		}
+	}
+}
+
+func TestIndex(t *testing.T) {
+	defer resetMocks()
+
+	specs := []struct {
+		layout   *[patEntries]MemoryType
+		memType  MemoryType
+		expIndex uint8
+		expOK    bool
+	}{
+		{&defaultLayout, WriteBack, 0, true},
+		{&defaultLayout, WriteThrough, 1, true},
+		{&defaultLayout, Uncacheable, 3, true},
+		{&defaultLayout, WriteCombining, 0, false},
+		{&layout, WriteCombining, 1, true},
+		{&layout, UncachedMinus, 2, true},
+		{&layout, WriteThrough, 0, false},
+	}
+
+	for specIndex, spec := range specs {
+		activeLayout = spec.layout
+
+		index, ok := Index(spec.memType)
+		if ok != spec.expOK || index != spec.expIndex {
+			t.Errorf("[spec %d] expected to get (%d, %t); got (%d, %t)", specIndex, spec.expIndex, spec.expOK, index, ok)
+		}
+	}
+}
+
+func resetMocks() {
+	cpuIDFn = cpu.ID
+	readMSRFn = cpu.ReadMSR
+	writeMSRFn = cpu.WriteMSR
+	activeLayout = &defaultLayout
+}
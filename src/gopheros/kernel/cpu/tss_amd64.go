@@ -0,0 +1,83 @@
+package cpu
+
+import "unsafe"
+
+const (
+	// MaxISTStacks defines the max number of stacks that can be referenced
+	// by the interrupt stack table of a task state segment.
+	MaxISTStacks = 7
+
+	// bootGDTEntries is the number of descriptors in the GDT set up by the
+	// rt0 code (null, code and data segment).
+	bootGDTEntries = 3
+
+	// The 16-byte TSS descriptor is placed right after the boot GDT
+	// descriptors.
+	tssSelector = bootGDTEntries << 3
+
+	tssSize            = 104
+	tssISTOffset       = 0x24
+	tssIOMapBaseOffset = 0x66
+
+	// present, ring-0, available 64-bit TSS
+	tssDescriptorAccess = 0x89
+)
+
+var (
+	// tss is the task state segment of the boot CPU. As the kernel does
+	// not use hardware task switching, it only serves as the container for
+	// the interrupt stack table.
+	tss [tssSize]byte
+
+	// gdt replaces the GDT set up by the rt0 code. It contains a copy of
+	// the boot GDT descriptors followed by the TSS descriptor.
+	gdt [bootGDTEntries + 2]uint64
+
+	// the following functions are mocked by tests.
+	activeGDTFn = activeGDT
+	loadGDTFn   = loadGDT
+	loadTRFn    = loadTR
+)
+
+// LoadTSS sets up a task state segment whose interrupt stack table points to
+// the supplied stack tops and loads it into the task register. The stack at
+// index i is used by the IDT entries whose IST index is set to i+1. Stacks
+// beyond MaxISTStacks are ignored.
+//
+// As the TSS descriptor must be present in the GDT, LoadTSS replaces the
+// GDT set up by the rt0 code with a copy that also includes the TSS
+// descriptor. The code and data segment selectors remain unchanged.
+func LoadTSS(istStackTops []uintptr) {
+	for index := 0; index < MaxISTStacks; index++ {
+		var top uintptr
+		if index < len(istStackTops) {
+			top = istStackTops[index]
+		}
+		*(*uintptr)(unsafe.Pointer(&tss[tssISTOffset+index*8])) = top
+	}
+
+	// Placing the I/O map base past the end of the TSS disables the I/O
+	// permission bitmap.
+	*(*uint16)(unsafe.Pointer(&tss[tssIOMapBaseOffset])) = tssSize
+
+	bootGDT := activeGDTFn()
+	for index := 0; index < bootGDTEntries; index++ {
+		gdt[index] = *(*uint64)(unsafe.Pointer(bootGDT + uintptr(index<<3)))
+	}
+
+	base, limit := uint64(uintptr(unsafe.Pointer(&tss[0]))), uint64(tssSize-1)
+	gdt[bootGDTEntries] = limit&0xffff | (base&0xffffff)<<16 | tssDescriptorAccess<<40 | (limit>>16&0xf)<<48 | (base>>24&0xff)<<56
+	gdt[bootGDTEntries+1] = base >> 32
+
+	loadGDTFn(uintptr(unsafe.Pointer(&gdt[0])), uint16(len(gdt)<<3-1))
+	loadTRFn(tssSelector)
+}
+
+// activeGDT returns the address of the currently loaded GDT.
+func activeGDT() uintptr
+
+// loadGDT loads the GDT with the supplied address and limit.
+func loadGDT(base uintptr, limit uint16)
+
+// loadTR loads the task register with the supplied TSS selector.
+func loadTR(selector uint16)
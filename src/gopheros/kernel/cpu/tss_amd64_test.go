@@ -0,0 +1,69 @@
+package cpu
+
+import (
+	"testing"
+	"unsafe"
+)
+
+func TestLoadTSS(t *testing.T) {
+	defer func() {
+		activeGDTFn = activeGDT
+		loadGDTFn = loadGDT
+		loadTRFn = loadTR
+	}()
+
+	var (
+		bootGDT             = [bootGDTEntries]uint64{0, 0x0020980000000000, 0x0000920000000000}
+		loadedBase          uintptr
+		loadedLimit, loadTR uint16
+	)
+
+	activeGDTFn = func() uintptr { return uintptr(unsafe.Pointer(&bootGDT[0])) }
+	loadGDTFn = func(base uintptr, limit uint16) { loadedBase, loadedLimit = base, limit }
+	loadTRFn = func(selector uint16) { loadTR = selector }
+
+	istStackTops := []uintptr{0xffffff7f00002000, 0xffffff7f00004000, 0, 0, 0, 0, 0, 0xbadf00d}
+	LoadTSS(istStackTops)
+
+	for index := 0; index < MaxISTStacks; index++ {
+		if got := *(*uintptr)(unsafe.Pointer(&tss[tssISTOffset+index*8])); got != istStackTops[index] {
+			t.Errorf("expected IST%d to be 0x%x; got 0x%x", index+1, istStackTops[index], got)
+		}
+	}
+
+	if got := *(*uint16)(unsafe.Pointer(&tss[tssIOMapBaseOffset])); got != tssSize {
+		t.Errorf("expected the I/O map base to be %d; got %d", tssSize, got)
+	}
+
+	if exp := uintptr(unsafe.Pointer(&gdt[0])); loadedBase != exp || loadedLimit != 5*8-1 {
+		t.Fatalf("expected GDT at 0x%x with limit %d to be loaded; got 0x%x with limit %d", exp, 5*8-1, loadedBase, loadedLimit)
+	}
+
+	for index, exp := range bootGDT {
+		if gdt[index] != exp {
+			t.Errorf("expected GDT entry %d to be copied from the boot GDT; got 0x%x", index, gdt[index])
+		}
+	}
+
+	var (
+		low, high = gdt[bootGDTEntries], gdt[bootGDTEntries+1]
+		base      = low>>16&0xffffff | (low>>56&0xff)<<24 | high<<32
+		limit     = low&0xffff | (low>>48&0xf)<<16
+	)
+
+	if exp := uint64(uintptr(unsafe.Pointer(&tss[0]))); base != exp {
+		t.Errorf("expected TSS descriptor base to be 0x%x; got 0x%x", exp, base)
+	}
+
+	if limit != tssSize-1 {
+		t.Errorf("expected TSS descriptor limit to be %d; got %d", tssSize-1, limit)
+	}
+
+	if access := low >> 40 & 0xff; access != tssDescriptorAccess {
+		t.Errorf("expected TSS descriptor access byte to be 0x%x; got 0x%x", tssDescriptorAccess, access)
+	}
+
+	if loadTR != tssSelector {
+		t.Errorf("expected task register to be loaded with selector 0x%x; got 0x%x", tssSelector, loadTR)
+	}
+}
@@ -3,13 +3,16 @@ package hal
 import (
 	"bytes"
 	"gopheros/device"
+	_ "gopheros/device/intc/ioapic" // registers the I/O APIC driver
+	_ "gopheros/device/intc/lapic"  // registers the local APIC driver
+	_ "gopheros/device/rtc"         // registers the CMOS RTC driver
+	_ "gopheros/device/smbios"      // registers the SMBIOS driver
 	"gopheros/device/tty"
 	"gopheros/device/video/console"
 	"gopheros/device/video/console/font"
 	"gopheros/device/video/console/logo"
-	"gopheros/kernel/hal/multiboot"
+	"gopheros/kernel"
 	"gopheros/kernel/kfmt"
-	"sort"
 )
 
 // managedDevices contains the devices discovered by the HAL.
@@ -19,6 +22,9 @@ type managedDevices struct {
 
 	// activeDrivers tracks all initialized device drivers.
 	activeDrivers []device.Driver
+
+	// probeRecords tracks the outcome of probing each registered driver.
+	probeRecords map[*device.DriverInfo]*probeRecord
 }
 
 var (
@@ -34,38 +40,314 @@ func ActiveTTY() tty.Device {
 // DetectHardware probes for hardware devices and initializes the appropriate
 // drivers.
 func DetectHardware() {
-	// Get driver list and sort by detection priority
-	drivers := device.DriverList()
-	sort.Sort(drivers)
+	device.ConfigureLogLevels()
+
+	// Get driver list and sort it so that each driver is probed after its
+	// dependencies and by detection priority
+	drivers, unresolved := device.DriverList().Resolve()
+	for _, info := range unresolved {
+		kfmt.Printf("[hal] %s: skipped; missing dependency or dependency cycle\n", info.Name)
+	}
 
 	probe(drivers)
+
+	if device.ParamBool("selftest", false) {
+		runSelfTests()
+	}
 }
 
-// probe executes the probe function for each driver and invokes
-// onDriverInit for each successfully initialized driver.
-func probe(driverInfoList device.DriverInfoList) {
-	var w = kfmt.PrefixWriter{Sink: kfmt.GetOutputSink()}
+// runSelfTests invokes DriverSelfTest for each active driver that implements
+// device.SelfTester in initialization order and logs the results.
+func runSelfTests() {
+	var (
+		drivers        = lifecycleOrder()
+		passed, failed int
+	)
 
-	for _, info := range driverInfoList {
-		drv := info.Probe()
-		if drv == nil {
+	for index := len(drivers) - 1; index >= 0; index-- {
+		tester, ok := drivers[index].(device.SelfTester)
+		if !ok {
 			continue
 		}
 
 		strBuf.Reset()
-		major, minor, patch := drv.DriverVersion()
-		kfmt.Fprintf(&strBuf, "[hal] %s(%d.%d.%d): ", drv.DriverName(), major, minor, patch)
-		w.Prefix = strBuf.Bytes()
+		kfmt.Fprintf(&strBuf, "[hal] %s: selftest: ", drivers[index].DriverName())
+		w := kfmt.PrefixWriter{Sink: kfmt.GetOutputSink(), Prefix: strBuf.Bytes()}
+
+		if err := tester.DriverSelfTest(&w); err != nil {
+			kfmt.Fprintf(&w, "failed: %s\n", err.Message)
+			failed++
+			continue
+		}
+
+		kfmt.Fprintf(&w, "passed\n")
+		passed++
+	}
+
+	kfmt.Printf("[hal] selftest: %d passed, %d failed\n", passed, failed)
+}
+
+// deferredDriver tracks a driver whose initialization has been deferred.
+type deferredDriver struct {
+	info *device.DriverInfo
+
+	// drv is nil if the driver was deferred before its probe function
+	// was invoked.
+	drv device.Driver
+}
+
+// probeState tracks the outcome of the driver probes.
+type probeState struct {
+	// initialized contains the names of the initialized drivers and the
+	// functions that they provide.
+	initialized map[string]bool
+
+	// providers maps each provided function to the name of the driver
+	// that provides it.
+	providers map[string]string
+
+	// deferred contains the names of the drivers, and the functions that
+	// they provide, whose initialization was deferred during the current
+	// pass.
+	deferred map[string]bool
+}
+
+// probe executes the probe function for each driver and invokes
+// onDriverInit for each successfully initialized driver. Drivers whose
+// dependencies have not been successfully initialized are skipped. Drivers
+// that provide a function which is already provided by a previously
+// initialized driver are also skipped.
+//
+// Drivers whose DriverInit method returns device.ErrProbeDeferred, as well
+// as drivers that depend on them, are retried after the remaining drivers
+// have been probed. Retries stop once a pass fails to initialize any driver.
+func probe(driverInfoList device.DriverInfoList) {
+	var (
+		state = probeState{
+			initialized: make(map[string]bool),
+			providers:   make(map[string]string),
+		}
+		pending = make([]deferredDriver, len(driverInfoList))
+	)
+
+	if devices.probeRecords == nil {
+		devices.probeRecords = make(map[*device.DriverInfo]*probeRecord)
+	}
+
+	for index, info := range driverInfoList {
+		pending[index].info = info
+	}
+
+	for progress := true; progress && len(pending) != 0; {
+		var retry []deferredDriver
+
+		state.deferred = make(map[string]bool)
+		progress = false
+		for _, entry := range pending {
+			res := probeDriver(&entry, &state)
+			devices.probeRecords[entry.info] = &probeRecord{result: res, drv: entry.drv}
+
+			switch res {
+			case probeInitialized:
+				progress = true
+			case probeDeferred:
+				state.deferred[entry.info.Name] = true
+				if entry.info.Provides != "" {
+					state.deferred[entry.info.Provides] = true
+				}
+				retry = append(retry, entry)
+			}
+		}
+
+		pending = retry
+	}
+
+	for _, entry := range pending {
+		kfmt.Printf("[hal] %s: skipped; initialization remained deferred\n", entry.info.Name)
+	}
+}
+
+// probeResult describes the outcome of a call to probeDriver.
+type probeResult uint8
+
+const (
+	probeSkipped probeResult = iota
+	probeInitialized
+	probeDeferred
+	probeAbsent
+	probeFailed
+)
+
+// String implements fmt.Stringer for probeResult.
+func (r probeResult) String() string {
+	switch r {
+	case probeSkipped:
+		return "skipped"
+	case probeInitialized:
+		return "active"
+	case probeDeferred:
+		return "deferred"
+	case probeAbsent:
+		return "absent"
+	default:
+		return "failed"
+	}
+}
+
+// probeRecord describes the outcome of probing a registered driver.
+type probeRecord struct {
+	result probeResult
+
+	// drv is nil if the probe function did not detect any hardware.
+	drv device.Driver
+}
+
+// probeDriver probes and initializes the driver described by the supplied
+// entry. If the driver has already been probed during an earlier pass, its
+// probe function is not invoked again.
+func probeDriver(entry *deferredDriver, state *probeState) probeResult {
+	if provider, ok := state.providers[entry.info.Provides]; ok {
+		kfmt.Printf("[hal] %s: skipped; %s is provided by %s\n", entry.info.Name, entry.info.Provides, provider)
+		return probeSkipped
+	}
+
+	if dep := missingDependency(entry.info, state.initialized); dep != "" {
+		if state.deferred[dep] {
+			return probeDeferred
+		}
 
-		if err := drv.DriverInit(&w); err != nil {
-			kfmt.Fprintf(&w, "init failed: %s\n", err.Message)
+		kfmt.Printf("[hal] %s: skipped; dependency %s is not available\n", entry.info.Name, dep)
+		return probeSkipped
+	}
+
+	if entry.drv == nil {
+		if entry.drv = entry.info.Probe(); entry.drv == nil {
+			return probeAbsent
+		}
+	}
+
+	strBuf.Reset()
+	major, minor, patch := entry.drv.DriverVersion()
+	kfmt.Fprintf(&strBuf, "[hal] %s(%d.%d.%d): ", entry.drv.DriverName(), major, minor, patch)
+	log := device.NewLogger(kfmt.GetOutputSink(), strBuf.Bytes(), device.DriverLogLevel(entry.drv.DriverName()))
+
+	switch err := entry.drv.DriverInit(log); err {
+	case nil:
+	case device.ErrProbeDeferred:
+		log.Infof("init deferred\n")
+		return probeDeferred
+	default:
+		log.Errorf("init failed: %s\n", err.Message)
+		return probeFailed
+	}
+
+	log.Infof("initialized\n")
+	onDriverInit(entry.info, entry.drv)
+	devices.activeDrivers = append(devices.activeDrivers, entry.drv)
+	state.initialized[entry.info.Name] = true
+	if entry.info.Provides != "" {
+		state.initialized[entry.info.Provides] = true
+		state.providers[entry.info.Provides] = entry.info.Name
+	}
+	return probeInitialized
+}
+
+// missingDependency returns the name of the first dependency of the supplied
+// driver that has not been initialized or an empty string if all
+// dependencies are satisfied.
+func missingDependency(info *device.DriverInfo, initialized map[string]bool) string {
+	for _, dep := range info.DependsOn {
+		if !initialized[dep] {
+			return dep
+		}
+	}
+
+	return ""
+}
+
+// ShutdownDevices invokes DriverShutdown for each active driver that
+// implements device.Shutdowner. It must be called before the system is
+// powered off or rebooted. Drivers are shut down in the reverse order of
+// their initialization; drivers bound to devices in the device registry are
+// shut down before the drivers of their parent devices. Errors are logged
+// but do not prevent the remaining drivers from being shut down.
+func ShutdownDevices() {
+	for _, drv := range lifecycleOrder() {
+		if s, ok := drv.(device.Shutdowner); ok {
+			if err := s.DriverShutdown(); err != nil {
+				kfmt.Printf("[hal] %s: shutdown failed: %s\n", drv.DriverName(), err.Message)
+			}
+		}
+	}
+}
+
+// SuspendDevices invokes DriverSuspend for each active driver that
+// implements device.Suspender using the same order as ShutdownDevices. If a
+// driver fails to suspend, the drivers that were already suspended are
+// resumed and the error is returned.
+func SuspendDevices() *kernel.Error {
+	drivers := lifecycleOrder()
+	for index, drv := range drivers {
+		s, ok := drv.(device.Suspender)
+		if !ok {
 			continue
 		}
 
-		kfmt.Fprintf(&w, "initialized\n")
-		onDriverInit(info, drv)
-		devices.activeDrivers = append(devices.activeDrivers, drv)
+		if err := s.DriverSuspend(); err != nil {
+			kfmt.Printf("[hal] %s: suspend failed: %s\n", drv.DriverName(), err.Message)
+			resumeDrivers(drivers[:index])
+			return err
+		}
 	}
+
+	return nil
+}
+
+// ResumeDevices invokes DriverResume for each active driver that implements
+// device.Suspender in the reverse order of SuspendDevices. Errors are logged
+// but do not prevent the remaining drivers from being resumed.
+func ResumeDevices() {
+	resumeDrivers(lifecycleOrder())
+}
+
+// resumeDrivers resumes the supplied list of suspended drivers in reverse
+// order.
+func resumeDrivers(drivers []device.Driver) {
+	for index := len(drivers) - 1; index >= 0; index-- {
+		if s, ok := drivers[index].(device.Suspender); ok {
+			if err := s.DriverResume(); err != nil {
+				kfmt.Printf("[hal] %s: resume failed: %s\n", drivers[index].DriverName(), err.Message)
+			}
+		}
+	}
+}
+
+// lifecycleOrder returns the list of active drivers in the order they should
+// be shut down or suspended. Drivers bound to devices in the device registry
+// come first with child devices preceding their parents. They are followed
+// by the drivers initialized by probe in the reverse order of their
+// initialization.
+func lifecycleOrder() []device.Driver {
+	var drivers []device.Driver
+
+	var visit func(*device.Node)
+	visit = func(dev *device.Node) {
+		children := dev.Children()
+		for index := len(children) - 1; index >= 0; index-- {
+			visit(children[index])
+		}
+
+		if dev.Driver != nil {
+			drivers = append(drivers, dev.Driver)
+		}
+	}
+	visit(device.Devices().Root())
+
+	for index := len(devices.activeDrivers) - 1; index >= 0; index-- {
+		drivers = append(drivers, devices.activeDrivers[index])
+	}
+
+	return drivers
 }
 
 // onDriverInit is invoked by probe() whenever a piece of hardware is detected
@@ -100,15 +382,7 @@ func onConsoleInit(cons console.Device) {
 	devices.activeConsole = cons
 
 	if logoSetter, ok := (devices.activeConsole).(console.LogoSetter); ok {
-		disableLogo := false
-		for k, v := range multiboot.GetBootCmdLine() {
-			if k == "consoleLogo" && v == "off" {
-				disableLogo = true
-				break
-			}
-		}
-
-		if !disableLogo {
+		if device.ParamBool("consoleLogo", true) {
 			consW, consH := devices.activeConsole.Dimensions(console.Pixels)
 			logoSetter.SetLogo(logo.BestFit(consW, consH))
 		}
@@ -119,14 +393,8 @@ func onConsoleInit(cons console.Device) {
 
 		// Check boot cmdline for a font request
 		var selFont *font.Font
-		for k, v := range multiboot.GetBootCmdLine() {
-			if k != "consoleFont" {
-				continue
-			}
-
-			if selFont = font.FindByName(v); selFont != nil {
-				break
-			}
+		if name, ok := device.Param("consoleFont"); ok {
+			selFont = font.FindByName(name)
 		}
 
 		if selFont == nil {
@@ -0,0 +1,306 @@
+package hal
+
+import (
+	"bytes"
+	"gopheros/device"
+	"gopheros/kernel"
+	"gopheros/kernel/kfmt"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestDeviceLifecycle(t *testing.T) {
+	var (
+		buf    bytes.Buffer
+		calls  []string
+		expErr = &kernel.Error{Module: "test", Message: "device busy"}
+
+		bus     = &device.Node{Name: "bus", Driver: &lifecycleDriver{name: "bus", calls: &calls}}
+		child   = &device.Node{Name: "child", Driver: &lifecycleDriver{name: "child", calls: &calls}}
+		plain   = &device.Node{Name: "plain", Driver: &plainDriver{}}
+		unbound = &device.Node{Name: "unbound"}
+
+		early = &lifecycleDriver{name: "early", calls: &calls}
+		late  = &lifecycleDriver{name: "late", calls: &calls}
+	)
+
+	kfmt.SetOutputSink(&buf)
+	buf.Reset()
+	defer func() {
+		kfmt.SetOutputSink(nil)
+		devices.activeDrivers = nil
+		_ = device.Devices().RemoveDevice(bus)
+		_ = device.Devices().RemoveDevice(plain)
+		_ = device.Devices().RemoveDevice(unbound)
+	}()
+
+	for _, spec := range []struct{ parent, dev *device.Node }{{nil, bus}, {bus, child}, {nil, plain}, {nil, unbound}} {
+		if err := device.Devices().AddDevice(spec.parent, spec.dev); err != nil {
+			t.Fatal(err)
+		}
+	}
+	devices.activeDrivers = []device.Driver{early, &plainDriver{}, late}
+
+	if err := SuspendDevices(); err != nil {
+		t.Fatal(err)
+	}
+	ResumeDevices()
+	ShutdownDevices()
+
+	exp := []string{
+		"suspend child", "suspend bus", "suspend late", "suspend early",
+		"resume early", "resume late", "resume bus", "resume child",
+		"shutdown child", "shutdown bus", "shutdown late", "shutdown early",
+	}
+	if !reflect.DeepEqual(calls, exp) {
+		t.Fatalf("expected driver calls to be:\n%v\ngot:\n%v", exp, calls)
+	}
+
+	t.Run("errors", func(t *testing.T) {
+		calls = calls[:0]
+		late.err = expErr
+
+		if err := SuspendDevices(); err != expErr {
+			t.Fatalf("expected error %v; got %v", expErr, err)
+		}
+
+		// Errors while resuming or shutting down are only logged
+		early.err = expErr
+		ResumeDevices()
+		ShutdownDevices()
+
+		exp := []string{
+			"suspend child", "suspend bus", "suspend late", "resume bus", "resume child",
+			"resume early", "resume late", "resume bus", "resume child",
+			"shutdown child", "shutdown bus", "shutdown late", "shutdown early",
+		}
+		if !reflect.DeepEqual(calls, exp) {
+			t.Fatalf("expected driver calls to be:\n%v\ngot:\n%v", exp, calls)
+		}
+
+		expOutput := "[hal] late: suspend failed: device busy\n" +
+			"[hal] early: resume failed: device busy\n" +
+			"[hal] late: resume failed: device busy\n" +
+			"[hal] late: shutdown failed: device busy\n" +
+			"[hal] early: shutdown failed: device busy\n"
+		if got := buf.String(); got != expOutput {
+			t.Fatalf("expected output to be:\n%q\ngot:\n%q", expOutput, got)
+		}
+	})
+}
+
+func TestProbeAlternatives(t *testing.T) {
+	var (
+		buf    bytes.Buffer
+		expErr = &kernel.Error{Module: "test", Message: "not supported"}
+	)
+
+	kfmt.SetOutputSink(&buf)
+	buf.Reset()
+	defer func() {
+		kfmt.SetOutputSink(nil)
+		devices.activeDrivers = nil
+	}()
+
+	driverInfo := func(name string, priority int, drv device.Driver, deps ...string) *device.DriverInfo {
+		return &device.DriverInfo{
+			Name:      name,
+			DependsOn: deps,
+			Provides:  "clocksource",
+			Priority:  priority,
+			Probe:     func() device.Driver { return drv },
+		}
+	}
+
+	list := device.DriverInfoList{
+		driverInfo("pit", 0, &deferringDriver{name: "pit"}),
+		driverInfo("kvmclock", 300, &deferringDriver{name: "kvmclock", deferCount: 100}),
+		driverInfo("tsc", 200, &deferringDriver{name: "tsc", initErr: expErr}),
+		driverInfo("hpet", 100, nil),
+		driverInfo("acpi_pm", 50, &deferringDriver{name: "acpi_pm"}),
+		{
+			Name:      "sched",
+			DependsOn: []string{"clocksource"},
+			Probe:     func() device.Driver { return &deferringDriver{name: "sched"} },
+		},
+	}
+
+	sorted, _ := list.Resolve()
+	probe(sorted)
+
+	expOutput := "[hal] kvmclock(0.0.1): init deferred\n" +
+		"[hal] tsc(0.0.1): init failed: not supported\n" +
+		"[hal] acpi_pm(0.0.1): initialized\n" +
+		"[hal] pit: skipped; clocksource is provided by acpi_pm\n" +
+		"[hal] sched(0.0.1): initialized\n" +
+		// Deferred alternatives are skipped once the function is provided
+		"[hal] kvmclock: skipped; clocksource is provided by acpi_pm\n"
+
+	if got := buf.String(); got != expOutput {
+		t.Fatalf("expected output to be:\n%s\ngot:\n%s", expOutput, got)
+	}
+}
+
+func TestRunSelfTests(t *testing.T) {
+	var buf bytes.Buffer
+
+	kfmt.SetOutputSink(&buf)
+	buf.Reset()
+	defer func() {
+		kfmt.SetOutputSink(nil)
+		devices.activeDrivers = nil
+	}()
+
+	devices.activeDrivers = []device.Driver{
+		&selfTestDriver{name: "hpet", output: "counter is running\n"},
+		&plainDriver{},
+		&selfTestDriver{name: "acpi", err: &kernel.Error{Module: "test", Message: "bad checksum"}},
+	}
+
+	runSelfTests()
+
+	exp := "[hal] hpet: selftest: counter is running\n" +
+		"[hal] hpet: selftest: passed\n" +
+		"[hal] acpi: selftest: failed: bad checksum\n" +
+		"[hal] selftest: 1 passed, 1 failed\n"
+
+	if got := buf.String(); got != exp {
+		t.Fatalf("expected output to be:\n%q\ngot:\n%q", exp, got)
+	}
+}
+
+type selfTestDriver struct {
+	plainDriver
+
+	name   string
+	output string
+	err    *kernel.Error
+}
+
+func (d *selfTestDriver) DriverName() string { return d.name }
+
+func (d *selfTestDriver) DriverSelfTest(w io.Writer) *kernel.Error {
+	kfmt.Fprintf(w, d.output)
+	return d.err
+}
+
+type deferringDriver struct {
+	plainDriver
+
+	name       string
+	deferCount int
+	initErr    *kernel.Error
+}
+
+func (d *deferringDriver) DriverName() string { return d.name }
+
+func (d *deferringDriver) DriverInit(_ *device.Logger) *kernel.Error {
+	if d.deferCount > 0 {
+		d.deferCount--
+		return device.ErrProbeDeferred
+	}
+
+	return d.initErr
+}
+
+type plainDriver struct{}
+
+func (d *plainDriver) DriverName() string                        { return "plain" }
+func (d *plainDriver) DriverVersion() (uint16, uint16, uint16)   { return 0, 0, 1 }
+func (d *plainDriver) DriverInit(_ *device.Logger) *kernel.Error { return nil }
+
+type lifecycleDriver struct {
+	plainDriver
+
+	name  string
+	calls *[]string
+	err   *kernel.Error
+}
+
+func (d *lifecycleDriver) DriverName() string { return d.name }
+
+func (d *lifecycleDriver) DriverShutdown() *kernel.Error {
+	*d.calls = append(*d.calls, "shutdown "+d.name)
+	return d.err
+}
+
+func (d *lifecycleDriver) DriverSuspend() *kernel.Error {
+	*d.calls = append(*d.calls, "suspend "+d.name)
+	return d.err
+}
+
+func (d *lifecycleDriver) DriverResume() *kernel.Error {
+	*d.calls = append(*d.calls, "resume "+d.name)
+	return d.err
+}
+
+func TestProbeDeferred(t *testing.T) {
+	var (
+		buf        bytes.Buffer
+		probeCount = make(map[string]int)
+		expErr     = &kernel.Error{Module: "test", Message: "no such device"}
+	)
+
+	kfmt.SetOutputSink(&buf)
+	buf.Reset()
+	defer func() {
+		kfmt.SetOutputSink(nil)
+		devices.activeDrivers = nil
+	}()
+
+	driverInfo := func(name string, drv device.Driver, deps ...string) *device.DriverInfo {
+		return &device.DriverInfo{
+			Name:      name,
+			DependsOn: deps,
+			Probe: func() device.Driver {
+				probeCount[name]++
+				return drv
+			},
+		}
+	}
+
+	probe(device.DriverInfoList{
+		driverInfo("bus", &deferringDriver{name: "bus", deferCount: 1}),
+		driverInfo("absent", nil),
+		driverInfo("serial", &deferringDriver{name: "serial"}),
+		driverInfo("nic", &deferringDriver{name: "nic"}, "bus"),
+		driverInfo("stuck", &deferringDriver{name: "stuck", deferCount: 100}),
+		driverInfo("stuck-child", &deferringDriver{name: "stuck-child"}, "stuck"),
+		driverInfo("broken", &deferringDriver{name: "broken", initErr: expErr}),
+		driverInfo("orphan", &deferringDriver{name: "orphan"}, "broken"),
+		driverInfo("late", &deferringDriver{name: "late", deferCount: 2}),
+	})
+
+	expOutput := "[hal] bus(0.0.1): init deferred\n" +
+		"[hal] serial(0.0.1): initialized\n" +
+		"[hal] stuck(0.0.1): init deferred\n" +
+		"[hal] broken(0.0.1): init failed: no such device\n" +
+		"[hal] orphan: skipped; dependency broken is not available\n" +
+		"[hal] late(0.0.1): init deferred\n" +
+		// second pass
+		"[hal] bus(0.0.1): initialized\n" +
+		"[hal] nic(0.0.1): initialized\n" +
+		"[hal] stuck(0.0.1): init deferred\n" +
+		"[hal] late(0.0.1): init deferred\n" +
+		// third pass
+		"[hal] stuck(0.0.1): init deferred\n" +
+		"[hal] late(0.0.1): initialized\n" +
+		// fourth pass; no progress
+		"[hal] stuck(0.0.1): init deferred\n" +
+		"[hal] stuck: skipped; initialization remained deferred\n" +
+		"[hal] stuck-child: skipped; initialization remained deferred\n"
+
+	if got := buf.String(); got != expOutput {
+		t.Fatalf("expected output to be:\n%s\ngot:\n%s", expOutput, got)
+	}
+
+	expProbeCount := map[string]int{"bus": 1, "absent": 1, "serial": 1, "nic": 1, "stuck": 1, "broken": 1, "late": 1}
+	if !reflect.DeepEqual(probeCount, expProbeCount) {
+		t.Fatalf("expected probe counts to be %v; got %v", expProbeCount, probeCount)
+	}
+
+	if exp, got := 4, len(devices.activeDrivers); got != exp {
+		t.Fatalf("expected %d active drivers; got %d", exp, got)
+	}
+}
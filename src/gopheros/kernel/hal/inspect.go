@@ -0,0 +1,138 @@
+package hal
+
+import (
+	"bytes"
+	"gopheros/device"
+	"gopheros/kernel/kfmt"
+	"io"
+)
+
+var (
+	// driverListFn is overridden by tests.
+	driverListFn = device.DriverList
+)
+
+// PrintDevices writes a listing of the registered drivers and the devices in
+// the device registry to w. For each registered driver, the listing includes
+// its version and the outcome of its probe (active, absent, deferred,
+// failed, skipped or unprobed). For each device, the listing includes its
+// location in the registry, the bus it is attached to, its bound driver and
+// its assigned resources.
+func PrintDevices(w io.Writer) {
+	var (
+		drivers = newTable("NAME", "VERSION", "STATE")
+		devs    = newTable("PATH", "BUS", "DRIVER", "VERSION", "RESOURCES")
+	)
+
+	for _, info := range driverListFn() {
+		state, version := "unprobed", "-"
+		if record, ok := devices.probeRecords[info]; ok {
+			state = record.result.String()
+			if record.drv != nil {
+				version = driverVersion(record.drv)
+			}
+		}
+
+		drivers.addRow(info.Name, version, state)
+	}
+
+	device.Devices().Walk(func(dev *device.Node, _ int) bool {
+		if dev == device.Devices().Root() {
+			return true
+		}
+
+		drvName, version := "-", "-"
+		if dev.Driver != nil {
+			drvName, version = dev.Driver.DriverName(), driverVersion(dev.Driver)
+		}
+
+		devs.addRow(dev.Path(), orDash(dev.Bus), drvName, version, resourceList(dev.Resources))
+		return true
+	})
+
+	kfmt.Fprintf(w, "drivers:\n")
+	drivers.print(w)
+	kfmt.Fprintf(w, "devices:\n")
+	devs.print(w)
+}
+
+// driverVersion returns the version of drv formatted as "major.minor.patch".
+func driverVersion(drv device.Driver) string {
+	var buf bytes.Buffer
+	major, minor, patch := drv.DriverVersion()
+	kfmt.Fprintf(&buf, "%d.%d.%d", major, minor, patch)
+	return buf.String()
+}
+
+// resourceList returns a comma-separated list of the supplied resources.
+func resourceList(resources []device.Resource) string {
+	if len(resources) == 0 {
+		return "-"
+	}
+
+	var buf bytes.Buffer
+	for index, res := range resources {
+		if index != 0 {
+			buf.WriteString(", ")
+		}
+
+		kfmt.Fprintf(&buf, "%s 0x%x", res.Type.String(), res.Base)
+		if res.Type != device.ResourceIRQ {
+			kfmt.Fprintf(&buf, "-0x%x", res.Base+res.Length-1)
+		}
+	}
+
+	return buf.String()
+}
+
+// orDash returns s or "-" if s is empty.
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+
+	return s
+}
+
+// table formats rows of text so that each column is left-aligned.
+type table struct {
+	rows   [][]string
+	widths []int
+}
+
+// newTable returns a table with the supplied column headers.
+func newTable(headers ...string) *table {
+	t := &table{widths: make([]int, len(headers))}
+	t.addRow(headers...)
+	return t
+}
+
+// addRow appends a row to the table. The number of columns must match the
+// number of table headers.
+func (t *table) addRow(cols ...string) {
+	for index, col := range cols {
+		if len(col) > t.widths[index] {
+			t.widths[index] = len(col)
+		}
+	}
+
+	t.rows = append(t.rows, cols)
+}
+
+// print writes the table rows to w. Columns are separated by two spaces.
+func (t *table) print(w io.Writer) {
+	for _, row := range t.rows {
+		kfmt.Fprintf(w, "  ")
+		for index, col := range row {
+			kfmt.Fprintf(w, "%s", col)
+			if index == len(row)-1 {
+				break
+			}
+
+			for pad := len(col); pad < t.widths[index]+2; pad++ {
+				kfmt.Fprintf(w, " ")
+			}
+		}
+		kfmt.Fprintf(w, "\n")
+	}
+}
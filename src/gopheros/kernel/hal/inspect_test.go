@@ -0,0 +1,94 @@
+package hal
+
+import (
+	"bytes"
+	"gopheros/device"
+	"testing"
+)
+
+func TestPrintDevices(t *testing.T) {
+	var (
+		buf bytes.Buffer
+
+		smbios = &device.DriverInfo{Name: "smbios"}
+		vesa   = &device.DriverInfo{Name: "vesa_fb_console"}
+		vt     = &device.DriverInfo{Name: "vt"}
+		pit    = &device.DriverInfo{Name: "pit"}
+
+		pci = &device.Node{
+			Name:      "pci0",
+			Bus:       "acpi",
+			Driver:    &selfTestDriver{name: "pci"},
+			Resources: []device.Resource{{Type: device.ResourceIOPort, Base: 0xcf8, Length: 8}},
+		}
+		nic = &device.Node{
+			Name: "00:03.0",
+			Bus:  "pci",
+			Resources: []device.Resource{
+				{Type: device.ResourceMemory, Base: 0xfebc0000, Length: 0x20000},
+				{Type: device.ResourceIRQ, Base: 11},
+			},
+		}
+		hub = &device.Node{Name: "hub"}
+	)
+
+	defer func(origDriverListFn func() device.DriverInfoList) {
+		driverListFn = origDriverListFn
+		devices.probeRecords = nil
+		_ = device.Devices().RemoveDevice(pci)
+		_ = device.Devices().RemoveDevice(hub)
+	}(driverListFn)
+
+	driverListFn = func() device.DriverInfoList {
+		return device.DriverInfoList{smbios, vesa, vt, pit}
+	}
+
+	devices.probeRecords = map[*device.DriverInfo]*probeRecord{
+		smbios: {result: probeInitialized, drv: &plainDriver{}},
+		vesa:   {result: probeAbsent},
+		vt:     {result: probeFailed, drv: &plainDriver{}},
+	}
+
+	for _, spec := range []struct{ parent, dev *device.Node }{{nil, pci}, {pci, nic}, {nil, hub}} {
+		if err := device.Devices().AddDevice(spec.parent, spec.dev); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	PrintDevices(&buf)
+
+	exp := "drivers:\n" +
+		"  NAME             VERSION  STATE\n" +
+		"  smbios           0.0.1    active\n" +
+		"  vesa_fb_console  -        absent\n" +
+		"  vt               0.0.1    failed\n" +
+		"  pit              -        unprobed\n" +
+		"devices:\n" +
+		"  PATH           BUS   DRIVER  VERSION  RESOURCES\n" +
+		"  /pci0          acpi  pci     0.0.1    io 0xcf8-0xcff\n" +
+		"  /pci0/00:03.0  pci   -       -        mem 0xfebc0000-0xfebdffff, irq 0xb\n" +
+		"  /hub           -     -       -        -\n"
+
+	if got := buf.String(); got != exp {
+		t.Fatalf("expected output to be:\n%s\ngot:\n%s", exp, got)
+	}
+}
+
+func TestProbeResultString(t *testing.T) {
+	specs := []struct {
+		input probeResult
+		exp   string
+	}{
+		{probeSkipped, "skipped"},
+		{probeInitialized, "active"},
+		{probeDeferred, "deferred"},
+		{probeAbsent, "absent"},
+		{probeFailed, "failed"},
+	}
+
+	for specIndex, spec := range specs {
+		if got := spec.input.String(); got != spec.exp {
+			t.Errorf("[spec %d] expected %q; got %q", specIndex, spec.exp, got)
+		}
+	}
+}
@@ -26,6 +26,9 @@ const (
 	tagFramebufferInfo
 	tagElfSymbols
 	tagApmTable
+	tagEfi32SystemTable
+	tagEfi64SystemTable
+	tagSMBIOSTables
 )
 
 // info describes the multiboot info section header.
@@ -141,6 +144,10 @@ const (
 	// MemNvs indicates memory that must be preserved when hibernating.
 	MemNvs
 
+	// MemBadRAM indicates a memory region that is occupied by defective
+	// RAM modules.
+	MemBadRAM
+
 	// Any value >= memUnknown will be mapped to MemReserved.
 	memUnknown
 )
@@ -174,6 +181,8 @@ func (t MemoryEntryType) String() string {
 		return "ACPI (reclaimable)"
 	case MemNvs:
 		return "NVS"
+	case MemBadRAM:
+		return "bad RAM"
 	default:
 		return "unknown"
 	}
@@ -294,7 +303,7 @@ func VisitMemRegions(visitor MemRegionVisitor) {
 		entry = (*MemoryMapEntry)(unsafe.Pointer(curPtr))
 
 		// Mark unknown entry types as reserved
-		if entry.Type == 0 || entry.Type > memUnknown {
+		if entry.Type == 0 || entry.Type >= memUnknown {
 			entry.Type = MemReserved
 		}
 
@@ -319,6 +328,22 @@ func GetFramebufferInfo() *FramebufferInfo {
 	return info
 }
 
+// GetSMBIOSEntryPoint returns a pointer to the copy of the SMBIOS entry point
+// structure that the bootloader appended to the multiboot info data. This tag
+// is typically provided when booting via EFI where the entry point may not
+// reside in the legacy BIOS area. This function returns 0 if the bootloader
+// did not provide a copy of the SMBIOS entry point.
+func GetSMBIOSEntryPoint() uintptr {
+	// The tag contents start with the SMBIOS major/minor version followed
+	// by 6 reserved bytes and the entry point structure.
+	curPtr, size := findTagByType(tagSMBIOSTables)
+	if size <= 8 {
+		return 0
+	}
+
+	return curPtr + 8
+}
+
 // GetBootCmdLine returns the command line key-value pairs passed to the
 // kernel.  This function must only be invoked after bootstrapping the memory
 // allocator.
@@ -339,9 +364,9 @@ func GetBootCmdLine() map[string]string {
 		}))
 		pairs := strings.Fields(string(cmdLine))
 		for _, pair := range pairs {
-			kv := strings.Split(pair, "=")
+			kv := strings.SplitN(pair, "=", 2)
 			switch len(kv) {
-			case 2: // foo=bar
+			case 2: // foo=bar or foo=bar=baz
 				cmdLineKV[kv[0]] = kv[1]
 			case 1: // nofoo
 				cmdLineKV[kv[0]] = kv[0]
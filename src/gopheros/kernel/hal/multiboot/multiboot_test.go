@@ -114,6 +114,7 @@ func TestMemoryEntryTypeStringer(t *testing.T) {
 		{MemReserved, "reserved"},
 		{MemAcpiReclaimable, "ACPI (reclaimable)"},
 		{MemNvs, "NVS"},
+		{MemBadRAM, "bad RAM"},
 		{MemoryEntryType(123), "unknown"},
 	}
 
@@ -173,6 +174,31 @@ func TestGetFramebufferInfo(t *testing.T) {
 	}
 }
 
+func TestGetSMBIOSEntryPoint(t *testing.T) {
+	SetInfoPtr(uintptr(unsafe.Pointer(&emptyInfoData[0])))
+
+	if got := GetSMBIOSEntryPoint(); got != 0 {
+		t.Fatalf("expected GetSMBIOSEntryPoint() to return 0 when no SMBIOS tag is present; got 0x%x", got)
+	}
+
+	smbiosInfoData := []byte{
+		0, 0, 0, 0, // size
+		0, 0, 0, 0, // reserved
+		13, 0, 0, 0, // tag type: SMBIOS tables
+		24, 0, 0, 0, // tag size (header + 8 byte preamble + 8 bytes)
+		3, 0, 0, 0, 0, 0, 0, 0, // SMBIOS v3.0 + reserved bytes
+		'_', 'S', 'M', '3', '_', 0, 0, 0, // entry point
+		0, 0, 0, 0, // tag with type zero and length zero
+		0, 0, 0, 0,
+	}
+
+	SetInfoPtr(uintptr(unsafe.Pointer(&smbiosInfoData[0])))
+
+	if exp, got := uintptr(unsafe.Pointer(&smbiosInfoData[24])), GetSMBIOSEntryPoint(); got != exp {
+		t.Fatalf("expected GetSMBIOSEntryPoint() to return 0x%x; got 0x%x", exp, got)
+	}
+}
+
 func TestGetBootCmdLine(t *testing.T) {
 	SetInfoPtr(uintptr(unsafe.Pointer(&multibootInfoTestData[0])))
 
@@ -0,0 +1,147 @@
+package irq
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/kfmt"
+	"io"
+)
+
+const (
+	// firstIRQVector is the first vector that can be assigned a Handler.
+	// Vectors below it are reserved for CPU exceptions which are handled
+	// via HandleException and HandleExceptionWithCode.
+	firstIRQVector = 0x20
+
+	vectorCount = 256
+)
+
+// Handler is a function that services an interrupt. Vectors may be shared
+// by multiple devices so handlers must check whether their device raised
+// the interrupt and return false if it did not.
+type Handler func(vector uint8, frame *Frame, regs *Regs) bool
+
+// action describes a handler registered for a vector.
+type action struct {
+	name    string
+	handler Handler
+	handled uint64
+}
+
+// Descriptor tracks the handlers attached to an interrupt vector and the
+// number of times the vector was raised.
+type Descriptor struct {
+	actions []*action
+
+	// Count is the number of times the vector was raised.
+	Count uint64
+
+	// Unhandled is the number of times the vector was raised without any
+	// of its handlers claiming the interrupt.
+	Unhandled uint64
+}
+
+var (
+	descriptors [vectorCount]Descriptor
+
+	errInvalidVector  = &kernel.Error{Module: "irq", Message: "vector is reserved for CPU exceptions"}
+	errInvalidHandler = &kernel.Error{Module: "irq", Message: "handler name and function must be specified"}
+	errHandlerExists  = &kernel.Error{Module: "irq", Message: "a handler with the same name is already attached to the vector"}
+	errNoSuchHandler  = &kernel.Error{Module: "irq", Message: "no handler with the supplied name is attached to the vector"}
+)
+
+// RequestIRQ attaches a named handler to an interrupt vector. Multiple
+// handlers can be attached to the same vector; they are invoked in the
+// order they were attached whenever the vector is raised.
+func RequestIRQ(vector uint8, name string, handler Handler) *kernel.Error {
+	if vector < firstIRQVector {
+		return errInvalidVector
+	}
+
+	if name == "" || handler == nil {
+		return errInvalidHandler
+	}
+
+	desc := &descriptors[vector]
+	for _, act := range desc.actions {
+		if act.name == name {
+			return errHandlerExists
+		}
+	}
+
+	desc.actions = append(desc.actions, &action{name: name, handler: handler})
+	return nil
+}
+
+// FreeIRQ detaches the handler with the supplied name from an interrupt
+// vector.
+func FreeIRQ(vector uint8, name string) *kernel.Error {
+	desc := &descriptors[vector]
+	for index, act := range desc.actions {
+		if act.name != name {
+			continue
+		}
+
+		// Build a new slice so that a Dispatch call that is iterating
+		// the old one is not affected.
+		actions := make([]*action, 0, len(desc.actions)-1)
+		actions = append(actions, desc.actions[:index]...)
+		desc.actions = append(actions, desc.actions[index+1:]...)
+		return nil
+	}
+
+	return errNoSuchHandler
+}
+
+// Dispatch updates the statistics for vector and invokes all handlers
+// attached to it. It is invoked by the interrupt gate entries installed by
+// Init for vectors that are not used by CPU exceptions. Dispatch does not
+// signal the end of the interrupt to the interrupt controller; handlers of
+// interrupts raised via the local APIC must invoke lapic.EOI.
+func Dispatch(vector uint8, frame *Frame, regs *Regs) {
+	desc := &descriptors[vector]
+	desc.Count++
+
+	handled := false
+	for _, act := range desc.actions {
+		if act.handler(vector, frame, regs) {
+			act.handled++
+			handled = true
+		}
+	}
+
+	if !handled {
+		desc.Unhandled++
+	}
+}
+
+// Stats returns the descriptor for the supplied vector.
+func Stats(vector uint8) Descriptor {
+	return descriptors[vector]
+}
+
+// PrintStats writes a listing of the vectors that have attached handlers or
+// have been raised at least once to w. For each vector, the listing includes
+// the number of times it was raised, the number of times none of its
+// handlers claimed the interrupt and, for each attached handler, the number
+// of interrupts it claimed.
+func PrintStats(w io.Writer) {
+	kfmt.Fprintf(w, "VECTOR      COUNT  UNHANDLED  HANDLERS\n")
+	for vector := firstIRQVector; vector < vectorCount; vector++ {
+		desc := &descriptors[vector]
+		if len(desc.actions) == 0 && desc.Count == 0 {
+			continue
+		}
+
+		kfmt.Fprintf(w, "  0x%2x %10d %10d  ", vector, desc.Count, desc.Unhandled)
+		if len(desc.actions) == 0 {
+			kfmt.Fprintf(w, "-")
+		}
+		for index, act := range desc.actions {
+			if index != 0 {
+				kfmt.Fprintf(w, ", ")
+			}
+			kfmt.Fprintf(w, "%s(%d)", act.name, act.handled)
+		}
+		kfmt.Fprintf(w, "\n")
+	}
+}
@@ -0,0 +1,96 @@
+package irq
+
+import (
+	"bytes"
+	"gopheros/kernel"
+	"testing"
+)
+
+func TestIRQDescriptors(t *testing.T) {
+	defer func() {
+		descriptors = [vectorCount]Descriptor{}
+	}()
+
+	var (
+		calls   []string
+		pending = map[string]bool{}
+	)
+
+	handlerFor := func(name string) Handler {
+		return func(_ uint8, _ *Frame, _ *Regs) bool {
+			calls = append(calls, name)
+			claimed := pending[name]
+			pending[name] = false
+			return claimed
+		}
+	}
+
+	specs := []struct {
+		vector  uint8
+		name    string
+		handler Handler
+		expErr  *kernel.Error
+	}{
+		{0x30, "e1000", handlerFor("e1000"), nil},
+		{0x30, "ahci", handlerFor("ahci"), nil},
+		{0x31, "serial", handlerFor("serial"), nil},
+		{0x30, "e1000", handlerFor("e1000"), errHandlerExists},
+		{0x0e, "bad", handlerFor("bad"), errInvalidVector},
+		{0x30, "", handlerFor("anon"), errInvalidHandler},
+		{0x30, "nil", nil, errInvalidHandler},
+	}
+
+	for specIndex, spec := range specs {
+		if err := RequestIRQ(spec.vector, spec.name, spec.handler); err != spec.expErr {
+			t.Errorf("[spec %d] expected error %v; got %v", specIndex, spec.expErr, err)
+		}
+	}
+
+	// Both handlers of a shared vector are invoked even if the first one
+	// claims the interrupt.
+	pending["e1000"] = true
+	Dispatch(0x30, nil, nil)
+	pending["ahci"] = true
+	Dispatch(0x30, nil, nil)
+	Dispatch(0x30, nil, nil)
+	Dispatch(0x40, nil, nil)
+
+	expCalls := []string{"e1000", "ahci", "e1000", "ahci", "e1000", "ahci"}
+	if len(calls) != len(expCalls) {
+		t.Fatalf("expected handler calls %v; got %v", expCalls, calls)
+	}
+	for index := range expCalls {
+		if calls[index] != expCalls[index] {
+			t.Fatalf("expected handler calls %v; got %v", expCalls, calls)
+		}
+	}
+
+	if desc := Stats(0x30); desc.Count != 3 || desc.Unhandled != 1 {
+		t.Fatalf("expected vector 0x30 to be raised 3 times (1 unhandled); got %d (%d unhandled)", desc.Count, desc.Unhandled)
+	}
+
+	var buf bytes.Buffer
+	PrintStats(&buf)
+
+	exp := "VECTOR      COUNT  UNHANDLED  HANDLERS\n" +
+		"  0x30          3          1  e1000(1), ahci(1)\n" +
+		"  0x31          0          0  serial(0)\n" +
+		"  0x40          1          1  -\n"
+	if got := buf.String(); got != exp {
+		t.Fatalf("expected output to be:\n%q\ngot:\n%q", exp, got)
+	}
+
+	if err := FreeIRQ(0x30, "e1000"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := FreeIRQ(0x30, "e1000"); err != errNoSuchHandler {
+		t.Fatalf("expected error %v; got %v", errNoSuchHandler, err)
+	}
+
+	calls = nil
+	Dispatch(0x30, nil, nil)
+	if len(calls) != 1 || calls[0] != "ahci" {
+		t.Fatalf("expected only the ahci handler to be invoked; got %v", calls)
+	}
+}
@@ -6,6 +6,10 @@ package irq
 type ExceptionNum uint8
 
 const (
+	// NMI is raised when a non-maskable interrupt is delivered to the CPU,
+	// e.g. due to a hardware error or a watchdog.
+	NMI = ExceptionNum(2)
+
 	// DoubleFault occurs when an exception is unhandled
 	// or when an exception occurs while the CPU is
 	// trying to call an exception handler.
@@ -18,6 +22,10 @@ const (
 	// PDT-entry is not present or when a privilege
 	// and/or RW protection check fails.
 	PageFaultException = ExceptionNum(14)
+
+	// MachineCheck is raised when the CPU detects an internal or bus
+	// error that it could not correct.
+	MachineCheck = ExceptionNum(18)
 )
 
 // ExceptionHandler is a function that handles an exception that does not push
@@ -39,3 +47,28 @@ func HandleException(exceptionNum ExceptionNum, handler ExceptionHandler)
 // HandleExceptionWithCode registers an exception handler (with an error code)
 // for the given interrupt number.
 func HandleExceptionWithCode(exceptionNum ExceptionNum, handler ExceptionHandlerWithCode)
+
+// SetIST configures the IDT entry for the given interrupt number to switch to
+// the stack at the supplied index (1-7) of the interrupt stack table before
+// invoking the handler. An index of 0 disables the stack switch.
+func SetIST(exceptionNum ExceptionNum, ist uint8)
+
+// handleExceptionWithCodeFn is used by tests to mock calls to
+// HandleExceptionWithCode.
+var handleExceptionWithCodeFn = HandleExceptionWithCode
+
+// Init installs the gate handler for all vectors that are not reserved for
+// CPU exceptions. The gate entries for these vectors push the vector number
+// in place of an exception code and the gate handler forwards the interrupt
+// to Dispatch.
+func Init() {
+	for vector := firstIRQVector; vector < vectorCount; vector++ {
+		handleExceptionWithCodeFn(ExceptionNum(vector), dispatchGate)
+	}
+}
+
+// dispatchGate is invoked by the gate entries for the vectors that are not
+// reserved for CPU exceptions.
+func dispatchGate(vector uint64, frame *Frame, regs *Regs) {
+	Dispatch(uint8(vector), frame, regs)
+}
@@ -34,3 +34,16 @@ TEXT ·HandleExceptionWithCode(SB),NOSPLIT,$0
 	                   // see: http://wiki.osdev.org/Interrupt_Descriptor_Table
 
 	RET
+
+TEXT ·SetIST(SB),NOSPLIT,$0
+	MOVQ IDTR, _rt0_idtr<>+0(SB)
+	LEAQ _rt0_idtr<>(SB), CX
+	MOVQ 2(CX), CX     // CX points to IDT base address
+	MOVBQZX exceptionNum+0(FP), AX
+	SHLQ $4, AX
+	ADDQ AX, CX        // CX points to the IDT entry
+
+	MOVB ist+1(FP), AX
+	ANDB $7, AX
+	MOVB AX, 4(CX)     // bits 0-2 of the 5th byte select the IST stack
+	RET
@@ -0,0 +1,59 @@
+package irq
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestInit(t *testing.T) {
+	defer func() {
+		handleExceptionWithCodeFn = HandleExceptionWithCode
+		descriptors = [vectorCount]Descriptor{}
+	}()
+
+	var (
+		installed []ExceptionNum
+		gate      ExceptionHandlerWithCode
+	)
+
+	handleExceptionWithCodeFn = func(num ExceptionNum, handler ExceptionHandlerWithCode) {
+		installed = append(installed, num)
+		gate = handler
+	}
+
+	Init()
+
+	if exp := vectorCount - firstIRQVector; len(installed) != exp {
+		t.Fatalf("expected a gate handler to be installed for %d vectors; got %d", exp, len(installed))
+	}
+
+	for index, num := range installed {
+		if exp := ExceptionNum(firstIRQVector + index); num != exp {
+			t.Fatalf("expected gate handler %d to be installed for vector %d; got %d", index, exp, num)
+		}
+	}
+
+	var (
+		frame Frame
+		regs  Regs
+		got   []interface{}
+	)
+
+	if err := RequestIRQ(0x42, "test", func(vector uint8, f *Frame, r *Regs) bool {
+		got = append(got, vector, f, r)
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The gate entries pass the vector number in place of an error code
+	gate(0x42, &frame, &regs)
+
+	if exp := []interface{}{uint8(0x42), &frame, &regs}; !reflect.DeepEqual(got, exp) {
+		t.Fatalf("expected the handler to be invoked with %v; got %v", exp, got)
+	}
+
+	if stats := Stats(0x42); stats.Count != 1 || stats.Unhandled != 0 {
+		t.Fatalf("expected vector 0x42 to be raised once; got count %d, unhandled %d", stats.Count, stats.Unhandled)
+	}
+}
@@ -0,0 +1,94 @@
+package irq
+
+import "gopheros/kernel"
+
+const (
+	// FirstDeviceVector is the first IDT vector that can be allocated to
+	// a device. Vectors 0-31 are reserved for exceptions and vectors
+	// 32-47 are reserved for the remapped legacy PIC IRQs.
+	FirstDeviceVector = 0x30
+
+	// LastDeviceVector is the last IDT vector that can be allocated to a
+	// device. Vectors above it are reserved for IPIs, the local APIC
+	// timer and the spurious interrupt vector.
+	LastDeviceVector = 0xef
+
+	// MaxVectorBlock is the max number of vectors that can be allocated
+	// with a single call to AllocVectors. It matches the max number of
+	// messages that can be enabled for a PCI MSI capability.
+	MaxVectorBlock = 32
+
+	// maxCPUs defines the max number of CPUs whose vectors can be
+	// allocated. It matches percpu.MaxCPUs; the percpu package cannot be
+	// imported here as it depends on the vmm package which in turn
+	// depends on this package.
+	maxCPUs = 64
+)
+
+var (
+	// allocatedVectors is a bitmap that tracks the vectors allocated on
+	// each CPU.
+	allocatedVectors [maxCPUs][256 / 64]uint64
+
+	errInvalidCPU         = &kernel.Error{Module: "irq", Message: "invalid CPU index"}
+	errInvalidVectorCount = &kernel.Error{Module: "irq", Message: "vector count must be a power of 2 between 1 and 32"}
+	errNoFreeVectors      = &kernel.Error{Module: "irq", Message: "not enough free vectors"}
+)
+
+// AllocVectors reserves a block of count contiguous IDT vectors on the
+// CPU with the supplied index and returns the first vector in the block.
+// The count must be a power of 2 and the returned vector is aligned to
+// count as required for PCI devices with multiple MSI messages.
+func AllocVectors(cpuIndex uint32, count uint8) (uint8, *kernel.Error) {
+	if cpuIndex >= maxCPUs {
+		return 0, errInvalidCPU
+	}
+
+	if count == 0 || count > MaxVectorBlock || count&(count-1) != 0 {
+		return 0, errInvalidVectorCount
+	}
+
+	bitmap := &allocatedVectors[cpuIndex]
+	first := (uint32(FirstDeviceVector) + uint32(count) - 1) &^ (uint32(count) - 1)
+	for base := first; base+uint32(count)-1 <= LastDeviceVector; base += uint32(count) {
+		if vectorsFree(bitmap, base, uint32(count)) {
+			setVectors(bitmap, base, uint32(count), true)
+			return uint8(base), nil
+		}
+	}
+
+	return 0, errNoFreeVectors
+}
+
+// FreeVectors releases a block of vectors previously reserved via a call to
+// AllocVectors.
+func FreeVectors(cpuIndex uint32, base, count uint8) {
+	if cpuIndex >= maxCPUs {
+		return
+	}
+
+	setVectors(&allocatedVectors[cpuIndex], uint32(base), uint32(count), false)
+}
+
+// vectorsFree returns true if none of the vectors in the supplied range are
+// marked as allocated.
+func vectorsFree(bitmap *[256 / 64]uint64, base, count uint32) bool {
+	for vec := base; vec < base+count; vec++ {
+		if bitmap[vec>>6]&(1<<(vec&63)) != 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// setVectors marks the vectors in the supplied range as allocated or free.
+func setVectors(bitmap *[256 / 64]uint64, base, count uint32, allocated bool) {
+	for vec := base; vec < base+count && vec < 256; vec++ {
+		if allocated {
+			bitmap[vec>>6] |= 1 << (vec & 63)
+		} else {
+			bitmap[vec>>6] &^= 1 << (vec & 63)
+		}
+	}
+}
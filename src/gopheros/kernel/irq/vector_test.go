@@ -0,0 +1,69 @@
+package irq
+
+import "testing"
+
+func TestAllocVectors(t *testing.T) {
+	defer func() {
+		allocatedVectors = [maxCPUs][256 / 64]uint64{}
+	}()
+
+	specs := []struct {
+		cpuIndex uint32
+		count    uint8
+		expBase  uint8
+		expErr   bool
+	}{
+		{0, 1, 0x30, false},
+		{0, 4, 0x34, false},
+		{0, 1, 0x31, false},
+		{0, 32, 0x40, false},
+		{0, 2, 0x32, false},
+		// Vectors are allocated independently for each CPU
+		{1, 32, 0x40, false},
+		{1, 16, 0x30, false},
+		{maxCPUs, 1, 0, true},
+		{0, 0, 0, true},
+		{0, 3, 0, true},
+		{0, 64, 0, true},
+	}
+
+	for specIndex, spec := range specs {
+		base, err := AllocVectors(spec.cpuIndex, spec.count)
+		if spec.expErr {
+			if err == nil {
+				t.Errorf("[spec %d] expected to get an error", specIndex)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("[spec %d] unexpected error: %v", specIndex, err)
+			continue
+		}
+
+		if base != spec.expBase {
+			t.Errorf("[spec %d] expected base vector 0x%x; got 0x%x", specIndex, spec.expBase, base)
+		}
+	}
+
+	// Exhaust the vectors of CPU 2
+	for {
+		if _, err := AllocVectors(2, 1); err != nil {
+			if err != errNoFreeVectors {
+				t.Fatalf("expected error %v; got %v", errNoFreeVectors, err)
+			}
+			break
+		}
+	}
+
+	// Freeing a block makes it available for allocation
+	FreeVectors(2, 0x80, 8)
+	FreeVectors(maxCPUs, 0x80, 8)
+	if base, err := AllocVectors(2, 8); err != nil || base != 0x80 {
+		t.Fatalf("expected to allocate the freed block at 0x80; got 0x%x, %v", base, err)
+	}
+
+	if _, err := AllocVectors(2, 1); err != errNoFreeVectors {
+		t.Fatalf("expected error %v; got %v", errNoFreeVectors, err)
+	}
+}
@@ -5,9 +5,15 @@ import (
 	"gopheros/kernel/goruntime"
 	"gopheros/kernel/hal"
 	"gopheros/kernel/hal/multiboot"
+	"gopheros/kernel/irq"
 	"gopheros/kernel/kfmt"
+	"gopheros/kernel/mce"
+	"gopheros/kernel/mem"
+	"gopheros/kernel/mem/percpu"
 	"gopheros/kernel/mem/pmm/allocator"
 	"gopheros/kernel/mem/vmm"
+	"gopheros/kernel/nmi"
+	"gopheros/kernel/time"
 )
 
 var (
@@ -37,6 +43,26 @@ func Kmain(multibootInfoPtr, kernelStart, kernelEnd, kernelPageOffset uintptr) {
 		panic(err)
 	} else if err = goruntime.Init(); err != nil {
 		panic(err)
+	} else if err = vmm.ProtectKernelImage(); err != nil {
+		panic(err)
+	} else if err = percpu.Init(1); err != nil {
+		panic(err)
+	} else if err = time.Init(); err != nil {
+		panic(err)
+	}
+
+	// Route the vectors that are not reserved for CPU exceptions to the
+	// handlers registered via irq.RequestIRQ
+	irq.Init()
+
+	// Enable machine checks before probing hardware so that hardware
+	// errors are reported instead of shutting down the CPU
+	mce.Init()
+
+	// Poisoning relies on the runtime for locating the callers of the
+	// allocator so it can only be enabled once the runtime is initialized
+	if mem.PoisonEnabled {
+		allocator.EnablePoisoning()
 	}
 
 	// After goruntime.Init returns we can safely use defer
@@ -48,4 +74,7 @@ func Kmain(multibootInfoPtr, kernelStart, kernelEnd, kernelPageOffset uintptr) {
 
 	// Detect and initialize hardware
 	hal.DetectHardware()
+
+	// The NMI watchdog depends on the local APIC driver
+	nmi.Init()
 }
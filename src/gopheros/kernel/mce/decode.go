@@ -0,0 +1,50 @@
+package mce
+
+const (
+	// Compound error codes may set the correction report filtering bit
+	// which does not affect their interpretation.
+	errCodeFilter = 1 << 12
+)
+
+// decodeErrorCode returns a description of the architectural MCA error
+// code stored in the low 16 bits of an MCi_STATUS register.
+func decodeErrorCode(code uint16) string {
+	switch code {
+	case 0x0000:
+		return "no error"
+	case 0x0001:
+		return "unclassified error"
+	case 0x0002:
+		return "microcode ROM parity error"
+	case 0x0003:
+		return "external error"
+	case 0x0004:
+		return "FRC error"
+	case 0x0005:
+		return "internal parity error"
+	case 0x0006:
+		return "SMM handler code access violation"
+	case 0x0400:
+		return "internal timer error"
+	case 0x0e0b:
+		return "I/O error"
+	}
+
+	if code&0xfc00 == 0x0400 {
+		return "internal unclassified error"
+	}
+
+	code &^= errCodeFilter
+	switch {
+	case code&0xf800 == 0x0800:
+		return "bus/interconnect error"
+	case code&0xff00 == 0x0100:
+		return "cache hierarchy error"
+	case code&0xff80 == 0x0080:
+		return "memory controller error"
+	case code&0xfff0 == 0x0010:
+		return "TLB error"
+	default:
+		return "unknown error"
+	}
+}
@@ -0,0 +1,33 @@
+package mce
+
+import "testing"
+
+func TestDecodeErrorCode(t *testing.T) {
+	specs := []struct {
+		code uint16
+		exp  string
+	}{
+		{0x0000, "no error"},
+		{0x0001, "unclassified error"},
+		{0x0002, "microcode ROM parity error"},
+		{0x0003, "external error"},
+		{0x0004, "FRC error"},
+		{0x0005, "internal parity error"},
+		{0x0006, "SMM handler code access violation"},
+		{0x0400, "internal timer error"},
+		{0x0e0b, "I/O error"},
+		{0x0401, "internal unclassified error"},
+		{0x0e0f, "bus/interconnect error"},
+		{0x0151, "cache hierarchy error"},
+		{0x1151, "cache hierarchy error"},
+		{0x009f, "memory controller error"},
+		{0x0014, "TLB error"},
+		{0x0007, "unknown error"},
+	}
+
+	for specIndex, spec := range specs {
+		if got := decodeErrorCode(spec.code); got != spec.exp {
+			t.Errorf("[spec %d] expected code 0x%x to decode to %q; got %q", specIndex, spec.code, spec.exp, got)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+// Package mce handles machine-check exceptions.
+//
+// The machine-check architecture reports hardware errors (e.g. ECC errors
+// in memory or caches and bus errors) via a set of error-reporting banks.
+// Errors that the hardware corrected are logged silently in the banks
+// while uncorrected errors also raise a machine-check exception (#MC). If
+// machine-check exceptions are not enabled via CR4.MCE, the CPU shuts down
+// when an uncorrected error is detected.
+package mce
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/irq"
+	"gopheros/kernel/kfmt"
+)
+
+const (
+	cr4MCE = 1 << 6
+
+	msrMCGCap    = 0x179
+	msrMCGStatus = 0x17a
+	msrMCGCtl    = 0x17b
+
+	// Each bank is controlled by 4 consecutive MSRs starting at
+	// msrMC0Ctl + 4 * bank.
+	msrMC0Ctl    = 0x400
+	msrMC0Status = 0x401
+	msrMC0Addr   = 0x402
+	msrMC0Misc   = 0x403
+
+	mcgCapCountMask = 0xff
+	mcgCapCtlP      = 1 << 8
+
+	mcgStatusRIPV = 1 << 0
+	mcgStatusMCIP = 1 << 2
+
+	statusVal   = 1 << 63
+	statusOver  = 1 << 62
+	statusUC    = 1 << 61
+	statusMiscV = 1 << 59
+	statusAddrV = 1 << 58
+	statusPCC   = 1 << 57
+)
+
+var (
+	// bankCount is the number of error-reporting banks supported by the
+	// CPU or zero if machine checks are not enabled.
+	bankCount uint32
+
+	// correctedCount tracks the number of corrected errors that have
+	// been logged.
+	correctedCount uint64
+
+	// The following functions are used by tests to mock calls to the cpu
+	// and irq packages.
+	hasMCAFn          = cpu.HasMCA
+	isIntelFn         = cpu.IsIntel
+	cpuidFn           = cpu.ID
+	readCR4Fn         = cpu.ReadCR4
+	writeCR4Fn        = cpu.WriteCR4
+	readMSRFn         = cpu.ReadMSR
+	writeMSRFn        = cpu.WriteMSR
+	handleExceptionFn = irq.HandleException
+
+	errMachineCheck = &kernel.Error{Module: "mce", Message: "uncorrected machine check"}
+)
+
+// Init enables machine-check exceptions. It logs and clears any errors
+// that the error-reporting banks retained across the last reset, enables
+// error reporting for all banks, installs the #MC handler and finally sets
+// CR4.MCE. Init does nothing if the CPU does not support the machine-check
+// architecture.
+func Init() {
+	if !hasMCAFn() {
+		kfmt.Printf("[mce] machine-check architecture not supported\n")
+		return
+	}
+
+	mcgCap := readMSRFn(msrMCGCap)
+	bankCount = uint32(mcgCap & mcgCapCountMask)
+
+	// Report the errors that the banks retained across the last reset
+	logBanks(true)
+
+	if mcgCap&mcgCapCtlP != 0 {
+		writeMSRFn(msrMCGCtl, ^uint64(0))
+	}
+
+	for bank := uint32(0); bank < bankCount; bank++ {
+		// On older Intel P6 family CPUs, MC0_CTL is owned by the
+		// firmware and must not be modified.
+		if bank != 0 || !skipBank0Ctl() {
+			writeMSRFn(msrMC0Ctl+4*bank, ^uint64(0))
+		}
+		writeMSRFn(msrMC0Status+4*bank, 0)
+	}
+
+	handleExceptionFn(irq.MachineCheck, machineCheckHandler)
+	writeCR4Fn(readCR4Fn() | cr4MCE)
+
+	kfmt.Printf("[mce] machine checks enabled (%d banks)\n", bankCount)
+}
+
+// Poll logs and clears any errors that have been recorded by the
+// error-reporting banks since the last call to Poll. Corrected errors do
+// not raise a machine-check exception so Poll should be invoked
+// periodically.
+func Poll() {
+	logBanks(true)
+}
+
+// CorrectedCount returns the number of corrected errors that have been
+// logged.
+func CorrectedCount() uint64 {
+	return correctedCount
+}
+
+// machineCheckHandler logs the contents of all error-reporting banks that
+// contain a valid error. If any of the errors is uncorrected or the
+// interrupted code cannot be safely restarted, the handler halts the
+// system.
+func machineCheckHandler(frame *irq.Frame, regs *irq.Regs) {
+	mcgStatus := readMSRFn(msrMCGStatus)
+	kfmt.Printf("\nMachine check exception (MCG_STATUS: 0x%x)\n", mcgStatus)
+
+	fatal := logBanks(false)
+	if mcgStatus&mcgStatusRIPV == 0 {
+		fatal = true
+		kfmt.Printf("[mce] interrupted code cannot be restarted\n")
+	}
+
+	if fatal {
+		kfmt.Printf("Registers:\n")
+		regs.Print()
+		frame.Print()
+
+		panic(errMachineCheck)
+	}
+
+	// Another machine check that occurs while MCIP is set causes the CPU
+	// to shut down.
+	writeMSRFn(msrMCGStatus, mcgStatus&^mcgStatusMCIP)
+}
+
+// logBanks logs the errors recorded by the error-reporting banks and
+// returns true if any of them is uncorrected. Corrected errors are always
+// cleared; uncorrected errors are only cleared if clearUncorrected is true.
+// The #MC handler leaves them in place when it halts the system so that
+// the firmware can retrieve them after the next reset.
+func logBanks(clearUncorrected bool) bool {
+	var uncorrected bool
+
+	for bank := uint32(0); bank < bankCount; bank++ {
+		status := readMSRFn(msrMC0Status + 4*bank)
+		if status&statusVal == 0 {
+			continue
+		}
+
+		logBank(bank, status)
+
+		if status&(statusUC|statusPCC) != 0 {
+			uncorrected = true
+			if !clearUncorrected {
+				continue
+			}
+		} else {
+			correctedCount++
+		}
+
+		writeMSRFn(msrMC0Status+4*bank, 0)
+	}
+
+	return uncorrected
+}
+
+// logBank prints the decoded contents of an error-reporting bank.
+func logBank(bank uint32, status uint64) {
+	kind := "corrected"
+	if status&statusUC != 0 {
+		kind = "uncorrected"
+	}
+
+	kfmt.Printf("[mce] bank %d: %s error: %s (status: 0x%16x)\n", bank, kind, decodeErrorCode(uint16(status)), status)
+
+	if status&statusOver != 0 {
+		kfmt.Printf("[mce] bank %d: previous errors were overwritten\n", bank)
+	}
+
+	if status&statusPCC != 0 {
+		kfmt.Printf("[mce] bank %d: processor context corrupt\n", bank)
+	}
+
+	if status&statusAddrV != 0 {
+		kfmt.Printf("[mce] bank %d: address: 0x%16x\n", bank, readMSRFn(msrMC0Addr+4*bank))
+	}
+
+	if status&statusMiscV != 0 {
+		kfmt.Printf("[mce] bank %d: misc: 0x%16x\n", bank, readMSRFn(msrMC0Misc+4*bank))
+	}
+}
+
+// skipBank0Ctl returns true if the CPU is an Intel P6 family CPU with a
+// model number below 0x1a.
+func skipBank0Ctl() bool {
+	if !isIntelFn() {
+		return false
+	}
+
+	eax, _, _, _ := cpuidFn(1)
+	family := (eax >> 8) & 0xf
+	model := (eax>>4)&0xf | (eax>>12)&0xf0
+	return family == 6 && model < 0x1a
+}
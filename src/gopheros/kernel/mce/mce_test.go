@@ -0,0 +1,239 @@
+package mce
+
+import (
+	"bytes"
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/irq"
+	"gopheros/kernel/kfmt"
+	"strings"
+	"testing"
+)
+
+func TestInitUnsupported(t *testing.T) {
+	defer resetState()
+
+	var buf bytes.Buffer
+	kfmt.SetOutputSink(&buf)
+	defer kfmt.SetOutputSink(nil)
+
+	hasMCAFn = func() bool { return false }
+	handleExceptionFn = func(_ irq.ExceptionNum, _ irq.ExceptionHandler) {
+		t.Fatal("unexpected call to HandleException")
+	}
+
+	Init()
+
+	if exp := "[mce] machine-check architecture not supported\n"; buf.String() != exp {
+		t.Fatalf("expected output to be %q; got %q", exp, buf.String())
+	}
+}
+
+func TestInit(t *testing.T) {
+	defer resetState()
+
+	var buf bytes.Buffer
+	kfmt.SetOutputSink(&buf)
+	defer kfmt.SetOutputSink(nil)
+
+	specs := []struct {
+		mcgCap    uint64
+		intel     bool
+		signature uint32
+		expMCGCtl bool
+		expMC0Ctl bool
+		expBanks  string
+	}{
+		// Intel P6 family CPU (model 0xf) with MCG_CTL
+		{mcgCapCtlP | 3, true, 0x6f0, true, false, "(3 banks)"},
+		// Intel CPU with a model number that uses the extended model field
+		{mcgCapCtlP | 3, true, 0x106a0, true, true, "(3 banks)"},
+		// Non-Intel CPU without MCG_CTL
+		{2, false, 0x6f0, false, true, "(2 banks)"},
+	}
+
+	for specIndex, spec := range specs {
+		var (
+			handler irq.ExceptionHandler
+			cr4     uint64 = 1 << 5
+		)
+
+		resetState()
+		msrs := mockMSRs(map[uint32]uint64{
+			msrMCGCap: spec.mcgCap,
+			// An error retained across the last reset
+			msrMC0Status + 4: statusVal | statusUC | 0x0151,
+		})
+		hasMCAFn = func() bool { return true }
+		isIntelFn = func() bool { return spec.intel }
+		cpuidFn = func(_ uint32) (uint32, uint32, uint32, uint32) { return spec.signature, 0, 0, 0 }
+		readCR4Fn = func() uint64 { return cr4 }
+		writeCR4Fn = func(val uint64) { cr4 = val }
+		handleExceptionFn = func(num irq.ExceptionNum, fn irq.ExceptionHandler) {
+			if num != irq.MachineCheck {
+				t.Errorf("[spec %d] expected handler to be installed for exception %d; got %d", specIndex, irq.MachineCheck, num)
+			}
+			handler = fn
+		}
+
+		buf.Reset()
+		Init()
+
+		if handler == nil {
+			t.Errorf("[spec %d] expected the #MC handler to be installed", specIndex)
+		}
+
+		if cr4 != 1<<5|cr4MCE {
+			t.Errorf("[spec %d] expected CR4.MCE to be set; CR4 = 0x%x", specIndex, cr4)
+		}
+
+		if _, set := msrs[msrMCGCtl]; set != spec.expMCGCtl {
+			t.Errorf("[spec %d] expected MCG_CTL to be written: %t", specIndex, spec.expMCGCtl)
+		}
+
+		if _, set := msrs[msrMC0Ctl]; set != spec.expMC0Ctl {
+			t.Errorf("[spec %d] expected MC0_CTL to be written: %t", specIndex, spec.expMC0Ctl)
+		}
+
+		for bank := uint32(1); bank < bankCount; bank++ {
+			if got := msrs[msrMC0Ctl+4*bank]; got != ^uint64(0) {
+				t.Errorf("[spec %d] expected MC%d_CTL to enable all errors; got 0x%x", specIndex, bank, got)
+			}
+
+			if got := msrs[msrMC0Status+4*bank]; got != 0 {
+				t.Errorf("[spec %d] expected MC%d_STATUS to be cleared; got 0x%x", specIndex, bank, got)
+			}
+		}
+
+		for _, exp := range []string{"[mce] bank 1: uncorrected error: cache hierarchy error", spec.expBanks} {
+			if !strings.Contains(buf.String(), exp) {
+				t.Errorf("[spec %d] expected output to contain %q; got:\n%s", specIndex, exp, buf.String())
+			}
+		}
+	}
+}
+
+func TestPoll(t *testing.T) {
+	defer resetState()
+
+	var buf bytes.Buffer
+	kfmt.SetOutputSink(&buf)
+	defer kfmt.SetOutputSink(nil)
+
+	bankCount = 3
+	msrs := mockMSRs(map[uint32]uint64{
+		msrMC0Status:     statusVal | statusOver | statusAddrV | statusMiscV | 0x009f,
+		msrMC0Addr:       0x12345000,
+		msrMC0Misc:       0x86,
+		msrMC0Status + 8: statusVal | 0x0014,
+	})
+
+	Poll()
+
+	if got := CorrectedCount(); got != 2 {
+		t.Fatalf("expected 2 corrected errors to be logged; got %d", got)
+	}
+
+	if msrs[msrMC0Status] != 0 || msrs[msrMC0Status+8] != 0 {
+		t.Fatal("expected the status of the banks with logged errors to be cleared")
+	}
+
+	exp := "[mce] bank 0: corrected error: memory controller error (status: 0xcc0000000000009f)\n" +
+		"[mce] bank 0: previous errors were overwritten\n" +
+		"[mce] bank 0: address: 0x0000000012345000\n" +
+		"[mce] bank 0: misc: 0x0000000000000086\n" +
+		"[mce] bank 2: corrected error: TLB error (status: 0x8000000000000014)\n"
+	if buf.String() != exp {
+		t.Fatalf("expected output to be:\n%q\ngot:\n%q", exp, buf.String())
+	}
+
+	// Banks without a valid error are left untouched
+	buf.Reset()
+	Poll()
+	if buf.Len() != 0 || CorrectedCount() != 2 {
+		t.Fatalf("expected no errors to be logged; got %q", buf.String())
+	}
+}
+
+func TestMachineCheckHandler(t *testing.T) {
+	defer resetState()
+
+	var buf bytes.Buffer
+	kfmt.SetOutputSink(&buf)
+	defer kfmt.SetOutputSink(nil)
+
+	specs := []struct {
+		mcgStatus  uint64
+		bankStatus uint64
+		expFatal   bool
+		expOutput  string
+	}{
+		// Corrected error with a restartable context
+		{mcgStatusMCIP | mcgStatusRIPV, statusVal | 0x0e0b, false, "[mce] bank 1: corrected error: I/O error"},
+		// Processor context corrupt
+		{mcgStatusMCIP | mcgStatusRIPV, statusVal | statusPCC | 0x0005, true, "[mce] bank 1: processor context corrupt"},
+		// Uncorrected error
+		{mcgStatusMCIP | mcgStatusRIPV, statusVal | statusUC | 0x0e0f, true, "[mce] bank 1: uncorrected error: bus/interconnect error"},
+		// The interrupted code cannot be restarted
+		{mcgStatusMCIP, 0, true, "[mce] interrupted code cannot be restarted"},
+	}
+
+	for specIndex, spec := range specs {
+		bankCount = 2
+		msrs := mockMSRs(map[uint32]uint64{
+			msrMCGStatus:     spec.mcgStatus,
+			msrMC0Status + 4: spec.bankStatus,
+		})
+
+		buf.Reset()
+		func() {
+			defer func() {
+				err := recover()
+				if spec.expFatal && err != errMachineCheck {
+					t.Errorf("[spec %d] expected a panic with %v; got %v", specIndex, errMachineCheck, err)
+				} else if !spec.expFatal && err != nil {
+					t.Errorf("[spec %d] unexpected panic: %v", specIndex, err)
+				}
+			}()
+
+			machineCheckHandler(&irq.Frame{}, &irq.Regs{})
+		}()
+
+		if !strings.Contains(buf.String(), spec.expOutput) {
+			t.Errorf("[spec %d] expected output to contain %q; got:\n%s", specIndex, spec.expOutput, buf.String())
+		}
+
+		if spec.expFatal {
+			// Uncorrected errors are preserved for the firmware
+			if got := msrs[msrMC0Status+4]; got != spec.bankStatus {
+				t.Errorf("[spec %d] expected MC1_STATUS to be preserved; got 0x%x", specIndex, got)
+			}
+			continue
+		}
+
+		if got := msrs[msrMCGStatus]; got != mcgStatusRIPV {
+			t.Errorf("[spec %d] expected MCG_STATUS.MCIP to be cleared; got 0x%x", specIndex, got)
+		}
+	}
+}
+
+// mockMSRs replaces the MSR accessors with a fake implementation backed by a
+// map that is initialized with the supplied values.
+func mockMSRs(values map[uint32]uint64) map[uint32]uint64 {
+	readMSRFn = func(reg uint32) uint64 { return values[reg] }
+	writeMSRFn = func(reg uint32, val uint64) { values[reg] = val }
+	return values
+}
+
+func resetState() {
+	bankCount = 0
+	correctedCount = 0
+
+	hasMCAFn = cpu.HasMCA
+	isIntelFn = cpu.IsIntel
+	cpuidFn = cpu.ID
+	readCR4Fn = cpu.ReadCR4
+	writeCR4Fn = cpu.WriteCR4
+	readMSRFn = cpu.ReadMSR
+	writeMSRFn = cpu.WriteMSR
+	handleExceptionFn = irq.HandleException
+}
@@ -0,0 +1,141 @@
+// Package dma provides allocations of physically contiguous memory that can
+// be used as the target of DMA transfers by devices with limited addressing
+// capabilities.
+//
+// Buffers are backed by blocks of frames obtained from the buddy allocator.
+// As buddy blocks are naturally aligned to their size, a buffer never crosses
+// an address boundary that is a multiple of its (rounded up) size. Buffer
+// contents are accessed through the physmap. The bus address of a buffer is
+// its physical address as the kernel does not program any IOMMU.
+package dma
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/mem"
+	"gopheros/kernel/mem/pmm"
+	"gopheros/kernel/mem/pmm/allocator"
+	"gopheros/kernel/mem/vmm"
+)
+
+const (
+	// MaxAddr24Bit is the highest physical address that can be accessed
+	// by ISA DMA controllers.
+	MaxAddr24Bit = uintptr(1<<24 - 1)
+
+	// MaxAddr32Bit is the highest physical address that can be accessed
+	// by devices that only support 32-bit DMA.
+	MaxAddr32Bit = uintptr(1<<32 - 1)
+)
+
+var (
+	errInvalidSize      = &kernel.Error{Module: "dma", Message: "invalid allocation size"}
+	errInvalidAlignment = &kernel.Error{Module: "dma", Message: "alignment must be a power of two"}
+	errInvalidBoundary  = &kernel.Error{Module: "dma", Message: "boundary must be a power of two not smaller than the allocation size"}
+	errSizeTooLarge     = &kernel.Error{Module: "dma", Message: "allocation size exceeds the max contiguous block size"}
+	errInvalidMaxAddr   = &kernel.Error{Module: "dma", Message: "max address does not cover a full page"}
+
+	// The following functions are used by tests to mock calls to the
+	// allocator, vmm and mem packages.
+	allocFramesBelowFn = allocator.AllocFramesBelow
+	freeFramesFn       = allocator.FreeFrames
+	setOwnerFn         = allocator.SetOwner
+	physToVirtFn       = vmm.PhysToVirt
+	memsetFn           = mem.Memset
+)
+
+// Constraints describes the addressing requirements of the device that will
+// access a DMA buffer.
+type Constraints struct {
+	// MaxAddr is the highest physical address that the device can access.
+	// A zero value indicates that there is no address limit.
+	MaxAddr uintptr
+
+	// Align is the required alignment of the buffer address. It must be
+	// a power of two. A zero value defaults to page alignment.
+	Align mem.Size
+
+	// Boundary is an address boundary (e.g. 64K for ISA DMA) that the
+	// buffer must not cross. It must be a power of two. A zero value
+	// indicates that there is no boundary restriction.
+	Boundary mem.Size
+}
+
+// Buffer describes a physically contiguous memory block allocated by Alloc.
+type Buffer struct {
+	// The address that the kernel uses to access the buffer contents.
+	VirtAddr uintptr
+
+	// The address that must be programmed into the device.
+	BusAddr uintptr
+
+	// The requested buffer size.
+	Size mem.Size
+
+	// The block order that was used for allocating the backing frames.
+	order uint8
+}
+
+// Alloc allocates a zero-cleared, physically contiguous buffer with at least
+// the requested size that satisfies the supplied constraints.
+func Alloc(size mem.Size, constraints Constraints) (Buffer, *kernel.Error) {
+	if size == 0 {
+		return Buffer{}, errInvalidSize
+	}
+
+	if constraints.Align&(constraints.Align-1) != 0 {
+		return Buffer{}, errInvalidAlignment
+	}
+
+	// The backing block must be large enough to hold the buffer and
+	// be aligned to the requested alignment. Its natural alignment takes
+	// care of both requirements.
+	blockSize := size
+	if constraints.Align > blockSize {
+		blockSize = constraints.Align
+	}
+
+	order := uint8(0)
+	for ; mem.PageSize<<order < blockSize; order++ {
+		if order == allocator.MaxOrder {
+			return Buffer{}, errSizeTooLarge
+		}
+	}
+
+	if constraints.Boundary != 0 && (constraints.Boundary&(constraints.Boundary-1) != 0 || constraints.Boundary < mem.PageSize<<order) {
+		return Buffer{}, errInvalidBoundary
+	}
+
+	// Only frames that are fully addressable by the device can be used
+	maxFrame := pmm.InvalidFrame
+	if constraints.MaxAddr != 0 {
+		if constraints.MaxAddr < uintptr(mem.PageSize-1) {
+			return Buffer{}, errInvalidMaxAddr
+		}
+		maxFrame = pmm.Frame((constraints.MaxAddr - uintptr(mem.PageSize-1)) >> mem.PageShift)
+	}
+
+	frame, err := allocFramesBelowFn(order, maxFrame)
+	if err != nil {
+		return Buffer{}, err
+	}
+
+	if err = setOwnerFn(frame, order, allocator.OwnerDMA); err != nil {
+		_ = freeFramesFn(frame, order)
+		return Buffer{}, err
+	}
+
+	buf := Buffer{
+		VirtAddr: physToVirtFn(frame.Address()),
+		BusAddr:  frame.Address(),
+		Size:     size,
+		order:    order,
+	}
+
+	memsetFn(buf.VirtAddr, 0, mem.PageSize<<order)
+	return buf, nil
+}
+
+// Free releases a buffer allocated by a call to Alloc.
+func Free(buf Buffer) *kernel.Error {
+	return freeFramesFn(pmm.Frame(buf.BusAddr>>mem.PageShift), buf.order)
+}
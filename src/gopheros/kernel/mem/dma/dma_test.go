@@ -0,0 +1,164 @@
+package dma
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/mem"
+	"gopheros/kernel/mem/pmm"
+	"gopheros/kernel/mem/pmm/allocator"
+	"gopheros/kernel/mem/vmm"
+	"testing"
+)
+
+func TestAlloc(t *testing.T) {
+	defer resetMocks()
+
+	var (
+		allocOrder    uint8
+		allocMaxFrame pmm.Frame
+		memsetAddr    uintptr
+		memsetSize    mem.Size
+	)
+
+	allocFramesBelowFn = func(order uint8, maxFrame pmm.Frame) (pmm.Frame, *kernel.Error) {
+		allocOrder, allocMaxFrame = order, maxFrame
+		return pmm.Frame(0x100), nil
+	}
+	setOwnerFn = func(_ pmm.Frame, order uint8, owner allocator.FrameOwner) *kernel.Error {
+		if order != allocOrder || owner != allocator.OwnerDMA {
+			t.Errorf("expected order %d block to be tagged with owner %s; got order %d, owner %s", allocOrder, allocator.OwnerDMA, order, owner)
+		}
+		return nil
+	}
+	physToVirtFn = func(physAddr uintptr) uintptr {
+		return physAddr + 0xf000000000
+	}
+	memsetFn = func(addr uintptr, _ byte, size mem.Size) {
+		memsetAddr, memsetSize = addr, size
+	}
+
+	specs := []struct {
+		size        mem.Size
+		constraints Constraints
+		expOrder    uint8
+		expMaxFrame pmm.Frame
+	}{
+		{1, Constraints{}, 0, pmm.InvalidFrame},
+		{mem.PageSize + 1, Constraints{}, 1, pmm.InvalidFrame},
+		{mem.PageSize, Constraints{Align: 16 * mem.Kb}, 2, pmm.InvalidFrame},
+		{64 * mem.Kb, Constraints{Boundary: 64 * mem.Kb}, 4, pmm.InvalidFrame},
+		{mem.PageSize, Constraints{MaxAddr: MaxAddr32Bit}, 0, pmm.Frame(0xfffff)},
+		{mem.PageSize, Constraints{MaxAddr: MaxAddr24Bit}, 0, pmm.Frame(0xfff)},
+		// The last page below MaxAddr is only partially addressable
+		{mem.PageSize, Constraints{MaxAddr: 0x2ffe}, 0, pmm.Frame(1)},
+	}
+
+	for specIndex, spec := range specs {
+		buf, err := Alloc(spec.size, spec.constraints)
+		if err != nil {
+			t.Errorf("[spec %d] unexpected error: %v", specIndex, err)
+			continue
+		}
+
+		if allocOrder != spec.expOrder || allocMaxFrame != spec.expMaxFrame {
+			t.Errorf("[spec %d] expected a request for an order %d block below frame %d; got order %d, frame %d", specIndex, spec.expOrder, spec.expMaxFrame, allocOrder, allocMaxFrame)
+		}
+
+		if exp := uintptr(0x100000); buf.BusAddr != exp {
+			t.Errorf("[spec %d] expected bus address to be 0x%x; got 0x%x", specIndex, exp, buf.BusAddr)
+		}
+
+		if exp := uintptr(0xf000100000); buf.VirtAddr != exp {
+			t.Errorf("[spec %d] expected virtual address to be 0x%x; got 0x%x", specIndex, exp, buf.VirtAddr)
+		}
+
+		if buf.Size != spec.size {
+			t.Errorf("[spec %d] expected buffer size to be %d; got %d", specIndex, spec.size, buf.Size)
+		}
+
+		if exp := mem.PageSize << spec.expOrder; memsetAddr != buf.VirtAddr || memsetSize != exp {
+			t.Errorf("[spec %d] expected %d bytes at 0x%x to be cleared; got %d bytes at 0x%x", specIndex, exp, buf.VirtAddr, memsetSize, memsetAddr)
+		}
+	}
+}
+
+func TestAllocErrors(t *testing.T) {
+	defer resetMocks()
+
+	expErr := &kernel.Error{Module: "test", Message: "out of memory"}
+	allocFramesBelowFn = func(_ uint8, _ pmm.Frame) (pmm.Frame, *kernel.Error) {
+		return pmm.InvalidFrame, expErr
+	}
+
+	specs := []struct {
+		size        mem.Size
+		constraints Constraints
+		expErr      *kernel.Error
+	}{
+		{0, Constraints{}, errInvalidSize},
+		{mem.PageSize, Constraints{Align: 3}, errInvalidAlignment},
+		{mem.PageSize << (allocator.MaxOrder + 1), Constraints{}, errSizeTooLarge},
+		{mem.PageSize, Constraints{Boundary: 3 * mem.PageSize}, errInvalidBoundary},
+		{2 * mem.PageSize, Constraints{Boundary: mem.PageSize}, errInvalidBoundary},
+		{mem.PageSize, Constraints{MaxAddr: 0x100}, errInvalidMaxAddr},
+		{mem.PageSize, Constraints{}, expErr},
+	}
+
+	for specIndex, spec := range specs {
+		if _, err := Alloc(spec.size, spec.constraints); err != spec.expErr {
+			t.Errorf("[spec %d] expected error %v; got %v", specIndex, spec.expErr, err)
+		}
+	}
+
+	t.Run("tagging frames fails", func(t *testing.T) {
+		var freedFrame pmm.Frame
+
+		allocFramesBelowFn = func(_ uint8, _ pmm.Frame) (pmm.Frame, *kernel.Error) {
+			return pmm.Frame(0x100), nil
+		}
+		setOwnerFn = func(_ pmm.Frame, _ uint8, _ allocator.FrameOwner) *kernel.Error {
+			return expErr
+		}
+		freeFramesFn = func(frame pmm.Frame, _ uint8) *kernel.Error {
+			freedFrame = frame
+			return nil
+		}
+
+		if _, err := Alloc(mem.PageSize, Constraints{}); err != expErr {
+			t.Fatalf("expected error %v; got %v", expErr, err)
+		}
+
+		if freedFrame != pmm.Frame(0x100) {
+			t.Fatalf("expected allocated block to be released; got frame 0x%x", freedFrame)
+		}
+	})
+}
+
+func TestFree(t *testing.T) {
+	defer resetMocks()
+
+	var (
+		freedFrame pmm.Frame
+		freedOrder uint8
+	)
+
+	freeFramesFn = func(frame pmm.Frame, order uint8) *kernel.Error {
+		freedFrame, freedOrder = frame, order
+		return nil
+	}
+
+	if err := Free(Buffer{BusAddr: 0x200000, order: 3}); err != nil {
+		t.Fatal(err)
+	}
+
+	if freedFrame != pmm.Frame(0x200) || freedOrder != 3 {
+		t.Fatalf("expected order 3 block at frame 0x200 to be released; got order %d block at frame 0x%x", freedOrder, freedFrame)
+	}
+}
+
+func resetMocks() {
+	allocFramesBelowFn = allocator.AllocFramesBelow
+	freeFramesFn = allocator.FreeFrames
+	setOwnerFn = allocator.SetOwner
+	physToVirtFn = vmm.PhysToVirt
+	memsetFn = mem.Memset
+}
@@ -0,0 +1,148 @@
+// Package kheap provides a general-purpose heap for kernel code that needs
+// small dynamic allocations outside of the Go allocator (e.g. memory shared
+// with hardware or memory that must not be moved or collected).
+//
+// Small allocations are serviced by the power-of-two size caches of the slab
+// allocator. Allocations larger than slab.MaxObjectSize are backed by a
+// dedicated set of pages in the vmalloc region.
+package kheap
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/mem"
+	"gopheros/kernel/mem/slab"
+	"gopheros/kernel/mem/vmm"
+	"unsafe"
+)
+
+// largeAllocMagic is stored in the header of large allocations and allows
+// Free to detect attempts to release invalid addresses.
+const largeAllocMagic = 0x6b686561
+
+var (
+	errInvalidSize      = &kernel.Error{Module: "kheap", Message: "invalid allocation size"}
+	errInvalidAlignment = &kernel.Error{Module: "kheap", Message: "alignment must be a power of two not exceeding the page size"}
+	errInvalidAddress   = &kernel.Error{Module: "kheap", Message: "address was not allocated by the kernel heap"}
+
+	// The following functions are used by tests to mock calls to the
+	// slab and vmm packages.
+	slabAllocFn  = slab.Alloc
+	slabFreeFn   = slab.Free
+	allocPagesFn = vmm.AllocPages
+	freePagesFn  = vmm.FreePages
+	translateFn  = vmm.Translate
+	memsetFn     = mem.Memset
+)
+
+// largeAllocHeader is stored in the page that precedes the pages of a large
+// allocation.
+type largeAllocHeader struct {
+	magic uint32
+
+	// The number of pages (including the header page) that back the
+	// allocation.
+	pageCount uint32
+}
+
+// Alloc allocates a block of memory with at least the requested size and
+// returns its address. Blocks of up to slab.MaxObjectSize bytes are aligned
+// to the nearest power of two that is greater than or equal to their size.
+// Larger blocks are always page-aligned.
+func Alloc(size mem.Size) (uintptr, *kernel.Error) {
+	if size == 0 {
+		return 0, errInvalidSize
+	}
+
+	if size <= slab.MaxObjectSize {
+		return slabAllocFn(size)
+	}
+
+	return allocLarge(size)
+}
+
+// AllocZeroed behaves like Alloc but also clears the contents of the
+// allocated block.
+func AllocZeroed(size mem.Size) (uintptr, *kernel.Error) {
+	addr, err := Alloc(size)
+	if err != nil {
+		return 0, err
+	}
+
+	memsetFn(addr, 0, size)
+	return addr, nil
+}
+
+// AllocAligned allocates a block of memory with at least the requested size
+// whose address is a multiple of align. The alignment must be a power of two
+// that does not exceed the page size.
+func AllocAligned(size, align mem.Size) (uintptr, *kernel.Error) {
+	if align == 0 || align&(align-1) != 0 || align > mem.PageSize {
+		return 0, errInvalidAlignment
+	}
+
+	// As small blocks are aligned to their size class, increasing the
+	// requested size to the alignment is enough to guarantee the
+	// requested alignment.
+	if size < align {
+		size = align
+	}
+
+	return Alloc(size)
+}
+
+// Free releases a block of memory allocated via a call to Alloc,
+// AllocZeroed or AllocAligned.
+func Free(addr uintptr) *kernel.Error {
+	// Slab objects are never page-aligned as the first bytes of each slab
+	// page are occupied by the slab header.
+	if addr&uintptr(mem.PageSize-1) != 0 {
+		return slabFreeFn(addr)
+	}
+
+	return freeLarge(addr)
+}
+
+// allocLarge allocates enough pages for the requested size plus an extra
+// page for storing the allocation header. The pages are allocated from the
+// vmalloc region so their virtual addresses can be reused once the
+// allocation is released.
+func allocLarge(size mem.Size) (uintptr, *kernel.Error) {
+	pageCount := ((size + mem.PageSize - 1) >> mem.PageShift) + 1
+	if pageCount > mem.Size(^uint32(0)) {
+		return 0, errInvalidSize
+	}
+
+	regionStartAddr, err := allocPagesFn(uint32(pageCount))
+	if err != nil {
+		return 0, err
+	}
+
+	hdr := (*largeAllocHeader)(unsafe.Pointer(regionStartAddr))
+	hdr.magic = largeAllocMagic
+	hdr.pageCount = uint32(pageCount)
+
+	return regionStartAddr + uintptr(mem.PageSize), nil
+}
+
+// freeLarge releases the pages of a large allocation together with the
+// physical frames that back them.
+func freeLarge(addr uintptr) *kernel.Error {
+	if addr < uintptr(mem.PageSize) {
+		return errInvalidAddress
+	}
+
+	regionStartAddr := addr - uintptr(mem.PageSize)
+	if _, err := translateFn(regionStartAddr); err != nil {
+		return errInvalidAddress
+	}
+
+	hdr := (*largeAllocHeader)(unsafe.Pointer(regionStartAddr))
+	if hdr.magic != largeAllocMagic {
+		return errInvalidAddress
+	}
+
+	// Clear the magic value to detect double frees
+	hdr.magic = 0
+
+	return freePagesFn(regionStartAddr)
+}
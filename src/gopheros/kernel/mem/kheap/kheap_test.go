@@ -0,0 +1,285 @@
+package kheap
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/mem"
+	"gopheros/kernel/mem/pmm"
+	"gopheros/kernel/mem/slab"
+	"gopheros/kernel/mem/vmm"
+	"testing"
+	"unsafe"
+)
+
+func TestAlloc(t *testing.T) {
+	defer resetMocks()
+
+	var slabAllocSize mem.Size
+	slabAllocFn = func(size mem.Size) (uintptr, *kernel.Error) {
+		slabAllocSize = size
+		return 0xbadf00d, nil
+	}
+
+	if _, err := Alloc(0); err != errInvalidSize {
+		t.Fatalf("expected error %v; got %v", errInvalidSize, err)
+	}
+
+	addr, err := Alloc(slab.MaxObjectSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if addr != 0xbadf00d || slabAllocSize != slab.MaxObjectSize {
+		t.Fatalf("expected allocation to be serviced by the slab allocator; got addr %x, size %d", addr, slabAllocSize)
+	}
+
+	heap := mockLargeAllocs(4)
+	addr, err = Alloc(slab.MaxObjectSize + 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if exp := heap.pages[1]; addr != exp {
+		t.Fatalf("expected large allocation to return address %x; got %x", exp, addr)
+	}
+
+	hdr := (*largeAllocHeader)(unsafe.Pointer(heap.pages[0]))
+	if hdr.magic != largeAllocMagic || hdr.pageCount != 2 {
+		t.Fatalf("unexpected large allocation header: %+v", *hdr)
+	}
+
+	if exp, got := 2, len(heap.mapped); got != exp {
+		t.Fatalf("expected %d pages to be mapped; got %d", exp, got)
+	}
+}
+
+func TestAllocZeroed(t *testing.T) {
+	defer resetMocks()
+
+	buf := make([]byte, 32)
+	for i := 0; i < len(buf); i++ {
+		buf[i] = 0xff
+	}
+
+	slabAllocFn = func(size mem.Size) (uintptr, *kernel.Error) {
+		return uintptr(unsafe.Pointer(&buf[0])), nil
+	}
+
+	if _, err := AllocZeroed(32); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < len(buf); i++ {
+		if buf[i] != 0 {
+			t.Fatalf("expected byte %d to be cleared; got %x", i, buf[i])
+		}
+	}
+
+	expErr := &kernel.Error{Module: "test", Message: "out of memory"}
+	slabAllocFn = func(size mem.Size) (uintptr, *kernel.Error) {
+		return 0, expErr
+	}
+
+	if _, err := AllocZeroed(32); err != expErr {
+		t.Fatalf("expected error %v; got %v", expErr, err)
+	}
+}
+
+func TestAllocAligned(t *testing.T) {
+	defer resetMocks()
+
+	var slabAllocSize mem.Size
+	slabAllocFn = func(size mem.Size) (uintptr, *kernel.Error) {
+		slabAllocSize = size
+		return 0, nil
+	}
+
+	specs := []struct {
+		size, align mem.Size
+		expErr      *kernel.Error
+		expSize     mem.Size
+	}{
+		{8, 0, errInvalidAlignment, 0},
+		{8, 3, errInvalidAlignment, 0},
+		{8, 2 * mem.PageSize, errInvalidAlignment, 0},
+		{8, 64, nil, 64},
+		{100, 16, nil, 100},
+	}
+
+	for specIndex, spec := range specs {
+		slabAllocSize = 0
+		if _, err := AllocAligned(spec.size, spec.align); err != spec.expErr {
+			t.Errorf("[spec %d] expected error %v; got %v", specIndex, spec.expErr, err)
+			continue
+		}
+
+		if slabAllocSize != spec.expSize {
+			t.Errorf("[spec %d] expected slab allocation size to be %d; got %d", specIndex, spec.expSize, slabAllocSize)
+		}
+	}
+
+	// Alignments larger than slab.MaxObjectSize require a large allocation
+	heap := mockLargeAllocs(2)
+	addr, err := AllocAligned(8, mem.PageSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if addr != heap.pages[1] || addr&uintptr(mem.PageSize-1) != 0 {
+		t.Fatalf("expected a page-aligned large allocation; got %x", addr)
+	}
+}
+
+func TestAllocLargeErrors(t *testing.T) {
+	defer resetMocks()
+
+	expErr := &kernel.Error{Module: "test", Message: "something went wrong"}
+
+	t.Run("size too large", func(t *testing.T) {
+		allocPagesFn = func(_ uint32) (uintptr, *kernel.Error) {
+			t.Fatal("unexpected call to AllocPages")
+			return 0, nil
+		}
+
+		if _, err := Alloc(mem.Size(^uint32(0)) << mem.PageShift); err != errInvalidSize {
+			t.Fatalf("expected error %v; got %v", errInvalidSize, err)
+		}
+	})
+
+	t.Run("page allocation fails", func(t *testing.T) {
+		allocPagesFn = func(_ uint32) (uintptr, *kernel.Error) {
+			return 0, expErr
+		}
+
+		if _, err := Alloc(mem.PageSize); err != expErr {
+			t.Fatalf("expected error %v; got %v", expErr, err)
+		}
+	})
+}
+
+func TestFree(t *testing.T) {
+	defer resetMocks()
+
+	var slabFreeAddr uintptr
+	slabFreeFn = func(addr uintptr) *kernel.Error {
+		slabFreeAddr = addr
+		return nil
+	}
+
+	if err := Free(0x1010); err != nil || slabFreeAddr != 0x1010 {
+		t.Fatalf("expected unaligned address to be released by the slab allocator; got err %v, addr %x", err, slabFreeAddr)
+	}
+
+	heap := mockLargeAllocs(4)
+	addr, err := Alloc(2 * mem.PageSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = Free(addr); err != nil {
+		t.Fatal(err)
+	}
+
+	if exp, got := 0, len(heap.mapped); got != exp {
+		t.Fatalf("expected all pages to be released; %d pages are still mapped", got)
+	}
+
+	// Attempting to release the same block twice should fail
+	heap.mapped[vmm.PageFromAddress(heap.pages[0])] = pmm.Frame(0)
+	if err = Free(addr); err != errInvalidAddress {
+		t.Fatalf("expected error %v; got %v", errInvalidAddress, err)
+	}
+}
+
+func TestFreeLargeErrors(t *testing.T) {
+	defer resetMocks()
+
+	expErr := &kernel.Error{Module: "test", Message: "something went wrong"}
+
+	if err := Free(0); err != errInvalidAddress {
+		t.Fatalf("expected error %v; got %v", errInvalidAddress, err)
+	}
+
+	t.Run("header page not mapped", func(t *testing.T) {
+		mockLargeAllocs(1)
+
+		if err := Free(0x2000); err != errInvalidAddress {
+			t.Fatalf("expected error %v; got %v", errInvalidAddress, err)
+		}
+	})
+
+	t.Run("freeing pages fails", func(t *testing.T) {
+		mockLargeAllocs(2)
+		addr, err := Alloc(mem.PageSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		freePagesFn = func(_ uintptr) *kernel.Error {
+			return expErr
+		}
+
+		if err := Free(addr); err != expErr {
+			t.Fatalf("expected error %v; got %v", expErr, err)
+		}
+	})
+}
+
+// mockHeap tracks the state of the mocked vmm calls that are used by large
+// allocations.
+type mockHeap struct {
+	buf    []byte
+	pages  []uintptr
+	mapped map[vmm.Page]pmm.Frame
+}
+
+// mockLargeAllocs mocks the vmm calls used by large allocations so that they
+// are backed by pageCount page-aligned blocks of heap memory.
+func mockLargeAllocs(pageCount int) *mockHeap {
+	heap := &mockHeap{
+		buf:    make([]byte, (pageCount+1)*int(mem.PageSize)),
+		pages:  make([]uintptr, pageCount),
+		mapped: make(map[vmm.Page]pmm.Frame),
+	}
+
+	firstPage := (uintptr(unsafe.Pointer(&heap.buf[0])) + uintptr(mem.PageSize-1)) &^ uintptr(mem.PageSize-1)
+	for i := 0; i < pageCount; i++ {
+		heap.pages[i] = firstPage + uintptr(i)*uintptr(mem.PageSize)
+	}
+
+	allocPagesFn = func(count uint32) (uintptr, *kernel.Error) {
+		if int(count) > pageCount {
+			return 0, &kernel.Error{Module: "test", Message: "out of memory"}
+		}
+
+		for i := uint32(0); i < count; i++ {
+			heap.mapped[vmm.PageFromAddress(heap.pages[i])] = pmm.Frame(i + 1)
+		}
+		return heap.pages[0], nil
+	}
+	freePagesFn = func(addr uintptr) *kernel.Error {
+		if addr != heap.pages[0] {
+			return &kernel.Error{Module: "test", Message: "invalid address"}
+		}
+
+		heap.mapped = make(map[vmm.Page]pmm.Frame)
+		return nil
+	}
+	translateFn = func(addr uintptr) (uintptr, *kernel.Error) {
+		frame, ok := heap.mapped[vmm.PageFromAddress(addr)]
+		if !ok {
+			return 0, vmm.ErrInvalidMapping
+		}
+		return frame.Address(), nil
+	}
+
+	return heap
+}
+
+func resetMocks() {
+	slabAllocFn = slab.Alloc
+	slabFreeFn = slab.Free
+	allocPagesFn = vmm.AllocPages
+	freePagesFn = vmm.FreePages
+	translateFn = vmm.Translate
+	memsetFn = mem.Memset
+}
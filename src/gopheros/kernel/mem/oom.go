@@ -0,0 +1,94 @@
+package mem
+
+import "gopheros/kernel"
+
+const (
+	// maxReclaimers defines the max number of reclaimers that can be
+	// registered via RegisterReclaimer.
+	maxReclaimers = 8
+
+	// maxLowMemoryListeners defines the max number of listeners that can
+	// be registered via RegisterLowMemoryListener.
+	maxLowMemoryListeners = 8
+)
+
+var (
+	// reclaimers and lowMemoryListeners are statically allocated arrays
+	// so that callbacks can be registered before the Go runtime is
+	// initialized.
+	reclaimers             [maxReclaimers]Reclaimer
+	reclaimerCount         int
+	lowMemoryListeners     [maxLowMemoryListeners]LowMemoryListener
+	lowMemoryListenerCount int
+
+	errTooManyReclaimers         = &kernel.Error{Module: "mem", Message: "max number of reclaimers reached"}
+	errTooManyLowMemoryListeners = &kernel.Error{Module: "mem", Message: "max number of low memory listeners reached"}
+)
+
+// Reclaimer is a function that releases memory held by a kernel subsystem
+// that can be recreated on demand (e.g. empty slab pages) back to the frame
+// allocator. It returns the number of frames that were released.
+type Reclaimer func() uint32
+
+// LowMemoryEvent describes a frame allocation request that could not be
+// serviced using the available free memory.
+type LowMemoryEvent struct {
+	// The number of contiguous frames that were requested.
+	RequestedFrames uint32
+
+	// The number of frames released by the registered reclaimers.
+	ReclaimedFrames uint32
+
+	// Recovered is set if the request was serviced after reclaiming
+	// memory. Otherwise, the request failed with an out of memory error.
+	Recovered bool
+}
+
+// LowMemoryListener is a function that gets notified when the system runs
+// low on memory.
+type LowMemoryListener func(LowMemoryEvent)
+
+// RegisterReclaimer adds a reclaimer to the list of reclaimers invoked by
+// Reclaim.
+func RegisterReclaimer(reclaimer Reclaimer) *kernel.Error {
+	if reclaimerCount == maxReclaimers {
+		return errTooManyReclaimers
+	}
+
+	reclaimers[reclaimerCount] = reclaimer
+	reclaimerCount++
+	return nil
+}
+
+// RegisterLowMemoryListener adds a listener to the list of listeners invoked
+// by NotifyLowMemory.
+func RegisterLowMemoryListener(listener LowMemoryListener) *kernel.Error {
+	if lowMemoryListenerCount == maxLowMemoryListeners {
+		return errTooManyLowMemoryListeners
+	}
+
+	lowMemoryListeners[lowMemoryListenerCount] = listener
+	lowMemoryListenerCount++
+	return nil
+}
+
+// Reclaim invokes each registered reclaimer and returns the total number of
+// frames that were released. It is invoked by the frame allocator before
+// failing an allocation request.
+func Reclaim() uint32 {
+	var released uint32
+	for index := 0; index < reclaimerCount; index++ {
+		released += reclaimers[index]()
+	}
+
+	return released
+}
+
+// NotifyLowMemory delivers a low memory event to each registered listener.
+// It is invoked by the frame allocator whenever an allocation request could
+// not be serviced using the available free memory.
+func NotifyLowMemory(event LowMemoryEvent) {
+	for index := 0; index < lowMemoryListenerCount; index++ {
+		lowMemoryListeners[index](event)
+	}
+}
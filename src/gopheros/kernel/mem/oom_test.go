@@ -0,0 +1,69 @@
+package mem
+
+import "testing"
+
+func TestReclaim(t *testing.T) {
+	defer func() {
+		reclaimerCount = 0
+	}()
+
+	reclaimerCount = 0
+	if got := Reclaim(); got != 0 {
+		t.Fatalf("expected no frames to be reclaimed when no reclaimers are registered; got %d", got)
+	}
+
+	for _, released := range []uint32{3, 0, 5} {
+		released := released
+		if err := RegisterReclaimer(func() uint32 { return released }); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if exp, got := uint32(8), Reclaim(); got != exp {
+		t.Fatalf("expected %d frames to be reclaimed; got %d", exp, got)
+	}
+
+	for index := reclaimerCount; index < maxReclaimers; index++ {
+		if err := RegisterReclaimer(func() uint32 { return 0 }); err != nil {
+			t.Fatalf("[reclaimer %d] unexpected error: %v", index, err)
+		}
+	}
+
+	if err := RegisterReclaimer(func() uint32 { return 0 }); err != errTooManyReclaimers {
+		t.Fatalf("expected error %v; got %v", errTooManyReclaimers, err)
+	}
+}
+
+func TestNotifyLowMemory(t *testing.T) {
+	defer func() {
+		lowMemoryListenerCount = 0
+	}()
+
+	var (
+		events []LowMemoryEvent
+		event  = LowMemoryEvent{RequestedFrames: 4, ReclaimedFrames: 2}
+	)
+
+	lowMemoryListenerCount = 0
+
+	for index := 0; index < maxLowMemoryListeners; index++ {
+		if err := RegisterLowMemoryListener(func(ev LowMemoryEvent) { events = append(events, ev) }); err != nil {
+			t.Fatalf("[listener %d] unexpected error: %v", index, err)
+		}
+	}
+
+	if err := RegisterLowMemoryListener(func(_ LowMemoryEvent) {}); err != errTooManyLowMemoryListeners {
+		t.Fatalf("expected error %v; got %v", errTooManyLowMemoryListeners, err)
+	}
+
+	NotifyLowMemory(event)
+	if len(events) != maxLowMemoryListeners {
+		t.Fatalf("expected event to be delivered to %d listeners; got %d", maxLowMemoryListeners, len(events))
+	}
+
+	for index, got := range events {
+		if got != event {
+			t.Errorf("[listener %d] expected event %+v; got %+v", index, event, got)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+// Package percpu provides variables that have a separate instance for each
+// CPU in the system.
+//
+// Each CPU is assigned a contiguous area of memory that holds its copy of
+// every per-CPU variable. A variable allocated via New is identified by its
+// offset from the start of the per-CPU area. The GS segment base of each CPU
+// points to its own area; the first word of each area contains the area's
+// address allowing the current CPU's area to be located with a single
+// GS-relative load. The Go runtime uses the FS segment for its thread-local
+// storage so GS is available for use by the kernel.
+package percpu
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/mem"
+	"gopheros/kernel/mem/vmm"
+	"unsafe"
+)
+
+const (
+	// MaxCPUs defines the max number of CPUs that can be supported.
+	MaxCPUs = 64
+
+	// AreaSize defines the size of each per-CPU area.
+	AreaSize = 16 * mem.PageSize
+
+	// msrGSBase is the model-specific register that holds the base
+	// address of the GS segment.
+	msrGSBase = 0xc0000101
+
+	// The offsets of the area header fields.
+	selfOffset     = 0
+	cpuIndexOffset = selfOffset + unsafe.Sizeof(uintptr(0))
+	headerSize     = cpuIndexOffset + unsafe.Sizeof(uintptr(0))
+)
+
+var (
+	// areas contains the address of each CPU's area.
+	areas    [MaxCPUs]uintptr
+	cpuCount uint32
+
+	// nextOffset is the offset that will be assigned to the next variable
+	// allocated via New.
+	nextOffset = headerSize
+
+	// The following functions are used by tests to mock calls to the
+	// vmm and cpu packages.
+	allocPagesFn = vmm.AllocPages
+	writeMSRFn   = cpu.WriteMSR
+	readGSFn     = cpu.ReadGS
+
+	errInvalidCPUCount    = &kernel.Error{Module: "percpu", Message: "invalid CPU count"}
+	errAlreadyInitialized = &kernel.Error{Module: "percpu", Message: "per-CPU areas have already been allocated"}
+	errInvalidCPU         = &kernel.Error{Module: "percpu", Message: "invalid CPU index"}
+	errAreaExhausted      = &kernel.Error{Module: "percpu", Message: "not enough space in per-CPU area"}
+	errInvalidAlignment   = &kernel.Error{Module: "percpu", Message: "alignment must be a power of 2"}
+)
+
+// Var describes a variable with a separate instance for each CPU.
+type Var struct {
+	offset uintptr
+}
+
+// New reserves size bytes aligned to align in the area of each CPU. Space can
+// be reserved before or after Init is called; the instances of each variable
+// are initially zeroed. Callers typically pass the unsafe.Sizeof and
+// unsafe.Alignof values of the variable type and cast the pointers returned
+// by Ptr and CPUPtr to a pointer of that type.
+func New(size, align uintptr) (Var, *kernel.Error) {
+	if align == 0 || align&(align-1) != 0 {
+		return Var{}, errInvalidAlignment
+	}
+
+	offset := (nextOffset + align - 1) &^ (align - 1)
+	if offset+size > uintptr(AreaSize) {
+		return Var{}, errAreaExhausted
+	}
+
+	nextOffset = offset + size
+	return Var{offset: offset}, nil
+}
+
+// Ptr returns a pointer to the instance of the variable that belongs to the
+// current CPU. Callers must ensure that they are not migrated to a different
+// CPU while using the returned pointer.
+func (v Var) Ptr() unsafe.Pointer {
+	return unsafe.Pointer(readGSFn(selfOffset) + v.offset)
+}
+
+// CPUPtr returns a pointer to the instance of the variable that belongs to
+// the CPU with the supplied index or nil if the index is not valid.
+func (v Var) CPUPtr(cpuIndex uint32) unsafe.Pointer {
+	if cpuIndex >= cpuCount {
+		return nil
+	}
+
+	return unsafe.Pointer(areas[cpuIndex] + v.offset)
+}
+
+// Init allocates and clears the per-CPU areas for numCPUs CPUs and activates
+// the area of the boot CPU (index 0). The remaining CPUs must call Activate
+// with their own index when they are brought online.
+func Init(numCPUs uint32) *kernel.Error {
+	if numCPUs == 0 || numCPUs > MaxCPUs {
+		return errInvalidCPUCount
+	}
+
+	if cpuCount != 0 {
+		return errAlreadyInitialized
+	}
+
+	for cpuIndex := uint32(0); cpuIndex < numCPUs; cpuIndex++ {
+		addr, err := allocPagesFn(uint32(AreaSize >> mem.PageShift))
+		if err != nil {
+			return err
+		}
+
+		mem.Memset(addr, 0, AreaSize)
+		*(*uintptr)(unsafe.Pointer(addr + selfOffset)) = addr
+		*(*uintptr)(unsafe.Pointer(addr + cpuIndexOffset)) = uintptr(cpuIndex)
+		areas[cpuIndex] = addr
+	}
+
+	cpuCount = numCPUs
+	return Activate(0)
+}
+
+// Activate points the GS segment base of the calling CPU to the per-CPU
+// area with the supplied index.
+func Activate(cpuIndex uint32) *kernel.Error {
+	if cpuIndex >= cpuCount {
+		return errInvalidCPU
+	}
+
+	writeMSRFn(msrGSBase, uint64(areas[cpuIndex]))
+	return nil
+}
+
+// CPUCount returns the number of CPUs for which per-CPU areas have been
+// allocated.
+func CPUCount() uint32 {
+	return cpuCount
+}
+
+// CurrentCPU returns the index of the CPU that executes the call.
+func CurrentCPU() uint32 {
+	return uint32(readGSFn(cpuIndexOffset))
+}
@@ -0,0 +1,176 @@
+package percpu
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/mem"
+	"gopheros/kernel/mem/vmm"
+	"testing"
+	"unsafe"
+)
+
+// areaBuf backs the per-CPU areas used by the tests. It is not allocated on
+// the stack as the stack may be moved while the tests access the buffer via
+// its address.
+var areaBuf [2 * AreaSize]byte
+
+func TestInit(t *testing.T) {
+	defer resetMocks()
+
+	var gsBase uint64
+	mockAreas(&gsBase)
+
+	if err := Init(2); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := CPUCount(); got != 2 {
+		t.Fatalf("expected CPU count to be 2; got %d", got)
+	}
+
+	if gsBase != uint64(areas[0]) {
+		t.Fatalf("expected GS base to point to the area of CPU 0 (0x%x); got 0x%x", areas[0], gsBase)
+	}
+
+	for cpuIndex := uint32(0); cpuIndex < 2; cpuIndex++ {
+		if err := Activate(cpuIndex); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := CurrentCPU(); got != cpuIndex {
+			t.Errorf("expected current CPU to be %d; got %d", cpuIndex, got)
+		}
+	}
+
+	if err := Activate(2); err != errInvalidCPU {
+		t.Fatalf("expected error %v; got %v", errInvalidCPU, err)
+	}
+
+	if err := Init(2); err != errAlreadyInitialized {
+		t.Fatalf("expected error %v; got %v", errAlreadyInitialized, err)
+	}
+}
+
+func TestInitErrors(t *testing.T) {
+	defer resetMocks()
+
+	for _, numCPUs := range []uint32{0, MaxCPUs + 1} {
+		if err := Init(numCPUs); err != errInvalidCPUCount {
+			t.Errorf("[%d CPUs] expected error %v; got %v", numCPUs, errInvalidCPUCount, err)
+		}
+	}
+
+	expErr := &kernel.Error{Module: "test", Message: "out of memory"}
+	allocPagesFn = func(_ uint32) (uintptr, *kernel.Error) {
+		return 0, expErr
+	}
+
+	if err := Init(1); err != expErr {
+		t.Fatalf("expected error %v; got %v", expErr, err)
+	}
+
+	if got := CPUCount(); got != 0 {
+		t.Fatalf("expected CPU count to be 0 after a failed Init; got %d", got)
+	}
+}
+
+func TestVar(t *testing.T) {
+	defer resetMocks()
+
+	var gsBase uint64
+	mockAreas(&gsBase)
+
+	type statsT struct {
+		flag  bool
+		count uint64
+	}
+
+	counter, err := New(unsafe.Sizeof(uint32(0)), unsafe.Alignof(uint32(0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Variables allocated before Init are also available
+	if err = Init(2); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := New(unsafe.Sizeof(statsT{}), unsafe.Alignof(statsT{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if exp := headerSize; counter.offset != exp {
+		t.Errorf("expected first variable to be placed at offset %d; got %d", exp, counter.offset)
+	}
+
+	if stats.offset%unsafe.Alignof(uint64(0)) != 0 || stats.offset < counter.offset+4 {
+		t.Errorf("expected second variable to be placed at an aligned offset after the first one; got %d", stats.offset)
+	}
+
+	for cpuIndex := uint32(0); cpuIndex < 2; cpuIndex++ {
+		if err = Activate(cpuIndex); err != nil {
+			t.Fatal(err)
+		}
+
+		if *(*uint32)(counter.Ptr()) != 0 || (*statsT)(stats.Ptr()).count != 0 {
+			t.Fatalf("[cpu %d] expected per-CPU variables to be zeroed", cpuIndex)
+		}
+
+		*(*uint32)(counter.Ptr()) = 42 + cpuIndex
+		(*statsT)(stats.Ptr()).count = uint64(cpuIndex) + 1
+	}
+
+	for cpuIndex := uint32(0); cpuIndex < 2; cpuIndex++ {
+		if got, exp := *(*uint32)(counter.CPUPtr(cpuIndex)), 42+cpuIndex; got != exp {
+			t.Errorf("[cpu %d] expected counter to be %d; got %d", cpuIndex, exp, got)
+		}
+
+		if got, exp := (*statsT)(stats.CPUPtr(cpuIndex)).count, uint64(cpuIndex)+1; got != exp {
+			t.Errorf("[cpu %d] expected stats count to be %d; got %d", cpuIndex, exp, got)
+		}
+	}
+
+	if got := counter.CPUPtr(2); got != nil {
+		t.Fatalf("expected CPUPtr to return nil for an invalid CPU index; got %v", got)
+	}
+
+	if _, err = New(uintptr(AreaSize), 1); err != errAreaExhausted {
+		t.Fatalf("expected error %v; got %v", errAreaExhausted, err)
+	}
+
+	for _, align := range []uintptr{0, 3} {
+		if _, err = New(1, align); err != errInvalidAlignment {
+			t.Errorf("[align %d] expected error %v; got %v", align, errInvalidAlignment, err)
+		}
+	}
+}
+
+// mockAreas mocks the page allocator so that the per-CPU areas are backed by
+// areaBuf and emulates the GS segment using the value written to the GS base
+// MSR.
+func mockAreas(gsBase *uint64) {
+	nextArea := 0
+	allocPagesFn = func(pageCount uint32) (uintptr, *kernel.Error) {
+		addr := uintptr(unsafe.Pointer(&areaBuf[nextArea*int(AreaSize)]))
+		mem.Memset(addr, 0xff, mem.Size(pageCount)<<mem.PageShift)
+		nextArea++
+		return addr, nil
+	}
+	writeMSRFn = func(reg uint32, val uint64) {
+		if reg == msrGSBase {
+			*gsBase = val
+		}
+	}
+	readGSFn = func(offset uintptr) uintptr {
+		return *(*uintptr)(unsafe.Pointer(uintptr(*gsBase) + offset))
+	}
+}
+
+func resetMocks() {
+	allocPagesFn = vmm.AllocPages
+	writeMSRFn = cpu.WriteMSR
+	readGSFn = cpu.ReadGS
+	cpuCount = 0
+	nextOffset = headerSize
+}
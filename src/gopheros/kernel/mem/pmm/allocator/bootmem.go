@@ -2,7 +2,6 @@ package allocator
 
 import (
 	"gopheros/kernel"
-	"gopheros/kernel/hal/multiboot"
 	"gopheros/kernel/kfmt"
 	"gopheros/kernel/mem"
 	"gopheros/kernel/mem/pmm"
@@ -14,8 +13,18 @@ var (
 	earlyAllocator bootMemAllocator
 
 	errBootAllocOutOfMemory = &kernel.Error{Module: "boot_mem_alloc", Message: "out of memory"}
+	errBootAllocRetired     = &kernel.Error{Module: "boot_mem_alloc", Message: "allocator has been retired"}
 )
 
+// bootMemHandoff is implemented by allocators that take over the frames in
+// use by the kernel when the boot memory allocator is retired.
+type bootMemHandoff interface {
+	// reserveBootFrame marks a frame that is in use by the kernel as
+	// reserved. It returns false if the frame cannot be tracked by the
+	// allocator.
+	reserveBootFrame(frame pmm.Frame) bool
+}
+
 // bootMemAllocator implements a rudimentary physical memory allocator which is
 // used to bootstrap the kernel.
 //
@@ -26,12 +35,16 @@ var (
 //
 // Due to the way that the allocator works, it is not possible to free
 // allocated pages. Once the kernel is properly initialized, the allocated
-// blocks will be handed over to a more advanced memory allocator that does
-// support freeing.
+// blocks are handed over to a more advanced memory allocator that does
+// support freeing via a call to Retire.
 type bootMemAllocator struct {
 	// allocCount tracks the total number of allocated frames.
 	allocCount uint64
 
+	// retired is set once the allocator has handed off its frames via a
+	// call to Retire. Retired allocators reject any further allocations.
+	retired bool
+
 	// lastAllocFrame tracks the last allocated frame number.
 	lastAllocFrame pmm.Frame
 
@@ -45,6 +58,7 @@ func (alloc *bootMemAllocator) init(kernelStart, kernelEnd uintptr) {
 	// round down kernel start to the nearest page and round up kernel end
 	// to the nearest page.
 	pageSizeMinus1 := uintptr(mem.PageSize - 1)
+	alloc.allocCount, alloc.lastAllocFrame, alloc.retired = 0, 0, false
 	alloc.kernelStartAddr = kernelStart
 	alloc.kernelEndAddr = kernelEnd
 	alloc.kernelStartFrame = pmm.Frame((kernelStart & ^pageSizeMinus1) >> mem.PageShift)
@@ -53,27 +67,43 @@ func (alloc *bootMemAllocator) init(kernelStart, kernelEnd uintptr) {
 }
 
 // AllocFrame scans the system memory regions reported by the bootloader and
-// reserves the next available free frame.
+// reserves the next available free frame that has not been reserved via
+// pmm.ReserveRange.
 //
-// AllocFrame returns an error if no more memory can be allocated.
+// AllocFrame returns an error if no more memory can be allocated or if the
+// allocator has been retired.
 func (alloc *bootMemAllocator) AllocFrame() (pmm.Frame, *kernel.Error) {
+	if alloc.retired {
+		return pmm.InvalidFrame, errBootAllocRetired
+	}
+
+	// Skip over any frames reserved via pmm.ReserveRange
+	for {
+		frame, err := alloc.nextFrame()
+		if _, reserved := reservationOwnerFn(frame); err != nil || !reserved {
+			return frame, err
+		}
+	}
+}
+
+// nextFrame selects the next available free frame.
+func (alloc *bootMemAllocator) nextFrame() (pmm.Frame, *kernel.Error) {
 	var err = errBootAllocOutOfMemory
 
-	multiboot.VisitMemRegions(func(region *multiboot.MemoryMapEntry) bool {
+	for _, region := range pmm.MemoryMap() {
 		// Ignore reserved regions and regions smaller than a single page
-		if region.Type != multiboot.MemAvailable || region.Length < uint64(mem.PageSize) {
-			return true
+		if region.Type != pmm.RegionUsable || region.Size < mem.PageSize {
+			continue
 		}
 
 		// Reported addresses may not be page-aligned; round up to get
 		// the start frame and round down to get the end frame
-		pageSizeMinus1 := uint64(mem.PageSize - 1)
-		regionStartFrame := pmm.Frame(((region.PhysAddress + pageSizeMinus1) & ^pageSizeMinus1) >> mem.PageShift)
-		regionEndFrame := pmm.Frame(((region.PhysAddress+region.Length) & ^pageSizeMinus1)>>mem.PageShift) - 1
+		regionStartFrame := region.StartFrame()
+		regionEndFrame := region.EndFrame()
 
 		// Skip over already allocated regions
 		if alloc.lastAllocFrame >= regionEndFrame {
-			return true
+			continue
 		}
 
 		// If last frame used a different region and the kernel image
@@ -99,12 +129,12 @@ func (alloc *bootMemAllocator) AllocFrame() (pmm.Frame, *kernel.Error) {
 		// The above adjustment might push lastAllocFrame outside of the
 		// region end (e.g kernel ends at last page in the region)
 		if alloc.lastAllocFrame > regionEndFrame {
-			return true
+			continue
 		}
 
 		err = nil
-		return false
-	})
+		break
+	}
 
 	if err != nil {
 		return pmm.InvalidFrame, errBootAllocOutOfMemory
@@ -114,19 +144,59 @@ func (alloc *bootMemAllocator) AllocFrame() (pmm.Frame, *kernel.Error) {
 	return alloc.lastAllocFrame, nil
 }
 
+// Retire hands off the frames occupied by the kernel image and the frames
+// allocated so far to the supplied allocator and rejects any further
+// allocation requests. Allocated frames that cannot be tracked by the new
+// allocator are reported as leaked. Retire returns the number of leaked
+// frames.
+func (alloc *bootMemAllocator) Retire(handoff bootMemHandoff) uint64 {
+	var handedOff, leaked uint64
+
+	// Kernel image frames located outside the memory tracked by the new
+	// allocator (e.g. in a reserved region) do not need to be handed off.
+	for frame := alloc.kernelStartFrame; frame <= alloc.kernelEndFrame; frame++ {
+		if handoff.reserveBootFrame(frame) {
+			handedOff++
+		}
+	}
+
+	// The allocator does not track individual frames but only a counter
+	// of allocated frames. To get the list of frames we reset its
+	// internal state and "replay" the allocation requests.
+	allocCount := alloc.allocCount
+	alloc.allocCount, alloc.lastAllocFrame = 0, 0
+	for i := uint64(0); i < allocCount; i++ {
+		frame, _ := alloc.nextFrame()
+		if _, reserved := reservationOwnerFn(frame); reserved {
+			continue
+		}
+
+		if handoff.reserveBootFrame(frame) {
+			handedOff++
+			continue
+		}
+
+		leaked++
+		kfmt.Printf("[boot_mem_alloc] leaked frame at 0x%x: not tracked by the new allocator\n", frame.Address())
+	}
+
+	alloc.retired = true
+	kfmt.Printf("[boot_mem_alloc] retired; frames handed off: %d, leaked: %d\n", handedOff, leaked)
+	return leaked
+}
+
 // printMemoryMap scans the memory region information provided by the
 // bootloader and prints out the system's memory map.
 func (alloc *bootMemAllocator) printMemoryMap() {
 	kfmt.Printf("[boot_mem_alloc] system memory map:\n")
 	var totalFree mem.Size
-	multiboot.VisitMemRegions(func(region *multiboot.MemoryMapEntry) bool {
-		kfmt.Printf("\t[0x%10x - 0x%10x], size: %10d, type: %s\n", region.PhysAddress, region.PhysAddress+region.Length, region.Length, region.Type.String())
+	for _, region := range pmm.MemoryMap() {
+		kfmt.Printf("\t[0x%10x - 0x%10x], size: %10d, type: %s\n", region.PhysAddress, region.PhysAddress+uintptr(region.Size), uint64(region.Size), region.Type.String())
 
-		if region.Type == multiboot.MemAvailable {
-			totalFree += mem.Size(region.Length)
+		if region.Type == pmm.RegionUsable {
+			totalFree += region.Size
 		}
-		return true
-	})
+	}
 	kfmt.Printf("[boot_mem_alloc] available memory: %dKb\n", uint64(totalFree/mem.Kb))
 	kfmt.Printf("[boot_mem_alloc] kernel loaded at 0x%x - 0x%x\n", alloc.kernelStartAddr, alloc.kernelEndAddr)
 	kfmt.Printf("[boot_mem_alloc] size: %d bytes, reserved pages: %d\n",
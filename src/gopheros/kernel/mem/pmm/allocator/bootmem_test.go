@@ -2,6 +2,7 @@ package allocator
 
 import (
 	"gopheros/kernel/hal/multiboot"
+	"gopheros/kernel/mem/pmm"
 	"testing"
 	"unsafe"
 )
@@ -90,6 +91,33 @@ func TestBootMemoryAllocator(t *testing.T) {
 	}
 }
 
+func TestBootMemoryAllocatorSkipsReservedFrames(t *testing.T) {
+	defer func() {
+		reservationOwnerFn = pmm.ReservationOwner
+	}()
+
+	multiboot.SetInfoPtr(uintptr(unsafe.Pointer(&multibootMemoryMap[0])))
+
+	// Frames 1 and 2 have been reserved via pmm.ReserveRange
+	reservationOwnerFn = func(frame pmm.Frame) (string, bool) {
+		return "test", frame == 1 || frame == 2
+	}
+
+	var alloc bootMemAllocator
+	alloc.init(0xa0000, 0xa0000)
+
+	for allocIndex, exp := range []pmm.Frame{0, 3, 4} {
+		frame, err := alloc.AllocFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if frame != exp {
+			t.Errorf("[alloc %d] expected allocated frame to be %d; got %d", allocIndex, exp, frame)
+		}
+	}
+}
+
 var (
 	// A dump of multiboot data when running under qemu containing only the
 	// memory region tag.  The dump encodes the following available memory
@@ -0,0 +1,1127 @@
+package allocator
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/kfmt"
+	"gopheros/kernel/mem"
+	"gopheros/kernel/mem/pmm"
+	"gopheros/kernel/mem/vmm"
+	"math"
+	"reflect"
+	"unsafe"
+)
+
+// MaxOrder defines the largest block order that can be allocated by the
+// buddy allocator. A block of order N contains 2^N contiguous frames and its
+// first frame is always aligned to a 2^N frame boundary.
+const MaxOrder = 10
+
+// maxHotplugPools defines the number of pool slots that are reserved for
+// memory ranges that are added at runtime via AddMemory.
+const maxHotplugPools = 8
+
+// NodeID identifies a NUMA node.
+type NodeID uint8
+
+var (
+	// buddyAllocator is a BuddyAllocator instance that serves as the
+	// primary allocator for reserving pages.
+	buddyAllocator BuddyAllocator
+
+	errBuddyAllocOutOfMemory     = &kernel.Error{Module: "buddy_alloc", Message: "out of memory"}
+	errBuddyAllocFrameNotManaged = &kernel.Error{Module: "buddy_alloc", Message: "frame not managed by this allocator"}
+	errBuddyAllocDoubleFree      = &kernel.Error{Module: "buddy_alloc", Message: "frame is already free"}
+	errBuddyAllocInvalidOrder    = &kernel.Error{Module: "buddy_alloc", Message: "requested block order exceeds MaxOrder"}
+	errBuddyAllocMisalignedFrame = &kernel.Error{Module: "buddy_alloc", Message: "frame is not aligned to the block order"}
+	errBuddyAllocFrameNotInUse   = &kernel.Error{Module: "buddy_alloc", Message: "frame is not allocated"}
+	errBuddyAllocFrameShared     = &kernel.Error{Module: "buddy_alloc", Message: "frame is shared and cannot be freed"}
+	errBuddyAllocRefOverflow     = &kernel.Error{Module: "buddy_alloc", Message: "frame reference count overflow"}
+	errBuddyAllocInvalidRange    = &kernel.Error{Module: "buddy_alloc", Message: "memory range is too small or invalid"}
+	errBuddyAllocRangeOverlap    = &kernel.Error{Module: "buddy_alloc", Message: "memory range overlaps an existing pool"}
+	errBuddyAllocTooManyPools    = &kernel.Error{Module: "buddy_alloc", Message: "no free pool slots for memory range"}
+	errBuddyAllocFrameInUse      = &kernel.Error{Module: "buddy_alloc", Message: "frame is already in use"}
+
+	// The followning functions are used by tests to mock calls to the vmm package
+	// and are automatically inlined by the compiler.
+	reserveRegionFn = vmm.EarlyReserveRegion
+	mapFn           = vmm.Map
+	physToVirtFn    = vmm.PhysToVirt
+	extendPhysMapFn = vmm.ExtendPhysMap
+
+	// The following functions are used by tests to mock the list of
+	// ranges reserved via the pmm package.
+	reservationsFn     = pmm.Reservations
+	reservationOwnerFn = pmm.ReservationOwner
+
+	// The following functions are used by tests to mock the low memory
+	// handling hooks of the mem package.
+	reclaimFn         = mem.Reclaim
+	notifyLowMemoryFn = mem.NotifyLowMemory
+)
+
+type markAs bool
+
+const (
+	markReserved markAs = false
+	markFree            = true
+)
+
+type framePool struct {
+	// startFrame is the frame number for the first page in this pool.
+	// each frame metadata entry i corresponds to frame (startFrame + i).
+	startFrame pmm.Frame
+
+	// endFrame tracks the last frame in the pool. The total number of
+	// frames is given by: (endFrame - startFrame) + 1
+	endFrame pmm.Frame
+
+	// baseFrame is startFrame rounded down to a multiple of 2^MaxOrder.
+	// Block indices are calculated relative to baseFrame so that the
+	// frames of each block are naturally aligned to the block size.
+	baseFrame pmm.Frame
+
+	// freeCount tracks the available pages in this pool. The allocator
+	// can use this field to skip pools without enough free pages
+	// without the need to scan the free block bitmaps.
+	freeCount uint32
+
+	// node is the NUMA node that the pool memory belongs to. All pools
+	// belong to node 0 unless assigned to a different node via a call to
+	// AssignNode.
+	node NodeID
+
+	// reclaimable is set for pools backed by ACPI reclaimable memory.
+	// The frames in such pools remain reserved until the pool is released
+	// via a call to ReleaseACPIReclaimableRegions.
+	reclaimable bool
+
+	// blockBitmap stores a bitmap for each block order. The offset of
+	// each bitmap inside the slice is stored in blockOffset. If bit i of
+	// the bitmap for order N is set then the block of 2^N frames that
+	// starts at frame (baseFrame + i*2^N) is free and not part of a
+	// larger free block.
+	blockBitmap    []uint64
+	blockBitmapHdr reflect.SliceHeader
+	blockOffset    [MaxOrder + 2]uint32
+
+	// freeBlocks tracks the number of free blocks for each order.
+	freeBlocks [MaxOrder + 1]uint32
+
+	// frames stores the metadata for each frame in the pool. Entry i
+	// corresponds to frame (startFrame + i).
+	frames    []FrameInfo
+	framesHdr reflect.SliceHeader
+}
+
+// poolStateWords returns the number of uint64 words that are required for
+// storing the block bitmaps and the frame metadata for a pool that manages
+// the frames in the [startFrame, endFrame] range.
+func poolStateWords(startFrame, endFrame pmm.Frame) uintptr {
+	baseFrame := startFrame &^ (1<<MaxOrder - 1)
+	var words uintptr
+	for order := uint8(0); order <= MaxOrder; order++ {
+		words += ((uintptr(endFrame-baseFrame) >> order) + 64) >> 6
+	}
+
+	// Each uint64 word can hold the metadata for 2 frames
+	words += (uintptr(endFrame-startFrame) + 2) >> 1
+
+	return words
+}
+
+// init configures the pool to manage the frames in the [startFrame,
+// endFrame] range and overlays its block bitmaps and frame metadata on top of
+// the zeroed memory block starting at stateAddr. The memory block must be
+// large enough to hold poolStateWords(startFrame, endFrame) words.
+func (pool *framePool) init(startFrame, endFrame pmm.Frame, stateAddr uintptr) {
+	pool.startFrame = startFrame
+	pool.endFrame = endFrame
+	pool.baseFrame = startFrame &^ (1<<MaxOrder - 1)
+	pool.freeCount = uint32(endFrame - startFrame + 1)
+
+	var blockWords uint32
+	for order := uint8(0); order <= MaxOrder; order++ {
+		pool.blockOffset[order] = blockWords
+		blockWords += uint32(((endFrame-pool.baseFrame)>>order)+64) >> 6
+	}
+	pool.blockOffset[MaxOrder+1] = blockWords
+
+	pool.blockBitmapHdr.Len = int(blockWords)
+	pool.blockBitmapHdr.Cap = int(blockWords)
+	pool.blockBitmapHdr.Data = stateAddr
+	pool.blockBitmap = *(*[]uint64)(unsafe.Pointer(&pool.blockBitmapHdr))
+
+	frameCount := int(endFrame - startFrame + 1)
+	pool.framesHdr.Len = frameCount
+	pool.framesHdr.Cap = frameCount
+	pool.framesHdr.Data = stateAddr + uintptr(blockWords)<<3
+	pool.frames = *(*[]FrameInfo)(unsafe.Pointer(&pool.framesHdr))
+}
+
+// isFreeBlock returns true if the block with the supplied order and index is
+// free and not part of a larger free block.
+func (pool *framePool) isFreeBlock(order uint8, index uintptr) bool {
+	word := uintptr(pool.blockOffset[order]) + index>>6
+	return pool.blockBitmap[word]&(1<<(63-index&63)) != 0
+}
+
+// markBlock updates the free flag for the block with the supplied order and
+// index.
+func (pool *framePool) markBlock(order uint8, index uintptr, flag markAs) {
+	word := uintptr(pool.blockOffset[order]) + index>>6
+	mask := uint64(1 << (63 - index&63))
+	switch flag {
+	case markFree:
+		pool.blockBitmap[word] |= mask
+		pool.freeBlocks[order]++
+	case markReserved:
+		pool.blockBitmap[word] &^= mask
+		pool.freeBlocks[order]--
+	}
+}
+
+// addFreeBlock marks the block of 2^order frames starting at frame as free.
+// If the buddy of the block is also free, the two blocks are merged into a
+// block of the next order and the process repeats until no more merges are
+// possible or MaxOrder is reached.
+func (pool *framePool) addFreeBlock(frame pmm.Frame, order uint8) {
+	index := uintptr(frame-pool.baseFrame) >> order
+	for ; order < MaxOrder; order++ {
+		buddyIndex := index ^ 1
+		if !pool.isFreeBlock(order, buddyIndex) {
+			break
+		}
+
+		pool.markBlock(order, buddyIndex, markReserved)
+		index >>= 1
+	}
+
+	pool.markBlock(order, index, markFree)
+}
+
+// takeFreeBlock reserves a free block of 2^order frames that ends at or below
+// maxFrame and returns its first frame. If no block of the requested order is
+// available, the smallest available block of a higher order gets split into
+// two buddies; the lower buddy is split further while the upper buddy is
+// marked as free. If the pool contains no suitable block then takeFreeBlock
+// returns pmm.InvalidFrame.
+func (pool *framePool) takeFreeBlock(order uint8, maxFrame pmm.Frame) pmm.Frame {
+	for curOrder := order; curOrder <= MaxOrder; curOrder++ {
+		if pool.freeBlocks[curOrder] == 0 {
+			continue
+		}
+
+		// As firstFreeBlock returns the block with the lowest address,
+		// no other block with this order can satisfy the limit if the
+		// first one does not.
+		index := pool.firstFreeBlock(curOrder)
+		if pool.baseFrame+pmm.Frame(index<<curOrder)+(pmm.Frame(1)<<order)-1 > maxFrame {
+			continue
+		}
+
+		pool.markBlock(curOrder, index, markReserved)
+
+		for ; curOrder > order; curOrder-- {
+			index <<= 1
+			pool.markBlock(curOrder-1, index|1, markFree)
+		}
+
+		return pool.baseFrame + pmm.Frame(index<<order)
+	}
+
+	return pmm.InvalidFrame
+}
+
+// takeFrame removes a single free frame from the free block that contains it.
+// The block is split into buddies and all buddies that do not contain the
+// frame are marked as free. Callers must ensure that the frame is free.
+func (pool *framePool) takeFrame(frame pmm.Frame) {
+	frameIndex := uintptr(frame - pool.baseFrame)
+	order := uint8(0)
+	for order < MaxOrder && !pool.isFreeBlock(order, frameIndex>>order) {
+		order++
+	}
+
+	pool.markBlock(order, frameIndex>>order, markReserved)
+	for ; order > 0; order-- {
+		pool.markBlock(order-1, frameIndex>>(order-1)^1, markFree)
+	}
+}
+
+// firstFreeBlock scans the bitmap for the supplied order and returns the
+// index of the first free block. Callers must ensure that at least one block
+// with the requested order is free.
+func (pool *framePool) firstFreeBlock(order uint8) uintptr {
+	startWord, endWord := int(pool.blockOffset[order]), int(pool.blockOffset[order+1])
+	for word := startWord; word < endWord; word++ {
+		block := pool.blockBitmap[word]
+		if block == 0 {
+			continue
+		}
+
+		for blockOffset, mask := uintptr(0), uint64(1<<63); ; blockOffset, mask = blockOffset+1, mask>>1 {
+			if block&mask != 0 {
+				return uintptr(word-startWord)<<6 + blockOffset
+			}
+		}
+	}
+
+	return 0
+}
+
+// BuddyAllocator implements a physical frame allocator that uses the buddy
+// system for tracking free blocks of contiguous frames across the available
+// memory pools. The allocator can service requests for up to 2^MaxOrder
+// contiguous frames and coalesces adjacent free blocks when they get
+// released.
+type BuddyAllocator struct {
+	// totalPages tracks the total number of pages across all pools.
+	totalPages uint32
+
+	// reservedPages tracks the number of reserved pages across all pools.
+	reservedPages uint32
+
+	pools    []framePool
+	poolsHdr reflect.SliceHeader
+
+	// poison is set when free frames are filled with the mem.PoisonFree
+	// pattern and checked for modifications when they get allocated.
+	poison bool
+
+	// reclaiming is set while the registered reclaimers are invoked to
+	// release memory after a failed allocation.
+	reclaiming bool
+}
+
+// init allocates space for the allocator structures using the early bootmem
+// allocator and then retires the early allocator, taking over the frames
+// occupied by the kernel and the frames allocated by the early allocator.
+func (alloc *BuddyAllocator) init() *kernel.Error {
+	if err := alloc.setupPools(); err != nil {
+		return err
+	}
+
+	earlyAllocator.Retire(alloc)
+	alloc.reserveReclaimableFrames()
+	alloc.reserveRangeFrames()
+	alloc.populateFreeBlocks()
+	alloc.printStats()
+	return nil
+}
+
+// setupPools uses the early allocator and vmm region reservation helper to
+// initialize the list of available pools and their bitmap slices.
+func (alloc *BuddyAllocator) setupPools() *kernel.Error {
+	var (
+		err                 *kernel.Error
+		sizeofPool          = unsafe.Sizeof(framePool{})
+		pageSizeMinus1      = uint64(mem.PageSize - 1)
+		requiredBitmapWords uintptr
+	)
+
+	// Detect available memory regions and calculate their pool bitmap
+	// requirements. ACPI reclaimable regions are also tracked by pools
+	// but their frames remain reserved until ReleaseACPIReclaimableRegions
+	// is invoked.
+	for _, region := range pmm.MemoryMap() {
+		if !isPoolRegion(&region) {
+			continue
+		}
+
+		alloc.poolsHdr.Len++
+		alloc.poolsHdr.Cap++
+
+		alloc.totalPages += uint32(region.EndFrame() - region.StartFrame() + 1)
+		requiredBitmapWords += poolStateWords(region.StartFrame(), region.EndFrame())
+	}
+
+	// Reserve enough pages to hold the allocator state including the
+	// slots for any memory ranges added at runtime
+	alloc.poolsHdr.Cap += maxHotplugPools
+	requiredBytes := mem.Size(((uint64(uintptr(alloc.poolsHdr.Cap)*sizeofPool) + uint64(requiredBitmapWords<<3)) + pageSizeMinus1) & ^pageSizeMinus1)
+	requiredPages := requiredBytes >> mem.PageShift
+	alloc.poolsHdr.Data, err = reserveRegionFn(requiredBytes)
+	if err != nil {
+		return err
+	}
+
+	for page, index := vmm.PageFromAddress(alloc.poolsHdr.Data), mem.Size(0); index < requiredPages; page, index = page+1, index+1 {
+		nextFrame, err := earlyAllocFrame()
+		if err != nil {
+			return err
+		}
+
+		if err = mapFn(page, nextFrame, vmm.FlagPresent|vmm.FlagRW|vmm.FlagNoExecute); err != nil {
+			return err
+		}
+
+		mem.Memset(page.Address(), 0, mem.PageSize)
+	}
+
+	alloc.pools = *(*[]framePool)(unsafe.Pointer(&alloc.poolsHdr))
+
+	// Run a second pass to initialize the bitmap slices for all pools
+	bitmapStartAddr := alloc.poolsHdr.Data + uintptr(alloc.poolsHdr.Cap)*sizeofPool
+	poolIndex := 0
+	for _, region := range pmm.MemoryMap() {
+		if !isPoolRegion(&region) {
+			continue
+		}
+
+		alloc.pools[poolIndex].init(region.StartFrame(), region.EndFrame(), bitmapStartAddr)
+		alloc.pools[poolIndex].reclaimable = region.Type == pmm.RegionACPIReclaimable
+
+		bitmapStartAddr += poolStateWords(region.StartFrame(), region.EndFrame()) << 3
+		poolIndex++
+	}
+
+	return nil
+}
+
+// markFrame updates the state and owner of the metadata entry that
+// corresponds to the supplied frame. Callers must only use markFrame to
+// transition frames from the FrameFree state to another state and vice-versa.
+func (alloc *BuddyAllocator) markFrame(poolIndex int, frame pmm.Frame, state FrameState, owner FrameOwner) {
+	if poolIndex < 0 || frame > alloc.pools[poolIndex].endFrame {
+		return
+	}
+
+	alloc.pools[poolIndex].frames[frame-alloc.pools[poolIndex].startFrame] = FrameInfo{State: state, Owner: owner}
+	switch state {
+	case FrameFree:
+		alloc.pools[poolIndex].freeCount++
+		alloc.reservedPages--
+	default:
+		alloc.pools[poolIndex].freeCount--
+		alloc.reservedPages++
+	}
+}
+
+// isReserved returns true if the supplied frame is not free.
+func (alloc *BuddyAllocator) isReserved(poolIndex int, frame pmm.Frame) bool {
+	return alloc.pools[poolIndex].frames[frame-alloc.pools[poolIndex].startFrame].State != FrameFree
+}
+
+// poolForFrame returns the index of the pool that contains frame or -1 if
+// the frame is not contained in any of the available memory pools (e.g it
+// points to a reserved memory region).
+func (alloc *BuddyAllocator) poolForFrame(frame pmm.Frame) int {
+	for poolIndex, pool := range alloc.pools {
+		if frame >= pool.startFrame && frame <= pool.endFrame {
+			return poolIndex
+		}
+	}
+
+	return -1
+}
+
+// reserveBootFrame implements bootMemHandoff. It marks a frame handed off by
+// the boot memory allocator as reserved for the kernel.
+func (alloc *BuddyAllocator) reserveBootFrame(frame pmm.Frame) bool {
+	poolIndex := alloc.poolForFrame(frame)
+	if poolIndex < 0 || alloc.isReserved(poolIndex, frame) {
+		return false
+	}
+
+	alloc.markFrame(poolIndex, frame, FrameReserved, OwnerKernel)
+	return true
+}
+
+// reserveReclaimableFrames marks as reserved all frames that belong to ACPI
+// reclaimable pools.
+func (alloc *BuddyAllocator) reserveReclaimableFrames() {
+	for poolIndex, pool := range alloc.pools {
+		if !pool.reclaimable {
+			continue
+		}
+
+		for frame := pool.startFrame; frame <= pool.endFrame; frame++ {
+			alloc.markFrame(poolIndex, frame, FrameReserved, OwnerACPI)
+		}
+	}
+}
+
+// reserveRangeFrames marks as reserved all free frames that belong to the
+// physical memory ranges reserved via pmm.ReserveRange before the allocator
+// was initialized.
+func (alloc *BuddyAllocator) reserveRangeFrames() {
+	for _, res := range reservationsFn() {
+		for frame := res.StartFrame(); frame <= res.EndFrame(); frame++ {
+			if poolIndex := alloc.poolForFrame(frame); poolIndex >= 0 && !alloc.isReserved(poolIndex, frame) {
+				alloc.markFrame(poolIndex, frame, FrameReserved, OwnerReserved)
+			}
+		}
+	}
+}
+
+// populateFreeBlocks scans the frame metadata of each pool and adds all free
+// frames to the pool free blocks. Adjacent free frames are
+// automatically coalesced into larger blocks.
+func (alloc *BuddyAllocator) populateFreeBlocks() {
+	for poolIndex := range alloc.pools {
+		pool := &alloc.pools[poolIndex]
+		for frame := pool.startFrame; frame <= pool.endFrame; frame++ {
+			if !alloc.isReserved(poolIndex, frame) {
+				pool.addFreeBlock(frame, 0)
+			}
+		}
+	}
+}
+
+// releaseReclaimableFrames marks as free all frames that belong to ACPI reclaimable pools and converts them to regular pools.
+func (alloc *BuddyAllocator) releaseReclaimableFrames() {
+	for poolIndex := range alloc.pools {
+		pool := &alloc.pools[poolIndex]
+		if !pool.reclaimable {
+			continue
+		}
+
+		if alloc.poison {
+			alloc.poisonFrames(pool.startFrame, pool.endFrame-pool.startFrame+1)
+		}
+
+		for frame := pool.startFrame; frame <= pool.endFrame; frame++ {
+			alloc.markFrame(poolIndex, frame, FrameFree, OwnerUnknown)
+			pool.addFreeBlock(frame, 0)
+		}
+		pool.reclaimable = false
+	}
+}
+
+// AddMemory makes the usable physical memory range [startAddr,
+// startAddr+size) available for allocation. It is meant to be invoked when
+// memory is hot-added to the system at runtime. The range is added to the
+// physmap and managed by a new pool whose state is stored in the first frames
+// of the range. Partial pages at either end of the range are ignored.
+func (alloc *BuddyAllocator) AddMemory(startAddr uintptr, size mem.Size) *kernel.Error {
+	endAddr := startAddr + uintptr(size)
+	startFrame := pmm.Frame((startAddr + uintptr(mem.PageSize-1)) >> mem.PageShift)
+	endFrame := pmm.Frame(endAddr>>mem.PageShift) - 1
+	if endAddr < startAddr || endFrame < startFrame || endFrame == pmm.InvalidFrame {
+		return errBuddyAllocInvalidRange
+	}
+
+	for poolIndex := 0; poolIndex < len(alloc.pools); poolIndex++ {
+		if startFrame <= alloc.pools[poolIndex].endFrame && endFrame >= alloc.pools[poolIndex].startFrame {
+			return errBuddyAllocRangeOverlap
+		}
+	}
+
+	if len(alloc.pools) == cap(alloc.pools) {
+		return errBuddyAllocTooManyPools
+	}
+
+	// At least one frame must remain available after reserving the
+	// frames for the pool state
+	stateFrames := pmm.Frame((poolStateWords(startFrame, endFrame)<<3 + uintptr(mem.PageSize-1)) >> mem.PageShift)
+	if stateFrames > endFrame-startFrame {
+		return errBuddyAllocInvalidRange
+	}
+
+	if err := extendPhysMapFn(startFrame.Address(), mem.Size(endFrame-startFrame+1)<<mem.PageShift); err != nil {
+		return err
+	}
+
+	stateAddr := physToVirtFn(startFrame.Address())
+	mem.Memset(stateAddr, 0, mem.Size(stateFrames)<<mem.PageShift)
+
+	poolIndex := len(alloc.pools)
+	alloc.pools = alloc.pools[:poolIndex+1]
+	pool := &alloc.pools[poolIndex]
+	*pool = framePool{}
+	pool.init(startFrame, endFrame, stateAddr)
+	alloc.totalPages += uint32(endFrame - startFrame + 1)
+
+	for frame := startFrame; frame < startFrame+stateFrames; frame++ {
+		alloc.markFrame(poolIndex, frame, FrameReserved, OwnerKernel)
+	}
+
+	if alloc.poison {
+		alloc.poisonFrames(startFrame+stateFrames, endFrame-startFrame-stateFrames+1)
+	}
+
+	for frame := startFrame + stateFrames; frame <= endFrame; frame++ {
+		pool.addFreeBlock(frame, 0)
+	}
+
+	kfmt.Printf("[buddy_alloc] added memory range [0x%16x - 0x%16x], pages: %d\n",
+		startFrame.Address(),
+		endFrame.Address()+uintptr(mem.PageSize-1),
+		uint32(endFrame-startFrame+1),
+	)
+	return nil
+}
+
+// enablePoisoning fills all free frames with the mem.PoisonFree pattern and
+// enables poisoning for any frames that are released in the future.
+func (alloc *BuddyAllocator) enablePoisoning() {
+	freePC := mem.CallerPC()
+	for poolIndex := range alloc.pools {
+		pool := &alloc.pools[poolIndex]
+		for frame := pool.startFrame; frame <= pool.endFrame; frame++ {
+			if !alloc.isReserved(poolIndex, frame) {
+				mem.Poison(physToVirtFn(frame.Address()), mem.PageSize, freePC)
+			}
+		}
+	}
+
+	alloc.poison = true
+}
+
+// poisonFrames fills a range of frames that is about to be released with
+// the mem.PoisonFree pattern. The frame contents are accessed via the
+// physmap.
+func (alloc *BuddyAllocator) poisonFrames(startFrame, frameCount pmm.Frame) {
+	freePC := mem.CallerPC()
+	for frame := startFrame; frame < startFrame+frameCount; frame++ {
+		mem.Poison(physToVirtFn(frame.Address()), mem.PageSize, freePC)
+	}
+}
+
+// checkPoisonedFrames reports any modifications to the poison pattern of a
+// range of frames that has just been allocated. Such modifications indicate
+// that the frames were accessed after being released.
+func (alloc *BuddyAllocator) checkPoisonedFrames(startFrame, frameCount pmm.Frame) {
+	allocPC := mem.CallerPC()
+	for frame := startFrame; frame < startFrame+frameCount; frame++ {
+		mem.CheckPoison("buddy_alloc", physToVirtFn(frame.Address()), mem.PageSize, allocPC)
+	}
+}
+
+func (alloc *BuddyAllocator) printStats() {
+	kfmt.Printf(
+		"[buddy_alloc] page stats: free: %d/%d (%d reserved)\n",
+		alloc.totalPages-alloc.reservedPages,
+		alloc.totalPages,
+		alloc.reservedPages,
+	)
+}
+
+// AllocFrame reserves and returns a physical memory frame. An error will be
+// returned if no more memory can be allocated.
+func (alloc *BuddyAllocator) AllocFrame() (pmm.Frame, *kernel.Error) {
+	return alloc.AllocFrames(0)
+}
+
+// AllocFrames reserves a block of 2^order contiguous physical memory frames
+// and returns the first frame in the block. The returned frame is always
+// aligned to a 2^order frame boundary. An error will be returned if order
+// exceeds MaxOrder or if no contiguous block of the requested size is
+// available.
+func (alloc *BuddyAllocator) AllocFrames(order uint8) (pmm.Frame, *kernel.Error) {
+	return alloc.AllocFramesBelow(order, pmm.InvalidFrame)
+}
+
+// AllocFramesBelow behaves like AllocFrames but only returns blocks whose
+// frames are all less than or equal to maxFrame. It allows callers to
+// allocate memory that is addressable by devices with a limited address
+// width.
+func (alloc *BuddyAllocator) AllocFramesBelow(order uint8, maxFrame pmm.Frame) (pmm.Frame, *kernel.Error) {
+	return alloc.allocFrames(order, maxFrame, OwnerUnknown)
+}
+
+// AllocFrameFor behaves like AllocFrame but also tags the allocated frame
+// with the supplied owner so that it is accounted to the right subsystem by
+// the memory statistics.
+func (alloc *BuddyAllocator) AllocFrameFor(owner FrameOwner) (pmm.Frame, *kernel.Error) {
+	return alloc.allocFrames(0, pmm.InvalidFrame, owner)
+}
+
+// allocFrames reserves a block of 2^order contiguous frames that do not
+// exceed maxFrame and assigns them to the supplied owner. If no suitable
+// block is available, allocFrames asks the registered mem reclaimers to
+// release memory and retries the request once. In both cases, the mem low
+// memory listeners are notified about the outcome.
+func (alloc *BuddyAllocator) allocFrames(order uint8, maxFrame pmm.Frame, owner FrameOwner) (pmm.Frame, *kernel.Error) {
+	if order > MaxOrder {
+		return pmm.InvalidFrame, errBuddyAllocInvalidOrder
+	}
+
+	startFrame := alloc.allocFromPools(order, maxFrame, owner)
+	if startFrame.Valid() {
+		return startFrame, nil
+	}
+
+	event := alloc.reclaim(uint32(1) << order)
+	if event.ReclaimedFrames != 0 {
+		startFrame = alloc.allocFromPools(order, maxFrame, owner)
+	}
+
+	event.Recovered = startFrame.Valid()
+	notifyLowMemoryFn(event)
+	if !event.Recovered {
+		return pmm.InvalidFrame, errBuddyAllocOutOfMemory
+	}
+
+	return startFrame, nil
+}
+
+// allocFromPools attempts to reserve a block of 2^order contiguous frames
+// that do not exceed maxFrame from any of the available pools. It returns
+// pmm.InvalidFrame if no pool can service the request.
+func (alloc *BuddyAllocator) allocFromPools(order uint8, maxFrame pmm.Frame, owner FrameOwner) pmm.Frame {
+	for poolIndex := 0; poolIndex < len(alloc.pools); poolIndex++ {
+		if startFrame := alloc.allocFromPool(poolIndex, order, maxFrame, owner); startFrame.Valid() {
+			return startFrame
+		}
+	}
+
+	return pmm.InvalidFrame
+}
+
+// reclaim is invoked when a request for frameCount contiguous frames cannot
+// be serviced. It asks the registered reclaimers to release memory and
+// returns a low memory event describing the outcome. As reclaimers may need
+// to allocate memory themselves, allocation failures while a reclaim is in
+// progress do not trigger another reclaim.
+func (alloc *BuddyAllocator) reclaim(frameCount uint32) mem.LowMemoryEvent {
+	event := mem.LowMemoryEvent{RequestedFrames: frameCount}
+	if !alloc.reclaiming {
+		alloc.reclaiming = true
+		event.ReclaimedFrames = reclaimFn()
+		alloc.reclaiming = false
+	}
+
+	return event
+}
+
+// AllocFrameOnNode reserves and returns a physical memory frame that belongs
+// to the requested NUMA node. If the node has no free frames, the frame is
+// allocated from any of the remaining nodes instead. Like AllocFrames, memory
+// is reclaimed before failing the request.
+func (alloc *BuddyAllocator) AllocFrameOnNode(node NodeID) (pmm.Frame, *kernel.Error) {
+	frame := alloc.allocFromNode(node)
+	if frame.Valid() {
+		return frame, nil
+	}
+
+	event := alloc.reclaim(1)
+	if event.ReclaimedFrames != 0 {
+		frame = alloc.allocFromNode(node)
+	}
+
+	event.Recovered = frame.Valid()
+	notifyLowMemoryFn(event)
+	if !event.Recovered {
+		return pmm.InvalidFrame, errBuddyAllocOutOfMemory
+	}
+
+	return frame, nil
+}
+
+// allocFromNode attempts to reserve a frame from the pools of the requested
+// NUMA node and then falls back to the pools of the remaining nodes. It
+// returns pmm.InvalidFrame if no pool can service the request.
+func (alloc *BuddyAllocator) allocFromNode(node NodeID) pmm.Frame {
+	for _, localPass := range [2]bool{true, false} {
+		for poolIndex := 0; poolIndex < len(alloc.pools); poolIndex++ {
+			if (alloc.pools[poolIndex].node == node) != localPass {
+				continue
+			}
+
+			if frame := alloc.allocFromPool(poolIndex, 0, pmm.InvalidFrame, OwnerUnknown); frame.Valid() {
+				return frame
+			}
+		}
+	}
+
+	return pmm.InvalidFrame
+}
+
+// allocFromPool attempts to reserve a block of 2^order contiguous frames
+// that do not exceed maxFrame from the specified pool and assigns them to
+// the supplied owner. It returns pmm.InvalidFrame if the pool cannot service
+// the request.
+func (alloc *BuddyAllocator) allocFromPool(poolIndex int, order uint8, maxFrame pmm.Frame, owner FrameOwner) pmm.Frame {
+	frameCount := pmm.Frame(1) << order
+	if alloc.pools[poolIndex].freeCount < uint32(frameCount) || alloc.pools[poolIndex].startFrame > maxFrame {
+		return pmm.InvalidFrame
+	}
+
+	startFrame := alloc.pools[poolIndex].takeFreeBlock(order, maxFrame)
+	if !startFrame.Valid() {
+		return pmm.InvalidFrame
+	}
+
+	for frame := startFrame; frame < startFrame+frameCount; frame++ {
+		alloc.markFrame(poolIndex, frame, FrameAllocated, owner)
+	}
+
+	if alloc.poison {
+		alloc.checkPoisonedFrames(startFrame, frameCount)
+	}
+
+	return startFrame
+}
+
+// AssignNode associates the pools whose first frame falls within the
+// [startAddr, startAddr+size) physical address range with the supplied NUMA
+// node. It is meant to be invoked by the code that parses the firmware memory
+// affinity information (e.g. the ACPI SRAT table). As pools are never split,
+// a pool that spans the ranges of multiple nodes is assigned to the node
+// that contains its first frame.
+func (alloc *BuddyAllocator) AssignNode(startAddr uintptr, size mem.Size, node NodeID) {
+	for poolIndex := range alloc.pools {
+		if poolAddr := alloc.pools[poolIndex].startFrame.Address(); poolAddr >= startAddr && poolAddr-startAddr < uintptr(size) {
+			alloc.pools[poolIndex].node = node
+		}
+	}
+}
+
+// FreeFrame releases a frame previously allocated via a call to AllocFrame.
+// Trying to release a frame not part of the allocator pools or a frame that
+// is already marked as free will cause an error to be returned.
+func (alloc *BuddyAllocator) FreeFrame(frame pmm.Frame) *kernel.Error {
+	return alloc.FreeFrames(frame, 0)
+}
+
+// FreeFrames releases a block of 2^order frames previously allocated via a
+// call to AllocFrames and coalesces it with any free buddy blocks. Trying to
+// release a block that is not aligned to a 2^order frame boundary, is not
+// fully contained in one of the allocator pools or contains frames that are
+// already marked as free will cause an error to be returned.
+func (alloc *BuddyAllocator) FreeFrames(startFrame pmm.Frame, order uint8) *kernel.Error {
+	if order > MaxOrder {
+		return errBuddyAllocInvalidOrder
+	}
+
+	poolIndex := alloc.poolForFrame(startFrame)
+	if poolIndex < 0 {
+		return errBuddyAllocFrameNotManaged
+	}
+
+	frameCount := pmm.Frame(1) << order
+	if startFrame&(frameCount-1) != 0 {
+		return errBuddyAllocMisalignedFrame
+	}
+
+	endFrame := startFrame + frameCount - 1
+	if endFrame > alloc.pools[poolIndex].endFrame {
+		return errBuddyAllocFrameNotManaged
+	}
+
+	for frame := startFrame; frame <= endFrame; frame++ {
+		// Callers that release frames while cleaning up after another
+		// error tend to ignore the returned error so double frees are
+		// also reported to the console.
+		if !alloc.isReserved(poolIndex, frame) {
+			kfmt.Printf("[buddy_alloc] double free of frame 0x%x (block: 0x%x, order: %d)\n", frame.Address(), startFrame.Address(), order)
+			return errBuddyAllocDoubleFree
+		}
+
+		if alloc.pools[poolIndex].frames[frame-alloc.pools[poolIndex].startFrame].extraRefs != 0 {
+			return errBuddyAllocFrameShared
+		}
+	}
+
+	if alloc.poison {
+		alloc.poisonFrames(startFrame, frameCount)
+	}
+
+	for frame := startFrame; frame <= endFrame; frame++ {
+		alloc.markFrame(poolIndex, frame, FrameFree, OwnerUnknown)
+	}
+	alloc.pools[poolIndex].addFreeBlock(startFrame, order)
+
+	return nil
+}
+
+// ReserveFrames withdraws the free frames in the [startFrame, endFrame] range
+// from the allocator pools and marks them as reserved. Frames that are not
+// managed by the allocator (e.g. frames in reserved memory regions) are
+// ignored. An error is returned and no frames are reserved if any managed
+// frame in the range is not free.
+func (alloc *BuddyAllocator) ReserveFrames(startFrame, endFrame pmm.Frame) *kernel.Error {
+	for frame := startFrame; frame <= endFrame; frame++ {
+		if poolIndex := alloc.poolForFrame(frame); poolIndex >= 0 && alloc.isReserved(poolIndex, frame) {
+			return errBuddyAllocFrameInUse
+		}
+	}
+
+	for frame := startFrame; frame <= endFrame; frame++ {
+		if poolIndex := alloc.poolForFrame(frame); poolIndex >= 0 {
+			alloc.pools[poolIndex].takeFrame(frame)
+			alloc.markFrame(poolIndex, frame, FrameReserved, OwnerReserved)
+		}
+	}
+
+	return nil
+}
+
+// ShareFrame adds a reference to a frame previously allocated via a call to
+// AllocFrame or AllocFrames. Shared frames are only released when all their
+// references are dropped via calls to ReleaseFrame.
+func (alloc *BuddyAllocator) ShareFrame(frame pmm.Frame) *kernel.Error {
+	pool, err := alloc.poolForAllocatedFrame(frame)
+	if err != nil {
+		return err
+	}
+
+	info := &pool.frames[frame-pool.startFrame]
+	if info.extraRefs == math.MaxUint16 {
+		return errBuddyAllocRefOverflow
+	}
+
+	info.extraRefs++
+	return nil
+}
+
+// ReleaseFrame drops a reference to an allocated frame. If this was the last
+// reference to the frame, the frame is released as if FreeFrame was called.
+func (alloc *BuddyAllocator) ReleaseFrame(frame pmm.Frame) *kernel.Error {
+	pool, err := alloc.poolForAllocatedFrame(frame)
+	if err != nil {
+		return err
+	}
+
+	if info := &pool.frames[frame-pool.startFrame]; info.extraRefs != 0 {
+		info.extraRefs--
+		return nil
+	}
+
+	return alloc.FreeFrames(frame, 0)
+}
+
+// RefCount returns the number of references to an allocated frame. If the
+// frame is free or not managed by the allocator, RefCount returns 0.
+func (alloc *BuddyAllocator) RefCount(frame pmm.Frame) uint32 {
+	pool, err := alloc.poolForAllocatedFrame(frame)
+	if err != nil {
+		return 0
+	}
+
+	return pool.frames[frame-pool.startFrame].RefCount()
+}
+
+// LookupFrame returns the metadata for a frame managed by the allocator.
+func (alloc *BuddyAllocator) LookupFrame(frame pmm.Frame) (FrameInfo, *kernel.Error) {
+	poolIndex := alloc.poolForFrame(frame)
+	if poolIndex < 0 {
+		return FrameInfo{}, errBuddyAllocFrameNotManaged
+	}
+
+	return alloc.pools[poolIndex].frames[frame-alloc.pools[poolIndex].startFrame], nil
+}
+
+// SetOwner updates the owner of a block of 2^order frames previously
+// allocated via a call to AllocFrames. An error is returned and no frames are
+// updated if any frame in the block is not currently allocated.
+func (alloc *BuddyAllocator) SetOwner(startFrame pmm.Frame, order uint8, owner FrameOwner) *kernel.Error {
+	endFrame := startFrame + pmm.Frame(1)<<order - 1
+	for frame := startFrame; frame <= endFrame; frame++ {
+		if _, err := alloc.poolForAllocatedFrame(frame); err != nil {
+			return err
+		}
+	}
+
+	for frame := startFrame; frame <= endFrame; frame++ {
+		pool, _ := alloc.poolForAllocatedFrame(frame)
+		pool.frames[frame-pool.startFrame].Owner = owner
+	}
+
+	return nil
+}
+
+// collectStats populates the frame counts, per-pool zone breakdown and
+// per-owner frame usage of the supplied mem.Usage value.
+func (alloc *BuddyAllocator) collectStats(usage *mem.Usage) {
+	var ownerFrames [numFrameOwners]uint32
+
+	usage.TotalFrames = alloc.totalPages
+	usage.UsedFrames = alloc.reservedPages
+	usage.FreeFrames = alloc.totalPages - alloc.reservedPages
+
+	for poolIndex := 0; poolIndex < len(alloc.pools); poolIndex++ {
+		pool := &alloc.pools[poolIndex]
+		usage.Zones = append(usage.Zones, mem.ZoneUsage{
+			StartAddr:   pool.startFrame.Address(),
+			EndAddr:     pool.endFrame.Address() + uintptr(mem.PageSize-1),
+			TotalFrames: uint32(pool.endFrame-pool.startFrame) + 1,
+			FreeFrames:  pool.freeCount,
+		})
+
+		for _, info := range pool.frames {
+			if info.State != FrameFree && info.Owner < numFrameOwners {
+				ownerFrames[info.Owner]++
+			}
+		}
+	}
+
+	for owner, frames := range ownerFrames {
+		if frames != 0 {
+			usage.Owners = append(usage.Owners, mem.OwnerUsage{Owner: FrameOwner(owner).String(), Frames: frames})
+		}
+	}
+}
+
+// poolForAllocatedFrame returns the pool that contains the supplied frame. An
+// error is returned if the frame is not managed by the allocator or if it is
+// not currently allocated.
+func (alloc *BuddyAllocator) poolForAllocatedFrame(frame pmm.Frame) (*framePool, *kernel.Error) {
+	poolIndex := alloc.poolForFrame(frame)
+	if poolIndex < 0 {
+		return nil, errBuddyAllocFrameNotManaged
+	}
+
+	if !alloc.isReserved(poolIndex, frame) {
+		return nil, errBuddyAllocFrameNotInUse
+	}
+
+	return &alloc.pools[poolIndex], nil
+}
+
+// earlyAllocFrame is a helper that delegates a frame allocation request to the
+// early allocator instance. This function is passed as an argument to
+// vmm.SetFrameAllocator instead of earlyAllocator.AllocFrame. The latter
+// confuses the compiler's escape analysis into thinking that
+// earlyAllocator.Frame escapes to heap.
+func earlyAllocFrame() (pmm.Frame, *kernel.Error) {
+	return earlyAllocator.AllocFrame()
+}
+
+// AllocFrame is a helper that delegates a frame allocation request to the
+// buddy allocator instance.
+func AllocFrame() (pmm.Frame, *kernel.Error) {
+	return buddyAllocator.AllocFrame()
+}
+
+// FreeFrame is a helper that delegates a request for releasing a frame to
+// the buddy allocator instance.
+func FreeFrame(frame pmm.Frame) *kernel.Error {
+	return buddyAllocator.FreeFrame(frame)
+}
+
+// AllocFrameFor is a helper that delegates a request for allocating a frame
+// on behalf of the supplied owner to the buddy allocator instance.
+func AllocFrameFor(owner FrameOwner) (pmm.Frame, *kernel.Error) {
+	return buddyAllocator.AllocFrameFor(owner)
+}
+
+// AllocFrameOnNode is a helper that delegates a request for allocating a
+// frame on the supplied NUMA node to the buddy allocator instance.
+func AllocFrameOnNode(node NodeID) (pmm.Frame, *kernel.Error) {
+	return buddyAllocator.AllocFrameOnNode(node)
+}
+
+// AssignNode is a helper that delegates a request for associating a physical
+// address range with a NUMA node to the buddy allocator instance.
+func AssignNode(startAddr uintptr, size mem.Size, node NodeID) {
+	buddyAllocator.AssignNode(startAddr, size, node)
+}
+
+// allocVMMFrame is passed to vmm.SetFrameAllocator so that the frames
+// allocated by the vmm package are accounted to OwnerVMM.
+func allocVMMFrame() (pmm.Frame, *kernel.Error) {
+	return buddyAllocator.AllocFrameFor(OwnerVMM)
+}
+
+// collectStats is registered as a mem stats collector and delegates the
+// collection of frame statistics to the buddy allocator instance.
+func collectStats(usage *mem.Usage) {
+	buddyAllocator.collectStats(usage)
+}
+
+// AllocFrames is a helper that delegates a request for allocating a block of
+// 2^order contiguous frames to the buddy allocator instance.
+func AllocFrames(order uint8) (pmm.Frame, *kernel.Error) {
+	return buddyAllocator.AllocFrames(order)
+}
+
+// AllocFramesBelow is a helper that delegates a request for allocating a
+// block of 2^order contiguous frames that do not exceed maxFrame to the buddy
+// allocator instance.
+func AllocFramesBelow(order uint8, maxFrame pmm.Frame) (pmm.Frame, *kernel.Error) {
+	return buddyAllocator.AllocFramesBelow(order, maxFrame)
+}
+
+// FreeFrames is a helper that delegates a request for releasing a block of
+// 2^order contiguous frames to the buddy allocator instance.
+func FreeFrames(startFrame pmm.Frame, order uint8) *kernel.Error {
+	return buddyAllocator.FreeFrames(startFrame, order)
+}
+
+// ReserveFrames is a helper that delegates a request for withdrawing a range
+// of free frames to the buddy allocator instance.
+func ReserveFrames(startFrame, endFrame pmm.Frame) *kernel.Error {
+	return buddyAllocator.ReserveFrames(startFrame, endFrame)
+}
+
+// ShareFrame is a helper that delegates a request for adding a reference to
+// an allocated frame to the buddy allocator instance.
+func ShareFrame(frame pmm.Frame) *kernel.Error {
+	return buddyAllocator.ShareFrame(frame)
+}
+
+// ReleaseFrame is a helper that delegates a request for dropping a reference
+// to an allocated frame to the buddy allocator instance.
+func ReleaseFrame(frame pmm.Frame) *kernel.Error {
+	return buddyAllocator.ReleaseFrame(frame)
+}
+
+// RefCount is a helper that queries the buddy allocator instance for the
+// number of references to an allocated frame.
+func RefCount(frame pmm.Frame) uint32 {
+	return buddyAllocator.RefCount(frame)
+}
+
+// LookupFrame is a helper that queries the buddy allocator instance for the
+// metadata of a frame.
+func LookupFrame(frame pmm.Frame) (FrameInfo, *kernel.Error) {
+	return buddyAllocator.LookupFrame(frame)
+}
+
+// SetOwner is a helper that delegates a request for updating the owner of an
+// allocated block of 2^order frames to the buddy allocator instance.
+func SetOwner(startFrame pmm.Frame, order uint8, owner FrameOwner) *kernel.Error {
+	return buddyAllocator.SetOwner(startFrame, order, owner)
+}
+
+// AddMemory is a helper that delegates a request for adding a hot-added
+// physical memory range to the buddy allocator instance.
+func AddMemory(startAddr uintptr, size mem.Size) *kernel.Error {
+	return buddyAllocator.AddMemory(startAddr, size)
+}
+
+// EnablePoisoning enables the detection of accesses to released frames. Once
+// enabled, free frames are filled with the mem.PoisonFree pattern which gets
+// checked whenever the frames are allocated. As the frame contents are
+// accessed via the physmap, EnablePoisoning must only be invoked after the
+// vmm package has been initialized.
+func EnablePoisoning() {
+	buddyAllocator.enablePoisoning()
+}
+
+// ReleaseACPIReclaimableRegions makes the frames that belong to ACPI
+// reclaimable memory regions available for allocation. It must only be
+// invoked after the ACPI tables stored in these regions are no longer needed
+// (e.g. when the ACPI driver has finished parsing them or has copied them to
+// kernel-owned memory). Subsequent calls to this function are no-ops.
+func ReleaseACPIReclaimableRegions() {
+	buddyAllocator.releaseReclaimableFrames()
+}
+
+// isPoolRegion returns true if the supplied memory region should be managed
+// by a frame pool.
+func isPoolRegion(region *pmm.Region) bool {
+	if region.Size < mem.PageSize || region.EndFrame() < region.StartFrame() {
+		return false
+	}
+
+	return region.Type == pmm.RegionUsable || region.Type == pmm.RegionACPIReclaimable
+}
+
+// Init sets up the kernel physical memory allocation sub-system.
+func Init(kernelStart, kernelEnd uintptr) *kernel.Error {
+	earlyAllocator.init(kernelStart, kernelEnd)
+	earlyAllocator.printMemoryMap()
+
+	vmm.SetFrameAllocator(earlyAllocFrame)
+	if err := buddyAllocator.init(); err != nil {
+		return err
+	}
+	vmm.SetFrameAllocator(allocVMMFrame)
+	vmm.SetFrameRefCounter(ShareFrame, ReleaseFrame, RefCount)
+	pmm.SetFrameReserver(ReserveFrames)
+
+	return mem.RegisterStatsCollector(collectStats)
+}
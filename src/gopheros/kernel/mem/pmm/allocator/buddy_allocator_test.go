@@ -0,0 +1,1671 @@
+package allocator
+
+import (
+	"bytes"
+	"gopheros/kernel"
+	"gopheros/kernel/hal/multiboot"
+	"gopheros/kernel/kfmt"
+	"gopheros/kernel/mem"
+	"gopheros/kernel/mem/pmm"
+	"gopheros/kernel/mem/vmm"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"unsafe"
+)
+
+func TestBuddyAllocatorSetupPools(t *testing.T) {
+	defer func() {
+		mapFn = vmm.Map
+		reserveRegionFn = vmm.EarlyReserveRegion
+	}()
+
+	multiboot.SetInfoPtr(uintptr(unsafe.Pointer(&multibootMemoryMap[0])))
+
+	// The captured multiboot data corresponds to qemu running with 128M RAM.
+	// The allocator will need to reserve 35 pages to store the block
+	// bitmaps and the frame metadata.
+	var (
+		alloc   BuddyAllocator
+		physMem = make([]byte, 35*mem.PageSize)
+	)
+
+	// Init phys mem with junk
+	for i := 0; i < len(physMem); i++ {
+		physMem[i] = 0xf0
+	}
+
+	mapCallCount := 0
+	mapFn = func(page vmm.Page, frame pmm.Frame, flags vmm.PageTableEntryFlag) *kernel.Error {
+		mapCallCount++
+		return nil
+	}
+
+	reserveCallCount := 0
+	reserveRegionFn = func(_ mem.Size) (uintptr, *kernel.Error) {
+		reserveCallCount++
+		return uintptr(unsafe.Pointer(&physMem[0])), nil
+	}
+
+	if err := alloc.setupPools(); err != nil {
+		t.Fatal(err)
+	}
+
+	if exp := 35; mapCallCount != exp {
+		t.Fatalf("expected allocator to call vmm.Map %d times; called %d", exp, mapCallCount)
+	}
+
+	if exp := 1; reserveCallCount != exp {
+		t.Fatalf("expected allocator to call vmm.EarlyReserveRegion %d times; called %d", exp, reserveCallCount)
+	}
+
+	if exp, got := 2, len(alloc.pools); got != exp {
+		t.Fatalf("expected allocator to initialize %d pools; got %d", exp, got)
+	}
+
+	for poolIndex, pool := range alloc.pools {
+		if expFreeCount := uint32(pool.endFrame - pool.startFrame + 1); pool.freeCount != expFreeCount {
+			t.Errorf("[pool %d] expected free count to be %d; got %d", poolIndex, expFreeCount, pool.freeCount)
+		}
+
+		if exp, got := pool.startFrame&^(1<<MaxOrder-1), pool.baseFrame; got != exp {
+			t.Errorf("[pool %d] expected base frame to be %d; got %d", poolIndex, exp, got)
+		}
+
+		if exp, got := int(pool.freeCount), len(pool.frames); got != exp {
+			t.Errorf("[pool %d] expected frame metadata slice len to be %d; got %d", poolIndex, exp, got)
+		}
+
+		frameWords := (len(pool.frames) + 1) >> 1
+		if exp, got := int(poolStateWords(pool.startFrame, pool.endFrame))-frameWords, len(pool.blockBitmap); got != exp {
+			t.Errorf("[pool %d] expected block bitmap len to be %d; got %d", poolIndex, exp, got)
+		}
+
+		for blockIndex, block := range pool.blockBitmap {
+			if block != 0 {
+				t.Errorf("[pool %d] expected block bitmap block %d to be cleared; got %d", poolIndex, blockIndex, block)
+			}
+		}
+
+		for frameIndex, info := range pool.frames {
+			if info != (FrameInfo{}) {
+				t.Errorf("[pool %d] expected metadata for frame %d to be cleared; got %+v", poolIndex, frameIndex, info)
+				break
+			}
+		}
+	}
+}
+
+func TestBuddyAllocatorSetupPoolsErrors(t *testing.T) {
+	defer func() {
+		mapFn = vmm.Map
+		reserveRegionFn = vmm.EarlyReserveRegion
+	}()
+
+	multiboot.SetInfoPtr(uintptr(unsafe.Pointer(&multibootMemoryMap[0])))
+	var alloc BuddyAllocator
+
+	t.Run("vmm.EarlyReserveRegion returns an error", func(t *testing.T) {
+		expErr := &kernel.Error{Module: "test", Message: "something went wrong"}
+
+		reserveRegionFn = func(_ mem.Size) (uintptr, *kernel.Error) {
+			return 0, expErr
+		}
+
+		if err := alloc.setupPools(); err != expErr {
+			t.Fatalf("expected to get error: %v; got %v", expErr, err)
+		}
+	})
+	t.Run("vmm.Map returns an error", func(t *testing.T) {
+		expErr := &kernel.Error{Module: "test", Message: "something went wrong"}
+
+		reserveRegionFn = func(_ mem.Size) (uintptr, *kernel.Error) {
+			return 0, nil
+		}
+
+		mapFn = func(page vmm.Page, frame pmm.Frame, flags vmm.PageTableEntryFlag) *kernel.Error {
+			return expErr
+		}
+
+		if err := alloc.setupPools(); err != expErr {
+			t.Fatalf("expected to get error: %v; got %v", expErr, err)
+		}
+	})
+
+	t.Run("earlyAllocator returns an error", func(t *testing.T) {
+		emptyInfoData := []byte{
+			0, 0, 0, 0, // size
+			0, 0, 0, 0, // reserved
+			0, 0, 0, 0, // tag with type zero and length zero
+			0, 0, 0, 0,
+		}
+
+		multiboot.SetInfoPtr(uintptr(unsafe.Pointer(&emptyInfoData[0])))
+
+		if err := alloc.setupPools(); err != errBootAllocOutOfMemory {
+			t.Fatalf("expected to get error: %v; got %v", errBootAllocOutOfMemory, err)
+		}
+	})
+}
+
+func TestBuddyAllocatorMarkFrame(t *testing.T) {
+	var alloc = BuddyAllocator{
+		pools: []framePool{
+			{
+				startFrame: pmm.Frame(0),
+				endFrame:   pmm.Frame(127),
+				freeCount:  128,
+				frames:     make([]FrameInfo, 128),
+			},
+		},
+		totalPages: 128,
+	}
+
+	lastFrame := pmm.Frame(alloc.totalPages)
+	for frame := pmm.Frame(0); frame < lastFrame; frame++ {
+		alloc.markFrame(0, frame, FrameReserved, OwnerKernel)
+
+		if exp, got := (FrameInfo{State: FrameReserved, Owner: OwnerKernel}), alloc.pools[0].frames[frame]; got != exp {
+			t.Errorf("[frame %d] expected frame metadata to be %+v; got %+v", frame, exp, got)
+		}
+
+		if exp, got := uint32(127), alloc.pools[0].freeCount; got != exp {
+			t.Errorf("[frame %d] expected free count to be %d; got %d", frame, exp, got)
+		}
+
+		alloc.markFrame(0, frame, FrameFree, OwnerUnknown)
+
+		if exp, got := (FrameInfo{}), alloc.pools[0].frames[frame]; got != exp {
+			t.Errorf("[frame %d] expected frame metadata to be %+v; got %+v", frame, exp, got)
+		}
+	}
+
+	// Calling markFrame with a frame not part of the pool should be a no-op
+	alloc.markFrame(0, pmm.Frame(0xbadf00d), FrameAllocated, OwnerUnknown)
+	for frameIndex, info := range alloc.pools[0].frames {
+		if info.State != FrameFree {
+			t.Errorf("expected all frames to be free; frame %d is %s", frameIndex, info.State)
+		}
+	}
+
+	// Calling markFrame with a negative pool index should be a no-op
+	alloc.markFrame(-1, pmm.Frame(0), FrameAllocated, OwnerUnknown)
+	for frameIndex, info := range alloc.pools[0].frames {
+		if info.State != FrameFree {
+			t.Errorf("expected all frames to be free; frame %d is %s", frameIndex, info.State)
+		}
+	}
+
+	if exp, got := uint32(128), alloc.pools[0].freeCount; got != exp {
+		t.Errorf("expected free count to be %d; got %d", exp, got)
+	}
+}
+
+func TestBuddyAllocatorPoolForFrame(t *testing.T) {
+	var alloc = BuddyAllocator{
+		pools: []framePool{
+			{
+				startFrame: pmm.Frame(0),
+				endFrame:   pmm.Frame(63),
+				freeCount:  64,
+				frames:     make([]FrameInfo, 64),
+			},
+			{
+				startFrame: pmm.Frame(128),
+				endFrame:   pmm.Frame(191),
+				freeCount:  64,
+				frames:     make([]FrameInfo, 64),
+			},
+		},
+		totalPages: 128,
+	}
+
+	specs := []struct {
+		frame    pmm.Frame
+		expIndex int
+	}{
+		{pmm.Frame(0), 0},
+		{pmm.Frame(63), 0},
+		{pmm.Frame(64), -1},
+		{pmm.Frame(128), 1},
+		{pmm.Frame(192), -1},
+	}
+
+	for specIndex, spec := range specs {
+		if got := alloc.poolForFrame(spec.frame); got != spec.expIndex {
+			t.Errorf("[spec %d] expected to get pool index %d; got %d", specIndex, spec.expIndex, got)
+		}
+	}
+}
+
+func TestBuddyAllocatorRetireEarlyAllocatorKernelFrames(t *testing.T) {
+	defer func() {
+		earlyAllocator = bootMemAllocator{}
+	}()
+
+	var alloc = BuddyAllocator{
+		pools: []framePool{
+			{
+				startFrame: pmm.Frame(0),
+				endFrame:   pmm.Frame(7),
+				freeCount:  8,
+				frames:     make([]FrameInfo, 8),
+			},
+			{
+				startFrame: pmm.Frame(64),
+				endFrame:   pmm.Frame(191),
+				freeCount:  128,
+				frames:     make([]FrameInfo, 128),
+			},
+		},
+		totalPages: 136,
+	}
+
+	// kernel occupies 16 frames and starts at the beginning of pool 1
+	earlyAllocator = bootMemAllocator{}
+	earlyAllocator.kernelStartFrame = pmm.Frame(64)
+	earlyAllocator.kernelEndFrame = pmm.Frame(79)
+	kernelSizePages := uint32(earlyAllocator.kernelEndFrame - earlyAllocator.kernelStartFrame + 1)
+	if leaked := earlyAllocator.Retire(&alloc); leaked != 0 {
+		t.Fatalf("expected no leaked frames; got %d", leaked)
+	}
+
+	if exp, got := kernelSizePages, alloc.reservedPages; got != exp {
+		t.Fatalf("expected reserved page counter to be %d; got %d", exp, got)
+	}
+
+	if exp, got := uint32(8), alloc.pools[0].freeCount; got != exp {
+		t.Fatalf("expected free count for pool 0 to be %d; got %d", exp, got)
+	}
+
+	if exp, got := 128-kernelSizePages, alloc.pools[1].freeCount; got != exp {
+		t.Fatalf("expected free count for pool 1 to be %d; got %d", exp, got)
+	}
+
+	// The first 16 frames in pool 1 should be reserved for the kernel
+	for frameIndex, info := range alloc.pools[1].frames {
+		exp := FrameInfo{}
+		if frameIndex < 16 {
+			exp = FrameInfo{State: FrameReserved, Owner: OwnerKernel}
+		}
+
+		if info != exp {
+			t.Fatalf("expected metadata for frame %d in pool 1 to be %+v; got %+v", frameIndex, exp, info)
+		}
+	}
+}
+
+func TestBuddyAllocatorRetireEarlyAllocatorFrames(t *testing.T) {
+	defer func() {
+		earlyAllocator = bootMemAllocator{}
+	}()
+
+	var alloc = BuddyAllocator{
+		pools: []framePool{
+			{
+				startFrame: pmm.Frame(0),
+				endFrame:   pmm.Frame(63),
+				freeCount:  64,
+				frames:     make([]FrameInfo, 64),
+			},
+			{
+				startFrame: pmm.Frame(64),
+				endFrame:   pmm.Frame(191),
+				freeCount:  128,
+				frames:     make([]FrameInfo, 128),
+			},
+		},
+		totalPages: 64,
+	}
+
+	multiboot.SetInfoPtr(uintptr(unsafe.Pointer(&multibootMemoryMap[0])))
+
+	// Simulate 16 allocations made using the early allocator in region 0
+	// as reported by the multiboot data and move the kernel to pool 1
+	allocCount := uint32(16)
+	earlyAllocator = bootMemAllocator{allocCount: uint64(allocCount)}
+	earlyAllocator.kernelStartFrame = pmm.Frame(256)
+	earlyAllocator.kernelEndFrame = pmm.Frame(256)
+	if leaked := earlyAllocator.Retire(&alloc); leaked != 0 {
+		t.Fatalf("expected no leaked frames; got %d", leaked)
+	}
+
+	if exp, got := allocCount, alloc.reservedPages; got != exp {
+		t.Fatalf("expected reserved page counter to be %d; got %d", exp, got)
+	}
+
+	if exp, got := 64-allocCount, alloc.pools[0].freeCount; got != exp {
+		t.Fatalf("expected free count for pool 0 to be %d; got %d", exp, got)
+	}
+
+	if exp, got := uint32(128), alloc.pools[1].freeCount; got != exp {
+		t.Fatalf("expected free count for pool 1 to be %d; got %d", exp, got)
+	}
+
+	// The first 16 frames in pool 0 should be reserved for the kernel
+	for frameIndex, info := range alloc.pools[0].frames {
+		exp := FrameInfo{}
+		if frameIndex < 16 {
+			exp = FrameInfo{State: FrameReserved, Owner: OwnerKernel}
+		}
+
+		if info != exp {
+			t.Fatalf("expected metadata for frame %d in pool 0 to be %+v; got %+v", frameIndex, exp, info)
+		}
+	}
+
+	// Once retired, the early allocator should reject any allocations
+	if _, err := earlyAllocator.AllocFrame(); err != errBootAllocRetired {
+		t.Fatalf("expected error errBootAllocRetired; got %v", err)
+	}
+}
+
+func TestBuddyAllocatorRetireEarlyAllocatorLeaks(t *testing.T) {
+	defer func() {
+		earlyAllocator = bootMemAllocator{}
+	}()
+
+	var alloc = BuddyAllocator{
+		pools: []framePool{
+			newTestPool(pmm.Frame(0), pmm.Frame(7)),
+		},
+		totalPages: 8,
+	}
+
+	multiboot.SetInfoPtr(uintptr(unsafe.Pointer(&multibootMemoryMap[0])))
+
+	// Frame 0 is already reserved and frames 8-15 are not tracked by any
+	// pool; these frames cannot be handed off
+	alloc.markFrame(0, pmm.Frame(0), FrameReserved, OwnerACPI)
+	earlyAllocator = bootMemAllocator{allocCount: 16}
+	earlyAllocator.kernelStartFrame = pmm.Frame(256)
+	earlyAllocator.kernelEndFrame = pmm.Frame(256)
+
+	if exp, got := uint64(9), earlyAllocator.Retire(&alloc); got != exp {
+		t.Fatalf("expected %d leaked frames; got %d", exp, got)
+	}
+
+	if exp, got := uint32(8), alloc.reservedPages; got != exp {
+		t.Fatalf("expected reserved page counter to be %d; got %d", exp, got)
+	}
+}
+
+func TestBuddyAllocatorRetireEarlyAllocatorReservedFrames(t *testing.T) {
+	defer func() {
+		earlyAllocator = bootMemAllocator{}
+		reservationOwnerFn = pmm.ReservationOwner
+	}()
+
+	var alloc = BuddyAllocator{
+		pools: []framePool{
+			newTestPool(pmm.Frame(0), pmm.Frame(7)),
+		},
+		totalPages: 8,
+	}
+
+	multiboot.SetInfoPtr(uintptr(unsafe.Pointer(&multibootMemoryMap[0])))
+
+	// Frames skipped by the early allocator because they were reserved
+	// via pmm.ReserveRange should neither be handed off nor leaked
+	reservationOwnerFn = func(frame pmm.Frame) (string, bool) {
+		return "test", frame == 2
+	}
+	earlyAllocator = bootMemAllocator{allocCount: 4}
+	earlyAllocator.kernelStartFrame = pmm.Frame(256)
+	earlyAllocator.kernelEndFrame = pmm.Frame(256)
+
+	if leaked := earlyAllocator.Retire(&alloc); leaked != 0 {
+		t.Fatalf("expected no leaked frames; got %d", leaked)
+	}
+
+	if exp, got := uint32(3), alloc.reservedPages; got != exp {
+		t.Fatalf("expected reserved page counter to be %d; got %d", exp, got)
+	}
+
+	if info := alloc.pools[0].frames[2]; info.State != FrameFree {
+		t.Fatalf("expected reserved range frame not to be handed off; got %+v", info)
+	}
+}
+
+func TestBuddyAllocatorReserveRangeFrames(t *testing.T) {
+	defer func() {
+		reservationsFn = pmm.Reservations
+	}()
+
+	var alloc = BuddyAllocator{
+		pools: []framePool{
+			newTestPool(pmm.Frame(0), pmm.Frame(63)),
+		},
+		totalPages: 64,
+	}
+
+	reservationsFn = func() []pmm.Reservation {
+		return []pmm.Reservation{
+			{PhysAddress: 0x4800, Size: mem.PageSize, Owner: "trampoline"},
+			{PhysAddress: 0xfd000000, Size: mem.PageSize, Owner: "framebuffer"},
+		}
+	}
+
+	// Frames that are already in use are not updated and frames outside
+	// the pools are ignored
+	alloc.markFrame(0, pmm.Frame(5), FrameReserved, OwnerKernel)
+	alloc.reserveRangeFrames()
+	alloc.populateFreeBlocks()
+
+	if exp, got := uint32(2), alloc.reservedPages; got != exp {
+		t.Fatalf("expected reserved page counter to be %d; got %d", exp, got)
+	}
+
+	specs := []struct {
+		frame pmm.Frame
+		exp   FrameInfo
+	}{
+		{3, FrameInfo{}},
+		{4, FrameInfo{State: FrameReserved, Owner: OwnerReserved}},
+		{5, FrameInfo{State: FrameReserved, Owner: OwnerKernel}},
+		{6, FrameInfo{}},
+	}
+
+	for specIndex, spec := range specs {
+		if got := alloc.pools[0].frames[spec.frame]; got != spec.exp {
+			t.Errorf("[spec %d] expected metadata for frame %d to be %+v; got %+v", specIndex, spec.frame, spec.exp, got)
+		}
+	}
+}
+
+func TestBuddyAllocatorReserveFrames(t *testing.T) {
+	defer func(origAlloc BuddyAllocator) {
+		buddyAllocator = origAlloc
+	}(buddyAllocator)
+
+	buddyAllocator = BuddyAllocator{
+		pools: []framePool{
+			newTestPool(pmm.Frame(0), pmm.Frame(63)),
+		},
+		totalPages: 64,
+	}
+	buddyAllocator.populateFreeBlocks()
+	pool := &buddyAllocator.pools[0]
+
+	// Frames outside the allocator pools are ignored
+	if err := ReserveFrames(pmm.Frame(5), pmm.Frame(6)); err != nil {
+		t.Fatal(err)
+	}
+	if err := ReserveFrames(pmm.Frame(0xfd000), pmm.Frame(0xfd2ff)); err != nil {
+		t.Fatal(err)
+	}
+
+	if exp, got := uint32(62), pool.freeCount; got != exp {
+		t.Fatalf("expected free count to be %d; got %d", exp, got)
+	}
+
+	// expected free blocks:
+	// [0, 3]: order 2
+	// [4]: order 0
+	// [7]: order 0
+	// [8, 15]: order 3
+	// [16, 31]: order 4
+	// [32, 63]: order 5
+	expFreeBlocks := [MaxOrder + 1]uint32{2, 0, 1, 1, 1, 1, 0, 0, 0, 0, 0}
+	if got := pool.freeBlocks; got != expFreeBlocks {
+		t.Fatalf("expected free block counts to be %v; got %v", expFreeBlocks, got)
+	}
+
+	for frame := pmm.Frame(5); frame <= 6; frame++ {
+		if exp, got := (FrameInfo{State: FrameReserved, Owner: OwnerReserved}), pool.frames[frame]; got != exp {
+			t.Fatalf("expected metadata for frame %d to be %+v; got %+v", frame, exp, got)
+		}
+	}
+
+	// Reserved frames cannot be allocated
+	for allocCount := 0; allocCount < 62; allocCount++ {
+		frame, err := buddyAllocator.AllocFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if frame == 5 || frame == 6 {
+			t.Fatalf("expected reserved frame %d not to be allocated", frame)
+		}
+	}
+
+	if err := buddyAllocator.FreeFrame(pmm.Frame(4)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Ranges with frames that are in use cannot be reserved
+	if err := ReserveFrames(pmm.Frame(3), pmm.Frame(4)); err != errBuddyAllocFrameInUse {
+		t.Fatalf("expected error %v; got %v", errBuddyAllocFrameInUse, err)
+	}
+
+	if info := pool.frames[4]; info.State != FrameFree {
+		t.Fatalf("expected failed reservation not to modify frame 4; got %+v", info)
+	}
+
+	// Releasing the reserved frames restores the original free block
+	if err := buddyAllocator.FreeFrame(pmm.Frame(5)); err != nil {
+		t.Fatal(err)
+	}
+	if err := buddyAllocator.FreeFrame(pmm.Frame(6)); err != nil {
+		t.Fatal(err)
+	}
+	for frame := pmm.Frame(0); frame < 64; frame++ {
+		if frame < 4 || frame > 6 {
+			if err := buddyAllocator.FreeFrame(frame); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	expFreeBlocks = [MaxOrder + 1]uint32{0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 0}
+	if got := pool.freeBlocks; got != expFreeBlocks {
+		t.Fatalf("expected free block counts to be %v; got %v", expFreeBlocks, got)
+	}
+}
+
+func TestBuddyAllocatorLowMemory(t *testing.T) {
+	defer func() {
+		reclaimFn = mem.Reclaim
+		notifyLowMemoryFn = mem.NotifyLowMemory
+	}()
+
+	var (
+		alloc = BuddyAllocator{
+			pools: []framePool{
+				newTestPool(pmm.Frame(0), pmm.Frame(7)),
+			},
+			totalPages: 8,
+		}
+		reclaimCalls int
+		events       []mem.LowMemoryEvent
+	)
+	alloc.populateFreeBlocks()
+
+	notifyLowMemoryFn = func(event mem.LowMemoryEvent) {
+		events = append(events, event)
+	}
+
+	for allocCount := 0; allocCount < 8; allocCount++ {
+		if _, err := alloc.AllocFrame(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The reclaimer releases a frame; allocation failures while reclaiming
+	// must not trigger another reclaim
+	reclaimFn = func() uint32 {
+		reclaimCalls++
+		if _, err := alloc.AllocFrame(); err != errBuddyAllocOutOfMemory {
+			t.Errorf("expected nested allocation to fail with %v; got %v", errBuddyAllocOutOfMemory, err)
+		}
+
+		if err := alloc.FreeFrame(pmm.Frame(3)); err != nil {
+			t.Error(err)
+		}
+		return 1
+	}
+
+	if frame, err := alloc.AllocFrame(); err != nil || frame != pmm.Frame(3) {
+		t.Fatalf("expected to allocate reclaimed frame 3; got %d, %v", frame, err)
+	}
+
+	if frame, err := alloc.AllocFrameOnNode(0); err != nil || frame != pmm.Frame(3) {
+		t.Fatalf("expected to allocate reclaimed frame 3; got %d, %v", frame, err)
+	}
+
+	if reclaimCalls != 2 {
+		t.Fatalf("expected reclaimer to be invoked twice; got %d", reclaimCalls)
+	}
+
+	// Requests fail if no memory can be reclaimed
+	reclaimFn = func() uint32 { return 0 }
+	if _, err := alloc.AllocFrames(1); err != errBuddyAllocOutOfMemory {
+		t.Fatalf("expected error %v; got %v", errBuddyAllocOutOfMemory, err)
+	}
+
+	if _, err := alloc.AllocFrameOnNode(0); err != errBuddyAllocOutOfMemory {
+		t.Fatalf("expected error %v; got %v", errBuddyAllocOutOfMemory, err)
+	}
+
+	expEvents := []mem.LowMemoryEvent{
+		// nested allocations
+		{RequestedFrames: 1},
+		{RequestedFrames: 1, ReclaimedFrames: 1, Recovered: true},
+		{RequestedFrames: 1},
+		{RequestedFrames: 1, ReclaimedFrames: 1, Recovered: true},
+		{RequestedFrames: 2},
+		{RequestedFrames: 1},
+	}
+	if !reflect.DeepEqual(events, expEvents) {
+		t.Fatalf("expected low memory events to be:\n%+v\ngot:\n%+v", expEvents, events)
+	}
+}
+
+func TestBuddyAllocatorReclaimableFrames(t *testing.T) {
+	defer func(origAlloc BuddyAllocator) {
+		buddyAllocator = origAlloc
+	}(buddyAllocator)
+
+	buddyAllocator = BuddyAllocator{
+		pools: []framePool{
+			newTestPool(pmm.Frame(0), pmm.Frame(63)),
+			newTestPool(pmm.Frame(64), pmm.Frame(127)),
+		},
+		totalPages: 128,
+	}
+	buddyAllocator.pools[1].reclaimable = true
+
+	buddyAllocator.reserveReclaimableFrames()
+	buddyAllocator.populateFreeBlocks()
+
+	if exp, got := uint32(64), buddyAllocator.reservedPages; got != exp {
+		t.Fatalf("expected reserved page counter to be %d; got %d", exp, got)
+	}
+
+	for frameIndex, info := range buddyAllocator.pools[0].frames {
+		if info.State != FrameFree {
+			t.Fatalf("expected frame %d in pool 0 to be free; got %s", frameIndex, info.State)
+		}
+	}
+
+	if exp, got := uint32(0), buddyAllocator.pools[1].freeCount; got != exp {
+		t.Fatalf("expected free count for pool 1 to be %d; got %d", exp, got)
+	}
+
+	for frameIndex, info := range buddyAllocator.pools[1].frames {
+		if exp := (FrameInfo{State: FrameReserved, Owner: OwnerACPI}); info != exp {
+			t.Fatalf("expected metadata for frame %d in pool 1 to be %+v; got %+v", frameIndex, exp, info)
+		}
+	}
+
+	// Releasing the reclaimable frames should make them available for
+	// allocation; subsequent calls should be no-ops
+	for i := 0; i < 2; i++ {
+		ReleaseACPIReclaimableRegions()
+
+		if exp, got := uint32(0), buddyAllocator.reservedPages; got != exp {
+			t.Fatalf("[call %d] expected reserved page counter to be %d; got %d", i, exp, got)
+		}
+
+		if exp, got := uint32(64), buddyAllocator.pools[1].freeCount; got != exp {
+			t.Fatalf("[call %d] expected free count for pool 1 to be %d; got %d", i, exp, got)
+		}
+
+		if buddyAllocator.pools[1].reclaimable {
+			t.Fatalf("[call %d] expected pool 1 to be converted to a regular pool", i)
+		}
+
+		// The released frames should be coalesced into a single
+		// order 6 block
+		if exp, got := uint32(1), buddyAllocator.pools[1].freeBlocks[6]; got != exp {
+			t.Fatalf("[call %d] expected pool 1 to contain %d free order 6 blocks; got %d", i, exp, got)
+		}
+	}
+}
+
+func TestBuddyAllocatorAllocAndFreeFrame(t *testing.T) {
+	var alloc = BuddyAllocator{
+		pools: []framePool{
+			newTestPool(pmm.Frame(0), pmm.Frame(7)),
+			newTestPool(pmm.Frame(64), pmm.Frame(191)),
+		},
+		totalPages: 136,
+	}
+	alloc.populateFreeBlocks()
+
+	// Test Alloc
+	for poolIndex, pool := range alloc.pools {
+		for expFrame := pool.startFrame; expFrame <= pool.endFrame; expFrame++ {
+			got, err := alloc.AllocFrame()
+			if err != nil {
+				t.Fatalf("[pool %d] unexpected error: %v", poolIndex, err)
+			}
+
+			if got != expFrame {
+				t.Errorf("[pool %d] expected allocated frame to be %d; got %d", poolIndex, expFrame, got)
+			}
+		}
+
+		if alloc.pools[poolIndex].freeCount != 0 {
+			t.Errorf("[pool %d] expected free count to be 0; got %d", poolIndex, alloc.pools[poolIndex].freeCount)
+		}
+	}
+
+	if alloc.reservedPages != alloc.totalPages {
+		t.Errorf("expected reservedPages to match totalPages(%d); got %d", alloc.totalPages, alloc.reservedPages)
+	}
+
+	if _, err := alloc.AllocFrame(); err != errBuddyAllocOutOfMemory {
+		t.Fatalf("expected error errBuddyAllocOutOfMemory; got %v", err)
+	}
+
+	// Test Free
+	expFreeCount := []uint32{8, 128}
+	for poolIndex, pool := range alloc.pools {
+		for frame := pool.startFrame; frame <= pool.endFrame; frame++ {
+			if err := alloc.FreeFrame(frame); err != nil {
+				t.Fatalf("[pool %d] unexpected error: %v", poolIndex, err)
+			}
+		}
+
+		if alloc.pools[poolIndex].freeCount != expFreeCount[poolIndex] {
+			t.Errorf("[pool %d] expected free count to be %d; got %d", poolIndex, expFreeCount[poolIndex], alloc.pools[poolIndex].freeCount)
+		}
+	}
+
+	if alloc.reservedPages != 0 {
+		t.Errorf("expected reservedPages to be 0; got %d", alloc.reservedPages)
+	}
+
+	// Test Free errors
+	var output bytes.Buffer
+	kfmt.SetOutputSink(&output)
+	defer kfmt.SetOutputSink(nil)
+	output.Reset()
+
+	if err := alloc.FreeFrame(pmm.Frame(0)); err != errBuddyAllocDoubleFree {
+		t.Fatalf("expected error errBuddyAllocDoubleFree; got %v", err)
+	}
+
+	if exp, got := "[buddy_alloc] double free of frame 0x0 (block: 0x0, order: 0)\n", output.String(); got != exp {
+		t.Fatalf("expected double free to be reported as %q; got %q", exp, got)
+	}
+
+	if err := alloc.FreeFrame(pmm.Frame(0xbadf00d)); err != errBuddyAllocFrameNotManaged {
+		t.Fatalf("expected error errBuddyAllocFrameNotManaged; got %v", err)
+	}
+
+	// All freed frames should be coalesced back to the original blocks
+	if exp, got := uint32(1), alloc.pools[0].freeBlocks[3]; got != exp {
+		t.Errorf("expected pool 0 to contain %d free order 3 blocks; got %d", exp, got)
+	}
+
+	if exp, got := uint32(2), alloc.pools[1].freeBlocks[6]; got != exp {
+		t.Errorf("expected pool 1 to contain %d free order 6 blocks; got %d", exp, got)
+	}
+}
+
+func TestBuddyAllocatorFreeBlockFramesIndividually(t *testing.T) {
+	var alloc = BuddyAllocator{
+		pools: []framePool{
+			newTestPool(pmm.Frame(0), pmm.Frame(15)),
+		},
+		totalPages: 16,
+	}
+	alloc.populateFreeBlocks()
+
+	block, err := alloc.AllocFrames(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Releasing the frames of a block one at a time should coalesce them
+	// back into the original free block
+	for frame := block + 3; frame >= block && frame <= block+3; frame-- {
+		if err = alloc.FreeFrame(frame); err != nil {
+			t.Fatalf("unexpected error freeing frame %d: %v", frame, err)
+		}
+	}
+
+	if exp, got := uint32(1), alloc.pools[0].freeBlocks[4]; got != exp {
+		t.Fatalf("expected pool to contain %d free order 4 block; got %d", exp, got)
+	}
+
+	for order := uint8(0); order < 4; order++ {
+		if got := alloc.pools[0].freeBlocks[order]; got != 0 {
+			t.Errorf("expected pool to contain no free order %d blocks; got %d", order, got)
+		}
+	}
+
+	if alloc.reservedPages != 0 || alloc.pools[0].freeCount != 16 {
+		t.Fatalf("expected all frames to be free; reserved: %d, free: %d", alloc.reservedPages, alloc.pools[0].freeCount)
+	}
+}
+
+func TestBuddyAllocatorPopulateFreeBlocks(t *testing.T) {
+	var alloc = BuddyAllocator{
+		pools: []framePool{
+			// base frame is 1024; frames [1030, 2047] and [2048, 2060]
+			newTestPool(pmm.Frame(1030), pmm.Frame(2060)),
+		},
+		totalPages: 1031,
+	}
+
+	// Reserve frame 1536 which splits the [1024, 2047] block
+	alloc.markFrame(0, pmm.Frame(1536), FrameReserved, OwnerUnknown)
+	alloc.populateFreeBlocks()
+
+	// expected free blocks:
+	// [1030, 1031]: order 1
+	// [1032, 1039]: order 3
+	// [1040, 1055]: order 4
+	// [1056, 1087]: order 5
+	// [1088, 1151]: order 6
+	// [1152, 1279]: order 7
+	// [1280, 1535]: order 8
+	// [1537]: order 0
+	// [1538, 1539]: order 1
+	// [1540, 1543]: order 2
+	// [1544, 1551]: order 3
+	// [1552, 1567]: order 4
+	// [1568, 1599]: order 5
+	// [1600, 1663]: order 6
+	// [1664, 1791]: order 7
+	// [1792, 2047]: order 8
+	// [2048, 2055]: order 3
+	// [2056, 2059]: order 2
+	// [2060]: order 0
+	expFreeBlocks := [MaxOrder + 1]uint32{2, 2, 2, 3, 2, 2, 2, 2, 2, 0, 0}
+	if got := alloc.pools[0].freeBlocks; got != expFreeBlocks {
+		t.Fatalf("expected free block counts to be %v; got %v", expFreeBlocks, got)
+	}
+}
+
+func TestBuddyAllocatorAllocAndFreeFrames(t *testing.T) {
+	var alloc = BuddyAllocator{
+		pools: []framePool{
+			newTestPool(pmm.Frame(0), pmm.Frame(5)),
+			newTestPool(pmm.Frame(1024), pmm.Frame(3*1024-1)),
+		},
+		totalPages: 6 + 2*1024,
+	}
+	alloc.populateFreeBlocks()
+
+	specs := []struct {
+		order    uint8
+		expFrame pmm.Frame
+	}{
+		// Pool 0 contains the blocks [0, 3] and [4, 5]
+		{2, 0},
+		{1, 4},
+		// Pool 0 is exhausted; the first order 0 block gets split from
+		// the first order 10 block in pool 1
+		{0, 1024},
+		{9, 1536},
+		{0, 1025},
+		{1, 1026},
+		{MaxOrder, 2048},
+	}
+
+	for specIndex, spec := range specs {
+		got, err := alloc.AllocFrames(spec.order)
+		if err != nil {
+			t.Fatalf("[spec %d] unexpected error: %v", specIndex, err)
+		}
+
+		if got != spec.expFrame {
+			t.Errorf("[spec %d] expected allocated frame to be %d; got %d", specIndex, spec.expFrame, got)
+		}
+
+		if got&(1<<spec.order-1) != 0 {
+			t.Errorf("[spec %d] expected allocated frame %d to be aligned to a %d frame boundary", specIndex, got, 1<<spec.order)
+		}
+	}
+
+	if exp, got := uint32(4+2+1+512+1+2+1024), alloc.reservedPages; got != exp {
+		t.Fatalf("expected reserved page counter to be %d; got %d", exp, got)
+	}
+
+	if _, err := alloc.AllocFrames(MaxOrder); err != errBuddyAllocOutOfMemory {
+		t.Fatalf("expected error errBuddyAllocOutOfMemory; got %v", err)
+	}
+
+	// Release all blocks in reverse order; buddies should be coalesced so
+	// that the allocator can service MaxOrder requests again
+	for specIndex := len(specs) - 1; specIndex >= 0; specIndex-- {
+		spec := specs[specIndex]
+		if err := alloc.FreeFrames(spec.expFrame, spec.order); err != nil {
+			t.Fatalf("[spec %d] unexpected error: %v", specIndex, err)
+		}
+	}
+
+	if alloc.reservedPages != 0 {
+		t.Fatalf("expected reservedPages to be 0; got %d", alloc.reservedPages)
+	}
+
+	expFreeBlocks := [MaxOrder + 1]uint32{0, 1, 1, 0, 0, 0, 0, 0, 0, 0, 0}
+	if got := alloc.pools[0].freeBlocks; got != expFreeBlocks {
+		t.Errorf("expected pool 0 free block counts to be %v; got %v", expFreeBlocks, got)
+	}
+
+	expFreeBlocks = [MaxOrder + 1]uint32{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 2}
+	if got := alloc.pools[1].freeBlocks; got != expFreeBlocks {
+		t.Errorf("expected pool 1 free block counts to be %v; got %v", expFreeBlocks, got)
+	}
+
+	t.Run("errors", func(t *testing.T) {
+		if _, err := alloc.AllocFrames(MaxOrder + 1); err != errBuddyAllocInvalidOrder {
+			t.Errorf("expected error errBuddyAllocInvalidOrder; got %v", err)
+		}
+
+		frame, err := alloc.AllocFrames(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		specs := []struct {
+			frame  pmm.Frame
+			order  uint8
+			expErr *kernel.Error
+		}{
+			{frame, MaxOrder + 1, errBuddyAllocInvalidOrder},
+			{pmm.Frame(0xbadf00d), 0, errBuddyAllocFrameNotManaged},
+			{frame + 1, 1, errBuddyAllocMisalignedFrame},
+			{frame, 2, errBuddyAllocFrameNotManaged},
+			{pmm.Frame(0), 2, errBuddyAllocDoubleFree},
+		}
+
+		for specIndex, spec := range specs {
+			if err := alloc.FreeFrames(spec.frame, spec.order); err != spec.expErr {
+				t.Errorf("[spec %d] expected error %v; got %v", specIndex, spec.expErr, err)
+			}
+		}
+
+		// Releasing the block one frame at a time should also work
+		for i := pmm.Frame(0); i < 2; i++ {
+			if err := alloc.FreeFrame(frame + i); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+
+	t.Run("fragmented pool", func(t *testing.T) {
+		var alloc = BuddyAllocator{
+			pools: []framePool{
+				newTestPool(pmm.Frame(0), pmm.Frame(3)),
+			},
+			totalPages: 4,
+		}
+		alloc.populateFreeBlocks()
+
+		for i := 0; i < 4; i++ {
+			if _, err := alloc.AllocFrame(); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// Free frames 0 and 2; the pool now has 2 free frames but
+		// cannot service an order 1 request
+		for _, frame := range []pmm.Frame{0, 2} {
+			if err := alloc.FreeFrame(frame); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if _, err := alloc.AllocFrames(1); err != errBuddyAllocOutOfMemory {
+			t.Fatalf("expected error errBuddyAllocOutOfMemory; got %v", err)
+		}
+	})
+}
+
+func TestBuddyAllocatorPackageHelpers(t *testing.T) {
+	defer func(origAlloc BuddyAllocator) {
+		buddyAllocator = origAlloc
+	}(buddyAllocator)
+
+	buddyAllocator = BuddyAllocator{
+		pools: []framePool{
+			newTestPool(pmm.Frame(0), pmm.Frame(15)),
+		},
+		totalPages: 16,
+	}
+	buddyAllocator.populateFreeBlocks()
+
+	frame, err := AllocFrames(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if exp, got := uint32(8), buddyAllocator.reservedPages; got != exp {
+		t.Fatalf("expected reserved page counter to be %d; got %d", exp, got)
+	}
+
+	if err = FreeFrames(frame, 3); err != nil {
+		t.Fatal(err)
+	}
+
+	if frame, err = AllocFramesBelow(0, 7); err != nil || frame > 7 {
+		t.Fatalf("expected to allocate a frame below frame 7; got frame %d, err %v", frame, err)
+	}
+
+	if err = FreeFrames(frame, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if frame, err = AllocFrame(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = FreeFrame(frame); err != nil {
+		t.Fatal(err)
+	}
+
+	if exp, got := uint32(0), buddyAllocator.reservedPages; got != exp {
+		t.Fatalf("expected reserved page counter to be %d; got %d", exp, got)
+	}
+
+	if frame, err = AllocFrame(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = ShareFrame(frame); err != nil {
+		t.Fatal(err)
+	}
+
+	if exp, got := uint32(2), RefCount(frame); got != exp {
+		t.Fatalf("expected ref count to be %d; got %d", exp, got)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err = ReleaseFrame(frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if exp, got := uint32(0), RefCount(frame); got != exp {
+		t.Fatalf("expected ref count to be %d; got %d", exp, got)
+	}
+
+	if frame, err = AllocFrame(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = SetOwner(frame, 0, OwnerKernel); err != nil {
+		t.Fatal(err)
+	}
+
+	if info, err := LookupFrame(frame); err != nil || info.Owner != OwnerKernel {
+		t.Fatalf("expected frame owner to be %s; got %s (err: %v)", OwnerKernel, info.Owner, err)
+	}
+
+	for _, spec := range []struct {
+		allocFn  func() (pmm.Frame, *kernel.Error)
+		expOwner FrameOwner
+	}{
+		{func() (pmm.Frame, *kernel.Error) { return AllocFrameFor(OwnerDriver) }, OwnerDriver},
+		{allocVMMFrame, OwnerVMM},
+	} {
+		if frame, err = spec.allocFn(); err != nil {
+			t.Fatal(err)
+		}
+
+		if info, err := LookupFrame(frame); err != nil || info.Owner != spec.expOwner {
+			t.Fatalf("expected frame owner to be %s; got %s (err: %v)", spec.expOwner, info.Owner, err)
+		}
+	}
+
+	var usage mem.Usage
+	collectStats(&usage)
+	if exp := uint32(3); usage.UsedFrames != exp {
+		t.Fatalf("expected used frame count to be %d; got %d", exp, usage.UsedFrames)
+	}
+}
+
+func TestBuddyAllocatorCollectStats(t *testing.T) {
+	var alloc = BuddyAllocator{
+		pools: []framePool{
+			newTestPool(pmm.Frame(0), pmm.Frame(7)),
+			newTestPool(pmm.Frame(16), pmm.Frame(31)),
+		},
+		totalPages: 24,
+	}
+	alloc.populateFreeBlocks()
+
+	for _, owner := range []FrameOwner{OwnerACPI, OwnerHeap, OwnerHeap, OwnerSlab} {
+		if _, err := alloc.AllocFrameFor(owner); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Frames with an invalid owner should not be accounted to any owner
+	frame, err := alloc.AllocFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	alloc.pools[0].frames[frame].Owner = FrameOwner(42)
+
+	var usage mem.Usage
+	alloc.collectStats(&usage)
+
+	if usage.TotalFrames != 24 || usage.UsedFrames != 5 || usage.FreeFrames != 19 {
+		t.Fatalf("unexpected frame counts: total %d, used %d, free %d", usage.TotalFrames, usage.UsedFrames, usage.FreeFrames)
+	}
+
+	expZones := []mem.ZoneUsage{
+		{StartAddr: 0, EndAddr: 0x7fff, TotalFrames: 8, FreeFrames: 3},
+		{StartAddr: 0x10000, EndAddr: 0x1ffff, TotalFrames: 16, FreeFrames: 16},
+	}
+	if !reflect.DeepEqual(usage.Zones, expZones) {
+		t.Fatalf("expected zones to be:\n%+v\ngot:\n%+v", expZones, usage.Zones)
+	}
+
+	expOwners := []mem.OwnerUsage{
+		{Owner: "acpi", Frames: 1},
+		{Owner: "heap", Frames: 2},
+		{Owner: "slab", Frames: 1},
+	}
+	if !reflect.DeepEqual(usage.Owners, expOwners) {
+		t.Fatalf("expected owners to be:\n%+v\ngot:\n%+v", expOwners, usage.Owners)
+	}
+}
+
+func TestBuddyAllocatorAllocFramesBelow(t *testing.T) {
+	var alloc = BuddyAllocator{
+		pools: []framePool{
+			newTestPool(pmm.Frame(0), pmm.Frame(7)),
+			newTestPool(pmm.Frame(1024), pmm.Frame(3*1024-1)),
+		},
+		totalPages: 8 + 2*1024,
+	}
+	alloc.populateFreeBlocks()
+
+	// Leave pool 0 with a free order 0 block at frame 5, a free order 1
+	// block at frame 6 and a free order 2 block at frame 0.
+	for _, order := range []uint8{2, 0} {
+		if _, err := alloc.AllocFrames(order); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := alloc.FreeFrames(pmm.Frame(0), 2); err != nil {
+		t.Fatal(err)
+	}
+
+	specs := []struct {
+		order    uint8
+		maxFrame pmm.Frame
+		expFrame pmm.Frame
+		expErr   *kernel.Error
+	}{
+		// The lower-order free blocks exceed the limit; the order 2
+		// block at frame 0 needs to be split
+		{0, 3, 0, nil},
+		{1, 3, 2, nil},
+		{3, 1023, pmm.InvalidFrame, errBuddyAllocOutOfMemory},
+		{MaxOrder, 2047, 1024, nil},
+		{MaxOrder, 2047, pmm.InvalidFrame, errBuddyAllocOutOfMemory},
+		{MaxOrder + 1, 2047, pmm.InvalidFrame, errBuddyAllocInvalidOrder},
+	}
+
+	for specIndex, spec := range specs {
+		got, err := alloc.AllocFramesBelow(spec.order, spec.maxFrame)
+		if err != spec.expErr {
+			t.Errorf("[spec %d] expected error %v; got %v", specIndex, spec.expErr, err)
+			continue
+		}
+
+		if got != spec.expFrame {
+			t.Errorf("[spec %d] expected allocated frame to be %d; got %d", specIndex, spec.expFrame, got)
+		}
+	}
+}
+
+func TestBuddyAllocatorRefCounts(t *testing.T) {
+	var alloc = BuddyAllocator{
+		pools: []framePool{
+			newTestPool(pmm.Frame(0), pmm.Frame(7)),
+		},
+		totalPages: 8,
+	}
+	alloc.populateFreeBlocks()
+
+	frame, err := alloc.AllocFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if exp, got := uint32(1), alloc.RefCount(frame); got != exp {
+		t.Fatalf("expected ref count for newly allocated frame to be %d; got %d", exp, got)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err = alloc.ShareFrame(frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if exp, got := uint32(3), alloc.RefCount(frame); got != exp {
+		t.Fatalf("expected ref count to be %d; got %d", exp, got)
+	}
+
+	if err = alloc.FreeFrame(frame); err != errBuddyAllocFrameShared {
+		t.Fatalf("expected error errBuddyAllocFrameShared; got %v", err)
+	}
+
+	for exp := uint32(2); exp > 0; exp-- {
+		if err = alloc.ReleaseFrame(frame); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := alloc.RefCount(frame); got != exp {
+			t.Fatalf("expected ref count to be %d; got %d", exp, got)
+		}
+	}
+
+	// Dropping the last reference should release the frame
+	freeCount := alloc.pools[0].freeCount
+	if err = alloc.ReleaseFrame(frame); err != nil {
+		t.Fatal(err)
+	}
+
+	if exp, got := freeCount+1, alloc.pools[0].freeCount; got != exp {
+		t.Fatalf("expected pool free count to be %d; got %d", exp, got)
+	}
+
+	if exp, got := uint32(0), alloc.RefCount(frame); got != exp {
+		t.Fatalf("expected ref count for free frame to be %d; got %d", exp, got)
+	}
+
+	t.Run("errors", func(t *testing.T) {
+		specs := []struct {
+			frame  pmm.Frame
+			expErr *kernel.Error
+		}{
+			{pmm.Frame(0xbadf00d), errBuddyAllocFrameNotManaged},
+			{frame, errBuddyAllocFrameNotInUse},
+		}
+
+		for specIndex, spec := range specs {
+			if err := alloc.ShareFrame(spec.frame); err != spec.expErr {
+				t.Errorf("[spec %d] ShareFrame: expected error %v; got %v", specIndex, spec.expErr, err)
+			}
+
+			if err := alloc.ReleaseFrame(spec.frame); err != spec.expErr {
+				t.Errorf("[spec %d] ReleaseFrame: expected error %v; got %v", specIndex, spec.expErr, err)
+			}
+
+			if got := alloc.RefCount(spec.frame); got != 0 {
+				t.Errorf("[spec %d] expected RefCount to return 0; got %d", specIndex, got)
+			}
+		}
+
+		frame, err := alloc.AllocFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		alloc.pools[0].frames[frame-alloc.pools[0].startFrame].extraRefs = math.MaxUint16
+		if err = alloc.ShareFrame(frame); err != errBuddyAllocRefOverflow {
+			t.Fatalf("expected error errBuddyAllocRefOverflow; got %v", err)
+		}
+	})
+}
+
+func TestBuddyAllocatorFrameMetadata(t *testing.T) {
+	var alloc = BuddyAllocator{
+		pools: []framePool{
+			newTestPool(pmm.Frame(0), pmm.Frame(7)),
+		},
+		totalPages: 8,
+	}
+	alloc.populateFreeBlocks()
+
+	frame, err := alloc.AllocFrames(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = alloc.SetOwner(frame, 1, OwnerACPI); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := pmm.Frame(0); i < 2; i++ {
+		info, err := alloc.LookupFrame(frame + i)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if exp := (FrameInfo{State: FrameAllocated, Owner: OwnerACPI}); info != exp {
+			t.Errorf("[frame %d] expected frame metadata to be %+v; got %+v", frame+i, exp, info)
+		}
+	}
+
+	info, err := alloc.LookupFrame(frame + 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info != (FrameInfo{}) {
+		t.Errorf("expected metadata for free frame to be cleared; got %+v", info)
+	}
+
+	// Updating the owner of a block that contains free frames should fail
+	// without modifying any frame metadata
+	if err = alloc.SetOwner(frame, 2, OwnerKernel); err != errBuddyAllocFrameNotInUse {
+		t.Fatalf("expected error errBuddyAllocFrameNotInUse; got %v", err)
+	}
+
+	if got := alloc.pools[0].frames[frame].Owner; got != OwnerACPI {
+		t.Fatalf("expected frame owner to remain %s; got %s", OwnerACPI, got)
+	}
+
+	if _, err = alloc.LookupFrame(pmm.Frame(0xbadf00d)); err != errBuddyAllocFrameNotManaged {
+		t.Fatalf("expected error errBuddyAllocFrameNotManaged; got %v", err)
+	}
+
+	// Releasing the block should reset its metadata
+	if err = alloc.FreeFrames(frame, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if info, _ = alloc.LookupFrame(frame); info != (FrameInfo{}) {
+		t.Errorf("expected metadata for released frame to be cleared; got %+v", info)
+	}
+}
+
+func TestAllocatorPackageInit(t *testing.T) {
+	defer func() {
+		mapFn = vmm.Map
+		reserveRegionFn = vmm.EarlyReserveRegion
+	}()
+
+	var (
+		physMem = make([]byte, 35*mem.PageSize)
+	)
+	multiboot.SetInfoPtr(uintptr(unsafe.Pointer(&multibootMemoryMap[0])))
+
+	t.Run("success", func(t *testing.T) {
+		mapFn = func(page vmm.Page, frame pmm.Frame, flags vmm.PageTableEntryFlag) *kernel.Error {
+			return nil
+		}
+
+		reserveRegionFn = func(_ mem.Size) (uintptr, *kernel.Error) {
+			return uintptr(unsafe.Pointer(&physMem[0])), nil
+		}
+
+		if err := Init(0x100000, 0x1fa7c8); err != nil {
+			t.Fatal(err)
+		}
+
+		// At this point sysAllocFrame should work
+		if _, err := AllocFrame(); err != nil {
+			t.Fatal(err)
+		}
+
+		if usage := mem.Stats(); usage.TotalFrames != buddyAllocator.totalPages {
+			t.Fatalf("expected the allocator stats collector to be registered; got %+v", usage)
+		}
+	})
+
+	t.Run("error", func(t *testing.T) {
+		expErr := &kernel.Error{Module: "test", Message: "something went wrong"}
+
+		mapFn = func(page vmm.Page, frame pmm.Frame, flags vmm.PageTableEntryFlag) *kernel.Error {
+			return expErr
+		}
+
+		if err := Init(0x100000, 0x1fa7c8); err != expErr {
+			t.Fatalf("expected to get error: %v; got %v", expErr, err)
+		}
+	})
+}
+
+// newTestPool returns a frame pool for the supplied frame range whose bitmaps
+// are backed by a heap-allocated slice.
+func newTestPool(startFrame, endFrame pmm.Frame) framePool {
+	var (
+		pool  framePool
+		state = make([]uint64, poolStateWords(startFrame, endFrame))
+	)
+
+	pool.init(startFrame, endFrame, uintptr(unsafe.Pointer(&state[0])))
+	return pool
+}
+
+func TestBuddyAllocatorPoisoning(t *testing.T) {
+	defer func(origAlloc BuddyAllocator) {
+		physToVirtFn = vmm.PhysToVirt
+		kfmt.SetOutputSink(nil)
+		buddyAllocator = origAlloc
+	}(buddyAllocator)
+
+	var (
+		physMem = make([]byte, 16*mem.PageSize)
+		output  bytes.Buffer
+	)
+
+	physToVirtFn = func(physAddr uintptr) uintptr {
+		return uintptr(unsafe.Pointer(&physMem[0])) + physAddr
+	}
+	// Discard any output accumulated by earlier tests
+	kfmt.SetOutputSink(&output)
+	output.Reset()
+
+	framePoisoned := func(frame pmm.Frame) bool {
+		for _, val := range physMem[frame.Address()+8 : frame.Address()+uintptr(mem.PageSize)] {
+			if val != mem.PoisonFree {
+				return false
+			}
+		}
+		return true
+	}
+
+	buddyAllocator = BuddyAllocator{
+		pools: []framePool{
+			newTestPool(pmm.Frame(0), pmm.Frame(7)),
+			newTestPool(pmm.Frame(8), pmm.Frame(15)),
+		},
+		totalPages: 16,
+	}
+	buddyAllocator.pools[1].reclaimable = true
+	buddyAllocator.reserveReclaimableFrames()
+	buddyAllocator.populateFreeBlocks()
+
+	usedFrame, err := buddyAllocator.AllocFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	EnablePoisoning()
+
+	for frame := pmm.Frame(0); frame < 16; frame++ {
+		if exp, got := frame != usedFrame && frame < 8, framePoisoned(frame); got != exp {
+			t.Errorf("[frame %d] expected poisoned state to be %t; got %t", frame, exp, got)
+		}
+	}
+
+	// Allocating a frame whose poison pattern is intact should not
+	// generate any reports
+	frame, err := buddyAllocator.AllocFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if output.Len() != 0 {
+		t.Fatalf("expected no use-after-free reports; got:\n%s", output.String())
+	}
+
+	// Released frames should be poisoned; writing to them should be
+	// detected when they are allocated again
+	if err = buddyAllocator.FreeFrame(frame); err != nil {
+		t.Fatal(err)
+	}
+
+	if !framePoisoned(frame) {
+		t.Fatalf("expected released frame %d to be poisoned", frame)
+	}
+
+	physMem[frame.Address()+42] = 0
+
+	if got, err := buddyAllocator.AllocFrame(); err != nil || got != frame {
+		t.Fatalf("expected frame %d to be reallocated; got %d (err: %v)", frame, got, err)
+	}
+
+	if exp := "[buddy_alloc] use-after-free"; !strings.Contains(output.String(), exp) {
+		t.Fatalf("expected output to contain %q; got:\n%s", exp, output.String())
+	}
+
+	// Frames released by reclaimable pools should also be poisoned
+	buddyAllocator.releaseReclaimableFrames()
+	for frame := pmm.Frame(8); frame < 16; frame++ {
+		if !framePoisoned(frame) {
+			t.Errorf("expected reclaimed frame %d to be poisoned", frame)
+		}
+	}
+}
+
+func TestBuddyAllocatorNodes(t *testing.T) {
+	defer func(origAlloc BuddyAllocator) {
+		buddyAllocator = origAlloc
+	}(buddyAllocator)
+
+	buddyAllocator = BuddyAllocator{
+		pools: []framePool{
+			newTestPool(pmm.Frame(0), pmm.Frame(1)),
+			newTestPool(pmm.Frame(16), pmm.Frame(17)),
+			newTestPool(pmm.Frame(32), pmm.Frame(33)),
+		},
+		totalPages: 6,
+	}
+	buddyAllocator.populateFreeBlocks()
+
+	// Assign the second and third pool to node 1. The range does not
+	// cover the first frame of the first pool.
+	AssignNode(pmm.Frame(1).Address(), 40*mem.PageSize, 1)
+
+	for poolIndex, exp := range []NodeID{0, 1, 1} {
+		if got := buddyAllocator.pools[poolIndex].node; got != exp {
+			t.Errorf("[pool %d] expected node to be %d; got %d", poolIndex, exp, got)
+		}
+	}
+
+	specs := []struct {
+		node      NodeID
+		expFrames []pmm.Frame
+	}{
+		{1, []pmm.Frame{16, 17, 32, 33}},
+		{0, []pmm.Frame{0, 1}},
+	}
+
+	for specIndex, spec := range specs {
+		for _, expFrame := range spec.expFrames {
+			frame, err := AllocFrameOnNode(spec.node)
+			if err != nil {
+				t.Fatalf("[spec %d] unexpected error: %v", specIndex, err)
+			}
+
+			if frame != expFrame {
+				t.Errorf("[spec %d] expected to allocate frame %d; got %d", specIndex, expFrame, frame)
+			}
+		}
+	}
+
+	if _, err := AllocFrameOnNode(1); err != errBuddyAllocOutOfMemory {
+		t.Fatalf("expected error errBuddyAllocOutOfMemory; got %v", err)
+	}
+
+	// Free a frame from node 1 and request a frame on node 0; the
+	// allocator should fall back to node 1
+	if err := buddyAllocator.FreeFrame(pmm.Frame(33)); err != nil {
+		t.Fatal(err)
+	}
+
+	if frame, err := AllocFrameOnNode(0); err != nil || frame != pmm.Frame(33) {
+		t.Fatalf("expected to allocate frame 33 from node 1; got %d (err: %v)", frame, err)
+	}
+}
+
+func TestBuddyAllocatorAddMemory(t *testing.T) {
+	defer func(origAlloc BuddyAllocator) {
+		physToVirtFn = vmm.PhysToVirt
+		extendPhysMapFn = vmm.ExtendPhysMap
+		buddyAllocator = origAlloc
+	}(buddyAllocator)
+
+	const hotAddr = uintptr(0x100000)
+
+	var (
+		physMem    = make([]byte, 64*mem.PageSize)
+		extendAddr uintptr
+		extendSize mem.Size
+		expErr     = &kernel.Error{Module: "test", Message: "something went wrong"}
+	)
+
+	physToVirtFn = func(physAddr uintptr) uintptr {
+		return uintptr(unsafe.Pointer(&physMem[0])) + physAddr - hotAddr
+	}
+	extendPhysMapFn = func(physAddr uintptr, size mem.Size) *kernel.Error {
+		if physAddr == 0xbadf000 {
+			return expErr
+		}
+
+		extendAddr, extendSize = physAddr, size
+		return nil
+	}
+
+	buddyAllocator = BuddyAllocator{
+		pools:      append(make([]framePool, 0, 2), newTestPool(pmm.Frame(0), pmm.Frame(7))),
+		totalPages: 8,
+	}
+	buddyAllocator.populateFreeBlocks()
+	buddyAllocator.poison = true
+
+	specs := []struct {
+		startAddr uintptr
+		size      mem.Size
+		expErr    *kernel.Error
+	}{
+		{0x200000, 0, errBuddyAllocInvalidRange},
+		// less than a full page
+		{0x200800, 0x1000, errBuddyAllocInvalidRange},
+		// address overflow
+		{^uintptr(0) - 0xfff, 2 * mem.PageSize, errBuddyAllocInvalidRange},
+		// not enough frames to hold the pool state and at least one
+		// usable frame
+		{0x200000, mem.PageSize, errBuddyAllocInvalidRange},
+		{0x7000, 2 * mem.PageSize, errBuddyAllocRangeOverlap},
+		{0xbadf000, 2 * mem.PageSize, expErr},
+	}
+
+	for specIndex, spec := range specs {
+		if err := AddMemory(spec.startAddr, spec.size); err != spec.expErr {
+			t.Errorf("[spec %d] expected error %v; got %v", specIndex, spec.expErr, err)
+		}
+	}
+
+	if len(buddyAllocator.pools) != 1 {
+		t.Fatalf("expected failed calls not to add any pools; got %d pools", len(buddyAllocator.pools))
+	}
+
+	if err := AddMemory(hotAddr, 64*mem.PageSize); err != nil {
+		t.Fatal(err)
+	}
+
+	if extendAddr != hotAddr || extendSize != 64*mem.PageSize {
+		t.Fatalf("expected range [0x%x, +%d) to be added to the physmap; got [0x%x, +%d)", hotAddr, 64*mem.PageSize, extendAddr, extendSize)
+	}
+
+	if exp := uint32(72); buddyAllocator.totalPages != exp {
+		t.Fatalf("expected total page count to be %d; got %d", exp, buddyAllocator.totalPages)
+	}
+
+	pool := &buddyAllocator.pools[1]
+	if pool.startFrame != pmm.Frame(0x100) || pool.endFrame != pmm.Frame(0x13f) || pool.freeCount != 63 {
+		t.Fatalf("unexpected pool state: start frame: %d, end frame: %d, free: %d", pool.startFrame, pool.endFrame, pool.freeCount)
+	}
+
+	// The first frame holds the pool state
+	if info, err := LookupFrame(pmm.Frame(0x100)); err != nil || info.State != FrameReserved || info.Owner != OwnerKernel {
+		t.Fatalf("expected frame 0x100 to be reserved for the kernel; got %+v (err: %v)", info, err)
+	}
+
+	// Free frames should be poisoned as poisoning is enabled
+	if got := physMem[mem.PageSize+42]; got != mem.PoisonFree {
+		t.Fatalf("expected free frame to be poisoned; got 0x%x", got)
+	}
+
+	// Pool 0 cannot service an order 5 request so the block should be
+	// allocated from the new pool
+	frame, err := AllocFrames(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if exp := pmm.Frame(0x120); frame != exp {
+		t.Fatalf("expected to allocate block at frame 0x%x; got 0x%x", exp, frame)
+	}
+
+	if err = AddMemory(0x200000, 64*mem.PageSize); err != errBuddyAllocTooManyPools {
+		t.Fatalf("expected error errBuddyAllocTooManyPools; got %v", err)
+	}
+}
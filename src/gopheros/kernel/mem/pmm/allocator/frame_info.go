@@ -0,0 +1,118 @@
+package allocator
+
+// FrameState describes the allocation state of a physical frame.
+type FrameState uint8
+
+const (
+	// FrameFree indicates that the frame is available for allocation.
+	FrameFree FrameState = iota
+
+	// FrameAllocated indicates that the frame was handed out by the
+	// allocator.
+	FrameAllocated
+
+	// FrameReserved indicates that the frame was already in use when the
+	// allocator was initialized (e.g. it holds the kernel image or ACPI
+	// tables).
+	FrameReserved
+)
+
+// String implements fmt.Stringer for FrameState.
+func (s FrameState) String() string {
+	switch s {
+	case FrameFree:
+		return "free"
+	case FrameAllocated:
+		return "allocated"
+	case FrameReserved:
+		return "reserved"
+	default:
+		return "unknown"
+	}
+}
+
+// FrameOwner identifies the kernel subsystem that uses a frame.
+type FrameOwner uint8
+
+const (
+	// OwnerUnknown is assigned to frames whose owner has not been set.
+	OwnerUnknown FrameOwner = iota
+
+	// OwnerKernel is assigned to frames occupied by the kernel image and
+	// the frames allocated while bootstrapping the allocator.
+	OwnerKernel
+
+	// OwnerACPI is assigned to frames that hold ACPI tables.
+	OwnerACPI
+
+	// OwnerVMM is assigned to frames allocated by the vmm package (e.g.
+	// page tables and vmalloc pages).
+	OwnerVMM
+
+	// OwnerHeap is assigned to frames allocated on behalf of the kernel
+	// heap. Large heap allocations are backed by vmalloc pages and are
+	// therefore accounted to OwnerVMM.
+	OwnerHeap
+
+	// OwnerSlab is assigned to frames used as slab cache pages.
+	OwnerSlab
+
+	// OwnerDMA is assigned to frames that back DMA buffers.
+	OwnerDMA
+
+	// OwnerDriver is assigned to frames allocated by device drivers.
+	OwnerDriver
+
+	// OwnerReserved is assigned to frames withdrawn from the allocator
+	// via pmm.ReserveRange. The tag of the subsystem that reserved them
+	// can be queried via pmm.ReservationOwner.
+	OwnerReserved
+
+	// numFrameOwners is the number of defined frame owners.
+	numFrameOwners
+)
+
+// String implements fmt.Stringer for FrameOwner.
+func (o FrameOwner) String() string {
+	switch o {
+	case OwnerKernel:
+		return "kernel"
+	case OwnerACPI:
+		return "acpi"
+	case OwnerVMM:
+		return "vmm"
+	case OwnerHeap:
+		return "heap"
+	case OwnerSlab:
+		return "slab"
+	case OwnerDMA:
+		return "dma"
+	case OwnerDriver:
+		return "drivers"
+	case OwnerReserved:
+		return "reserved"
+	default:
+		return "unknown"
+	}
+}
+
+// FrameInfo holds the metadata that the allocator tracks for each physical
+// frame.
+type FrameInfo struct {
+	State FrameState
+	Owner FrameOwner
+
+	// extraRefs tracks the number of additional references to an
+	// allocated frame (e.g. by copy-on-write mappings).
+	extraRefs uint16
+}
+
+// RefCount returns the number of references to the frame. Free frames always
+// have a zero reference count.
+func (info FrameInfo) RefCount() uint32 {
+	if info.State == FrameFree {
+		return 0
+	}
+
+	return uint32(info.extraRefs) + 1
+}
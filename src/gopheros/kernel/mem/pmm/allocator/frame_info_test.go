@@ -0,0 +1,63 @@
+package allocator
+
+import "testing"
+
+func TestFrameStateString(t *testing.T) {
+	specs := []struct {
+		state FrameState
+		exp   string
+	}{
+		{FrameFree, "free"},
+		{FrameAllocated, "allocated"},
+		{FrameReserved, "reserved"},
+		{FrameState(42), "unknown"},
+	}
+
+	for specIndex, spec := range specs {
+		if got := spec.state.String(); got != spec.exp {
+			t.Errorf("[spec %d] expected %q; got %q", specIndex, spec.exp, got)
+		}
+	}
+}
+
+func TestFrameOwnerString(t *testing.T) {
+	specs := []struct {
+		owner FrameOwner
+		exp   string
+	}{
+		{OwnerUnknown, "unknown"},
+		{OwnerKernel, "kernel"},
+		{OwnerACPI, "acpi"},
+		{OwnerVMM, "vmm"},
+		{OwnerHeap, "heap"},
+		{OwnerSlab, "slab"},
+		{OwnerDMA, "dma"},
+		{OwnerDriver, "drivers"},
+		{OwnerReserved, "reserved"},
+		{FrameOwner(42), "unknown"},
+	}
+
+	for specIndex, spec := range specs {
+		if got := spec.owner.String(); got != spec.exp {
+			t.Errorf("[spec %d] expected %q; got %q", specIndex, spec.exp, got)
+		}
+	}
+}
+
+func TestFrameInfoRefCount(t *testing.T) {
+	specs := []struct {
+		info FrameInfo
+		exp  uint32
+	}{
+		{FrameInfo{State: FrameFree}, 0},
+		{FrameInfo{State: FrameAllocated}, 1},
+		{FrameInfo{State: FrameAllocated, extraRefs: 2}, 3},
+		{FrameInfo{State: FrameReserved}, 1},
+	}
+
+	for specIndex, spec := range specs {
+		if got := spec.info.RefCount(); got != spec.exp {
+			t.Errorf("[spec %d] expected ref count to be %d; got %d", specIndex, spec.exp, got)
+		}
+	}
+}
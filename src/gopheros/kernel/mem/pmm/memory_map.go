@@ -0,0 +1,121 @@
+package pmm
+
+import (
+	"gopheros/kernel/hal/multiboot"
+	"gopheros/kernel/mem"
+)
+
+// maxMemoryMapRegions defines the max number of regions that can be returned
+// by a call to MemoryMap. Any additional regions reported by the bootloader
+// will be ignored.
+const maxMemoryMapRegions = 128
+
+// memoryMap is a statically allocated array that backs the slice returned by
+// MemoryMap. Using a static array allows MemoryMap to be invoked before the Go
+// allocator has been initialized.
+var memoryMap [maxMemoryMapRegions]Region
+
+// RegionType describes the type of a physical memory region.
+type RegionType uint8
+
+const (
+	// RegionUsable indicates that the memory region is available for use.
+	RegionUsable RegionType = iota
+
+	// RegionReserved indicates that the memory region is not available
+	// for use.
+	RegionReserved
+
+	// RegionACPIReclaimable indicates that the memory region holds ACPI
+	// tables. The region can be reused once the ACPI tables are no longer
+	// needed.
+	RegionACPIReclaimable
+
+	// RegionACPINVS indicates that the memory region must be preserved
+	// when hibernating.
+	RegionACPINVS
+
+	// RegionBadRAM indicates that the memory region is occupied by
+	// defective RAM modules.
+	RegionBadRAM
+)
+
+// String implements fmt.Stringer for RegionType.
+func (t RegionType) String() string {
+	switch t {
+	case RegionUsable:
+		return "usable"
+	case RegionACPIReclaimable:
+		return "ACPI (reclaimable)"
+	case RegionACPINVS:
+		return "ACPI NVS"
+	case RegionBadRAM:
+		return "bad RAM"
+	default:
+		return "reserved"
+	}
+}
+
+// Region describes a typed physical memory region.
+type Region struct {
+	// The physical address where the region begins.
+	PhysAddress uintptr
+
+	// The region size in bytes.
+	Size mem.Size
+
+	// The type of the region.
+	Type RegionType
+}
+
+// StartFrame returns the first frame that is fully contained in this region.
+// Reported region addresses may not be page-aligned so the region start
+// address is rounded up to the nearest page.
+func (r *Region) StartFrame() Frame {
+	pageSizeMinus1 := uintptr(mem.PageSize - 1)
+	return Frame(((r.PhysAddress + pageSizeMinus1) & ^pageSizeMinus1) >> mem.PageShift)
+}
+
+// EndFrame returns the last frame that is fully contained in this region.
+// Reported region addresses may not be page-aligned so the region end
+// address is rounded down to the nearest page.
+func (r *Region) EndFrame() Frame {
+	pageSizeMinus1 := uintptr(mem.PageSize - 1)
+	return Frame(((r.PhysAddress+uintptr(r.Size)) & ^pageSizeMinus1)>>mem.PageShift) - 1
+}
+
+// MemoryMap returns the list of typed physical memory regions reported by the
+// bootloader. The returned slice is backed by a statically allocated array
+// that gets repopulated by each call to MemoryMap so callers must not modify
+// its contents.
+//
+// MemoryMap does not allocate any memory and can be safely invoked before the
+// Go allocator has been initialized.
+func MemoryMap() []Region {
+	count := 0
+	multiboot.VisitMemRegions(func(entry *multiboot.MemoryMapEntry) bool {
+		if count == len(memoryMap) {
+			return false
+		}
+
+		memoryMap[count].PhysAddress = uintptr(entry.PhysAddress)
+		memoryMap[count].Size = mem.Size(entry.Length)
+		switch entry.Type {
+		case multiboot.MemAvailable:
+			memoryMap[count].Type = RegionUsable
+		case multiboot.MemAcpiReclaimable:
+			memoryMap[count].Type = RegionACPIReclaimable
+		case multiboot.MemNvs:
+			memoryMap[count].Type = RegionACPINVS
+		case multiboot.MemBadRAM:
+			memoryMap[count].Type = RegionBadRAM
+		default:
+			memoryMap[count].Type = RegionReserved
+		}
+
+		count++
+		return true
+	})
+
+	return memoryMap[:count]
+}
@@ -0,0 +1,147 @@
+package pmm
+
+import (
+	"encoding/binary"
+	"gopheros/kernel/hal/multiboot"
+	"gopheros/kernel/mem"
+	"testing"
+	"unsafe"
+)
+
+func TestRegionTypeString(t *testing.T) {
+	specs := []struct {
+		input RegionType
+		exp   string
+	}{
+		{RegionUsable, "usable"},
+		{RegionReserved, "reserved"},
+		{RegionACPIReclaimable, "ACPI (reclaimable)"},
+		{RegionACPINVS, "ACPI NVS"},
+		{RegionBadRAM, "bad RAM"},
+		{RegionType(123), "reserved"},
+	}
+
+	for specIndex, spec := range specs {
+		if got := spec.input.String(); got != spec.exp {
+			t.Errorf("[spec %d] expected %q; got %q", specIndex, spec.exp, got)
+		}
+	}
+}
+
+func TestRegionFrames(t *testing.T) {
+	specs := []struct {
+		region   Region
+		expStart Frame
+		expEnd   Frame
+	}{
+		{Region{PhysAddress: 0, Size: 4 * mem.PageSize}, 0, 3},
+		{Region{PhysAddress: 0x9fc00, Size: 0x400}, 0xa0, 0x9f},
+		{Region{PhysAddress: 0x100, Size: 2 * mem.PageSize}, 1, 1},
+		{Region{PhysAddress: 0x100000, Size: 0x7ee0000}, 0x100, 0x7fdf},
+	}
+
+	for specIndex, spec := range specs {
+		if got := spec.region.StartFrame(); got != spec.expStart {
+			t.Errorf("[spec %d] expected start frame to be %d; got %d", specIndex, spec.expStart, got)
+		}
+		if got := spec.region.EndFrame(); got != spec.expEnd {
+			t.Errorf("[spec %d] expected end frame to be %d; got %d", specIndex, spec.expEnd, got)
+		}
+	}
+}
+
+func TestMemoryMap(t *testing.T) {
+	entries := []multiboot.MemoryMapEntry{
+		{PhysAddress: 0, Length: 0x9fc00, Type: multiboot.MemAvailable},
+		{PhysAddress: 0x9fc00, Length: 0x400, Type: multiboot.MemReserved},
+		{PhysAddress: 0x100000, Length: 0x7ee0000, Type: multiboot.MemAvailable},
+		{PhysAddress: 0x7fe0000, Length: 0x10000, Type: multiboot.MemAcpiReclaimable},
+		{PhysAddress: 0x7ff0000, Length: 0x10000, Type: multiboot.MemNvs},
+		{PhysAddress: 0x8000000, Length: 0x1000, Type: multiboot.MemBadRAM},
+		{PhysAddress: 0x8001000, Length: 0x1000, Type: multiboot.MemoryEntryType(42)},
+	}
+
+	infoData := genMemoryMapInfo(entries)
+	multiboot.SetInfoPtr(uintptr(unsafe.Pointer(&infoData[0])))
+
+	expRegions := []Region{
+		{PhysAddress: 0, Size: 0x9fc00, Type: RegionUsable},
+		{PhysAddress: 0x9fc00, Size: 0x400, Type: RegionReserved},
+		{PhysAddress: 0x100000, Size: 0x7ee0000, Type: RegionUsable},
+		{PhysAddress: 0x7fe0000, Size: 0x10000, Type: RegionACPIReclaimable},
+		{PhysAddress: 0x7ff0000, Size: 0x10000, Type: RegionACPINVS},
+		{PhysAddress: 0x8000000, Size: 0x1000, Type: RegionBadRAM},
+		{PhysAddress: 0x8001000, Size: 0x1000, Type: RegionReserved},
+	}
+
+	regions := MemoryMap()
+	if len(regions) != len(expRegions) {
+		t.Fatalf("expected MemoryMap to return %d regions; got %d", len(expRegions), len(regions))
+	}
+
+	for regionIndex, region := range regions {
+		if region != expRegions[regionIndex] {
+			t.Errorf("[region %d] expected %+v; got %+v", regionIndex, expRegions[regionIndex], region)
+		}
+	}
+
+	t.Run("too many regions", func(t *testing.T) {
+		entries := make([]multiboot.MemoryMapEntry, maxMemoryMapRegions+1)
+		for i := 0; i < len(entries); i++ {
+			entries[i] = multiboot.MemoryMapEntry{
+				PhysAddress: uint64(i) * uint64(mem.PageSize),
+				Length:      uint64(mem.PageSize),
+				Type:        multiboot.MemAvailable,
+			}
+		}
+
+		infoData := genMemoryMapInfo(entries)
+		multiboot.SetInfoPtr(uintptr(unsafe.Pointer(&infoData[0])))
+
+		if got := len(MemoryMap()); got != maxMemoryMapRegions {
+			t.Fatalf("expected MemoryMap to return %d regions; got %d", maxMemoryMapRegions, got)
+		}
+	})
+
+	t.Run("missing memory map", func(t *testing.T) {
+		infoData := []byte{
+			16, 0, 0, 0, 0, 0, 0, 0,
+			0, 0, 0, 0, 8, 0, 0, 0,
+		}
+		multiboot.SetInfoPtr(uintptr(unsafe.Pointer(&infoData[0])))
+
+		if got := len(MemoryMap()); got != 0 {
+			t.Fatalf("expected MemoryMap to return 0 regions; got %d", got)
+		}
+	})
+}
+
+// genMemoryMapInfo generates a multiboot info block that contains a memory
+// map tag populated with the supplied entries followed by the end tag.
+func genMemoryMapInfo(entries []multiboot.MemoryMapEntry) []byte {
+	const entrySize = 24
+
+	tagSize := 16 + entrySize*len(entries)
+	buf := make([]byte, 8+tagSize+8)
+
+	// info header
+	binary.LittleEndian.PutUint32(buf[0:], uint32(len(buf)))
+
+	// memory map tag header
+	binary.LittleEndian.PutUint32(buf[8:], 6)
+	binary.LittleEndian.PutUint32(buf[12:], uint32(tagSize))
+	binary.LittleEndian.PutUint32(buf[16:], entrySize)
+
+	offset := 24
+	for _, entry := range entries {
+		binary.LittleEndian.PutUint64(buf[offset:], entry.PhysAddress)
+		binary.LittleEndian.PutUint64(buf[offset+8:], entry.Length)
+		binary.LittleEndian.PutUint32(buf[offset+16:], uint32(entry.Type))
+		offset += entrySize
+	}
+
+	// end tag
+	binary.LittleEndian.PutUint32(buf[offset+4:], 8)
+
+	return buf
+}
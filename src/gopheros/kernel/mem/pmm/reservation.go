@@ -0,0 +1,122 @@
+package pmm
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/mem"
+)
+
+// maxReservations defines the max number of physical memory ranges that can
+// be reserved via ReserveRange.
+const maxReservations = 32
+
+// FrameReserverFn is a function that removes the frames in the [startFrame,
+// endFrame] range from the pool of frames available for allocation.
+type FrameReserverFn func(startFrame, endFrame Frame) *kernel.Error
+
+var (
+	// reservations is a statically allocated array that tracks the ranges
+	// reserved via ReserveRange. Using a static array allows ranges to be
+	// reserved before the Go allocator has been initialized.
+	reservations     [maxReservations]Reservation
+	reservationCount int
+
+	// frameReserverFn points to the function registered using
+	// SetFrameReserver. It remains nil until the physical frame allocator
+	// has been initialized.
+	frameReserverFn FrameReserverFn
+
+	errInvalidReservation  = &kernel.Error{Module: "pmm", Message: "invalid reservation range"}
+	errReservationOverlap  = &kernel.Error{Module: "pmm", Message: "range overlaps an existing reservation"}
+	errTooManyReservations = &kernel.Error{Module: "pmm", Message: "max number of reservations reached"}
+)
+
+// Reservation describes a physical memory range that has been marked as
+// off-limits for the frame allocator.
+type Reservation struct {
+	// The physical address where the reserved range begins.
+	PhysAddress uintptr
+
+	// The reserved range size in bytes.
+	Size mem.Size
+
+	// Owner describes the driver or subsystem that reserved the range.
+	Owner string
+}
+
+// StartFrame returns the first frame that overlaps this reservation. Unlike
+// Region, partially covered pages are considered to be part of the
+// reservation so the start address is rounded down to the nearest page.
+func (r *Reservation) StartFrame() Frame {
+	return Frame(r.PhysAddress >> mem.PageShift)
+}
+
+// EndFrame returns the last frame that overlaps this reservation. The end
+// address is rounded up to the nearest page.
+func (r *Reservation) EndFrame() Frame {
+	return Frame((r.PhysAddress + uintptr(r.Size) - 1) >> mem.PageShift)
+}
+
+// SetFrameReserver registers the function that ReserveRange uses to withdraw
+// frames from the physical frame allocator. Ranges reserved before a
+// reserver is registered are only recorded; the frame allocator is expected
+// to exclude them (see Reservations) when it initializes.
+func SetFrameReserver(fn FrameReserverFn) {
+	frameReserverFn = fn
+}
+
+// ReserveRange marks the physical memory range [start, start+size) as
+// off-limits for the frame allocator and records the supplied owner tag for
+// it. Drivers use ReserveRange to protect memory that is accessed by the
+// firmware or by hardware (e.g. ACPI NVS regions, framebuffers or the AP
+// trampoline) from being handed out. Partially covered pages are reserved in
+// their entirety.
+//
+// An error is returned if the range overlaps an existing reservation or if
+// its frames cannot be withdrawn from the frame allocator (e.g. because they
+// are already allocated).
+func ReserveRange(start uintptr, size mem.Size, owner string) *kernel.Error {
+	res := Reservation{PhysAddress: start, Size: size, Owner: owner}
+	if size == 0 || start+uintptr(size)-1 < start {
+		return errInvalidReservation
+	}
+
+	for index := 0; index < reservationCount; index++ {
+		if res.StartFrame() <= reservations[index].EndFrame() && reservations[index].StartFrame() <= res.EndFrame() {
+			return errReservationOverlap
+		}
+	}
+
+	if reservationCount == maxReservations {
+		return errTooManyReservations
+	}
+
+	if frameReserverFn != nil {
+		if err := frameReserverFn(res.StartFrame(), res.EndFrame()); err != nil {
+			return err
+		}
+	}
+
+	reservations[reservationCount] = res
+	reservationCount++
+	return nil
+}
+
+// Reservations returns the list of ranges reserved via ReserveRange in the
+// order they were reserved. The returned slice is backed by a statically
+// allocated array so callers must not modify its contents.
+func Reservations() []Reservation {
+	return reservations[:reservationCount]
+}
+
+// ReservationOwner returns the owner tag of the reservation that contains
+// the supplied frame. The second return value is false if the frame is not
+// reserved.
+func ReservationOwner(frame Frame) (string, bool) {
+	for index := 0; index < reservationCount; index++ {
+		if frame >= reservations[index].StartFrame() && frame <= reservations[index].EndFrame() {
+			return reservations[index].Owner, true
+		}
+	}
+
+	return "", false
+}
@@ -0,0 +1,125 @@
+package pmm
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/mem"
+	"reflect"
+	"testing"
+)
+
+func TestReservationFrames(t *testing.T) {
+	specs := []struct {
+		res      Reservation
+		expStart Frame
+		expEnd   Frame
+	}{
+		{Reservation{PhysAddress: 0, Size: 4 * mem.PageSize}, 0, 3},
+		{Reservation{PhysAddress: 0x9fc00, Size: 0x400}, 0x9f, 0x9f},
+		{Reservation{PhysAddress: 0x100, Size: 2 * mem.PageSize}, 0, 2},
+		{Reservation{PhysAddress: 0xfd000000, Size: 1}, 0xfd000, 0xfd000},
+	}
+
+	for specIndex, spec := range specs {
+		if got := spec.res.StartFrame(); got != spec.expStart {
+			t.Errorf("[spec %d] expected start frame to be %d; got %d", specIndex, spec.expStart, got)
+		}
+		if got := spec.res.EndFrame(); got != spec.expEnd {
+			t.Errorf("[spec %d] expected end frame to be %d; got %d", specIndex, spec.expEnd, got)
+		}
+	}
+}
+
+func TestReserveRange(t *testing.T) {
+	defer resetReservations()
+
+	var reservedRanges [][2]Frame
+	SetFrameReserver(func(startFrame, endFrame Frame) *kernel.Error {
+		reservedRanges = append(reservedRanges, [2]Frame{startFrame, endFrame})
+		return nil
+	})
+
+	specs := []struct {
+		start  uintptr
+		size   mem.Size
+		owner  string
+		expErr *kernel.Error
+	}{
+		{0x8000, mem.PageSize, "ap-trampoline", nil},
+		{0xfd000000, 3 * mem.Mb, "framebuffer", nil},
+		{0x7fe0100, 0x100, "acpi-nvs", nil},
+		{0x8800, 0x100, "overlap", errReservationOverlap},
+		{0xfcfff000, 2 * mem.PageSize, "overlap", errReservationOverlap},
+		{0x10000, 0, "empty", errInvalidReservation},
+		{^uintptr(0), 2, "overflow", errInvalidReservation},
+	}
+
+	for specIndex, spec := range specs {
+		if err := ReserveRange(spec.start, spec.size, spec.owner); err != spec.expErr {
+			t.Errorf("[spec %d] expected error %v; got %v", specIndex, spec.expErr, err)
+		}
+	}
+
+	expReservations := []Reservation{
+		{0x8000, mem.PageSize, "ap-trampoline"},
+		{0xfd000000, 3 * mem.Mb, "framebuffer"},
+		{0x7fe0100, 0x100, "acpi-nvs"},
+	}
+	if got := Reservations(); !reflect.DeepEqual(got, expReservations) {
+		t.Fatalf("expected reservations to be:\n%v\ngot:\n%v", expReservations, got)
+	}
+
+	expRanges := [][2]Frame{{0x8, 0x8}, {0xfd000, 0xfd2ff}, {0x7fe0, 0x7fe0}}
+	if !reflect.DeepEqual(reservedRanges, expRanges) {
+		t.Fatalf("expected frame ranges %v to be withdrawn from the allocator; got %v", expRanges, reservedRanges)
+	}
+
+	ownerSpecs := []struct {
+		frame    Frame
+		expOwner string
+		expOK    bool
+	}{
+		{0x8, "ap-trampoline", true},
+		{0xfd1ab, "framebuffer", true},
+		{0x7fe0, "acpi-nvs", true},
+		{0x9, "", false},
+	}
+
+	for specIndex, spec := range ownerSpecs {
+		owner, ok := ReservationOwner(spec.frame)
+		if owner != spec.expOwner || ok != spec.expOK {
+			t.Errorf("[spec %d] expected ReservationOwner to return %q, %t; got %q, %t", specIndex, spec.expOwner, spec.expOK, owner, ok)
+		}
+	}
+}
+
+func TestReserveRangeErrors(t *testing.T) {
+	defer resetReservations()
+
+	expErr := &kernel.Error{Module: "test", Message: "frame in use"}
+	SetFrameReserver(func(_, _ Frame) *kernel.Error { return expErr })
+
+	if err := ReserveRange(0x8000, mem.PageSize, "ap-trampoline"); err != expErr {
+		t.Fatalf("expected error %v; got %v", expErr, err)
+	}
+
+	if got := len(Reservations()); got != 0 {
+		t.Fatalf("expected failed reservation not to be recorded; got %d reservations", got)
+	}
+
+	// Reservations made before a reserver is registered are only recorded
+	SetFrameReserver(nil)
+	for index := 0; index < maxReservations; index++ {
+		if err := ReserveRange(uintptr(index)<<mem.PageShift, mem.PageSize, "test"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := ReserveRange(uintptr(maxReservations)<<mem.PageShift, mem.PageSize, "test"); err != errTooManyReservations {
+		t.Fatalf("expected error %v; got %v", errTooManyReservations, err)
+	}
+}
+
+func resetReservations() {
+	reservationCount = 0
+	frameReserverFn = nil
+}
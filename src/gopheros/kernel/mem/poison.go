@@ -0,0 +1,109 @@
+package mem
+
+import (
+	"gopheros/kernel/kfmt"
+	"reflect"
+	"runtime"
+	"unsafe"
+)
+
+const (
+	// PoisonFree is the byte pattern used for filling released memory
+	// blocks when poisoning is enabled.
+	PoisonFree = byte(0x6b)
+
+	// poisonHeaderSize is the size of the header stored at the start of
+	// each poisoned block. The header records the address of the code
+	// that released the block.
+	poisonHeaderSize = Size(unsafe.Sizeof(uintptr(0)))
+
+	// MinPoisonSize is the smallest block size that can be poisoned.
+	MinPoisonSize = 2 * poisonHeaderSize
+
+	// maxCallerDepth defines the max number of stack frames that are
+	// inspected by CallerPC.
+	maxCallerDepth = 16
+
+	// memPkgPath is the import path prefix shared by all memory
+	// management packages.
+	memPkgPath = "gopheros/kernel/mem"
+)
+
+// PoisonEnabled controls whether the memory allocators poison the blocks
+// that get released and check them for modifications when they are handed
+// out again. This debug feature is enabled by building the kernel with the
+// "mempoison" build tag.
+var PoisonEnabled = poisonByDefault
+
+// Poison fills size bytes at addr with the PoisonFree pattern. The address of
+// the code that released the block (freePC) is stored at the start of the
+// block so that it can be reported if the block is modified while poisoned.
+// The block size must be at least MinPoisonSize bytes.
+func Poison(addr uintptr, size Size, freePC uintptr) {
+	*(*uintptr)(unsafe.Pointer(addr)) = freePC
+	Memset(addr+uintptr(poisonHeaderSize), PoisonFree, size-poisonHeaderSize)
+}
+
+// CheckPoison verifies that a block previously poisoned via a call to Poison
+// has not been modified. If a modification is detected, CheckPoison prints
+// the address of the first modified byte together with the location of the
+// code that released the block and the location of the code that attempted
+// to allocate it (allocPC) and returns false.
+func CheckPoison(module string, addr uintptr, size Size, allocPC uintptr) bool {
+	block := *(*[]byte)(unsafe.Pointer(&reflect.SliceHeader{
+		Len:  int(size - poisonHeaderSize),
+		Cap:  int(size - poisonHeaderSize),
+		Data: addr + uintptr(poisonHeaderSize),
+	}))
+
+	for offset, val := range block {
+		if val == PoisonFree {
+			continue
+		}
+
+		freePC := *(*uintptr)(unsafe.Pointer(addr))
+		kfmt.Printf("[%s] use-after-free: byte at 0x%x modified after block 0x%x was released\n", module, addr+uintptr(poisonHeaderSize)+uintptr(offset), addr)
+		kfmt.Printf("[%s] block released by: %s\n", module, funcName(freePC))
+		kfmt.Printf("[%s] detected when allocated by: %s\n", module, funcName(allocPC))
+		return false
+	}
+
+	return true
+}
+
+// CallerPC returns the program counter of the first function in the call
+// stack that does not belong to one of the memory management packages. It
+// allows allocators to identify the code that invoked them regardless of the
+// number of allocator layers in the call chain. If no such function can be
+// found, CallerPC returns 0.
+func CallerPC() uintptr {
+	var pcs [maxCallerDepth]uintptr
+
+	count := runtime.Callers(2, pcs[:])
+	for _, pc := range pcs[:count] {
+		if !isMemPkgFunc(funcName(pc)) {
+			return pc
+		}
+	}
+
+	return 0
+}
+
+// isMemPkgFunc returns true if the supplied function name belongs to one of
+// the memory management packages.
+func isMemPkgFunc(name string) bool {
+	if len(name) <= len(memPkgPath) || name[:len(memPkgPath)] != memPkgPath {
+		return false
+	}
+
+	return name[len(memPkgPath)] == '.' || name[len(memPkgPath)] == '/'
+}
+
+// funcName returns the name of the function that contains pc.
+func funcName(pc uintptr) string {
+	if fn := runtime.FuncForPC(pc - 1); fn != nil {
+		return fn.Name()
+	}
+
+	return "unknown"
+}
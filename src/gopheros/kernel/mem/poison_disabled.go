@@ -0,0 +1,6 @@
+//go:build !mempoison
+// +build !mempoison
+
+package mem
+
+const poisonByDefault = false
@@ -0,0 +1,111 @@
+package mem
+
+import (
+	"bytes"
+	"gopheros/kernel/kfmt"
+	"runtime"
+	"strings"
+	"testing"
+	"unsafe"
+)
+
+// poisonTestBuf is not allocated on the stack as the stack may be moved while
+// the test accesses the buffer via its address.
+var poisonTestBuf [64]byte
+
+func TestPoison(t *testing.T) {
+	defer func() {
+		kfmt.SetOutputSink(nil)
+	}()
+
+	var (
+		buf             = poisonTestBuf[:]
+		addr            = uintptr(unsafe.Pointer(&buf[0]))
+		output          bytes.Buffer
+		freePC, _, _, _ = runtime.Caller(0)
+	)
+	kfmt.SetOutputSink(&output)
+	output.Reset()
+
+	Poison(addr, Size(len(buf)), freePC)
+
+	if got := *(*uintptr)(unsafe.Pointer(addr)); got != freePC {
+		t.Fatalf("expected block header to contain the free PC 0x%x; got 0x%x", freePC, got)
+	}
+
+	for i := int(poisonHeaderSize); i < len(buf); i++ {
+		if buf[i] != PoisonFree {
+			t.Fatalf("expected byte %d to be set to the poison pattern; got 0x%x", i, buf[i])
+		}
+	}
+
+	if !CheckPoison("test", addr, Size(len(buf)), 0) {
+		t.Fatal("expected CheckPoison to return true for an unmodified block")
+	}
+
+	if output.Len() != 0 {
+		t.Fatalf("expected no output for an unmodified block; got %q", output.String())
+	}
+
+	buf[42] = 0
+	if CheckPoison("test", addr, Size(len(buf)), freePC) {
+		t.Fatal("expected CheckPoison to return false for a modified block")
+	}
+
+	expLines := []string{
+		"[test] use-after-free: byte at 0x",
+		"[test] block released by: gopheros/kernel/mem.TestPoison",
+		"[test] detected when allocated by: gopheros/kernel/mem.TestPoison",
+	}
+	for _, exp := range expLines {
+		if got := output.String(); !strings.Contains(got, exp) {
+			t.Fatalf("expected output to contain %q; got:\n%s", exp, got)
+		}
+	}
+}
+
+func TestCallerPC(t *testing.T) {
+	// All functions in this package are skipped so the first reported
+	// caller should be the test runner
+	if got, exp := funcName(CallerPC()), "testing.tRunner"; got != exp {
+		t.Fatalf("expected caller to be %q; got %q", exp, got)
+	}
+
+	// If the stack frames inspected by CallerPC all belong to the memory
+	// management packages, CallerPC returns 0
+	var deepCallerPC func(depth int) uintptr
+	deepCallerPC = func(depth int) uintptr {
+		if depth == 0 {
+			return CallerPC()
+		}
+		return deepCallerPC(depth - 1)
+	}
+
+	if got := deepCallerPC(maxCallerDepth); got != 0 {
+		t.Fatalf("expected CallerPC to return 0; got 0x%x", got)
+	}
+
+	if got, exp := funcName(0), "unknown"; got != exp {
+		t.Fatalf("expected name for invalid PC to be %q; got %q", exp, got)
+	}
+}
+
+func TestIsMemPkgFunc(t *testing.T) {
+	specs := []struct {
+		name string
+		exp  bool
+	}{
+		{"gopheros/kernel/mem.Memset", true},
+		{"gopheros/kernel/mem/slab.(*Cache).Alloc", true},
+		{"gopheros/kernel/memory.Foo", false},
+		{"gopheros/kernel/mem", false},
+		{"gopheros/device/acpi.probe", false},
+		{"main.main", false},
+	}
+
+	for specIndex, spec := range specs {
+		if got := isMemPkgFunc(spec.name); got != spec.exp {
+			t.Errorf("[spec %d] expected isMemPkgFunc(%q) to return %t; got %t", specIndex, spec.name, spec.exp, got)
+		}
+	}
+}
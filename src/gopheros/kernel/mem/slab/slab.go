@@ -0,0 +1,502 @@
+// Package slab implements an object allocator that carves physical pages into
+// caches of fixed-size objects. Frequently allocated kernel structures should
+// be allocated from a slab cache instead of reserving whole pages via the
+// physical frame allocator.
+package slab
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/kfmt"
+	"gopheros/kernel/mem"
+	"gopheros/kernel/mem/pmm"
+	"gopheros/kernel/mem/pmm/allocator"
+	"gopheros/kernel/mem/vmm"
+	"io"
+	"unsafe"
+)
+
+const (
+	// MaxObjectSize defines the largest object size that can be managed by
+	// a slab cache. Larger objects should be allocated directly via the
+	// physical frame allocator.
+	MaxObjectSize = mem.PageSize / 8
+
+	// objectAlign defines the alignment for objects allocated by a cache.
+	objectAlign = mem.Size(8)
+
+	// slabMagic is stored in each slab header and allows Free to detect
+	// attempts to release addresses that do not belong to a slab.
+	slabMagic = 0x51ab51ab
+
+	// noFreeObject is used as the free list terminator.
+	noFreeObject = uint16(0xffff)
+
+	// allocatedObject is stored in the free list entry of each allocated
+	// object and allows Free to detect objects that are released twice.
+	allocatedObject = uint16(0xfffe)
+
+	// maxFreeSlabPages defines the max number of virtual pages released by
+	// Shrink that are kept for reuse by caches that need to grow.
+	maxFreeSlabPages = 64
+)
+
+var (
+	// caches tracks all caches created via NewCache.
+	caches []*Cache
+
+	// sizeCaches contains a lazily-initialized cache for each entry in
+	// sizeClasses. These caches are used to service calls to Alloc.
+	sizeClasses    = [...]mem.Size{16, 32, 64, 128, 256, 512}
+	sizeCacheNames = [...]string{"size-16", "size-32", "size-64", "size-128", "size-256", "size-512"}
+	sizeCaches     [len(sizeClasses)]*Cache
+
+	// freeSlabPages holds the virtual addresses of the slab pages that
+	// were unmapped by Shrink. Virtual addresses reserved via
+	// EarlyReserveRegion cannot be returned so they are reused by grow.
+	freeSlabPages     [maxFreeSlabPages]uintptr
+	freeSlabPageCount int
+
+	errInvalidObjectSize = &kernel.Error{Module: "slab", Message: "invalid object size"}
+	errNotSlabObject     = &kernel.Error{Module: "slab", Message: "address does not belong to a slab"}
+	errWrongCache        = &kernel.Error{Module: "slab", Message: "object does not belong to this cache"}
+	errDoubleFree        = &kernel.Error{Module: "slab", Message: "object has already been freed"}
+
+	// The following functions are used by tests to mock calls to the vmm
+	// and allocator packages.
+	earlyReserveRegionFn = vmm.EarlyReserveRegion
+	mapFn                = vmm.Map
+	allocFrameFn         = allocator.AllocFrameFor
+	translateFn          = vmm.Translate
+	unmapFn              = vmm.Unmap
+	freeFrameFn          = allocator.FreeFrame
+)
+
+// Constructor is a function that initializes the contents of a newly
+// allocated object. Constructors are invoked once for each object when a
+// cache allocates a new slab; objects are expected to be returned to the
+// cache in their constructed state.
+type Constructor func(obj uintptr)
+
+// Stats contains allocation statistics for a slab cache.
+type Stats struct {
+	// The number of pages allocated by the cache.
+	Slabs uint32
+
+	// The number of objects that fit in a single slab.
+	ObjectsPerSlab uint32
+
+	// The number of objects currently handed out by the cache.
+	ActiveObjects uint32
+
+	// The total number of objects (free and allocated) managed by the
+	// cache.
+	TotalObjects uint32
+
+	// The total number of calls to Alloc and Free.
+	AllocCount uint64
+	FreeCount  uint64
+}
+
+// slab is the header stored at the beginning of each page that is managed by
+// a cache. The header is followed by an array of uint16 values that contains
+// the index of the next free object for each free object in the slab (or
+// allocatedObject for allocated objects) and the object storage. Keeping the
+// free list outside the objects allows caches to preserve the constructed
+// state of released objects.
+type slab struct {
+	magic uint32
+
+	// The number of allocated objects in this slab.
+	inUse uint16
+
+	// The index of the first free object in this slab or noFreeObject if
+	// the slab is full.
+	freeHead uint16
+
+	// The cache that owns this slab.
+	cache *Cache
+
+	// Links to the previous and next slab in the cache partial/full list.
+	prev, next uintptr
+}
+
+// Cache manages a set of slabs that are used to allocate objects of a
+// particular size.
+type Cache struct {
+	name    string
+	objSize mem.Size
+	ctor    Constructor
+
+	// The offset of the object storage from the start of each slab.
+	objOffset uintptr
+
+	// poison is set if free objects are filled with the mem.PoisonFree
+	// pattern. Caches with a constructor are never poisoned as that would
+	// destroy the constructed state of their objects.
+	poison bool
+
+	// The partial list contains slabs with at least one free object.
+	// Fully allocated slabs are moved to the full list.
+	partial, full uintptr
+
+	stats Stats
+}
+
+// NewCache creates a new cache for allocating objects of the requested size.
+// Object sizes are rounded up to a multiple of 8 bytes. If the object size is
+// a power of two, the allocated objects will be aligned to their size. If
+// ctor is not nil it will be invoked for each object when the cache allocates
+// a new slab. If mem.PoisonEnabled is set and no ctor is specified, released
+// objects are poisoned and checked for modifications when reallocated.
+//
+// NewCache uses the Go allocator and must not be called before the Go runtime
+// has been initialized.
+func NewCache(name string, objSize mem.Size, ctor Constructor) (*Cache, *kernel.Error) {
+	objSize = (objSize + objectAlign - 1) &^ (objectAlign - 1)
+	if objSize == 0 || objSize > MaxObjectSize {
+		return nil, errInvalidObjectSize
+	}
+
+	cache := &Cache{
+		name:    name,
+		objSize: objSize,
+		ctor:    ctor,
+		poison:  mem.PoisonEnabled && ctor == nil && objSize >= mem.MinPoisonSize,
+	}
+
+	// Objects whose size is a power of two are naturally aligned to their
+	// size; all other objects are aligned to objectAlign.
+	align := uintptr(objectAlign)
+	if objSize&(objSize-1) == 0 {
+		align = uintptr(objSize)
+	}
+
+	// Calculate how many objects (and their free list entries) fit in a
+	// page after the slab header and make sure that the object storage
+	// is properly aligned.
+	hdrSize := unsafe.Sizeof(slab{})
+	objCount := (uintptr(mem.PageSize) - hdrSize) / (uintptr(objSize) + 2)
+	for ; ; objCount-- {
+		cache.objOffset = (hdrSize + 2*objCount + align - 1) &^ (align - 1)
+		if cache.objOffset+objCount*uintptr(objSize) <= uintptr(mem.PageSize) {
+			break
+		}
+	}
+	cache.stats.ObjectsPerSlab = uint32(objCount)
+
+	caches = append(caches, cache)
+	return cache, nil
+}
+
+// Name returns the name of the cache.
+func (c *Cache) Name() string {
+	return c.name
+}
+
+// ObjectSize returns the size of the objects managed by the cache.
+func (c *Cache) ObjectSize() mem.Size {
+	return c.objSize
+}
+
+// Stats returns the allocation statistics for the cache.
+func (c *Cache) Stats() Stats {
+	return c.stats
+}
+
+// Alloc returns the address of a free object from the cache. If no free
+// objects are available, the cache will allocate a new slab.
+func (c *Cache) Alloc() (uintptr, *kernel.Error) {
+	if c.partial == 0 {
+		if err := c.grow(); err != nil {
+			return 0, err
+		}
+	}
+
+	slabAddr := c.partial
+	s := (*slab)(unsafe.Pointer(slabAddr))
+	objIndex := s.freeHead
+	nextFree := c.nextFreePtr(slabAddr, objIndex)
+	s.freeHead, *nextFree = *nextFree, allocatedObject
+	s.inUse++
+
+	if s.freeHead == noFreeObject {
+		c.partial = listRemove(c.partial, s)
+		c.full = listPush(c.full, s)
+	}
+
+	c.stats.ActiveObjects++
+	c.stats.AllocCount++
+
+	obj := slabAddr + c.objOffset + uintptr(objIndex)*uintptr(c.objSize)
+	if c.poison {
+		mem.CheckPoison("slab", obj, c.objSize, mem.CallerPC())
+	}
+
+	return obj, nil
+}
+
+// Free returns an object previously allocated via a call to Alloc back to
+// the cache. Attempts to free an object that is not currently allocated
+// fail with an error.
+func (c *Cache) Free(obj uintptr) *kernel.Error {
+	slabAddr := obj &^ uintptr(mem.PageSize-1)
+	s := (*slab)(unsafe.Pointer(slabAddr))
+	if s.magic != slabMagic {
+		return errNotSlabObject
+	}
+
+	if s.cache != c {
+		return errWrongCache
+	}
+
+	objAddr := obj - slabAddr
+	if objAddr < c.objOffset || (objAddr-c.objOffset)%uintptr(c.objSize) != 0 {
+		return errNotSlabObject
+	}
+
+	objIndex := uint16((objAddr - c.objOffset) / uintptr(c.objSize))
+	if uint32(objIndex) >= c.stats.ObjectsPerSlab {
+		return errNotSlabObject
+	}
+
+	nextFree := c.nextFreePtr(slabAddr, objIndex)
+	if *nextFree != allocatedObject {
+		return errDoubleFree
+	}
+
+	if c.poison {
+		mem.Poison(obj, c.objSize, mem.CallerPC())
+	}
+
+	if s.freeHead == noFreeObject {
+		c.full = listRemove(c.full, s)
+		c.partial = listPush(c.partial, s)
+	}
+
+	*nextFree = s.freeHead
+	s.freeHead = objIndex
+	s.inUse--
+
+	c.stats.ActiveObjects--
+	c.stats.FreeCount++
+	return nil
+}
+
+// grow allocates a new slab and adds it to the partial slab list. If the slab
+// cannot be set up, its frame is returned to the physical frame allocator and
+// its virtual address is kept for reuse.
+func (c *Cache) grow() *kernel.Error {
+	var (
+		slabAddr uintptr
+		err      *kernel.Error
+	)
+
+	if freeSlabPageCount != 0 {
+		freeSlabPageCount--
+		slabAddr = freeSlabPages[freeSlabPageCount]
+	} else if slabAddr, err = earlyReserveRegionFn(mem.PageSize); err != nil {
+		return err
+	}
+
+	frame, err := allocFrameFn(allocator.OwnerSlab)
+	if err != nil {
+		putFreeSlabPage(slabAddr)
+		return err
+	}
+
+	if err = mapFn(vmm.PageFromAddress(slabAddr), frame, vmm.FlagPresent|vmm.FlagRW|vmm.FlagNoExecute); err != nil {
+		_ = freeFrameFn(frame)
+		putFreeSlabPage(slabAddr)
+		return err
+	}
+
+	s := (*slab)(unsafe.Pointer(slabAddr))
+	s.magic = slabMagic
+	s.cache = c
+	s.inUse = 0
+	s.freeHead = 0
+
+	objCount := uint16(c.stats.ObjectsPerSlab)
+	for objIndex := uint16(0); objIndex < objCount; objIndex++ {
+		if objIndex == objCount-1 {
+			*c.nextFreePtr(slabAddr, objIndex) = noFreeObject
+		} else {
+			*c.nextFreePtr(slabAddr, objIndex) = objIndex + 1
+		}
+
+		obj := slabAddr + c.objOffset + uintptr(objIndex)*uintptr(c.objSize)
+		switch {
+		case c.ctor != nil:
+			c.ctor(obj)
+		case c.poison:
+			mem.Poison(obj, c.objSize, 0)
+		}
+	}
+
+	c.partial = listPush(c.partial, s)
+	c.stats.Slabs++
+	c.stats.TotalObjects += uint32(objCount)
+	return nil
+}
+
+// Shrink releases the pages of all slabs without any allocated objects back
+// to the physical frame allocator and returns the number of released pages.
+func (c *Cache) Shrink() uint32 {
+	var released uint32
+
+	for slabAddr := c.partial; slabAddr != 0; {
+		s := (*slab)(unsafe.Pointer(slabAddr))
+		nextAddr := s.next
+		if s.inUse == 0 && c.release(s) {
+			released++
+		}
+		slabAddr = nextAddr
+	}
+
+	return released
+}
+
+// release unmaps an empty slab and returns its page to the physical frame
+// allocator. It returns false if the slab could not be released.
+func (c *Cache) release(s *slab) bool {
+	slabAddr := uintptr(unsafe.Pointer(s))
+	physAddr, err := translateFn(slabAddr)
+	if err != nil {
+		return false
+	}
+
+	c.partial = listRemove(c.partial, s)
+	s.magic = 0
+	if err = unmapFn(vmm.PageFromAddress(slabAddr)); err != nil {
+		c.partial = listPush(c.partial, s)
+		s.magic = slabMagic
+		return false
+	}
+
+	c.stats.Slabs--
+	c.stats.TotalObjects -= c.stats.ObjectsPerSlab
+	putFreeSlabPage(slabAddr)
+
+	return freeFrameFn(pmm.Frame(physAddr>>mem.PageShift)) == nil
+}
+
+// putFreeSlabPage adds an unmapped slab page to the list of pages that can be
+// reused by grow. The page is dropped if the list is full.
+func putFreeSlabPage(slabAddr uintptr) {
+	if freeSlabPageCount < maxFreeSlabPages {
+		freeSlabPages[freeSlabPageCount] = slabAddr
+		freeSlabPageCount++
+	}
+}
+
+// nextFreePtr returns a pointer to the free list entry for the object with
+// the supplied index.
+func (c *Cache) nextFreePtr(slabAddr uintptr, objIndex uint16) *uint16 {
+	return (*uint16)(unsafe.Pointer(slabAddr + unsafe.Sizeof(slab{}) + 2*uintptr(objIndex)))
+}
+
+// listPush inserts s at the head of the slab list and returns the new list
+// head.
+func listPush(head uintptr, s *slab) uintptr {
+	s.prev, s.next = 0, head
+	if head != 0 {
+		(*slab)(unsafe.Pointer(head)).prev = uintptr(unsafe.Pointer(s))
+	}
+
+	return uintptr(unsafe.Pointer(s))
+}
+
+// listRemove removes s from the slab list and returns the new list head.
+func listRemove(head uintptr, s *slab) uintptr {
+	if s.prev != 0 {
+		(*slab)(unsafe.Pointer(s.prev)).next = s.next
+	} else {
+		head = s.next
+	}
+
+	if s.next != 0 {
+		(*slab)(unsafe.Pointer(s.next)).prev = s.prev
+	}
+
+	s.prev, s.next = 0, 0
+	return head
+}
+
+// Alloc allocates an object of at least the requested size from the
+// smallest matching size cache. The size caches are created the first time
+// they are used.
+func Alloc(size mem.Size) (uintptr, *kernel.Error) {
+	for classIndex, classSize := range sizeClasses {
+		if size > classSize {
+			continue
+		}
+
+		if sizeCaches[classIndex] == nil {
+			cache, err := NewCache(sizeCacheNames[classIndex], classSize, nil)
+			if err != nil {
+				return 0, err
+			}
+			sizeCaches[classIndex] = cache
+		}
+
+		return sizeCaches[classIndex].Alloc()
+	}
+
+	return 0, errInvalidObjectSize
+}
+
+// Free releases an object allocated by any slab cache.
+func Free(obj uintptr) *kernel.Error {
+	s := (*slab)(unsafe.Pointer(obj &^ uintptr(mem.PageSize-1)))
+	if s.magic != slabMagic {
+		return errNotSlabObject
+	}
+
+	return s.cache.Free(obj)
+}
+
+// collectStats is registered as a mem stats collector and reports the object
+// usage of all slab caches.
+func collectStats(usage *mem.Usage) {
+	for _, cache := range caches {
+		usage.Caches = append(usage.Caches, mem.CacheUsage{
+			Name:          cache.name,
+			ObjectSize:    cache.objSize,
+			ActiveObjects: cache.stats.ActiveObjects,
+			TotalObjects:  cache.stats.TotalObjects,
+			Slabs:         cache.stats.Slabs,
+		})
+	}
+}
+
+// Shrink releases the pages of all empty slabs across all caches and returns
+// the number of released pages. It is registered as a mem reclaimer so that
+// it gets invoked when the system runs low on memory.
+func Shrink() uint32 {
+	var released uint32
+	for _, cache := range caches {
+		released += cache.Shrink()
+	}
+
+	return released
+}
+
+func init() {
+	_ = mem.RegisterStatsCollector(collectStats)
+	_ = mem.RegisterReclaimer(Shrink)
+}
+
+// PrintStats outputs the allocation statistics for all slab caches to w.
+func PrintStats(w io.Writer) {
+	for _, cache := range caches {
+		kfmt.Fprintf(w, "[slab] %s: object size: %d, active: %d/%d, slabs: %d, allocs: %d, frees: %d\n",
+			cache.name,
+			uint64(cache.objSize),
+			cache.stats.ActiveObjects,
+			cache.stats.TotalObjects,
+			cache.stats.Slabs,
+			cache.stats.AllocCount,
+			cache.stats.FreeCount,
+		)
+	}
+}
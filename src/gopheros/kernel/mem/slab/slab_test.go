@@ -0,0 +1,643 @@
+package slab
+
+import (
+	"bytes"
+	"gopheros/kernel"
+	"gopheros/kernel/kfmt"
+	"gopheros/kernel/mem"
+	"gopheros/kernel/mem/pmm"
+	"gopheros/kernel/mem/pmm/allocator"
+	"gopheros/kernel/mem/vmm"
+	"reflect"
+	"strings"
+	"testing"
+	"unsafe"
+)
+
+func TestNewCache(t *testing.T) {
+	defer resetState()
+
+	specs := []struct {
+		objSize        mem.Size
+		expObjSize     mem.Size
+		expErr         *kernel.Error
+		expObjsPerSlab uint32
+	}{
+		{0, 0, errInvalidObjectSize, 0},
+		{MaxObjectSize + 1, 0, errInvalidObjectSize, 0},
+		{1, 8, nil, 406},
+		{24, 24, nil, 156},
+		{256, 256, nil, 15},
+		{MaxObjectSize, MaxObjectSize, nil, 7},
+	}
+
+	for specIndex, spec := range specs {
+		cache, err := NewCache("test", spec.objSize, nil)
+		if err != spec.expErr {
+			t.Errorf("[spec %d] expected error %v; got %v", specIndex, spec.expErr, err)
+			continue
+		}
+
+		if err != nil {
+			continue
+		}
+
+		if got := cache.ObjectSize(); got != spec.expObjSize {
+			t.Errorf("[spec %d] expected object size to be %d; got %d", specIndex, spec.expObjSize, got)
+		}
+
+		if got := cache.Stats().ObjectsPerSlab; got != spec.expObjsPerSlab {
+			t.Errorf("[spec %d] expected objects per slab to be %d; got %d", specIndex, spec.expObjsPerSlab, got)
+		}
+
+		expAlign := uintptr(objectAlign)
+		if spec.expObjSize&(spec.expObjSize-1) == 0 {
+			expAlign = uintptr(spec.expObjSize)
+		}
+
+		if cache.objOffset%expAlign != 0 {
+			t.Errorf("[spec %d] expected object offset %d to be aligned to %d bytes", specIndex, cache.objOffset, expAlign)
+		}
+
+		if lastObjEnd := cache.objOffset + uintptr(cache.stats.ObjectsPerSlab)*uintptr(cache.objSize); lastObjEnd > uintptr(mem.PageSize) {
+			t.Errorf("[spec %d] expected objects to fit in a single page; last object ends at offset %d", specIndex, lastObjEnd)
+		}
+	}
+
+	if exp, got := 4, len(caches); got != exp {
+		t.Fatalf("expected %d caches to be registered; got %d", exp, got)
+	}
+}
+
+func TestCacheAllocFree(t *testing.T) {
+	defer resetState()
+	mockPages(2)
+
+	var ctorCalls int
+	cache, err := NewCache("test", MaxObjectSize, func(obj uintptr) {
+		ctorCalls++
+		*(*uint64)(unsafe.Pointer(obj)) = 0xbadf00d
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cache.Name() != "test" {
+		t.Fatalf("expected cache name to be %q; got %q", "test", cache.Name())
+	}
+
+	objsPerSlab := int(cache.Stats().ObjectsPerSlab)
+	objects := make([]uintptr, 0, 2*objsPerSlab)
+	for i := 0; i < 2*objsPerSlab; i++ {
+		obj, err := cache.Alloc()
+		if err != nil {
+			t.Fatalf("[alloc %d] unexpected error: %v", i, err)
+		}
+
+		if got := *(*uint64)(unsafe.Pointer(obj)); got != 0xbadf00d {
+			t.Errorf("[alloc %d] expected object to be initialized by the constructor; got %x", i, got)
+		}
+
+		for _, prevObj := range objects {
+			if prevObj == obj {
+				t.Fatalf("[alloc %d] object %x was allocated twice", i, obj)
+			}
+		}
+		objects = append(objects, obj)
+	}
+
+	if ctorCalls != 2*objsPerSlab {
+		t.Fatalf("expected constructor to be called %d times; got %d", 2*objsPerSlab, ctorCalls)
+	}
+
+	stats := cache.Stats()
+	if stats.Slabs != 2 || stats.ActiveObjects != uint32(2*objsPerSlab) || stats.TotalObjects != uint32(2*objsPerSlab) {
+		t.Fatalf("unexpected cache stats: %+v", stats)
+	}
+
+	if cache.partial != 0 {
+		t.Fatal("expected all slabs to be moved to the full list")
+	}
+
+	// Both slabs are full; the next allocation needs a new slab
+	if _, err := cache.Alloc(); err != errOutOfPages {
+		t.Fatalf("expected error %v; got %v", errOutOfPages, err)
+	}
+
+	// Free all objects in the first slab and one object in the second slab
+	for i := 0; i <= objsPerSlab; i++ {
+		if err := cache.Free(objects[i]); err != nil {
+			t.Fatalf("[free %d] unexpected error: %v", i, err)
+		}
+	}
+
+	if cache.partial == 0 || cache.full != 0 {
+		t.Fatal("expected all slabs to be moved to the partial list")
+	}
+
+	// The released objects should be reused
+	for i := 0; i <= objsPerSlab; i++ {
+		if _, err := cache.Alloc(); err != nil {
+			t.Fatalf("[realloc %d] unexpected error: %v", i, err)
+		}
+	}
+
+	stats = cache.Stats()
+	if exp := uint64(3*objsPerSlab + 1); stats.AllocCount != exp {
+		t.Fatalf("expected alloc count to be %d; got %d", exp, stats.AllocCount)
+	}
+
+	if exp := uint64(objsPerSlab + 1); stats.FreeCount != exp {
+		t.Fatalf("expected free count to be %d; got %d", exp, stats.FreeCount)
+	}
+
+	if ctorCalls != 2*objsPerSlab {
+		t.Fatalf("expected the constructor not to be called for reused objects; got %d calls", ctorCalls)
+	}
+}
+
+func TestCacheFreeErrors(t *testing.T) {
+	defer resetState()
+	pages := mockPages(2)
+
+	cache1, _ := NewCache("test1", 32, nil)
+	cache2, _ := NewCache("test2", 32, nil)
+
+	obj, err := cache1.Alloc()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The objects of this cache do not fill the entire page
+	cache3, _ := NewCache("test3", 48, nil)
+	if _, err = cache3.Alloc(); err != nil {
+		t.Fatal(err)
+	}
+	pastLastObj := pages[1] + cache3.objOffset + uintptr(cache3.stats.ObjectsPerSlab)*uintptr(cache3.objSize)
+	if pastLastObj >= pages[1]+uintptr(mem.PageSize) {
+		t.Fatal("expected the objects of cache3 to leave space at the end of the page")
+	}
+
+	notSlab := make([]byte, 2*mem.PageSize)
+	notSlabAddr := (uintptr(unsafe.Pointer(&notSlab[0])) + uintptr(mem.PageSize-1)) &^ uintptr(mem.PageSize-1)
+
+	specs := []struct {
+		cache  *Cache
+		obj    uintptr
+		expErr *kernel.Error
+	}{
+		{cache1, notSlabAddr, errNotSlabObject},
+		{cache2, obj, errWrongCache},
+		{cache1, obj + 1, errNotSlabObject},
+		{cache1, pages[0], errNotSlabObject},
+		{cache1, pages[0] + uintptr(mem.PageSize) - 8, errNotSlabObject},
+		{cache3, pastLastObj, errNotSlabObject},
+	}
+
+	for specIndex, spec := range specs {
+		if err := spec.cache.Free(spec.obj); err != spec.expErr {
+			t.Errorf("[spec %d] expected error %v; got %v", specIndex, spec.expErr, err)
+		}
+	}
+
+	// Objects that are not allocated cannot be freed
+	if err := cache1.Free(obj + uintptr(cache1.ObjectSize())); err != errDoubleFree {
+		t.Errorf("expected error %v when freeing an object that was never allocated; got %v", errDoubleFree, err)
+	}
+
+	if err := cache1.Free(obj); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cache1.Free(obj); err != errDoubleFree {
+		t.Errorf("expected error %v; got %v", errDoubleFree, err)
+	}
+
+	if stats := cache1.Stats(); stats.ActiveObjects != 0 || stats.FreeCount != 1 {
+		t.Errorf("expected a double free not to update the cache stats; got %d active objects, %d frees", stats.ActiveObjects, stats.FreeCount)
+	}
+
+	// The object can be allocated again after a rejected double free
+	if got, err := cache1.Alloc(); err != nil || got != obj {
+		t.Errorf("expected Alloc to return 0x%x; got 0x%x, %v", obj, got, err)
+	}
+}
+
+func TestCacheGrowErrors(t *testing.T) {
+	defer resetState()
+
+	expErr := &kernel.Error{Module: "test", Message: "something went wrong"}
+	cache, _ := NewCache("test", 32, nil)
+
+	t.Run("reserve region fails", func(t *testing.T) {
+		earlyReserveRegionFn = func(_ mem.Size) (uintptr, *kernel.Error) {
+			return 0, expErr
+		}
+
+		if _, err := cache.Alloc(); err != expErr {
+			t.Fatalf("expected error %v; got %v", expErr, err)
+		}
+	})
+
+	// The reserved page is kept for reuse when the slab cannot be set up
+	const slabAddr = uintptr(0xffff800000001000)
+	reserveCount := 0
+	earlyReserveRegionFn = func(_ mem.Size) (uintptr, *kernel.Error) {
+		reserveCount++
+		return slabAddr, nil
+	}
+
+	t.Run("frame allocation fails", func(t *testing.T) {
+		allocFrameFn = func(_ allocator.FrameOwner) (pmm.Frame, *kernel.Error) {
+			return pmm.InvalidFrame, expErr
+		}
+
+		for attempt := 0; attempt < 2; attempt++ {
+			if _, err := cache.Alloc(); err != expErr {
+				t.Fatalf("[attempt %d] expected error %v; got %v", attempt, expErr, err)
+			}
+
+			if freeSlabPageCount != 1 || freeSlabPages[0] != slabAddr {
+				t.Fatalf("[attempt %d] expected the slab page to be kept for reuse", attempt)
+			}
+		}
+
+		if reserveCount != 1 {
+			t.Fatalf("expected the slab page to be reserved once; got %d reservations", reserveCount)
+		}
+	})
+
+	t.Run("map fails", func(t *testing.T) {
+		var freedFrames []pmm.Frame
+		allocFrameFn = func(_ allocator.FrameOwner) (pmm.Frame, *kernel.Error) {
+			return pmm.Frame(42), nil
+		}
+		mapFn = func(_ vmm.Page, _ pmm.Frame, _ vmm.PageTableEntryFlag) *kernel.Error {
+			return expErr
+		}
+		freeFrameFn = func(frame pmm.Frame) *kernel.Error {
+			freedFrames = append(freedFrames, frame)
+			return nil
+		}
+
+		if _, err := cache.Alloc(); err != expErr {
+			t.Fatalf("expected error %v; got %v", expErr, err)
+		}
+
+		if len(freedFrames) != 1 || freedFrames[0] != pmm.Frame(42) {
+			t.Fatalf("expected the slab frame to be freed; got %v", freedFrames)
+		}
+
+		if freeSlabPageCount != 1 || freeSlabPages[0] != slabAddr {
+			t.Fatal("expected the slab page to be kept for reuse")
+		}
+	})
+}
+
+func TestAllocFree(t *testing.T) {
+	defer resetState()
+	mockPages(len(sizeClasses))
+
+	if _, err := Alloc(MaxObjectSize + 1); err != errInvalidObjectSize {
+		t.Fatalf("expected error %v; got %v", errInvalidObjectSize, err)
+	}
+
+	for specIndex, size := range []mem.Size{1, 16, 17, 64, 100, 512} {
+		obj, err := Alloc(size)
+		if err != nil {
+			t.Fatalf("[spec %d] unexpected error: %v", specIndex, err)
+		}
+
+		s := (*slab)(unsafe.Pointer(obj &^ uintptr(mem.PageSize-1)))
+		if s.cache.ObjectSize() < size {
+			t.Errorf("[spec %d] expected object to be allocated from a cache with object size >= %d; got %d", specIndex, size, s.cache.ObjectSize())
+		}
+
+		if err = Free(obj); err != nil {
+			t.Errorf("[spec %d] unexpected error: %v", specIndex, err)
+		}
+	}
+
+	// Size caches should be created on demand and reused
+	if exp, got := 5, len(caches); got != exp {
+		t.Fatalf("expected %d caches to be registered; got %d", exp, got)
+	}
+
+	notSlab := make([]byte, 2*mem.PageSize)
+	notSlabAddr := (uintptr(unsafe.Pointer(&notSlab[0])) + uintptr(mem.PageSize-1)) &^ uintptr(mem.PageSize-1)
+	if err := Free(notSlabAddr); err != errNotSlabObject {
+		t.Fatalf("expected error %v; got %v", errNotSlabObject, err)
+	}
+
+	t.Run("cache creation error", func(t *testing.T) {
+		defer func(origSize mem.Size) {
+			sizeClasses[0] = origSize
+		}(sizeClasses[0])
+
+		sizeCaches[0] = nil
+		sizeClasses[0] = 0
+		if _, err := Alloc(0); err != errInvalidObjectSize {
+			t.Fatalf("expected error %v; got %v", errInvalidObjectSize, err)
+		}
+	})
+}
+
+func TestCacheShrink(t *testing.T) {
+	defer resetState()
+	pages := mockPages(3)
+
+	var (
+		unmapped []vmm.Page
+		freed    []pmm.Frame
+	)
+
+	translateFn = func(virtAddr uintptr) (uintptr, *kernel.Error) {
+		return virtAddr - pages[0] + 0x100000, nil
+	}
+	unmapFn = func(page vmm.Page) *kernel.Error {
+		unmapped = append(unmapped, page)
+		return nil
+	}
+	freeFrameFn = func(frame pmm.Frame) *kernel.Error {
+		freed = append(freed, frame)
+		return nil
+	}
+
+	cache, _ := NewCache("test", MaxObjectSize, nil)
+	objPerSlab := int(cache.Stats().ObjectsPerSlab)
+
+	// Allocate 3 slabs and release all objects in the first two
+	objs := make([]uintptr, 0, 3*objPerSlab)
+	for i := 0; i < 2*objPerSlab+1; i++ {
+		obj, err := cache.Alloc()
+		if err != nil {
+			t.Fatal(err)
+		}
+		objs = append(objs, obj)
+	}
+
+	for _, obj := range objs[:2*objPerSlab] {
+		if err := cache.Free(obj); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if exp, got := uint32(2), Shrink(); got != exp {
+		t.Fatalf("expected %d pages to be released; got %d", exp, got)
+	}
+
+	if stats := cache.Stats(); stats.Slabs != 1 || stats.TotalObjects != uint32(objPerSlab) || stats.ActiveObjects != 1 {
+		t.Fatalf("unexpected cache stats after shrinking: %+v", stats)
+	}
+
+	expUnmapped := []vmm.Page{vmm.PageFromAddress(pages[1]), vmm.PageFromAddress(pages[0])}
+	if !reflect.DeepEqual(unmapped, expUnmapped) {
+		t.Fatalf("expected pages %v to be unmapped; got %v", expUnmapped, unmapped)
+	}
+
+	expFreed := []pmm.Frame{0x101, 0x100}
+	if !reflect.DeepEqual(freed, expFreed) {
+		t.Fatalf("expected frames %v to be freed; got %v", expFreed, freed)
+	}
+
+	// Released virtual pages should be reused when the cache grows
+	for i := 0; i < 2*objPerSlab; i++ {
+		obj, err := cache.Alloc()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if slabAddr := obj &^ uintptr(mem.PageSize-1); slabAddr != pages[0] && slabAddr != pages[1] && slabAddr != pages[2] {
+			t.Fatalf("expected object to be allocated from a reused slab page; got 0x%x", obj)
+		}
+	}
+
+	if freeSlabPageCount != 0 {
+		t.Fatalf("expected all released pages to be reused; %d pages remain", freeSlabPageCount)
+	}
+}
+
+func TestCacheShrinkErrors(t *testing.T) {
+	defer resetState()
+	mockPages(maxFreeSlabPages + 1)
+
+	expErr := &kernel.Error{Module: "test", Message: "something went wrong"}
+	cache, _ := NewCache("test", MaxObjectSize, nil)
+	objPerSlab := int(cache.Stats().ObjectsPerSlab)
+
+	growSlabs := func(count int) {
+		objs := make([]uintptr, 0, count*objPerSlab)
+		for i := 0; i < count*objPerSlab; i++ {
+			obj, err := cache.Alloc()
+			if err != nil {
+				t.Fatal(err)
+			}
+			objs = append(objs, obj)
+		}
+
+		for _, obj := range objs {
+			if err := cache.Free(obj); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	growSlabs(1)
+
+	specs := []struct {
+		translateErr, unmapErr, freeErr *kernel.Error
+		expReleased                     uint32
+		expSlabs                        uint32
+	}{
+		{expErr, nil, nil, 0, 1},
+		{nil, expErr, nil, 0, 1},
+		// The page is unmapped but its frame cannot be returned
+		{nil, nil, expErr, 0, 0},
+	}
+
+	for specIndex, spec := range specs {
+		translateFn = func(virtAddr uintptr) (uintptr, *kernel.Error) { return virtAddr, spec.translateErr }
+		unmapFn = func(_ vmm.Page) *kernel.Error { return spec.unmapErr }
+		freeFrameFn = func(_ pmm.Frame) *kernel.Error { return spec.freeErr }
+
+		if got := cache.Shrink(); got != spec.expReleased {
+			t.Errorf("[spec %d] expected %d pages to be released; got %d", specIndex, spec.expReleased, got)
+		}
+
+		if got := cache.Stats().Slabs; got != spec.expSlabs {
+			t.Errorf("[spec %d] expected cache to have %d slabs; got %d", specIndex, spec.expSlabs, got)
+		}
+	}
+
+	// Once the free page list is full, released pages are not reused
+	freeFrameFn = func(_ pmm.Frame) *kernel.Error { return nil }
+	growSlabs(maxFreeSlabPages + 1)
+
+	if exp, got := uint32(maxFreeSlabPages+1), cache.Shrink(); got != exp {
+		t.Fatalf("expected %d pages to be released; got %d", exp, got)
+	}
+
+	if freeSlabPageCount != maxFreeSlabPages {
+		t.Fatalf("expected free slab page list to contain %d pages; got %d", maxFreeSlabPages, freeSlabPageCount)
+	}
+}
+
+func TestPrintStats(t *testing.T) {
+	defer resetState()
+	mockPages(1)
+
+	cache, _ := NewCache("test", 32, nil)
+	if _, err := cache.Alloc(); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	PrintStats(&buf)
+
+	exp := "[slab] test: object size: 32, active: 1/119, slabs: 1, allocs: 1, frees: 0\n"
+	if got := buf.String(); !strings.Contains(got, exp) {
+		t.Fatalf("expected output to contain:\n%q\ngot:\n%q", exp, got)
+	}
+}
+
+func TestCollectStats(t *testing.T) {
+	defer resetState()
+	mockPages(1)
+
+	cache, _ := NewCache("test", 32, nil)
+	if _, err := cache.Alloc(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The slab collector is registered when the package is initialized
+	usage := mem.Stats()
+
+	exp := []mem.CacheUsage{
+		{Name: "test", ObjectSize: 32, ActiveObjects: 1, TotalObjects: 119, Slabs: 1},
+	}
+	if !reflect.DeepEqual(usage.Caches, exp) {
+		t.Fatalf("expected cache usage to be:\n%+v\ngot:\n%+v", exp, usage.Caches)
+	}
+}
+
+func TestCachePoisoning(t *testing.T) {
+	defer func() {
+		mem.PoisonEnabled = false
+		kfmt.SetOutputSink(nil)
+		resetState()
+	}()
+	mockPages(2)
+
+	var output bytes.Buffer
+	kfmt.SetOutputSink(&output)
+	output.Reset()
+
+	mem.PoisonEnabled = true
+
+	isPoisoned := func(obj uintptr, size mem.Size) bool {
+		for offset := uintptr(8); offset < uintptr(size); offset++ {
+			if *(*byte)(unsafe.Pointer(obj + offset)) != mem.PoisonFree {
+				return false
+			}
+		}
+		return true
+	}
+
+	// Caches with a constructor should never be poisoned
+	ctorCache, _ := NewCache("ctor", 32, func(obj uintptr) {
+		*(*uint64)(unsafe.Pointer(obj)) = 0xf00
+	})
+	if ctorCache.poison {
+		t.Fatal("expected caches with a constructor not to be poisoned")
+	}
+
+	cache, _ := NewCache("test", 32, nil)
+	obj, err := cache.Alloc()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Newly allocated objects still contain the poison pattern written by
+	// grow as the caller is expected to initialize them.
+	if !isPoisoned(obj, 32) || output.Len() != 0 {
+		t.Fatalf("expected object from a new slab to be poisoned without any reports; got output:\n%s", output.String())
+	}
+
+	*(*uint64)(unsafe.Pointer(obj + 8)) = 0xbadf00d
+	if err = cache.Free(obj); err != nil {
+		t.Fatal(err)
+	}
+
+	if !isPoisoned(obj, 32) {
+		t.Fatal("expected released object to be poisoned")
+	}
+
+	// Write to the object after it has been released
+	*(*byte)(unsafe.Pointer(obj + 16)) = 0
+
+	if got, err := cache.Alloc(); err != nil || got != obj {
+		t.Fatalf("expected object 0x%x to be reallocated; got 0x%x (err: %v)", obj, got, err)
+	}
+
+	if exp := "[slab] use-after-free"; !strings.Contains(output.String(), exp) {
+		t.Fatalf("expected output to contain %q; got:\n%s", exp, output.String())
+	}
+}
+
+var (
+	errOutOfPages = &kernel.Error{Module: "test", Message: "out of pages"}
+
+	// mockPageBuf keeps the memory returned by mockPages alive.
+	mockPageBuf []byte
+)
+
+// mockPages mocks the vmm and allocator calls used by grow so that slabs are
+// backed by count page-aligned blocks of heap memory. Once all pages have
+// been handed out, grow will fail with errOutOfPages. mockPages returns the
+// addresses of the pages.
+func mockPages(count int) []uintptr {
+	mockPageBuf = make([]byte, (count+1)*int(mem.PageSize))
+
+	pages := make([]uintptr, count)
+	firstPage := (uintptr(unsafe.Pointer(&mockPageBuf[0])) + uintptr(mem.PageSize-1)) &^ uintptr(mem.PageSize-1)
+	for i := 0; i < count; i++ {
+		pages[i] = firstPage + uintptr(i)*uintptr(mem.PageSize)
+	}
+
+	nextPage := 0
+	earlyReserveRegionFn = func(_ mem.Size) (uintptr, *kernel.Error) {
+		if nextPage == len(pages) {
+			return 0, errOutOfPages
+		}
+
+		nextPage++
+		return pages[nextPage-1], nil
+	}
+	allocFrameFn = func(owner allocator.FrameOwner) (pmm.Frame, *kernel.Error) {
+		if owner != allocator.OwnerSlab {
+			return pmm.InvalidFrame, &kernel.Error{Module: "test", Message: "frame not allocated on behalf of slab"}
+		}
+
+		return pmm.Frame(0), nil
+	}
+	mapFn = func(_ vmm.Page, _ pmm.Frame, _ vmm.PageTableEntryFlag) *kernel.Error {
+		return nil
+	}
+
+	return pages
+}
+
+func resetState() {
+	earlyReserveRegionFn = vmm.EarlyReserveRegion
+	mapFn = vmm.Map
+	allocFrameFn = allocator.AllocFrameFor
+	translateFn = vmm.Translate
+	unmapFn = vmm.Unmap
+	freeFrameFn = allocator.FreeFrame
+	freeSlabPageCount = 0
+	mockPageBuf = nil
+	caches = nil
+	for i := 0; i < len(sizeCaches); i++ {
+		sizeCaches[i] = nil
+	}
+}
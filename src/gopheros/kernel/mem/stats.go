@@ -0,0 +1,118 @@
+package mem
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/kfmt"
+	"io"
+)
+
+// maxStatsCollectors defines the max number of collectors that can be
+// registered via RegisterStatsCollector.
+const maxStatsCollectors = 8
+
+var (
+	// statsCollectors is a statically allocated array so that collectors
+	// can be registered before the Go runtime is initialized.
+	statsCollectors     [maxStatsCollectors]StatsCollector
+	statsCollectorCount int
+
+	errTooManyStatsCollectors = &kernel.Error{Module: "mem", Message: "max number of stats collectors reached"}
+)
+
+// Usage describes the memory usage of the system as reported by the
+// registered stats collectors.
+type Usage struct {
+	// The total number of physical frames managed by the frame allocator.
+	TotalFrames uint32
+
+	// The number of frames that are currently in use.
+	UsedFrames uint32
+
+	// The number of frames that are available for allocation.
+	FreeFrames uint32
+
+	// A breakdown of the frame counts for each physical memory zone.
+	Zones []ZoneUsage
+
+	// The number of frames used by each kernel subsystem.
+	Owners []OwnerUsage
+
+	// The object usage of each slab cache.
+	Caches []CacheUsage
+}
+
+// ZoneUsage describes the usage of a contiguous physical memory zone.
+type ZoneUsage struct {
+	// The physical address range covered by the zone.
+	StartAddr uintptr
+	EndAddr   uintptr
+
+	TotalFrames uint32
+	FreeFrames  uint32
+}
+
+// OwnerUsage describes the number of frames used by a kernel subsystem.
+type OwnerUsage struct {
+	Owner  string
+	Frames uint32
+}
+
+// CacheUsage describes the object usage of a slab cache.
+type CacheUsage struct {
+	Name          string
+	ObjectSize    Size
+	ActiveObjects uint32
+	TotalObjects  uint32
+	Slabs         uint32
+}
+
+// StatsCollector is a function that populates the fields of a Usage value
+// with the statistics maintained by a memory management subsystem.
+type StatsCollector func(*Usage)
+
+// RegisterStatsCollector adds a collector to the list of collectors invoked
+// by Stats.
+func RegisterStatsCollector(collector StatsCollector) *kernel.Error {
+	if statsCollectorCount == maxStatsCollectors {
+		return errTooManyStatsCollectors
+	}
+
+	statsCollectors[statsCollectorCount] = collector
+	statsCollectorCount++
+	return nil
+}
+
+// Stats returns a snapshot of the current memory usage by invoking each
+// registered stats collector.
+func Stats() Usage {
+	var usage Usage
+	for index := 0; index < statsCollectorCount; index++ {
+		statsCollectors[index](&usage)
+	}
+
+	return usage
+}
+
+// PrintStats outputs a summary of the current memory usage to w.
+func PrintStats(w io.Writer) {
+	usage := Stats()
+
+	kfmt.Fprintf(w, "[mem] frames: %d total, %d used, %d free\n", usage.TotalFrames, usage.UsedFrames, usage.FreeFrames)
+	for _, zone := range usage.Zones {
+		kfmt.Fprintf(w, "[mem] zone [0x%16x - 0x%16x]: %d/%d frames free\n", zone.StartAddr, zone.EndAddr, zone.FreeFrames, zone.TotalFrames)
+	}
+
+	for _, owner := range usage.Owners {
+		kfmt.Fprintf(w, "[mem] %s: %d frames (%d KB)\n", owner.Owner, owner.Frames, uint64(Size(owner.Frames)<<PageShift/Kb))
+	}
+
+	for _, cache := range usage.Caches {
+		kfmt.Fprintf(w, "[mem] cache %s: object size: %d, active: %d/%d, slabs: %d\n",
+			cache.Name,
+			uint64(cache.ObjectSize),
+			cache.ActiveObjects,
+			cache.TotalObjects,
+			cache.Slabs,
+		)
+	}
+}
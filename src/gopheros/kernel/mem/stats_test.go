@@ -0,0 +1,68 @@
+package mem
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	defer func() {
+		statsCollectorCount = 0
+	}()
+
+	statsCollectorCount = 0
+	if usage := Stats(); usage.TotalFrames != 0 || len(usage.Zones) != 0 {
+		t.Fatalf("expected empty usage when no collectors are registered; got %+v", usage)
+	}
+
+	if err := RegisterStatsCollector(func(usage *Usage) {
+		usage.TotalFrames, usage.UsedFrames, usage.FreeFrames = 10, 4, 6
+		usage.Zones = append(usage.Zones, ZoneUsage{StartAddr: 0x1000, EndAddr: 0xafff, TotalFrames: 10, FreeFrames: 6})
+		usage.Owners = append(usage.Owners, OwnerUsage{Owner: "acpi", Frames: 4})
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := RegisterStatsCollector(func(usage *Usage) {
+		usage.Caches = append(usage.Caches, CacheUsage{Name: "foo", ObjectSize: 64, ActiveObjects: 3, TotalObjects: 63, Slabs: 1})
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	usage := Stats()
+	if usage.TotalFrames != 10 || usage.UsedFrames != 4 || usage.FreeFrames != 6 {
+		t.Fatalf("unexpected frame counts: %+v", usage)
+	}
+
+	if len(usage.Zones) != 1 || len(usage.Owners) != 1 || len(usage.Caches) != 1 {
+		t.Fatalf("expected usage to be populated by all collectors; got %+v", usage)
+	}
+
+	var buf bytes.Buffer
+	PrintStats(&buf)
+
+	exp := "[mem] frames: 10 total, 4 used, 6 free\n" +
+		"[mem] zone [0x0000000000001000 - 0x000000000000afff]: 6/10 frames free\n" +
+		"[mem] acpi: 4 frames (16 KB)\n" +
+		"[mem] cache foo: object size: 64, active: 3/63, slabs: 1\n"
+	if got := buf.String(); got != exp {
+		t.Fatalf("expected output to be:\n%q\ngot:\n%q", exp, got)
+	}
+}
+
+func TestRegisterStatsCollectorErrors(t *testing.T) {
+	defer func() {
+		statsCollectorCount = 0
+	}()
+
+	statsCollectorCount = 0
+	for index := 0; index < maxStatsCollectors; index++ {
+		if err := RegisterStatsCollector(func(_ *Usage) {}); err != nil {
+			t.Fatalf("[collector %d] unexpected error: %v", index, err)
+		}
+	}
+
+	if err := RegisterStatsCollector(func(_ *Usage) {}); err != errTooManyStatsCollectors {
+		t.Fatalf("expected error %v; got %v", errTooManyStatsCollectors, err)
+	}
+}
@@ -3,6 +3,8 @@ package vmm
 import (
 	"gopheros/kernel"
 	"gopheros/kernel/mem"
+	"gopheros/kernel/mem/pmm"
+	"unsafe"
 )
 
 var (
@@ -33,3 +35,238 @@ func EarlyReserveRegion(size mem.Size) (uintptr, *kernel.Error) {
 	earlyReserveLastUsed -= uintptr(size)
 	return earlyReserveLastUsed, nil
 }
+
+// releaseEarlyRegion returns a region obtained via EarlyReserveRegion so it
+// can be reserved again. As EarlyReserveRegion hands out regions in order,
+// the region can only be returned if no other region has been reserved after
+// it; otherwise, it remains reserved.
+func releaseEarlyRegion(startAddr uintptr, size mem.Size) {
+	if startAddr == earlyReserveLastUsed {
+		earlyReserveLastUsed += uintptr((size + (mem.PageSize - 1)) & ^(mem.PageSize - 1))
+	}
+}
+
+var (
+	// kernelAddrSpace describes the address space established by Init.
+	kernelAddrSpace AddressSpace
+
+	// tablePtrFn returns a pointer to the page table stored in the supplied
+	// frame. It is used by tests to override the physmap-based page table
+	// lookups. When compiling the kernel this function will be
+	// automatically inlined.
+	tablePtrFn = func(frame pmm.Frame) *pageTable {
+		return (*pageTable)(unsafe.Pointer(PhysToVirt(frame.Address())))
+	}
+
+	errCloneHugePage = &kernel.Error{Module: "vmm", Message: "address spaces with huge page user mappings cannot be cloned"}
+)
+
+// pageTable describes the contents of a page table at any page level.
+type pageTable [mem.PageSize >> mem.PointerShift]pageTableEntry
+
+// AddressSpace describes a virtual address space backed by its own page
+// directory table. All address spaces share the page tables for the kernel
+// half of the address space. As a result, kernel mappings established in any
+// address space are visible to all other address spaces as long as they do
+// not require a new top-level page table entry.
+type AddressSpace struct {
+	pdt PageDirectoryTable
+
+	// The anonymous memory regions created via MapAnonymous.
+	regions regionList
+}
+
+// KernelAddressSpace returns the address space established by Init.
+func KernelAddressSpace() *AddressSpace {
+	return &kernelAddrSpace
+}
+
+// NewAddressSpace creates an address space that contains no user mappings
+// and shares the kernel mappings with the kernel address space.
+func NewAddressSpace() (*AddressSpace, *kernel.Error) {
+	return newAddressSpace(&kernelAddrSpace)
+}
+
+// Clone creates a new address space that shares the kernel mappings with this
+// address space and contains a copy of its user mappings. The pages that back
+// the user mappings are shared by both address spaces and their frame
+// reference counts are incremented; any writable pages are marked as
+// copy-on-write so a private copy gets created the first time either address
+// space writes to them. The anonymous memory regions of this address space
+// are also copied so that the clone enforces the same protection and
+// populates the pages that have not been accessed yet. If cloning fails, the
+// page tables allocated for the clone are released and the extra frame
+// references are dropped.
+func (as *AddressSpace) Clone() (*AddressSpace, *kernel.Error) {
+	clone, err := newAddressSpace(as)
+	if err != nil {
+		return nil, err
+	}
+	clone.regions = as.regions
+
+	var (
+		srcTable = tablePtrFn(as.pdt.pdtFrame)
+		dstTable = tablePtrFn(clone.pdt.pdtFrame)
+	)
+
+	for index := 0; index < kernelSpaceFirstEntry; index++ {
+		if !srcTable[index].HasFlags(FlagPresent) {
+			continue
+		}
+
+		if err = cloneTable(1, &srcTable[index], &dstTable[index]); err != nil {
+			clone.releaseUserTables()
+			return nil, err
+		}
+	}
+
+	// Flush the TLB on all CPUs to make sure that the CoW changes to the
+	// user mappings are visible to any CPU using this address space.
+	shootdownAll()
+
+	return clone, nil
+}
+
+// Map establishes a mapping between a virtual page and a physical memory frame
+// in this address space. It behaves like the global Map function.
+func (as *AddressSpace) Map(page Page, frame pmm.Frame, flags PageTableEntryFlag) *kernel.Error {
+	return as.pdt.Map(page, frame, flags)
+}
+
+// Unmap removes a mapping previously installed by a call to Map from this
+// address space.
+func (as *AddressSpace) Unmap(page Page) *kernel.Error {
+	return as.pdt.Unmap(page)
+}
+
+// Activate switches the CPU to this address space.
+func (as *AddressSpace) Activate() {
+	as.pdt.Activate()
+	activeAddrSpace = as
+}
+
+// IsActive returns true if this is the address space currently used by the
+// CPU.
+func (as *AddressSpace) IsActive() bool {
+	return activePDTFn() == as.pdt.pdtFrame.Address()
+}
+
+// newAddressSpace allocates a new page directory table and copies the
+// top-level entries for the kernel half of the address space from the src
+// address space.
+func newAddressSpace(src *AddressSpace) (*AddressSpace, *kernel.Error) {
+	pdtFrame, err := frameAllocator()
+	if err != nil {
+		return nil, err
+	}
+
+	as := &AddressSpace{}
+	if err = as.pdt.Init(pdtFrame); err != nil {
+		if frameReleaseFn != nil {
+			_ = frameReleaseFn(pdtFrame)
+		}
+		return nil, err
+	}
+
+	var (
+		srcTable = tablePtrFn(src.pdt.pdtFrame)
+		dstTable = tablePtrFn(pdtFrame)
+	)
+
+	// The last entry is used for the recursive mapping and is set up by
+	// PageDirectoryTable.Init
+	for index := kernelSpaceFirstEntry; index < len(srcTable)-1; index++ {
+		dstTable[index] = srcTable[index]
+	}
+
+	return as, nil
+}
+
+// cloneTable allocates a copy of the page table referenced by srcEntry and
+// updates dstEntry to point to it. Page tables at lower levels are recursively
+// cloned while the pages referenced by the last page level are shared using
+// copy-on-write.
+func cloneTable(level uint8, srcEntry, dstEntry *pageTableEntry) *kernel.Error {
+	frame, err := frameAllocator()
+	if err != nil {
+		return err
+	}
+
+	*dstEntry = *srcEntry
+	dstEntry.SetFrame(frame)
+
+	var (
+		srcTable = tablePtrFn(srcEntry.Frame())
+		dstTable = tablePtrFn(frame)
+	)
+
+	// Clear the new table up front so that a partially cloned table only
+	// contains valid entries if cloning fails.
+	for index := 0; index < len(dstTable); index++ {
+		dstTable[index] = 0
+	}
+
+	for index := 0; index < len(srcTable); index++ {
+		switch {
+		case !srcTable[index].HasFlags(FlagPresent):
+			continue
+		case srcTable[index].HasFlags(FlagHugePage):
+			return errCloneHugePage
+		case level < pageLevels-1:
+			if err = cloneTable(level+1, &srcTable[index], &dstTable[index]); err != nil {
+				return err
+			}
+		default:
+			if frameShareFn != nil {
+				if err = frameShareFn(srcTable[index].Frame()); err != nil {
+					return err
+				}
+			}
+
+			if srcTable[index].HasFlags(FlagRW) {
+				srcTable[index].ClearFlags(FlagRW)
+				srcTable[index].SetFlags(FlagCopyOnWrite)
+			}
+			dstTable[index] = srcTable[index]
+		}
+	}
+
+	return nil
+}
+
+// releaseUserTables tears down a partially constructed clone. It drops the
+// references to the frames mapped by the user half of the address space and
+// releases its page tables together with the page directory table frame.
+func (as *AddressSpace) releaseUserTables() {
+	table := tablePtrFn(as.pdt.pdtFrame)
+	for index := 0; index < kernelSpaceFirstEntry; index++ {
+		if table[index].HasFlags(FlagPresent) {
+			releaseTable(1, table[index].Frame())
+		}
+	}
+
+	if frameReleaseFn != nil {
+		_ = frameReleaseFn(as.pdt.pdtFrame)
+	}
+}
+
+// releaseTable releases the page table stored in the supplied frame. Page
+// tables at lower levels are recursively released while the references to
+// the pages referenced by the last page level are dropped.
+func releaseTable(level uint8, frame pmm.Frame) {
+	table := tablePtrFn(frame)
+	for index := 0; index < len(table); index++ {
+		switch {
+		case !table[index].HasFlags(FlagPresent):
+			continue
+		case level < pageLevels-1:
+			releaseTable(level+1, table[index].Frame())
+		case frameReleaseFn != nil:
+			_ = frameReleaseFn(table[index].Frame())
+		}
+	}
+
+	if frameReleaseFn != nil {
+		_ = frameReleaseFn(frame)
+	}
+}
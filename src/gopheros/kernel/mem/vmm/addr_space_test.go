@@ -1,8 +1,13 @@
 package vmm
 
 import (
+	"gopheros/kernel"
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/mem"
+	"gopheros/kernel/mem/pmm"
 	"runtime"
 	"testing"
+	"unsafe"
 )
 
 func TestEarlyReserveAmd64(t *testing.T) {
@@ -27,3 +32,372 @@ func TestEarlyReserveAmd64(t *testing.T) {
 		t.Fatalf("expected to get errEarlyReserveNoSpace; got %v", err)
 	}
 }
+
+func TestAddressSpaceClone(t *testing.T) {
+	defer resetAddressSpaceMocks()
+
+	tables := mockPageTables(8)
+	tableFrame := func(index int) pmm.Frame {
+		return pmm.Frame(uintptr(unsafe.Pointer(tables[index])) >> mem.PageShift)
+	}
+
+	// Tables 0-3 contain the P4-P1 tables for the source address space
+	var src AddressSpace
+	src.pdt.pdtFrame = tableFrame(0)
+	for level := 0; level < pageLevels-1; level++ {
+		tables[level][0].SetFlags(FlagPresent | FlagRW | FlagUserAccessible)
+		tables[level][0].SetFrame(tableFrame(level + 1))
+	}
+	tables[0][kernelSpaceFirstEntry].SetFlags(FlagPresent | FlagRW)
+	tables[0][kernelSpaceFirstEntry].SetFrame(pmm.Frame(0xabc))
+	tables[3][0].SetFlags(FlagPresent | FlagRW | FlagUserAccessible)
+	tables[3][0].SetFrame(pmm.Frame(0x100))
+	tables[3][1].SetFlags(FlagPresent | FlagUserAccessible)
+	tables[3][1].SetFrame(pmm.Frame(0x101))
+
+	// Tables 4-7 are handed out by the frame allocator
+	nextTable := 4
+	SetFrameAllocator(func() (pmm.Frame, *kernel.Error) {
+		nextTable++
+		return tableFrame(nextTable - 1), nil
+	})
+
+	activePDTFn = func() uintptr { return src.pdt.pdtFrame.Address() }
+	switchCount := 0
+	switchPDTFn = func(_ uintptr) { switchCount++ }
+
+	var sharedFrames []pmm.Frame
+	SetFrameRefCounter(func(f pmm.Frame) *kernel.Error {
+		sharedFrames = append(sharedFrames, f)
+		return nil
+	}, nil, nil)
+
+	clone, err := src.Clone()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if exp := tableFrame(4); clone.pdt.pdtFrame != exp {
+		t.Fatalf("expected clone PDT frame to be %d; got %d", exp, clone.pdt.pdtFrame)
+	}
+
+	if clone.IsActive() {
+		t.Fatal("expected the clone not to be the active address space")
+	}
+
+	if exp := 1; switchCount != exp {
+		t.Fatalf("expected the active address space to be reloaded %d time(s); got %d", exp, switchCount)
+	}
+
+	if got, exp := tables[4][kernelSpaceFirstEntry], tables[0][kernelSpaceFirstEntry]; got != exp {
+		t.Fatalf("expected kernel P4 entry to be shared; got %x, exp %x", got, exp)
+	}
+
+	if got := tables[4][len(tables[4])-1].Frame(); got != tableFrame(4) {
+		t.Fatalf("expected the last clone PDT entry to be recursively mapped; got frame %d", got)
+	}
+
+	for level := 0; level < pageLevels-1; level++ {
+		entry := tables[4+level][0]
+		if exp := tableFrame(5 + level); entry.Frame() != exp {
+			t.Errorf("[level %d] expected entry to point to frame %d; got %d", level, exp, entry.Frame())
+		}
+
+		if !entry.HasFlags(FlagPresent | FlagRW | FlagUserAccessible) {
+			t.Errorf("[level %d] expected entry flags to be copied", level)
+		}
+	}
+
+	for index, expFrame := range []pmm.Frame{0x100, 0x101} {
+		srcPte, dstPte := tables[3][index], tables[7][index]
+		if srcPte != dstPte {
+			t.Errorf("[page %d] expected page to be shared; got src entry %x, clone entry %x", index, srcPte, dstPte)
+		}
+
+		if srcPte.Frame() != expFrame || srcPte.HasFlags(FlagRW) {
+			t.Errorf("[page %d] expected a read-only mapping to frame %d; got %x", index, expFrame, srcPte)
+		}
+	}
+
+	if !tables[3][0].HasFlags(FlagCopyOnWrite) {
+		t.Error("expected writable page to be marked as copy-on-write")
+	}
+
+	if tables[3][1].HasFlags(FlagCopyOnWrite) {
+		t.Error("expected read-only page not to be marked as copy-on-write")
+	}
+
+	if exp := []pmm.Frame{0x100, 0x101}; len(sharedFrames) != len(exp) || sharedFrames[0] != exp[0] || sharedFrames[1] != exp[1] {
+		t.Errorf("expected frames %v to be shared; got %v", exp, sharedFrames)
+	}
+}
+
+func TestAddressSpaceCloneErrors(t *testing.T) {
+	defer resetAddressSpaceMocks()
+
+	expErr := &kernel.Error{Module: "test", Message: "out of memory"}
+	tables := mockPageTables(4)
+	tableFrame := func(index int) pmm.Frame {
+		return pmm.Frame(uintptr(unsafe.Pointer(tables[index])) >> mem.PageShift)
+	}
+
+	var src AddressSpace
+	src.pdt.pdtFrame = tableFrame(0)
+	tables[0][0].SetFlags(FlagPresent | FlagRW)
+	tables[0][0].SetFrame(tableFrame(1))
+
+	activePDTFn = func() uintptr { return 0 }
+
+	// Failed clones must release all frames that they have allocated
+	var released []pmm.Frame
+	SetFrameRefCounter(nil, func(f pmm.Frame) *kernel.Error {
+		released = append(released, f)
+		return nil
+	}, nil)
+	expReleased := func(t *testing.T, exp ...pmm.Frame) {
+		if len(released) != len(exp) {
+			t.Fatalf("expected frames %v to be released; got %v", exp, released)
+		}
+
+		for index := range exp {
+			if released[index] != exp[index] {
+				t.Fatalf("expected frames %v to be released; got %v", exp, released)
+			}
+		}
+		released = nil
+	}
+
+	t.Run("PDT allocation fails", func(t *testing.T) {
+		SetFrameAllocator(func() (pmm.Frame, *kernel.Error) {
+			return pmm.InvalidFrame, expErr
+		})
+
+		if _, err := src.Clone(); err != expErr {
+			t.Fatalf("expected error %v; got %v", expErr, err)
+		}
+		expReleased(t)
+	})
+
+	t.Run("PDT init fails", func(t *testing.T) {
+		SetFrameAllocator(func() (pmm.Frame, *kernel.Error) {
+			return tableFrame(2), nil
+		})
+		mapTemporaryFn = func(_ pmm.Frame) (Page, *kernel.Error) {
+			return 0, expErr
+		}
+
+		if _, err := src.Clone(); err != expErr {
+			t.Fatalf("expected error %v; got %v", expErr, err)
+		}
+		expReleased(t, tableFrame(2))
+	})
+
+	t.Run("page table allocation fails", func(t *testing.T) {
+		allocCount := 0
+		SetFrameAllocator(func() (pmm.Frame, *kernel.Error) {
+			allocCount++
+			if allocCount == 1 {
+				return tableFrame(2), nil
+			}
+			return pmm.InvalidFrame, expErr
+		})
+		mapTemporaryFn = func(f pmm.Frame) (Page, *kernel.Error) { return Page(f), nil }
+
+		if _, err := src.Clone(); err != expErr {
+			t.Fatalf("expected error %v; got %v", expErr, err)
+		}
+		expReleased(t, tableFrame(2))
+	})
+
+	t.Run("nested page table allocation fails", func(t *testing.T) {
+		tables[1][0].SetFlags(FlagPresent | FlagRW)
+		tables[1][0].SetFrame(pmm.Frame(0xbad))
+
+		allocCount := 0
+		SetFrameAllocator(func() (pmm.Frame, *kernel.Error) {
+			allocCount++
+			if allocCount <= 2 {
+				return tableFrame(allocCount + 1), nil
+			}
+			return pmm.InvalidFrame, expErr
+		})
+
+		if _, err := src.Clone(); err != expErr {
+			t.Fatalf("expected error %v; got %v", expErr, err)
+		}
+		expReleased(t, tableFrame(3), tableFrame(2))
+	})
+
+	t.Run("huge page user mapping", func(t *testing.T) {
+		tables[1][0] = 0
+		tables[1][0].SetFlags(FlagPresent | FlagRW | FlagHugePage)
+
+		allocCount := 0
+		SetFrameAllocator(func() (pmm.Frame, *kernel.Error) {
+			allocCount++
+			return tableFrame(allocCount + 1), nil
+		})
+
+		if _, err := src.Clone(); err != errCloneHugePage {
+			t.Fatalf("expected error %v; got %v", errCloneHugePage, err)
+		}
+		expReleased(t, tableFrame(3), tableFrame(2))
+	})
+
+	t.Run("sharing user page fails", func(t *testing.T) {
+		tables := mockPageTables(8)
+		tableFrame := func(index int) pmm.Frame {
+			return pmm.Frame(uintptr(unsafe.Pointer(tables[index])) >> mem.PageShift)
+		}
+
+		var src AddressSpace
+		src.pdt.pdtFrame = tableFrame(0)
+		for level := 0; level < pageLevels-1; level++ {
+			tables[level][0].SetFlags(FlagPresent | FlagRW)
+			tables[level][0].SetFrame(tableFrame(level + 1))
+		}
+		tables[3][0].SetFlags(FlagPresent | FlagRW)
+		tables[3][0].SetFrame(pmm.Frame(0x100))
+		tables[3][1].SetFlags(FlagPresent | FlagRW)
+		tables[3][1].SetFrame(pmm.Frame(0x101))
+
+		nextTable := 4
+		SetFrameAllocator(func() (pmm.Frame, *kernel.Error) {
+			nextTable++
+			return tableFrame(nextTable - 1), nil
+		})
+		SetFrameRefCounter(func(f pmm.Frame) *kernel.Error {
+			if f == pmm.Frame(0x101) {
+				return expErr
+			}
+			return nil
+		}, func(f pmm.Frame) *kernel.Error {
+			released = append(released, f)
+			return nil
+		}, nil)
+
+		if _, err := src.Clone(); err != expErr {
+			t.Fatalf("expected error %v; got %v", expErr, err)
+		}
+
+		// The reference to the page that was already shared must be
+		// dropped before releasing the page tables
+		expReleased(t, pmm.Frame(0x100), tableFrame(7), tableFrame(6), tableFrame(5), tableFrame(4))
+	})
+}
+
+func TestNewAddressSpace(t *testing.T) {
+	defer resetAddressSpaceMocks()
+
+	tables := mockPageTables(2)
+	tableFrame := func(index int) pmm.Frame {
+		return pmm.Frame(uintptr(unsafe.Pointer(tables[index])) >> mem.PageShift)
+	}
+
+	kernelAddrSpace.pdt.pdtFrame = tableFrame(0)
+	tables[0][0].SetFlags(FlagPresent | FlagUserAccessible)
+	tables[0][kernelSpaceFirstEntry].SetFlags(FlagPresent | FlagRW)
+
+	SetFrameAllocator(func() (pmm.Frame, *kernel.Error) {
+		return tableFrame(1), nil
+	})
+	activePDTFn = func() uintptr { return tableFrame(0).Address() }
+
+	as, err := NewAddressSpace()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tables[1][0] != 0 {
+		t.Error("expected the new address space not to contain any user mappings")
+	}
+
+	if tables[1][kernelSpaceFirstEntry] != tables[0][kernelSpaceFirstEntry] {
+		t.Error("expected the new address space to share the kernel mappings")
+	}
+
+	if KernelAddressSpace() != &kernelAddrSpace || !KernelAddressSpace().IsActive() || as.IsActive() {
+		t.Error("expected the kernel address space to be the active one")
+	}
+}
+
+func TestAddressSpaceMapUnmap(t *testing.T) {
+	defer resetAddressSpaceMocks()
+
+	as := AddressSpace{pdt: PageDirectoryTable{pdtFrame: pmm.Frame(123)}}
+	activePDTFn = func() uintptr { return as.pdt.pdtFrame.Address() }
+
+	var mapCalled, unmapCalled bool
+	mapFn = func(_ Page, _ pmm.Frame, _ PageTableEntryFlag) *kernel.Error {
+		mapCalled = true
+		return nil
+	}
+	unmapFn = func(_ Page) *kernel.Error {
+		unmapCalled = true
+		return nil
+	}
+
+	if err := as.Map(Page(1), pmm.Frame(2), FlagPresent); err != nil || !mapCalled {
+		t.Fatalf("expected Map to be called; got err: %v", err)
+	}
+
+	if err := as.Unmap(Page(1)); err != nil || !unmapCalled {
+		t.Fatalf("expected Unmap to be called; got err: %v", err)
+	}
+
+	var switchAddr uintptr
+	switchPDTFn = func(addr uintptr) { switchAddr = addr }
+	as.Activate()
+
+	if exp := as.pdt.pdtFrame.Address(); switchAddr != exp {
+		t.Fatalf("expected PDT at 0x%x to be activated; got 0x%x", exp, switchAddr)
+	}
+}
+
+func TestTablePtrFn(t *testing.T) {
+	if exp, got := PhysToVirt(0x1000), uintptr(unsafe.Pointer(tablePtrFn(pmm.Frame(1)))); got != exp {
+		t.Fatalf("expected page table pointer to be 0x%x; got 0x%x", exp, got)
+	}
+}
+
+var (
+	// mockPageTableBuf keeps the memory returned by mockPageTables alive.
+	mockPageTableBuf []byte
+
+	origTablePtrFn = tablePtrFn
+)
+
+// mockPageTables returns count page-aligned page tables backed by heap memory
+// and mocks the functions used to access page tables so that each frame
+// number corresponds to the address of a mocked table.
+func mockPageTables(count int) []*pageTable {
+	mockPageTableBuf = make([]byte, (count+1)*int(mem.PageSize))
+
+	tables := make([]*pageTable, count)
+	firstPage := (uintptr(unsafe.Pointer(&mockPageTableBuf[0])) + uintptr(mem.PageSize-1)) &^ uintptr(mem.PageSize-1)
+	for i := 0; i < count; i++ {
+		tables[i] = (*pageTable)(unsafe.Pointer(firstPage + uintptr(i)*uintptr(mem.PageSize)))
+	}
+
+	tablePtrFn = func(frame pmm.Frame) *pageTable {
+		return (*pageTable)(unsafe.Pointer(frame.Address()))
+	}
+	mapTemporaryFn = func(f pmm.Frame) (Page, *kernel.Error) { return Page(f), nil }
+	unmapFn = func(_ Page) *kernel.Error { return nil }
+
+	return tables
+}
+
+func resetAddressSpaceMocks() {
+	tablePtrFn = origTablePtrFn
+	frameAllocator = nil
+	SetFrameRefCounter(nil, nil, nil)
+	activePDTFn = cpu.ActivePDT
+	switchPDTFn = cpu.SwitchPDT
+	mapFn = Map
+	mapTemporaryFn = MapTemporary
+	unmapFn = Unmap
+	kernelAddrSpace = AddressSpace{}
+	activeAddrSpace = nil
+	mockPageTableBuf = nil
+}
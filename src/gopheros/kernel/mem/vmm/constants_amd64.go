@@ -2,7 +2,10 @@
 
 package vmm
 
-import "math"
+import (
+	"gopheros/kernel/mem"
+	"math"
+)
 
 const (
 	// pageLevels indicates the number of page levels supported by the amd64 architecture.
@@ -13,6 +16,71 @@ const (
 	// bits 12-51 contain the physical memory address.
 	ptePhysPageMask = uintptr(0x000ffffffffff000)
 
+	// HugePageSize2M defines the size of the huge pages that can be mapped
+	// by a page directory (P2) entry.
+	HugePageSize2M = 2 * mem.Mb
+
+	// HugePageSize1G defines the size of the huge pages that can be mapped
+	// by a page directory pointer table (P3) entry. Support for this page
+	// size depends on the CPU.
+	HugePageSize1G = mem.Gb
+
+	// minHugePageLevel is the first page level whose entries can be used
+	// to map huge pages. Huge pages can be mapped at any level between
+	// minHugePageLevel and pageLevels - 2.
+	minHugePageLevel = 1
+
+	// kernelSpaceFirstEntry is the index of the first top-level (P4) page
+	// table entry that belongs to the kernel half of the address space.
+	// All address spaces share the kernel page tables that are referenced
+	// by the entries in the [kernelSpaceFirstEntry, 511) range.
+	kernelSpaceFirstEntry = 256
+
+	// userSpaceEnd is the first address above the user half of the address
+	// space. Addresses in the [userSpaceEnd, kernel half) range are not
+	// canonical and cannot be mapped.
+	userSpaceEnd = uintptr(0x0000800000000000)
+
+	// anonMinAddr is the lowest address that can be selected by
+	// MapAnonymous when the caller does not request a specific address.
+	// The pages below it are never mapped so that nil pointer dereferences
+	// always trigger a page fault.
+	anonMinAddr = uintptr(0x10000)
+
+	// PhysMapBase is the default virtual address where the direct map of
+	// the system's physical memory (physmap) begins. For amd64 this address
+	// uses P4 table index 273. Init randomizes the physmap base so that it
+	// falls within the [physMapMinBase, PhysMapBase] range.
+	PhysMapBase = uintptr(0xffff888000000000)
+
+	// kernelImageBase and kernelImageEnd define the 1G-aligned virtual
+	// address range that contains the kernel image. The kernel is linked at
+	// PAGE_OFFSET + LOAD_ADDRESS (see arch/x86_64/asm/constants.inc).
+	kernelImageBase = uintptr(0xffff800000000000)
+	kernelImageEnd  = kernelImageBase + uintptr(HugePageSize1G)
+
+	// physMapMinBase is the lowest address that can be selected as the
+	// physmap base when randomizing the kernel address space layout. It
+	// is placed right after the kernel image so that the physmap never
+	// overlaps it.
+	physMapMinBase = kernelImageEnd
+
+	// physMapAlign defines the alignment of the randomized physmap base.
+	// It allows the physmap to be established using huge pages.
+	physMapAlign = HugePageSize1G
+
+	// PhysMapSize defines the max amount of physical memory that can be
+	// accessed via the physmap.
+	PhysMapSize = 64 * 1024 * mem.Gb
+
+	// VmallocBase is the virtual address where the region used by
+	// AllocPages begins. For amd64 this address uses P4 table index 402.
+	VmallocBase = uintptr(0xffffc90000000000)
+
+	// VmallocSize defines the size of the region used by AllocPages. The
+	// region is covered by a single P4 entry.
+	VmallocSize = 512 * mem.Gb
+
 	// tempMappingAddr is a reserved virtual page address used for
 	// temporary physical page mappings (e.g. when mapping inactive PDT
 	// pages). For amd64 this address uses the following table indices:
@@ -61,7 +129,8 @@ const (
 	FlagUserAccessible
 
 	// FlagWriteThroughCaching implies write-through caching when set and write-back
-	// caching if cleared.
+	// caching if cleared. Once the PAT has been programmed by Init, setting
+	// this flag without FlagDoNotCache selects write-combining instead.
 	FlagWriteThroughCaching
 
 	// FlagDoNotCache prevents this page from being cached if set.
@@ -0,0 +1,178 @@
+package vmm
+
+import (
+	"gopheros/kernel/kfmt"
+	"gopheros/kernel/mem"
+	"gopheros/kernel/mem/pmm"
+	"io"
+)
+
+// ignoredDumpFlags contains the flags that are managed by the CPU and are
+// therefore ignored when deciding whether two mappings can be coalesced.
+const ignoredDumpFlags = FlagAccessed | FlagDirty
+
+// flagNames contains the flag/name tuples used when printing page table
+// entries.
+var flagNames = [...]struct {
+	flag PageTableEntryFlag
+	name string
+}{
+	{FlagPresent, "P"},
+	{FlagRW, "RW"},
+	{FlagUserAccessible, "U"},
+	{FlagWriteThroughCaching, "WT"},
+	{FlagDoNotCache, "NC"},
+	{FlagAccessed, "A"},
+	{FlagDirty, "D"},
+	{FlagHugePage, "H"},
+	{FlagGlobal, "G"},
+	{FlagCopyOnWrite, "COW"},
+	{FlagNoExecute, "NX"},
+}
+
+// DumpTranslation walks the page tables for the supplied virtual address and
+// prints the page table entry encountered at each page level. The walk stops
+// at the first non-present or huge page entry. If the address is mapped, the
+// physical address it translates to is also printed.
+func DumpTranslation(w io.Writer, virtAddr uintptr) {
+	var (
+		physAddr uintptr
+		mapped   bool
+	)
+
+	kfmt.Fprintf(w, "[vmm] translation for 0x%16x:\n", virtAddr)
+	walk(virtAddr, func(pteLevel uint8, pte *pageTableEntry) bool {
+		entryIndex := (virtAddr >> pageLevelShifts[pteLevel]) & ((1 << pageLevelBits[pteLevel]) - 1)
+		kfmt.Fprintf(w, "[vmm]  P%d[%3d] = 0x%16x frame: 0x%16x flags: ", pageLevels-pteLevel, entryIndex, uintptr(*pte), pte.Frame().Address())
+		printFlags(w, *pte)
+		w.Write([]byte{'\n'})
+
+		if !pte.HasFlags(FlagPresent) {
+			return false
+		}
+
+		if pteLevel == pageLevels-1 || (pteLevel >= minHugePageLevel && pte.HasFlags(FlagHugePage)) {
+			physAddr = pte.Frame().Address() + (virtAddr & ((1 << pageLevelShifts[pteLevel]) - 1))
+			mapped = true
+			return false
+		}
+
+		return true
+	})
+
+	if !mapped {
+		kfmt.Fprintf(w, "[vmm]  address is not mapped\n")
+		return
+	}
+
+	kfmt.Fprintf(w, "[vmm]  physical address: 0x%16x\n", physAddr)
+}
+
+// mappingRange describes a contiguous range of virtual addresses that are
+// mapped to a contiguous range of physical addresses using the same flags.
+type mappingRange struct {
+	virtStart, virtEnd uintptr
+	physStart          uintptr
+	flags              PageTableEntryFlag
+}
+
+// DumpMappings prints a summary of all mappings in the currently active
+// address space. Contiguous virtual address ranges that are mapped to
+// contiguous physical address ranges with the same set of flags are
+// coalesced into a single line.
+func DumpMappings(w io.Writer) {
+	var cur mappingRange
+
+	kfmt.Fprintf(w, "[vmm] mappings for PDT at 0x%16x:\n", activePDTFn())
+	dumpTable(w, 0, pmm.Frame(activePDTFn()>>mem.PageShift), 0, &cur)
+	printMappingRange(w, &cur)
+}
+
+// dumpTable visits the present entries of the page table stored in the
+// supplied frame. The entries that map pages are merged with the range in cur
+// or, if that is not possible, cur is printed and replaced by a new range.
+func dumpTable(w io.Writer, level uint8, tableFrame pmm.Frame, baseAddr uintptr, cur *mappingRange) {
+	var (
+		table      = tablePtrFn(tableFrame)
+		entryCount = len(table)
+	)
+
+	// The last top-level entry is used for the recursive mapping
+	if level == 0 {
+		entryCount--
+	}
+
+	for index := 0; index < entryCount; index++ {
+		pte := table[index]
+		if !pte.HasFlags(FlagPresent) {
+			continue
+		}
+
+		virtAddr := canonicalAddr(baseAddr | uintptr(index)<<pageLevelShifts[level])
+		if level < pageLevels-1 && (level < minHugePageLevel || !pte.HasFlags(FlagHugePage)) {
+			dumpTable(w, level+1, pte.Frame(), virtAddr, cur)
+			continue
+		}
+
+		var (
+			size     = uintptr(1) << pageLevelShifts[level]
+			physAddr = pte.Frame().Address()
+			flags    = PageTableEntryFlag(uintptr(pte)&^ptePhysPageMask) &^ ignoredDumpFlags
+		)
+
+		if cur.virtEnd != 0 && cur.virtEnd == virtAddr &&
+			cur.physStart+(cur.virtEnd-cur.virtStart) == physAddr && cur.flags == flags {
+			cur.virtEnd += size
+			continue
+		}
+
+		printMappingRange(w, cur)
+		*cur = mappingRange{virtStart: virtAddr, virtEnd: virtAddr + size, physStart: physAddr, flags: flags}
+	}
+}
+
+// printMappingRange prints the supplied mapping range if it is not empty.
+func printMappingRange(w io.Writer, r *mappingRange) {
+	if r.virtEnd == 0 {
+		return
+	}
+
+	kfmt.Fprintf(w, "[vmm]  0x%16x - 0x%16x -> 0x%16x (%d KB) flags: ",
+		r.virtStart, r.virtEnd-1, r.physStart, uint64((r.virtEnd-r.virtStart)/uintptr(mem.Kb)),
+	)
+	printFlags(w, pageTableEntry(r.flags))
+	w.Write([]byte{'\n'})
+}
+
+// printFlags prints the names of the flags that are set in the supplied page
+// table entry.
+func printFlags(w io.Writer, pte pageTableEntry) {
+	var printed bool
+	for _, f := range flagNames {
+		if !pte.HasFlags(f.flag) {
+			continue
+		}
+
+		if printed {
+			w.Write([]byte{' '})
+		}
+		kfmt.Fprintf(w, "%s", f.name)
+		printed = true
+	}
+
+	if !printed {
+		kfmt.Fprintf(w, "-")
+	}
+}
+
+// canonicalAddr sign-extends the most significant implemented bit of a
+// virtual address to the unimplemented upper address bits.
+func canonicalAddr(addr uintptr) uintptr {
+	signBit := uintptr(1) << (pageLevelShifts[0] + pageLevelBits[0] - 1)
+
+	if addr&signBit != 0 {
+		return addr | ^(signBit<<1 - 1)
+	}
+
+	return addr
+}
@@ -0,0 +1,162 @@
+package vmm
+
+import (
+	"bytes"
+	"gopheros/kernel/mem"
+	"gopheros/kernel/mem/pmm"
+	"runtime"
+	"testing"
+	"unsafe"
+)
+
+func TestDumpTranslationAmd64(t *testing.T) {
+	if runtime.GOARCH != "amd64" {
+		t.Skip("test requires amd64 runtime; skipping")
+	}
+
+	defer func(origPtePtr func(uintptr) unsafe.Pointer) {
+		ptePtrFn = origPtePtr
+	}(ptePtrFn)
+
+	virtAddr := uintptr(0xffff800000201234)
+	specs := []struct {
+		entries [pageLevels]pageTableEntry
+		exp     string
+	}{
+		{
+			[pageLevels]pageTableEntry{
+				pageTableEntry(0x1000 | FlagPresent | FlagRW),
+				pageTableEntry(0x2000 | FlagPresent | FlagRW),
+				pageTableEntry(0x3000 | FlagPresent | FlagRW | FlagUserAccessible),
+				pageTableEntry(0x4000 | FlagPresent | FlagAccessed | FlagDirty | FlagNoExecute),
+			},
+			"[vmm] translation for 0xffff800000201234:\n" +
+				"[vmm]  P4[256] = 0x0000000000001003 frame: 0x0000000000001000 flags: P RW\n" +
+				"[vmm]  P3[  0] = 0x0000000000002003 frame: 0x0000000000002000 flags: P RW\n" +
+				"[vmm]  P2[  1] = 0x0000000000003007 frame: 0x0000000000003000 flags: P RW U\n" +
+				"[vmm]  P1[  1] = 0x8000000000004061 frame: 0x0000000000004000 flags: P A D NX\n" +
+				"[vmm]  physical address: 0x0000000000004234\n",
+		},
+		{
+			[pageLevels]pageTableEntry{
+				pageTableEntry(0x1000 | FlagPresent | FlagRW),
+				pageTableEntry(0x2000 | FlagPresent | FlagRW),
+				pageTableEntry(0x200000 | FlagPresent | FlagHugePage | FlagGlobal),
+			},
+			"[vmm] translation for 0xffff800000201234:\n" +
+				"[vmm]  P4[256] = 0x0000000000001003 frame: 0x0000000000001000 flags: P RW\n" +
+				"[vmm]  P3[  0] = 0x0000000000002003 frame: 0x0000000000002000 flags: P RW\n" +
+				"[vmm]  P2[  1] = 0x0000000000200181 frame: 0x0000000000200000 flags: P H G\n" +
+				"[vmm]  physical address: 0x0000000000201234\n",
+		},
+		{
+			[pageLevels]pageTableEntry{
+				pageTableEntry(0x1000 | FlagPresent | FlagRW),
+				pageTableEntry(0x2000),
+			},
+			"[vmm] translation for 0xffff800000201234:\n" +
+				"[vmm]  P4[256] = 0x0000000000001003 frame: 0x0000000000001000 flags: P RW\n" +
+				"[vmm]  P3[  0] = 0x0000000000002000 frame: 0x0000000000002000 flags: -\n" +
+				"[vmm]  address is not mapped\n",
+		},
+	}
+
+	for specIndex, spec := range specs {
+		pteCallCount := 0
+		ptePtrFn = func(_ uintptr) unsafe.Pointer {
+			pte := &specs[specIndex].entries[pteCallCount]
+			pteCallCount++
+			return unsafe.Pointer(pte)
+		}
+
+		var buf bytes.Buffer
+		DumpTranslation(&buf, virtAddr)
+
+		if got := buf.String(); got != spec.exp {
+			t.Errorf("[spec %d] expected output to be:\n%s\ngot:\n%s", specIndex, spec.exp, got)
+		}
+	}
+}
+
+func TestDumpMappingsAmd64(t *testing.T) {
+	if runtime.GOARCH != "amd64" {
+		t.Skip("test requires amd64 runtime; skipping")
+	}
+
+	defer resetAddressSpaceMocks()
+
+	tables := mockPageTables(5)
+	tableFrame := func(index int) pmm.Frame {
+		return pmm.Frame(uintptr(unsafe.Pointer(tables[index])) >> mem.PageShift)
+	}
+	activePDTFn = func() uintptr { return tableFrame(0).Address() }
+
+	// Tables 0-3 contain the P4-P1 tables for the user half of the address
+	// space. The last P4 entry holds the recursive mapping.
+	for level := 0; level < pageLevels-1; level++ {
+		tables[level][0].SetFlags(FlagPresent | FlagRW)
+		tables[level][0].SetFrame(tableFrame(level + 1))
+	}
+	tables[0][len(tables[0])-1].SetFlags(FlagPresent | FlagRW)
+	tables[0][len(tables[0])-1].SetFrame(tableFrame(0))
+
+	// Contiguous pages with the same flags are coalesced even if the CPU
+	// has set the accessed or dirty flags.
+	tables[3][0] = pageTableEntry(0x100000 | FlagPresent | FlagRW)
+	tables[3][1] = pageTableEntry(0x101000 | FlagPresent | FlagRW | FlagAccessed | FlagDirty)
+	tables[3][2] = pageTableEntry(0x102000 | FlagPresent | FlagRW)
+	// Flag mismatch
+	tables[3][3] = pageTableEntry(0x103000 | FlagPresent)
+	// Physical address gap
+	tables[3][4] = pageTableEntry(0x200000 | FlagPresent)
+	// Virtual address gap
+	tables[3][6] = pageTableEntry(0x201000 | FlagPresent)
+	// 2M huge page
+	tables[2][1] = pageTableEntry(0x400000 | FlagPresent | FlagRW | FlagHugePage)
+
+	// Table 4 is the P3 table for the kernel half of the address space and
+	// contains a 1G huge page
+	tables[0][kernelSpaceFirstEntry].SetFlags(FlagPresent | FlagRW)
+	tables[0][kernelSpaceFirstEntry].SetFrame(tableFrame(4))
+	tables[4][1] = pageTableEntry(0x40000000 | FlagPresent | FlagRW | FlagHugePage | FlagGlobal | FlagNoExecute)
+
+	var buf bytes.Buffer
+	DumpMappings(&buf)
+
+	exp := "[vmm] mappings for PDT at " + fmtAddr(tableFrame(0).Address()) + ":\n" +
+		"[vmm]  0x0000000000000000 - 0x0000000000002fff -> 0x0000000000100000 (12 KB) flags: P RW\n" +
+		"[vmm]  0x0000000000003000 - 0x0000000000003fff -> 0x0000000000103000 (4 KB) flags: P\n" +
+		"[vmm]  0x0000000000004000 - 0x0000000000004fff -> 0x0000000000200000 (4 KB) flags: P\n" +
+		"[vmm]  0x0000000000006000 - 0x0000000000006fff -> 0x0000000000201000 (4 KB) flags: P\n" +
+		"[vmm]  0x0000000000200000 - 0x00000000003fffff -> 0x0000000000400000 (2048 KB) flags: P RW H\n" +
+		"[vmm]  0xffff800040000000 - 0xffff80007fffffff -> 0x0000000040000000 (1048576 KB) flags: P RW H G NX\n"
+
+	if got := buf.String(); got != exp {
+		t.Fatalf("expected output to be:\n%s\ngot:\n%s", exp, got)
+	}
+
+	// An address space without any mappings
+	for index := range tables[0] {
+		tables[0][index] = 0
+	}
+
+	buf.Reset()
+	DumpMappings(&buf)
+
+	exp = "[vmm] mappings for PDT at " + fmtAddr(tableFrame(0).Address()) + ":\n"
+	if got := buf.String(); got != exp {
+		t.Fatalf("expected output to be:\n%s\ngot:\n%s", exp, got)
+	}
+}
+
+func fmtAddr(addr uintptr) string {
+	const hexDigits = "0123456789abcdef"
+
+	var out [18]byte
+	out[0], out[1] = '0', 'x'
+	for index := len(out) - 1; index > 1; index, addr = index-1, addr>>4 {
+		out[index] = hexDigits[addr&0xf]
+	}
+
+	return string(out[:])
+}
@@ -0,0 +1,101 @@
+package vmm
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/mem"
+	"gopheros/kernel/mem/pmm"
+)
+
+var (
+	// cpuIDFn is used by tests to override calls to cpu.ID.
+	cpuIDFn = cpu.ID
+
+	errUnsupportedHugePageSize = &kernel.Error{Module: "vmm", Message: "unsupported huge page size"}
+	errMisalignedHugePage      = &kernel.Error{Module: "vmm", Message: "huge page and frame addresses must be aligned to the page size"}
+	errHugePageOverlapsTable   = &kernel.Error{Module: "vmm", Message: "huge page overlaps an existing page table"}
+)
+
+// MapHuge establishes a mapping between a virtual address range and a
+// contiguous physical memory region using a single page table entry. The
+// pageSize argument selects the paging level where the entry is installed
+// (e.g. HugePageSize2M or HugePageSize1G for amd64). Both page and frame must
+// be aligned to pageSize.
+//
+// Like Map, calls to MapHuge will use the supplied physical frame allocator to
+// initialize any missing page tables above the level that holds the mapping.
+// An existing huge page mapping for the same address range is overwritten.
+// However, an error is returned if the address range is already mapped using
+// a lower-level page table.
+//
+// Like Map, huge pages are always flagged as non-executable.
+func MapHuge(page Page, frame pmm.Frame, pageSize mem.Size, flags PageTableEntryFlag) *kernel.Error {
+	hugeLevel, err := hugePageLevel(pageSize)
+	if err != nil {
+		return err
+	}
+
+	alignMask := uintptr(pageSize - 1)
+	if page.Address()&alignMask != 0 || frame.Address()&alignMask != 0 {
+		return errMisalignedHugePage
+	}
+
+	walk(page.Address(), func(pteLevel uint8, pte *pageTableEntry) bool {
+		if pteLevel == hugeLevel {
+			if pte.HasFlags(FlagPresent) && !pte.HasFlags(FlagHugePage) {
+				err = errHugePageOverlapsTable
+				return false
+			}
+
+			wasPresent := pte.HasFlags(FlagPresent)
+			*pte = 0
+			pte.SetFrame(frame)
+			pte.SetFlags(flags | FlagHugePage | FlagNoExecute)
+			if wasPresent {
+				shootdownPage(page.Address())
+			} else {
+				flushTLBEntryFn(page.Address())
+			}
+			return false
+		}
+
+		if pte.HasFlags(FlagPresent | FlagHugePage) {
+			err = errHugePageMapped
+			return false
+		}
+
+		if !pte.HasFlags(FlagPresent) {
+			err = allocPageTable(pteLevel, pte)
+		}
+
+		return err == nil
+	})
+
+	return err
+}
+
+// hugePageLevel returns the page level whose entries map pages with the
+// requested size. An error is returned if the size does not match any of the
+// huge page sizes supported by the CPU.
+func hugePageLevel(pageSize mem.Size) (uint8, *kernel.Error) {
+	for level := uint8(minHugePageLevel); level < pageLevels-1; level++ {
+		if mem.Size(1)<<pageLevelShifts[level] != pageSize {
+			continue
+		}
+
+		if pageSize == HugePageSize1G && !supports1GPages() {
+			break
+		}
+
+		return level, nil
+	}
+
+	return 0, errUnsupportedHugePageSize
+}
+
+// supports1GPages returns true if the CPU supports 1GiB pages.
+func supports1GPages() bool {
+	// CPUID leaf 0x80000001 reports support for 1G pages via EDX bit 26
+	_, _, _, edx := cpuIDFn(0x80000001)
+	return edx&(1<<26) != 0
+}
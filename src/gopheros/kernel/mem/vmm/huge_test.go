@@ -0,0 +1,324 @@
+package vmm
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/mem"
+	"gopheros/kernel/mem/pmm"
+	"runtime"
+	"testing"
+	"unsafe"
+)
+
+func TestMapHugeAmd64(t *testing.T) {
+	if runtime.GOARCH != "amd64" {
+		t.Skip("test requires amd64 runtime; skipping")
+	}
+
+	defer func(origPtePtr func(uintptr) unsafe.Pointer, origNextAddrFn func(uintptr) uintptr, origFlushTLBEntryFn func(uintptr), origCPUIDFn func(uint32) (uint32, uint32, uint32, uint32)) {
+		ptePtrFn = origPtePtr
+		nextAddrFn = origNextAddrFn
+		flushTLBEntryFn = origFlushTLBEntryFn
+		cpuIDFn = origCPUIDFn
+		frameAllocator = nil
+	}(ptePtrFn, nextAddrFn, flushTLBEntryFn, cpuIDFn)
+
+	cpuIDFn = func(_ uint32) (uint32, uint32, uint32, uint32) {
+		return 0, 0, 0, 1 << 26
+	}
+
+	specs := []struct {
+		virtAddr     uintptr
+		pageSize     mem.Size
+		levelIndices []uint
+	}{
+		// p4 index: 1, p3 index: 2, p2 index: 3
+		{uintptr(1<<39 | 2<<30 | 3<<21), HugePageSize2M, []uint{1, 2, 3}},
+		// p4 index: 4, p3 index: 5
+		{uintptr(4<<39 | 5<<30), HugePageSize1G, []uint{4, 5}},
+	}
+
+	for specIndex, spec := range specs {
+		var physPages [pageLevels][mem.PageSize >> mem.PointerShift]pageTableEntry
+		nextPhysPage := 0
+
+		// allocFn returns pages from index 1; we keep index 0 for the P4 entry
+		SetFrameAllocator(func() (pmm.Frame, *kernel.Error) {
+			nextPhysPage++
+			pageAddr := unsafe.Pointer(&physPages[nextPhysPage][0])
+			return pmm.Frame(uintptr(pageAddr) >> mem.PageShift), nil
+		})
+
+		pteCallCount := 0
+		ptePtrFn = func(entry uintptr) unsafe.Pointer {
+			pteCallCount++
+			pteIndex := (entry & uintptr(mem.PageSize-1)) >> mem.PointerShift
+			return unsafe.Pointer(&physPages[pteCallCount-1][pteIndex])
+		}
+
+		nextAddrFn = func(entry uintptr) uintptr {
+			return uintptr(unsafe.Pointer(&physPages[nextPhysPage][0]))
+		}
+
+		flushTLBEntryCallCount := 0
+		flushTLBEntryFn = func(uintptr) {
+			flushTLBEntryCallCount++
+		}
+
+		frame := pmm.Frame(uintptr(spec.pageSize) >> mem.PageShift)
+		if err := MapHuge(PageFromAddress(spec.virtAddr), frame, spec.pageSize, FlagPresent|FlagRW); err != nil {
+			t.Errorf("[spec %d] unexpected error: %v", specIndex, err)
+			continue
+		}
+
+		hugeLevel := len(spec.levelIndices) - 1
+		for level, index := range spec.levelIndices {
+			pte := physPages[level][index]
+			if !pte.HasFlags(FlagPresent | FlagRW) {
+				t.Errorf("[spec %d] [pte at level %d] expected entry to have FlagPresent and FlagRW set", specIndex, level)
+			}
+
+			if level < hugeLevel {
+				if pte.HasFlags(FlagHugePage) {
+					t.Errorf("[spec %d] [pte at level %d] expected entry not to have FlagHugePage set", specIndex, level)
+				}
+				continue
+			}
+
+			if !pte.HasFlags(FlagHugePage) {
+				t.Errorf("[spec %d] [pte at level %d] expected entry to have FlagHugePage set", specIndex, level)
+			}
+
+			if got := pte.Frame(); got != frame {
+				t.Errorf("[spec %d] [pte at level %d] expected entry frame to be %d; got %d", specIndex, level, frame, got)
+			}
+		}
+
+		if exp := hugeLevel; nextPhysPage != exp {
+			t.Errorf("[spec %d] expected %d page tables to be allocated; got %d", specIndex, exp, nextPhysPage)
+		}
+
+		if exp := 1; flushTLBEntryCallCount != exp {
+			t.Errorf("[spec %d] expected flushTLBEntry to be called %d times; got %d", specIndex, exp, flushTLBEntryCallCount)
+		}
+
+		// Replacing the existing huge page mapping should not allocate any
+		// page tables and should overwrite the entry in place
+		pteCallCount = 0
+		newFrame := frame * 2
+		if err := MapHuge(PageFromAddress(spec.virtAddr), newFrame, spec.pageSize, FlagPresent); err != nil {
+			t.Errorf("[spec %d] unexpected error: %v", specIndex, err)
+			continue
+		}
+
+		if got := physPages[hugeLevel][spec.levelIndices[hugeLevel]].Frame(); got != newFrame {
+			t.Errorf("[spec %d] expected huge page entry frame to be %d; got %d", specIndex, newFrame, got)
+		}
+
+		if exp := hugeLevel; nextPhysPage != exp {
+			t.Errorf("[spec %d] expected %d page tables to be allocated; got %d", specIndex, exp, nextPhysPage)
+		}
+
+		if exp := 2; flushTLBEntryCallCount != exp {
+			t.Errorf("[spec %d] expected flushTLBEntry to be called %d times; got %d", specIndex, exp, flushTLBEntryCallCount)
+		}
+	}
+}
+
+func TestMapHugeErrorsAmd64(t *testing.T) {
+	if runtime.GOARCH != "amd64" {
+		t.Skip("test requires amd64 runtime; skipping")
+	}
+
+	defer func(origPtePtr func(uintptr) unsafe.Pointer, origNextAddrFn func(uintptr) uintptr, origFlushTLBEntryFn func(uintptr), origCPUIDFn func(uint32) (uint32, uint32, uint32, uint32)) {
+		ptePtrFn = origPtePtr
+		nextAddrFn = origNextAddrFn
+		flushTLBEntryFn = origFlushTLBEntryFn
+		cpuIDFn = origCPUIDFn
+		frameAllocator = nil
+	}(ptePtrFn, nextAddrFn, flushTLBEntryFn, cpuIDFn)
+
+	var physPages [pageLevels][mem.PageSize >> mem.PointerShift]pageTableEntry
+	ptePtrFn = func(entry uintptr) unsafe.Pointer {
+		return unsafe.Pointer(&physPages[0][0])
+	}
+	flushTLBEntryFn = func(uintptr) {}
+
+	t.Run("unsupported page size", func(t *testing.T) {
+		cpuIDFn = func(_ uint32) (uint32, uint32, uint32, uint32) {
+			return 0, 0, 0, 0
+		}
+
+		for specIndex, pageSize := range []mem.Size{mem.PageSize, 4 * mem.Mb, HugePageSize1G} {
+			if err := MapHuge(PageFromAddress(0), pmm.Frame(0), pageSize, FlagPresent); err != errUnsupportedHugePageSize {
+				t.Errorf("[spec %d] expected to get errUnsupportedHugePageSize; got %v", specIndex, err)
+			}
+		}
+	})
+
+	t.Run("misaligned page or frame", func(t *testing.T) {
+		if err := MapHuge(PageFromAddress(0x1000), pmm.Frame(0), HugePageSize2M, FlagPresent); err != errMisalignedHugePage {
+			t.Errorf("expected to get errMisalignedHugePage; got %v", err)
+		}
+
+		if err := MapHuge(PageFromAddress(0), pmm.Frame(1), HugePageSize2M, FlagPresent); err != errMisalignedHugePage {
+			t.Errorf("expected to get errMisalignedHugePage; got %v", err)
+		}
+	})
+
+	t.Run("address covered by huge page at higher level", func(t *testing.T) {
+		physPages[0][0] = 0
+		physPages[0][0].SetFlags(FlagPresent | FlagHugePage)
+
+		if err := MapHuge(PageFromAddress(0), pmm.Frame(0), HugePageSize2M, FlagPresent); err != errHugePageMapped {
+			t.Errorf("expected to get errHugePageMapped; got %v", err)
+		}
+	})
+
+	t.Run("address covered by page table", func(t *testing.T) {
+		physPages[0][0] = 0
+		physPages[0][0].SetFlags(FlagPresent)
+
+		if err := MapHuge(PageFromAddress(0), pmm.Frame(0), HugePageSize2M, FlagPresent); err != errHugePageOverlapsTable {
+			t.Errorf("expected to get errHugePageOverlapsTable; got %v", err)
+		}
+	})
+
+	t.Run("allocFn returns an error", func(t *testing.T) {
+		physPages[0][0] = 0
+		expErr := &kernel.Error{Module: "test", Message: "out of memory"}
+		SetFrameAllocator(func() (pmm.Frame, *kernel.Error) {
+			return 0, expErr
+		})
+
+		if err := MapHuge(PageFromAddress(0), pmm.Frame(0), HugePageSize2M, FlagPresent); err != expErr {
+			t.Errorf("expected to get %v; got %v", expErr, err)
+		}
+	})
+}
+
+func TestUnmapHugeAmd64(t *testing.T) {
+	if runtime.GOARCH != "amd64" {
+		t.Skip("test requires amd64 runtime; skipping")
+	}
+
+	defer func(origPtePtr func(uintptr) unsafe.Pointer, origFlushTLBEntryFn func(uintptr)) {
+		ptePtrFn = origPtePtr
+		flushTLBEntryFn = origFlushTLBEntryFn
+	}(ptePtrFn, flushTLBEntryFn)
+
+	var physPages [pageLevels][mem.PageSize >> mem.PointerShift]pageTableEntry
+
+	// Emulate a 2M page mapped to virtAddr 0
+	frame := pmm.Frame(512)
+	for level := 0; level < 2; level++ {
+		physPages[level][0].SetFlags(FlagPresent | FlagRW)
+		physPages[level][0].SetFrame(pmm.Frame(uintptr(unsafe.Pointer(&physPages[level+1][0])) >> mem.PageShift))
+	}
+	physPages[2][0].SetFlags(FlagPresent | FlagRW | FlagHugePage)
+	physPages[2][0].SetFrame(frame)
+
+	pteCallCount := 0
+	ptePtrFn = func(entry uintptr) unsafe.Pointer {
+		pteCallCount++
+		return unsafe.Pointer(&physPages[pteCallCount-1][0])
+	}
+
+	flushTLBEntryCallCount := 0
+	flushTLBEntryFn = func(uintptr) {
+		flushTLBEntryCallCount++
+	}
+
+	// Unmapping any page inside the huge page should unmap the huge page
+	if err := Unmap(PageFromAddress(0x1000)); err != nil {
+		t.Fatal(err)
+	}
+
+	if exp := 3; pteCallCount != exp {
+		t.Errorf("expected the page walk to stop at level %d; visited %d levels", exp-1, pteCallCount)
+	}
+
+	if physPages[2][0].HasFlags(FlagPresent) {
+		t.Error("expected huge page entry not to have FlagPresent set")
+	}
+
+	if got := physPages[2][0].Frame(); got != frame {
+		t.Errorf("expected huge page entry frame to be %d; got %d", frame, got)
+	}
+
+	if exp := 1; flushTLBEntryCallCount != exp {
+		t.Errorf("expected flushTLBEntry to be called %d times; got %d", exp, flushTLBEntryCallCount)
+	}
+}
+
+func TestTranslateHugeAmd64(t *testing.T) {
+	if runtime.GOARCH != "amd64" {
+		t.Skip("test requires amd64 runtime; skipping")
+	}
+
+	defer func(origPtePtr func(uintptr) unsafe.Pointer) {
+		ptePtrFn = origPtePtr
+	}(ptePtrFn)
+
+	specs := []struct {
+		hugeLevel   int
+		virtAddr    uintptr
+		frame       pmm.Frame
+		expPhysAddr uintptr
+	}{
+		{2, 0x123456, pmm.Frame(0x400), 0x523456},
+		{1, 0x12345678, pmm.Frame(0x80000), 0x92345678},
+	}
+
+	for specIndex, spec := range specs {
+		pteCallCount := 0
+		ptePtrFn = func(entry uintptr) unsafe.Pointer {
+			var pte pageTableEntry
+			pte.SetFlags(FlagPresent)
+			if pteCallCount == spec.hugeLevel {
+				pte.SetFlags(FlagHugePage)
+				pte.SetFrame(spec.frame)
+			}
+			pteCallCount++
+
+			return unsafe.Pointer(&pte)
+		}
+
+		physAddr, err := Translate(spec.virtAddr)
+		if err != nil {
+			t.Errorf("[spec %d] unexpected error: %v", specIndex, err)
+			continue
+		}
+
+		if physAddr != spec.expPhysAddr {
+			t.Errorf("[spec %d] expected phys addr to be 0x%x; got 0x%x", specIndex, spec.expPhysAddr, physAddr)
+		}
+
+		if exp := spec.hugeLevel + 1; pteCallCount != exp {
+			t.Errorf("[spec %d] expected the page walk to visit %d levels; visited %d", specIndex, exp, pteCallCount)
+		}
+	}
+}
+
+func TestSupports1GPages(t *testing.T) {
+	defer func() {
+		cpuIDFn = cpu.ID
+	}()
+
+	for _, exp := range []bool{true, false} {
+		cpuIDFn = func(leaf uint32) (uint32, uint32, uint32, uint32) {
+			if leaf != 0x80000001 {
+				t.Fatalf("unexpected CPUID leaf 0x%x", leaf)
+			}
+
+			if exp {
+				return 0, 0, 0, 1 << 26
+			}
+			return 0, 0, 0, 0
+		}
+
+		if got := supports1GPages(); got != exp {
+			t.Errorf("expected supports1GPages to return %t; got %t", exp, got)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package vmm
+
+import "gopheros/kernel/cpu"
+
+// rdrandRetries defines the number of attempts for obtaining a random value
+// via RDRAND before falling back to the time-stamp counter.
+const rdrandRetries = 10
+
+var (
+	// physMapBase is the virtual address where the physmap begins. It
+	// defaults to PhysMapBase and is randomized by Init.
+	physMapBase = PhysMapBase
+
+	// the following functions are mocked by tests and are automatically
+	// inlined by the compiler.
+	hasRDRANDFn  = cpu.HasRDRAND
+	readRandomFn = cpu.ReadRandom
+	readTSCFn    = cpu.ReadTSC
+)
+
+// randomizeLayout selects a random, 1G-aligned physmap base address in the
+// [physMapMinBase, PhysMapBase] range. It must be invoked before the physmap
+// is established.
+//
+// The kernel image is linked at a fixed address by the Go toolchain and is
+// not relocatable; as a result, only the physmap location is randomized.
+//
+// TODO: randomize the kernel image base. This requires the early boot code
+// to relocate the kernel before jumping to the Go entrypoint.
+func randomizeLayout() {
+	slots := uint64((PhysMapBase-physMapMinBase)/uintptr(physMapAlign)) + 1
+	physMapBase = physMapMinBase + uintptr(layoutEntropy()%slots)*uintptr(physMapAlign)
+}
+
+// layoutEntropy returns a random value obtained via the RDRAND instruction.
+// If RDRAND is not supported or fails to provide a value, layoutEntropy
+// derives a value from the time-stamp counter.
+func layoutEntropy() uint64 {
+	if hasRDRANDFn() {
+		for attempt := 0; attempt < rdrandRetries; attempt++ {
+			if val, ok := readRandomFn(); ok {
+				return val
+			}
+		}
+	}
+
+	// Spread the entropy from the low TSC bits, which change frequently,
+	// to the high bits (splitmix64 finalizer).
+	val := readTSCFn()
+	val = (val ^ (val >> 30)) * 0xbf58476d1ce4e5b9
+	val = (val ^ (val >> 27)) * 0x94d049bb133111eb
+	return val ^ (val >> 31)
+}
@@ -0,0 +1,106 @@
+package vmm
+
+import (
+	"gopheros/kernel/cpu"
+	"testing"
+)
+
+func TestRandomizeLayout(t *testing.T) {
+	defer resetLayoutMocks()
+
+	var (
+		randomVal uint64
+		tscVal    uint64
+		failCount int
+	)
+
+	hasRDRANDFn = func() bool { return true }
+	readRandomFn = func() (uint64, bool) {
+		if failCount > 0 {
+			failCount--
+			return 0, false
+		}
+		return randomVal, true
+	}
+	readTSCFn = func() uint64 { return tscVal }
+
+	maxSlot := uint64((PhysMapBase - physMapMinBase) / uintptr(physMapAlign))
+
+	specs := []struct {
+		randomVal uint64
+		expBase   uintptr
+	}{
+		{0, physMapMinBase},
+		{1, physMapMinBase + uintptr(physMapAlign)},
+		{maxSlot, PhysMapBase},
+		// Random values wrap around the available slots
+		{maxSlot + 1, physMapMinBase},
+	}
+
+	for specIndex, spec := range specs {
+		randomVal = spec.randomVal
+		randomizeLayout()
+
+		if physMapBase != spec.expBase {
+			t.Errorf("[spec %d] expected physmap base to be 0x%x; got 0x%x", specIndex, spec.expBase, physMapBase)
+		}
+
+		if got := PhysToVirt(0x1000); got != spec.expBase+0x1000 {
+			t.Errorf("[spec %d] expected PhysToVirt to use the randomized base; got 0x%x", specIndex, got)
+		}
+	}
+
+	// RDRAND may transiently fail to provide a value
+	randomVal, failCount = 1, rdrandRetries-1
+	randomizeLayout()
+	if exp := physMapMinBase + uintptr(physMapAlign); physMapBase != exp {
+		t.Fatalf("expected physmap base to be 0x%x; got 0x%x", exp, physMapBase)
+	}
+
+	// When RDRAND keeps failing or is not available, the TSC is used as
+	// the entropy source
+	for _, rdrandSupported := range []bool{true, false} {
+		hasRDRANDFn = func() bool { return rdrandSupported }
+		failCount = rdrandRetries
+
+		bases := make(map[uintptr]struct{})
+		for tscVal = 0; tscVal < 32; tscVal++ {
+			randomizeLayout()
+			if physMapBase < physMapMinBase || physMapBase > PhysMapBase || physMapBase%uintptr(physMapAlign) != 0 {
+				t.Fatalf("invalid physmap base 0x%x", physMapBase)
+			}
+			bases[physMapBase] = struct{}{}
+			failCount = rdrandRetries
+		}
+
+		// Nearby TSC values should still yield different bases
+		if len(bases) < 16 {
+			t.Fatalf("expected TSC-derived physmap bases to be spread out; got %d distinct bases", len(bases))
+		}
+	}
+}
+
+func resetLayoutMocks() {
+	hasRDRANDFn = cpu.HasRDRAND
+	readRandomFn = cpu.ReadRandom
+	readTSCFn = cpu.ReadTSC
+	physMapBase = PhysMapBase
+}
+
+func TestRandomizeLayoutAvoidsKernelImage(t *testing.T) {
+	defer resetLayoutMocks()
+
+	var slot uint64
+	hasRDRANDFn = func() bool { return true }
+	readRandomFn = func() (uint64, bool) { return slot, true }
+
+	maxSlot := uint64((PhysMapBase - physMapMinBase) / uintptr(physMapAlign))
+	for slot = 0; slot <= maxSlot; slot++ {
+		randomizeLayout()
+
+		physMapEnd := physMapBase + uintptr(PhysMapSize)
+		if physMapBase < kernelImageEnd && physMapEnd > kernelImageBase {
+			t.Fatalf("[slot %d] physmap range [0x%x, 0x%x) overlaps the kernel image range [0x%x, 0x%x)", slot, physMapBase, physMapEnd, kernelImageBase, kernelImageEnd)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package vmm
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/mem"
+)
+
+// maxLazyRegions defines the max number of regions that can be reserved via
+// calls to Reserve.
+const maxLazyRegions = 32
+
+var (
+	// lazyRegions is a statically allocated array that tracks the regions
+	// reserved by Reserve so that the page fault handler can populate them
+	// on demand.
+	lazyRegions     [maxLazyRegions]lazyRegion
+	lazyRegionCount int
+
+	errTooManyLazyRegions = &kernel.Error{Module: "vmm", Message: "max number of on-demand regions reached"}
+)
+
+// lazyRegion describes a virtual memory region whose pages are allocated when
+// they are first accessed.
+type lazyRegion struct {
+	start, end uintptr
+}
+
+// Reserve reserves a page-aligned contiguous virtual memory region with the
+// requested size in the kernel address space and returns its virtual address.
+// Unlike MapRegion, no physical memory is allocated for the region. Instead,
+// the first access to any of its pages triggers a page fault which is handled
+// by allocating a zeroed physical frame and mapping it in place with RW
+// permissions.
+//
+// If size is not a multiple of mem.PageSize it will be automatically rounded
+// up.
+func Reserve(size mem.Size) (uintptr, *kernel.Error) {
+	if lazyRegionCount == maxLazyRegions {
+		return 0, errTooManyLazyRegions
+	}
+
+	startAddr, err := earlyReserveRegionFn(size)
+	if err != nil {
+		return 0, err
+	}
+
+	size = (size + (mem.PageSize - 1)) & ^(mem.PageSize - 1)
+	lazyRegions[lazyRegionCount] = lazyRegion{start: startAddr, end: startAddr + uintptr(size)}
+	lazyRegionCount++
+
+	return startAddr, nil
+}
+
+// isLazyAddress returns true if the supplied address belongs to a region
+// reserved via a call to Reserve.
+func isLazyAddress(addr uintptr) bool {
+	for index := 0; index < lazyRegionCount; index++ {
+		if addr >= lazyRegions[index].start && addr < lazyRegions[index].end {
+			return true
+		}
+	}
+
+	return false
+}
+
+// faultInPage allocates a physical frame for a page that belongs to a region
+// reserved via a call to Reserve, maps it and clears its contents.
+func faultInPage(page Page) *kernel.Error {
+	frame, err := frameAllocator()
+	if err != nil {
+		return err
+	}
+
+	if err = mapFn(page, frame, FlagPresent|FlagRW); err != nil {
+		return err
+	}
+
+	mem.Memset(page.Address(), 0, mem.PageSize)
+	return nil
+}
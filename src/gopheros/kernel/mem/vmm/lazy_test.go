@@ -0,0 +1,152 @@
+package vmm
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/irq"
+	"gopheros/kernel/mem"
+	"gopheros/kernel/mem/pmm"
+	"testing"
+	"unsafe"
+)
+
+func TestReserve(t *testing.T) {
+	defer func() {
+		earlyReserveRegionFn = EarlyReserveRegion
+		lazyRegionCount = 0
+	}()
+
+	earlyReserveRegionFn = func(_ mem.Size) (uintptr, *kernel.Error) {
+		return 0x10000, nil
+	}
+
+	addr, err := Reserve(mem.PageSize + 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if addr != 0x10000 {
+		t.Fatalf("expected reserved region address to be 0x10000; got 0x%x", addr)
+	}
+
+	specs := []struct {
+		addr uintptr
+		exp  bool
+	}{
+		{0xffff, false},
+		{0x10000, true},
+		{0x11fff, true},
+		{0x12000, false},
+	}
+
+	for specIndex, spec := range specs {
+		if got := isLazyAddress(spec.addr); got != spec.exp {
+			t.Errorf("[spec %d] expected isLazyAddress(0x%x) to return %t; got %t", specIndex, spec.addr, spec.exp, got)
+		}
+	}
+}
+
+func TestReserveErrors(t *testing.T) {
+	defer func() {
+		earlyReserveRegionFn = EarlyReserveRegion
+		lazyRegionCount = 0
+	}()
+
+	lazyRegionCount = maxLazyRegions
+	if _, err := Reserve(mem.PageSize); err != errTooManyLazyRegions {
+		t.Fatalf("expected error %v; got %v", errTooManyLazyRegions, err)
+	}
+
+	lazyRegionCount = 0
+	expErr := &kernel.Error{Module: "test", Message: "out of address space"}
+	earlyReserveRegionFn = func(_ mem.Size) (uintptr, *kernel.Error) {
+		return 0, expErr
+	}
+
+	if _, err := Reserve(mem.PageSize); err != expErr {
+		t.Fatalf("expected error %v; got %v", expErr, err)
+	}
+
+	if lazyRegionCount != 0 {
+		t.Fatal("expected failed reservation not to be tracked")
+	}
+}
+
+func TestLazyPageFault(t *testing.T) {
+	defer func() {
+		readCR2Fn = cpu.ReadCR2
+		frameAllocator = nil
+		mapFn = Map
+		lazyRegionCount = 0
+	}()
+
+	var (
+		frame irq.Frame
+		regs  irq.Regs
+		buf   = make([]byte, 2*mem.PageSize)
+	)
+
+	// Use a page-aligned block of heap memory as the lazily allocated page
+	// and fill it with junk
+	pageAddr := (uintptr(unsafe.Pointer(&buf[0])) + uintptr(mem.PageSize-1)) &^ uintptr(mem.PageSize-1)
+	page := (*[mem.PageSize]byte)(unsafe.Pointer(pageAddr))
+	for i := 0; i < len(page); i++ {
+		page[i] = 0xff
+	}
+
+	lazyRegions[0] = lazyRegion{start: pageAddr, end: pageAddr + uintptr(mem.PageSize)}
+	lazyRegionCount = 1
+
+	readCR2Fn = func() uint64 { return uint64(pageAddr + 8) }
+	SetFrameAllocator(func() (pmm.Frame, *kernel.Error) {
+		return pmm.Frame(123), nil
+	})
+
+	var mappedPage Page
+	mapFn = func(p Page, f pmm.Frame, flags PageTableEntryFlag) *kernel.Error {
+		if f != pmm.Frame(123) || flags != FlagPresent|FlagRW {
+			t.Errorf("unexpected mapping of frame %d with flags %d", f, flags)
+		}
+		mappedPage = p
+		return nil
+	}
+
+	pageFaultHandler(2, &frame, &regs)
+
+	if exp := PageFromAddress(pageAddr); mappedPage != exp {
+		t.Fatalf("expected page 0x%x to be mapped; got 0x%x", exp, mappedPage)
+	}
+
+	for i := 0; i < len(page); i++ {
+		if page[i] != 0 {
+			t.Fatalf("expected page to be cleared; got byte %x at index %d", page[i], i)
+		}
+	}
+
+	expErr := &kernel.Error{Module: "test", Message: "something went wrong"}
+	specs := []struct {
+		allocErr, mapErr *kernel.Error
+	}{
+		{expErr, nil},
+		{nil, expErr},
+	}
+
+	for specIndex, spec := range specs {
+		SetFrameAllocator(func() (pmm.Frame, *kernel.Error) {
+			return pmm.Frame(123), spec.allocErr
+		})
+		mapFn = func(_ Page, _ pmm.Frame, _ PageTableEntryFlag) *kernel.Error {
+			return spec.mapErr
+		}
+
+		func() {
+			defer func() {
+				if err := recover(); err != expErr {
+					t.Errorf("[spec %d] expected a panic with %v; got %v", specIndex, expErr, err)
+				}
+			}()
+
+			pageFaultHandler(2, &frame, &regs)
+		}()
+	}
+}
@@ -49,7 +49,7 @@ var (
 
 	earlyReserveRegionFn = EarlyReserveRegion
 
-	errNoHugePageSupport           = &kernel.Error{Module: "vmm", Message: "huge pages are not supported"}
+	errHugePageMapped              = &kernel.Error{Module: "vmm", Message: "virtual address is mapped by a huge page"}
 	errAttemptToRWMapReservedFrame = &kernel.Error{Module: "vmm", Message: "reserved blank frame cannot be mapped with a RW flag"}
 )
 
@@ -58,8 +58,23 @@ var (
 // supplied physical frame allocator to initialize missing page tables at each
 // paging level supported by the MMU.
 //
+// Pages mapped by Map are always flagged as non-executable. Code that needs to
+// map executable pages (e.g. the kernel image) must use MapExecutable instead.
+//
 // Attempts to map ReservedZeroedFrame with a RW flag will result in an error.
 func Map(page Page, frame pmm.Frame, flags PageTableEntryFlag) *kernel.Error {
+	return mapPage(page, frame, flags|FlagNoExecute)
+}
+
+// MapExecutable behaves like Map but allows the CPU to execute code from the
+// mapped page. The FlagNoExecute flag, if specified, is ignored.
+func MapExecutable(page Page, frame pmm.Frame, flags PageTableEntryFlag) *kernel.Error {
+	return mapPage(page, frame, flags&^FlagNoExecute)
+}
+
+// mapPage establishes a mapping between a virtual page and a physical memory
+// frame using the supplied flags as-is.
+func mapPage(page Page, frame pmm.Frame, flags PageTableEntryFlag) *kernel.Error {
 	if protectReservedZeroedPage && frame == ReservedZeroedFrame && (flags&FlagRW) != 0 {
 		return errAttemptToRWMapReservedFrame
 	}
@@ -68,45 +83,59 @@ func Map(page Page, frame pmm.Frame, flags PageTableEntryFlag) *kernel.Error {
 
 	walk(page.Address(), func(pteLevel uint8, pte *pageTableEntry) bool {
 		// If we reached the last level all we need to do is to map the
-		// frame in place and flag it as present and flush its TLB entry
+		// frame in place and flag it as present and flush its TLB entry.
+		// If we are replacing an existing mapping, other CPUs may have
+		// cached it so its TLB entry must be flushed on all CPUs.
 		if pteLevel == pageLevels-1 {
+			wasPresent := pte.HasFlags(FlagPresent)
 			*pte = 0
 			pte.SetFrame(frame)
 			pte.SetFlags(flags)
-			flushTLBEntryFn(page.Address())
+			if wasPresent {
+				shootdownPage(page.Address())
+			} else {
+				flushTLBEntryFn(page.Address())
+			}
 			return true
 		}
 
 		if pte.HasFlags(FlagHugePage) {
-			err = errNoHugePageSupport
+			err = errHugePageMapped
 			return false
 		}
 
 		// Next table does not yet exist; we need to allocate a
 		// physical frame for it map it and clear its contents.
 		if !pte.HasFlags(FlagPresent) {
-			var newTableFrame pmm.Frame
-			newTableFrame, err = frameAllocator()
-			if err != nil {
-				return false
-			}
-
-			*pte = 0
-			pte.SetFrame(newTableFrame)
-			pte.SetFlags(FlagPresent | FlagRW)
-
-			// The next pte entry becomes available but we need to
-			// make sure that the new page is properly cleared
-			nextTableAddr := (uintptr(unsafe.Pointer(pte)) << pageLevelBits[pteLevel+1])
-			mem.Memset(nextAddrFn(nextTableAddr), 0, mem.PageSize)
+			err = allocPageTable(pteLevel, pte)
 		}
 
-		return true
+		return err == nil
 	})
 
 	return err
 }
 
+// allocPageTable allocates a physical frame for the page table pointed to by
+// the supplied page table entry, updates the entry to point to it and clears
+// the contents of the new table.
+func allocPageTable(pteLevel uint8, pte *pageTableEntry) *kernel.Error {
+	newTableFrame, err := frameAllocator()
+	if err != nil {
+		return err
+	}
+
+	*pte = 0
+	pte.SetFrame(newTableFrame)
+	pte.SetFlags(FlagPresent | FlagRW)
+
+	// The next pte entry becomes available but we need to
+	// make sure that the new page is properly cleared
+	nextTableAddr := (uintptr(unsafe.Pointer(pte)) << pageLevelBits[pteLevel+1])
+	mem.Memset(nextAddrFn(nextTableAddr), 0, mem.PageSize)
+	return nil
+}
+
 // MapRegion establishes a mapping to the physical memory region which starts
 // at the given frame and ends at frame + pages(size). The size argument is
 // always rounded up to the nearest page boundary. MapRegion reserves the next
@@ -148,16 +177,18 @@ func MapTemporary(frame pmm.Frame) (Page, *kernel.Error) {
 	return PageFromAddress(tempMappingAddr), nil
 }
 
-// Unmap removes a mapping previously installed via a call to Map or MapTemporary.
+// Unmap removes a mapping previously installed via a call to Map, MapHuge or
+// MapTemporary. If the page belongs to a huge page mapping, the entire huge
+// page is unmapped.
 func Unmap(page Page) *kernel.Error {
 	var err *kernel.Error
 
 	walk(page.Address(), func(pteLevel uint8, pte *pageTableEntry) bool {
 		// If we reached the last level all we need to do is to set the
-		// page as non-present and flush its TLB entry
+		// page as non-present and flush its TLB entry on all CPUs
 		if pteLevel == pageLevels-1 {
 			pte.ClearFlags(FlagPresent)
-			flushTLBEntryFn(page.Address())
+			shootdownPage(page.Address())
 			return true
 		}
 
@@ -168,7 +199,13 @@ func Unmap(page Page) *kernel.Error {
 		}
 
 		if pte.HasFlags(FlagHugePage) {
-			err = errNoHugePageSupport
+			if pteLevel < minHugePageLevel {
+				err = ErrInvalidMapping
+				return false
+			}
+
+			pte.ClearFlags(FlagPresent)
+			shootdownPage(page.Address())
 			return false
 		}
 
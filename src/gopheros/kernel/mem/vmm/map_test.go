@@ -97,6 +97,52 @@ func TestMapTemporaryAmd64(t *testing.T) {
 	}
 }
 
+func TestMapNoExecuteAmd64(t *testing.T) {
+	if runtime.GOARCH != "amd64" {
+		t.Skip("test requires amd64 runtime; skipping")
+	}
+
+	defer func(origPtePtr func(uintptr) unsafe.Pointer, origFlushTLBEntryFn func(uintptr)) {
+		ptePtrFn = origPtePtr
+		flushTLBEntryFn = origFlushTLBEntryFn
+	}(ptePtrFn, flushTLBEntryFn)
+
+	var physPages [pageLevels][mem.PageSize >> mem.PointerShift]pageTableEntry
+	for level := 0; level < pageLevels-1; level++ {
+		physPages[level][0].SetFlags(FlagPresent | FlagRW)
+	}
+
+	flushTLBEntryFn = func(uintptr) {}
+
+	specs := []struct {
+		mapFn    func(Page, pmm.Frame, PageTableEntryFlag) *kernel.Error
+		flags    PageTableEntryFlag
+		expNoExe bool
+	}{
+		{Map, FlagPresent | FlagRW, true},
+		{Map, FlagPresent | FlagNoExecute, true},
+		{MapExecutable, FlagPresent, false},
+		{MapExecutable, FlagPresent | FlagNoExecute, false},
+	}
+
+	for specIndex, spec := range specs {
+		pteCallCount := 0
+		ptePtrFn = func(entry uintptr) unsafe.Pointer {
+			pteCallCount++
+			return unsafe.Pointer(&physPages[pteCallCount-1][0])
+		}
+
+		if err := spec.mapFn(PageFromAddress(0), pmm.Frame(123), spec.flags); err != nil {
+			t.Errorf("[spec %d] unexpected error: %v", specIndex, err)
+			continue
+		}
+
+		if got := physPages[pageLevels-1][0].HasFlags(FlagNoExecute); got != spec.expNoExe {
+			t.Errorf("[spec %d] expected FlagNoExecute to be %t; got %t", specIndex, spec.expNoExe, got)
+		}
+	}
+}
+
 func TestMapRegion(t *testing.T) {
 	defer func() {
 		mapFn = Map
@@ -191,8 +237,8 @@ func TestMapTemporaryErrorsAmd64(t *testing.T) {
 			return unsafe.Pointer(&physPages[0][pteIndex])
 		}
 
-		if _, err := MapTemporary(frame); err != errNoHugePageSupport {
-			t.Fatalf("expected to get errNoHugePageSupport; got %v", err)
+		if _, err := MapTemporary(frame); err != errHugePageMapped {
+			t.Fatalf("expected to get errHugePageMapped; got %v", err)
 		}
 	})
 
@@ -322,8 +368,9 @@ func TestUnmapErrorsAmd64(t *testing.T) {
 			return unsafe.Pointer(&physPages[0][pteIndex])
 		}
 
-		if err := Unmap(PageFromAddress(0)); err != errNoHugePageSupport {
-			t.Fatalf("expected to get errNoHugePageSupport; got %v", err)
+		// P4 entries cannot map huge pages
+		if err := Unmap(PageFromAddress(0)); err != ErrInvalidMapping {
+			t.Fatalf("expected to get ErrInvalidMapping; got %v", err)
 		}
 	})
 
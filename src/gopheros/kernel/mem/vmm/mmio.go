@@ -0,0 +1,113 @@
+package vmm
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/cpu/pat"
+	"gopheros/kernel/mem"
+	"gopheros/kernel/mem/pmm"
+)
+
+var (
+	// the following functions are mocked by tests and are automatically
+	// inlined by the compiler.
+	patInitFn  = pat.Init
+	patIndexFn = pat.Index
+
+	errInvalidCacheAttr = &kernel.Error{Module: "vmm", Message: "unsupported cache attribute"}
+)
+
+// CacheAttr describes the caching policy for a memory-mapped I/O region.
+type CacheAttr uint8
+
+const (
+	// CacheWriteBack enables write-back caching. It should only be used
+	// for regions that behave like regular memory.
+	CacheWriteBack CacheAttr = iota
+
+	// CacheUncached disables caching. This is the appropriate policy for
+	// device registers.
+	CacheUncached
+
+	// CacheWriteCombining allows writes to be combined in the CPU's
+	// write-combining buffers before reaching the device. This policy is
+	// suitable for framebuffers. If the CPU does not support PAT, the
+	// region is mapped as uncached.
+	CacheWriteCombining
+)
+
+// pageFlags returns the page table entry flags that select the PAT entry for
+// this cache attribute.
+func (attr CacheAttr) pageFlags() (PageTableEntryFlag, *kernel.Error) {
+	var memType pat.MemoryType
+	switch attr {
+	case CacheWriteBack:
+		memType = pat.WriteBack
+	case CacheUncached:
+		memType = pat.Uncacheable
+	case CacheWriteCombining:
+		memType = pat.WriteCombining
+	default:
+		return 0, errInvalidCacheAttr
+	}
+
+	index, ok := patIndexFn(memType)
+	if !ok {
+		index, _ = patIndexFn(pat.Uncacheable)
+	}
+
+	// The PAT bit shares its position with FlagHugePage so only the PAT
+	// entries that are addressable via the PWT and PCD bits can be used.
+	var flags PageTableEntryFlag
+	if index&1 != 0 {
+		flags |= FlagWriteThroughCaching
+	}
+	if index&2 != 0 {
+		flags |= FlagDoNotCache
+	}
+
+	return flags, nil
+}
+
+// MapMMIO maps a physical memory region that belongs to a memory-mapped device
+// using the requested cache attributes and returns the virtual address that
+// corresponds to the supplied physical address. The physical address does not
+// need to be page-aligned.
+func MapMMIO(physAddr uintptr, size mem.Size, attrs CacheAttr) (uintptr, *kernel.Error) {
+	cacheFlags, err := attrs.pageFlags()
+	if err != nil {
+		return 0, err
+	}
+
+	pageOffset := physAddr & uintptr(mem.PageSize-1)
+	page, err := MapRegion(
+		pmm.Frame(physAddr>>mem.PageShift),
+		size+mem.Size(pageOffset),
+		FlagPresent|FlagRW|FlagNoExecute|cacheFlags,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	return page.Address() + pageOffset, nil
+}
+
+// UnmapMMIO removes a mapping that was established by MapMMIO. The virtAddr
+// and size arguments must match the address returned by MapMMIO and the size
+// passed to it. The virtual address range used by the mapping is not reused.
+func UnmapMMIO(virtAddr uintptr, size mem.Size) *kernel.Error {
+	var (
+		pageOffset = virtAddr & uintptr(mem.PageSize-1)
+		pageCount  = (size + mem.Size(pageOffset) + (mem.PageSize - 1)) >> mem.PageShift
+	)
+
+	BeginShootdownBatch()
+	defer EndShootdownBatch()
+
+	for page := PageFromAddress(virtAddr); pageCount > 0; page, pageCount = page+1, pageCount-1 {
+		if err := unmapFn(page); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
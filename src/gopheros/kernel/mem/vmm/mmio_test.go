@@ -0,0 +1,153 @@
+package vmm
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/cpu/pat"
+	"gopheros/kernel/mem"
+	"gopheros/kernel/mem/pmm"
+	"reflect"
+	"testing"
+)
+
+func TestMapMMIO(t *testing.T) {
+	defer func() {
+		earlyReserveRegionFn = EarlyReserveRegion
+		mapFn = Map
+		patIndexFn = pat.Index
+	}()
+
+	const regionAddr = uintptr(0xffff000000000000)
+
+	var (
+		mappedFrames []pmm.Frame
+		mappedFlags  PageTableEntryFlag
+	)
+
+	earlyReserveRegionFn = func(_ mem.Size) (uintptr, *kernel.Error) {
+		return regionAddr, nil
+	}
+	mapFn = func(_ Page, frame pmm.Frame, flags PageTableEntryFlag) *kernel.Error {
+		mappedFrames = append(mappedFrames, frame)
+		mappedFlags = flags
+		return nil
+	}
+
+	specs := []struct {
+		physAddr   uintptr
+		size       mem.Size
+		attrs      CacheAttr
+		patEnabled bool
+		expAddr    uintptr
+		expFrames  []pmm.Frame
+		expFlags   PageTableEntryFlag
+	}{
+		{0xfee00000, 0x400, CacheUncached, true, regionAddr, []pmm.Frame{0xfee00}, FlagDoNotCache | FlagWriteThroughCaching},
+		// Unaligned region that spans two pages
+		{0xfed00f00, 0x200, CacheUncached, true, regionAddr + 0xf00, []pmm.Frame{0xfed00, 0xfed01}, FlagDoNotCache | FlagWriteThroughCaching},
+		{0xfd000000, 0x2000, CacheWriteCombining, true, regionAddr, []pmm.Frame{0xfd000, 0xfd001}, FlagWriteThroughCaching},
+		// Without PAT support, write-combining falls back to uncached
+		{0xfd000000, 0x1000, CacheWriteCombining, false, regionAddr, []pmm.Frame{0xfd000}, FlagDoNotCache | FlagWriteThroughCaching},
+		{0x1000, 0x1000, CacheWriteBack, true, regionAddr, []pmm.Frame{0x1}, 0},
+	}
+
+	for specIndex, spec := range specs {
+		mappedFrames = nil
+		patIndexFn = func(memType pat.MemoryType) (uint8, bool) {
+			switch {
+			case memType == pat.WriteBack:
+				return 0, true
+			case memType == pat.WriteCombining && spec.patEnabled:
+				return 1, true
+			case memType == pat.Uncacheable:
+				return 3, true
+			}
+			return 0, false
+		}
+
+		addr, err := MapMMIO(spec.physAddr, spec.size, spec.attrs)
+		if err != nil {
+			t.Errorf("[spec %d] unexpected error: %v", specIndex, err)
+			continue
+		}
+
+		if addr != spec.expAddr {
+			t.Errorf("[spec %d] expected returned address to be 0x%x; got 0x%x", specIndex, spec.expAddr, addr)
+		}
+
+		if len(mappedFrames) != len(spec.expFrames) {
+			t.Errorf("[spec %d] expected frames %v to be mapped; got %v", specIndex, spec.expFrames, mappedFrames)
+			continue
+		}
+
+		for i, frame := range spec.expFrames {
+			if mappedFrames[i] != frame {
+				t.Errorf("[spec %d] expected frames %v to be mapped; got %v", specIndex, spec.expFrames, mappedFrames)
+				break
+			}
+		}
+
+		if exp := FlagPresent | FlagRW | FlagNoExecute | spec.expFlags; mappedFlags != exp {
+			t.Errorf("[spec %d] expected mapping flags to be %d; got %d", specIndex, exp, mappedFlags)
+		}
+	}
+}
+
+func TestMapMMIOErrors(t *testing.T) {
+	defer func() {
+		earlyReserveRegionFn = EarlyReserveRegion
+	}()
+
+	if _, err := MapMMIO(0, mem.PageSize, CacheAttr(0xff)); err != errInvalidCacheAttr {
+		t.Errorf("expected error %v; got %v", errInvalidCacheAttr, err)
+	}
+
+	expErr := &kernel.Error{Module: "test", Message: "out of address space"}
+	earlyReserveRegionFn = func(_ mem.Size) (uintptr, *kernel.Error) {
+		return 0, expErr
+	}
+
+	if _, err := MapMMIO(0, mem.PageSize, CacheUncached); err != expErr {
+		t.Errorf("expected error %v; got %v", expErr, err)
+	}
+}
+
+func TestUnmapMMIO(t *testing.T) {
+	defer func() {
+		unmapFn = Unmap
+	}()
+
+	var unmappedPages []Page
+	unmapFn = func(page Page) *kernel.Error {
+		unmappedPages = append(unmappedPages, page)
+		return nil
+	}
+
+	specs := []struct {
+		virtAddr uintptr
+		size     mem.Size
+		expPages []Page
+	}{
+		{0xffff000000000000, 0x400, []Page{0xffff000000000000 >> mem.PageShift}},
+		// Unaligned region that spans two pages
+		{0xffff000000000f00, 0x200, []Page{0xffff000000000000 >> mem.PageShift, 0xffff000000001000 >> mem.PageShift}},
+		{0xffff000000000000, 0x2000, []Page{0xffff000000000000 >> mem.PageShift, 0xffff000000001000 >> mem.PageShift}},
+	}
+
+	for specIndex, spec := range specs {
+		unmappedPages = nil
+		if err := UnmapMMIO(spec.virtAddr, spec.size); err != nil {
+			t.Errorf("[spec %d] unexpected error: %v", specIndex, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(unmappedPages, spec.expPages) {
+			t.Errorf("[spec %d] expected pages %v to be unmapped; got %v", specIndex, spec.expPages, unmappedPages)
+		}
+	}
+
+	expErr := &kernel.Error{Module: "test", Message: "unmap failed"}
+	unmapFn = func(_ Page) *kernel.Error { return expErr }
+	if err := UnmapMMIO(0xffff000000000000, mem.PageSize); err != expErr {
+		t.Errorf("expected error %v; got %v", expErr, err)
+	}
+}
@@ -20,6 +20,10 @@ var (
 	// mapFn is used by tests and is automatically inlined by the compiler.
 	mapFn = Map
 
+	// mapExecutableFn is used by tests and is automatically inlined by the
+	// compiler.
+	mapExecutableFn = MapExecutable
+
 	// mapTemporaryFn is used by tests and is automatically inlined by the compiler.
 	mapTemporaryFn = MapTemporary
 
@@ -74,6 +78,19 @@ func (pdt *PageDirectoryTable) Init(pdtFrame pmm.Frame) *kernel.Error {
 // establishing a temporary mapping so that Map() can access the inactive PDT
 // entries.
 func (pdt PageDirectoryTable) Map(page Page, frame pmm.Frame, flags PageTableEntryFlag) *kernel.Error {
+	return pdt.mapWith(mapFn, page, frame, flags)
+}
+
+// MapExecutable behaves like Map but allows the CPU to execute code from the
+// mapped page. It is the PDT-aware equivalent of the global MapExecutable()
+// function.
+func (pdt PageDirectoryTable) MapExecutable(page Page, frame pmm.Frame, flags PageTableEntryFlag) *kernel.Error {
+	return pdt.mapWith(mapExecutableFn, page, frame, flags)
+}
+
+// mapWith invokes the supplied map function after temporarily installing this
+// PDT as the target of the recursive mapping in the active PDT, if required.
+func (pdt PageDirectoryTable) mapWith(mapPageFn func(Page, pmm.Frame, PageTableEntryFlag) *kernel.Error, page Page, frame pmm.Frame, flags PageTableEntryFlag) *kernel.Error {
 	var (
 		activePdtFrame   = pmm.Frame(activePDTFn() >> mem.PageShift)
 		lastPdtEntryAddr uintptr
@@ -89,7 +106,7 @@ func (pdt PageDirectoryTable) Map(page Page, frame pmm.Frame, flags PageTableEnt
 		flushTLBEntryFn(lastPdtEntryAddr)
 	}
 
-	err := mapFn(page, frame, flags)
+	err := mapPageFn(page, frame, flags)
 
 	if activePdtFrame != pdt.pdtFrame {
 		lastPdtEntry.SetFrame(activePdtFrame)
@@ -133,6 +133,7 @@ func TestPageDirectoryTableMapAmd64(t *testing.T) {
 		flushTLBEntryFn = origFlushTLBEntry
 		activePDTFn = origActivePDT
 		mapFn = origMap
+		mapExecutableFn = MapExecutable
 	}(flushTLBEntryFn, activePDTFn, mapFn)
 
 	t.Run("already mapped PDT", func(t *testing.T) {
@@ -159,6 +160,20 @@ func TestPageDirectoryTableMapAmd64(t *testing.T) {
 			t.Fatal(err)
 		}
 
+		var mapExecutableCalled bool
+		mapExecutableFn = func(_ Page, _ pmm.Frame, _ PageTableEntryFlag) *kernel.Error {
+			mapExecutableCalled = true
+			return nil
+		}
+
+		if err := pdt.MapExecutable(page, pmm.Frame(321), FlagPresent); err != nil {
+			t.Fatal(err)
+		}
+
+		if !mapExecutableCalled {
+			t.Fatal("expected MapExecutable to be called")
+		}
+
 		if exp := 0; flushCallCount != exp {
 			t.Fatalf("expected flushTLBEntry to be called %d times; called %d", exp, flushCallCount)
 		}
@@ -0,0 +1,104 @@
+package vmm
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/mem"
+	"gopheros/kernel/mem/pmm"
+)
+
+var (
+	// the following functions are mocked by tests and are automatically
+	// inlined by the compiler.
+	mapHugeFn   = MapHuge
+	memoryMapFn = pmm.MemoryMap
+
+	errPhysMapInvalidRange = &kernel.Error{Module: "vmm", Message: "invalid physmap range"}
+)
+
+// PhysToVirt returns the virtual address that can be used to access the
+// supplied physical address via the physmap.
+func PhysToVirt(physAddr uintptr) uintptr {
+	return physMapBase + physAddr
+}
+
+// VirtToPhys returns the physical address that corresponds to the supplied
+// virtual address. Physmap addresses are converted without consulting the
+// page tables; for any other address VirtToPhys behaves like Translate.
+func VirtToPhys(virtAddr uintptr) (uintptr, *kernel.Error) {
+	if virtAddr >= physMapBase && virtAddr-physMapBase < uintptr(PhysMapSize) {
+		return virtAddr - physMapBase, nil
+	}
+
+	return translateFn(virtAddr)
+}
+
+// setupPhysMap establishes a direct mapping at the physmap base for all physical
+// memory regions that contain RAM. Regions occupied by memory-mapped devices
+// are not mapped to avoid accessing them using the wrong caching policy.
+func setupPhysMap() *kernel.Error {
+	for _, region := range memoryMapFn() {
+		switch region.Type {
+		case pmm.RegionUsable, pmm.RegionACPIReclaimable, pmm.RegionACPINVS:
+		default:
+			continue
+		}
+
+		if err := mapPhysRange(region.StartFrame(), region.EndFrame()+1); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ExtendPhysMap adds the physical memory range [physAddr, physAddr+size) to
+// the physmap. It allows RAM that becomes available at runtime (e.g. via
+// memory hot-add) to be accessed via PhysToVirt.
+func ExtendPhysMap(physAddr uintptr, size mem.Size) *kernel.Error {
+	if size == 0 || physAddr&uintptr(mem.PageSize-1) != 0 || size&(mem.PageSize-1) != 0 {
+		return errPhysMapInvalidRange
+	}
+
+	startFrame := pmm.Frame(physAddr >> mem.PageShift)
+	endFrame := startFrame + pmm.Frame(size>>mem.PageShift)
+	if endFrame > pmm.Frame(PhysMapSize>>mem.PageShift) || endFrame < startFrame {
+		return errPhysMapInvalidRange
+	}
+
+	return mapPhysRange(startFrame, endFrame)
+}
+
+// mapPhysRange maps the frames in the [curFrame, endFrame) range to the
+// physmap. Frames beyond the physmap size are ignored. Whenever possible, the
+// mappings are established using 2M pages. Regular pages are always used for
+// frames that belong to the read-only kernel sections so that their physmap
+// aliases can be individually write-protected by ProtectKernelImage.
+func mapPhysRange(curFrame, endFrame pmm.Frame) *kernel.Error {
+	var (
+		flags          = FlagPresent | FlagRW | FlagNoExecute
+		hugePageFrames = pmm.Frame(HugePageSize2M >> mem.PageShift)
+		maxFrame       = pmm.Frame(PhysMapSize >> mem.PageShift)
+		err            *kernel.Error
+	)
+
+	if endFrame > maxFrame {
+		endFrame = maxFrame
+	}
+
+	for curFrame < endFrame {
+		page := PageFromAddress(PhysToVirt(curFrame.Address()))
+		if curFrame%hugePageFrames == 0 && endFrame-curFrame >= hugePageFrames && !overlapsKernelROSection(curFrame, curFrame+hugePageFrames) {
+			err = mapHugeFn(page, curFrame, HugePageSize2M, flags)
+			curFrame += hugePageFrames
+		} else {
+			err = mapFn(page, curFrame, flags)
+			curFrame++
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,241 @@
+package vmm
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/mem"
+	"gopheros/kernel/mem/pmm"
+	"testing"
+)
+
+func TestPhysToVirt(t *testing.T) {
+	specs := []struct {
+		physAddr uintptr
+		exp      uintptr
+	}{
+		{0, PhysMapBase},
+		{0xb8000, PhysMapBase + 0xb8000},
+		{0x12345678, PhysMapBase + 0x12345678},
+	}
+
+	for specIndex, spec := range specs {
+		if got := PhysToVirt(spec.physAddr); got != spec.exp {
+			t.Errorf("[spec %d] expected virtual address to be 0x%x; got 0x%x", specIndex, spec.exp, got)
+		}
+	}
+}
+
+func TestVirtToPhys(t *testing.T) {
+	defer func() {
+		translateFn = Translate
+	}()
+
+	expErr := &kernel.Error{Module: "test", Message: "not mapped"}
+	translateFn = func(virtAddr uintptr) (uintptr, *kernel.Error) {
+		if virtAddr == 0xbadf00d {
+			return 0, expErr
+		}
+		return 0x1000, nil
+	}
+
+	specs := []struct {
+		virtAddr uintptr
+		expAddr  uintptr
+		expErr   *kernel.Error
+	}{
+		{PhysMapBase, 0, nil},
+		{PhysMapBase + 0x12345678, 0x12345678, nil},
+		{PhysMapBase + uintptr(PhysMapSize) - 1, uintptr(PhysMapSize) - 1, nil},
+		// The following addresses are translated via the page tables
+		{PhysMapBase + uintptr(PhysMapSize), 0x1000, nil},
+		{PhysMapBase - 1, 0x1000, nil},
+		{0xbadf00d, 0, expErr},
+	}
+
+	for specIndex, spec := range specs {
+		got, err := VirtToPhys(spec.virtAddr)
+		if err != spec.expErr {
+			t.Errorf("[spec %d] expected error %v; got %v", specIndex, spec.expErr, err)
+			continue
+		}
+
+		if got != spec.expAddr {
+			t.Errorf("[spec %d] expected physical address to be 0x%x; got 0x%x", specIndex, spec.expAddr, got)
+		}
+	}
+}
+
+func TestSetupPhysMap(t *testing.T) {
+	defer func() {
+		mapFn = Map
+		mapHugeFn = MapHuge
+		memoryMapFn = pmm.MemoryMap
+	}()
+
+	memoryMapFn = func() []pmm.Region {
+		return []pmm.Region{
+			// Unaligned region; only frames 1 and 2 are fully contained in it
+			{PhysAddress: 0x800, Size: 0x2800, Type: pmm.RegionUsable},
+			{PhysAddress: 0xa0000, Size: 0x60000, Type: pmm.RegionReserved},
+			// 2M region preceded by a single 4K page
+			{PhysAddress: 0x1ff000, Size: HugePageSize2M + 0x1000, Type: pmm.RegionUsable},
+			{PhysAddress: 0x400000, Size: 0x1000, Type: pmm.RegionACPIReclaimable},
+			{PhysAddress: 0x401000, Size: 0x1000, Type: pmm.RegionACPINVS},
+			{PhysAddress: 0x402000, Size: 0x1000, Type: pmm.RegionBadRAM},
+			// Region beyond the physmap limit
+			{PhysAddress: uintptr(PhysMapSize), Size: 0x1000, Type: pmm.RegionUsable},
+		}
+	}
+
+	var (
+		mapped     []pmm.Frame
+		hugeMapped []pmm.Frame
+	)
+
+	mapFn = func(page Page, frame pmm.Frame, flags PageTableEntryFlag) *kernel.Error {
+		if exp := PageFromAddress(PhysToVirt(frame.Address())); page != exp {
+			t.Errorf("expected frame %d to be mapped to page 0x%x; got 0x%x", frame, exp, page)
+		}
+
+		if exp := FlagPresent | FlagRW | FlagNoExecute; flags != exp {
+			t.Errorf("expected mapping flags to be %d; got %d", exp, flags)
+		}
+
+		mapped = append(mapped, frame)
+		return nil
+	}
+
+	mapHugeFn = func(page Page, frame pmm.Frame, pageSize mem.Size, flags PageTableEntryFlag) *kernel.Error {
+		if exp := PageFromAddress(PhysToVirt(frame.Address())); page != exp {
+			t.Errorf("expected frame %d to be mapped to page 0x%x; got 0x%x", frame, exp, page)
+		}
+
+		if pageSize != HugePageSize2M {
+			t.Errorf("expected huge page size to be %d; got %d", HugePageSize2M, pageSize)
+		}
+
+		hugeMapped = append(hugeMapped, frame)
+		return nil
+	}
+
+	if err := setupPhysMap(); err != nil {
+		t.Fatal(err)
+	}
+
+	expMapped := []pmm.Frame{1, 2, 0x1ff, 0x400, 0x401}
+	if len(mapped) != len(expMapped) {
+		t.Fatalf("expected frames %v to be mapped; got %v", expMapped, mapped)
+	}
+	for i, frame := range expMapped {
+		if mapped[i] != frame {
+			t.Fatalf("expected frames %v to be mapped; got %v", expMapped, mapped)
+		}
+	}
+
+	if len(hugeMapped) != 1 || hugeMapped[0] != 0x200 {
+		t.Fatalf("expected frame 0x200 to be mapped using a huge page; got %v", hugeMapped)
+	}
+
+	t.Run("map errors", func(t *testing.T) {
+		expErr := &kernel.Error{Module: "test", Message: "map failed"}
+
+		mapFn = func(_ Page, _ pmm.Frame, _ PageTableEntryFlag) *kernel.Error {
+			return expErr
+		}
+		if err := setupPhysMap(); err != expErr {
+			t.Errorf("expected error %v; got %v", expErr, err)
+		}
+
+		mapFn = func(_ Page, _ pmm.Frame, _ PageTableEntryFlag) *kernel.Error {
+			return nil
+		}
+		mapHugeFn = func(_ Page, _ pmm.Frame, _ mem.Size, _ PageTableEntryFlag) *kernel.Error {
+			return expErr
+		}
+		if err := setupPhysMap(); err != expErr {
+			t.Errorf("expected error %v; got %v", expErr, err)
+		}
+	})
+}
+
+func TestExtendPhysMap(t *testing.T) {
+	defer func() {
+		mapFn = Map
+		mapHugeFn = MapHuge
+	}()
+
+	var mapped, hugeMapped []pmm.Frame
+	mapFn = func(_ Page, frame pmm.Frame, _ PageTableEntryFlag) *kernel.Error {
+		mapped = append(mapped, frame)
+		return nil
+	}
+	mapHugeFn = func(_ Page, frame pmm.Frame, _ mem.Size, _ PageTableEntryFlag) *kernel.Error {
+		hugeMapped = append(hugeMapped, frame)
+		return nil
+	}
+
+	if err := ExtendPhysMap(0x1ff000, HugePageSize2M+2*mem.PageSize); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(mapped) != 2 || mapped[0] != 0x1ff || mapped[1] != 0x400 {
+		t.Fatalf("expected frames 0x1ff and 0x400 to be mapped; got %v", mapped)
+	}
+
+	if len(hugeMapped) != 1 || hugeMapped[0] != 0x200 {
+		t.Fatalf("expected frame 0x200 to be mapped using a huge page; got %v", hugeMapped)
+	}
+
+	specs := []struct {
+		physAddr uintptr
+		size     mem.Size
+	}{
+		{0x1000, 0},
+		{0x1800, mem.PageSize},
+		{0x1000, mem.PageSize + 1},
+		{uintptr(PhysMapSize), mem.PageSize},
+		{^uintptr(mem.PageSize - 1), 2 * mem.PageSize},
+	}
+
+	for specIndex, spec := range specs {
+		if err := ExtendPhysMap(spec.physAddr, spec.size); err != errPhysMapInvalidRange {
+			t.Errorf("[spec %d] expected error %v; got %v", specIndex, errPhysMapInvalidRange, err)
+		}
+	}
+}
+
+func TestPhysMapKernelROSections(t *testing.T) {
+	defer func() {
+		mapFn = Map
+		mapHugeFn = MapHuge
+		kernelROSectionCount = 0
+	}()
+
+	var mapped, hugeMapped []pmm.Frame
+	mapFn = func(_ Page, frame pmm.Frame, _ PageTableEntryFlag) *kernel.Error {
+		mapped = append(mapped, frame)
+		return nil
+	}
+	mapHugeFn = func(_ Page, frame pmm.Frame, _ mem.Size, _ PageTableEntryFlag) *kernel.Error {
+		hugeMapped = append(hugeMapped, frame)
+		return nil
+	}
+
+	// The 2M block that contains a read-only kernel section must be
+	// mapped using regular pages
+	kernelROSectionCount = 0
+	if err := trackKernelROSection(Page(0x1234), pmm.Frame(0x3fe), 2, true); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ExtendPhysMap(0, 3*HugePageSize2M); err != nil {
+		t.Fatal(err)
+	}
+
+	if exp := int(HugePageSize2M >> mem.PageShift); len(mapped) != exp || mapped[0] != 0x200 {
+		t.Fatalf("expected %d regular page mappings starting at frame 0x200; got %d", exp, len(mapped))
+	}
+
+	if len(hugeMapped) != 2 || hugeMapped[0] != 0 || hugeMapped[1] != 0x400 {
+		t.Fatalf("expected frames 0x0 and 0x400 to be mapped using huge pages; got %v", hugeMapped)
+	}
+}
@@ -0,0 +1,116 @@
+package vmm
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/mem"
+	"gopheros/kernel/mem/pmm"
+)
+
+// maxKernelROSections defines the max number of read-only kernel image
+// sections that can be tracked by the vmm.
+const maxKernelROSections = 16
+
+var (
+	// kernelROSections is a statically allocated array that tracks the
+	// read-only sections (e.g. .text and .rodata) of the kernel image as
+	// reported by the multiboot ELF section list. It is populated by
+	// setupPDTForKernel.
+	kernelROSections     [maxKernelROSections]kernelSection
+	kernelROSectionCount int
+
+	errTooManyKernelSections = &kernel.Error{Module: "vmm", Message: "max number of read-only kernel sections reached"}
+)
+
+// kernelSection describes a read-only section of the kernel image.
+type kernelSection struct {
+	page       Page
+	frame      pmm.Frame
+	pageCount  uint32
+	executable bool
+}
+
+// trackKernelROSection records a read-only kernel image section so its
+// mappings can be updated by ProtectKernelImage and UnprotectKernelImage.
+func trackKernelROSection(page Page, frame pmm.Frame, pageCount uint32, executable bool) *kernel.Error {
+	if kernelROSectionCount == maxKernelROSections {
+		return errTooManyKernelSections
+	}
+
+	kernelROSections[kernelROSectionCount] = kernelSection{
+		page:       page,
+		frame:      frame,
+		pageCount:  pageCount,
+		executable: executable,
+	}
+	kernelROSectionCount++
+	return nil
+}
+
+// overlapsKernelROSection returns true if any frame in the [startFrame,
+// endFrame) range belongs to a read-only kernel section.
+func overlapsKernelROSection(startFrame, endFrame pmm.Frame) bool {
+	for index := 0; index < kernelROSectionCount; index++ {
+		sec := &kernelROSections[index]
+		if startFrame < sec.frame+pmm.Frame(sec.pageCount) && sec.frame < endFrame {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ProtectKernelImage write-protects the pages that contain the read-only
+// sections of the kernel image. Code sections are mapped as read-only and
+// executable while the remaining sections are mapped as read-only and
+// non-executable. The aliases of these pages in the physmap are also mapped
+// as read-only.
+//
+// ProtectKernelImage is invoked once the kernel has completed its early
+// initialization. Code that needs to legitimately patch the kernel image can
+// temporarily lift the protection using UnprotectKernelImage and restore it
+// with a call to ProtectKernelImage once done.
+func ProtectKernelImage() *kernel.Error {
+	return setKernelImageProtection(FlagPresent)
+}
+
+// UnprotectKernelImage makes the pages that contain the read-only sections
+// of the kernel image writable. Code sections remain executable. Callers must
+// invoke ProtectKernelImage once they finish patching the kernel image.
+func UnprotectKernelImage() *kernel.Error {
+	return setKernelImageProtection(FlagPresent | FlagRW)
+}
+
+// setKernelImageProtection remaps the pages of each tracked read-only kernel
+// section and their physmap aliases using the supplied flags.
+func setKernelImageProtection(flags PageTableEntryFlag) *kernel.Error {
+	var (
+		sec        *kernelSection
+		page       Page
+		frame      pmm.Frame
+		physMapEnd = pmm.Frame(PhysMapSize >> mem.PageShift)
+		err        *kernel.Error
+	)
+
+	for index := 0; index < kernelROSectionCount; index++ {
+		sec = &kernelROSections[index]
+		for pageIndex := uint32(0); pageIndex < sec.pageCount; pageIndex++ {
+			page, frame = sec.page+Page(pageIndex), sec.frame+pmm.Frame(pageIndex)
+
+			if sec.executable {
+				err = mapExecutableFn(page, frame, flags)
+			} else {
+				err = mapFn(page, frame, flags)
+			}
+
+			if err == nil && frame < physMapEnd {
+				err = mapFn(PageFromAddress(PhysToVirt(frame.Address())), frame, flags)
+			}
+
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
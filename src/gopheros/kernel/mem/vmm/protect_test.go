@@ -0,0 +1,142 @@
+package vmm
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/mem"
+	"gopheros/kernel/mem/pmm"
+	"testing"
+)
+
+func TestTrackKernelROSection(t *testing.T) {
+	defer func() {
+		kernelROSectionCount = 0
+	}()
+
+	kernelROSectionCount = 0
+	for index := 0; index < maxKernelROSections; index++ {
+		if err := trackKernelROSection(Page(index), pmm.Frame(index), 1, false); err != nil {
+			t.Fatalf("[section %d] unexpected error: %v", index, err)
+		}
+	}
+
+	if err := trackKernelROSection(Page(0), pmm.Frame(0), 1, false); err != errTooManyKernelSections {
+		t.Fatalf("expected error %v; got %v", errTooManyKernelSections, err)
+	}
+}
+
+func TestOverlapsKernelROSection(t *testing.T) {
+	defer func() {
+		kernelROSectionCount = 0
+	}()
+
+	kernelROSectionCount = 0
+	if err := trackKernelROSection(Page(0), pmm.Frame(10), 4, false); err != nil {
+		t.Fatal(err)
+	}
+
+	specs := []struct {
+		startFrame, endFrame pmm.Frame
+		exp                  bool
+	}{
+		{0, 10, false},
+		{0, 11, true},
+		{12, 13, true},
+		{13, 20, true},
+		{14, 20, false},
+	}
+
+	for specIndex, spec := range specs {
+		if got := overlapsKernelROSection(spec.startFrame, spec.endFrame); got != spec.exp {
+			t.Errorf("[spec %d] expected overlapsKernelROSection(%d, %d) to return %t; got %t", specIndex, spec.startFrame, spec.endFrame, spec.exp, got)
+		}
+	}
+}
+
+func TestProtectKernelImage(t *testing.T) {
+	defer func() {
+		mapFn = Map
+		mapExecutableFn = MapExecutable
+		kernelROSectionCount = 0
+	}()
+
+	type mapping struct {
+		page       Page
+		frame      pmm.Frame
+		flags      PageTableEntryFlag
+		executable bool
+	}
+
+	var mappings []mapping
+	mapFn = func(page Page, frame pmm.Frame, flags PageTableEntryFlag) *kernel.Error {
+		mappings = append(mappings, mapping{page, frame, flags, false})
+		return nil
+	}
+	mapExecutableFn = func(page Page, frame pmm.Frame, flags PageTableEntryFlag) *kernel.Error {
+		mappings = append(mappings, mapping{page, frame, flags, true})
+		return nil
+	}
+
+	kernelROSectionCount = 0
+	textPage := PageFromAddress(0xffffffff80100000)
+	if err := trackKernelROSection(textPage, pmm.Frame(0x100), 2, true); err != nil {
+		t.Fatal(err)
+	}
+	// Frames beyond the physmap limit do not have a physmap alias
+	rodataPage := PageFromAddress(0xffffffff80200000)
+	beyondPhysMap := pmm.Frame(PhysMapSize >> mem.PageShift)
+	if err := trackKernelROSection(rodataPage, beyondPhysMap, 1, false); err != nil {
+		t.Fatal(err)
+	}
+
+	physMapPage := func(frame pmm.Frame) Page {
+		return PageFromAddress(PhysToVirt(frame.Address()))
+	}
+
+	specs := []struct {
+		fn       func() *kernel.Error
+		expFlags PageTableEntryFlag
+	}{
+		{ProtectKernelImage, FlagPresent},
+		{UnprotectKernelImage, FlagPresent | FlagRW},
+	}
+
+	for specIndex, spec := range specs {
+		mappings = mappings[:0]
+		if err := spec.fn(); err != nil {
+			t.Fatalf("[spec %d] unexpected error: %v", specIndex, err)
+		}
+
+		expMappings := []mapping{
+			{textPage, 0x100, spec.expFlags, true},
+			{physMapPage(0x100), 0x100, spec.expFlags, false},
+			{textPage + 1, 0x101, spec.expFlags, true},
+			{physMapPage(0x101), 0x101, spec.expFlags, false},
+			{rodataPage, beyondPhysMap, spec.expFlags, false},
+		}
+
+		if len(mappings) != len(expMappings) {
+			t.Fatalf("[spec %d] expected mappings to be:\n%v\ngot:\n%v", specIndex, expMappings, mappings)
+		}
+
+		for index, exp := range expMappings {
+			if mappings[index] != exp {
+				t.Fatalf("[spec %d] expected mapping %d to be %v; got %v", specIndex, index, exp, mappings[index])
+			}
+		}
+	}
+
+	t.Run("map fails", func(t *testing.T) {
+		expErr := &kernel.Error{Module: "test", Message: "map failed"}
+
+		mapExecutableFn = func(_ Page, _ pmm.Frame, _ PageTableEntryFlag) *kernel.Error { return expErr }
+		if err := ProtectKernelImage(); err != expErr {
+			t.Errorf("expected error %v; got %v", expErr, err)
+		}
+
+		mapExecutableFn = func(_ Page, _ pmm.Frame, _ PageTableEntryFlag) *kernel.Error { return nil }
+		mapFn = func(_ Page, _ pmm.Frame, _ PageTableEntryFlag) *kernel.Error { return expErr }
+		if err := ProtectKernelImage(); err != expErr {
+			t.Errorf("expected error %v; got %v", expErr, err)
+		}
+	})
+}
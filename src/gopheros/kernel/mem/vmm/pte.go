@@ -50,13 +50,14 @@ func (pte *pageTableEntry) SetFrame(frame pmm.Frame) {
 }
 
 // pteForAddress returns the final page table entry that correspond to a
-// particular virtual address. The function performs a page table walk till it
-// reaches the final page table entry returning ErrInvalidMapping if the page
-// is not present.
-func pteForAddress(virtAddr uintptr) (*pageTableEntry, *kernel.Error) {
+// particular virtual address together with its page level. The function
+// performs a page table walk till it reaches the final page table entry or a
+// huge page entry returning ErrInvalidMapping if the page is not present.
+func pteForAddress(virtAddr uintptr) (*pageTableEntry, uint8, *kernel.Error) {
 	var (
 		err   *kernel.Error
 		entry *pageTableEntry
+		level uint8
 	)
 
 	walk(virtAddr, func(pteLevel uint8, pte *pageTableEntry) bool {
@@ -66,9 +67,9 @@ func pteForAddress(virtAddr uintptr) (*pageTableEntry, *kernel.Error) {
 			return false
 		}
 
-		entry = pte
-		return true
+		entry, level = pte, pteLevel
+		return pteLevel < minHugePageLevel || !pte.HasFlags(FlagHugePage)
 	})
 
-	return entry, err
+	return entry, level, err
 }
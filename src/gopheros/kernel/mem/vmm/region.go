@@ -0,0 +1,481 @@
+package vmm
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/mem"
+)
+
+// maxRegions defines the max number of regions that can be tracked by each
+// address space.
+const maxRegions = 64
+
+var (
+	// activeAddrSpace points to the address space that was last activated.
+	// It is used by the page fault handler to locate the regions for
+	// faults in the user half of the address space.
+	activeAddrSpace *AddressSpace
+
+	errInvalidRegion      = &kernel.Error{Module: "vmm", Message: "region address and size must be page-aligned and non-zero"}
+	errInvalidProtection  = &kernel.Error{Module: "vmm", Message: "invalid region protection flags"}
+	errRegionOverlap      = &kernel.Error{Module: "vmm", Message: "region overlaps an existing region"}
+	errRegionNotMapped    = &kernel.Error{Module: "vmm", Message: "range is not fully covered by mapped regions"}
+	errTooManyRegions     = &kernel.Error{Module: "vmm", Message: "max number of regions reached"}
+	errNoRegionSpace      = &kernel.Error{Module: "vmm", Message: "no free address range large enough for region"}
+	errAddrSpaceNotActive = &kernel.Error{Module: "vmm", Message: "the page tables of inactive address spaces cannot be modified"}
+)
+
+// Protection describes the type of accesses that are allowed to the pages
+// of a region.
+type Protection uint8
+
+const (
+	// ProtRead allows the pages of a region to be read.
+	ProtRead Protection = 1 << iota
+
+	// ProtWrite allows the pages of a region to be written to. As the
+	// MMU cannot express write-only mappings, ProtWrite implies ProtRead.
+	ProtWrite
+
+	// ProtExec allows the CPU to execute code from the pages of a region.
+	ProtExec
+
+	// ProtNone reserves a region whose pages cannot be accessed.
+	ProtNone Protection = 0
+
+	protMask = ProtRead | ProtWrite | ProtExec
+)
+
+// pageFlags returns the page table entry flags for mapping a page at the
+// supplied address with this protection.
+func (prot Protection) pageFlags(addr uintptr) PageTableEntryFlag {
+	flags := FlagPresent
+	if prot&ProtWrite != 0 {
+		flags |= FlagRW
+	}
+
+	if prot&ProtExec == 0 {
+		flags |= FlagNoExecute
+	}
+
+	if addr < userSpaceEnd {
+		flags |= FlagUserAccessible
+	}
+
+	return flags
+}
+
+// Region describes a contiguous range of virtual addresses that is backed by
+// anonymous memory. The pages of a region are allocated and cleared when
+// they are first accessed.
+type Region struct {
+	// The [Start, End) range of virtual addresses covered by the region.
+	Start, End uintptr
+
+	// The accesses that are allowed to the pages of the region.
+	Prot Protection
+}
+
+// Size returns the size of the region.
+func (r Region) Size() mem.Size {
+	return mem.Size(r.End - r.Start)
+}
+
+// regionList is a statically allocated list of non-overlapping regions that
+// is sorted by start address.
+type regionList struct {
+	regions [maxRegions]Region
+	count   int
+}
+
+// find returns the index of the region that contains addr or -1 if no such
+// region exists.
+func (l *regionList) find(addr uintptr) int {
+	for index := 0; index < l.count; index++ {
+		if addr >= l.regions[index].Start && addr < l.regions[index].End {
+			return index
+		}
+	}
+
+	return -1
+}
+
+// insert adds a region that does not overlap any existing region to the list.
+func (l *regionList) insert(r Region) *kernel.Error {
+	if l.count == maxRegions {
+		return errTooManyRegions
+	}
+
+	index := l.count
+	for index > 0 && l.regions[index-1].Start > r.Start {
+		index--
+	}
+
+	copy(l.regions[index+1:l.count+1], l.regions[index:l.count])
+	l.regions[index] = r
+	l.count++
+	return nil
+}
+
+// remove deletes the region with the supplied index from the list.
+func (l *regionList) remove(index int) {
+	copy(l.regions[index:l.count-1], l.regions[index+1:l.count])
+	l.count--
+}
+
+// split ensures that addr is not contained in the middle of a region by
+// splitting any region that spans it in two.
+func (l *regionList) split(addr uintptr) *kernel.Error {
+	index := l.find(addr)
+	if index < 0 || l.regions[index].Start == addr {
+		return nil
+	}
+
+	upper := l.regions[index]
+	upper.Start = addr
+	if err := l.insert(upper); err != nil {
+		return err
+	}
+
+	l.regions[index].End = addr
+	return nil
+}
+
+// coalesce merges adjacent regions that use the same protection.
+func (l *regionList) coalesce() {
+	for index := 1; index < l.count; {
+		prev, cur := &l.regions[index-1], &l.regions[index]
+		if prev.End != cur.Start || prev.Prot != cur.Prot {
+			index++
+			continue
+		}
+
+		prev.End = cur.End
+		l.remove(index)
+	}
+}
+
+// overlaps returns true if any region overlaps the [start, end) range.
+func (l *regionList) overlaps(start, end uintptr) bool {
+	for index := 0; index < l.count; index++ {
+		if start < l.regions[index].End && l.regions[index].Start < end {
+			return true
+		}
+	}
+
+	return false
+}
+
+// covers returns true if the [start, end) range is fully covered by regions.
+func (l *regionList) covers(start, end uintptr) bool {
+	for addr := start; addr < end; {
+		index := l.find(addr)
+		if index < 0 {
+			return false
+		}
+
+		addr = l.regions[index].End
+	}
+
+	return true
+}
+
+// findGap returns the lowest page-aligned address in the user half of the
+// address space that can accommodate a region with the supplied size or 0 if
+// no such address exists.
+func (l *regionList) findGap(size uintptr) uintptr {
+	if size > userSpaceEnd-anonMinAddr {
+		return 0
+	}
+
+	start := anonMinAddr
+	for index := 0; index < l.count && start < userSpaceEnd; index++ {
+		if l.regions[index].End <= start {
+			continue
+		}
+
+		if l.regions[index].Start >= start+size {
+			break
+		}
+
+		start = l.regions[index].End
+	}
+
+	if start >= userSpaceEnd || userSpaceEnd-start < size {
+		return 0
+	}
+
+	return start
+}
+
+// regionRange validates the supplied address and size and returns the end of
+// the range that they describe.
+func regionRange(addr uintptr, size mem.Size) (uintptr, *kernel.Error) {
+	end := addr + uintptr(size)
+	switch {
+	case size == 0 || addr&uintptr(mem.PageSize-1) != 0 || size&(mem.PageSize-1) != 0:
+		return 0, errInvalidRegion
+	case end < addr || (addr < userSpaceEnd && end > userSpaceEnd):
+		return 0, errInvalidRegion
+	}
+
+	return end, nil
+}
+
+// MapAnonymous creates a region of anonymous memory with the requested size
+// and protection in this address space and returns its address. No physical
+// memory is allocated for the region. Instead, the first access to any of its
+// pages triggers a page fault which is handled by mapping a zeroed frame in
+// place. Accesses that are not allowed by the region protection are not
+// serviced.
+//
+// If addr is 0, the region is placed at the lowest free address in the user
+// half of the address space. Otherwise, addr must be page-aligned and the
+// region must not overlap any existing region. The size is always rounded up
+// to the nearest page boundary. Adjacent regions with the same protection are
+// merged.
+func (as *AddressSpace) MapAnonymous(addr uintptr, size mem.Size, prot Protection) (uintptr, *kernel.Error) {
+	if prot&^protMask != 0 {
+		return 0, errInvalidProtection
+	}
+
+	size = (size + (mem.PageSize - 1)) & ^(mem.PageSize - 1)
+	if addr == 0 && size != 0 {
+		if addr = as.regions.findGap(uintptr(size)); addr == 0 {
+			return 0, errNoRegionSpace
+		}
+	}
+
+	end, err := regionRange(addr, size)
+	if err != nil {
+		return 0, err
+	}
+
+	if as.regions.overlaps(addr, end) {
+		return 0, errRegionOverlap
+	}
+
+	if err = as.regions.insert(Region{Start: addr, End: end, Prot: prot}); err != nil {
+		return 0, err
+	}
+
+	as.regions.coalesce()
+	return addr, nil
+}
+
+// UnmapAnonymous removes the [addr, addr+size) range from the regions of this
+// address space and releases any physical frames that back it. Regions that
+// partially overlap the range are split. Parts of the range that are not
+// covered by a region are ignored.
+//
+// Regions in the user half of the address space can only be unmapped while
+// the address space is active.
+func (as *AddressSpace) UnmapAnonymous(addr uintptr, size mem.Size) *kernel.Error {
+	end, err := as.prepareRange(addr, size)
+	if err != nil {
+		return err
+	}
+
+	for index := 0; index < as.regions.count; {
+		r := as.regions.regions[index]
+		if r.Start < addr || r.End > end {
+			index++
+			continue
+		}
+
+		as.regions.remove(index)
+		if err = releaseRegionPages(r.Start, r.End); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Protect changes the protection of the [addr, addr+size) range which must be
+// fully covered by the regions of this address space. Regions that partially
+// overlap the range are split and the permissions of any pages that are
+// already mapped are updated. Pages marked as copy-on-write remain read-only
+// until they get written to; writes to them are only serviced while the
+// region protection includes ProtWrite.
+//
+// Regions in the user half of the address space can only be protected while
+// the address space is active.
+func (as *AddressSpace) Protect(addr uintptr, size mem.Size, prot Protection) *kernel.Error {
+	if prot == ProtNone || prot&^protMask != 0 {
+		return errInvalidProtection
+	}
+
+	end, err := regionRange(addr, size)
+	if err != nil {
+		return err
+	}
+
+	if !as.regions.covers(addr, end) {
+		return errRegionNotMapped
+	}
+
+	if _, err = as.prepareRange(addr, size); err != nil {
+		return err
+	}
+
+	for index := 0; index < as.regions.count; index++ {
+		if r := &as.regions.regions[index]; r.Start >= addr && r.End <= end {
+			r.Prot = prot
+		}
+	}
+	as.regions.coalesce()
+
+	for pageAddr := addr; pageAddr < end; pageAddr += uintptr(mem.PageSize) {
+		pte, _, err := pteForAddress(pageAddr)
+		if err != nil {
+			continue
+		}
+
+		flags := prot.pageFlags(pageAddr)
+		if pte.HasFlags(FlagCopyOnWrite) {
+			flags &^= FlagRW
+		}
+
+		pte.ClearFlags(FlagRW | FlagNoExecute | FlagUserAccessible)
+		pte.SetFlags(flags)
+		shootdownPage(pageAddr)
+	}
+
+	return nil
+}
+
+// FindRegion returns the region of this address space that contains addr. The
+// second return value is false if no region contains addr.
+func (as *AddressSpace) FindRegion(addr uintptr) (Region, bool) {
+	index := as.regions.find(addr)
+	if index < 0 {
+		return Region{}, false
+	}
+
+	return as.regions.regions[index], true
+}
+
+// prepareRange validates the supplied range, ensures that the page tables that
+// map it can be modified and splits any regions that partially overlap it.
+func (as *AddressSpace) prepareRange(addr uintptr, size mem.Size) (uintptr, *kernel.Error) {
+	end, err := regionRange(addr, size)
+	if err != nil {
+		return 0, err
+	}
+
+	// The page tables for the kernel half are shared by all address
+	// spaces and can always be modified via the active one.
+	if addr < userSpaceEnd && !as.IsActive() {
+		return 0, errAddrSpaceNotActive
+	}
+
+	if err = as.regions.split(addr); err == nil {
+		err = as.regions.split(end)
+	}
+
+	if err != nil {
+		as.regions.coalesce()
+		return 0, err
+	}
+
+	return end, nil
+}
+
+// releaseRegionPages unmaps any mapped pages in the [start, end) range and
+// drops the references to the frames that back them.
+func releaseRegionPages(start, end uintptr) *kernel.Error {
+	for pageAddr := start; pageAddr < end; pageAddr += uintptr(mem.PageSize) {
+		pte, _, err := pteForAddress(pageAddr)
+		if err != nil {
+			continue
+		}
+
+		frame := pte.Frame()
+		if err = unmapFn(PageFromAddress(pageAddr)); err != nil {
+			return err
+		}
+
+		if frame != ReservedZeroedFrame && frameReleaseFn != nil {
+			if err = frameReleaseFn(frame); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// addrSpaceForFault returns the address space whose regions should be used
+// for servicing a page fault at the supplied address.
+func addrSpaceForFault(faultAddr uintptr) *AddressSpace {
+	if faultAddr >= userSpaceEnd {
+		return &kernelAddrSpace
+	}
+
+	return activeAddrSpace
+}
+
+// regionAllowsWrite returns false if faultAddr belongs to a region whose
+// protection does not allow writes. Protect leaves the copy-on-write flag of
+// shared pages intact so the page fault handler must check the region
+// protection before resolving a write to such a page. Addresses outside of
+// any region are not restricted.
+func regionAllowsWrite(faultAddr uintptr) bool {
+	as := addrSpaceForFault(faultAddr)
+	if as == nil {
+		return true
+	}
+
+	r, ok := as.FindRegion(faultAddr)
+	return !ok || r.Prot&ProtWrite != 0
+}
+
+// handleRegionFault services a page fault caused by accessing a non-present
+// page that belongs to one of the regions of this address space by mapping a
+// zeroed frame in place. It returns false if the fault address does not
+// belong to a region or the access is not allowed by the region protection.
+func (as *AddressSpace) handleRegionFault(faultAddr uintptr, errorCode uint64) (bool, *kernel.Error) {
+	index := as.regions.find(faultAddr)
+	if index < 0 {
+		return false, nil
+	}
+
+	// Bit 1 of the error code is set for writes and bit 4 is set for
+	// instruction fetches.
+	prot := as.regions.regions[index].Prot
+	switch {
+	case prot == ProtNone,
+		errorCode&(1<<1) != 0 && prot&ProtWrite == 0,
+		errorCode&(1<<4) != 0 && prot&ProtExec == 0:
+		return false, nil
+	}
+
+	frame, err := frameAllocator()
+	if err != nil {
+		return true, err
+	}
+
+	tmpPage, err := mapTemporaryFn(frame)
+	if err != nil {
+		return true, err
+	}
+	mem.Memset(tmpPage.Address(), 0, mem.PageSize)
+	_ = unmapFn(tmpPage)
+
+	var (
+		page  = PageFromAddress(faultAddr)
+		flags = prot.pageFlags(faultAddr)
+	)
+
+	if prot&ProtExec != 0 {
+		err = mapExecutableFn(page, frame, flags)
+	} else {
+		err = mapFn(page, frame, flags)
+	}
+
+	if err != nil && frameReleaseFn != nil {
+		_ = frameReleaseFn(frame)
+	}
+
+	return true, err
+}
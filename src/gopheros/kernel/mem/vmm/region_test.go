@@ -0,0 +1,721 @@
+package vmm
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/irq"
+	"gopheros/kernel/mem"
+	"gopheros/kernel/mem/pmm"
+	"reflect"
+	"runtime"
+	"testing"
+	"unsafe"
+)
+
+// regionTestPage is used as the target of temporary mappings by the region
+// fault tests. It is not allocated on the stack as the stack may be moved
+// while the tests access the page via its address.
+var regionTestPage [2 * mem.PageSize]byte
+
+var origPtePtrFn = ptePtrFn
+
+func TestMapAnonymous(t *testing.T) {
+	var (
+		as       AddressSpace
+		pageSize = uintptr(mem.PageSize)
+	)
+
+	addr, err := as.MapAnonymous(0, mem.PageSize+1, ProtRead|ProtWrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if addr != anonMinAddr {
+		t.Fatalf("expected region to be placed at 0x%x; got 0x%x", anonMinAddr, addr)
+	}
+
+	// Adjacent regions with the same protection are merged
+	if addr, err = as.MapAnonymous(0, mem.PageSize, ProtRead|ProtWrite); err != nil {
+		t.Fatal(err)
+	} else if exp := anonMinAddr + 2*pageSize; addr != exp {
+		t.Fatalf("expected region to be placed at 0x%x; got 0x%x", exp, addr)
+	}
+
+	if _, err = as.MapAnonymous(anonMinAddr+4*pageSize, mem.PageSize, ProtRead); err != nil {
+		t.Fatal(err)
+	}
+
+	// The gap between the two regions should be used if possible
+	if addr, err = as.MapAnonymous(0, mem.PageSize, ProtNone); err != nil {
+		t.Fatal(err)
+	} else if exp := anonMinAddr + 3*pageSize; addr != exp {
+		t.Fatalf("expected region to be placed at 0x%x; got 0x%x", exp, addr)
+	}
+
+	// Regions in the kernel half can only be created at fixed addresses
+	kernelAddr := uintptr(0xffff900000000000)
+	if _, err = as.MapAnonymous(kernelAddr, mem.PageSize, ProtRead|ProtWrite|ProtExec); err != nil {
+		t.Fatal(err)
+	}
+
+	expRegions := []Region{
+		{anonMinAddr, anonMinAddr + 3*pageSize, ProtRead | ProtWrite},
+		{anonMinAddr + 3*pageSize, anonMinAddr + 4*pageSize, ProtNone},
+		{anonMinAddr + 4*pageSize, anonMinAddr + 5*pageSize, ProtRead},
+		{kernelAddr, kernelAddr + pageSize, ProtRead | ProtWrite | ProtExec},
+	}
+	if got := as.regions.regions[:as.regions.count]; !reflect.DeepEqual(got, expRegions) {
+		t.Fatalf("expected regions to be:\n%v\ngot:\n%v", expRegions, got)
+	}
+
+	if r, ok := as.FindRegion(anonMinAddr + pageSize + 42); !ok || r != expRegions[0] || r.Size() != 3*mem.PageSize {
+		t.Fatalf("expected FindRegion to return %v; got %v, %t", expRegions[0], r, ok)
+	}
+
+	if _, ok := as.FindRegion(anonMinAddr - 1); ok {
+		t.Fatal("expected FindRegion to return false for an address outside any region")
+	}
+}
+
+func TestMapAnonymousErrors(t *testing.T) {
+	var as AddressSpace
+
+	if _, err := as.MapAnonymous(anonMinAddr, 2*mem.PageSize, ProtRead); err != nil {
+		t.Fatal(err)
+	}
+
+	specs := []struct {
+		addr   uintptr
+		size   mem.Size
+		prot   Protection
+		expErr *kernel.Error
+	}{
+		{0, mem.PageSize, 0x80, errInvalidProtection},
+		{0, 0, ProtRead, errInvalidRegion},
+		{anonMinAddr + 1, mem.PageSize, ProtRead, errInvalidRegion},
+		{userSpaceEnd - uintptr(mem.PageSize), 2 * mem.PageSize, ProtRead, errInvalidRegion},
+		{^uintptr(mem.PageSize - 1), 2 * mem.PageSize, ProtRead, errInvalidRegion},
+		{anonMinAddr + uintptr(mem.PageSize), mem.PageSize, ProtRead, errRegionOverlap},
+		{0, mem.Size(userSpaceEnd), ProtRead, errNoRegionSpace},
+		{0, mem.Size(userSpaceEnd - anonMinAddr - uintptr(mem.PageSize)), ProtRead, errNoRegionSpace},
+	}
+
+	for specIndex, spec := range specs {
+		if _, err := as.MapAnonymous(spec.addr, spec.size, spec.prot); err != spec.expErr {
+			t.Errorf("[spec %d] expected error %v; got %v", specIndex, spec.expErr, err)
+		}
+	}
+
+	as.regions.count = maxRegions
+	if _, err := as.MapAnonymous(0, mem.PageSize, ProtRead); err != errTooManyRegions {
+		t.Fatalf("expected error %v; got %v", errTooManyRegions, err)
+	}
+}
+
+func TestProtect(t *testing.T) {
+	if runtime.GOARCH != "amd64" {
+		t.Skip("test requires amd64 runtime; skipping")
+	}
+
+	defer resetRegionMocks()
+	leaves := mockRegionPageTables()
+
+	var (
+		as       AddressSpace
+		pageSize = uintptr(mem.PageSize)
+		start    = anonMinAddr
+	)
+
+	if _, err := as.MapAnonymous(start, 4*mem.PageSize, ProtRead|ProtWrite); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first page is mapped and writable while the second one is
+	// shared using copy-on-write
+	*leafPTE(leaves, start) = pageTableEntry(0xa000) | pageTableEntry(FlagPresent|FlagRW|FlagUserAccessible|FlagNoExecute)
+	*leafPTE(leaves, start+pageSize) = pageTableEntry(0xb000) | pageTableEntry(FlagPresent|FlagUserAccessible|FlagNoExecute|FlagCopyOnWrite)
+
+	if err := as.Protect(start, 2*mem.PageSize, ProtRead|ProtExec); err != nil {
+		t.Fatal(err)
+	}
+
+	expRegions := []Region{
+		{start, start + 2*pageSize, ProtRead | ProtExec},
+		{start + 2*pageSize, start + 4*pageSize, ProtRead | ProtWrite},
+	}
+	if got := as.regions.regions[:as.regions.count]; !reflect.DeepEqual(got, expRegions) {
+		t.Fatalf("expected regions to be:\n%v\ngot:\n%v", expRegions, got)
+	}
+
+	specs := []struct {
+		addr     uintptr
+		expEntry pageTableEntry
+	}{
+		{start, pageTableEntry(0xa000) | pageTableEntry(FlagPresent|FlagUserAccessible)},
+		{start + pageSize, pageTableEntry(0xb000) | pageTableEntry(FlagPresent|FlagUserAccessible|FlagCopyOnWrite)},
+	}
+	for specIndex, spec := range specs {
+		if got := *leafPTE(leaves, spec.addr); got != spec.expEntry {
+			t.Errorf("[spec %d] expected page table entry to be 0x%x; got 0x%x", specIndex, spec.expEntry, got)
+		}
+	}
+
+	// Restoring the original protection should merge the regions back
+	// but copy-on-write pages must remain read-only. Pages that have not
+	// been mapped yet are skipped.
+	if err := as.Protect(start, 3*mem.PageSize, ProtRead|ProtWrite); err != nil {
+		t.Fatal(err)
+	}
+
+	expRegions = []Region{
+		{start, start + 4*pageSize, ProtRead | ProtWrite},
+	}
+	if got := as.regions.regions[:as.regions.count]; !reflect.DeepEqual(got, expRegions) {
+		t.Fatalf("expected regions to be:\n%v\ngot:\n%v", expRegions, got)
+	}
+
+	specs[0].expEntry = pageTableEntry(0xa000) | pageTableEntry(FlagPresent|FlagRW|FlagUserAccessible|FlagNoExecute)
+	specs[1].expEntry = pageTableEntry(0xb000) | pageTableEntry(FlagPresent|FlagUserAccessible|FlagNoExecute|FlagCopyOnWrite)
+	for specIndex, spec := range specs {
+		if got := *leafPTE(leaves, spec.addr); got != spec.expEntry {
+			t.Errorf("[spec %d] expected page table entry to be 0x%x; got 0x%x", specIndex, spec.expEntry, got)
+		}
+	}
+}
+
+func TestProtectErrors(t *testing.T) {
+	defer resetRegionMocks()
+	mockRegionPageTables()
+
+	var as AddressSpace
+	if _, err := as.MapAnonymous(anonMinAddr, mem.PageSize, ProtRead); err != nil {
+		t.Fatal(err)
+	}
+
+	specs := []struct {
+		addr   uintptr
+		size   mem.Size
+		prot   Protection
+		expErr *kernel.Error
+	}{
+		{anonMinAddr, mem.PageSize, ProtNone, errInvalidProtection},
+		{anonMinAddr, mem.PageSize, 0x80, errInvalidProtection},
+		{anonMinAddr, mem.PageSize + 1, ProtRead, errInvalidRegion},
+		{anonMinAddr, 2 * mem.PageSize, ProtRead, errRegionNotMapped},
+	}
+
+	for specIndex, spec := range specs {
+		if err := as.Protect(spec.addr, spec.size, spec.prot); err != spec.expErr {
+			t.Errorf("[spec %d] expected error %v; got %v", specIndex, spec.expErr, err)
+		}
+	}
+
+	activePDTFn = func() uintptr { return 0xbadf00d000 }
+	if err := as.Protect(anonMinAddr, mem.PageSize, ProtRead|ProtWrite); err != errAddrSpaceNotActive {
+		t.Fatalf("expected error %v; got %v", errAddrSpaceNotActive, err)
+	}
+}
+
+func TestUnmapAnonymous(t *testing.T) {
+	if runtime.GOARCH != "amd64" {
+		t.Skip("test requires amd64 runtime; skipping")
+	}
+
+	defer resetRegionMocks()
+	leaves := mockRegionPageTables()
+
+	var (
+		as       AddressSpace
+		pageSize = uintptr(mem.PageSize)
+		start    = anonMinAddr
+		unmapped []Page
+		released []pmm.Frame
+	)
+
+	unmapFn = func(page Page) *kernel.Error {
+		unmapped = append(unmapped, page)
+		return nil
+	}
+	SetFrameRefCounter(nil, func(frame pmm.Frame) *kernel.Error {
+		released = append(released, frame)
+		return nil
+	}, nil)
+
+	if _, err := as.MapAnonymous(start, 4*mem.PageSize, ProtRead|ProtWrite); err != nil {
+		t.Fatal(err)
+	}
+
+	*leafPTE(leaves, start) = pageTableEntry(0xa000) | pageTableEntry(FlagPresent|FlagRW)
+	*leafPTE(leaves, start+pageSize) = pageTableEntry(0xb000) | pageTableEntry(FlagPresent|FlagRW)
+	*leafPTE(leaves, start+2*pageSize) = pageTableEntry(ReservedZeroedFrame.Address()) | pageTableEntry(FlagPresent|FlagCopyOnWrite)
+
+	// Unmapping a range that extends past the region should only affect
+	// the pages that belong to the region
+	if err := as.UnmapAnonymous(start+pageSize, 8*mem.PageSize); err != nil {
+		t.Fatal(err)
+	}
+
+	expRegions := []Region{
+		{start, start + pageSize, ProtRead | ProtWrite},
+	}
+	if got := as.regions.regions[:as.regions.count]; !reflect.DeepEqual(got, expRegions) {
+		t.Fatalf("expected regions to be:\n%v\ngot:\n%v", expRegions, got)
+	}
+
+	if exp := []Page{PageFromAddress(start + pageSize), PageFromAddress(start + 2*pageSize)}; !reflect.DeepEqual(unmapped, exp) {
+		t.Fatalf("expected pages %v to be unmapped; got %v", exp, unmapped)
+	}
+
+	// The reserved zeroed frame is never released
+	if exp := []pmm.Frame{pmm.Frame(0xb)}; !reflect.DeepEqual(released, exp) {
+		t.Fatalf("expected frames %v to be released; got %v", exp, released)
+	}
+}
+
+func TestUnmapAnonymousErrors(t *testing.T) {
+	if runtime.GOARCH != "amd64" {
+		t.Skip("test requires amd64 runtime; skipping")
+	}
+
+	defer resetRegionMocks()
+	leaves := mockRegionPageTables()
+
+	var (
+		as     AddressSpace
+		expErr = &kernel.Error{Module: "test", Message: "something went wrong"}
+	)
+
+	if err := as.UnmapAnonymous(anonMinAddr+1, mem.PageSize); err != errInvalidRegion {
+		t.Fatalf("expected error %v; got %v", errInvalidRegion, err)
+	}
+
+	// Regions with alternating protections cannot be merged
+	for index := 0; index < maxRegions; index++ {
+		prot := ProtRead
+		if index%2 == 0 {
+			prot |= ProtWrite
+		}
+
+		if _, err := as.MapAnonymous(0, 2*mem.PageSize, prot); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := as.UnmapAnonymous(anonMinAddr+uintptr(mem.PageSize), mem.PageSize); err != errTooManyRegions {
+		t.Fatalf("expected error %v; got %v", errTooManyRegions, err)
+	}
+
+	if as.regions.count != maxRegions {
+		t.Fatalf("expected failed unmap not to modify the regions; got %d regions", as.regions.count)
+	}
+
+	*leafPTE(leaves, anonMinAddr) = pageTableEntry(0xa000) | pageTableEntry(FlagPresent|FlagRW)
+
+	unmapFn = func(_ Page) *kernel.Error { return expErr }
+	if err := as.UnmapAnonymous(anonMinAddr, 2*mem.PageSize); err != expErr {
+		t.Fatalf("expected error %v; got %v", expErr, err)
+	}
+
+	*leafPTE(leaves, anonMinAddr+2*uintptr(mem.PageSize)) = pageTableEntry(0xb000) | pageTableEntry(FlagPresent|FlagRW)
+
+	unmapFn = func(_ Page) *kernel.Error { return nil }
+	SetFrameRefCounter(nil, func(_ pmm.Frame) *kernel.Error { return expErr }, nil)
+	if err := as.UnmapAnonymous(anonMinAddr+2*uintptr(mem.PageSize), 2*mem.PageSize); err != expErr {
+		t.Fatalf("expected error %v; got %v", expErr, err)
+	}
+
+	activePDTFn = func() uintptr { return 0xbadf00d000 }
+	if err := as.UnmapAnonymous(anonMinAddr, mem.PageSize); err != errAddrSpaceNotActive {
+		t.Fatalf("expected error %v; got %v", errAddrSpaceNotActive, err)
+	}
+}
+
+func TestHandleRegionFault(t *testing.T) {
+	defer resetRegionMocks()
+
+	var (
+		as          AddressSpace
+		pageSize    = uintptr(mem.PageSize)
+		tmpAddr     = (uintptr(unsafe.Pointer(&regionTestPage[0])) + pageSize - 1) &^ (pageSize - 1)
+		tmpFrame    = pmm.Frame(tmpAddr >> mem.PageShift)
+		kernelAddr  = uintptr(0xffff900000000000)
+		mapped      []PageTableEntryFlag
+		mappedExec  []PageTableEntryFlag
+		releaseCall int
+	)
+
+	if _, err := as.MapAnonymous(anonMinAddr, mem.PageSize, ProtRead); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := as.MapAnonymous(anonMinAddr+pageSize, mem.PageSize, ProtRead|ProtWrite); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := as.MapAnonymous(anonMinAddr+2*pageSize, mem.PageSize, ProtNone); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := as.MapAnonymous(kernelAddr, mem.PageSize, ProtRead|ProtExec); err != nil {
+		t.Fatal(err)
+	}
+
+	SetFrameAllocator(func() (pmm.Frame, *kernel.Error) { return tmpFrame, nil })
+	mapTemporaryFn = func(f pmm.Frame) (Page, *kernel.Error) { return Page(f), nil }
+	unmapFn = func(_ Page) *kernel.Error { return nil }
+	mapFn = func(_ Page, f pmm.Frame, flags PageTableEntryFlag) *kernel.Error {
+		mapped = append(mapped, flags)
+		return nil
+	}
+	mapExecutableFn = func(_ Page, f pmm.Frame, flags PageTableEntryFlag) *kernel.Error {
+		mappedExec = append(mappedExec, flags)
+		return nil
+	}
+	SetFrameRefCounter(nil, func(_ pmm.Frame) *kernel.Error {
+		releaseCall++
+		return nil
+	}, nil)
+
+	// Errors codes: bit 1 is set for writes and bit 4 for instruction fetches
+	specs := []struct {
+		addr       uintptr
+		errorCode  uint64
+		expHandled bool
+	}{
+		{anonMinAddr - 1, 0, false},
+		{anonMinAddr, 2, false},
+		{anonMinAddr + 2*pageSize, 0, false},
+		{anonMinAddr + pageSize, 1 << 4, false},
+		{anonMinAddr, 0, true},
+		{anonMinAddr + pageSize + 42, 2, true},
+		{kernelAddr, 1 << 4, true},
+	}
+
+	for specIndex, spec := range specs {
+		for i := range regionTestPage {
+			regionTestPage[i] = 0xff
+		}
+
+		handled, err := as.handleRegionFault(spec.addr, spec.errorCode)
+		if err != nil {
+			t.Fatalf("[spec %d] unexpected error: %v", specIndex, err)
+		}
+
+		if handled != spec.expHandled {
+			t.Errorf("[spec %d] expected handled to be %t; got %t", specIndex, spec.expHandled, handled)
+		}
+
+		if handled && regionTestPage[tmpAddr-uintptr(unsafe.Pointer(&regionTestPage[0]))] != 0 {
+			t.Errorf("[spec %d] expected the allocated frame to be cleared", specIndex)
+		}
+	}
+
+	expMapped := []PageTableEntryFlag{
+		FlagPresent | FlagUserAccessible | FlagNoExecute,
+		FlagPresent | FlagRW | FlagUserAccessible | FlagNoExecute,
+	}
+	if !reflect.DeepEqual(mapped, expMapped) {
+		t.Fatalf("expected pages to be mapped with flags %v; got %v", expMapped, mapped)
+	}
+
+	if exp := []PageTableEntryFlag{FlagPresent}; !reflect.DeepEqual(mappedExec, exp) {
+		t.Fatalf("expected executable pages to be mapped with flags %v; got %v", exp, mappedExec)
+	}
+
+	t.Run("errors", func(t *testing.T) {
+		expErr := &kernel.Error{Module: "test", Message: "something went wrong"}
+
+		SetFrameAllocator(func() (pmm.Frame, *kernel.Error) { return pmm.InvalidFrame, expErr })
+		if handled, err := as.handleRegionFault(anonMinAddr, 0); !handled || err != expErr {
+			t.Errorf("expected fault to be handled with error %v; got %t, %v", expErr, handled, err)
+		}
+
+		SetFrameAllocator(func() (pmm.Frame, *kernel.Error) { return tmpFrame, nil })
+		mapTemporaryFn = func(_ pmm.Frame) (Page, *kernel.Error) { return 0, expErr }
+		if handled, err := as.handleRegionFault(anonMinAddr, 0); !handled || err != expErr {
+			t.Errorf("expected fault to be handled with error %v; got %t, %v", expErr, handled, err)
+		}
+
+		mapTemporaryFn = func(f pmm.Frame) (Page, *kernel.Error) { return Page(f), nil }
+		mapFn = func(_ Page, _ pmm.Frame, _ PageTableEntryFlag) *kernel.Error { return expErr }
+		releaseCall = 0
+		if handled, err := as.handleRegionFault(anonMinAddr, 0); !handled || err != expErr {
+			t.Errorf("expected fault to be handled with error %v; got %t, %v", expErr, handled, err)
+		}
+
+		if releaseCall != 1 {
+			t.Errorf("expected the allocated frame to be released when the mapping fails")
+		}
+	})
+}
+
+func TestRegionPageFault(t *testing.T) {
+	defer func() {
+		resetRegionMocks()
+		readCR2Fn = cpu.ReadCR2
+	}()
+
+	var (
+		frame      irq.Frame
+		regs       irq.Regs
+		kernelAddr = uintptr(0xffff900000000000)
+		tmpAddr    = (uintptr(unsafe.Pointer(&regionTestPage[0])) + uintptr(mem.PageSize-1)) &^ uintptr(mem.PageSize-1)
+		mapCount   int
+	)
+
+	if _, err := kernelAddrSpace.MapAnonymous(kernelAddr, mem.PageSize, ProtRead|ProtWrite); err != nil {
+		t.Fatal(err)
+	}
+
+	readCR2Fn = func() uint64 { return uint64(kernelAddr) }
+	mapTemporaryFn = func(f pmm.Frame) (Page, *kernel.Error) { return Page(f), nil }
+	unmapFn = func(_ Page) *kernel.Error { return nil }
+	mapFn = func(_ Page, _ pmm.Frame, _ PageTableEntryFlag) *kernel.Error {
+		mapCount++
+		return nil
+	}
+	SetFrameAllocator(func() (pmm.Frame, *kernel.Error) {
+		return pmm.Frame(tmpAddr >> mem.PageShift), nil
+	})
+
+	pageFaultHandler(2, &frame, &regs)
+	if mapCount != 1 {
+		t.Fatalf("expected the faulting page to be mapped")
+	}
+
+	expErr := &kernel.Error{Module: "test", Message: "out of memory"}
+	SetFrameAllocator(func() (pmm.Frame, *kernel.Error) {
+		return pmm.InvalidFrame, expErr
+	})
+
+	defer func() {
+		if err := recover(); err != expErr {
+			t.Errorf("expected a panic with %v; got %v", expErr, err)
+		}
+	}()
+
+	pageFaultHandler(2, &frame, &regs)
+}
+
+func TestProtectedCopyOnWriteFault(t *testing.T) {
+	if runtime.GOARCH != "amd64" {
+		t.Skip("test requires amd64 runtime; skipping")
+	}
+
+	defer func() {
+		resetRegionMocks()
+		readCR2Fn = cpu.ReadCR2
+	}()
+	leaves := mockRegionPageTables()
+
+	var (
+		as    AddressSpace
+		frame irq.Frame
+		regs  irq.Regs
+		start = anonMinAddr
+	)
+
+	activeAddrSpace = &as
+	readCR2Fn = func() uint64 { return uint64(start) }
+	SetFrameRefCounter(nil, nil, func(_ pmm.Frame) uint32 { return 1 })
+	SetFrameAllocator(func() (pmm.Frame, *kernel.Error) {
+		t.Error("unexpected call to the frame allocator")
+		return pmm.InvalidFrame, nil
+	})
+
+	if _, err := as.MapAnonymous(start, mem.PageSize, ProtRead|ProtWrite); err != nil {
+		t.Fatal(err)
+	}
+
+	// The page has been shared with a clone of the address space and the
+	// region is then made read-only
+	*leafPTE(leaves, start) = pageTableEntry(0xb000) | pageTableEntry(FlagPresent|FlagUserAccessible|FlagNoExecute|FlagCopyOnWrite)
+	if err := as.Protect(start, mem.PageSize, ProtRead); err != nil {
+		t.Fatal(err)
+	}
+
+	func() {
+		defer func() {
+			if err := recover(); err != errUnrecoverableFault {
+				t.Errorf("expected a panic with %v; got %v", errUnrecoverableFault, err)
+			}
+		}()
+
+		pageFaultHandler(3, &frame, &regs)
+	}()
+
+	if leafPTE(leaves, start).HasFlags(FlagRW) {
+		t.Fatal("expected the page to remain read-only")
+	}
+
+	// Once writes are allowed again the fault is resolved
+	if err := as.Protect(start, mem.PageSize, ProtRead|ProtWrite); err != nil {
+		t.Fatal(err)
+	}
+
+	pageFaultHandler(3, &frame, &regs)
+	if pte := leafPTE(leaves, start); !pte.HasFlags(FlagRW) || pte.HasFlags(FlagCopyOnWrite) {
+		t.Fatal("expected the page to be made writable")
+	}
+}
+
+func TestAddressSpaceCloneRegionFaults(t *testing.T) {
+	if runtime.GOARCH != "amd64" {
+		t.Skip("test requires amd64 runtime; skipping")
+	}
+
+	defer func() {
+		resetRegionMocks()
+		resetAddressSpaceMocks()
+		readCR2Fn = cpu.ReadCR2
+	}()
+
+	tables := mockPageTables(2)
+	tableFrame := func(index int) pmm.Frame {
+		return pmm.Frame(uintptr(unsafe.Pointer(tables[index])) >> mem.PageShift)
+	}
+
+	var (
+		src      AddressSpace
+		frame    irq.Frame
+		regs     irq.Regs
+		roAddr   = anonMinAddr
+		rwAddr   = anonMinAddr + 2*uintptr(mem.PageSize)
+		tmpAddr  = (uintptr(unsafe.Pointer(&regionTestPage[0])) + uintptr(mem.PageSize-1)) &^ uintptr(mem.PageSize-1)
+		mapCount int
+	)
+
+	src.pdt.pdtFrame = tableFrame(0)
+	if _, err := src.MapAnonymous(roAddr, mem.PageSize, ProtRead); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := src.MapAnonymous(rwAddr, mem.PageSize, ProtRead|ProtWrite); err != nil {
+		t.Fatal(err)
+	}
+
+	SetFrameAllocator(func() (pmm.Frame, *kernel.Error) { return tableFrame(1), nil })
+	activePDTFn = func() uintptr { return src.pdt.pdtFrame.Address() }
+	switchPDTFn = func(_ uintptr) {}
+
+	clone, err := src.Clone()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(clone.regions, src.regions) {
+		t.Fatal("expected the regions to be copied to the clone")
+	}
+
+	leaves := mockRegionPageTables()
+	activeAddrSpace = clone
+
+	// A write to a shared page of a read-only region must not be resolved
+	// by the clone
+	*leafPTE(leaves, roAddr) = pageTableEntry(0xb000) | pageTableEntry(FlagPresent|FlagUserAccessible|FlagNoExecute|FlagCopyOnWrite)
+	readCR2Fn = func() uint64 { return uint64(roAddr) }
+	SetFrameRefCounter(nil, nil, func(_ pmm.Frame) uint32 { return 1 })
+
+	func() {
+		defer func() {
+			if err := recover(); err != errUnrecoverableFault {
+				t.Errorf("expected a panic with %v; got %v", errUnrecoverableFault, err)
+			}
+		}()
+
+		pageFaultHandler(3, &frame, &regs)
+	}()
+
+	if leafPTE(leaves, roAddr).HasFlags(FlagRW) {
+		t.Fatal("expected the page to remain read-only")
+	}
+
+	// Pages that were not accessed before cloning are populated on first
+	// access
+	readCR2Fn = func() uint64 { return uint64(rwAddr) }
+	mapTemporaryFn = func(f pmm.Frame) (Page, *kernel.Error) { return Page(f), nil }
+	mapFn = func(page Page, _ pmm.Frame, _ PageTableEntryFlag) *kernel.Error {
+		if exp := PageFromAddress(rwAddr); page != exp {
+			t.Errorf("expected page %d to be mapped; got %d", exp, page)
+		}
+		mapCount++
+		return nil
+	}
+	SetFrameAllocator(func() (pmm.Frame, *kernel.Error) {
+		return pmm.Frame(tmpAddr >> mem.PageShift), nil
+	})
+
+	pageFaultHandler(2, &frame, &regs)
+	if mapCount != 1 {
+		t.Fatal("expected the faulting page to be mapped")
+	}
+}
+
+func TestActivateTracksAddressSpace(t *testing.T) {
+	defer resetAddressSpaceMocks()
+
+	switchPDTFn = func(_ uintptr) {}
+	activePDTFn = func() uintptr { return 0 }
+
+	var as AddressSpace
+	as.Activate()
+
+	if activeAddrSpace != &as {
+		t.Fatal("expected Activate to update the active address space")
+	}
+
+	if got := addrSpaceForFault(anonMinAddr); got != &as {
+		t.Fatal("expected faults in the user half to be serviced by the active address space")
+	}
+
+	if got := addrSpaceForFault(0xffff900000000000); got != &kernelAddrSpace {
+		t.Fatal("expected faults in the kernel half to be serviced by the kernel address space")
+	}
+}
+
+// mockRegionPageTables mocks the page table walks performed by pteForAddress
+// so that all upper-level entries are present. The returned map holds the
+// last-level entry for each page that has been looked up.
+func mockRegionPageTables() map[Page]*pageTableEntry {
+	var (
+		leaves = make(map[Page]*pageTableEntry)
+
+		// The recursive mapping places the last-level entries starting
+		// at this address followed by the tables for the upper levels.
+		leafTableBase  = uintptr(0xffffff8000000000)
+		upperTableBase = uintptr(0xffffffffc0000000)
+	)
+
+	activePDTFn = func() uintptr { return 0 }
+	flushTLBEntryFn = func(_ uintptr) {}
+	ptePtrFn = func(entryAddr uintptr) unsafe.Pointer {
+		if entryAddr >= upperTableBase {
+			upper := pageTableEntry(FlagPresent | FlagRW)
+			return unsafe.Pointer(&upper)
+		}
+
+		return unsafe.Pointer(leafPTE(leaves, (entryAddr-leafTableBase)>>mem.PointerShift<<mem.PageShift))
+	}
+
+	return leaves
+}
+
+// leafPTE returns the last-level entry for the page that contains addr.
+func leafPTE(leaves map[Page]*pageTableEntry, addr uintptr) *pageTableEntry {
+	page := PageFromAddress(addr)
+	if _, ok := leaves[page]; !ok {
+		leaves[page] = new(pageTableEntry)
+	}
+
+	return leaves[page]
+}
+
+func resetRegionMocks() {
+	activePDTFn = cpu.ActivePDT
+	flushTLBEntryFn = cpu.FlushTLBEntry
+	ptePtrFn = origPtePtrFn
+	frameAllocator = nil
+	SetFrameRefCounter(nil, nil, nil)
+	mapFn = Map
+	mapExecutableFn = MapExecutable
+	mapTemporaryFn = MapTemporary
+	unmapFn = Unmap
+	kernelAddrSpace = AddressSpace{}
+	activeAddrSpace = nil
+}
@@ -0,0 +1,95 @@
+package vmm
+
+// maxShootdownBatch defines the max number of page invalidations that can be
+// queued while a shootdown batch is active. If more pages get invalidated,
+// the batch falls back to requesting a full TLB flush.
+const maxShootdownBatch = 32
+
+// ShootdownFn is a function that asks all other CPUs to invalidate their TLB
+// entries for the supplied virtual addresses. If flushAll is true, the
+// addresses should be ignored and the entire TLB should be flushed instead.
+type ShootdownFn func(addrs []uintptr, flushAll bool)
+
+var (
+	// remoteShootdownFn points to the function registered using
+	// SetShootdownHandler. While it is nil, TLB invalidations are only
+	// applied to the local TLB.
+	remoteShootdownFn ShootdownFn
+
+	// shootdownBatch is a statically allocated queue of the page
+	// invalidations that have not yet been sent to the other CPUs.
+	shootdownBatch struct {
+		depth    int
+		count    int
+		flushAll bool
+		addrs    [maxShootdownBatch]uintptr
+	}
+)
+
+// SetShootdownHandler registers the function that the vmm code uses to
+// propagate TLB invalidations to the other CPUs. The lapic driver registers
+// a handler that broadcasts a shootdown IPI and waits for all other CPUs to
+// acknowledge it; the vmm package cannot do this itself as the lapic
+// package depends on it.
+func SetShootdownHandler(fn ShootdownFn) {
+	remoteShootdownFn = fn
+}
+
+// BeginShootdownBatch starts queuing the TLB invalidations that need to be
+// sent to other CPUs so that they get delivered with a single request when
+// the matching call to EndShootdownBatch is made. Local TLB entries are
+// still flushed immediately. Batches may be nested.
+func BeginShootdownBatch() {
+	shootdownBatch.depth++
+}
+
+// EndShootdownBatch ends a batch started by BeginShootdownBatch. When the
+// outermost batch ends, all queued invalidations are sent to the other CPUs.
+func EndShootdownBatch() {
+	if shootdownBatch.depth == 0 {
+		return
+	}
+
+	if shootdownBatch.depth--; shootdownBatch.depth == 0 {
+		flushShootdownBatch()
+	}
+}
+
+// shootdownPage flushes the TLB entry for the supplied address on all CPUs.
+// It must be used instead of flushTLBEntryFn whenever an existing mapping is
+// removed or its frame or permissions change.
+func shootdownPage(virtAddr uintptr) {
+	flushTLBEntryFn(virtAddr)
+
+	if shootdownBatch.count == maxShootdownBatch {
+		shootdownBatch.flushAll = true
+	} else {
+		shootdownBatch.addrs[shootdownBatch.count] = virtAddr
+		shootdownBatch.count++
+	}
+
+	if shootdownBatch.depth == 0 {
+		flushShootdownBatch()
+	}
+}
+
+// shootdownAll flushes the entire TLB on all CPUs.
+func shootdownAll() {
+	switchPDTFn(activePDTFn())
+
+	shootdownBatch.flushAll = true
+	if shootdownBatch.depth == 0 {
+		flushShootdownBatch()
+	}
+}
+
+// flushShootdownBatch sends the queued invalidations to the other CPUs and
+// resets the queue.
+func flushShootdownBatch() {
+	if remoteShootdownFn != nil && (shootdownBatch.count != 0 || shootdownBatch.flushAll) {
+		remoteShootdownFn(shootdownBatch.addrs[:shootdownBatch.count], shootdownBatch.flushAll)
+	}
+
+	shootdownBatch.count = 0
+	shootdownBatch.flushAll = false
+}
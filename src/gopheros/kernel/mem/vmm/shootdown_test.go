@@ -0,0 +1,155 @@
+package vmm
+
+import (
+	"gopheros/kernel/cpu"
+	"testing"
+)
+
+func TestShootdownPage(t *testing.T) {
+	defer resetShootdownMocks()
+
+	var (
+		localFlushes []uintptr
+		remoteCalls  int
+		remoteAddrs  []uintptr
+	)
+
+	flushTLBEntryFn = func(addr uintptr) { localFlushes = append(localFlushes, addr) }
+
+	// Without a registered handler only the local TLB gets flushed
+	shootdownPage(0x1000)
+	if len(localFlushes) != 1 || localFlushes[0] != 0x1000 {
+		t.Fatalf("expected local TLB entry for 0x1000 to be flushed; got %v", localFlushes)
+	}
+
+	SetShootdownHandler(func(addrs []uintptr, flushAll bool) {
+		remoteCalls++
+		remoteAddrs = append([]uintptr(nil), addrs...)
+		if flushAll {
+			t.Error("expected flushAll to be false")
+		}
+	})
+
+	shootdownPage(0x2000)
+	if exp := 1; remoteCalls != exp {
+		t.Fatalf("expected remote shootdown handler to be called %d time(s); got %d", exp, remoteCalls)
+	}
+
+	if len(remoteAddrs) != 1 || remoteAddrs[0] != 0x2000 {
+		t.Fatalf("expected remote shootdown for address 0x2000; got %v", remoteAddrs)
+	}
+
+	if shootdownBatch.count != 0 {
+		t.Fatalf("expected shootdown queue to be reset; got %d queued entries", shootdownBatch.count)
+	}
+}
+
+func TestShootdownBatch(t *testing.T) {
+	defer resetShootdownMocks()
+
+	var (
+		localFlushes int
+		remoteCalls  int
+		remoteAddrs  []uintptr
+		remoteAll    bool
+	)
+
+	flushTLBEntryFn = func(_ uintptr) { localFlushes++ }
+	SetShootdownHandler(func(addrs []uintptr, flushAll bool) {
+		remoteCalls++
+		remoteAddrs = append([]uintptr(nil), addrs...)
+		remoteAll = flushAll
+	})
+
+	// Ending a batch that was never started should be a no-op
+	EndShootdownBatch()
+	if remoteCalls != 0 {
+		t.Fatalf("expected remote shootdown handler not to be called; got %d calls", remoteCalls)
+	}
+
+	BeginShootdownBatch()
+	BeginShootdownBatch()
+	for i := uintptr(0); i < 4; i++ {
+		shootdownPage(i << 12)
+	}
+
+	if exp := 4; localFlushes != exp {
+		t.Fatalf("expected local TLB entries to be flushed immediately; got %d flushes", localFlushes)
+	}
+
+	// Ending the nested batch should not trigger a remote shootdown
+	EndShootdownBatch()
+	if remoteCalls != 0 {
+		t.Fatalf("expected remote shootdown handler not to be called; got %d calls", remoteCalls)
+	}
+
+	EndShootdownBatch()
+	if exp := 1; remoteCalls != exp {
+		t.Fatalf("expected remote shootdown handler to be called %d time(s); got %d", exp, remoteCalls)
+	}
+
+	if exp := 4; len(remoteAddrs) != exp || remoteAll {
+		t.Fatalf("expected a remote shootdown for %d addresses; got %v (flushAll: %t)", exp, remoteAddrs, remoteAll)
+	}
+
+	// Overflowing the batch queue should fall back to a full flush
+	BeginShootdownBatch()
+	for i := uintptr(0); i <= maxShootdownBatch; i++ {
+		shootdownPage(i << 12)
+	}
+	EndShootdownBatch()
+
+	if exp := 2; remoteCalls != exp {
+		t.Fatalf("expected remote shootdown handler to be called %d time(s); got %d", exp, remoteCalls)
+	}
+
+	if !remoteAll {
+		t.Fatal("expected remote shootdown to request a full TLB flush")
+	}
+
+	// Ending an empty batch should not trigger a remote shootdown
+	BeginShootdownBatch()
+	EndShootdownBatch()
+	if exp := 2; remoteCalls != exp {
+		t.Fatalf("expected remote shootdown handler to be called %d time(s); got %d", exp, remoteCalls)
+	}
+}
+
+func TestShootdownAll(t *testing.T) {
+	defer resetShootdownMocks()
+
+	var (
+		switchedPDT uintptr
+		remoteAll   bool
+	)
+
+	activePDTFn = func() uintptr { return 0xbadf00d000 }
+	switchPDTFn = func(addr uintptr) { switchedPDT = addr }
+	SetShootdownHandler(func(_ []uintptr, flushAll bool) {
+		remoteAll = flushAll
+	})
+
+	shootdownAll()
+
+	if exp := uintptr(0xbadf00d000); switchedPDT != exp {
+		t.Fatalf("expected active PDT 0x%x to be reloaded; got 0x%x", exp, switchedPDT)
+	}
+
+	if !remoteAll {
+		t.Fatal("expected remote shootdown to request a full TLB flush")
+	}
+
+	if shootdownBatch.flushAll {
+		t.Fatal("expected shootdown queue to be reset")
+	}
+}
+
+func resetShootdownMocks() {
+	flushTLBEntryFn = cpu.FlushTLBEntry
+	activePDTFn = cpu.ActivePDT
+	switchPDTFn = cpu.SwitchPDT
+	SetShootdownHandler(nil)
+	shootdownBatch.depth = 0
+	shootdownBatch.count = 0
+	shootdownBatch.flushAll = false
+}
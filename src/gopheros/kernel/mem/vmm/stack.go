@@ -0,0 +1,137 @@
+package vmm
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/irq"
+	"gopheros/kernel/mem"
+)
+
+const (
+	// maxKernelStacks defines the max number of kernel stacks that can be
+	// allocated via AllocKernelStack.
+	maxKernelStacks = 64
+
+	// doubleFaultIST is the interrupt stack table index of the stack used
+	// by the double fault handler.
+	doubleFaultIST = 1
+
+	// doubleFaultStackSize is the size of the stack used by the double
+	// fault handler.
+	doubleFaultStackSize = 4 * mem.PageSize
+)
+
+var (
+	// kernelStacks is a statically allocated array that tracks the kernel
+	// stacks allocated by AllocKernelStack so that the fault handlers can
+	// detect stack overflows.
+	kernelStacks     [maxKernelStacks]KernelStack
+	kernelStackCount int
+
+	errTooManyKernelStacks = &kernel.Error{Module: "vmm", Message: "max number of kernel stacks reached"}
+	errInvalidStackSize    = &kernel.Error{Module: "vmm", Message: "invalid kernel stack size"}
+)
+
+// KernelStack describes a kernel stack allocated by AllocKernelStack. The
+// stack pages are preceded by an unmapped guard page so that stack overflows
+// trigger a page fault instead of silently corrupting adjacent memory.
+//
+// When a stack overflows into its guard page, the CPU cannot push the page
+// fault frame to it and raises a double fault instead. The double fault
+// handler runs on a dedicated stack (see setupDoubleFaultStack) and reports
+// the overflow together with the name of the overflowing stack.
+type KernelStack struct {
+	// The name of the stack (e.g. the name of the task or CPU that uses
+	// it). It is included in the fault report for stack overflows.
+	Name string
+
+	// The address of the guard page below the stack.
+	GuardPage Page
+
+	// The stack top address. As stacks grow downwards, this is the initial
+	// value for the stack pointer.
+	Top uintptr
+}
+
+// AllocKernelStack reserves a region of the kernel address space for a stack
+// with the requested size plus a guard page, maps the stack pages to newly
+// allocated physical frames and leaves the guard page unmapped. The size is
+// always rounded up to the nearest page boundary. If an error occurs, any
+// mapped pages are released and the reserved region is returned.
+func AllocKernelStack(name string, size mem.Size) (KernelStack, *kernel.Error) {
+	if size == 0 {
+		return KernelStack{}, errInvalidStackSize
+	}
+
+	if kernelStackCount == maxKernelStacks {
+		return KernelStack{}, errTooManyKernelStacks
+	}
+
+	size = (size + (mem.PageSize - 1)) & ^(mem.PageSize - 1)
+	regionStartAddr, err := earlyReserveRegionFn(size + mem.PageSize)
+	if err != nil {
+		return KernelStack{}, err
+	}
+
+	guardPage := PageFromAddress(regionStartAddr)
+	pageCount := uint32(size >> mem.PageShift)
+	for mapped := uint32(0); mapped < pageCount; mapped++ {
+		frame, err := frameAllocator()
+		if err == nil {
+			if err = mapFn(guardPage+1+Page(mapped), frame, FlagPresent|FlagRW); err != nil && frameReleaseFn != nil {
+				_ = frameReleaseFn(frame)
+			}
+		}
+
+		if err != nil {
+			_ = unmapVmallocPages((guardPage + 1).Address(), mapped)
+			releaseEarlyRegion(regionStartAddr, size+mem.PageSize)
+			return KernelStack{}, err
+		}
+	}
+
+	stack := KernelStack{
+		Name:      name,
+		GuardPage: guardPage,
+		Top:       regionStartAddr + uintptr(mem.PageSize+size),
+	}
+
+	kernelStacks[kernelStackCount] = stack
+	kernelStackCount++
+
+	return stack, nil
+}
+
+// stackForGuardPage returns the kernel stack whose guard page contains the
+// supplied address or nil if the address does not belong to a guard page.
+func stackForGuardPage(addr uintptr) *KernelStack {
+	page := PageFromAddress(addr)
+	for index := 0; index < kernelStackCount; index++ {
+		if kernelStacks[index].GuardPage == page {
+			return &kernelStacks[index]
+		}
+	}
+
+	return nil
+}
+
+// setupDoubleFaultStack allocates the stack for the double fault handler and
+// installs a TSS whose interrupt stack table points to it. The double fault
+// IDT entry is configured to always switch to this stack so the handler can
+// run even if the fault was caused by an overflowing kernel stack.
+//
+// Page faults do not use an IST stack as the page fault handler may itself
+// trigger a nested page fault that would clobber the frame of the outer one.
+// A page fault in a guard page that cannot be delivered on the overflowing
+// stack is escalated by the CPU to a double fault.
+func setupDoubleFaultStack() *kernel.Error {
+	stack, err := allocKernelStackFn("double-fault", doubleFaultStackSize)
+	if err != nil {
+		return err
+	}
+
+	var istStackTops [doubleFaultIST]uintptr
+	istStackTops[doubleFaultIST-1] = stack.Top
+	loadTSSFn(istStackTops[:])
+	setISTFn(irq.DoubleFault, doubleFaultIST)
+	return nil
+}
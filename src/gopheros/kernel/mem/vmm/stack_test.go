@@ -0,0 +1,348 @@
+package vmm
+
+import (
+	"bytes"
+	"gopheros/kernel"
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/irq"
+	"gopheros/kernel/kfmt"
+	"gopheros/kernel/mem"
+	"gopheros/kernel/mem/pmm"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAllocKernelStack(t *testing.T) {
+	defer func() {
+		earlyReserveRegionFn = EarlyReserveRegion
+		mapFn = Map
+		frameAllocator = nil
+		kernelStackCount = 0
+	}()
+
+	const regionAddr = uintptr(0xffffff0000000000)
+
+	earlyReserveRegionFn = func(size mem.Size) (uintptr, *kernel.Error) {
+		if exp := 3 * mem.PageSize; size != exp {
+			t.Errorf("expected to reserve %d bytes; got %d", exp, size)
+		}
+		return regionAddr, nil
+	}
+
+	SetFrameAllocator(func() (pmm.Frame, *kernel.Error) {
+		return pmm.Frame(123), nil
+	})
+
+	var mappedPages []Page
+	mapFn = func(page Page, _ pmm.Frame, flags PageTableEntryFlag) *kernel.Error {
+		if exp := FlagPresent | FlagRW; flags != exp {
+			t.Errorf("expected mapping flags to be %d; got %d", exp, flags)
+		}
+		mappedPages = append(mappedPages, page)
+		return nil
+	}
+
+	stack, err := AllocKernelStack("test", mem.PageSize+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stack.Name != "test" {
+		t.Errorf("expected stack name to be %q; got %q", "test", stack.Name)
+	}
+
+	if exp := PageFromAddress(regionAddr); stack.GuardPage != exp {
+		t.Errorf("expected guard page to be 0x%x; got 0x%x", exp, stack.GuardPage)
+	}
+
+	if exp := regionAddr + 3*uintptr(mem.PageSize); stack.Top != exp {
+		t.Errorf("expected stack top to be 0x%x; got 0x%x", exp, stack.Top)
+	}
+
+	if len(mappedPages) != 2 || mappedPages[0] != stack.GuardPage+1 || mappedPages[1] != stack.GuardPage+2 {
+		t.Errorf("expected the 2 pages above the guard page to be mapped; got %v", mappedPages)
+	}
+
+	specs := []struct {
+		addr uintptr
+		exp  *KernelStack
+	}{
+		{regionAddr, &kernelStacks[0]},
+		{regionAddr + uintptr(mem.PageSize) - 1, &kernelStacks[0]},
+		{regionAddr + uintptr(mem.PageSize), nil},
+		{regionAddr - 1, nil},
+	}
+
+	for specIndex, spec := range specs {
+		if got := stackForGuardPage(spec.addr); got != spec.exp {
+			t.Errorf("[spec %d] expected stackForGuardPage(0x%x) to return %v; got %v", specIndex, spec.addr, spec.exp, got)
+		}
+	}
+}
+
+func TestAllocKernelStackErrors(t *testing.T) {
+	defer func(origLastUsed uintptr) {
+		earlyReserveRegionFn = EarlyReserveRegion
+		earlyReserveLastUsed = origLastUsed
+		mapFn = Map
+		unmapFn = Unmap
+		translateFn = Translate
+		frameAllocator = nil
+		frameReleaseFn = nil
+		kernelStackCount = 0
+	}(earlyReserveLastUsed)
+
+	expErr := &kernel.Error{Module: "test", Message: "something went wrong"}
+
+	if _, err := AllocKernelStack("test", 0); err != errInvalidStackSize {
+		t.Errorf("expected error %v; got %v", errInvalidStackSize, err)
+	}
+
+	kernelStackCount = maxKernelStacks
+	if _, err := AllocKernelStack("test", mem.PageSize); err != errTooManyKernelStacks {
+		t.Errorf("expected error %v; got %v", errTooManyKernelStacks, err)
+	}
+	kernelStackCount = 0
+
+	earlyReserveRegionFn = func(_ mem.Size) (uintptr, *kernel.Error) {
+		return 0, expErr
+	}
+	if _, err := AllocKernelStack("test", mem.PageSize); err != expErr {
+		t.Errorf("expected error %v; got %v", expErr, err)
+	}
+
+	// Emulate a region reserved via EarlyReserveRegion
+	const regionAddr = uintptr(0xffffff0000000000)
+	earlyReserveRegionFn = func(size mem.Size) (uintptr, *kernel.Error) {
+		earlyReserveLastUsed = regionAddr
+		return regionAddr, nil
+	}
+
+	var (
+		mappedPages   []Page
+		releasedPages []Page
+		released      []pmm.Frame
+	)
+	translateFn = func(addr uintptr) (uintptr, *kernel.Error) { return addr, nil }
+	unmapFn = func(page Page) *kernel.Error {
+		releasedPages = append(releasedPages, page)
+		return nil
+	}
+	frameReleaseFn = func(frame pmm.Frame) *kernel.Error {
+		released = append(released, frame)
+		return nil
+	}
+
+	specs := []struct {
+		failAlloc, failMap int
+		expReleasedPages   []Page
+		expReleased        []pmm.Frame
+	}{
+		// The second frame allocation fails
+		{
+			1, -1,
+			[]Page{PageFromAddress(regionAddr) + 1},
+			[]pmm.Frame{pmm.Frame(PageFromAddress(regionAddr) + 1)},
+		},
+		// Mapping the second page fails
+		{
+			-1, 1,
+			[]Page{PageFromAddress(regionAddr) + 1},
+			[]pmm.Frame{1, pmm.Frame(PageFromAddress(regionAddr) + 1)},
+		},
+	}
+
+	for specIndex, spec := range specs {
+		mappedPages, releasedPages, released = nil, nil, nil
+
+		var allocCount int
+		SetFrameAllocator(func() (pmm.Frame, *kernel.Error) {
+			defer func() { allocCount++ }()
+			if allocCount == spec.failAlloc {
+				return pmm.InvalidFrame, expErr
+			}
+			return pmm.Frame(allocCount), nil
+		})
+		mapFn = func(page Page, _ pmm.Frame, _ PageTableEntryFlag) *kernel.Error {
+			if len(mappedPages) == spec.failMap {
+				return expErr
+			}
+			mappedPages = append(mappedPages, page)
+			return nil
+		}
+
+		if _, err := AllocKernelStack("test", 3*mem.PageSize); err != expErr {
+			t.Errorf("[spec %d] expected error %v; got %v", specIndex, expErr, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(releasedPages, spec.expReleasedPages) {
+			t.Errorf("[spec %d] expected pages %v to be unmapped; got %v", specIndex, spec.expReleasedPages, releasedPages)
+		}
+
+		if !reflect.DeepEqual(released, spec.expReleased) {
+			t.Errorf("[spec %d] expected frames %v to be released; got %v", specIndex, spec.expReleased, released)
+		}
+
+		if exp := regionAddr + 4*uintptr(mem.PageSize); earlyReserveLastUsed != exp {
+			t.Errorf("[spec %d] expected the reserved region to be returned; last used address is 0x%x", specIndex, earlyReserveLastUsed)
+		}
+
+		if kernelStackCount != 0 {
+			t.Errorf("[spec %d] expected failed allocations not to be tracked; got %d tracked stacks", specIndex, kernelStackCount)
+		}
+	}
+}
+
+func TestReleaseEarlyRegion(t *testing.T) {
+	defer func(origLastUsed uintptr) {
+		earlyReserveLastUsed = origLastUsed
+	}(earlyReserveLastUsed)
+
+	earlyReserveLastUsed = 0x10000
+	first, _ := EarlyReserveRegion(mem.PageSize)
+	second, _ := EarlyReserveRegion(mem.PageSize + 1)
+
+	// Only the last reserved region can be returned
+	releaseEarlyRegion(first, mem.PageSize)
+	if earlyReserveLastUsed != second {
+		t.Fatalf("expected last used address to remain 0x%x; got 0x%x", second, earlyReserveLastUsed)
+	}
+
+	releaseEarlyRegion(second, mem.PageSize+1)
+	if earlyReserveLastUsed != first {
+		t.Fatalf("expected last used address to be 0x%x; got 0x%x", first, earlyReserveLastUsed)
+	}
+}
+
+func TestSetupDoubleFaultStack(t *testing.T) {
+	defer func() {
+		allocKernelStackFn = AllocKernelStack
+		loadTSSFn = cpu.LoadTSS
+		setISTFn = irq.SetIST
+	}()
+
+	var (
+		istStackTops []uintptr
+		istVector    irq.ExceptionNum
+		ist          uint8
+	)
+
+	allocKernelStackFn = func(name string, size mem.Size) (KernelStack, *kernel.Error) {
+		if name != "double-fault" || size != doubleFaultStackSize {
+			t.Errorf("unexpected stack allocation request: %q, %d", name, size)
+		}
+		return KernelStack{Name: name, Top: 0xbadf00d000}, nil
+	}
+	loadTSSFn = func(tops []uintptr) { istStackTops = tops }
+	setISTFn = func(exceptionNum irq.ExceptionNum, index uint8) { istVector, ist = exceptionNum, index }
+
+	if err := setupDoubleFaultStack(); err != nil {
+		t.Fatal(err)
+	}
+
+	if exp := []uintptr{0xbadf00d000}; !reflect.DeepEqual(istStackTops, exp) {
+		t.Errorf("expected IST stacks to be %v; got %v", exp, istStackTops)
+	}
+
+	if istVector != irq.DoubleFault || ist != doubleFaultIST {
+		t.Errorf("expected double fault IDT entry to use IST%d; got IST%d for vector %d", doubleFaultIST, ist, istVector)
+	}
+
+	expErr := &kernel.Error{Module: "test", Message: "out of memory"}
+	allocKernelStackFn = func(_ string, _ mem.Size) (KernelStack, *kernel.Error) {
+		return KernelStack{}, expErr
+	}
+
+	if err := setupDoubleFaultStack(); err != expErr {
+		t.Fatalf("expected error %v; got %v", expErr, err)
+	}
+}
+
+func TestStackOverflowReport(t *testing.T) {
+	defer func() {
+		kfmt.SetOutputSink(nil)
+		readCR2Fn = cpu.ReadCR2
+		kernelStackCount = 0
+	}()
+
+	kernelStacks[0] = KernelStack{Name: "cpu0", GuardPage: PageFromAddress(0xbadf00d000)}
+	kernelStackCount = 1
+
+	var (
+		regs  irq.Regs
+		frame irq.Frame
+		buf   bytes.Buffer
+	)
+	kfmt.SetOutputSink(&buf)
+
+	specs := []struct {
+		descr     string
+		fn        func(faultAddress uintptr)
+		expErr    *kernel.Error
+		expOutput string
+	}{
+		{
+			"page fault in guard page",
+			func(faultAddress uintptr) {
+				nonRecoverablePageFault(faultAddress, 2, &frame, &regs, errUnrecoverableFault)
+			},
+			errUnrecoverableFault,
+			"kernel stack overflow (stack: cpu0)",
+		},
+		{
+			"double fault in guard page",
+			func(faultAddress uintptr) {
+				readCR2Fn = func() uint64 { return uint64(faultAddress) }
+				doubleFaultHandler(0, &frame, &regs)
+			},
+			errDoubleFault,
+			"Kernel stack overflow (stack: cpu0)",
+		},
+	}
+
+	for _, spec := range specs {
+		t.Run(spec.descr, func(t *testing.T) {
+			buf.Reset()
+			defer func() {
+				if err := recover(); err != spec.expErr {
+					t.Errorf("expected a panic with %v; got %v", spec.expErr, err)
+				}
+
+				if got := buf.String(); !strings.Contains(got, spec.expOutput) {
+					t.Errorf("expected output to contain %q; got:\n%q", spec.expOutput, got)
+				}
+			}()
+
+			spec.fn(0xbadf00d008)
+		})
+	}
+}
+
+func TestDoubleFaultHandler(t *testing.T) {
+	defer func() {
+		kfmt.SetOutputSink(nil)
+		readCR2Fn = cpu.ReadCR2
+	}()
+
+	var (
+		regs  irq.Regs
+		frame irq.Frame
+		buf   bytes.Buffer
+	)
+	kfmt.SetOutputSink(&buf)
+	readCR2Fn = func() uint64 { return 0xbadf00d000 }
+
+	defer func() {
+		if err := recover(); err != errDoubleFault {
+			t.Errorf("expected a panic with errDoubleFault; got %v", err)
+		}
+
+		if got := buf.String(); !strings.Contains(got, "Double fault") || strings.Contains(got, "overflow") {
+			t.Errorf("unexpected output:\n%q", got)
+		}
+	}()
+
+	doubleFaultHandler(0, &frame, &regs)
+}
@@ -4,16 +4,19 @@ import "gopheros/kernel"
 
 // Translate returns the physical address that corresponds to the supplied
 // virtual address or ErrInvalidMapping if the virtual address does not
-// correspond to a mapped physical address.
+// correspond to a mapped physical address. Translate supports addresses that
+// are mapped using either regular or huge pages.
 func Translate(virtAddr uintptr) (uintptr, *kernel.Error) {
-	pte, err := pteForAddress(virtAddr)
+	pte, level, err := pteForAddress(virtAddr)
 	if err != nil {
 		return 0, err
 	}
 
 	// Calculate the physical address by taking the physical frame address and
-	// appending the offset from the virtual address
-	physAddr := pte.Frame().Address() + (virtAddr & ((1 << pageLevelShifts[pageLevels-1]) - 1))
+	// appending the offset from the virtual address. For huge pages, the
+	// offset includes all virtual address bits below the page level that
+	// holds the mapping.
+	physAddr := pte.Frame().Address() + (virtAddr & ((1 << pageLevelShifts[level]) - 1))
 
 	return physAddr, nil
 }
@@ -0,0 +1,167 @@
+package vmm
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/mem"
+	"gopheros/kernel/mem/pmm"
+)
+
+// maxVmallocAreas defines the max number of areas that can be allocated via
+// AllocPages at any given time.
+const maxVmallocAreas = 128
+
+var (
+	// vmallocAreas is a statically allocated array that tracks the areas
+	// allocated by AllocPages sorted by their start address.
+	vmallocAreas     [maxVmallocAreas]vmallocArea
+	vmallocAreaCount int
+
+	errVmallocInvalidPageCount = &kernel.Error{Module: "vmm", Message: "page count must be greater than zero"}
+	errVmallocTooManyAreas     = &kernel.Error{Module: "vmm", Message: "max number of vmalloc areas reached"}
+	errVmallocNoSpace          = &kernel.Error{Module: "vmm", Message: "not enough space in the vmalloc region"}
+	errVmallocInvalidAddress   = &kernel.Error{Module: "vmm", Message: "address was not allocated by AllocPages"}
+)
+
+// vmallocArea describes a set of pages allocated by AllocPages.
+type vmallocArea struct {
+	start     uintptr
+	pageCount uint32
+}
+
+// end returns the address past the guard page that follows the area.
+func (area *vmallocArea) end() uintptr {
+	return area.start + uintptr(area.pageCount+1)<<mem.PageShift
+}
+
+// AllocPages allocates pageCount physical frames and maps them to a
+// contiguous range of virtual addresses inside the vmalloc region. As the
+// frames are not required to be physically contiguous, AllocPages is better
+// suited than the frame allocator for large allocations that are only
+// accessed by the CPU. Each allocated range is followed by an unmapped guard
+// page. The contents of the allocated pages are not initialized.
+func AllocPages(pageCount uint32) (uintptr, *kernel.Error) {
+	if pageCount == 0 {
+		return 0, errVmallocInvalidPageCount
+	}
+
+	if vmallocAreaCount == maxVmallocAreas {
+		return 0, errVmallocTooManyAreas
+	}
+
+	area := vmallocArea{pageCount: pageCount}
+	areaIndex := findVmallocGap(&area)
+	if areaIndex < 0 {
+		return 0, errVmallocNoSpace
+	}
+
+	page := PageFromAddress(area.start)
+	for mapped := uint32(0); mapped < pageCount; mapped, page = mapped+1, page+1 {
+		frame, err := frameAllocator()
+		if err == nil {
+			if err = mapFn(page, frame, FlagPresent|FlagRW); err != nil && frameReleaseFn != nil {
+				_ = frameReleaseFn(frame)
+			}
+		}
+
+		if err != nil {
+			_ = unmapVmallocPages(area.start, mapped)
+			return 0, err
+		}
+	}
+
+	copy(vmallocAreas[areaIndex+1:vmallocAreaCount+1], vmallocAreas[areaIndex:vmallocAreaCount])
+	vmallocAreas[areaIndex] = area
+	vmallocAreaCount++
+
+	return area.start, nil
+}
+
+// FreePages unmaps the pages allocated by a call to AllocPages and releases
+// the physical frames that back them.
+func FreePages(addr uintptr) *kernel.Error {
+	for index := 0; index < vmallocAreaCount; index++ {
+		if vmallocAreas[index].start != addr {
+			continue
+		}
+
+		area := vmallocAreas[index]
+		copy(vmallocAreas[index:vmallocAreaCount-1], vmallocAreas[index+1:vmallocAreaCount])
+		vmallocAreaCount--
+
+		return unmapVmallocPages(area.start, area.pageCount)
+	}
+
+	return errVmallocInvalidAddress
+}
+
+// findVmallocGap locates the first gap in the vmalloc region that can fit the
+// supplied area and its guard page and sets the area start address. It
+// returns the index in vmallocAreas where the area should be inserted or -1
+// if no suitable gap exists.
+func findVmallocGap(area *vmallocArea) int {
+	var (
+		size      = uintptr(area.pageCount+1) << mem.PageShift
+		gapStart  = VmallocBase
+		regionEnd = VmallocBase + uintptr(VmallocSize)
+	)
+
+	for index := 0; index <= vmallocAreaCount; index++ {
+		gapEnd := regionEnd
+		if index < vmallocAreaCount {
+			gapEnd = vmallocAreas[index].start
+		}
+
+		if gapEnd-gapStart >= size {
+			area.start = gapStart
+			return index
+		}
+
+		if index < vmallocAreaCount {
+			gapStart = vmallocAreas[index].end()
+		}
+	}
+
+	return -1
+}
+
+// unmapVmallocPages unmaps pageCount pages starting at addr and releases the
+// frames that back them.
+func unmapVmallocPages(addr uintptr, pageCount uint32) *kernel.Error {
+	BeginShootdownBatch()
+	defer EndShootdownBatch()
+
+	for page := PageFromAddress(addr); pageCount > 0; page, pageCount = page+1, pageCount-1 {
+		physAddr, err := translateFn(page.Address())
+		if err != nil {
+			return err
+		}
+
+		if err = unmapFn(page); err != nil {
+			return err
+		}
+
+		if frameReleaseFn != nil {
+			if err = frameReleaseFn(pmm.Frame(physAddr >> mem.PageShift)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// setupVmallocRegion allocates the page table that covers the vmalloc region
+// so that the mappings established by AllocPages become visible to all
+// address spaces that share the kernel page tables.
+func setupVmallocRegion() *kernel.Error {
+	var err *kernel.Error
+
+	walk(VmallocBase, func(_ uint8, pte *pageTableEntry) bool {
+		if !pte.HasFlags(FlagPresent) {
+			err = allocPageTable(0, pte)
+		}
+		return false
+	})
+
+	return err
+}
@@ -0,0 +1,284 @@
+package vmm
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/mem"
+	"gopheros/kernel/mem/pmm"
+	"testing"
+	"unsafe"
+)
+
+func TestAllocFreePages(t *testing.T) {
+	defer resetVmallocMocks()
+	mapped, released := mockVmalloc()
+
+	specs := []struct {
+		pageCount uint32
+		expAddr   uintptr
+	}{
+		{2, VmallocBase},
+		// Areas are separated by a guard page
+		{1, VmallocBase + 3*uintptr(mem.PageSize)},
+	}
+
+	for specIndex, spec := range specs {
+		addr, err := AllocPages(spec.pageCount)
+		if err != nil {
+			t.Fatalf("[spec %d] unexpected error: %v", specIndex, err)
+		}
+
+		if addr != spec.expAddr {
+			t.Errorf("[spec %d] expected area address to be 0x%x; got 0x%x", specIndex, spec.expAddr, addr)
+		}
+	}
+
+	if exp, got := 3, len(mapped); got != exp {
+		t.Fatalf("expected %d pages to be mapped; got %d", exp, got)
+	}
+
+	if err := FreePages(VmallocBase); err != nil {
+		t.Fatal(err)
+	}
+
+	if exp, got := 1, len(mapped); got != exp {
+		t.Fatalf("expected %d page to remain mapped; got %d", exp, got)
+	}
+
+	if exp, got := 2, len(*released); got != exp {
+		t.Fatalf("expected %d frames to be released; got %d", exp, got)
+	}
+
+	// The gap left by the released area should be reused if possible
+	specs = []struct {
+		pageCount uint32
+		expAddr   uintptr
+	}{
+		{3, VmallocBase + 5*uintptr(mem.PageSize)},
+		{2, VmallocBase},
+	}
+
+	for specIndex, spec := range specs {
+		addr, err := AllocPages(spec.pageCount)
+		if err != nil {
+			t.Fatalf("[spec %d] unexpected error: %v", specIndex, err)
+		}
+
+		if addr != spec.expAddr {
+			t.Errorf("[spec %d] expected area address to be 0x%x; got 0x%x", specIndex, spec.expAddr, addr)
+		}
+	}
+
+	for index := 1; index < vmallocAreaCount; index++ {
+		if vmallocAreas[index-1].end() > vmallocAreas[index].start {
+			t.Fatalf("expected vmalloc areas to be sorted and not overlap; got %v", vmallocAreas[:vmallocAreaCount])
+		}
+	}
+
+	if err := FreePages(VmallocBase + uintptr(mem.PageSize)); err != errVmallocInvalidAddress {
+		t.Fatalf("expected error %v; got %v", errVmallocInvalidAddress, err)
+	}
+}
+
+func TestAllocPagesErrors(t *testing.T) {
+	defer resetVmallocMocks()
+	mapped, released := mockVmalloc()
+
+	if _, err := AllocPages(0); err != errVmallocInvalidPageCount {
+		t.Fatalf("expected error %v; got %v", errVmallocInvalidPageCount, err)
+	}
+
+	if _, err := AllocPages(uint32(VmallocSize >> mem.PageShift)); err != errVmallocNoSpace {
+		t.Fatalf("expected error %v; got %v", errVmallocNoSpace, err)
+	}
+
+	vmallocAreaCount = maxVmallocAreas
+	if _, err := AllocPages(1); err != errVmallocTooManyAreas {
+		t.Fatalf("expected error %v; got %v", errVmallocTooManyAreas, err)
+	}
+	vmallocAreaCount = 0
+
+	expErr := &kernel.Error{Module: "test", Message: "something went wrong"}
+
+	t.Run("frame allocation fails", func(t *testing.T) {
+		allocCount := 0
+		SetFrameAllocator(func() (pmm.Frame, *kernel.Error) {
+			if allocCount++; allocCount == 3 {
+				return pmm.InvalidFrame, expErr
+			}
+			return pmm.Frame(allocCount), nil
+		})
+
+		if _, err := AllocPages(4); err != expErr {
+			t.Fatalf("expected error %v; got %v", expErr, err)
+		}
+
+		if len(mapped) != 0 || len(*released) != 2 {
+			t.Fatalf("expected the already mapped pages to be released; %d pages still mapped, %d frames released", len(mapped), len(*released))
+		}
+
+		if vmallocAreaCount != 0 {
+			t.Fatal("expected failed allocation not to be tracked")
+		}
+	})
+
+	t.Run("map fails", func(t *testing.T) {
+		*released = (*released)[:0]
+		SetFrameAllocator(func() (pmm.Frame, *kernel.Error) {
+			return pmm.Frame(42), nil
+		})
+		mapFn = func(_ Page, _ pmm.Frame, _ PageTableEntryFlag) *kernel.Error {
+			return expErr
+		}
+
+		if _, err := AllocPages(1); err != expErr {
+			t.Fatalf("expected error %v; got %v", expErr, err)
+		}
+
+		if len(*released) != 1 || (*released)[0] != pmm.Frame(42) {
+			t.Fatalf("expected frame 42 to be released; got %v", *released)
+		}
+	})
+}
+
+func TestFreePagesErrors(t *testing.T) {
+	defer resetVmallocMocks()
+
+	expErr := &kernel.Error{Module: "test", Message: "something went wrong"}
+
+	specs := []struct {
+		descr string
+		setup func()
+	}{
+		{
+			"translate fails",
+			func() {
+				translateFn = func(_ uintptr) (uintptr, *kernel.Error) { return 0, expErr }
+			},
+		},
+		{
+			"unmap fails",
+			func() {
+				unmapFn = func(_ Page) *kernel.Error { return expErr }
+			},
+		},
+		{
+			"releasing frame fails",
+			func() {
+				frameReleaseFn = func(_ pmm.Frame) *kernel.Error { return expErr }
+			},
+		},
+	}
+
+	for specIndex, spec := range specs {
+		mockVmalloc()
+		addr, err := AllocPages(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		spec.setup()
+		if err = FreePages(addr); err != expErr {
+			t.Errorf("[spec %d] %s: expected error %v; got %v", specIndex, spec.descr, expErr, err)
+		}
+	}
+
+	// Without a registered frame release function, pages are only unmapped
+	mockVmalloc()
+	frameReleaseFn = nil
+	addr, err := AllocPages(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = FreePages(addr); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSetupVmallocRegion(t *testing.T) {
+	defer func(origPtePtr func(uintptr) unsafe.Pointer, origNextAddrFn func(uintptr) uintptr) {
+		ptePtrFn = origPtePtr
+		nextAddrFn = origNextAddrFn
+		frameAllocator = nil
+	}(ptePtrFn, nextAddrFn)
+
+	var (
+		pte       pageTableEntry
+		tableBuf  = make([]byte, 2*mem.PageSize)
+		tableAddr = (uintptr(unsafe.Pointer(&tableBuf[0])) + uintptr(mem.PageSize-1)) &^ uintptr(mem.PageSize-1)
+		walkCount int
+	)
+
+	*(*uint64)(unsafe.Pointer(tableAddr)) = 0xbadf00d
+	ptePtrFn = func(_ uintptr) unsafe.Pointer {
+		walkCount++
+		return unsafe.Pointer(&pte)
+	}
+	nextAddrFn = func(_ uintptr) uintptr { return tableAddr }
+	SetFrameAllocator(func() (pmm.Frame, *kernel.Error) {
+		return pmm.Frame(tableAddr >> mem.PageShift), nil
+	})
+
+	if err := setupVmallocRegion(); err != nil {
+		t.Fatal(err)
+	}
+
+	if exp := 1; walkCount != exp {
+		t.Fatalf("expected only the top-level entry to be visited; visited %d entries", walkCount)
+	}
+
+	if !pte.HasFlags(FlagPresent|FlagRW) || pte.Frame() != pmm.Frame(tableAddr>>mem.PageShift) {
+		t.Fatalf("expected top-level entry to point to the allocated table; got %x", pte)
+	}
+
+	if got := *(*uint64)(unsafe.Pointer(tableAddr)); got != 0 {
+		t.Fatalf("expected allocated table to be cleared; got %x", got)
+	}
+}
+
+// mockVmalloc mocks the frame allocator and the map, unmap, translate and
+// frame release calls used by AllocPages and FreePages. It returns the set of
+// mapped pages and a pointer to the list of released frames.
+func mockVmalloc() (map[Page]pmm.Frame, *[]pmm.Frame) {
+	var (
+		mapped    = make(map[Page]pmm.Frame)
+		released  = new([]pmm.Frame)
+		nextFrame pmm.Frame
+	)
+
+	vmallocAreaCount = 0
+	SetFrameAllocator(func() (pmm.Frame, *kernel.Error) {
+		nextFrame++
+		return nextFrame, nil
+	})
+	mapFn = func(page Page, frame pmm.Frame, _ PageTableEntryFlag) *kernel.Error {
+		mapped[page] = frame
+		return nil
+	}
+	unmapFn = func(page Page) *kernel.Error {
+		delete(mapped, page)
+		return nil
+	}
+	translateFn = func(addr uintptr) (uintptr, *kernel.Error) {
+		frame, ok := mapped[PageFromAddress(addr)]
+		if !ok {
+			return 0, ErrInvalidMapping
+		}
+		return frame.Address(), nil
+	}
+	frameReleaseFn = func(frame pmm.Frame) *kernel.Error {
+		*released = append(*released, frame)
+		return nil
+	}
+
+	return mapped, released
+}
+
+func resetVmallocMocks() {
+	frameAllocator = nil
+	frameReleaseFn = nil
+	mapFn = Map
+	unmapFn = Unmap
+	translateFn = Translate
+	vmallocAreaCount = 0
+}
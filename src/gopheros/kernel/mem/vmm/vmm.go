@@ -16,14 +16,24 @@ var (
 	// SetFrameAllocator.
 	frameAllocator FrameAllocatorFn
 
+	// frameShareFn, frameReleaseFn and frameRefCountFn point to the frame
+	// reference counting functions registered using SetFrameRefCounter.
+	frameShareFn    FrameRefFn
+	frameReleaseFn  FrameRefFn
+	frameRefCountFn FrameRefCountFn
+
 	// the following functions are mocked by tests and are automatically
 	// inlined by the compiler.
 	handleExceptionWithCodeFn = irq.HandleExceptionWithCode
 	readCR2Fn                 = cpu.ReadCR2
 	translateFn               = Translate
 	visitElfSectionsFn        = multiboot.VisitElfSections
+	allocKernelStackFn        = AllocKernelStack
+	loadTSSFn                 = cpu.LoadTSS
+	setISTFn                  = irq.SetIST
 
 	errUnrecoverableFault = &kernel.Error{Module: "vmm", Message: "page/gpf fault"}
+	errDoubleFault        = &kernel.Error{Module: "vmm", Message: "double fault"}
 )
 
 // FrameAllocatorFn is a function that can allocate physical frames.
@@ -35,6 +45,21 @@ func SetFrameAllocator(allocFn FrameAllocatorFn) {
 	frameAllocator = allocFn
 }
 
+// FrameRefFn is a function that adds or drops a reference to a physical frame.
+type FrameRefFn func(pmm.Frame) *kernel.Error
+
+// FrameRefCountFn is a function that returns the number of references to a
+// physical frame.
+type FrameRefCountFn func(pmm.Frame) uint32
+
+// SetFrameRefCounter registers the functions that will be used by the vmm code
+// for tracking physical frames that are shared by copy-on-write mappings.
+func SetFrameRefCounter(shareFn, releaseFn FrameRefFn, refCountFn FrameRefCountFn) {
+	frameShareFn = shareFn
+	frameReleaseFn = releaseFn
+	frameRefCountFn = refCountFn
+}
+
 func pageFaultHandler(errorCode uint64, frame *irq.Frame, regs *irq.Regs) {
 	var (
 		faultAddress = uintptr(readCR2Fn())
@@ -42,6 +67,28 @@ func pageFaultHandler(errorCode uint64, frame *irq.Frame, regs *irq.Regs) {
 		pageEntry    *pageTableEntry
 	)
 
+	// Populate pages that belong to on-demand regions on first access. A
+	// cleared bit 0 in the error code indicates a non-present page.
+	if errorCode&1 == 0 && isLazyAddress(faultAddress) {
+		if err := faultInPage(faultPage); err != nil {
+			nonRecoverablePageFault(faultAddress, errorCode, frame, regs, err)
+		}
+
+		// Fault recovered; retry the instruction that caused the fault
+		return
+	}
+
+	// Populate pages that belong to anonymous memory regions
+	if as := addrSpaceForFault(faultAddress); errorCode&1 == 0 && as != nil {
+		if handled, err := as.handleRegionFault(faultAddress, errorCode); handled {
+			if err != nil {
+				nonRecoverablePageFault(faultAddress, errorCode, frame, regs, err)
+			}
+
+			return
+		}
+	}
+
 	// Lookup entry for the page where the fault occurred
 	walk(faultPage.Address(), func(pteLevel uint8, pte *pageTableEntry) bool {
 		nextIsPresent := pte.HasFlags(FlagPresent)
@@ -54,14 +101,25 @@ func pageFaultHandler(errorCode uint64, frame *irq.Frame, regs *irq.Regs) {
 		return nextIsPresent
 	})
 
-	// CoW is supported for RO pages with the CoW flag set
-	if pageEntry != nil && !pageEntry.HasFlags(FlagRW) && pageEntry.HasFlags(FlagCopyOnWrite) {
+	// CoW is supported for RO pages with the CoW flag set as long as the
+	// region they belong to (if any) allows writes.
+	if pageEntry != nil && !pageEntry.HasFlags(FlagRW) && pageEntry.HasFlags(FlagCopyOnWrite) && regionAllowsWrite(faultAddress) {
 		var (
-			copy    pmm.Frame
-			tmpPage Page
-			err     *kernel.Error
+			origFrame = pageEntry.Frame()
+			copy      pmm.Frame
+			tmpPage   Page
+			err       *kernel.Error
 		)
 
+		// If no other mapping references the frame we can simply make the
+		// mapping writable instead of copying the page contents.
+		if origFrame != ReservedZeroedFrame && frameRefCountFn != nil && frameRefCountFn(origFrame) == 1 {
+			pageEntry.ClearFlags(FlagCopyOnWrite)
+			pageEntry.SetFlags(FlagPresent | FlagRW)
+			shootdownPage(faultPage.Address())
+			return
+		}
+
 		if copy, err = frameAllocator(); err != nil {
 			nonRecoverablePageFault(faultAddress, errorCode, frame, regs, err)
 		} else if tmpPage, err = mapTemporaryFn(copy); err != nil {
@@ -76,7 +134,14 @@ func pageFaultHandler(errorCode uint64, frame *irq.Frame, regs *irq.Regs) {
 			pageEntry.ClearFlags(FlagCopyOnWrite)
 			pageEntry.SetFlags(FlagPresent | FlagRW)
 			pageEntry.SetFrame(copy)
-			flushTLBEntryFn(faultPage.Address())
+			shootdownPage(faultPage.Address())
+
+			// Drop the reference to the original frame
+			if origFrame != ReservedZeroedFrame && frameReleaseFn != nil {
+				if err = frameReleaseFn(origFrame); err != nil {
+					nonRecoverablePageFault(faultAddress, errorCode, frame, regs, err)
+				}
+			}
 
 			// Fault recovered; retry the instruction that caused the fault
 			return
@@ -88,7 +153,9 @@ func pageFaultHandler(errorCode uint64, frame *irq.Frame, regs *irq.Regs) {
 
 func nonRecoverablePageFault(faultAddress uintptr, errorCode uint64, frame *irq.Frame, regs *irq.Regs, err *kernel.Error) {
 	kfmt.Printf("\nPage fault while accessing address: 0x%16x\nReason: ", faultAddress)
-	switch {
+	switch stack := stackForGuardPage(faultAddress); {
+	case stack != nil:
+		kfmt.Printf("kernel stack overflow (stack: %s)", stack.Name)
 	case errorCode == 0:
 		kfmt.Printf("read from non-present page")
 	case errorCode == 1:
@@ -125,6 +192,24 @@ func generalProtectionFaultHandler(_ uint64, frame *irq.Frame, regs *irq.Regs) {
 	panic(errUnrecoverableFault)
 }
 
+// doubleFaultHandler runs on a dedicated stack so it can report faults that
+// occur while the CPU is unable to deliver an exception on the current stack,
+// e.g. when a kernel stack overflows into its guard page.
+func doubleFaultHandler(_ uint64, frame *irq.Frame, regs *irq.Regs) {
+	faultAddress := uintptr(readCR2Fn())
+	if stack := stackForGuardPage(faultAddress); stack != nil {
+		kfmt.Printf("\nKernel stack overflow (stack: %s) while accessing address: 0x%16x\n", stack.Name, faultAddress)
+	} else {
+		kfmt.Printf("\nDouble fault\n")
+	}
+
+	kfmt.Printf("Registers:\n")
+	regs.Print()
+	frame.Print()
+
+	panic(errDoubleFault)
+}
+
 // reserveZeroedFrame reserves a physical frame to be used together with
 // FlagCopyOnWrite for lazy allocation requests.
 func reserveZeroedFrame() *kernel.Error {
@@ -146,26 +231,45 @@ func reserveZeroedFrame() *kernel.Error {
 	return nil
 }
 
-// Init initializes the vmm system, creates a granular PDT for the kernel and
-// installs paging-related exception handlers.
+// Init initializes the vmm system, programs the page attribute table, creates
+// a granular PDT for the kernel, maps the system's physical memory to a
+// randomized physmap location, sets up the double fault stack and installs
+// paging-related exception handlers.
 func Init(kernelPageOffset uintptr) *kernel.Error {
+	patInitFn()
+
 	if err := setupPDTForKernel(kernelPageOffset); err != nil {
 		return err
 	}
 
+	randomizeLayout()
+	if err := setupPhysMap(); err != nil {
+		return err
+	}
+
+	if err := setupVmallocRegion(); err != nil {
+		return err
+	}
+
 	if err := reserveZeroedFrame(); err != nil {
 		return err
 	}
 
+	if err := setupDoubleFaultStack(); err != nil {
+		return err
+	}
+
 	handleExceptionWithCodeFn(irq.PageFaultException, pageFaultHandler)
 	handleExceptionWithCodeFn(irq.GPFException, generalProtectionFaultHandler)
+	handleExceptionWithCodeFn(irq.DoubleFault, doubleFaultHandler)
 	return nil
 }
 
 // setupPDTForKernel queries the multiboot package for the ELF sections that
 // correspond to the loaded kernel image and establishes a new granular PDT for
 // the kernel's VMA using the appropriate flags (e.g. NX for data sections, RW
-// for writable sections e.t.c).
+// for writable sections e.t.c). The read-only sections are tracked so they can
+// be later write-protected via ProtectKernelImage.
 func setupPDTForKernel(kernelPageOffset uintptr) *kernel.Error {
 	var pdt PageDirectoryTable
 
@@ -179,6 +283,8 @@ func setupPDTForKernel(kernelPageOffset uintptr) *kernel.Error {
 		return err
 	}
 
+	kernelROSectionCount = 0
+
 	// Query the ELF sections of the kernel image and establish mappings
 	// for each one using the appropriate flags
 	pageSizeMinus1 := uint64(mem.PageSize - 1)
@@ -190,21 +296,28 @@ func setupPDTForKernel(kernelPageOffset uintptr) *kernel.Error {
 		}
 
 		flags := FlagPresent
-
-		if (secFlags & multiboot.ElfSectionExecutable) == 0 {
-			flags |= FlagNoExecute
-		}
-
-		if (secFlags & multiboot.ElfSectionWritable) != 0 {
-			flags |= FlagRW
-		}
+		executable := (secFlags & multiboot.ElfSectionExecutable) != 0
 
 		// We assume that all sections are page-aligned by the linker script
 		curPage := PageFromAddress(secAddress)
 		curFrame := pmm.Frame((secAddress - kernelPageOffset) >> mem.PageShift)
 		endFrame := curFrame + pmm.Frame(((secSize+pageSizeMinus1) & ^pageSizeMinus1)>>mem.PageShift)
+
+		// Read-only sections are tracked so that their physmap aliases
+		// can be write-protected by ProtectKernelImage
+		if (secFlags & multiboot.ElfSectionWritable) != 0 {
+			flags |= FlagRW
+		} else if err = trackKernelROSection(curPage, curFrame, uint32(endFrame-curFrame), executable); err != nil {
+			return
+		}
 		for ; curFrame < endFrame; curFrame, curPage = curFrame+1, curPage+1 {
-			if err = pdt.Map(curPage, curFrame, flags); err != nil {
+			if executable {
+				err = pdt.MapExecutable(curPage, curFrame, flags)
+			} else {
+				err = pdt.Map(curPage, curFrame, flags)
+			}
+
+			if err != nil {
 				return
 			}
 		}
@@ -240,6 +353,10 @@ func setupPDTForKernel(kernelPageOffset uintptr) *kernel.Error {
 	// physical memory addresses where the kernel is loaded becomes invalid.
 	pdt.Activate()
 
+	// The new PDT becomes the kernel address space
+	kernelAddrSpace.pdt = pdt
+	activeAddrSpace = &kernelAddrSpace
+
 	return nil
 }
 
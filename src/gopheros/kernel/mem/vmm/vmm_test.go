@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"gopheros/kernel"
 	"gopheros/kernel/cpu"
+	"gopheros/kernel/cpu/pat"
 	"gopheros/kernel/hal/multiboot"
 	"gopheros/kernel/irq"
 	"gopheros/kernel/kfmt"
@@ -99,6 +100,98 @@ func TestRecoverablePageFault(t *testing.T) {
 
 }
 
+func TestCopyOnWriteRefCounts(t *testing.T) {
+	var (
+		frame      irq.Frame
+		regs       irq.Regs
+		pageEntry  pageTableEntry
+		origPage   = make([]byte, mem.PageSize)
+		clonedPage = make([]byte, mem.PageSize)
+		origFrame  = pmm.Frame(uintptr(unsafe.Pointer(&origPage[0])) >> mem.PageShift)
+	)
+
+	defer func(origPtePtr func(uintptr) unsafe.Pointer) {
+		ptePtrFn = origPtePtr
+		readCR2Fn = cpu.ReadCR2
+		frameAllocator = nil
+		mapTemporaryFn = MapTemporary
+		unmapFn = Unmap
+		flushTLBEntryFn = cpu.FlushTLBEntry
+		SetFrameRefCounter(nil, nil, nil)
+	}(ptePtrFn)
+
+	ptePtrFn = func(entry uintptr) unsafe.Pointer { return unsafe.Pointer(&pageEntry) }
+	readCR2Fn = func() uint64 { return uint64(uintptr(unsafe.Pointer(&origPage[0]))) }
+	mapTemporaryFn = func(f pmm.Frame) (Page, *kernel.Error) { return Page(f), nil }
+	unmapFn = func(_ Page) *kernel.Error { return nil }
+	flushTLBEntryFn = func(_ uintptr) {}
+	SetFrameAllocator(func() (pmm.Frame, *kernel.Error) {
+		return pmm.Frame(uintptr(unsafe.Pointer(&clonedPage[0])) >> mem.PageShift), nil
+	})
+
+	specs := []struct {
+		refCount   uint32
+		releaseErr *kernel.Error
+		expCopy    bool
+		expRelease bool
+		expPanic   bool
+	}{
+		// Frame is not shared; the mapping should be made writable in place
+		{1, nil, false, false, false},
+		// Frame is shared; the page should be copied and the original released
+		{2, nil, true, true, false},
+		// Frame is shared but releasing the original frame fails
+		{2, &kernel.Error{Module: "test", Message: "something went wrong"}, true, true, true},
+	}
+
+	for specIndex, spec := range specs {
+		t.Run(fmt.Sprint(specIndex), func(t *testing.T) {
+			var releasedFrame = pmm.InvalidFrame
+
+			SetFrameRefCounter(
+				nil,
+				func(f pmm.Frame) *kernel.Error {
+					releasedFrame = f
+					return spec.releaseErr
+				},
+				func(f pmm.Frame) uint32 {
+					if f != origFrame {
+						t.Errorf("expected ref count to be queried for frame %d; got %d", origFrame, f)
+					}
+					return spec.refCount
+				},
+			)
+
+			defer func() {
+				err := recover()
+				if spec.expPanic != (err != nil) {
+					t.Errorf("expected panic: %t; got %v", spec.expPanic, err)
+				}
+
+				if spec.expRelease && releasedFrame != origFrame {
+					t.Errorf("expected frame %d to be released; got %d", origFrame, releasedFrame)
+				} else if !spec.expRelease && releasedFrame != pmm.InvalidFrame {
+					t.Errorf("expected no frame to be released; got %d", releasedFrame)
+				}
+			}()
+
+			pageEntry = 0
+			pageEntry.SetFlags(FlagPresent | FlagCopyOnWrite)
+			pageEntry.SetFrame(origFrame)
+
+			pageFaultHandler(2, &frame, &regs)
+
+			if !pageEntry.HasFlags(FlagPresent|FlagRW) || pageEntry.HasFlags(FlagCopyOnWrite) {
+				t.Error("expected page entry to be writable and not have FlagCopyOnWrite set")
+			}
+
+			if gotCopy := pageEntry.Frame() != origFrame; gotCopy != spec.expCopy {
+				t.Errorf("expected page to be copied: %t; got %t", spec.expCopy, gotCopy)
+			}
+		})
+	}
+}
+
 func TestNonRecoverablePageFault(t *testing.T) {
 	defer func() {
 		kfmt.SetOutputSink(nil)
@@ -190,7 +283,8 @@ func TestGPFHandler(t *testing.T) {
 }
 
 func TestInit(t *testing.T) {
-	defer func() {
+	defer func(origPtePtr func(uintptr) unsafe.Pointer) {
+		ptePtrFn = origPtePtr
 		frameAllocator = nil
 		activePDTFn = cpu.ActivePDT
 		switchPDTFn = cpu.SwitchPDT
@@ -198,7 +292,33 @@ func TestInit(t *testing.T) {
 		mapTemporaryFn = MapTemporary
 		unmapFn = Unmap
 		handleExceptionWithCodeFn = irq.HandleExceptionWithCode
-	}()
+		patInitFn = pat.Init
+		hasRDRANDFn = cpu.HasRDRAND
+		readTSCFn = cpu.ReadTSC
+		physMapBase = PhysMapBase
+		allocKernelStackFn = AllocKernelStack
+		loadTSSFn = cpu.LoadTSS
+		setISTFn = irq.SetIST
+	}(ptePtrFn)
+
+	// Init would otherwise attempt to access the PAT MSR
+	patInitFn = func() {}
+
+	// Init would otherwise attempt to load the TSS and update the IDT
+	allocKernelStackFn = func(name string, _ mem.Size) (KernelStack, *kernel.Error) {
+		return KernelStack{Name: name}, nil
+	}
+	loadTSSFn = func(_ []uintptr) {}
+	setISTFn = func(_ irq.ExceptionNum, _ uint8) {}
+
+	// Use a predictable physmap location
+	hasRDRANDFn = func() bool { return false }
+	readTSCFn = func() uint64 { return 0 }
+
+	// Emulate an already allocated page table for the vmalloc region
+	var vmallocPte pageTableEntry
+	vmallocPte.SetFlags(FlagPresent | FlagRW)
+	ptePtrFn = func(_ uintptr) unsafe.Pointer { return unsafe.Pointer(&vmallocPte) }
 
 	// reserve space for an allocated page
 	reservedPage := make([]byte, mem.PageSize)
@@ -249,6 +369,65 @@ func TestInit(t *testing.T) {
 		}
 	})
 
+	t.Run("physmap setup fails", func(t *testing.T) {
+		defer func() {
+			mapHugeFn = MapHuge
+			memoryMapFn = pmm.MemoryMap
+		}()
+
+		expErr := &kernel.Error{Module: "test", Message: "map failed"}
+
+		SetFrameAllocator(func() (pmm.Frame, *kernel.Error) {
+			addr := uintptr(unsafe.Pointer(&reservedPage[0]))
+			return pmm.Frame(addr >> mem.PageShift), nil
+		})
+		activePDTFn = func() uintptr {
+			return uintptr(unsafe.Pointer(&reservedPage[0]))
+		}
+		switchPDTFn = func(_ uintptr) {}
+		memoryMapFn = func() []pmm.Region {
+			return []pmm.Region{
+				{PhysAddress: 0, Size: HugePageSize2M, Type: pmm.RegionUsable},
+			}
+		}
+		mapHugeFn = func(_ Page, _ pmm.Frame, _ mem.Size, _ PageTableEntryFlag) *kernel.Error {
+			return expErr
+		}
+
+		if err := Init(0); err != expErr {
+			t.Fatalf("expected error: %v; got %v", expErr, err)
+		}
+	})
+
+	t.Run("vmalloc region setup fails", func(t *testing.T) {
+		defer func() { vmallocPte.SetFlags(FlagPresent) }()
+
+		expErr := &kernel.Error{Module: "test", Message: "out of memory"}
+
+		// Allow the PDT allocation to succeed and then return an error when
+		// trying to allocate the vmalloc page table
+		var allocCount int
+		SetFrameAllocator(func() (pmm.Frame, *kernel.Error) {
+			defer func() { allocCount++ }()
+
+			if allocCount == 0 {
+				addr := uintptr(unsafe.Pointer(&reservedPage[0]))
+				return pmm.Frame(addr >> mem.PageShift), nil
+			}
+
+			return pmm.InvalidFrame, expErr
+		})
+		activePDTFn = func() uintptr {
+			return uintptr(unsafe.Pointer(&reservedPage[0]))
+		}
+		switchPDTFn = func(_ uintptr) {}
+		vmallocPte.ClearFlags(FlagPresent)
+
+		if err := Init(0); err != expErr {
+			t.Fatalf("expected error: %v; got %v", expErr, err)
+		}
+	})
+
 	t.Run("blank page allocation error", func(t *testing.T) {
 		expErr := &kernel.Error{Module: "test", Message: "out of memory"}
 
@@ -278,6 +457,34 @@ func TestInit(t *testing.T) {
 		}
 	})
 
+	t.Run("double fault stack allocation error", func(t *testing.T) {
+		defer func() {
+			allocKernelStackFn = func(name string, _ mem.Size) (KernelStack, *kernel.Error) {
+				return KernelStack{Name: name}, nil
+			}
+		}()
+
+		expErr := &kernel.Error{Module: "test", Message: "out of memory"}
+
+		SetFrameAllocator(func() (pmm.Frame, *kernel.Error) {
+			addr := uintptr(unsafe.Pointer(&reservedPage[0]))
+			return pmm.Frame(addr >> mem.PageShift), nil
+		})
+		activePDTFn = func() uintptr {
+			return uintptr(unsafe.Pointer(&reservedPage[0]))
+		}
+		switchPDTFn = func(_ uintptr) {}
+		unmapFn = func(p Page) *kernel.Error { return nil }
+		mapTemporaryFn = func(f pmm.Frame) (Page, *kernel.Error) { return Page(f), nil }
+		allocKernelStackFn = func(_ string, _ mem.Size) (KernelStack, *kernel.Error) {
+			return KernelStack{}, expErr
+		}
+
+		if err := Init(0); err != expErr {
+			t.Fatalf("expected error: %v; got %v", expErr, err)
+		}
+	})
+
 	t.Run("blank page mapping error", func(t *testing.T) {
 		expErr := &kernel.Error{Module: "test", Message: "map failed"}
 
@@ -306,9 +513,11 @@ func TestSetupPDTForKernel(t *testing.T) {
 		switchPDTFn = cpu.SwitchPDT
 		translateFn = Translate
 		mapFn = Map
+		mapExecutableFn = MapExecutable
 		mapTemporaryFn = MapTemporary
 		unmapFn = Unmap
 		earlyReserveLastUsed = tempMappingAddr
+		kernelROSectionCount = 0
 	}()
 
 	// reserve space for an allocated page
@@ -336,21 +545,34 @@ func TestSetupPDTForKernel(t *testing.T) {
 			v(".rodata", 0, 0xbadc0ffee, uint64(mem.PageSize<<1))
 		}
 		mapCount := 0
+		mapExecutableFn = func(page Page, frame pmm.Frame, flags PageTableEntryFlag) *kernel.Error {
+			defer func() { mapCount++ }()
+
+			if mapCount != 0 {
+				t.Errorf("[map call %d] expected only the .text section to be mapped as executable", mapCount)
+			}
+
+			if exp := FlagPresent; flags != exp {
+				t.Errorf("[map call %d] expected flags to be %d; got %d", mapCount, exp, flags)
+			}
+
+			return nil
+		}
 		mapFn = func(page Page, frame pmm.Frame, flags PageTableEntryFlag) *kernel.Error {
 			defer func() { mapCount++ }()
 
 			var expFlags PageTableEntryFlag
 
 			switch mapCount {
-			case 0:
-				expFlags = FlagPresent
 			case 1:
-				expFlags = FlagPresent | FlagNoExecute | FlagRW
+				expFlags = FlagPresent | FlagRW
 			case 2, 3:
-				expFlags = FlagPresent | FlagNoExecute
+				expFlags = FlagPresent
+			default:
+				t.Errorf("[map call %d] expected the .text section to be mapped as executable", mapCount)
 			}
 
-			if (flags & expFlags) != expFlags {
+			if flags != expFlags {
 				t.Errorf("[map call %d] expected flags to be %d; got %d", mapCount, expFlags, flags)
 			}
 
@@ -364,6 +586,42 @@ func TestSetupPDTForKernel(t *testing.T) {
 		if exp := 4; mapCount != exp {
 			t.Errorf("expected Map to be called %d times; got %d", exp, mapCount)
 		}
+
+		// The .text and .rodata sections should be tracked as read-only
+		if exp := 2; kernelROSectionCount != exp {
+			t.Fatalf("expected %d read-only sections to be tracked; got %d", exp, kernelROSectionCount)
+		}
+
+		if sec := kernelROSections[0]; !sec.executable || sec.pageCount != 1 {
+			t.Errorf("expected .text section to be tracked as an executable section with 1 page; got %+v", sec)
+		}
+
+		if sec := kernelROSections[1]; sec.executable || sec.pageCount != 2 {
+			t.Errorf("expected .rodata section to be tracked as a non-executable section with 2 pages; got %+v", sec)
+		}
+	})
+
+	t.Run("too many read-only kernel sections", func(t *testing.T) {
+		defer func() { visitElfSectionsFn = multiboot.VisitElfSections }()
+
+		SetFrameAllocator(func() (pmm.Frame, *kernel.Error) {
+			addr := uintptr(unsafe.Pointer(&reservedPage[0]))
+			return pmm.Frame(addr >> mem.PageShift), nil
+		})
+		activePDTFn = func() uintptr {
+			return uintptr(unsafe.Pointer(&reservedPage[0]))
+		}
+		mapTemporaryFn = func(f pmm.Frame) (Page, *kernel.Error) { return Page(f), nil }
+		visitElfSectionsFn = func(v multiboot.ElfSectionVisitor) {
+			for index := 0; index <= maxKernelROSections; index++ {
+				v(".rodata", 0, 0xbadc0ffee, uint64(mem.PageSize))
+			}
+		}
+		mapFn = func(_ Page, _ pmm.Frame, _ PageTableEntryFlag) *kernel.Error { return nil }
+
+		if err := setupPDTForKernel(0); err != errTooManyKernelSections {
+			t.Fatalf("expected error: %v; got %v", errTooManyKernelSections, err)
+		}
 	})
 
 	t.Run("map of kernel sections fials", func(t *testing.T) {
@@ -383,7 +641,7 @@ func TestSetupPDTForKernel(t *testing.T) {
 		visitElfSectionsFn = func(v multiboot.ElfSectionVisitor) {
 			v(".text", multiboot.ElfSectionExecutable, 0xbadc0ffee, uint64(mem.PageSize>>1))
 		}
-		mapFn = func(page Page, frame pmm.Frame, flags PageTableEntryFlag) *kernel.Error {
+		mapExecutableFn = func(page Page, frame pmm.Frame, flags PageTableEntryFlag) *kernel.Error {
 			return expErr
 		}
 
@@ -0,0 +1,111 @@
+// Package nmi handles non-maskable interrupts.
+//
+// NMIs are raised by the chipset to report fatal hardware errors (memory
+// parity errors and I/O channel checks) and, when the NMI watchdog is
+// enabled, by a performance counter or an external source to periodically
+// check that each CPU is making progress. Since NMIs cannot be masked, the
+// watchdog is able to detect CPUs that hang with interrupts disabled.
+package nmi
+
+import (
+	"gopheros/device"
+	"gopheros/kernel"
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/irq"
+	"gopheros/kernel/kfmt"
+	"gopheros/kernel/time"
+)
+
+const (
+	// The NMI reason is reported by system control port B.
+	sysCtrlPortB       = 0x61
+	reasonIOCheck      = 1 << 6
+	reasonParityErr    = 1 << 7
+	reasonHardwareMask = reasonIOCheck | reasonParityErr
+
+	defaultWatchdogTimeoutSecs = 10
+)
+
+var (
+	// unknownCount tracks the number of NMIs that could not be attributed
+	// to a hardware error or to the watchdog.
+	unknownCount uint64
+
+	// The following functions are used by tests to mock calls to the irq,
+	// device and cpu packages.
+	handleExceptionFn = irq.HandleException
+	paramStringFn     = device.ParamString
+	paramIntFn        = device.ParamInt
+	portReadByteFn    = cpu.PortReadByte
+
+	errParityError = &kernel.Error{Module: "nmi", Message: "memory parity error"}
+	errIOCheck     = &kernel.Error{Module: "nmi", Message: "I/O channel check error"}
+)
+
+// Init installs the NMI handler and starts the NMI watchdog if it has been
+// requested via the "nmi_watchdog" kernel command line parameter. The
+// parameter accepts the values "off" (default), "perf" and "external";
+// the watchdog timeout defaults to 10 seconds and can be changed with the
+// "nmi_watchdog_timeout" parameter.
+//
+// Init must be invoked after the clock sources and the local APIC have
+// been initialized. Failures to start the watchdog are not fatal.
+func Init() {
+	handleExceptionFn(irq.NMI, nmiHandler)
+
+	var mode WatchdogMode
+	switch name := paramStringFn("nmi_watchdog", "off"); name {
+	case "off":
+		return
+	case "perf":
+		mode = WatchdogPerfCounter
+	case "external":
+		mode = WatchdogExternal
+	default:
+		kfmt.Printf("[nmi] unknown watchdog mode \"%s\"; watchdog disabled\n", name)
+		return
+	}
+
+	timeout := time.Duration(paramIntFn("nmi_watchdog_timeout", defaultWatchdogTimeoutSecs)) * time.Second
+	if err := StartWatchdog(mode, timeout); err != nil {
+		kfmt.Printf("[nmi] watchdog: %s\n", err.Message)
+	}
+}
+
+// UnknownCount returns the number of NMIs that could not be attributed to
+// a hardware error or to the watchdog.
+func UnknownCount() uint64 {
+	return unknownCount
+}
+
+// nmiHandler determines the source of an NMI. Hardware errors are fatal;
+// watchdog NMIs check whether the interrupted CPU is making progress.
+func nmiHandler(frame *irq.Frame, regs *irq.Regs) {
+	if reason := portReadByteFn(sysCtrlPortB); reason&reasonHardwareMask != 0 {
+		hardwareError(reason, frame, regs)
+		return
+	}
+
+	if watchdogNMI(frame, regs) {
+		return
+	}
+
+	unknownCount++
+	kfmt.Printf("[nmi] ignoring NMI with unknown reason (RIP: 0x%x)\n", frame.RIP)
+}
+
+// hardwareError reports a hardware error signaled via an NMI and halts the
+// system.
+func hardwareError(reason uint8, frame *irq.Frame, regs *irq.Regs) {
+	err := errIOCheck
+	if reason&reasonParityErr != 0 {
+		err = errParityError
+	}
+
+	kfmt.Printf("\nNMI: %s (reason: 0x%2x)\n", err.Message, reason)
+	kfmt.Printf("Registers:\n")
+	regs.Print()
+	frame.Print()
+
+	panic(err)
+}
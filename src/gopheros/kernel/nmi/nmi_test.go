@@ -0,0 +1,171 @@
+package nmi
+
+import (
+	"bytes"
+	"gopheros/device"
+	"gopheros/device/intc/lapic"
+	"gopheros/kernel"
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/irq"
+	"gopheros/kernel/kfmt"
+	"gopheros/kernel/mem/percpu"
+	"gopheros/kernel/time"
+	"gopheros/kernel/timer"
+	"strings"
+	"testing"
+)
+
+func TestInit(t *testing.T) {
+	defer resetState()
+
+	var buf bytes.Buffer
+	kfmt.SetOutputSink(&buf)
+	defer kfmt.SetOutputSink(nil)
+
+	var handlerInstalled bool
+	handleExceptionFn = func(num irq.ExceptionNum, _ irq.ExceptionHandler) {
+		if num != irq.NMI {
+			t.Errorf("expected handler to be installed for exception %d; got %d", irq.NMI, num)
+		}
+		handlerInstalled = true
+	}
+	mockWatchdog(2000000000)
+
+	specs := []struct {
+		mode       string
+		timeout    int
+		expMode    WatchdogMode
+		expOutput  string
+		expTimeout uint64
+	}{
+		{"off", 0, WatchdogOff, "", 0},
+		{"bogus", 0, WatchdogOff, "[nmi] unknown watchdog mode \"bogus\"; watchdog disabled\n", 0},
+		{"external", defaultWatchdogTimeoutSecs, WatchdogExternal, "[nmi] watchdog enabled (external, timeout: 10000 ms)\n", 20000000000},
+		{"perf", 5, WatchdogPerfCounter, "[nmi] watchdog enabled (perf, timeout: 5000 ms)\n", 10000000000},
+		{"perf", 0, WatchdogOff, "[nmi] watchdog: " + errInvalidTimeout.Message + "\n", 0},
+	}
+
+	for specIndex, spec := range specs {
+		StopWatchdog()
+		handlerInstalled = false
+		paramStringFn = func(name, defValue string) string {
+			if name != "nmi_watchdog" || defValue != "off" {
+				t.Errorf("unexpected parameter lookup: %q (default %q)", name, defValue)
+			}
+			return spec.mode
+		}
+		paramIntFn = func(name string, defValue int) int {
+			if name != "nmi_watchdog_timeout" || defValue != defaultWatchdogTimeoutSecs {
+				t.Errorf("unexpected parameter lookup: %q (default %d)", name, defValue)
+			}
+			return spec.timeout
+		}
+
+		buf.Reset()
+		Init()
+
+		if !handlerInstalled {
+			t.Errorf("[spec %d] expected NMI handler to be installed", specIndex)
+		}
+
+		if got := Watchdog(); got != spec.expMode {
+			t.Errorf("[spec %d] expected watchdog mode %s; got %s", specIndex, spec.expMode.String(), got.String())
+		}
+
+		if got := buf.String(); got != spec.expOutput {
+			t.Errorf("[spec %d] expected output:\n%q\ngot:\n%q", specIndex, spec.expOutput, got)
+		}
+
+		if spec.expMode != WatchdogOff && timeoutCycles != spec.expTimeout {
+			t.Errorf("[spec %d] expected timeout to be %d cycles; got %d", specIndex, spec.expTimeout, timeoutCycles)
+		}
+	}
+}
+
+func TestHandlerHardwareErrors(t *testing.T) {
+	defer resetState()
+
+	var buf bytes.Buffer
+	kfmt.SetOutputSink(&buf)
+	defer kfmt.SetOutputSink(nil)
+
+	specs := []struct {
+		reason uint8
+		expErr *kernel.Error
+	}{
+		{reasonIOCheck, errIOCheck},
+		{reasonParityErr, errParityError},
+		{reasonIOCheck | reasonParityErr, errParityError},
+	}
+
+	for specIndex, spec := range specs {
+		portReadByteFn = func(port uint16) uint8 {
+			if port != sysCtrlPortB {
+				t.Errorf("[spec %d] unexpected read from port 0x%x", specIndex, port)
+			}
+			return spec.reason
+		}
+
+		buf.Reset()
+		func() {
+			defer func() {
+				if err := recover(); err != spec.expErr {
+					t.Errorf("[spec %d] expected a panic with %v; got %v", specIndex, spec.expErr, err)
+				}
+			}()
+
+			nmiHandler(&irq.Frame{}, &irq.Regs{})
+		}()
+
+		if exp := "NMI: " + spec.expErr.Message; !strings.Contains(buf.String(), exp) {
+			t.Errorf("[spec %d] expected output to contain %q; got %q", specIndex, exp, buf.String())
+		}
+	}
+}
+
+func TestHandlerUnknownReason(t *testing.T) {
+	defer resetState()
+
+	var buf bytes.Buffer
+	kfmt.SetOutputSink(&buf)
+	defer kfmt.SetOutputSink(nil)
+
+	portReadByteFn = func(_ uint16) uint8 { return 0 }
+
+	nmiHandler(&irq.Frame{RIP: 0xbadf00d}, &irq.Regs{})
+
+	if exp := "[nmi] ignoring NMI with unknown reason (RIP: 0xbadf00d)\n"; buf.String() != exp {
+		t.Fatalf("expected output to be %q; got %q", exp, buf.String())
+	}
+
+	if got := UnknownCount(); got != 1 {
+		t.Fatalf("expected unknown NMI count to be 1; got %d", got)
+	}
+}
+
+func resetState() {
+	StopWatchdog()
+
+	unknownCount = 0
+	tscFrequency, timeoutCycles = 0, 0
+	perfVersion, perfWidth, perfPeriod = 0, 0, 0
+	heartbeats = [percpu.MaxCPUs]uint64{}
+	lastHeartbeats = [percpu.MaxCPUs]uint64{}
+	lastProgress = [percpu.MaxCPUs]uint64{}
+
+	handleExceptionFn = irq.HandleException
+	paramStringFn = device.ParamString
+	paramIntFn = device.ParamInt
+	portReadByteFn = cpu.PortReadByte
+	cpuidFn = cpu.ID
+	readMSRFn = cpu.ReadMSR
+	writeMSRFn = cpu.WriteMSR
+	readTSCFn = cpu.ReadTSC
+	currentCPUFn = percpu.CurrentCPU
+	clockSourcesFn = time.ClockSources
+	hasEventSourceFn = timer.HasEventSource
+	startHeartbeatFn = timer.Every
+	stopHeartbeatFn = (*timer.Timer).Stop
+	enablePerfCounterNMIFn = lapic.EnablePerfCounterNMI
+	readWordFn = readWord
+}
@@ -0,0 +1,75 @@
+package nmi
+
+import (
+	"gopheros/kernel/irq"
+	"gopheros/kernel/kfmt"
+	"runtime"
+	"unsafe"
+)
+
+const (
+	// maxStackFrames bounds the number of frames printed by dumpStack.
+	maxStackFrames = 32
+
+	// maxStackScan bounds the distance between the interrupted stack
+	// pointer and any frame pointer followed by dumpStack so that a
+	// corrupted frame pointer does not cause a fault while dumping.
+	maxStackScan = 64 * 1024
+)
+
+var (
+	// readWordFn is mocked by tests and is automatically inlined by the
+	// compiler.
+	readWordFn = readWord
+)
+
+// dumpStack prints the call stack of the interrupted code by following the
+// chain of frame pointers that starts at the interrupted RBP value. Each
+// frame stores the caller's RBP followed by the return address.
+func dumpStack(frame *irq.Frame, regs *irq.Regs) {
+	printStackFrame(uintptr(frame.RIP))
+
+	var (
+		stackLo = uintptr(frame.RSP)
+		stackHi = stackLo + maxStackScan
+		fp      = uintptr(regs.RBP)
+	)
+
+	for depth := 1; depth < maxStackFrames; depth++ {
+		if fp < stackLo || fp+16 > stackHi || fp&7 != 0 {
+			return
+		}
+
+		retAddr := readWordFn(fp + 8)
+		if retAddr == 0 {
+			return
+		}
+
+		printStackFrame(retAddr)
+
+		// Frames are located at increasing addresses
+		nextFP := readWordFn(fp)
+		if nextFP <= fp {
+			return
+		}
+		fp = nextFP
+	}
+
+	kfmt.Printf("  ...\n")
+}
+
+// readWord returns the machine word stored at the supplied address.
+func readWord(addr uintptr) uintptr {
+	return *(*uintptr)(unsafe.Pointer(addr))
+}
+
+// printStackFrame prints the supplied code address and the name of the
+// function that contains it.
+func printStackFrame(pc uintptr) {
+	name := "?"
+	if fn := runtime.FuncForPC(pc); fn != nil {
+		name = fn.Name()
+	}
+
+	kfmt.Printf("  [0x%16x] %s\n", pc, name)
+}
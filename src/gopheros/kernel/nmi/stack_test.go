@@ -0,0 +1,87 @@
+package nmi
+
+import (
+	"bytes"
+	"gopheros/kernel/irq"
+	"gopheros/kernel/kfmt"
+	"runtime"
+	"strings"
+	"testing"
+	"unsafe"
+)
+
+func TestDumpStack(t *testing.T) {
+	defer resetState()
+
+	var buf bytes.Buffer
+	kfmt.SetOutputSink(&buf)
+	defer kfmt.SetOutputSink(nil)
+
+	pc, _, _, _ := runtime.Caller(0)
+	const rsp = 0x10000
+
+	specs := []struct {
+		rbp      uint64
+		stack    map[uintptr]uintptr
+		expLines []string
+	}{
+		// Two linked frames; the chain ends with a zero return address
+		{
+			rsp + 0x10,
+			map[uintptr]uintptr{
+				rsp + 0x10: rsp + 0x40, rsp + 0x18: pc,
+				rsp + 0x40: rsp + 0x80, rsp + 0x48: 0x2000,
+			},
+			[]string{"  [0x0000000000001000] ?", "TestDumpStack", "  [0x0000000000002000] ?"},
+		},
+		// The frame pointer is below the stack pointer
+		{rsp - 0x10, nil, []string{"  [0x0000000000001000] ?"}},
+		// The frame pointer is not aligned
+		{rsp + 0x11, nil, []string{"  [0x0000000000001000] ?"}},
+		// The frame pointer is past the scanned area
+		{rsp + maxStackScan, nil, []string{"  [0x0000000000001000] ?"}},
+		// The frame chain points backwards
+		{
+			rsp + 0x40,
+			map[uintptr]uintptr{rsp + 0x40: rsp + 0x10, rsp + 0x48: 0x3000},
+			[]string{"  [0x0000000000001000] ?", "  [0x0000000000003000] ?"},
+		},
+		// The frame chain is deeper than maxStackFrames
+		{
+			rsp + 0x10,
+			map[uintptr]uintptr{},
+			[]string{"  ..."},
+		},
+	}
+
+	for specIndex, spec := range specs {
+		stack := spec.stack
+		if stack != nil && len(stack) == 0 {
+			// Every frame points to the next one and returns to 0x4000
+			for fp := uintptr(rsp); fp < rsp+0x1000; fp += 0x10 {
+				stack[fp], stack[fp+8] = fp+0x10, 0x4000
+			}
+		}
+		readWordFn = func(addr uintptr) uintptr { return stack[addr] }
+
+		buf.Reset()
+		dumpStack(&irq.Frame{RIP: 0x1000, RSP: rsp}, &irq.Regs{RBP: spec.rbp})
+
+		for _, exp := range spec.expLines {
+			if !strings.Contains(buf.String(), exp) {
+				t.Errorf("[spec %d] expected output to contain %q; got:\n%s", specIndex, exp, buf.String())
+			}
+		}
+	}
+
+	if got := strings.Count(buf.String(), "[0x"); got != maxStackFrames {
+		t.Errorf("expected deep stacks to be truncated to %d frames; got %d", maxStackFrames, got)
+	}
+}
+
+func TestReadWord(t *testing.T) {
+	word := uintptr(0xdeadbeef)
+	if got := readWord(uintptr(unsafe.Pointer(&word))); got != word {
+		t.Fatalf("expected to read 0x%x; got 0x%x", word, got)
+	}
+}
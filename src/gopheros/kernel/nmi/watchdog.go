@@ -0,0 +1,278 @@
+package nmi
+
+import (
+	"gopheros/device/intc/lapic"
+	"gopheros/kernel"
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/irq"
+	"gopheros/kernel/kfmt"
+	"gopheros/kernel/mem/percpu"
+	"gopheros/kernel/time"
+	"gopheros/kernel/timer"
+)
+
+// WatchdogMode describes the source of the NMIs that drive the watchdog.
+type WatchdogMode uint8
+
+const (
+	// WatchdogOff indicates that the watchdog is not running.
+	WatchdogOff WatchdogMode = iota
+
+	// WatchdogPerfCounter programs the first architectural performance
+	// counter to raise an NMI roughly once per second of unhalted CPU
+	// time.
+	WatchdogPerfCounter
+
+	// WatchdogExternal relies on an external source (e.g. a chipset or
+	// BMC watchdog) to raise NMIs. All NMIs that are not caused by a
+	// hardware error are treated as watchdog NMIs.
+	WatchdogExternal
+)
+
+const (
+	msrPMC0               = 0xc1
+	msrPerfEvtSel0        = 0x186
+	msrPerfGlobalCtrl     = 0x38f
+	msrPerfGlobalOvfCtrl  = 0x390
+	perfEvtUnhaltedCycles = 0x3c
+	perfEvtUser           = 1 << 16
+	perfEvtOS             = 1 << 17
+	perfEvtInterrupt      = 1 << 20
+	perfEvtEnable         = 1 << 22
+	perfCounter0          = 1 << 0
+	perfCyclesUnavailable = 1 << 0
+	perfCounterLeaf       = 0xa
+
+	// Writes to IA32_PMC0 are sign-extended from bit 31 which limits the
+	// period of the performance counter.
+	maxPerfPeriod = 0x7fffffff
+)
+
+var (
+	watchdogMode WatchdogMode
+
+	// The TSC is used for measuring the time since each CPU last made
+	// progress as it can be read from NMI context without locking.
+	tscFrequency  uint64
+	timeoutCycles uint64
+
+	// The performance counter configuration.
+	perfVersion  uint32
+	perfWidth    uint32
+	perfPeriod   uint64
+	heartbeatTmr *timer.Timer
+
+	// Each CPU increments its heartbeat count when it services the
+	// watchdog timer. The watchdog compares the count with the value
+	// observed by the previous NMI and records the TSC value when the
+	// count last changed.
+	heartbeats     [percpu.MaxCPUs]uint64
+	lastHeartbeats [percpu.MaxCPUs]uint64
+	lastProgress   [percpu.MaxCPUs]uint64
+
+	// The following functions are used by tests to mock calls to the
+	// cpu, percpu, time, timer and lapic packages.
+	cpuidFn                = cpu.ID
+	readMSRFn              = cpu.ReadMSR
+	writeMSRFn             = cpu.WriteMSR
+	readTSCFn              = cpu.ReadTSC
+	currentCPUFn           = percpu.CurrentCPU
+	clockSourcesFn         = time.ClockSources
+	hasEventSourceFn       = timer.HasEventSource
+	startHeartbeatFn       = timer.Every
+	stopHeartbeatFn        = (*timer.Timer).Stop
+	enablePerfCounterNMIFn = lapic.EnablePerfCounterNMI
+
+	errWatchdogRunning = &kernel.Error{Module: "nmi", Message: "watchdog already running"}
+	errInvalidMode     = &kernel.Error{Module: "nmi", Message: "invalid watchdog mode"}
+	errInvalidTimeout  = &kernel.Error{Module: "nmi", Message: "watchdog timeout must be at least one second"}
+	errNoTSC           = &kernel.Error{Module: "nmi", Message: "watchdog requires a calibrated TSC"}
+	errNoEventSource   = &kernel.Error{Module: "nmi", Message: "watchdog requires a timer event source"}
+	errNoPerfCounter   = &kernel.Error{Module: "nmi", Message: "CPU does not support counting unhalted core cycles"}
+	errCPUStuck        = &kernel.Error{Module: "nmi", Message: "watchdog detected a stuck CPU"}
+)
+
+// String implements fmt.Stringer for WatchdogMode.
+func (m WatchdogMode) String() string {
+	switch m {
+	case WatchdogPerfCounter:
+		return "perf"
+	case WatchdogExternal:
+		return "external"
+	default:
+		return "off"
+	}
+}
+
+// Watchdog returns the mode of the running watchdog.
+func Watchdog() WatchdogMode {
+	return watchdogMode
+}
+
+// StartWatchdog starts the NMI watchdog in the supplied mode. A CPU is
+// considered stuck if it does not service the watchdog timer for longer
+// than timeout; the watchdog then dumps the registers and the stack of
+// the stuck CPU and halts the system. The watchdog timer is driven by the
+// timer package so an event source must have been selected.
+func StartWatchdog(mode WatchdogMode, timeout time.Duration) *kernel.Error {
+	if watchdogMode != WatchdogOff {
+		return errWatchdogRunning
+	}
+
+	if mode != WatchdogPerfCounter && mode != WatchdogExternal {
+		return errInvalidMode
+	}
+
+	if timeout < time.Second {
+		return errInvalidTimeout
+	}
+
+	// The watchdog timer would never fire without an event source and
+	// the watchdog would report all CPUs as stuck.
+	if !hasEventSourceFn() {
+		return errNoEventSource
+	}
+
+	tscFrequency = 0
+	for _, cs := range clockSourcesFn() {
+		if cs.Name == "tsc" {
+			tscFrequency = cs.Frequency
+		}
+	}
+
+	if tscFrequency == 0 {
+		return errNoTSC
+	}
+
+	if mode == WatchdogPerfCounter {
+		if err := setupPerfCounter(); err != nil {
+			return err
+		}
+	}
+
+	timeoutCycles = tscFrequency * uint64(timeout/time.Millisecond) / 1000
+	now := readTSCFn()
+	for cpuIndex := range lastProgress {
+		lastHeartbeats[cpuIndex] = heartbeats[cpuIndex]
+		lastProgress[cpuIndex] = now
+	}
+
+	// Service the watchdog several times per timeout period so that a
+	// single delayed timer does not trigger it.
+	heartbeatTmr = startHeartbeatFn(timeout/4, Touch)
+	watchdogMode = mode
+
+	kfmt.Printf("[nmi] watchdog enabled (%s, timeout: %d ms)\n", mode.String(), int64(timeout/time.Millisecond))
+	return nil
+}
+
+// StopWatchdog stops the NMI watchdog.
+func StopWatchdog() {
+	if watchdogMode == WatchdogOff {
+		return
+	}
+
+	if watchdogMode == WatchdogPerfCounter {
+		writeMSRFn(msrPerfEvtSel0, 0)
+	}
+
+	stopHeartbeatFn(heartbeatTmr)
+	heartbeatTmr = nil
+	watchdogMode = WatchdogOff
+}
+
+// Touch signals that the calling CPU is making progress. It is invoked by
+// the watchdog timer and can also be invoked by code that legitimately
+// runs for a long time with interrupts disabled.
+func Touch() {
+	if watchdogMode == WatchdogOff {
+		return
+	}
+
+	heartbeats[currentCPUFn()]++
+}
+
+// setupPerfCounter programs the first architectural performance counter to
+// raise an NMI every time it counts perfPeriod unhalted core cycles.
+func setupPerfCounter() *kernel.Error {
+	if maxLeaf, _, _, _ := cpuidFn(0); maxLeaf < perfCounterLeaf {
+		return errNoPerfCounter
+	}
+
+	eax, ebx, _, _ := cpuidFn(perfCounterLeaf)
+	perfVersion, perfWidth = eax&0xff, (eax>>16)&0xff
+	if numCounters := (eax >> 8) & 0xff; perfVersion == 0 || numCounters == 0 || perfWidth == 0 || ebx&perfCyclesUnavailable != 0 {
+		return errNoPerfCounter
+	}
+
+	if err := enablePerfCounterNMIFn(); err != nil {
+		return err
+	}
+
+	// The core clock is assumed to tick at the TSC frequency
+	perfPeriod = tscFrequency
+	if perfPeriod > maxPerfPeriod {
+		perfPeriod = maxPerfPeriod
+	}
+
+	writeMSRFn(msrPerfEvtSel0, 0)
+	writeMSRFn(msrPMC0, uint64(-int64(perfPeriod)))
+	if perfVersion >= 2 {
+		writeMSRFn(msrPerfGlobalCtrl, readMSRFn(msrPerfGlobalCtrl)|perfCounter0)
+	}
+	writeMSRFn(msrPerfEvtSel0, perfEvtUnhaltedCycles|perfEvtUser|perfEvtOS|perfEvtInterrupt|perfEvtEnable)
+	return nil
+}
+
+// perfCounterOverflowed returns true if the performance counter overflowed
+// and re-arms it. The counter is loaded with a negative value so its most
+// significant bit is cleared when it overflows.
+func perfCounterOverflowed() bool {
+	if readMSRFn(msrPMC0)&(1<<(perfWidth-1)) != 0 {
+		return false
+	}
+
+	writeMSRFn(msrPMC0, uint64(-int64(perfPeriod)))
+	if perfVersion >= 2 {
+		writeMSRFn(msrPerfGlobalOvfCtrl, perfCounter0)
+	}
+
+	// The local APIC masks the performance counter entry on delivery
+	_ = enablePerfCounterNMIFn()
+	return true
+}
+
+// watchdogNMI returns true if the NMI was raised by the watchdog. If the
+// interrupted CPU has not made progress within the watchdog timeout,
+// watchdogNMI dumps its state and halts the system.
+func watchdogNMI(frame *irq.Frame, regs *irq.Regs) bool {
+	switch watchdogMode {
+	case WatchdogOff:
+		return false
+	case WatchdogPerfCounter:
+		if !perfCounterOverflowed() {
+			return false
+		}
+	}
+
+	cpuIndex, now := currentCPUFn(), readTSCFn()
+	if heartbeat := heartbeats[cpuIndex]; heartbeat != lastHeartbeats[cpuIndex] {
+		lastHeartbeats[cpuIndex] = heartbeat
+		lastProgress[cpuIndex] = now
+		return true
+	}
+
+	stuckCycles := now - lastProgress[cpuIndex]
+	if stuckCycles < timeoutCycles {
+		return true
+	}
+
+	kfmt.Printf("\nNMI watchdog: CPU %d stuck for %d ms\n", cpuIndex, stuckCycles*1000/tscFrequency)
+	kfmt.Printf("Registers:\n")
+	regs.Print()
+	frame.Print()
+	kfmt.Printf("Stack trace:\n")
+	dumpStack(frame, regs)
+
+	panic(errCPUStuck)
+}
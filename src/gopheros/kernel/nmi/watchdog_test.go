@@ -0,0 +1,282 @@
+package nmi
+
+import (
+	"bytes"
+	"gopheros/kernel"
+	"gopheros/kernel/irq"
+	"gopheros/kernel/kfmt"
+	"gopheros/kernel/time"
+	"gopheros/kernel/timer"
+	"strings"
+	"testing"
+)
+
+func TestStartWatchdogErrors(t *testing.T) {
+	defer resetState()
+
+	var buf bytes.Buffer
+	kfmt.SetOutputSink(&buf)
+	defer kfmt.SetOutputSink(nil)
+
+	mockWatchdog(1000000000)
+
+	if err := StartWatchdog(WatchdogOff, time.Second); err != errInvalidMode {
+		t.Fatalf("expected error %v; got %v", errInvalidMode, err)
+	}
+
+	if err := StartWatchdog(WatchdogExternal, time.Millisecond); err != errInvalidTimeout {
+		t.Fatalf("expected error %v; got %v", errInvalidTimeout, err)
+	}
+
+	hasEventSourceFn = func() bool { return false }
+	if err := StartWatchdog(WatchdogExternal, time.Second); err != errNoEventSource {
+		t.Fatalf("expected error %v; got %v", errNoEventSource, err)
+	}
+
+	hasEventSourceFn = func() bool { return true }
+	clockSourcesFn = func() []*time.ClockSource {
+		return []*time.ClockSource{{Name: "hpet", Frequency: 14318180}}
+	}
+	if err := StartWatchdog(WatchdogExternal, time.Second); err != errNoTSC {
+		t.Fatalf("expected error %v; got %v", errNoTSC, err)
+	}
+
+	mockWatchdog(1000000000)
+	perfSpecs := []struct {
+		leaves map[uint32][4]uint32
+		expErr *kernel.Error
+	}{
+		// Leaf 0xa is not available
+		{map[uint32][4]uint32{0: {0x7}}, errNoPerfCounter},
+		// Architectural performance monitoring not supported
+		{map[uint32][4]uint32{0: {0xa}, 0xa: {0}}, errNoPerfCounter},
+		// Unhalted core cycles event not available
+		{map[uint32][4]uint32{0: {0xa}, 0xa: {0x300802, 1}}, errNoPerfCounter},
+	}
+
+	for specIndex, spec := range perfSpecs {
+		cpuidFn = func(leaf uint32) (uint32, uint32, uint32, uint32) {
+			regs := spec.leaves[leaf]
+			return regs[0], regs[1], regs[2], regs[3]
+		}
+
+		if err := StartWatchdog(WatchdogPerfCounter, time.Second); err != spec.expErr {
+			t.Errorf("[spec %d] expected error %v; got %v", specIndex, spec.expErr, err)
+		}
+	}
+
+	mockWatchdog(1000000000)
+	expErr := &kernel.Error{Module: "test", Message: "local APIC not initialized"}
+	enablePerfCounterNMIFn = func() *kernel.Error { return expErr }
+	if err := StartWatchdog(WatchdogPerfCounter, time.Second); err != expErr {
+		t.Fatalf("expected error %v; got %v", expErr, err)
+	}
+
+	mockWatchdog(1000000000)
+	if err := StartWatchdog(WatchdogExternal, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := StartWatchdog(WatchdogExternal, time.Second); err != errWatchdogRunning {
+		t.Fatalf("expected error %v; got %v", errWatchdogRunning, err)
+	}
+}
+
+func TestPerfCounterWatchdog(t *testing.T) {
+	defer resetState()
+
+	var buf bytes.Buffer
+	kfmt.SetOutputSink(&buf)
+	defer kfmt.SetOutputSink(nil)
+
+	for _, version := range []uint32{1, 2} {
+		StopWatchdog()
+		msrs, tsc := mockWatchdog(3000000000)
+		cpuidFn = func(leaf uint32) (uint32, uint32, uint32, uint32) {
+			if leaf == 0 {
+				return 0xd, 0, 0, 0
+			}
+			// 48-bit wide counters, 4 counters per CPU
+			return 48<<16 | 4<<8 | version, 0, 0, 0
+		}
+
+		var nmiEnabled int
+		enablePerfCounterNMIFn = func() *kernel.Error {
+			nmiEnabled++
+			return nil
+		}
+
+		if err := StartWatchdog(WatchdogPerfCounter, 4*time.Second); err != nil {
+			t.Fatal(err)
+		}
+
+		// The period is clamped so it fits in 31 bits
+		if exp, got := uint64(0xffffffff80000001), msrs[msrPMC0]; got != exp {
+			t.Errorf("[v%d] expected PMC0 to be 0x%x; got 0x%x", version, exp, got)
+		}
+
+		expEvtSel := uint64(perfEvtUnhaltedCycles | perfEvtUser | perfEvtOS | perfEvtInterrupt | perfEvtEnable)
+		if got := msrs[msrPerfEvtSel0]; got != expEvtSel {
+			t.Errorf("[v%d] expected PERFEVTSEL0 to be 0x%x; got 0x%x", version, expEvtSel, got)
+		}
+
+		if exp, got := uint64(version-1), msrs[msrPerfGlobalCtrl]; got != exp {
+			t.Errorf("[v%d] expected PERF_GLOBAL_CTRL to be %d; got %d", version, exp, got)
+		}
+
+		// The counter has not overflowed; the NMI is not a watchdog NMI
+		msrs[msrPMC0] = 0xffffffffffff
+		if watchdogNMI(&irq.Frame{}, &irq.Regs{}) {
+			t.Errorf("[v%d] expected NMI not to be attributed to the watchdog", version)
+		}
+
+		// The counter overflowed; the CPU made progress
+		msrs[msrPMC0] = 0x10
+		Touch()
+		*tsc += 3000000000
+		if !watchdogNMI(&irq.Frame{}, &irq.Regs{}) {
+			t.Errorf("[v%d] expected NMI to be attributed to the watchdog", version)
+		}
+
+		if exp, got := uint64(0xffffffff80000001), msrs[msrPMC0]; got != exp {
+			t.Errorf("[v%d] expected PMC0 to be re-armed with 0x%x; got 0x%x", version, exp, got)
+		}
+
+		if exp, got := uint64(version-1), msrs[msrPerfGlobalOvfCtrl]; got != exp {
+			t.Errorf("[v%d] expected PERF_GLOBAL_OVF_CTRL to be %d; got %d", version, exp, got)
+		}
+
+		if nmiEnabled != 2 {
+			t.Errorf("[v%d] expected the performance counter LVT to be unmasked after each NMI", version)
+		}
+
+		StopWatchdog()
+		if got := msrs[msrPerfEvtSel0]; got != 0 {
+			t.Errorf("[v%d] expected PERFEVTSEL0 to be cleared; got 0x%x", version, got)
+		}
+	}
+}
+
+func TestExternalWatchdog(t *testing.T) {
+	defer resetState()
+
+	var buf bytes.Buffer
+	kfmt.SetOutputSink(&buf)
+	defer kfmt.SetOutputSink(nil)
+
+	// Touch is a no-op while the watchdog is not running
+	currentCPUFn = func() uint32 {
+		t.Fatal("unexpected call to CurrentCPU")
+		return 0
+	}
+	Touch()
+
+	_, tsc := mockWatchdog(1000000000)
+
+	var (
+		heartbeatPeriod time.Duration
+		heartbeatFn     func()
+		stopped         bool
+	)
+	startHeartbeatFn = func(period time.Duration, fn func()) *timer.Timer {
+		heartbeatPeriod, heartbeatFn = period, fn
+		return &timer.Timer{}
+	}
+	stopHeartbeatFn = func(_ *timer.Timer) bool {
+		stopped = true
+		return true
+	}
+
+	if err := StartWatchdog(WatchdogExternal, 2*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	if heartbeatPeriod != 500*time.Millisecond {
+		t.Fatalf("expected heartbeat period to be 500ms; got %d", heartbeatPeriod)
+	}
+
+	// The CPU made progress and then stalls for less than the timeout
+	portReadByteFn = func(_ uint16) uint8 { return 0 }
+	heartbeatFn()
+	for i := 0; i < 2; i++ {
+		*tsc += 1500000000
+		nmiHandler(&irq.Frame{}, &irq.Regs{})
+	}
+
+	if got := UnknownCount(); got != 0 {
+		t.Fatalf("expected all NMIs to be attributed to the external watchdog; got %d unknown NMIs", got)
+	}
+
+	// The CPU stalls for longer than the timeout
+	*tsc += 1000000000
+	readWordFn = func(_ uintptr) uintptr { return 0 }
+	func() {
+		defer func() {
+			if err := recover(); err != errCPUStuck {
+				t.Errorf("expected a panic with %v; got %v", errCPUStuck, err)
+			}
+		}()
+
+		nmiHandler(&irq.Frame{RIP: 0xbadf00d}, &irq.Regs{})
+	}()
+
+	if exp := "NMI watchdog: CPU 0 stuck for 2500 ms\n"; !strings.Contains(buf.String(), exp) {
+		t.Fatalf("expected output to contain %q; got %q", exp, buf.String())
+	}
+
+	StopWatchdog()
+	if !stopped || Watchdog() != WatchdogOff {
+		t.Fatal("expected StopWatchdog to stop the heartbeat timer")
+	}
+}
+
+func TestWatchdogModeString(t *testing.T) {
+	specs := []struct {
+		mode WatchdogMode
+		exp  string
+	}{
+		{WatchdogOff, "off"},
+		{WatchdogPerfCounter, "perf"},
+		{WatchdogExternal, "external"},
+		{WatchdogMode(42), "off"},
+	}
+
+	for specIndex, spec := range specs {
+		if got := spec.mode.String(); got != spec.exp {
+			t.Errorf("[spec %d] expected %q; got %q", specIndex, spec.exp, got)
+		}
+	}
+}
+
+// mockWatchdog replaces the functions used by the watchdog with fakes for a
+// CPU that supports architectural performance monitoring and has a TSC
+// running at the supplied frequency. It returns the fake MSRs and a pointer
+// to the fake TSC value.
+func mockWatchdog(tscFreq uint64) (map[uint32]uint64, *uint64) {
+	var (
+		msrs = make(map[uint32]uint64)
+		tsc  uint64
+	)
+
+	clockSourcesFn = func() []*time.ClockSource {
+		return []*time.ClockSource{
+			{Name: "hpet", Frequency: 14318180},
+			{Name: "tsc", Frequency: tscFreq},
+		}
+	}
+	cpuidFn = func(leaf uint32) (uint32, uint32, uint32, uint32) {
+		if leaf == 0 {
+			return 0xa, 0, 0, 0
+		}
+		return 48<<16 | 4<<8 | 2, 0, 0, 0
+	}
+	readMSRFn = func(reg uint32) uint64 { return msrs[reg] }
+	writeMSRFn = func(reg uint32, value uint64) { msrs[reg] = value }
+	readTSCFn = func() uint64 { return tsc }
+	currentCPUFn = func() uint32 { return 0 }
+	hasEventSourceFn = func() bool { return true }
+	startHeartbeatFn = func(_ time.Duration, _ func()) *timer.Timer { return &timer.Timer{} }
+	stopHeartbeatFn = func(_ *timer.Timer) bool { return true }
+	enablePerfCounterNMIFn = func() *kernel.Error { return nil }
+
+	return msrs, &tsc
+}
@@ -0,0 +1,184 @@
+package time
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/kfmt"
+)
+
+// ClockSource describes a free-running hardware counter that can be used to
+// drive the monotonic clock.
+type ClockSource struct {
+	// Name identifies the clock source when selecting it via the
+	// "clocksource" kernel command line parameter.
+	Name string
+
+	// Rating ranks the clock sources by their quality. The clock source
+	// with the highest rating is selected by default.
+	Rating int
+
+	// Frequency is the counter frequency in Hz.
+	Frequency uint64
+
+	// Mask selects the bits implemented by the counter. Counters that are
+	// narrower than 64 bits wrap around; the monotonic clock must be read
+	// at least once per wrap-around period to account for them.
+	Mask uint64
+
+	// Read returns the current counter value.
+	Read func() uint64
+}
+
+// cyclesToNs converts a cycle count to nanoseconds. The conversion uses a
+// 128-bit intermediate product so it does not overflow for any cycle count
+// that corresponds to less than 2^64 nanoseconds (~584 years).
+func (cs *ClockSource) cyclesToNs(cycles uint64) uint64 {
+	return mulDiv(cycles, uint64(Second), cs.Frequency)
+}
+
+// mulDiv returns the lower 64 bits of (a * b) / d using a 128-bit
+// intermediate product.
+func mulDiv(a, b, d uint64) uint64 {
+	hi, lo := mul128(a, b)
+
+	// The high word of the quotient is discarded so only the remainder of
+	// the high word needs to be carried into the long division.
+	var (
+		rem = hi % d
+		q   uint64
+	)
+	for bit := 63; bit >= 0; bit-- {
+		carry := rem >> 63
+		rem = rem<<1 | (lo>>uint(bit))&1
+		q <<= 1
+		if carry != 0 || rem >= d {
+			rem -= d
+			q |= 1
+		}
+	}
+
+	return q
+}
+
+// mul128 returns the 128-bit product of a and b as a (hi, lo) pair.
+func mul128(a, b uint64) (uint64, uint64) {
+	const mask32 = 1<<32 - 1
+
+	var (
+		a0, a1 = a & mask32, a >> 32
+		b0, b1 = b & mask32, b >> 32
+		p00    = a0 * b0
+		p01    = a0 * b1
+		p10    = a1 * b0
+		mid    = p00>>32 + p01&mask32 + p10&mask32
+	)
+
+	return a1*b1 + p01>>32 + p10>>32 + mid>>32, a * b
+}
+
+var (
+	clockSources []*ClockSource
+
+	// The active clock source and the state used to convert its counter
+	// value into the monotonic clock value.
+	active      *ClockSource
+	lastCycles  uint64
+	cycles      uint64
+	baseNs      uint64
+	monotonicNs uint64
+
+	errInvalidClockSource = &kernel.Error{Module: "time", Message: "clock source name, frequency and read function must be specified"}
+	errClockSourceExists  = &kernel.Error{Module: "time", Message: "a clock source with the same name is already registered"}
+)
+
+// RegisterClockSource adds a clock source to the list of clock sources that
+// can be selected by Init.
+func RegisterClockSource(cs *ClockSource) *kernel.Error {
+	if cs.Name == "" || cs.Frequency == 0 || cs.Read == nil {
+		return errInvalidClockSource
+	}
+
+	for _, other := range clockSources {
+		if other.Name == cs.Name {
+			return errClockSourceExists
+		}
+	}
+
+	if cs.Mask == 0 {
+		cs.Mask = ^uint64(0)
+	}
+	clockSources = append(clockSources, cs)
+	return nil
+}
+
+// ClockSources returns the list of registered clock sources.
+func ClockSources() []*ClockSource {
+	return clockSources
+}
+
+// ActiveClockSource returns the clock source that drives the monotonic clock
+// or nil if no clock source has been selected.
+func ActiveClockSource() *ClockSource {
+	return active
+}
+
+// selectClockSource switches the monotonic clock to the clock source with
+// the supplied name. If name is empty or does not match any registered
+// clock source, the clock source with the highest rating is selected.
+func selectClockSource(name string) {
+	var best *ClockSource
+	for _, cs := range clockSources {
+		if cs.Name == name {
+			best = cs
+			break
+		}
+
+		if best == nil || cs.Rating > best.Rating {
+			best = cs
+		}
+	}
+
+	if name != "" && (best == nil || best.Name != name) {
+		kfmt.Printf("[time] unknown clock source \"%s\"; using the default\n", name)
+	}
+
+	if best == nil {
+		return
+	}
+
+	flags := saveAndDisableInterruptsFn()
+	defer restoreInterruptsFn(flags)
+
+	// Continue counting from the current monotonic clock value
+	baseNs = updateMonotonic()
+	active, lastCycles, cycles = best, best.Read(), 0
+}
+
+// Monotonic returns the time elapsed since the first clock source was
+// selected. The returned value never decreases and is not affected by
+// changes to the wall clock. Monotonic returns zero if no clock source has
+// been selected.
+func Monotonic() Duration {
+	flags := saveAndDisableInterruptsFn()
+	defer restoreInterruptsFn(flags)
+
+	return Duration(updateMonotonic())
+}
+
+// updateMonotonic accounts for the cycles that elapsed since the last read
+// of the active clock source and returns the monotonic clock value in
+// nanoseconds. Cycles are accumulated and converted as a whole so that no
+// precision is lost to rounding between successive reads.
+func updateMonotonic() uint64 {
+	if active == nil {
+		return 0
+	}
+
+	now := active.Read()
+	cycles += (now - lastCycles) & active.Mask
+	lastCycles = now
+
+	if ns := baseNs + active.cyclesToNs(cycles); ns > monotonicNs {
+		monotonicNs = ns
+	}
+	return monotonicNs
+}
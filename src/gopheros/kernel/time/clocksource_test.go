@@ -0,0 +1,126 @@
+package time
+
+import (
+	"bytes"
+	"gopheros/kernel/kfmt"
+	"testing"
+)
+
+func TestRegisterClockSource(t *testing.T) {
+	defer resetState()
+
+	read := func() uint64 { return 0 }
+	specs := []struct {
+		cs     *ClockSource
+		expErr bool
+	}{
+		{&ClockSource{Name: "a", Frequency: 1000, Read: read}, false},
+		{&ClockSource{Name: "b", Frequency: 1000, Mask: 0xff, Read: read}, false},
+		{&ClockSource{Name: "a", Frequency: 1000, Read: read}, true},
+		{&ClockSource{Frequency: 1000, Read: read}, true},
+		{&ClockSource{Name: "c", Read: read}, true},
+		{&ClockSource{Name: "d", Frequency: 1000}, true},
+	}
+
+	for specIndex, spec := range specs {
+		if err := RegisterClockSource(spec.cs); (err != nil) != spec.expErr {
+			t.Errorf("[spec %d] expected error: %t; got %v", specIndex, spec.expErr, err)
+		}
+	}
+
+	if got := len(ClockSources()); got != 2 {
+		t.Fatalf("expected 2 registered clock sources; got %d", got)
+	}
+
+	if specs[0].cs.Mask != ^uint64(0) || specs[1].cs.Mask != 0xff {
+		t.Fatal("expected a default mask to be assigned only to clock sources without a mask")
+	}
+}
+
+func TestClockSourceSelection(t *testing.T) {
+	defer resetState()
+	mockInterrupts()
+
+	var (
+		buf                  bytes.Buffer
+		slowCount, fastCount uint64
+		slow                 = &ClockSource{Name: "slow", Rating: 100, Frequency: 1000, Mask: 0xff, Read: func() uint64 { return slowCount }}
+		fast                 = &ClockSource{Name: "fast", Rating: 300, Frequency: 3000000000, Read: func() uint64 { return fastCount }}
+	)
+	kfmt.SetOutputSink(&buf)
+	defer kfmt.SetOutputSink(nil)
+
+	// No clock sources are registered
+	selectClockSource("")
+	if ActiveClockSource() != nil || Monotonic() != 0 {
+		t.Fatal("expected the monotonic clock to read zero without a clock source")
+	}
+
+	for _, cs := range []*ClockSource{slow, fast} {
+		if err := RegisterClockSource(cs); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Select a clock source by name
+	slowCount = 0xf0
+	selectClockSource("slow")
+	if ActiveClockSource() != slow {
+		t.Fatal("expected the slow clock source to be selected")
+	}
+
+	// The counter wraps around
+	slowCount = 0x0a
+	if got := Monotonic(); got != 26*Millisecond {
+		t.Fatalf("expected monotonic clock to read 26ms; got %d", got)
+	}
+
+	// Unknown clock sources are ignored and the clock keeps counting
+	// from its current value
+	fastCount = 1000
+	buf.Reset()
+	selectClockSource("hpet")
+	if ActiveClockSource() != fast {
+		t.Fatal("expected the clock source with the highest rating to be selected")
+	}
+
+	if exp := "[time] unknown clock source \"hpet\"; using the default\n"; buf.String() != exp {
+		t.Fatalf("expected output to be:\n%q\ngot:\n%q", exp, buf.String())
+	}
+
+	fastCount += 3000000000
+	if got := Monotonic(); got != Second+26*Millisecond {
+		t.Fatalf("expected monotonic clock to read 1.026s; got %d", got)
+	}
+
+	// Successive reads do not accumulate rounding errors
+	for i := 0; i < 1000; i++ {
+		fastCount++
+		Monotonic()
+	}
+	if got := Monotonic(); got != Second+26*Millisecond+333 {
+		t.Fatalf("expected monotonic clock to read 1.026000333s; got %d", got)
+	}
+}
+
+func TestMulDiv(t *testing.T) {
+	specs := []struct {
+		a, b, d uint64
+		exp     uint64
+	}{
+		{0, 1000000000, 3, 0},
+		{3579545, 1000000000, 3579545, 1000000000},
+		// The intermediate product overflows 64 bits
+		{1 << 40, 1000000000, 1 << 20, 1000000000 << 20},
+		{^uint64(0), ^uint64(0), ^uint64(0), ^uint64(0)},
+		{^uint64(0), 3, 4, 0xbfffffffffffffff},
+		// The remainder exceeds 63 bits during the long division
+		{1<<63 + 1, 2, 1<<63 + 3, 1},
+	}
+
+	for specIndex, spec := range specs {
+		if got := mulDiv(spec.a, spec.b, spec.d); got != spec.exp {
+			t.Errorf("[spec %d] expected %d * %d / %d to be %d; got %d", specIndex, spec.a, spec.b, spec.d, spec.exp, got)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package time
+
+import (
+	"gopheros/device"
+	"gopheros/kernel"
+	"gopheros/kernel/mem"
+	"gopheros/kernel/mem/vmm"
+	"unsafe"
+)
+
+const (
+	hpetRating = 250
+
+	hpetRegCapabilities = 0x000
+	hpetRegConfig       = 0x010
+	hpetRegCounter      = 0x0f0
+	hpetRegsSize        = 0x400
+
+	hpetCap64BitCounter = 1 << 13
+	hpetConfigEnable    = 1 << 0
+
+	// The counter period is reported in femtoseconds and must not exceed
+	// 100ns.
+	femtosecondsPerSecond = 1000000000000000
+	hpetMaxPeriod         = 100000000
+)
+
+var (
+	// mapMMIOFn and unmapMMIOFn are used by tests to mock calls to the
+	// vmm package.
+	mapMMIOFn   = vmm.MapMMIO
+	unmapMMIOFn = vmm.UnmapMMIO
+
+	errInvalidHPETPeriod = &kernel.Error{Module: "time", Message: "HPET reports an invalid counter period"}
+)
+
+// RegisterHPET maps the registers of the high precision event timer at the
+// supplied physical address, enables its main counter and registers it as
+// a clock source. It is invoked with the contents of the ACPI HPET table.
+func RegisterHPET(physAddr uintptr) *kernel.Error {
+	res := device.Resource{Type: device.ResourceMemory, Base: uint64(physAddr), Length: hpetRegsSize}
+	if err := device.ClaimResource("hpet", res); err != nil {
+		return err
+	}
+
+	regs, err := mapMMIOFn(physAddr, mem.PageSize, vmm.CacheUncached)
+	if err != nil {
+		_ = device.ReleaseResource("hpet", res)
+		return err
+	}
+
+	caps := hpetRead(regs, hpetRegCapabilities)
+	period := caps >> 32
+	if period == 0 || period > hpetMaxPeriod {
+		err = errInvalidHPETPeriod
+	} else {
+		mask := uint64(0xffffffff)
+		if caps&hpetCap64BitCounter != 0 {
+			mask = ^uint64(0)
+		}
+
+		hpetWrite(regs, hpetRegConfig, hpetRead(regs, hpetRegConfig)|hpetConfigEnable)
+
+		err = RegisterClockSource(&ClockSource{
+			Name:      "hpet",
+			Rating:    hpetRating,
+			Frequency: femtosecondsPerSecond / period,
+			Mask:      mask,
+			Read:      func() uint64 { return hpetRead(regs, hpetRegCounter) },
+		})
+	}
+
+	if err != nil {
+		_ = unmapMMIOFn(regs, mem.PageSize)
+		_ = device.ReleaseResource("hpet", res)
+	}
+
+	return err
+}
+
+// hpetRead returns the value of a 64-bit HPET register.
+func hpetRead(regs uintptr, reg uintptr) uint64 {
+	return *(*uint64)(unsafe.Pointer(regs + reg))
+}
+
+// hpetWrite updates the value of a 64-bit HPET register.
+func hpetWrite(regs uintptr, reg uintptr, value uint64) {
+	*(*uint64)(unsafe.Pointer(regs + reg)) = value
+}
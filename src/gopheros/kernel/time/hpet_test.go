@@ -0,0 +1,132 @@
+package time
+
+import (
+	"gopheros/device"
+	"gopheros/kernel"
+	"gopheros/kernel/mem"
+	"gopheros/kernel/mem/vmm"
+	"testing"
+	"unsafe"
+)
+
+func TestRegisterHPET(t *testing.T) {
+	defer resetState()
+
+	var hpetRegs [hpetRegsSize / 8]uint64
+
+	mapMMIOFn = func(physAddr uintptr, size mem.Size, attrs vmm.CacheAttr) (uintptr, *kernel.Error) {
+		if physAddr != 0xfed00000 || size != mem.PageSize || attrs != vmm.CacheUncached {
+			t.Errorf("unexpected MMIO mapping request: addr=0x%x size=%d attrs=%d", physAddr, size, attrs)
+		}
+		return uintptr(unsafe.Pointer(&hpetRegs[0])), nil
+	}
+
+	var unmapCount int
+	unmapMMIOFn = func(virtAddr uintptr, size mem.Size) *kernel.Error {
+		if virtAddr != uintptr(unsafe.Pointer(&hpetRegs[0])) || size != mem.PageSize {
+			t.Errorf("unexpected MMIO unmap request: addr=0x%x size=%d", virtAddr, size)
+		}
+		unmapCount++
+		return nil
+	}
+
+	t.Run("invalid period", func(t *testing.T) {
+		for _, period := range []uint64{0, hpetMaxPeriod + 1} {
+			unmapCount = 0
+			hpetRegs[hpetRegCapabilities/8] = period << 32
+			if err := RegisterHPET(0xfed00000); err != errInvalidHPETPeriod {
+				t.Errorf("[period %d] expected error %v; got %v", period, errInvalidHPETPeriod, err)
+			}
+
+			if unmapCount != 1 {
+				t.Errorf("[period %d] expected the HPET registers to be unmapped", period)
+			}
+
+			if _, ok := device.ResourceOwner(device.Resource{Type: device.ResourceMemory, Base: 0xfed00000, Length: 1}); ok {
+				t.Errorf("[period %d] expected the HPET registers to be released", period)
+			}
+		}
+	})
+
+	t.Run("map error", func(t *testing.T) {
+		expErr := &kernel.Error{Module: "test", Message: "out of address space"}
+		origMapFn := mapMMIOFn
+		defer func() { mapMMIOFn = origMapFn }()
+		mapMMIOFn = func(_ uintptr, _ mem.Size, _ vmm.CacheAttr) (uintptr, *kernel.Error) {
+			return 0, expErr
+		}
+
+		if err := RegisterHPET(0xfed00000); err != expErr {
+			t.Fatalf("expected error %v; got %v", expErr, err)
+		}
+	})
+
+	t.Run("32-bit counter", func(t *testing.T) {
+		defer device.ReleaseResources("hpet")
+
+		// 10MHz counter
+		hpetRegs[hpetRegCapabilities/8] = 100000000 << 32
+		hpetRegs[hpetRegCounter/8] = 42
+
+		if err := RegisterHPET(0xfed00000); err != nil {
+			t.Fatal(err)
+		}
+
+		if hpetRegs[hpetRegConfig/8]&hpetConfigEnable == 0 {
+			t.Fatal("expected the HPET main counter to be enabled")
+		}
+
+		cs := ClockSources()[0]
+		if cs.Name != "hpet" || cs.Rating != hpetRating || cs.Frequency != 10000000 || cs.Mask != 0xffffffff {
+			t.Fatalf("unexpected clock source: %s, rating %d, %d Hz, mask 0x%x", cs.Name, cs.Rating, cs.Frequency, cs.Mask)
+		}
+
+		if got := cs.Read(); got != 42 {
+			t.Fatalf("expected clock source to read the HPET main counter; got %d", got)
+		}
+
+		if owner, ok := device.ResourceOwner(device.Resource{Type: device.ResourceMemory, Base: 0xfed00000, Length: 1}); !ok || owner != "hpet" {
+			t.Fatalf("expected the HPET registers to be claimed; got %q, %t", owner, ok)
+		}
+
+		// The clock source cannot be registered twice; the failed
+		// attempt must not release the registers of the first one
+		unmapCount = 0
+		if err := RegisterHPET(0xfed00000); err != errClockSourceExists {
+			t.Fatalf("expected error %v; got %v", errClockSourceExists, err)
+		}
+
+		if unmapCount != 1 {
+			t.Fatal("expected the registers mapped by the failed attempt to be unmapped")
+		}
+
+		if owner, ok := device.ResourceOwner(device.Resource{Type: device.ResourceMemory, Base: 0xfed00000, Length: 1}); !ok || owner != "hpet" {
+			t.Fatalf("expected the HPET registers to remain claimed; got %q, %t", owner, ok)
+		}
+	})
+
+	t.Run("resource conflict", func(t *testing.T) {
+		res := device.Resource{Type: device.ResourceMemory, Base: 0xfed00100, Length: 8}
+		if err := device.ClaimResource("other", res); err != nil {
+			t.Fatal(err)
+		}
+		defer device.ReleaseResources("other")
+
+		if err := RegisterHPET(0xfed00000); err == nil {
+			t.Fatal("expected an error when the HPET registers are claimed by another driver")
+		}
+	})
+
+	t.Run("64-bit counter", func(t *testing.T) {
+		clockSources = nil
+		hpetRegs[hpetRegCapabilities/8] = 100000000<<32 | hpetCap64BitCounter
+
+		if err := RegisterHPET(0xfed00000); err != nil {
+			t.Fatal(err)
+		}
+
+		if cs := ClockSources()[0]; cs.Mask != ^uint64(0) {
+			t.Fatalf("expected a 64-bit counter mask; got 0x%x", cs.Mask)
+		}
+	})
+}
@@ -0,0 +1,35 @@
+package time
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/cpu"
+)
+
+const (
+	pmTimerRating    = 200
+	pmTimerFrequency = 3579545
+)
+
+var (
+	// portReadDwordFn is used by tests to mock calls to the cpu package.
+	portReadDwordFn = cpu.PortReadDword
+)
+
+// RegisterPMTimer registers the ACPI power management timer at the supplied
+// I/O port as a clock source. It is invoked with the contents of the ACPI
+// FADT; extended should be set if the FADT reports a 32-bit counter. The
+// 24-bit counter wraps around roughly every 4.7 seconds.
+func RegisterPMTimer(port uint16, extended bool) *kernel.Error {
+	mask := uint64(0xffffff)
+	if extended {
+		mask = 0xffffffff
+	}
+
+	return RegisterClockSource(&ClockSource{
+		Name:      "acpi_pm",
+		Rating:    pmTimerRating,
+		Frequency: pmTimerFrequency,
+		Mask:      mask,
+		Read:      func() uint64 { return uint64(portReadDwordFn(port)) },
+	})
+}
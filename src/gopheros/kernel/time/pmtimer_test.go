@@ -0,0 +1,38 @@
+package time
+
+import "testing"
+
+func TestRegisterPMTimer(t *testing.T) {
+	defer resetState()
+
+	portReadDwordFn = func(port uint16) uint32 {
+		if port != 0x608 {
+			t.Errorf("unexpected read from port 0x%x", port)
+		}
+		return 0x123456
+	}
+
+	specs := []struct {
+		extended bool
+		expMask  uint64
+	}{
+		{false, 0xffffff},
+		{true, 0xffffffff},
+	}
+
+	for specIndex, spec := range specs {
+		clockSources = nil
+		if err := RegisterPMTimer(0x608, spec.extended); err != nil {
+			t.Fatal(err)
+		}
+
+		cs := ClockSources()[0]
+		if cs.Name != "acpi_pm" || cs.Frequency != pmTimerFrequency || cs.Mask != spec.expMask {
+			t.Errorf("[spec %d] unexpected clock source: %s, %d Hz, mask 0x%x", specIndex, cs.Name, cs.Frequency, cs.Mask)
+		}
+
+		if got := cs.Read(); got != 0x123456 {
+			t.Errorf("[spec %d] expected clock source to read the PM timer port; got 0x%x", specIndex, got)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+// Package time provides a monotonic clock and a wall clock for the kernel.
+//
+// The monotonic clock is driven by the best available hardware counter
+// (clock source). Counters such as the TSC, the HPET main counter and the
+// ACPI PM timer are registered via RegisterClockSource and the one with
+// the highest rating is selected when Init is invoked; the selection can be
+// overridden with the "clocksource=name" kernel command line parameter.
+// The wall clock is initialized from the CMOS real-time clock at boot and
+// advanced using the monotonic clock.
+package time
+
+import (
+	"gopheros/device"
+	"gopheros/device/rtc"
+	"gopheros/kernel"
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/kfmt"
+)
+
+// Duration describes an interval as a nanosecond count.
+type Duration int64
+
+// Common durations.
+const (
+	Nanosecond  Duration = 1
+	Microsecond          = 1000 * Nanosecond
+	Millisecond          = 1000 * Microsecond
+	Second               = 1000 * Millisecond
+)
+
+// Time describes a point in time as the number of nanoseconds elapsed
+// since the Unix epoch (1970-01-01 00:00:00 UTC).
+type Time int64
+
+// Unix returns t as the number of seconds elapsed since the Unix epoch.
+func (t Time) Unix() int64 {
+	return int64(t) / int64(Second)
+}
+
+var (
+	// bootTime is the wall clock time when the monotonic clock read zero.
+	bootTime Time
+
+	// The following functions are used by tests to mock calls to the
+	// device, rtc and cpu packages.
+	paramStringFn              = device.ParamString
+	saveAndDisableInterruptsFn = cpu.SaveAndDisableInterrupts
+	restoreInterruptsFn        = cpu.RestoreInterrupts
+	readRTCFn                  = rtc.ReadTime
+
+	errNoClockSource = &kernel.Error{Module: "time", Message: "no clock source available"}
+)
+
+// Init registers the clock sources that do not depend on firmware tables,
+// selects the clock source that drives the monotonic clock and initializes
+// the wall clock from the RTC. Clock sources discovered via firmware tables
+// must be registered before Init is invoked.
+func Init() *kernel.Error {
+	if err := registerTSC(); err != nil {
+		kfmt.Printf("[time] tsc: %s\n", err.Message)
+	}
+
+	selectClockSource(paramStringFn("clocksource", ""))
+	if active == nil {
+		return errNoClockSource
+	}
+	kfmt.Printf("[time] clocksource: %s (%d Hz)\n", active.Name, active.Frequency)
+
+	secs, err := readRTCFn()
+	if err != nil {
+		kfmt.Printf("[time] rtc: %s\n", err.Message)
+	}
+	SetWallClock(Time(secs * int64(Second)))
+
+	return nil
+}
+
+// Now returns the current wall clock time.
+func Now() Time {
+	return bootTime + Time(Monotonic())
+}
+
+// SetWallClock sets the current wall clock time.
+func SetWallClock(now Time) {
+	bootTime = now - Time(Monotonic())
+}
@@ -0,0 +1,139 @@
+package time
+
+import (
+	"bytes"
+	"gopheros/device"
+	"gopheros/device/pit"
+	"gopheros/device/rtc"
+	"gopheros/kernel"
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/kfmt"
+	"gopheros/kernel/mem/vmm"
+	"testing"
+)
+
+func TestInit(t *testing.T) {
+	defer resetState()
+	mockInterrupts()
+
+	var (
+		buf     bytes.Buffer
+		counter uint64
+	)
+	kfmt.SetOutputSink(&buf)
+	defer kfmt.SetOutputSink(nil)
+
+	cpuidFn = func(leaf uint32) (uint32, uint32, uint32, uint32) {
+		if leaf == 0 {
+			return 0x16, 0, 0, 0
+		}
+		if leaf == 0x16 {
+			return 1000, 0, 0, 0
+		}
+		return 0, 0, 0, 0
+	}
+	hasInvariantTSCFn = func() bool { return true }
+	readTSCFn = func() uint64 { return counter }
+	paramStringFn = func(name, defValue string) string {
+		if name != "clocksource" || defValue != "" {
+			t.Errorf("unexpected parameter lookup: %q (default %q)", name, defValue)
+		}
+		return defValue
+	}
+	readRTCFn = func() (int64, *kernel.Error) { return 1709210096, nil }
+
+	buf.Reset()
+	if err := Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	if exp := "[time] clocksource: tsc (1000000000 Hz)\n"; buf.String() != exp {
+		t.Fatalf("expected output to be:\n%q\ngot:\n%q", exp, buf.String())
+	}
+
+	counter += 1500000000
+	if got := Monotonic(); got != 1500*Millisecond {
+		t.Fatalf("expected monotonic clock to read 1.5s; got %d", got)
+	}
+
+	now := Now()
+	if now.Unix() != 1709210097 || int64(now)%int64(Second) != int64(500*Millisecond) {
+		t.Fatalf("expected wall clock to read 1709210097.5; got %d", now)
+	}
+
+	SetWallClock(Time(10 * Second))
+	counter += 1000000000
+	if got := Now(); got != Time(11*Second) {
+		t.Fatalf("expected wall clock to read 11s; got %d", got)
+	}
+}
+
+func TestInitErrors(t *testing.T) {
+	defer resetState()
+	mockInterrupts()
+
+	var buf bytes.Buffer
+	kfmt.SetOutputSink(&buf)
+	defer kfmt.SetOutputSink(nil)
+
+	// TSC calibration fails and no other clock source is available
+	cpuidFn = func(_ uint32) (uint32, uint32, uint32, uint32) { return 0, 0, 0, 0 }
+	pitOneShotFn = func(_ uint32, _ func()) *kernel.Error {
+		return &kernel.Error{Module: "test", Message: "PIT timeout"}
+	}
+	paramStringFn = func(_, defValue string) string { return defValue }
+
+	buf.Reset()
+	if err := Init(); err != errNoClockSource {
+		t.Fatalf("expected error %v; got %v", errNoClockSource, err)
+	}
+
+	if exp := "[time] tsc: " + errCalibrationFailed.Message + "\n"; buf.String() != exp {
+		t.Fatalf("expected output to be:\n%q\ngot:\n%q", exp, buf.String())
+	}
+
+	// RTC errors are not fatal
+	if err := RegisterPMTimer(0x408, true); err != nil {
+		t.Fatal(err)
+	}
+	portReadDwordFn = func(_ uint16) uint32 { return 0 }
+	rtcErr := &kernel.Error{Module: "test", Message: "RTC not responding"}
+	readRTCFn = func() (int64, *kernel.Error) { return 0, rtcErr }
+
+	buf.Reset()
+	if err := Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	exp := "[time] tsc: " + errCalibrationFailed.Message + "\n" +
+		"[time] clocksource: acpi_pm (3579545 Hz)\n" +
+		"[time] rtc: " + rtcErr.Message + "\n"
+	if buf.String() != exp {
+		t.Fatalf("expected output to be:\n%q\ngot:\n%q", exp, buf.String())
+	}
+}
+
+func mockInterrupts() {
+	saveAndDisableInterruptsFn = func() uint64 { return 0 }
+	restoreInterruptsFn = func(_ uint64) {}
+}
+
+func resetState() {
+	clockSources = nil
+	active = nil
+	lastCycles, cycles, baseNs, monotonicNs = 0, 0, 0, 0
+	bootTime = 0
+
+	paramStringFn = device.ParamString
+	saveAndDisableInterruptsFn = cpu.SaveAndDisableInterrupts
+	restoreInterruptsFn = cpu.RestoreInterrupts
+	readRTCFn = rtc.ReadTime
+	cpuidFn = cpu.ID
+	hasInvariantTSCFn = cpu.HasInvariantTSC
+	readTSCFn = cpu.ReadTSC
+	pitOneShotFn = pit.OneShot
+	portReadDwordFn = cpu.PortReadDword
+	mapMMIOFn = vmm.MapMMIO
+	unmapMMIOFn = vmm.UnmapMMIO
+	device.ReleaseResources("hpet")
+}
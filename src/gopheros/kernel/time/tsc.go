@@ -0,0 +1,132 @@
+package time
+
+import (
+	"gopheros/device/pit"
+	"gopheros/kernel"
+	"gopheros/kernel/cpu"
+)
+
+const (
+	// The TSC is preferred over the other clock sources if it runs at a
+	// constant rate as it can be read with a single instruction.
+	tscRatingInvariant = 300
+	tscRatingVariable  = 100
+
+	// If the CPU does not report the TSC frequency, the TSC is calibrated
+	// by counting the number of cycles that elapse during calibrationMs
+	// as measured by a reference clock.
+	calibrationMs      = 10
+	maxCalibrationPoll = 1 << 24
+)
+
+var (
+	// The following functions are used by tests to mock calls to the cpu
+	// and pit packages.
+	cpuidFn           = cpu.ID
+	hasInvariantTSCFn = cpu.HasInvariantTSC
+	readTSCFn         = cpu.ReadTSC
+	pitOneShotFn      = pit.OneShot
+
+	errCalibrationFailed = &kernel.Error{Module: "time", Message: "timed out while calibrating the TSC"}
+)
+
+// registerTSC registers the time-stamp counter as a clock source.
+func registerTSC() *kernel.Error {
+	freq, err := tscFrequency()
+	if err != nil {
+		return err
+	}
+
+	rating := tscRatingVariable
+	if hasInvariantTSCFn() {
+		rating = tscRatingInvariant
+	}
+
+	return RegisterClockSource(&ClockSource{
+		Name:      "tsc",
+		Rating:    rating,
+		Frequency: freq,
+		Read:      readTSCFn,
+	})
+}
+
+// tscFrequency returns the TSC frequency in Hz. The frequency is queried
+// via CPUID if the CPU reports it and measured otherwise.
+func tscFrequency() (uint64, *kernel.Error) {
+	maxLeaf, _, _, _ := cpuidFn(0)
+
+	// Leaf 0x15 reports the TSC frequency as a ratio of the core crystal
+	// clock frequency.
+	if maxLeaf >= 0x15 {
+		if denominator, numerator, crystalHz, _ := cpuidFn(0x15); denominator != 0 && numerator != 0 && crystalHz != 0 {
+			return uint64(crystalHz) * uint64(numerator) / uint64(denominator), nil
+		}
+	}
+
+	// Leaf 0x16 reports the processor base frequency in MHz which
+	// matches the TSC frequency.
+	if maxLeaf >= 0x16 {
+		if baseMHz, _, _, _ := cpuidFn(0x16); baseMHz != 0 {
+			return uint64(baseMHz) * 1000000, nil
+		}
+	}
+
+	return calibrateTSC()
+}
+
+// calibrateTSC returns the TSC frequency in Hz. The clock source with the
+// highest rating (e.g. the HPET or the ACPI PM timer) is used as the
+// reference clock if one has been registered; otherwise, the TSC is
+// calibrated against PIT channel 2.
+func calibrateTSC() (uint64, *kernel.Error) {
+	var ref *ClockSource
+	for _, cs := range clockSources {
+		if ref == nil || cs.Rating > ref.Rating {
+			ref = cs
+		}
+	}
+
+	if ref != nil {
+		return calibrateTSCWith(ref)
+	}
+
+	return calibrateTSCWithPIT()
+}
+
+// calibrateTSCWith returns the TSC frequency in Hz using the supplied clock
+// source as the reference clock.
+func calibrateTSCWith(ref *ClockSource) (uint64, *kernel.Error) {
+	var (
+		target   = ref.Frequency * calibrationMs / 1000
+		refStart = ref.Read()
+		tscStart = readTSCFn()
+		elapsed  uint64
+	)
+
+	if target == 0 {
+		target = 1
+	}
+
+	for poll := 0; elapsed < target; poll++ {
+		if poll == maxCalibrationPoll {
+			return 0, errCalibrationFailed
+		}
+
+		elapsed = (ref.Read() - refStart) & ref.Mask
+	}
+
+	// Scale the number of TSC cycles by the actual elapsed reference
+	// time using a 128-bit intermediate product.
+	return mulDiv(readTSCFn()-tscStart, ref.Frequency, elapsed), nil
+}
+
+// calibrateTSCWithPIT returns the TSC frequency in Hz using PIT channel 2
+// as the reference clock.
+func calibrateTSCWithPIT() (uint64, *kernel.Error) {
+	var start uint64
+	if err := pitOneShotFn(calibrationMs, func() { start = readTSCFn() }); err != nil {
+		return 0, errCalibrationFailed
+	}
+
+	return (readTSCFn() - start) * 1000 / calibrationMs, nil
+}
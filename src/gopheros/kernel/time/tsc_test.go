@@ -0,0 +1,153 @@
+package time
+
+import (
+	"gopheros/kernel"
+	"testing"
+)
+
+func TestTSCFrequency(t *testing.T) {
+	defer resetState()
+
+	specs := []struct {
+		leaves  map[uint32][4]uint32
+		expFreq uint64
+	}{
+		// Leaf 0x15: 24MHz crystal with a 2/200 ratio
+		{
+			map[uint32][4]uint32{0: {0x16}, 0x15: {2, 200, 24000000}, 0x16: {3000}},
+			2400000000,
+		},
+		// Leaf 0x15 does not report the crystal frequency
+		{
+			map[uint32][4]uint32{0: {0x16}, 0x15: {2, 200, 0}, 0x16: {3000}},
+			3000000000,
+		},
+		// Neither leaf is available; calibrate against the PIT
+		{
+			map[uint32][4]uint32{0: {0xd}},
+			1500000000,
+		},
+	}
+
+	var tsc uint64
+	readTSCFn = func() uint64 { return tsc }
+
+	for specIndex, spec := range specs {
+		cpuidFn = func(leaf uint32) (uint32, uint32, uint32, uint32) {
+			regs := spec.leaves[leaf]
+			return regs[0], regs[1], regs[2], regs[3]
+		}
+		pitDurations := mockPIT(func() { tsc += 15000000 })
+
+		freq, err := tscFrequency()
+		if err != nil {
+			t.Errorf("[spec %d] unexpected error: %v", specIndex, err)
+			continue
+		}
+
+		if freq != spec.expFreq {
+			t.Errorf("[spec %d] expected TSC frequency %d; got %d", specIndex, spec.expFreq, freq)
+		}
+
+		if calibrated := len(spec.leaves) == 1; calibrated && (len(*pitDurations) != 1 || (*pitDurations)[0] != calibrationMs) {
+			t.Errorf("[spec %d] expected a %dms PIT one-shot count; got %v", specIndex, calibrationMs, *pitDurations)
+		}
+	}
+}
+
+func TestCalibrateTSCWithClockSource(t *testing.T) {
+	defer resetState()
+
+	var refCount, tsc uint64
+	readTSCFn = func() uint64 { return tsc }
+
+	// Register a slow clock source and a 24-bit PM timer that wraps
+	// around during the calibration.
+	if err := RegisterClockSource(&ClockSource{Name: "slow", Rating: 1, Frequency: 50, Read: func() uint64 { return 0 }}); err != nil {
+		t.Fatal(err)
+	}
+	refCount = 0xffffff - 15000
+	portReadDwordFn = func(_ uint16) uint32 {
+		// Each read of the reference clock advances it by 10000
+		// cycles and the TSC by 1000 times as many cycles.
+		refCount += 10000
+		tsc += 10000 * 1000
+		return uint32(refCount)
+	}
+	if err := RegisterPMTimer(0x608, false); err != nil {
+		t.Fatal(err)
+	}
+
+	freq, err := calibrateTSC()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if exp := uint64(pmTimerFrequency * 1000); freq != exp {
+		t.Fatalf("expected TSC frequency %d; got %d", exp, freq)
+	}
+
+	// The reference clock does not advance
+	portReadDwordFn = func(_ uint16) uint32 { return 0 }
+	if _, err = calibrateTSC(); err != errCalibrationFailed {
+		t.Fatalf("expected error %v; got %v", errCalibrationFailed, err)
+	}
+
+	// Reference clocks with a frequency below 100Hz wait for at least one
+	// cycle to elapse.
+	var slowCount uint64
+	slow := &ClockSource{Frequency: 50, Mask: ^uint64(0), Read: func() uint64 {
+		slowCount++
+		tsc += 20000000
+		return slowCount
+	}}
+	if freq, err = calibrateTSCWith(slow); err != nil || freq != 1000000000 {
+		t.Fatalf("expected TSC frequency 1000000000; got %d, %v", freq, err)
+	}
+}
+
+func TestRegisterTSC(t *testing.T) {
+	defer resetState()
+
+	cpuidFn = func(leaf uint32) (uint32, uint32, uint32, uint32) {
+		if leaf == 0 {
+			return 0x16, 0, 0, 0
+		}
+		return 2000, 0, 0, 0
+	}
+
+	for _, invariant := range []bool{false, true} {
+		clockSources = nil
+		hasInvariantTSCFn = func() bool { return invariant }
+
+		if err := registerTSC(); err != nil {
+			t.Fatal(err)
+		}
+
+		cs := ClockSources()[0]
+		expRating := tscRatingVariable
+		if invariant {
+			expRating = tscRatingInvariant
+		}
+
+		if cs.Name != "tsc" || cs.Rating != expRating || cs.Frequency != 2000000000 {
+			t.Errorf("[invariant: %t] unexpected clock source: %s, rating %d, %d Hz", invariant, cs.Name, cs.Rating, cs.Frequency)
+		}
+	}
+}
+
+// mockPIT replaces the PIT one-shot helper with a fake implementation that
+// invokes the supplied function just before the count expires. mockPIT
+// returns a pointer to the list of requested durations.
+func mockPIT(onExpire func()) *[]uint32 {
+	var durations []uint32
+
+	pitOneShotFn = func(ms uint32, start func()) *kernel.Error {
+		durations = append(durations, ms)
+		start()
+		onExpire()
+		return nil
+	}
+
+	return &durations
+}
@@ -0,0 +1,216 @@
+// Package timer provides one-shot and periodic software timers that are
+// multiplexed on top of a single hardware timer capable of raising an
+// interrupt after a programmable delay (e.g. the local APIC timer in
+// one-shot mode or an HPET comparator).
+//
+// Pending timers are kept in a min-heap ordered by their expiration time.
+// The hardware timer is always armed to fire when the earliest timer
+// expires; its interrupt handler calls Expire which runs the callbacks of
+// all expired timers and re-arms the hardware timer.
+package timer
+
+import (
+	"container/heap"
+	"gopheros/kernel"
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/time"
+)
+
+// EventSource is implemented by hardware timers that can raise an interrupt
+// after a programmable delay.
+type EventSource interface {
+	// Arm programs the hardware timer to raise an interrupt after the
+	// supplied delay, replacing any previously programmed expiration.
+	Arm(delay time.Duration)
+}
+
+// ClockFn returns the time elapsed since an arbitrary point in the past.
+// The returned values must never decrease.
+type ClockFn func() time.Duration
+
+// Timer describes a pending software timer.
+type Timer struct {
+	expires time.Duration
+	period  time.Duration
+	fn      func()
+
+	// index is the position of the timer in the pending timer heap or
+	// -1 if the timer is not pending.
+	index int
+}
+
+// timerHeap implements heap.Interface for a list of timers ordered by their
+// expiration time.
+type timerHeap []*Timer
+
+func (h timerHeap) Len() int           { return len(h) }
+func (h timerHeap) Less(i, j int) bool { return h[i].expires < h[j].expires }
+func (h timerHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+
+func (h *timerHeap) Push(x interface{}) {
+	t := x.(*Timer)
+	t.index = len(*h)
+	*h = append(*h, t)
+}
+
+func (h *timerHeap) Pop() interface{} {
+	old := *h
+	t := old[len(old)-1]
+	old[len(old)-1] = nil
+	t.index = -1
+	*h = old[:len(old)-1]
+	return t
+}
+
+var (
+	pending timerHeap
+	source  EventSource
+	clockFn ClockFn
+
+	// The following functions are used by tests to mock calls to the cpu
+	// package.
+	saveAndDisableInterruptsFn = cpu.SaveAndDisableInterrupts
+	restoreInterruptsFn        = cpu.RestoreInterrupts
+
+	errInvalidEventSource = &kernel.Error{Module: "timer", Message: "an event source and a clock must be specified"}
+)
+
+// SetEventSource selects the hardware timer used to drive the software
+// timers and the clock used to track their expiration (normally
+// time.Monotonic). Timers that were
+// started before an event source was selected are armed by this call.
+func SetEventSource(src EventSource, clock ClockFn) *kernel.Error {
+	if src == nil || clock == nil {
+		return errInvalidEventSource
+	}
+
+	flags := saveAndDisableInterruptsFn()
+	defer restoreInterruptsFn(flags)
+
+	// Timers that were started before a clock was available have expiry
+	// times relative to zero; rebase them to the current time.
+	if clockFn == nil {
+		now := clock()
+		for _, t := range pending {
+			t.expires += now
+		}
+	}
+
+	source, clockFn = src, clock
+	arm()
+	return nil
+}
+
+// HasEventSource returns true if an event source has been selected via
+// SetEventSource. Timers do not fire until an event source is selected.
+func HasEventSource() bool {
+	return source != nil
+}
+
+// After starts a timer that invokes fn once after the supplied delay.
+// Timer callbacks are invoked from the hardware timer's interrupt handler
+// and should defer any lengthy processing using the workqueue package.
+func After(delay time.Duration, fn func()) *Timer {
+	return start(delay, 0, fn)
+}
+
+// Every starts a timer that invokes fn every period until it is stopped.
+func Every(period time.Duration, fn func()) *Timer {
+	return start(period, period, fn)
+}
+
+// start adds a new timer to the pending timer heap.
+func start(delay, period time.Duration, fn func()) *Timer {
+	if delay < 0 {
+		delay = 0
+	}
+
+	flags := saveAndDisableInterruptsFn()
+	defer restoreInterruptsFn(flags)
+
+	t := &Timer{expires: now() + delay, period: period, fn: fn, index: -1}
+	heap.Push(&pending, t)
+	if t.index == 0 {
+		arm()
+	}
+
+	return t
+}
+
+// Stop prevents the timer from firing. It returns false if the timer has
+// already expired (for one-shot timers) or has already been stopped.
+func (t *Timer) Stop() bool {
+	flags := saveAndDisableInterruptsFn()
+	defer restoreInterruptsFn(flags)
+
+	if t.index < 0 {
+		return false
+	}
+
+	wasFirst := t.index == 0
+	heap.Remove(&pending, t.index)
+	if wasFirst {
+		arm()
+	}
+
+	return true
+}
+
+// Pending returns the number of pending timers.
+func Pending() int {
+	return len(pending)
+}
+
+// Expire runs the callbacks of all expired timers, reschedules periodic
+// timers and re-arms the hardware timer. It is meant to be invoked by the
+// interrupt handler of the selected event source.
+func Expire() {
+	flags := saveAndDisableInterruptsFn()
+	defer restoreInterruptsFn(flags)
+
+	cur := now()
+	for len(pending) != 0 && pending[0].expires <= cur {
+		t := pending[0]
+		if t.period != 0 {
+			// Skip any periods that were missed instead of firing
+			// the timer repeatedly to catch up.
+			t.expires += t.period
+			if t.expires <= cur {
+				t.expires = cur + t.period
+			}
+			heap.Fix(&pending, 0)
+		} else {
+			heap.Pop(&pending)
+		}
+
+		t.fn()
+	}
+
+	arm()
+}
+
+// now returns the current time or zero if no clock has been selected.
+func now() time.Duration {
+	if clockFn == nil {
+		return 0
+	}
+
+	return clockFn()
+}
+
+// arm programs the event source to fire when the earliest pending timer
+// expires.
+func arm() {
+	if source == nil || len(pending) == 0 {
+		return
+	}
+
+	delay := pending[0].expires - clockFn()
+	if delay < 0 {
+		delay = 0
+	}
+	source.Arm(delay)
+}
@@ -0,0 +1,146 @@
+package timer
+
+import (
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/time"
+	"reflect"
+	"testing"
+)
+
+func TestTimers(t *testing.T) {
+	defer resetState()
+	mockInterrupts()
+
+	var (
+		clock time.Duration
+		src   mockEventSource
+		fired []string
+	)
+
+	record := func(name string) func() {
+		return func() { fired = append(fired, name) }
+	}
+
+	// Timers started before an event source is selected are rebased to
+	// the time when the source is selected.
+	early := After(5*time.Millisecond, record("early"))
+
+	if err := SetEventSource(nil, nil); err != errInvalidEventSource {
+		t.Fatalf("expected error %v; got %v", errInvalidEventSource, err)
+	}
+
+	if HasEventSource() {
+		t.Fatal("expected HasEventSource to return false before an event source is selected")
+	}
+
+	clock = 100 * time.Millisecond
+	if err := SetEventSource(&src, func() time.Duration { return clock }); err != nil {
+		t.Fatal(err)
+	}
+
+	if !HasEventSource() {
+		t.Fatal("expected HasEventSource to return true after an event source is selected")
+	}
+
+	if exp := []time.Duration{5 * time.Millisecond}; !reflect.DeepEqual(src.armed, exp) {
+		t.Fatalf("expected event source to be armed with %v; got %v", exp, src.armed)
+	}
+
+	var (
+		periodic  = Every(2*time.Millisecond, record("periodic"))
+		stopped   = After(time.Nanosecond, record("stopped"))
+		immediate = After(-time.Millisecond, record("immediate"))
+		late      = After(20*time.Millisecond, record("late"))
+	)
+
+	if got := Pending(); got != 5 {
+		t.Fatalf("expected 5 pending timers; got %d", got)
+	}
+
+	// Stopping the earliest timer re-arms the event source
+	if !stopped.Stop() {
+		t.Fatal("expected timer to be stopped")
+	}
+
+	if stopped.Stop() {
+		t.Fatal("expected Stop to return false for a stopped timer")
+	}
+
+	src.armed = nil
+	specs := []struct {
+		advance  time.Duration
+		expFired []string
+		expArmed time.Duration
+	}{
+		{0, []string{"immediate"}, 2 * time.Millisecond},
+		{2 * time.Millisecond, []string{"periodic"}, 2 * time.Millisecond},
+		{3 * time.Millisecond, []string{"periodic", "early"}, time.Millisecond},
+		// Missed periods are skipped
+		{10 * time.Millisecond, []string{"periodic"}, 2 * time.Millisecond},
+		{2 * time.Millisecond, []string{"periodic"}, 2 * time.Millisecond},
+		{3 * time.Millisecond, []string{"periodic", "late"}, time.Millisecond},
+	}
+
+	for specIndex, spec := range specs {
+		clock += spec.advance
+		fired = nil
+		src.armed = nil
+		Expire()
+
+		if !reflect.DeepEqual(fired, spec.expFired) {
+			t.Errorf("[spec %d] expected timers %v to fire; got %v", specIndex, spec.expFired, fired)
+		}
+
+		if exp := []time.Duration{spec.expArmed}; !reflect.DeepEqual(src.armed, exp) {
+			t.Errorf("[spec %d] expected event source to be armed with %v; got %v", specIndex, exp, src.armed)
+		}
+	}
+
+	if early.Stop() || immediate.Stop() || late.Stop() {
+		t.Fatal("expected Stop to return false for expired one-shot timers")
+	}
+
+	if !periodic.Stop() || Pending() != 0 {
+		t.Fatal("expected the periodic timer to be stopped")
+	}
+
+	// Expire does not arm the event source when no timers are pending
+	src.armed = nil
+	Expire()
+	if len(src.armed) != 0 {
+		t.Fatalf("expected event source not to be armed; got %v", src.armed)
+	}
+
+	// A timer whose expiration is already in the past arms the event
+	// source with a zero delay.
+	var selfStopping *Timer
+	selfStopping = Every(time.Millisecond, func() { selfStopping.Stop() })
+	clock += 5 * time.Millisecond
+	src.armed = nil
+	arm()
+	Expire()
+	if exp := []time.Duration{0}; !reflect.DeepEqual(src.armed, exp) || Pending() != 0 {
+		t.Fatalf("expected event source to be armed with %v and no pending timers; got %v, %d", exp, src.armed, Pending())
+	}
+}
+
+type mockEventSource struct {
+	armed []time.Duration
+}
+
+func (s *mockEventSource) Arm(delay time.Duration) {
+	s.armed = append(s.armed, delay)
+}
+
+func mockInterrupts() {
+	saveAndDisableInterruptsFn = func() uint64 { return 0 }
+	restoreInterruptsFn = func(_ uint64) {}
+}
+
+func resetState() {
+	pending = nil
+	source = nil
+	clockFn = nil
+	saveAndDisableInterruptsFn = cpu.SaveAndDisableInterrupts
+	restoreInterruptsFn = cpu.RestoreInterrupts
+}
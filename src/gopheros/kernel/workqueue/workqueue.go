@@ -0,0 +1,239 @@
+// Package workqueue provides per-CPU queues for deferred work.
+//
+// Interrupt handlers run with interrupts disabled and should therefore
+// return as quickly as possible. Handlers can use the functions in this
+// package to queue the bulk of their processing (the "bottom half") so it
+// runs at a later time with interrupts enabled. Work can also be delayed
+// by a number of timer ticks, e.g. to implement retransmission timeouts.
+//
+// Each CPU processes its own queue by calling Run from a context where
+// blocking is allowed and advances its delayed work by calling Tick from
+// its timer interrupt handler.
+package workqueue
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/mem/percpu"
+)
+
+// Func is a function that performs deferred work. It receives the Work
+// item that triggered its invocation and may queue it again.
+type Func func(*Work)
+
+// workState describes whether a Work item is queued.
+type workState uint8
+
+const (
+	workIdle workState = iota
+	workQueued
+	workDelayed
+)
+
+// Work describes a unit of deferred work. Work items are linked directly
+// into the queues so queueing them does not require any memory
+// allocations and is safe to do from interrupt handlers.
+type Work struct {
+	fn      Func
+	next    *Work
+	state   workState
+	cpu     uint32
+	expires uint64
+}
+
+// New returns a Work item that invokes fn when it runs.
+func New(fn Func) *Work {
+	return &Work{fn: fn}
+}
+
+// Pending returns true if the work item is queued or delayed.
+func (w *Work) Pending() bool {
+	return w.state != workIdle
+}
+
+// queue contains the work items queued on a CPU.
+type queue struct {
+	// The work items that are ready to run in FIFO order.
+	head, tail *Work
+	length     int
+
+	// The delayed work items and the number of ticks processed by the
+	// CPU so far.
+	delayed *Work
+	ticks   uint64
+}
+
+var (
+	queues [percpu.MaxCPUs]queue
+
+	// The following functions are used by tests to mock calls to the
+	// percpu and cpu packages.
+	currentCPUFn               = percpu.CurrentCPU
+	cpuCountFn                 = percpu.CPUCount
+	saveAndDisableInterruptsFn = cpu.SaveAndDisableInterrupts
+	restoreInterruptsFn        = cpu.RestoreInterrupts
+
+	errInvalidCPU = &kernel.Error{Module: "workqueue", Message: "invalid CPU index"}
+)
+
+// Queue appends w to the queue of the current CPU. It returns false if w is
+// already pending.
+func Queue(w *Work) bool {
+	queued, _ := QueueOn(currentCPUFn(), w)
+	return queued
+}
+
+// QueueOn appends w to the queue of the CPU with the supplied index. It
+// returns false if w is already pending.
+func QueueOn(cpuIndex uint32, w *Work) (bool, *kernel.Error) {
+	if cpuIndex >= cpuCountFn() {
+		return false, errInvalidCPU
+	}
+
+	flags := saveAndDisableInterruptsFn()
+	defer restoreInterruptsFn(flags)
+
+	if w.state != workIdle {
+		return false, nil
+	}
+
+	queues[cpuIndex].push(w)
+	w.cpu = cpuIndex
+	return true, nil
+}
+
+// QueueDelayed queues w on the current CPU after the supplied number of
+// timer ticks have elapsed. It returns false if w is already pending.
+func QueueDelayed(w *Work, ticks uint64) bool {
+	if ticks == 0 {
+		return Queue(w)
+	}
+
+	flags := saveAndDisableInterruptsFn()
+	defer restoreInterruptsFn(flags)
+
+	if w.state != workIdle {
+		return false
+	}
+
+	cpuIndex := currentCPUFn()
+	q := &queues[cpuIndex]
+	w.cpu = cpuIndex
+	w.expires = q.ticks + ticks
+	w.state = workDelayed
+	w.next = q.delayed
+	q.delayed = w
+	return true
+}
+
+// Cancel removes w from the queue it is pending on. It returns false if w
+// is not pending; this is also the case if w is currently running.
+func Cancel(w *Work) bool {
+	flags := saveAndDisableInterruptsFn()
+	defer restoreInterruptsFn(flags)
+
+	q := &queues[w.cpu]
+	switch w.state {
+	case workQueued:
+		var prev *Work
+		for cur := q.head; cur != w; prev, cur = cur, cur.next {
+		}
+
+		if prev == nil {
+			q.head = w.next
+		} else {
+			prev.next = w.next
+		}
+		if q.tail == w {
+			q.tail = prev
+		}
+		q.length--
+	case workDelayed:
+		q.delayed = unlink(q.delayed, w)
+	default:
+		return false
+	}
+
+	w.next, w.state = nil, workIdle
+	return true
+}
+
+// Tick advances the tick count of the current CPU and moves any delayed
+// work that has expired to the CPU's queue. It is meant to be invoked by
+// the timer interrupt handler of each CPU.
+func Tick() {
+	flags := saveAndDisableInterruptsFn()
+	defer restoreInterruptsFn(flags)
+
+	q := &queues[currentCPUFn()]
+	q.ticks++
+
+	for w := q.delayed; w != nil; {
+		next := w.next
+		if w.expires <= q.ticks {
+			q.delayed = unlink(q.delayed, w)
+			q.push(w)
+		}
+		w = next
+	}
+}
+
+// Run executes the work queued on the current CPU and returns the number of
+// work items that were executed. Work that is queued while Run is executing
+// is deferred to the next call to Run.
+func Run() int {
+	q := &queues[currentCPUFn()]
+
+	flags := saveAndDisableInterruptsFn()
+	count := q.length
+	restoreInterruptsFn(flags)
+
+	ran := 0
+	for ; ran < count; ran++ {
+		flags = saveAndDisableInterruptsFn()
+		w := q.head
+		if w == nil {
+			// The remaining work was cancelled by a work function
+			restoreInterruptsFn(flags)
+			break
+		}
+		q.head = w.next
+		if q.head == nil {
+			q.tail = nil
+		}
+		q.length--
+		w.next, w.state = nil, workIdle
+		restoreInterruptsFn(flags)
+
+		w.fn(w)
+	}
+
+	return ran
+}
+
+// push appends w to the queue of work items that are ready to run.
+func (q *queue) push(w *Work) {
+	w.next, w.state = nil, workQueued
+	if q.tail == nil {
+		q.head = w
+	} else {
+		q.tail.next = w
+	}
+	q.tail = w
+	q.length++
+}
+
+// unlink removes w from the singly-linked list starting at head and returns
+// the new list head. The list must contain w.
+func unlink(head, w *Work) *Work {
+	if head == w {
+		return w.next
+	}
+
+	prev := head
+	for ; prev.next != w; prev = prev.next {
+	}
+
+	prev.next = w.next
+	return head
+}
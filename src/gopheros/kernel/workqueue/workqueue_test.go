@@ -0,0 +1,211 @@
+package workqueue
+
+import (
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/mem/percpu"
+	"reflect"
+	"testing"
+)
+
+func TestQueueAndRun(t *testing.T) {
+	defer resetState()
+	cpuIndex := mockCPUs(2)
+
+	var ran []string
+	record := func(name string) *Work {
+		return New(func(*Work) { ran = append(ran, name) })
+	}
+
+	var (
+		a = record("a")
+		b = record("b")
+		c = record("c")
+	)
+
+	// Work that requeues itself runs again on the next call to Run
+	var requeue *Work
+	requeue = New(func(w *Work) {
+		ran = append(ran, "requeue")
+		if w != requeue {
+			t.Error("expected work function to receive its work item")
+		}
+		Queue(w)
+	})
+
+	if !Queue(a) || !Queue(requeue) || !Queue(b) {
+		t.Fatal("expected work to be queued")
+	}
+
+	if Queue(a) {
+		t.Fatal("expected Queue to return false for pending work")
+	}
+
+	if !a.Pending() {
+		t.Fatal("expected work to be pending")
+	}
+
+	// Work queued on another CPU does not run on the current one
+	if queued, err := QueueOn(1, c); !queued || err != nil {
+		t.Fatalf("expected work to be queued on CPU 1; got %t, %v", queued, err)
+	}
+
+	if queued, err := QueueOn(2, c); queued || err != errInvalidCPU {
+		t.Fatalf("expected error %v; got %t, %v", errInvalidCPU, queued, err)
+	}
+
+	if got := Run(); got != 3 {
+		t.Fatalf("expected Run to execute 3 work items; got %d", got)
+	}
+
+	if exp := []string{"a", "requeue", "b"}; !reflect.DeepEqual(ran, exp) {
+		t.Fatalf("expected work to run in order %v; got %v", exp, ran)
+	}
+
+	if a.Pending() {
+		t.Fatal("expected work not to be pending after it runs")
+	}
+
+	ran = nil
+	*cpuIndex = 1
+	if got := Run(); got != 1 || !reflect.DeepEqual(ran, []string{"c"}) {
+		t.Fatalf("expected CPU 1 to run its own work; ran %d items: %v", got, ran)
+	}
+
+	ran = nil
+	*cpuIndex = 0
+	Cancel(requeue)
+	if got := Run(); got != 0 || len(ran) != 0 {
+		t.Fatalf("expected no work to run; ran %d items: %v", got, ran)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	defer resetState()
+	mockCPUs(1)
+
+	var ran []string
+	work := make([]*Work, 4)
+	for index, name := range []string{"a", "b", "c", "d"} {
+		name := name
+		work[index] = New(func(*Work) { ran = append(ran, name) })
+		Queue(work[index])
+	}
+
+	// Cancel the head, tail and middle of the queue
+	for _, index := range []int{0, 3, 1} {
+		if !Cancel(work[index]) {
+			t.Fatalf("expected work %d to be cancelled", index)
+		}
+	}
+
+	if Cancel(work[0]) {
+		t.Fatal("expected Cancel to return false for work that is not pending")
+	}
+
+	// Appending after cancelling the tail must keep the queue consistent
+	Queue(work[3])
+	Run()
+
+	if exp := []string{"c", "d"}; !reflect.DeepEqual(ran, exp) {
+		t.Fatalf("expected work to run in order %v; got %v", exp, ran)
+	}
+
+	// Work cancelled by a running work function does not run
+	ran = nil
+	work[2] = New(func(*Work) { ran = append(ran, "canceller"); Cancel(work[3]) })
+	Queue(work[2])
+	Queue(work[3])
+	if got := Run(); got != 1 || !reflect.DeepEqual(ran, []string{"canceller"}) {
+		t.Fatalf("expected only the canceller to run; ran %d items: %v", got, ran)
+	}
+
+	// Cancelling the only queued item empties the queue
+	Queue(work[0])
+	Cancel(work[0])
+	Queue(work[1])
+	ran = nil
+	if Run(); !reflect.DeepEqual(ran, []string{"b"}) {
+		t.Fatalf("expected only work b to run; got %v", ran)
+	}
+}
+
+func TestDelayedWork(t *testing.T) {
+	defer resetState()
+	mockCPUs(1)
+
+	var ran []string
+	record := func(name string) *Work {
+		return New(func(*Work) { ran = append(ran, name) })
+	}
+
+	var (
+		soon      = record("soon")
+		later     = record("later")
+		now       = record("now")
+		cancelled = record("cancelled")
+	)
+
+	// Delayed work is tracked in LIFO order so queue the work that expires
+	// first in the middle of the list.
+	if !QueueDelayed(cancelled, 2) || !QueueDelayed(soon, 1) || !QueueDelayed(later, 3) || !QueueDelayed(now, 0) {
+		t.Fatal("expected work to be queued")
+	}
+
+	if QueueDelayed(later, 1) || QueueDelayed(now, 1) {
+		t.Fatal("expected QueueDelayed to return false for pending work")
+	}
+
+	if Queue(soon) {
+		t.Fatal("expected Queue to return false for delayed work")
+	}
+
+	if !Cancel(cancelled) {
+		t.Fatal("expected delayed work to be cancelled")
+	}
+
+	expRuns := [][]string{
+		{"now", "soon"},
+		nil,
+		{"later"},
+		nil,
+	}
+
+	for tick, exp := range expRuns {
+		Tick()
+		ran = nil
+		Run()
+		if !reflect.DeepEqual(ran, exp) {
+			t.Errorf("[tick %d] expected work %v to run; got %v", tick+1, exp, ran)
+		}
+	}
+}
+
+// mockCPUs mocks the percpu and cpu package functions for the supplied
+// number of CPUs and returns a pointer to the index of the current CPU.
+func mockCPUs(count uint32) *uint32 {
+	var (
+		cpuIndex         uint32
+		interruptsMasked bool
+	)
+
+	currentCPUFn = func() uint32 { return cpuIndex }
+	cpuCountFn = func() uint32 { return count }
+	saveAndDisableInterruptsFn = func() uint64 {
+		if interruptsMasked {
+			panic("nested call to SaveAndDisableInterrupts")
+		}
+		interruptsMasked = true
+		return 0
+	}
+	restoreInterruptsFn = func(_ uint64) { interruptsMasked = false }
+
+	return &cpuIndex
+}
+
+func resetState() {
+	queues = [percpu.MaxCPUs]queue{}
+	currentCPUFn = percpu.CurrentCPU
+	cpuCountFn = percpu.CPUCount
+	saveAndDisableInterruptsFn = cpu.SaveAndDisableInterrupts
+	restoreInterruptsFn = cpu.RestoreInterrupts
+}